@@ -226,6 +226,14 @@ type Rec struct {
 	DefAcs  *types.DefaultAccess `json:"defacs,omitempty"`
 	Public  interface{}          `json:"public,omitempty"`
 	Private interface{}          `json:"private,omitempty"`
+
+	// Parameters to return to the client in response to the request, such as a generated secret.
+	Params map[string]any `json:"-"`
+	// Challenge to return to the client when the update requires another step.
+	Challenge []byte `json:"-"`
+	// Server-side record of a revocable token: the one used to authenticate or the one to issue.
+	// The token authenticator creates a new record if the ID is blank.
+	Login *types.Login `json:"-"`
 }
 
 // AuthHandler is the interface which auth providers must implement.
@@ -249,6 +257,8 @@ type AuthHandler interface {
 	// continue the authentication process to the next step, or return an error code.
 	// The remoteAddr (i.e. the IP address of the client) can be used by custom authenticators for
 	// additional validation. The stock authenticators don't use it.
+	// If the account is known but the secret is wrong, the handler may return a record with just
+	// the Uid together with ErrFailed, so the failure is counted against the account.
 	// store.Users.GetAuthRecord("scheme", "unique")
 	// Returns: user auth record, challenge, error.
 	Authenticate(secret []byte, remoteAddr string) (*Rec, []byte, error)
@@ -234,8 +234,8 @@ func (a *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Re
 
 	err = bcrypt.CompareHashAndPassword(passhash, []byte(password))
 	if err != nil {
-		// Invalid password
-		return nil, nil, types.ErrFailed
+		// Invalid password. Report the user to count the failure against the account.
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
 	}
 
 	var lifetime time.Duration
@@ -114,14 +114,16 @@ func (ca *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.R
 		return nil, nil, types.ErrInternal
 	}
 
+	uid := types.ParseUid(parts[2])
 	if count >= ca.maxRetries {
-		return nil, nil, types.ErrFailed
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
 	}
 
 	if parts[0] != code {
 		// Update count of attempts. If the update fails, the error is ignored.
 		store.PCache.Upsert(key, parts[0]+":"+strconv.Itoa(count+1)+":"+parts[2], false)
-		return nil, nil, types.ErrFailed
+		// Report the user to count the failure against the account.
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
 	}
 
 	// Success. Remove no longer needed entry. The error is ignored here.
@@ -130,7 +132,7 @@ func (ca *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.R
 	}
 
 	return &auth.Rec{
-		Uid:        types.ParseUid(parts[2]),
+		Uid:        uid,
 		AuthLevel:  auth.LevelNone,
 		Lifetime:   auth.Duration(ca.lifetime),
 		Features:   auth.FeatureNoLogin,
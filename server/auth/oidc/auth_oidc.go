@@ -0,0 +1,520 @@
+// Package oidc implements authentication by OpenID Connect ID tokens issued by an external identity provider.
+//
+// The client obtains an ID token from the provider and sends it as the secret of {login scheme="oidc"}.
+// The token signature is verified with the provider's keys (JWKS), the user is identified by a verified
+// claim, "sub" or "email". Unknown users can be optionally registered automatically.
+package oidc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+const (
+	defaultJwksCacheTTL = 3600
+	defaultLeeway       = 60
+	defaultAuthAccess   = "JRWPA"
+	defaultAnonAccess   = "N"
+
+	// Timeout of requests to the identity provider.
+	httpTimeout = 10 * time.Second
+
+	// Length of the hashed unique identifier. The stored value "<auth name>:<hash>" must fit into 32 characters.
+	uniqueLength = 20
+)
+
+// authenticator is the type to map authentication methods to.
+type authenticator struct {
+	name string
+
+	// Expected 'iss' claim.
+	issuer string
+	// Expected 'aud' claim.
+	clientId string
+	// Allowed clock skew.
+	leeway time.Duration
+	// Claim which identifies the user: "sub" or "email".
+	uniqueClaim string
+	// Register unknown users.
+	allowNewAccounts bool
+	// Default access of new accounts.
+	defAcs types.DefaultAccess
+	// Claim name -> tag namespace.
+	tagClaims map[string]string
+
+	keys *keySet
+}
+
+// Init initializes the authenticator.
+func (a *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_oidc: authenticator name cannot be blank")
+	}
+
+	if a.name != "" {
+		return errors.New("auth_oidc: already initialized as " + a.name + "; " + name)
+	}
+
+	if len(name)+1+uniqueLength > 32 {
+		return errors.New("auth_oidc: authenticator name is too long")
+	}
+
+	type configType struct {
+		// Issuer URL, must match the 'iss' claim of ID tokens exactly.
+		Issuer string `json:"issuer"`
+		// Client ID registered with the provider, must be present in the 'aud' claim.
+		ClientId string `json:"client_id"`
+		// URL of the provider's JWKS. If blank, it's discovered from the issuer's OpenID configuration.
+		JwksUrl string `json:"jwks_url"`
+		// Local JWKS file to use instead of fetching the keys.
+		JwksFile string `json:"jwks_file"`
+		// How long to use the fetched keys before fetching them again, seconds.
+		JwksCacheTTL int `json:"jwks_cache_ttl"`
+		// Allowed clock skew when checking token expiration, seconds.
+		Leeway int `json:"leeway"`
+		// Claim which identifies the user: "sub" (default) or "email".
+		UniqueClaim string `json:"unique_claim"`
+		// Register users not seen before.
+		AllowNewAccounts bool `json:"allow_new_accounts"`
+		// Default access mode of new accounts.
+		DefaultAccess struct {
+			Auth string `json:"auth"`
+			Anon string `json:"anon"`
+		} `json:"default_access"`
+		// Claims to add to tags of new accounts: claim name -> tag namespace, e.g. {"email": "email"}.
+		Tags map[string]string `json:"tags"`
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_oidc: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if issuer, err := url.Parse(config.Issuer); err != nil || !issuer.IsAbs() {
+		return errors.New("auth_oidc: invalid issuer '" + config.Issuer + "'")
+	}
+	if config.ClientId == "" {
+		return errors.New("auth_oidc: missing client_id")
+	}
+	switch config.UniqueClaim {
+	case "":
+		config.UniqueClaim = "sub"
+	case "sub", "email":
+	default:
+		return errors.New("auth_oidc: unique_claim must be 'sub' or 'email'")
+	}
+	if config.JwksCacheTTL <= 0 {
+		config.JwksCacheTTL = defaultJwksCacheTTL
+	}
+	if config.Leeway < 0 {
+		return errors.New("auth_oidc: invalid leeway")
+	} else if config.Leeway == 0 {
+		config.Leeway = defaultLeeway
+	}
+	if config.DefaultAccess.Auth == "" {
+		config.DefaultAccess.Auth = defaultAuthAccess
+	}
+	if config.DefaultAccess.Anon == "" {
+		config.DefaultAccess.Anon = defaultAnonAccess
+	}
+	if err := a.defAcs.Auth.UnmarshalText([]byte(config.DefaultAccess.Auth)); err != nil {
+		return errors.New("auth_oidc: invalid default_access.auth: " + err.Error())
+	}
+	if err := a.defAcs.Anon.UnmarshalText([]byte(config.DefaultAccess.Anon)); err != nil {
+		return errors.New("auth_oidc: invalid default_access.anon: " + err.Error())
+	}
+	for claim, ns := range config.Tags {
+		if ns == "" || strings.Contains(ns, ":") {
+			return errors.New("auth_oidc: invalid tag namespace for claim '" + claim + "'")
+		}
+	}
+
+	a.name = name
+	a.issuer = config.Issuer
+	a.clientId = config.ClientId
+	a.leeway = time.Duration(config.Leeway) * time.Second
+	a.uniqueClaim = config.UniqueClaim
+	a.allowNewAccounts = config.AllowNewAccounts
+	a.tagClaims = config.Tags
+	a.keys = &keySet{
+		issuer:  config.Issuer,
+		jwksUrl: config.JwksUrl,
+		file:    config.JwksFile,
+		ttl:     time.Duration(config.JwksCacheTTL) * time.Second,
+		client:  &http.Client{Timeout: httpTimeout},
+	}
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (a *authenticator) IsInitialized() bool {
+	return a.name != ""
+}
+
+// AddRecord links a new account to the identity from the ID token.
+func (a *authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	claims, err := a.verify(secret)
+	if err != nil {
+		return nil, err
+	}
+	unique, value, err := a.unique(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = store.Users.AddAuthRecord(rec.Uid, auth.LevelAuth, a.name, unique, []byte(value), time.Time{}); err != nil {
+		return nil, err
+	}
+
+	rec.AuthLevel = auth.LevelAuth
+	rec.Tags = mergeTags(rec.Tags, a.tags(claims))
+	return rec, nil
+}
+
+// UpdateRecord links an existing account to the identity from the ID token replacing the earlier link.
+func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	claims, err := a.verify(secret)
+	if err != nil {
+		return nil, err
+	}
+	unique, value, err := a.unique(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(a.name, unique)
+	if err != nil {
+		return nil, err
+	}
+	if uid == rec.Uid {
+		// Already linked.
+		return rec, nil
+	}
+	if !uid.IsZero() {
+		// The identity is linked to another account.
+		return nil, types.ErrDuplicate
+	}
+
+	old, _, _, _, err := store.Users.GetAuthRecord(rec.Uid, a.name)
+	if err != nil && err != types.ErrNotFound {
+		return nil, err
+	}
+	if old != "" {
+		err = store.Users.UpdateAuthRecord(rec.Uid, auth.LevelAuth, a.name, unique, []byte(value), time.Time{})
+	} else {
+		err = store.Users.AddAuthRecord(rec.Uid, auth.LevelAuth, a.name, unique, []byte(value), time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rec.Tags = mergeTags(rec.Tags, a.tags(claims))
+	return rec, nil
+}
+
+// Authenticate checks the ID token and finds the linked account. If the account is not found and
+// new accounts are allowed, the account is created with public data and tags taken from the claims.
+func (a *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	claims, err := a.verify(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	unique, value, err := a.unique(claims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uid, authLvl, _, expires, err := store.Users.GetAuthUniqueRecord(a.name, unique)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !uid.IsZero() {
+		if !expires.IsZero() && expires.Before(time.Now()) {
+			return nil, nil, types.ErrExpired
+		}
+		return &auth.Rec{
+			Uid:       uid,
+			AuthLevel: authLvl,
+			State:     types.StateUndefined}, nil, nil
+	}
+
+	if !a.allowNewAccounts {
+		return nil, nil, types.ErrFailed
+	}
+
+	defAcs := a.defAcs
+	rec := &auth.Rec{
+		AuthLevel: auth.LevelAuth,
+		Tags:      a.tags(claims),
+		State:     types.StateOK,
+		DefAcs:    &defAcs,
+		Public:    a.public(claims),
+	}
+	user := types.User{
+		State:  rec.State,
+		Access: defAcs,
+		Public: rec.Public,
+		Tags:   rec.Tags,
+	}
+	if _, err = store.Users.Create(&user, nil); err != nil {
+		return nil, nil, err
+	}
+	rec.Uid = user.Uid()
+
+	if err = store.Users.AddAuthRecord(rec.Uid, rec.AuthLevel, a.name, unique, []byte(value), time.Time{}); err != nil {
+		// Concurrent login could have created the account already.
+		if derr := store.Users.Delete(rec.Uid, true); derr != nil {
+			logs.Warn.Println("oidc: failed to delete incomplete user", rec.Uid, derr)
+		}
+		return nil, nil, err
+	}
+
+	return rec, nil, nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique checks if the identity from the ID token is not linked to any account yet.
+func (a *authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	claims, err := a.verify(secret)
+	if err != nil {
+		return false, err
+	}
+	unique, _, err := a.unique(claims)
+	if err != nil {
+		return false, err
+	}
+
+	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(a.name, unique)
+	if err != nil {
+		return false, err
+	}
+	if !uid.IsZero() {
+		return false, types.ErrDuplicate
+	}
+	return true, nil
+}
+
+// GenSecret is not supported, will produce an error.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// DelRecords deletes saved authentication records of the given user.
+func (a *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, a.name)
+}
+
+// RestrictedTags returns tag namespaces assigned from the claims.
+func (a *authenticator) RestrictedTags() ([]string, error) {
+	var prefixes []string
+	for _, ns := range a.tagClaims {
+		prefixes = append(prefixes, ns)
+	}
+	return prefixes, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for OIDC: the secret is managed by the identity provider).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]interface{}, error) {
+	return nil, nil
+}
+
+const realName = "oidc"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+// verify checks the signature and the standard claims of the ID token, returns all claims.
+func (a *authenticator) verify(token []byte) (map[string]any, error) {
+	parts := bytes.Split(token, []byte{'.'})
+	if len(parts) != 3 {
+		return nil, types.ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, types.ErrMalformed
+	}
+	// Unsigned tokens and tokens signed by symmetric keys are not accepted.
+	switch header.Alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512":
+	default:
+		return nil, types.ErrMalformed
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(string(parts[2]))
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	key, err := a.keys.get(header.Kid)
+	if err != nil {
+		logs.Warn.Println("oidc: no key to verify the token:", err)
+		return nil, types.ErrFailed
+	}
+	if err = verifySignature(header.Alg, key, token[:len(parts[0])+1+len(parts[1])], sig); err != nil {
+		return nil, types.ErrFailed
+	}
+
+	var claims map[string]any
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, types.ErrMalformed
+	}
+
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return nil, types.ErrFailed
+	}
+	if !hasAudience(claims["aud"], a.clientId) {
+		return nil, types.ErrFailed
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, types.ErrMalformed
+	}
+	if now.Add(-a.leeway).After(time.Unix(int64(exp), 0)) {
+		return nil, types.ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, types.ErrFailed
+	}
+
+	return claims, nil
+}
+
+// unique returns the identifier to save in the auth record and the value of the identifying claim.
+// The value is hashed to fit into the database column.
+func (a *authenticator) unique(claims map[string]any) (string, string, error) {
+	value, _ := claims[a.uniqueClaim].(string)
+	if a.uniqueClaim == "email" {
+		if !isTrue(claims["email_verified"]) {
+			return "", "", types.ErrPermissionDenied
+		}
+		value = strings.ToLower(value)
+	}
+	if value == "" {
+		return "", "", types.ErrMalformed
+	}
+	sum := sha256.Sum256([]byte(a.issuer + " " + value))
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:uniqueLength], value, nil
+}
+
+// tags converts claims to tags according to the config. Unverified email is skipped.
+func (a *authenticator) tags(claims map[string]any) []string {
+	var tags []string
+	for claim, ns := range a.tagClaims {
+		if claim == "email" && !isTrue(claims["email_verified"]) {
+			continue
+		}
+		var values []any
+		switch v := claims[claim].(type) {
+		case string:
+			values = []any{v}
+		case []any:
+			values = v
+		}
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				if s = strings.ToLower(strings.TrimSpace(s)); s != "" {
+					tags = append(tags, ns+":"+s)
+				}
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// public makes public data of a new account from the claims.
+func (authenticator) public(claims map[string]any) any {
+	fn, _ := claims["name"].(string)
+	if fn == "" {
+		given, _ := claims["given_name"].(string)
+		family, _ := claims["family_name"].(string)
+		fn = strings.TrimSpace(given + " " + family)
+	}
+	if fn == "" {
+		fn, _ = claims["preferred_username"].(string)
+	}
+	if fn == "" {
+		return nil
+	}
+	return map[string]any{"fn": fn}
+}
+
+func decodeSegment(seg []byte, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(string(seg))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience checks if the 'aud' claim, a string or an array of strings, contains the client ID.
+func hasAudience(aud any, clientId string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientId
+	case []any:
+		for _, a := range v {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTrue checks boolean claim. Some providers send booleans as strings.
+func isTrue(v any) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case string:
+		return b == "true"
+	}
+	return false
+}
+
+// mergeTags appends new tags skipping those already present.
+func mergeTags(tags, extra []string) []string {
+	for _, tag := range extra {
+		found := false
+		for _, t := range tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &authenticator{})
+}
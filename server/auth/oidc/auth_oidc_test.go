@@ -0,0 +1,262 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testClientId = "chat-client"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+// signer signs test tokens with RSA or EC keys published in a JWKS file.
+type signer struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newSigner(t *testing.T) *signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("rsa.GenerateKey:", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("ecdsa.GenerateKey:", err)
+	}
+	return &signer{rsaKey: rsaKey, ecKey: ecKey}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwks returns the JWKS document with public keys of the signer.
+func (s *signer) jwks() []byte {
+	pad := func(n *big.Int) []byte {
+		return n.FillBytes(make([]byte, 32))
+	}
+	doc, _ := json.Marshal(map[string]any{"keys": []jwk{
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(s.rsaKey.N.Bytes()), E: b64(big.NewInt(int64(s.rsaKey.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(pad(s.ecKey.X)), Y: b64(pad(s.ecKey.Y))},
+		// Encryption keys are not used for signatures.
+		{Kty: "RSA", Kid: "enc", Use: "enc", N: b64(s.rsaKey.N.Bytes()), E: "AQAB"},
+	}})
+	return doc
+}
+
+// sign makes a token with the given header and claims.
+func (s *signer) sign(t *testing.T, header map[string]any, claims map[string]any) []byte {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch header["alg"] {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, s.rsaKey, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, ss *big.Int
+		if r, ss, err = ecdsa.Sign(rand.Reader, s.ecKey, digest[:]); err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+		}
+	case "HS256":
+		// Symmetric signature with the public key as the secret.
+		mac := hmac.New(sha256.New, s.rsaKey.N.Bytes())
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal("sign:", err)
+	}
+	return []byte(signed + "." + b64(sig))
+}
+
+// newTestAuthenticator creates an authenticator which reads the keys of the signer from a file.
+func newTestAuthenticator(t *testing.T, s *signer) *authenticator {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, s.jwks(), 0600); err != nil {
+		t.Fatal("WriteFile:", err)
+	}
+	config, _ := json.Marshal(map[string]any{
+		"issuer":    testIssuer,
+		"client_id": testClientId,
+		"jwks_file": path,
+		"leeway":    60,
+	})
+	a := &authenticator{}
+	if err := a.Init(config, "oidc"); err != nil {
+		t.Fatal("Init:", err)
+	}
+	return a
+}
+
+func validClaims() map[string]any {
+	now := time.Now().Unix()
+	return map[string]any{
+		"iss": testIssuer,
+		"aud": testClientId,
+		"sub": "alice",
+		"iat": now,
+		"exp": now + 600,
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := newSigner(t)
+	a := newTestAuthenticator(t, s)
+
+	for _, header := range []map[string]any{
+		{"alg": "RS256", "kid": "rsa"},
+		{"alg": "PS256", "kid": "rsa"},
+		{"alg": "ES256", "kid": "ec"},
+	} {
+		claims, err := a.verify(s.sign(t, header, validClaims()))
+		if err != nil || claims["sub"] != "alice" {
+			t.Errorf("%v: valid token is rejected: %v", header, err)
+		}
+	}
+
+	// The audience may be an array.
+	claims := validClaims()
+	claims["aud"] = []string{"other-client", testClientId}
+	if _, err := a.verify(s.sign(t, map[string]any{"alg": "RS256", "kid": "rsa"}, claims)); err != nil {
+		t.Error("Token with array audience is rejected:", err)
+	}
+	// Expiration within the leeway.
+	claims = validClaims()
+	claims["exp"] = time.Now().Unix() - 30
+	if _, err := a.verify(s.sign(t, map[string]any{"alg": "RS256", "kid": "rsa"}, claims)); err != nil {
+		t.Error("Token expired within leeway is rejected:", err)
+	}
+}
+
+func TestVerifyAlgorithm(t *testing.T) {
+	s := newSigner(t)
+	a := newTestAuthenticator(t, s)
+
+	valid := string(s.sign(t, map[string]any{"alg": "RS256", "kid": "rsa"}, validClaims()))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"unsigned", b64([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", types.ErrMalformed},
+		{"unsigned with signature", b64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + parts[1] + "." + parts[2],
+			types.ErrMalformed},
+		{"HMAC", string(s.sign(t, map[string]any{"alg": "HS256", "kid": "rsa"}, validClaims())), types.ErrMalformed},
+		{"algorithm mismatch", b64([]byte(`{"alg":"ES256","kid":"rsa"}`)) + "." + parts[1] + "." + parts[2],
+			types.ErrFailed},
+		{"wrong key", string(s.sign(t, map[string]any{"alg": "ES256", "kid": "rsa"}, validClaims())), types.ErrFailed},
+		{"unknown key", string(s.sign(t, map[string]any{"alg": "RS256", "kid": "other"}, validClaims())),
+			types.ErrFailed},
+		{"ambiguous key", string(s.sign(t, map[string]any{"alg": "RS256"}, validClaims())), types.ErrFailed},
+		{"encryption key", string(s.sign(t, map[string]any{"alg": "RS256", "kid": "enc"}, validClaims())),
+			types.ErrFailed},
+		{"tampered claims", parts[0] + "." + b64([]byte(`{"iss":"`+testIssuer+`","aud":"`+testClientId+
+			`","sub":"bob","exp":9999999999}`)) + "." + parts[2], types.ErrFailed},
+		{"two parts", parts[0] + "." + parts[1], types.ErrMalformed},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!", types.ErrMalformed},
+		{"bad header", "e30." + parts[1] + "." + parts[2], types.ErrMalformed},
+	}
+	for _, test := range tests {
+		if _, err := a.verify([]byte(test.token)); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	s := newSigner(t)
+	a := newTestAuthenticator(t, s)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name  string
+		claim string
+		value any
+		err   error
+	}{
+		{"wrong issuer", "iss", "https://evil.example.com", types.ErrFailed},
+		{"issuer with slash", "iss", testIssuer + "/", types.ErrFailed},
+		{"missing issuer", "iss", nil, types.ErrFailed},
+		{"wrong audience", "aud", "other-client", types.ErrFailed},
+		{"audience array without client", "aud", []string{"a", "b"}, types.ErrFailed},
+		{"missing audience", "aud", nil, types.ErrFailed},
+		{"expired", "exp", now - 120, types.ErrExpired},
+		{"missing expiration", "exp", nil, types.ErrMalformed},
+		{"expiration as string", "exp", "9999999999", types.ErrMalformed},
+		{"not yet valid", "nbf", now + 120, types.ErrFailed},
+		{"valid soon", "nbf", now + 30, nil},
+	}
+	for _, test := range tests {
+		claims := validClaims()
+		if test.value == nil {
+			delete(claims, test.claim)
+		} else {
+			claims[test.claim] = test.value
+		}
+		token := s.sign(t, map[string]any{"alg": "ES256", "kid": "ec"}, claims)
+		if _, err := a.verify(token); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	a := &authenticator{issuer: testIssuer, uniqueClaim: "email"}
+
+	if _, _, err := a.unique(map[string]any{"email": "alice@example.com"}); err != types.ErrPermissionDenied {
+		t.Error("Unverified email: expected ErrPermissionDenied, got", err)
+	}
+	first, value, err := a.unique(map[string]any{"email": "Alice@Example.com", "email_verified": "true"})
+	if err != nil || value != "alice@example.com" || len(first) != uniqueLength {
+		t.Fatal("Verified email:", first, value, err)
+	}
+	second, _, _ := a.unique(map[string]any{"email": "alice@example.com", "email_verified": true})
+	if first != second {
+		t.Error("Email case changes the identifier")
+	}
+
+	// The same subject at another issuer is a different user.
+	a.uniqueClaim = "sub"
+	fromOne, _, _ := a.unique(map[string]any{"sub": "alice"})
+	a.issuer = "https://other.example.com"
+	if fromOther, _, _ := a.unique(map[string]any{"sub": "alice"}); fromOne == fromOther {
+		t.Error("Identifiers of different issuers are the same")
+	}
+	if _, _, err := a.unique(map[string]any{}); err != types.ErrMalformed {
+		t.Error("Missing subject: expected ErrMalformed, got", err)
+	}
+}
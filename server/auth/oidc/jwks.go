@@ -0,0 +1,315 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+)
+
+const (
+	// Keys are not fetched more often than this when an unknown key ID is seen.
+	minRefreshInterval = time.Minute
+	// Maximum size of a JWKS or discovery document.
+	maxDocumentSize = 1 << 20
+)
+
+// keySet is a cached set of issuer's signing keys.
+type keySet struct {
+	mu sync.Mutex
+
+	// Issuer URL used to discover the JWKS URL if jwksUrl is not set.
+	issuer string
+	// URL of the JWKS document.
+	jwksUrl string
+	// Path to the local JWKS file. If set, the URL is not used.
+	file string
+	// How long the fetched keys are used before fetching them again.
+	ttl    time.Duration
+	client *http.Client
+
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// Closed when the refresh in progress completes, nil if there is none.
+	pending chan struct{}
+}
+
+// JSON Web Key, RFC 7517. Only public RSA and EC keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// get returns the key with the given ID. The key ID may be blank if the set contains a single key.
+func (ks *keySet) get(kid string) (crypto.PublicKey, error) {
+	key, loaded, fetched := ks.lookup(kid)
+
+	if !loaded || time.Since(fetched) > ks.ttl {
+		if err := ks.refresh(fetched); err != nil {
+			if !loaded {
+				return nil, err
+			}
+			// Keep using the keys fetched earlier.
+			logs.Warn.Println("oidc: failed to refresh JWKS:", err)
+		}
+		key, _, fetched = ks.lookup(kid)
+	}
+
+	if key == nil && time.Since(fetched) > minRefreshInterval {
+		// The issuer may have rotated the keys.
+		if err := ks.refresh(fetched); err != nil {
+			logs.Warn.Println("oidc: failed to refresh JWKS:", err)
+		}
+		key, _, _ = ks.lookup(kid)
+	}
+	if key == nil {
+		return nil, errors.New("unknown key '" + kid + "'")
+	}
+	return key, nil
+}
+
+// lookup finds the key in the cached set. Also returns if the keys are loaded and when they were fetched.
+func (ks *keySet) lookup(kid string) (crypto.PublicKey, bool, time.Time) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true, ks.fetched
+		}
+	}
+	return ks.keys[kid], ks.keys != nil, ks.fetched
+}
+
+// refresh replaces cached keys with the keys loaded from the file or fetched from the issuer. The lock
+// is not held while the keys are loaded so the cached keys can be used meanwhile. If the keys were
+// refreshed since 'seen' or are being refreshed by another caller, waits for that refresh instead.
+func (ks *keySet) refresh(seen time.Time) error {
+	ks.mu.Lock()
+	if !ks.fetched.Equal(seen) {
+		pending := ks.pending
+		ks.mu.Unlock()
+		if pending != nil {
+			<-pending
+		}
+		return nil
+	}
+	// Don't hammer the issuer if it's failing.
+	ks.fetched = time.Now()
+	done := make(chan struct{})
+	ks.pending = done
+	jwksUrl := ks.jwksUrl
+	ks.mu.Unlock()
+
+	keys, jwksUrl, err := ks.load(jwksUrl)
+
+	ks.mu.Lock()
+	if err == nil {
+		ks.keys = keys
+	}
+	ks.jwksUrl = jwksUrl
+	ks.pending = nil
+	ks.mu.Unlock()
+	close(done)
+
+	return err
+}
+
+// load reads keys from the file or fetches them from the issuer. The JWKS URL is discovered if it's blank.
+// Returns the keys and the JWKS URL.
+func (ks *keySet) load(jwksUrl string) (map[string]crypto.PublicKey, string, error) {
+	var data []byte
+	var err error
+	if ks.file != "" {
+		data, err = os.ReadFile(ks.file)
+	} else {
+		if jwksUrl == "" {
+			if jwksUrl, err = ks.discover(); err != nil {
+				return nil, "", err
+			}
+		}
+		data, err = ks.fetch(jwksUrl)
+	}
+	if err != nil {
+		return nil, jwksUrl, err
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, jwksUrl, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for i := range doc.Keys {
+		k := &doc.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logs.Warn.Printf("oidc: skipped invalid key '%s': %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, jwksUrl, errors.New("no usable keys in JWKS")
+	}
+	return keys, jwksUrl, nil
+}
+
+// discover reads the JWKS URL from the issuer's OpenID configuration.
+func (ks *keySet) discover() (string, error) {
+	data, err := ks.fetch(strings.TrimSuffix(ks.issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		JwksUri string `json:"jwks_uri"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return "", err
+	}
+	if config.JwksUri == "" {
+		return "", errors.New("missing jwks_uri in OpenID configuration")
+	}
+	return config.JwksUri, nil
+}
+
+func (ks *keySet) fetch(url string) ([]byte, error) {
+	resp, err := ks.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected HTTP response " + resp.Status + " from " + url)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize))
+}
+
+// publicKey converts JWK to RSA or ECDSA public key.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+func decodeBigInt(val string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// verifySignature checks signature of the signed JWT content with the key according to the algorithm.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return errors.New("unsupported algorithm " + alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errors.New("unsupported algorithm " + alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm " + alg)
+		}
+		if alg[0] == 'R' {
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		}
+		return rsa.VerifyPSS(pub, hash, digest, sig, nil)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm " + alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature size")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported algorithm " + alg)
+}
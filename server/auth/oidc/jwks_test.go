@@ -0,0 +1,148 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJwkPublicKey(t *testing.T) {
+	s := newSigner(t)
+	ecX, ecY := b64(s.ecKey.X.FillBytes(make([]byte, 32))), b64(s.ecKey.Y.FillBytes(make([]byte, 32)))
+
+	key, err := (&jwk{Kty: "RSA", N: b64(s.rsaKey.N.Bytes()), E: "AQAB"}).publicKey()
+	if pub, ok := key.(*rsa.PublicKey); err != nil || !ok || pub.N.Cmp(s.rsaKey.N) != 0 || pub.E != 65537 {
+		t.Error("RSA key:", key, err)
+	}
+	key, err = (&jwk{Kty: "EC", Crv: "P-256", X: ecX, Y: ecY}).publicKey()
+	if pub, ok := key.(*ecdsa.PublicKey); err != nil || !ok || !pub.Equal(&s.ecKey.PublicKey) {
+		t.Error("EC key:", key, err)
+	}
+
+	invalid := map[string]*jwk{
+		"symmetric key":        {Kty: "oct"},
+		"missing modulus":      {Kty: "RSA", E: "AQAB"},
+		"bad modulus encoding": {Kty: "RSA", N: "***", E: "AQAB"},
+		"huge exponent":        {Kty: "RSA", N: b64(s.rsaKey.N.Bytes()), E: b64([]byte{1, 0, 0, 0, 0})},
+		"unsupported curve":    {Kty: "EC", Crv: "secp256k1", X: ecX, Y: ecY},
+		"point not on curve":   {Kty: "EC", Crv: "P-256", X: ecX, Y: ecX},
+		"curve size mismatch":  {Kty: "EC", Crv: "P-384", X: ecX, Y: ecY},
+		"missing coordinate":   {Kty: "EC", Crv: "P-256", X: ecX},
+	}
+	for name, k := range invalid {
+		if key, err := k.publicKey(); err == nil {
+			t.Errorf("%s: expected error, got %v", name, key)
+		}
+	}
+}
+
+// Invalid keys are skipped, the set must contain at least one usable key.
+func TestKeySetLoad(t *testing.T) {
+	s := newSigner(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	ks := &keySet{file: path, ttl: time.Hour}
+
+	docs := map[string]string{
+		"missing file":   "",
+		"malformed JSON": `{"keys": [`,
+		"no keys":        `{"keys": []}`,
+		"only invalid":   `{"keys": [{"kty": "oct", "kid": "a"}, {"kty": "RSA", "kid": "b", "use": "enc"}]}`,
+	}
+	for name, doc := range docs {
+		os.Remove(path)
+		if doc != "" {
+			if err := os.WriteFile(path, []byte(doc), 0600); err != nil {
+				t.Fatal("WriteFile:", err)
+			}
+		}
+		if keys, _, err := ks.load(""); err == nil {
+			t.Errorf("%s: expected error, got %v", name, keys)
+		}
+	}
+
+	if err := os.WriteFile(path, s.jwks(), 0600); err != nil {
+		t.Fatal("WriteFile:", err)
+	}
+	keys, _, err := ks.load("")
+	if err != nil || len(keys) != 2 || keys["rsa"] == nil || keys["ec"] == nil {
+		t.Error("Valid JWKS:", keys, err)
+	}
+}
+
+// Keys are discovered from the issuer and fetched again when an unknown key is seen. The cached keys
+// are used while the keys are being fetched.
+func TestKeySetFetch(t *testing.T) {
+	s := newSigner(t)
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			w.Write([]byte(`{"jwks_uri": "` + server.URL + `/jwks"}`))
+		case "/jwks":
+			if fetches.Add(1) > 1 {
+				<-release
+			}
+			w.Write(s.jwks())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ks := &keySet{issuer: server.URL + "/", ttl: time.Hour, client: server.Client()}
+	if key, err := ks.get("rsa"); err != nil || key == nil {
+		t.Fatal("get:", key, err)
+	}
+	if !strings.HasSuffix(ks.jwksUrl, "/jwks") {
+		t.Error("JWKS URL is not discovered:", ks.jwksUrl)
+	}
+	// Unknown key does not cause a fetch too soon.
+	if _, err := ks.get("other"); err == nil || fetches.Load() != 1 {
+		t.Error("Unknown key:", err, fetches.Load())
+	}
+
+	// Fetch for an unknown key hangs.
+	ks.mu.Lock()
+	ks.fetched = ks.fetched.Add(-2 * minRefreshInterval)
+	ks.mu.Unlock()
+	done := make(chan error)
+	go func() {
+		_, err := ks.get("other")
+		done <- err
+	}()
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Known keys are available meanwhile.
+	lookup := make(chan error)
+	go func() {
+		_, err := ks.get("ec")
+		lookup <- err
+	}()
+	select {
+	case err := <-lookup:
+		if err != nil {
+			t.Error("get during refresh:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("get is blocked by refresh")
+	}
+
+	close(release)
+	if err := <-done; err == nil {
+		t.Error("Unknown key after refresh: expected error")
+	}
+	if fetches.Load() != 2 {
+		t.Error("Expected 2 fetches, got", fetches.Load())
+	}
+}
@@ -0,0 +1,741 @@
+// Package passkey implements authentication by WebAuthn public key credentials (passkeys).
+//
+// An account owner registers an authenticator by sending {acc scheme="passkey"} requests:
+//
+//	secret="" starts registration, the server responds with a challenge which contains JSON-formatted
+//	  PublicKeyCredentialCreationOptions to pass to navigator.credentials.create();
+//	secret="<JSON>" completes registration. The JSON object contains base64url-encoded fields "id",
+//	  "clientDataJSON", "attestationObject" of the created credential and an optional "name" of the
+//	  authenticator. The response contains the "id" of the saved key;
+//	secret="list" returns the list of registered keys;
+//	secret="delete:<id>" revokes the key with the given id.
+//
+// The login is performed in two steps. First {login scheme="passkey" secret=""} is answered with a challenge
+// which contains JSON-formatted PublicKeyCredentialRequestOptions to pass to navigator.credentials.get().
+// Then {login scheme="passkey" secret="<JSON>"} completes the login with the JSON object containing
+// base64url-encoded "id", "clientDataJSON", "authenticatorData" and "signature" of the assertion.
+//
+// Only ES256 and EdDSA keys are accepted. Attestation statements are not verified.
+package passkey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Defaults used when the config value is not set.
+const (
+	defaultRpName           = "Tinode"
+	defaultUserVerification = "preferred"
+	defaultChallengeTTL     = 300
+	defaultMaxKeys          = 8
+
+	// Each key is saved under its own scheme name <name>#<id>: there could be only one
+	// auth record per user per scheme. Unique identifiers of all keys are <name>:<hash>.
+	maxMaxKeys = 20
+	// Length of the credential ID hash used as a unique auth record identifier.
+	uniqueLength = 20
+	// Maximum length of the authenticator name in bytes.
+	maxNameLength = 32
+	// Maximum length of the auth record secret.
+	maxSecretLength = 255
+
+	// COSE algorithm identifiers.
+	algES256 = -7
+	algEdDSA = -8
+
+	// Authenticator data flags.
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+
+	// Persistent cache key prefixes: pending registrations and pending logins.
+	registrationPrefix = "pkreg_"
+	loginPrefix        = "pklog_"
+)
+
+// authenticator is a singleton instance of the authenticator.
+type authenticator struct {
+	name             string
+	rpId             string
+	rpName           string
+	origins          []string
+	userVerification string
+	challengeTTL     time.Duration
+	maxKeys          int
+}
+
+// record is a public key saved to the database.
+type record struct {
+	// Key id, the number in the scheme name.
+	Id int `json:"id"`
+	// COSE algorithm of the key.
+	Alg int `json:"alg"`
+	// Uncompressed EC point or Ed25519 public key.
+	Key []byte `json:"key"`
+	// The last seen signature counter.
+	Count     uint32    `json:"cnt,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created"`
+}
+
+// challenge is a pending registration or login.
+type challenge struct {
+	// The user registering a key; blank for logins.
+	Uid       string    `json:"uid,omitempty"`
+	CreatedAt time.Time `json:"created"`
+}
+
+// Collected client data, https://www.w3.org/TR/webauthn-2/#dictionary-client-data
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// Parsed authenticator data, https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+type authData struct {
+	rpIdHash []byte
+	flags    byte
+	count    uint32
+	// Attested credential data.
+	credId []byte
+	pubKey map[any]any
+}
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (a *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_passkey: authenticator name cannot be blank")
+	}
+
+	if a.name != "" {
+		return errors.New("auth_passkey: already initialized as " + a.name + "; " + name)
+	}
+
+	type configType struct {
+		// Relying party ID: the domain of the web app, like "example.com".
+		RpId string `json:"rp_id"`
+		// Name of the service shown by authenticators.
+		RpName string `json:"rp_name"`
+		// Origins of the web apps allowed to use the keys, like "https://web.example.com".
+		Origins []string `json:"origins"`
+		// User verification requirement: "required", "preferred" or "discouraged".
+		UserVerification string `json:"user_verification"`
+		// Time to complete registration or login in seconds.
+		ChallengeTTL int `json:"challenge_ttl"`
+		// Maximum number of keys per user.
+		MaxKeys int `json:"max_keys"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_passkey: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.RpId == "" {
+		return errors.New("auth_passkey: rp_id is required")
+	}
+	if config.RpName == "" {
+		config.RpName = defaultRpName
+	}
+	if len(config.Origins) == 0 {
+		config.Origins = []string{"https://" + config.RpId}
+	}
+	switch config.UserVerification {
+	case "":
+		config.UserVerification = defaultUserVerification
+	case "required", "preferred", "discouraged":
+	default:
+		return errors.New("auth_passkey: invalid user_verification '" + config.UserVerification + "'")
+	}
+	if config.ChallengeTTL <= 0 {
+		config.ChallengeTTL = defaultChallengeTTL
+	}
+	if config.MaxKeys <= 0 {
+		config.MaxKeys = defaultMaxKeys
+	} else if config.MaxKeys > maxMaxKeys {
+		return errors.New("auth_passkey: max_keys is too large")
+	}
+	// Scheme is limited to 16 characters, unique to 32: <name>:<hash>.
+	if scheme := name + "#" + strconv.Itoa(config.MaxKeys); len(scheme) > 16 || len(scheme)+1+uniqueLength > 32 {
+		return errors.New("auth_passkey: authenticator name is too long")
+	}
+
+	a.name = name
+	a.rpId = config.RpId
+	a.rpName = config.RpName
+	a.origins = config.Origins
+	a.userVerification = config.UserVerification
+	a.challengeTTL = time.Duration(config.ChallengeTTL) * time.Second
+	a.maxKeys = config.MaxKeys
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (a *authenticator) IsInitialized() bool {
+	return a.name != ""
+}
+
+// AddRecord is not supported: a key can be registered only to an existing account.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord registers, lists or revokes keys depending on the secret, see package description.
+func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	cmd := string(secret)
+	switch {
+	case cmd == "":
+		return a.startRegistration(rec)
+	case cmd == "list":
+		keys, err := a.getRecords(rec.Uid)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]map[string]any, 0, len(keys))
+		for id := 1; id <= a.maxKeys; id++ {
+			if key := keys[id]; key != nil {
+				list = append(list, map[string]any{"id": id, "name": key.Name, "created": key.CreatedAt})
+			}
+		}
+		rec.Params = map[string]any{"keys": list}
+		return rec, nil
+	case strings.HasPrefix(cmd, "delete:"):
+		id, err := strconv.Atoi(strings.TrimPrefix(cmd, "delete:"))
+		if err != nil || id < 1 || id > a.maxKeys {
+			return nil, types.ErrMalformed
+		}
+		if _, _, err = a.getRecord(rec.Uid, id); err != nil {
+			return nil, err
+		}
+		if err = store.Users.DelAuthRecords(rec.Uid, a.scheme(id)); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+	return a.finishRegistration(rec, secret)
+}
+
+// startRegistration issues a challenge for creating a new key.
+func (a *authenticator) startRegistration(rec *auth.Rec) (*auth.Rec, error) {
+	keys, err := a.getRecords(rec.Uid)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) >= a.maxKeys {
+		return nil, types.ErrPolicy
+	}
+
+	nonce, err := a.newChallenge(registrationPrefix, rec.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	userId := rec.Uid.UserId()
+	options, _ := json.Marshal(map[string]any{
+		"challenge": nonce,
+		"rp":        map[string]any{"id": a.rpId, "name": a.rpName},
+		"user": map[string]any{
+			"id":          base64.RawURLEncoding.EncodeToString([]byte(userId)),
+			"name":        userId,
+			"displayName": userId,
+		},
+		"pubKeyCredParams": []map[string]any{
+			{"type": "public-key", "alg": algES256},
+			{"type": "public-key", "alg": algEdDSA},
+		},
+		"timeout":     a.challengeTTL.Milliseconds(),
+		"attestation": "none",
+		"authenticatorSelection": map[string]any{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   a.userVerification,
+		},
+	})
+	rec.Challenge = options
+	return rec, nil
+}
+
+// finishRegistration verifies the created credential and saves its public key.
+func (a *authenticator) finishRegistration(rec *auth.Rec, secret []byte) (*auth.Rec, error) {
+	var resp struct {
+		Id                string `json:"id"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		Name              string `json:"name"`
+	}
+	if err := json.Unmarshal(secret, &resp); err != nil {
+		return nil, types.ErrMalformed
+	}
+	rawClientData, err := decodeBase64(resp.ClientDataJSON)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	attObject, err := decodeBase64(resp.AttestationObject)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+
+	pending, err := a.checkClientData(rawClientData, "webauthn.create", registrationPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if pending.Uid != rec.Uid.String() {
+		return nil, types.ErrFailed
+	}
+
+	obj, _, err := decodeCbor(attObject)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	m, _ := obj.(map[any]any)
+	rawAuthData, _ := m["authData"].([]byte)
+	data, err := a.checkAuthData(rawAuthData, true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != "" {
+		if id, err := decodeBase64(resp.Id); err != nil || !bytes.Equal(id, data.credId) {
+			return nil, types.ErrMalformed
+		}
+	}
+
+	key := &record{Count: data.count, Name: cleanName(resp.Name), CreatedAt: types.TimeNow()}
+	if key.Alg, key.Key, err = parseCoseKey(data.pubKey); err != nil {
+		return nil, types.ErrUnsupported
+	}
+
+	unique := credentialHash(data.credId)
+	if uid, _, _, err := a.findRecord(unique); err != nil {
+		return nil, err
+	} else if !uid.IsZero() {
+		return nil, types.ErrDuplicate
+	}
+
+	keys, err := a.getRecords(rec.Uid)
+	if err != nil {
+		return nil, err
+	}
+	id := 1
+	for ; id <= a.maxKeys && keys[id] != nil; id++ {
+	}
+	if id > a.maxKeys {
+		return nil, types.ErrPolicy
+	}
+	key.Id = id
+	value, err := json.Marshal(key)
+	if err != nil || len(value) > maxSecretLength {
+		return nil, types.ErrPolicy
+	}
+	err = store.Users.AddSharedAuthRecord(rec.Uid, auth.LevelAuth, a.scheme(id), a.name, unique, value, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	rec.Params = map[string]any{"id": id}
+	return rec, nil
+}
+
+// Authenticate issues a login challenge if the secret is empty, otherwise checks the assertion.
+func (a *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	if len(secret) == 0 {
+		nonce, err := a.newChallenge(loginPrefix, types.ZeroUid)
+		if err != nil {
+			return nil, nil, err
+		}
+		options, _ := json.Marshal(map[string]any{
+			"challenge":        nonce,
+			"rpId":             a.rpId,
+			"timeout":          a.challengeTTL.Milliseconds(),
+			"userVerification": a.userVerification,
+		})
+		return nil, options, nil
+	}
+
+	var resp struct {
+		Id                string `json:"id"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	}
+	if err := json.Unmarshal(secret, &resp); err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+	credId, err := decodeBase64(resp.Id)
+	if err != nil || len(credId) == 0 {
+		return nil, nil, types.ErrMalformed
+	}
+	rawClientData, err := decodeBase64(resp.ClientDataJSON)
+	if err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+	rawAuthData, err := decodeBase64(resp.AuthenticatorData)
+	if err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+	sig, err := decodeBase64(resp.Signature)
+	if err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+
+	if _, err = a.checkClientData(rawClientData, "webauthn.get", loginPrefix); err != nil {
+		return nil, nil, err
+	}
+	data, err := a.checkAuthData(rawAuthData, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	unique := credentialHash(credId)
+	uid, authLvl, key, err := a.findRecord(unique)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uid.IsZero() {
+		// The key was revoked or never registered.
+		return nil, nil, types.ErrFailed
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	if !verifySignature(key, append(rawAuthData, clientDataHash[:]...), sig) {
+		return nil, nil, types.ErrFailed
+	}
+
+	if data.count != 0 || key.Count != 0 {
+		if data.count <= key.Count {
+			// The authenticator may have been cloned.
+			logs.Warn.Println("passkey_auth: signature counter did not increase", uid, key.Id)
+			return nil, nil, types.ErrFailed
+		}
+		key.Count = data.count
+		value, _ := json.Marshal(key)
+		err = store.Users.UpdateSharedAuthRecord(uid, authLvl, a.scheme(key.Id), a.name, unique, value, time.Time{})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &auth.Rec{
+		Uid:       uid,
+		AuthLevel: authLvl,
+		Features:  0,
+		State:     types.StateUndefined}, nil, nil
+}
+
+// GenSecret is not supported, generates an error.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// DelRecords deletes all keys of the given user.
+func (a *authenticator) DelRecords(uid types.Uid) error {
+	for id := 1; id <= a.maxKeys; id++ {
+		if err := store.Users.DelAuthRecords(uid, a.scheme(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for passkey).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for passkey).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]interface{}, error) {
+	return nil, nil
+}
+
+const realName = "passkey"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+// scheme returns the name of the auth record scheme used for the key with the given id.
+func (a *authenticator) scheme(id int) string {
+	return a.name + "#" + strconv.Itoa(id)
+}
+
+// getRecord loads the key with the given id. Returns types.ErrNotFound if the key does not exist.
+func (a *authenticator) getRecord(uid types.Uid, id int) (*record, auth.Level, error) {
+	unique, authLvl, secret, _, err := store.Users.GetAuthRecord(uid, a.scheme(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	if unique == "" {
+		return nil, 0, types.ErrNotFound
+	}
+	var rec record
+	if err = json.Unmarshal(secret, &rec); err != nil {
+		return nil, 0, types.ErrInternal
+	}
+	return &rec, authLvl, nil
+}
+
+// getRecords loads all keys of the user indexed by key id.
+func (a *authenticator) getRecords(uid types.Uid) (map[int]*record, error) {
+	keys := make(map[int]*record)
+	for id := 1; id <= a.maxKeys; id++ {
+		key, _, err := a.getRecord(uid, id)
+		if err == types.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// findRecord finds the key by the hash of the credential ID. Keys are saved under different schemes
+// but share the namespace of unique identifiers, so the key is found by a single lookup.
+// Returns zero uid if the key is not found.
+func (a *authenticator) findRecord(unique string) (types.Uid, auth.Level, *record, error) {
+	uid, authLvl, secret, _, err := store.Users.GetAuthUniqueRecord(a.name, unique)
+	if err != nil || uid.IsZero() {
+		return types.ZeroUid, 0, nil, err
+	}
+	var rec record
+	if err = json.Unmarshal(secret, &rec); err != nil || rec.Id < 1 || rec.Id > maxMaxKeys {
+		return types.ZeroUid, 0, nil, types.ErrInternal
+	}
+	return uid, authLvl, &rec, nil
+}
+
+// newChallenge saves a new pending registration or login. Returns the base64url-encoded challenge.
+func (a *authenticator) newChallenge(prefix string, uid types.Uid) (string, error) {
+	// Run garbage collection.
+	store.PCache.Expire(prefix, time.Now().UTC().Add(-a.challengeTTL))
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", types.ErrInternal
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(buf)
+
+	pending := challenge{CreatedAt: types.TimeNow()}
+	if !uid.IsZero() {
+		pending.Uid = uid.String()
+	}
+	val, _ := json.Marshal(&pending)
+	if err := store.PCache.Upsert(prefix+nonce, string(val), true); err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// checkClientData verifies the type and the origin of the client data and consumes the challenge.
+func (a *authenticator) checkClientData(raw []byte, ceremony, prefix string) (*challenge, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, types.ErrMalformed
+	}
+	if cd.Type != ceremony || cd.Challenge == "" || cd.CrossOrigin {
+		return nil, types.ErrFailed
+	}
+	allowed := false
+	for _, origin := range a.origins {
+		if cd.Origin == origin {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, types.ErrFailed
+	}
+
+	key := prefix + cd.Challenge
+	val, err := store.PCache.Get(key)
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = types.ErrFailed
+		}
+		return nil, err
+	}
+	// The challenge can be used only once.
+	if err = store.PCache.Delete(key); err != nil {
+		logs.Warn.Println("passkey_auth: error deleting key", key, err)
+	}
+
+	var pending challenge
+	if err = json.Unmarshal([]byte(val), &pending); err != nil {
+		return nil, types.ErrInternal
+	}
+	if time.Since(pending.CreatedAt) >= a.challengeTTL {
+		return nil, types.ErrFailed
+	}
+	return &pending, nil
+}
+
+// checkAuthData parses the authenticator data and checks the relying party and the user flags.
+func (a *authenticator) checkAuthData(raw []byte, attested bool) (*authData, error) {
+	data, err := parseAuthData(raw)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	rpIdHash := sha256.Sum256([]byte(a.rpId))
+	if !bytes.Equal(data.rpIdHash, rpIdHash[:]) {
+		return nil, types.ErrFailed
+	}
+	if data.flags&flagUserPresent == 0 {
+		return nil, types.ErrFailed
+	}
+	if a.userVerification == "required" && data.flags&flagUserVerified == 0 {
+		return nil, types.ErrFailed
+	}
+	if attested && data.pubKey == nil {
+		return nil, types.ErrMalformed
+	}
+	return data, nil
+}
+
+// parseAuthData parses binary authenticator data.
+func parseAuthData(raw []byte) (*authData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	data := &authData{
+		rpIdHash: raw[:32],
+		flags:    raw[32],
+		count:    binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if data.flags&flagAttested == 0 {
+		return data, nil
+	}
+
+	// Attested credential data: AAGUID (16), credential ID length (2), credential ID, COSE key.
+	raw = raw[37:]
+	if len(raw) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+	size := int(binary.BigEndian.Uint16(raw[16:18]))
+	raw = raw[18:]
+	if len(raw) < size || size == 0 {
+		return nil, errors.New("invalid credential ID")
+	}
+	data.credId = raw[:size]
+	key, _, err := decodeCbor(raw[size:])
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	if data.pubKey, ok = key.(map[any]any); !ok {
+		return nil, errors.New("invalid credential public key")
+	}
+	return data, nil
+}
+
+// parseCoseKey converts COSE key (RFC 8152) to the algorithm and the key bytes.
+func parseCoseKey(m map[any]any) (int, []byte, error) {
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	switch {
+	case alg == algES256 && kty == 2 && crv == 1:
+		y, _ := m[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("invalid EC key")
+		}
+		if !elliptic.P256().IsOnCurve(new(big.Int).SetBytes(x), new(big.Int).SetBytes(y)) {
+			return 0, nil, errors.New("invalid EC point")
+		}
+		key := append([]byte{4}, x...)
+		return algES256, append(key, y...), nil
+	case alg == algEdDSA && kty == 1 && crv == 6:
+		if len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("invalid Ed25519 key")
+		}
+		return algEdDSA, x, nil
+	}
+	return 0, nil, errors.New("unsupported key")
+}
+
+// verifySignature checks signature of the data with the saved key.
+func verifySignature(key *record, data, sig []byte) bool {
+	switch key.Alg {
+	case algES256:
+		if len(key.Key) != 65 {
+			return false
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(key.Key[1:33]),
+			Y:     new(big.Int).SetBytes(key.Key[33:]),
+		}
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, digest[:], sig)
+	case algEdDSA:
+		if len(key.Key) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(key.Key, data, sig)
+	}
+	return false
+}
+
+// credentialHash converts credential ID of arbitrary length to a unique auth record identifier.
+func credentialHash(credId []byte) string {
+	sum := sha256.Sum256(credId)
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:uniqueLength]
+}
+
+// decodeBase64 decodes base64url-encoded value with or without padding.
+func decodeBase64(val string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(val, "="))
+}
+
+// cleanName removes non-printable characters from the authenticator name and truncates it.
+func cleanName(name string) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, name))
+	for len(name) > maxNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &authenticator{})
+}
@@ -0,0 +1,345 @@
+package passkey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/db/memory"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+const (
+	testRpId   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+// Tests which need the database run against the in-memory adapter.
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	store.RegisterAdapter(memory.GetTestAdapter())
+	config, _ := json.Marshal(map[string]any{
+		"uid_key":     []byte("la6YsO+bNX/+XIkO"),
+		"use_adapter": "memory",
+	})
+	if err := store.Store.Open(1, config); err != nil {
+		logs.Err.Fatal("failed to open store: ", err)
+	}
+	code := m.Run()
+	store.Store.Close()
+	os.Exit(code)
+}
+
+// encodeCbor encodes integers, strings, arrays and maps with integer or string keys.
+func encodeCbor(v any) []byte {
+	head := func(major byte, arg uint64) []byte {
+		switch {
+		case arg < 24:
+			return []byte{major<<5 | byte(arg)}
+		case arg <= 0xff:
+			return []byte{major<<5 | 24, byte(arg)}
+		case arg <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+		}
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	}
+	switch val := v.(type) {
+	case int:
+		if val < 0 {
+			return head(1, uint64(-1-val))
+		}
+		return head(0, uint64(val))
+	case []byte:
+		return append(head(2, uint64(len(val))), val...)
+	case string:
+		return append(head(3, uint64(len(val))), val...)
+	case []any:
+		out := head(4, uint64(len(val)))
+		for _, item := range val {
+			out = append(out, encodeCbor(item)...)
+		}
+		return out
+	case map[any]any:
+		// Sort for deterministic output.
+		var keys [][]byte
+		for k, item := range val {
+			keys = append(keys, append(encodeCbor(k), encodeCbor(item)...))
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		out := head(5, uint64(len(val)))
+		for _, pair := range keys {
+			out = append(out, pair...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
+
+// testKey is an ES256 authenticator holding a single credential.
+type testKey struct {
+	credId []byte
+	priv   *ecdsa.PrivateKey
+	count  uint32
+}
+
+func newTestKey(t *testing.T) *testKey {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("GenerateKey:", err)
+	}
+	credId := make([]byte, 16)
+	rand.Read(credId)
+	return &testKey{credId: credId, priv: priv}
+}
+
+func (k *testKey) coseKey() map[any]any {
+	return map[any]any{
+		1:  2,
+		3:  algES256,
+		-1: 1,
+		-2: k.priv.X.FillBytes(make([]byte, 32)),
+		-3: k.priv.Y.FillBytes(make([]byte, 32)),
+	}
+}
+
+// authData makes authenticator data, with attested credential data if attested is true.
+func (k *testKey) authData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(testRpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	flags := byte(flagUserPresent)
+	if attested {
+		flags |= flagAttested
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, k.count)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(k.credId)))
+		data = append(data, k.credId...)
+		data = append(data, encodeCbor(k.coseKey())...)
+	}
+	return data
+}
+
+func clientDataJSON(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	return data
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// register creates the credential of the key for the user. Returns the key id.
+func (k *testKey) register(t *testing.T, a *authenticator, uid types.Uid) (int, error) {
+	t.Helper()
+	started, err := a.UpdateRecord(&auth.Rec{Uid: uid}, nil, "")
+	if err != nil {
+		t.Fatal("Start registration:", err)
+	}
+	var options struct {
+		Challenge string `json:"challenge"`
+	}
+	if err = json.Unmarshal(started.Challenge, &options); err != nil {
+		t.Fatal("Malformed options:", err)
+	}
+
+	attObject := encodeCbor(map[any]any{"fmt": "none", "attStmt": map[any]any{}, "authData": k.authData(true)})
+	secret, _ := json.Marshal(map[string]string{
+		"id":                b64(k.credId),
+		"clientDataJSON":    b64(clientDataJSON("webauthn.create", options.Challenge)),
+		"attestationObject": b64(attObject),
+		"name":              "Test key\x00",
+	})
+	rec, err := a.UpdateRecord(&auth.Rec{Uid: uid}, secret, "")
+	if err != nil {
+		return 0, err
+	}
+	return rec.Params["id"].(int), nil
+}
+
+// login signs the login challenge with the key.
+func (k *testKey) login(t *testing.T, a *authenticator) (*auth.Rec, error) {
+	t.Helper()
+	_, challenge, err := a.Authenticate(nil, "")
+	if err != nil {
+		t.Fatal("Start login:", err)
+	}
+	var options struct {
+		Challenge string `json:"challenge"`
+	}
+	if err = json.Unmarshal(challenge, &options); err != nil {
+		t.Fatal("Malformed options:", err)
+	}
+
+	k.count++
+	authData := k.authData(false)
+	clientData := clientDataJSON("webauthn.get", options.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, k.priv, digest[:])
+	if err != nil {
+		t.Fatal("Sign:", err)
+	}
+	secret, _ := json.Marshal(map[string]string{
+		"id":                b64(k.credId),
+		"clientDataJSON":    b64(clientData),
+		"authenticatorData": b64(authData),
+		"signature":         b64(sig),
+	})
+	rec, _, err := a.Authenticate(secret, "")
+	return rec, err
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	if err := store.Store.GetAdapter().CreateDb(true); err != nil {
+		t.Fatal("CreateDb:", err)
+	}
+	a := &authenticator{}
+	if err := a.Init(json.RawMessage(`{"rp_id": "`+testRpId+`", "max_keys": 2}`), "passkey"); err != nil {
+		t.Fatal("Init:", err)
+	}
+	user, err := store.Users.Create(&types.User{}, nil)
+	if err != nil {
+		t.Fatal("Users.Create:", err)
+	}
+	uid := user.Uid()
+
+	first, second := newTestKey(t), newTestKey(t)
+	if id, err := first.register(t, a, uid); err != nil || id != 1 {
+		t.Fatal("Register first key:", id, err)
+	}
+	if _, err := first.register(t, a, uid); err != types.ErrDuplicate {
+		t.Error("Register the same key twice:", err)
+	}
+	if id, err := second.register(t, a, uid); err != nil || id != 2 {
+		t.Fatal("Register second key:", id, err)
+	}
+
+	// Both keys are found and the signature counters are saved.
+	for i, key := range []*testKey{first, second, second} {
+		if rec, err := key.login(t, a); err != nil || rec.Uid != uid || rec.AuthLevel != auth.LevelAuth {
+			t.Fatalf("Login %d: %v %v", i, rec, err)
+		}
+	}
+	second.count--
+	if _, err := second.login(t, a); err != types.ErrFailed {
+		t.Error("Login with reused counter:", err)
+	}
+	if _, err := newTestKey(t).login(t, a); err != types.ErrFailed {
+		t.Error("Login with unknown key:", err)
+	}
+
+	listed, err := a.UpdateRecord(&auth.Rec{Uid: uid}, []byte("list"), "")
+	if err != nil {
+		t.Fatal("List:", err)
+	}
+	keys := listed.Params["keys"].([]map[string]any)
+	if len(keys) != 2 || keys[0]["id"] != 1 || keys[0]["name"] != "Test key" || keys[1]["id"] != 2 {
+		t.Error("List:", keys)
+	}
+
+	// Revoked key cannot be used.
+	if _, err = a.UpdateRecord(&auth.Rec{Uid: uid}, []byte("delete:1"), ""); err != nil {
+		t.Fatal("Delete:", err)
+	}
+	if _, err = first.login(t, a); err != types.ErrFailed {
+		t.Error("Login with revoked key:", err)
+	}
+	if _, err = second.login(t, a); err != nil {
+		t.Error("Login with remaining key:", err)
+	}
+}
+
+func TestParseAuthData(t *testing.T) {
+	key := newTestKey(t)
+	key.count = 7
+
+	data, err := parseAuthData(key.authData(false))
+	if err != nil || data.count != 7 || data.flags != flagUserPresent || data.credId != nil || data.pubKey != nil {
+		t.Error("Assertion data:", data, err)
+	}
+	raw := key.authData(true)
+	data, err = parseAuthData(raw)
+	if err != nil || !bytes.Equal(data.credId, key.credId) || data.pubKey == nil {
+		t.Fatal("Attested data:", data, err)
+	}
+
+	// Any truncation of the data is rejected.
+	for i := 0; i < len(raw); i++ {
+		if data, err := parseAuthData(raw[:i]); err == nil {
+			t.Errorf("Truncated to %d bytes: expected error, got %+v", i, data)
+		}
+	}
+
+	credIdAt := 32 + 1 + 4 + 16
+	invalid := map[string]func([]byte){
+		"empty credential ID": func(b []byte) { binary.BigEndian.PutUint16(b[credIdAt:], 0) },
+		"oversized credential ID": func(b []byte) {
+			binary.BigEndian.PutUint16(b[credIdAt:], 0xffff)
+		},
+		"key is not a map": func(b []byte) { b[credIdAt+2+len(key.credId)] = 0x80 },
+	}
+	for name, corrupt := range invalid {
+		b := append([]byte{}, raw...)
+		corrupt(b)
+		if data, err := parseAuthData(b); err == nil {
+			t.Errorf("%s: expected error, got %+v", name, data)
+		}
+	}
+}
+
+func TestParseCoseKey(t *testing.T) {
+	key := newTestKey(t)
+	decode := func(m map[any]any) map[any]any {
+		val, _, err := decodeCbor(encodeCbor(m))
+		if err != nil {
+			t.Fatal("decodeCbor:", err)
+		}
+		return val.(map[any]any)
+	}
+
+	alg, pub, err := parseCoseKey(decode(key.coseKey()))
+	if err != nil || alg != algES256 || len(pub) != 65 || pub[0] != 4 {
+		t.Error("ES256 key:", alg, pub, err)
+	}
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	alg, pub, err = parseCoseKey(decode(map[any]any{1: 1, 3: algEdDSA, -1: 6, -2: []byte(edPub)}))
+	if err != nil || alg != algEdDSA || !bytes.Equal(pub, edPub) {
+		t.Error("EdDSA key:", alg, pub, err)
+	}
+
+	tests := map[string]func(map[any]any){
+		"RS256":             func(m map[any]any) { m[3] = -257 },
+		"wrong key type":    func(m map[any]any) { m[1] = 3 },
+		"wrong curve":       func(m map[any]any) { m[-1] = 2 },
+		"short coordinate":  func(m map[any]any) { m[-2] = make([]byte, 31) },
+		"long coordinate":   func(m map[any]any) { m[-3] = make([]byte, 33) },
+		"missing y":         func(m map[any]any) { delete(m, -3) },
+		"not on curve":      func(m map[any]any) { m[-3] = m[-2] },
+		"coordinate as int": func(m map[any]any) { m[-2] = 1 },
+	}
+	for name, corrupt := range tests {
+		m := key.coseKey()
+		corrupt(m)
+		if alg, pub, err := parseCoseKey(decode(m)); err == nil {
+			t.Errorf("%s: expected error, got %d %x", name, alg, pub)
+		}
+	}
+	if _, _, err = parseCoseKey(decode(map[any]any{1: 1, 3: algEdDSA, -1: 6, -2: make([]byte, 31)})); err == nil {
+		t.Error("Short Ed25519 key: expected error")
+	}
+}
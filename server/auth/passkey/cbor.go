@@ -0,0 +1,118 @@
+package passkey
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Maximum nesting of CBOR arrays and maps.
+const maxCborDepth = 8
+
+var errCbor = errors.New("malformed CBOR")
+
+// decodeCbor decodes a single CBOR item (RFC 8949) and returns it with the remaining bytes. Only the subset
+// used by WebAuthn is supported: integers, byte and text strings, arrays, maps and simple values. Integers
+// are returned as int64, byte strings as []byte, text as string, arrays as []any, maps as map[any]any.
+func decodeCbor(data []byte) (any, []byte, error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCborDepth || len(data) == 0 {
+		return nil, nil, errCbor
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, errCbor
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		// Indefinite lengths are not used by WebAuthn.
+		return nil, nil, errCbor
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCbor
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCbor
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCbor
+		}
+		val := data[:arg]
+		if major == 3 {
+			return string(val), data[arg:], nil
+		}
+		return val, data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCbor
+		}
+		arr := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			var err error
+			if item, data, err = decodeCborItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, item)
+		}
+		return arr, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCbor
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, val any
+			var err error
+			if key, data, err = decodeCborItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCbor
+			}
+			if val, data, err = decodeCborItem(data, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = val
+		}
+		return m, data, nil
+	}
+	// Tags are not used by WebAuthn.
+	return nil, nil, errCbor
+}
@@ -0,0 +1,103 @@
+package passkey
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal("hex:", err)
+	}
+	return data
+}
+
+// Examples from RFC 8949, Appendix A.
+func TestDecodeCbor(t *testing.T) {
+	tests := []struct {
+		data string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3b7fffffffffffffff", int64(-9223372036854775808)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"80", []any{}},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"a0", map[any]any{}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+	}
+	for _, test := range tests {
+		got, rest, err := decodeCbor(mustHex(t, test.data))
+		if err != nil || len(rest) != 0 || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %#v, got %#v, rest %x (%v)", test.data, test.want, got, rest, err)
+		}
+	}
+
+	// The remaining bytes are returned.
+	if got, rest, err := decodeCbor(mustHex(t, "0102")); err != nil || got != int64(1) || !bytes.Equal(rest, []byte{2}) {
+		t.Errorf("Trailing data: got %v, rest %x (%v)", got, rest, err)
+	}
+}
+
+func TestDecodeCborInvalid(t *testing.T) {
+	tests := map[string]string{
+		"empty":                     "",
+		"truncated argument":        "19e8",
+		"truncated 8-byte argument": "1b000000e8d4a510",
+		"truncated bytes":           "440102",
+		"truncated text":            "644945",
+		"truncated array":           "830102",
+		"truncated map key":         "a20102",
+		"truncated map value":       "a2010203",
+		"oversized bytes":           "5bffffffffffffffff00",
+		"oversized text":            "7a7fffffff",
+		"oversized array":           "9bffffffffffffffff",
+		"oversized map":             "ba7fffffff0102",
+		"integer overflow":          "1bffffffffffffffff",
+		"negative overflow":         "3bffffffffffffffff",
+		"indefinite bytes":          "5f4101ff",
+		"indefinite array":          "9f01ff",
+		"reserved argument":         "1c",
+		"tag":                       "c11a514b67b0",
+		"float":                     "f93c00",
+		"undefined simple value":    "f0",
+		"byte string map key":       "a1410102",
+		"array map key":             "a1800102",
+		"too deep":                  "818181818181818181818101",
+	}
+	for name, data := range tests {
+		if got, _, err := decodeCbor(mustHex(t, data)); err == nil {
+			t.Errorf("%s: expected error, got %#v", name, got)
+		}
+	}
+
+	// Every truncation of a valid item is rejected.
+	valid := mustHex(t, "a2616101616282420203a161636474657874")
+	if _, rest, err := decodeCbor(valid); err != nil || len(rest) != 0 {
+		t.Fatal("Valid item:", err, rest)
+	}
+	for i := 0; i < len(valid); i++ {
+		if got, _, err := decodeCbor(valid[:i]); err == nil {
+			t.Errorf("Truncated to %d bytes: expected error, got %#v", i, got)
+		}
+	}
+}
@@ -1,10 +1,16 @@
 // Package token implements authentication by HMAC-signed security token.
+//
+// If tokens are revocable, each token carries an ID of a login record saved on the server. Tokens
+// issued to a session which logged in with a token get the ID of that token. The token is accepted
+// only while the record exists.
 package token
 
 import (
 	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -21,10 +27,18 @@ type authenticator struct {
 	hmacSalt     []byte
 	lifetime     time.Duration
 	serialNumber int
+	revocable    bool
 }
 
+const (
+	// Size of the login ID in revocable tokens.
+	loginIdSize = 8
+)
+
 // tokenLayout defines positioning of various bytes in token.
 // [8:UID][4:expires][2:authLevel][2:serial-number][2:feature-bits][32:signature] = 50 bytes
+// Revocable tokens have the login ID before the signature:
+// [8:UID][4:expires][2:authLevel][2:serial-number][2:feature-bits][8:login-id][32:signature] = 58 bytes
 type tokenLayout struct {
 	// User ID.
 	Uid uint64
@@ -55,6 +69,9 @@ func (ta *authenticator) Init(jsonconf json.RawMessage, name string) error {
 		SerialNum int `json:"serial_num"`
 		// Token expiration time
 		ExpireIn int `json:"expire_in"`
+		// Save tokens on the server so they can be listed and revoked. Tokens issued before
+		// enabling this option are not accepted.
+		Revocable bool `json:"revocable"`
 	}
 	var config configType
 	if err := json.Unmarshal(jsonconf, &config); err != nil {
@@ -72,6 +89,7 @@ func (ta *authenticator) Init(jsonconf json.RawMessage, name string) error {
 	ta.hmacSalt = config.Key
 	ta.lifetime = time.Duration(config.ExpireIn) * time.Second
 	ta.serialNumber = config.SerialNum
+	ta.revocable = config.Revocable
 
 	return nil
 }
@@ -109,6 +127,13 @@ func (ta *authenticator) Authenticate(token []byte, remoteAddr string) (*auth.Re
 	hbuf := new(bytes.Buffer)
 	binary.Write(hbuf, binary.LittleEndian, &tl)
 
+	var loginId []byte
+	if len(token) >= dataSize+loginIdSize+sha256.Size {
+		loginId = token[dataSize : dataSize+loginIdSize]
+		hbuf.Write(loginId)
+		dataSize += loginIdSize
+	}
+
 	// Check signature.
 	hasher := hmac.New(sha256.New, ta.hmacSalt)
 	hasher.Write(hbuf.Bytes())
@@ -132,12 +157,29 @@ func (ta *authenticator) Authenticate(token []byte, remoteAddr string) (*auth.Re
 		return nil, nil, types.ErrExpired
 	}
 
+	var login *types.Login
+	if ta.revocable {
+		if loginId == nil {
+			// The token was issued before tokens became revocable.
+			return nil, nil, types.ErrFailed
+		}
+		login, err = store.Logins.Get(types.Uid(tl.Uid), base64.RawURLEncoding.EncodeToString(loginId))
+		if err != nil {
+			if err == types.ErrNotFound {
+				// The token was revoked.
+				err = types.ErrFailed
+			}
+			return nil, nil, err
+		}
+	}
+
 	return &auth.Rec{
 		Uid:       types.Uid(tl.Uid),
 		AuthLevel: auth.Level(tl.AuthLevel),
 		Lifetime:  auth.Duration(time.Until(expires)),
 		Features:  auth.Feature(tl.Features),
-		State:     types.StateUndefined}, nil, nil
+		State:     types.StateUndefined,
+		Login:     login}, nil, nil
 }
 
 // GenSecret generates a new token.
@@ -159,6 +201,13 @@ func (ta *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
 	}
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, &tl)
+	if ta.revocable {
+		loginId, err := ta.saveLogin(rec, expires)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		buf.Write(loginId)
+	}
 	hasher := hmac.New(sha256.New, ta.hmacSalt)
 	hasher.Write(buf.Bytes())
 	binary.Write(buf, binary.LittleEndian, hasher.Sum(nil))
@@ -176,9 +225,13 @@ func (authenticator) IsUnique(token []byte, remoteAddr string) (bool, error) {
 	return false, types.ErrUnsupported
 }
 
-// DelRecords adds disabled user ID to a stop list.
-func (authenticator) DelRecords(uid types.Uid) error {
-	return nil
+// DelRecords revokes all tokens of the user if tokens are revocable.
+func (ta *authenticator) DelRecords(uid types.Uid) error {
+	if !ta.revocable {
+		return nil
+	}
+	_, err := store.Logins.Delete(uid, nil)
+	return err
 }
 
 // RestrictedTags returns tag namespaces restricted by this authenticator (none for token).
@@ -199,6 +252,38 @@ func (authenticator) GetRealName() string {
 	return realName
 }
 
+// saveLogin creates or updates the login record of a revocable token. Returns the binary login ID.
+func (ta *authenticator) saveLogin(rec *auth.Rec, expires time.Time) ([]byte, error) {
+	login := rec.Login
+	if login == nil {
+		login = &types.Login{}
+	}
+
+	var loginId []byte
+	if login.Id != "" {
+		var err error
+		if loginId, err = base64.RawURLEncoding.DecodeString(login.Id); err != nil || len(loginId) != loginIdSize {
+			return nil, types.ErrMalformed
+		}
+	} else {
+		loginId = make([]byte, loginIdSize)
+		if _, err := rand.Read(loginId); err != nil {
+			return nil, types.ErrInternal
+		}
+		login.Id = base64.RawURLEncoding.EncodeToString(loginId)
+		login.CreatedAt = types.TimeNow()
+	}
+
+	login.NoLogin = rec.Features&auth.FeatureNoLogin != 0
+	login.LastSeen = types.TimeNow()
+	login.Expires = expires
+	if err := store.Logins.Save(rec.Uid, login); err != nil {
+		return nil, err
+	}
+	rec.Login = login
+	return loginId, nil
+}
+
 func init() {
 	store.RegisterAuthScheme(realName, &authenticator{})
 }
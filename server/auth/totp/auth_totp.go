@@ -0,0 +1,525 @@
+// Package totp implements the second authentication factor by time-based one-time passwords (RFC 6238).
+//
+// The authenticator cannot be used to create accounts or to log in by itself. An account owner enrolls
+// by sending {acc scheme="totp"} requests:
+//
+//	secret="" starts enrollment, the response contains the TOTP key and the otpauth:// URI;
+//	secret="<code>" confirms enrollment with the first code, the response contains recovery codes.
+//	  If the account is already enrolled, the recovery codes are replaced with new ones;
+//	secret="delete:<code>" removes the second factor. The code could be a recovery code. It must be
+//	  removed before enrolling a new key.
+//
+// Once enrolled, a login by any other scheme except "token" is answered with a challenge. The login is
+// completed by {login scheme="totp" secret="<challenge>:<code>"} where the code is either the current
+// TOTP code or one of unused recovery codes. Temporary credentials of {acc} are challenged the same way,
+// the request is repeated with tmpscheme="totp" tmpsecret="<challenge>:<code>".
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Defaults used when the config value is not set.
+const (
+	defaultIssuer        = "Tinode"
+	defaultDigits        = 6
+	defaultPeriod        = 30
+	defaultSkew          = 1
+	defaultChallengeTTL  = 300
+	defaultMaxRetries    = 3
+	defaultRecoveryCount = 10
+
+	// Length of the TOTP key in bytes.
+	keyLength = 20
+	// Length of a recovery code in bytes before encoding.
+	recoveryLength = 5
+	// Length of a saved recovery code hash in bytes.
+	recoveryHashLength = 6
+	// Maximum number of recovery codes. The record must fit into 255 bytes of the auth secret.
+	maxRecoveryCount = 16
+
+	// Persistent cache key prefixes: pending logins and pending enrollments.
+	challengePrefix  = "totpch_"
+	enrollmentPrefix = "totpen_"
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// authenticator is a singleton instance of the authenticator.
+type authenticator struct {
+	name          string
+	issuer        string
+	digits        int
+	period        int64
+	skew          int64
+	challengeTTL  time.Duration
+	maxRetries    int
+	recoveryCount int
+}
+
+// record is the authentication secret saved to the database.
+type record struct {
+	// Base32-encoded TOTP key.
+	Key string `json:"key"`
+	// The last accepted time step. Codes cannot be reused.
+	Last int64 `json:"last,omitempty"`
+	// Concatenated truncated SHA-256 hashes of unused recovery codes.
+	Recovery []byte `json:"recovery,omitempty"`
+}
+
+// challenge is a pending login waiting for the second factor.
+type challenge struct {
+	Uid        string         `json:"uid"`
+	AuthLevel  auth.Level     `json:"authlvl"`
+	Lifetime   time.Duration  `json:"lifetime,omitempty"`
+	Features   auth.Feature   `json:"features,omitempty"`
+	Tags       []string       `json:"tags,omitempty"`
+	State      types.ObjState `json:"state"`
+	Credential string         `json:"cred,omitempty"`
+	// Number of failed attempts.
+	Count     int       `json:"count,omitempty"`
+	CreatedAt time.Time `json:"created"`
+}
+
+// enrollment is a TOTP key waiting to be confirmed.
+type enrollment struct {
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created"`
+}
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (ta *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_totp: authenticator name cannot be blank")
+	}
+
+	if ta.name != "" {
+		return errors.New("auth_totp: already initialized as " + ta.name + "; " + name)
+	}
+
+	type configType struct {
+		// Name of the service shown by authenticator apps.
+		Issuer string `json:"issuer"`
+		// Number of digits in a code, 6 to 8.
+		Digits int `json:"digits"`
+		// Lifetime of a code in seconds.
+		Period int `json:"period"`
+		// Number of earlier and later codes which are also accepted to tolerate clock drift.
+		Skew int `json:"skew"`
+		// Time to enter the code in seconds.
+		ChallengeTTL int `json:"challenge_ttl"`
+		// Maximum number of attempts to enter the code per login.
+		MaxRetries int `json:"max_retries"`
+		// Number of recovery codes to generate.
+		RecoveryCodes int `json:"recovery_codes"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_totp: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.Issuer == "" {
+		config.Issuer = defaultIssuer
+	}
+	if config.Digits == 0 {
+		config.Digits = defaultDigits
+	} else if config.Digits < 6 || config.Digits > 8 {
+		return errors.New("auth_totp: invalid number of digits")
+	}
+	if config.Period <= 0 {
+		config.Period = defaultPeriod
+	}
+	if config.Skew < 0 {
+		return errors.New("auth_totp: invalid skew")
+	} else if config.Skew == 0 {
+		config.Skew = defaultSkew
+	}
+	if config.ChallengeTTL <= 0 {
+		config.ChallengeTTL = defaultChallengeTTL
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = defaultMaxRetries
+	}
+	if config.RecoveryCodes <= 0 {
+		config.RecoveryCodes = defaultRecoveryCount
+	} else if config.RecoveryCodes > maxRecoveryCount {
+		return errors.New("auth_totp: too many recovery codes")
+	}
+
+	ta.name = name
+	ta.issuer = config.Issuer
+	ta.digits = config.Digits
+	ta.period = int64(config.Period)
+	ta.skew = int64(config.Skew)
+	ta.challengeTTL = time.Duration(config.ChallengeTTL) * time.Second
+	ta.maxRetries = config.MaxRetries
+	ta.recoveryCount = config.RecoveryCodes
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (ta *authenticator) IsInitialized() bool {
+	return ta.name != ""
+}
+
+// AddRecord is not supported: the second factor cannot be used to create an account.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord enrolls the user, replaces recovery codes or removes the second factor depending on
+// the secret, see package description.
+func (ta *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	code := string(secret)
+	if code == "" {
+		return ta.startEnrollment(rec)
+	}
+
+	if strings.HasPrefix(code, "delete:") {
+		stored, err := ta.getRecord(rec.Uid)
+		if err != nil {
+			return nil, err
+		}
+		if !ta.verify(stored, strings.TrimPrefix(code, "delete:"), time.Now()) {
+			return nil, types.ErrFailed
+		}
+		if err = store.Users.DelAuthRecords(rec.Uid, ta.name); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+
+	// Confirm pending enrollment or replace recovery codes.
+	key := enrollmentPrefix + rec.Uid.String()
+	stored, err := ta.getRecord(rec.Uid)
+	exists := err == nil
+	if err != nil && err != types.ErrNotFound {
+		return nil, err
+	}
+	if !exists {
+		var pending enrollment
+		if val, err := store.PCache.Get(key); err == nil {
+			if err = json.Unmarshal([]byte(val), &pending); err != nil {
+				return nil, types.ErrInternal
+			}
+		} else if err != types.ErrNotFound {
+			return nil, err
+		}
+		if pending.Key == "" || time.Since(pending.CreatedAt) >= ta.challengeTTL {
+			// Enrollment is not started or expired.
+			return nil, types.ErrNotFound
+		}
+		stored = &record{Key: pending.Key}
+	}
+
+	if !ta.verify(stored, code, time.Now()) {
+		return nil, types.ErrFailed
+	}
+
+	codes, err := ta.genRecoveryCodes(stored)
+	if err != nil {
+		return nil, err
+	}
+	if err = ta.saveRecord(rec.Uid, stored, exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err = store.PCache.Delete(key); err != nil {
+			logs.Warn.Println("totp_auth: failed to delete enrollment", rec.Uid, err)
+		}
+	}
+
+	rec.Params = map[string]any{"recovery": codes}
+	return rec, nil
+}
+
+// startEnrollment generates a new TOTP key which must be confirmed by the user.
+func (ta *authenticator) startEnrollment(rec *auth.Rec) (*auth.Rec, error) {
+	// The second factor must be removed before a new key can be enrolled.
+	if _, err := ta.getRecord(rec.Uid); err == nil {
+		return nil, types.ErrDuplicate
+	} else if err != types.ErrNotFound {
+		return nil, err
+	}
+
+	buf := make([]byte, keyLength)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, types.ErrInternal
+	}
+	key := base32NoPad.EncodeToString(buf)
+
+	val, _ := json.Marshal(&enrollment{Key: key, CreatedAt: types.TimeNow()})
+	if err := store.PCache.Upsert(enrollmentPrefix+rec.Uid.String(), string(val), false); err != nil {
+		return nil, err
+	}
+
+	label := url.PathEscape(ta.issuer + ":" + rec.Uid.UserId())
+	query := url.Values{}
+	query.Set("secret", key)
+	query.Set("issuer", ta.issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(ta.digits))
+	query.Set("period", strconv.FormatInt(ta.period, 10))
+
+	rec.Params = map[string]any{
+		"secret": key,
+		"uri":    "otpauth://totp/" + label + "?" + query.Encode(),
+	}
+	return rec, nil
+}
+
+// Authenticate completes the login by checking the code entered in response to the challenge.
+// The secret is structured as <challenge>:<code>.
+func (ta *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	parts := strings.SplitN(string(secret), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, nil, types.ErrMalformed
+	}
+
+	key := challengePrefix + parts[0]
+	val, err := store.PCache.Get(key)
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = types.ErrFailed
+		}
+		return nil, nil, err
+	}
+
+	var pending challenge
+	if err = json.Unmarshal([]byte(val), &pending); err != nil {
+		return nil, nil, types.ErrInternal
+	}
+	uid := types.ParseUid(pending.Uid)
+	if pending.Count >= ta.maxRetries || time.Since(pending.CreatedAt) >= ta.challengeTTL {
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
+	}
+
+	stored, err := ta.getRecord(uid)
+	if err != nil {
+		if err == types.ErrNotFound {
+			// Second factor was removed after the challenge was issued.
+			err = types.ErrFailed
+		}
+		return nil, nil, err
+	}
+
+	if !ta.verify(stored, parts[1], time.Now()) {
+		// Update count of attempts. If the update fails, the error is ignored.
+		pending.Count++
+		val, _ := json.Marshal(&pending)
+		store.PCache.Upsert(key, string(val), false)
+		// Report the user to count the failure against the account.
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
+	}
+
+	// Save the last used time step or the remaining recovery codes.
+	if err = ta.saveRecord(uid, stored, true); err != nil {
+		return nil, nil, err
+	}
+	// Success. Remove no longer needed entry. The error is ignored here.
+	if err = store.PCache.Delete(key); err != nil {
+		logs.Warn.Println("totp_auth: error deleting key", key, err)
+	}
+
+	return &auth.Rec{
+		Uid:        uid,
+		AuthLevel:  pending.AuthLevel,
+		Lifetime:   auth.Duration(pending.Lifetime),
+		Features:   pending.Features,
+		Tags:       pending.Tags,
+		State:      pending.State,
+		Credential: pending.Credential}, nil, nil
+}
+
+// GenSecret issues a login challenge if the user is enrolled. The 'rec' is the result of
+// the first authentication step. Returns nil if the user is not enrolled.
+func (ta *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	if _, err := ta.getRecord(rec.Uid); err != nil {
+		if err == types.ErrNotFound {
+			err = nil
+		}
+		return nil, time.Time{}, err
+	}
+
+	// Run garbage collection.
+	olderThan := time.Now().UTC().Add(-ta.challengeTTL)
+	store.PCache.Expire(challengePrefix, olderThan)
+	store.PCache.Expire(enrollmentPrefix, olderThan)
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, time.Time{}, types.ErrInternal
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(buf)
+
+	now := types.TimeNow()
+	val, _ := json.Marshal(&challenge{
+		Uid:        rec.Uid.String(),
+		AuthLevel:  rec.AuthLevel,
+		Lifetime:   time.Duration(rec.Lifetime),
+		Features:   rec.Features,
+		Tags:       rec.Tags,
+		State:      rec.State,
+		Credential: rec.Credential,
+		CreatedAt:  now,
+	})
+	if err := store.PCache.Upsert(challengePrefix+nonce, string(val), true); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return []byte(nonce), now.Add(ta.challengeTTL), nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// DelRecords deletes saved authentication records of the given user.
+func (ta *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, ta.name)
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for TOTP).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for TOTP).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]interface{}, error) {
+	return nil, nil
+}
+
+const realName = "totp"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+// getRecord loads user's TOTP record. Returns types.ErrNotFound if the user is not enrolled.
+func (ta *authenticator) getRecord(uid types.Uid) (*record, error) {
+	unique, _, secret, _, err := store.Users.GetAuthRecord(uid, ta.name)
+	if err != nil {
+		return nil, err
+	}
+	if unique == "" {
+		return nil, types.ErrNotFound
+	}
+	var rec record
+	if err = json.Unmarshal(secret, &rec); err != nil {
+		return nil, types.ErrInternal
+	}
+	return &rec, nil
+}
+
+// saveRecord creates or updates user's TOTP record.
+func (ta *authenticator) saveRecord(uid types.Uid, rec *record, exists bool) error {
+	secret, err := json.Marshal(rec)
+	if err != nil {
+		return types.ErrInternal
+	}
+	if exists {
+		return store.Users.UpdateAuthRecord(uid, auth.LevelNone, ta.name, uid.UserId(), secret, time.Time{})
+	}
+	return store.Users.AddAuthRecord(uid, auth.LevelNone, ta.name, uid.UserId(), secret, time.Time{})
+}
+
+// genRecoveryCodes replaces recovery codes in the record with new ones. Returns the codes.
+func (ta *authenticator) genRecoveryCodes(rec *record) ([]string, error) {
+	codes := make([]string, ta.recoveryCount)
+	rec.Recovery = make([]byte, 0, ta.recoveryCount*recoveryHashLength)
+	buf := make([]byte, recoveryLength)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, types.ErrInternal
+		}
+		code := strings.ToLower(base32NoPad.EncodeToString(buf))
+		codes[i] = code[:len(code)/2] + "-" + code[len(code)/2:]
+		rec.Recovery = append(rec.Recovery, hashRecoveryCode(code)...)
+	}
+	return codes, nil
+}
+
+// verify checks the code and updates the record: saves the time step of the accepted TOTP code
+// or removes the used recovery code.
+func (ta *authenticator) verify(rec *record, code string, now time.Time) bool {
+	code = strings.TrimSpace(code)
+	if len(code) == ta.digits && strings.Trim(code, "0123456789") == "" {
+		key, err := base32NoPad.DecodeString(rec.Key)
+		if err != nil {
+			return false
+		}
+		step := now.Unix() / ta.period
+		for s := step - ta.skew; s <= step+ta.skew; s++ {
+			if s > rec.Last && subtle.ConstantTimeCompare([]byte(hotp(key, s, ta.digits)), []byte(code)) == 1 {
+				rec.Last = s
+				return true
+			}
+		}
+		return false
+	}
+
+	hash := hashRecoveryCode(code)
+	for i := 0; i+recoveryHashLength <= len(rec.Recovery); i += recoveryHashLength {
+		if subtle.ConstantTimeCompare(rec.Recovery[i:i+recoveryHashLength], hash) == 1 {
+			rec.Recovery = append(rec.Recovery[:i], rec.Recovery[i+recoveryHashLength:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// hotp calculates HOTP value as defined by RFC 4226.
+func hotp(key []byte, counter int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := int64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+	mod := int64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	code := strconv.FormatInt(value%mod, 10)
+	return strings.Repeat("0", digits-len(code)) + code
+}
+
+// hashRecoveryCode normalizes and hashes the recovery code.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return sum[:recoveryHashLength]
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &authenticator{})
+}
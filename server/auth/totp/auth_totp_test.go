@@ -0,0 +1,216 @@
+package totp
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/db/memory"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Tests which need the database run against the in-memory adapter.
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	store.RegisterAdapter(memory.GetTestAdapter())
+	config, _ := json.Marshal(map[string]any{
+		"uid_key":     []byte("la6YsO+bNX/+XIkO"),
+		"use_adapter": "memory",
+	})
+	if err := store.Store.Open(1, config); err != nil {
+		logs.Err.Fatal("failed to open store: ", err)
+	}
+	code := m.Run()
+	store.Store.Close()
+	os.Exit(code)
+}
+
+func newAuthenticator(t *testing.T, conf string) *authenticator {
+	t.Helper()
+	ta := &authenticator{}
+	if err := ta.Init(json.RawMessage(conf), "totp"); err != nil {
+		t.Fatal("Init:", err)
+	}
+	return ta
+}
+
+// enroll creates a user and enrolls it. Returns the user record and recovery codes.
+func enroll(t *testing.T, ta *authenticator) (*auth.Rec, []string) {
+	t.Helper()
+	if err := store.Store.GetAdapter().CreateDb(true); err != nil {
+		t.Fatal("CreateDb:", err)
+	}
+	user, err := store.Users.Create(&types.User{
+		Access: types.DefaultAccess{Auth: types.ModeCAuth, Anon: types.ModeNone},
+	}, nil)
+	if err != nil {
+		t.Fatal("Users.Create:", err)
+	}
+	rec := &auth.Rec{Uid: user.Uid(), AuthLevel: auth.LevelAuth}
+
+	started, err := ta.UpdateRecord(rec, nil, "")
+	if err != nil {
+		t.Fatal("Start enrollment:", err)
+	}
+	key, err := base32NoPad.DecodeString(started.Params["secret"].(string))
+	if err != nil {
+		t.Fatal("Malformed key:", err)
+	}
+
+	code := hotp(key, time.Now().Unix()/ta.period, ta.digits)
+	confirmed, err := ta.UpdateRecord(&auth.Rec{Uid: rec.Uid, AuthLevel: rec.AuthLevel}, []byte(code), "")
+	if err != nil {
+		t.Fatal("Confirm enrollment:", err)
+	}
+	return rec, confirmed.Params["recovery"].([]string)
+}
+
+// Test vectors of RFC 6238, Appendix B, SHA1.
+func TestHotp(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		if got := hotp(key, v.time/30, 8); got != v.code {
+			t.Errorf("T=%d: expected %s, got %s", v.time, v.code, got)
+		}
+	}
+	// Shorter codes are truncated from the left.
+	if got := hotp(key, 59/30, 6); got != "287082" {
+		t.Errorf("6 digits: expected 287082, got %s", got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ta := newAuthenticator(t, `{}`)
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / ta.period
+	rec := &record{Key: base32NoPad.EncodeToString(key)}
+
+	if ta.verify(rec, hotp(key, step+2, ta.digits), now) {
+		t.Error("Code outside of the skew is accepted")
+	}
+	if !ta.verify(rec, " "+hotp(key, step-1, ta.digits)+" ", now) {
+		t.Error("Previous code is rejected")
+	}
+	if !ta.verify(rec, hotp(key, step, ta.digits), now) || rec.Last != step {
+		t.Error("Current code is rejected", rec.Last)
+	}
+	// Codes cannot be reused, earlier codes are rejected after a later one is accepted.
+	if ta.verify(rec, hotp(key, step, ta.digits), now) {
+		t.Error("Code is accepted twice")
+	}
+	if ta.verify(rec, hotp(key, step-1, ta.digits), now) {
+		t.Error("Earlier code is accepted after a later one")
+	}
+
+	// Recovery codes are accepted in any form once.
+	codes, err := ta.genRecoveryCodes(rec)
+	if err != nil || len(codes) != defaultRecoveryCount || len(rec.Recovery) != defaultRecoveryCount*recoveryHashLength {
+		t.Fatal("genRecoveryCodes:", codes, len(rec.Recovery), err)
+	}
+	if !ta.verify(rec, strings.ToUpper(strings.ReplaceAll(codes[3], "-", "")), now) {
+		t.Error("Recovery code is rejected")
+	}
+	if ta.verify(rec, codes[3], now) {
+		t.Error("Recovery code is accepted twice")
+	}
+	if len(rec.Recovery) != (defaultRecoveryCount-1)*recoveryHashLength {
+		t.Error("Used recovery code is not removed", len(rec.Recovery))
+	}
+	for i, code := range codes {
+		if i != 3 && !ta.verify(rec, code, now) {
+			t.Error("Unused recovery code is rejected", i)
+		}
+	}
+	if len(rec.Recovery) != 0 {
+		t.Error("Recovery codes are left", len(rec.Recovery))
+	}
+}
+
+// The record is saved as the auth secret which is limited to 255 bytes.
+func TestRecordLength(t *testing.T) {
+	ta := newAuthenticator(t, `{"recovery_codes": 16}`)
+	rec := &record{Key: base32NoPad.EncodeToString(make([]byte, keyLength)), Last: math.MaxInt64}
+	if _, err := ta.genRecoveryCodes(rec); err != nil {
+		t.Fatal("genRecoveryCodes:", err)
+	}
+	if val, _ := json.Marshal(rec); len(val) > 255 {
+		t.Errorf("Record is too long: %d bytes", len(val))
+	}
+
+	if err := (&authenticator{}).Init(json.RawMessage(`{"recovery_codes": 17}`), "totp"); err == nil {
+		t.Error("More than 16 recovery codes are accepted")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	ta := newAuthenticator(t, `{"max_retries": 2}`)
+	rec, codes := enroll(t, ta)
+
+	challenge, expires, err := ta.GenSecret(rec)
+	if err != nil || len(challenge) == 0 || !expires.After(time.Now()) {
+		t.Fatal("GenSecret:", challenge, expires, err)
+	}
+
+	// Successful response returns the original login and removes the challenge.
+	done, _, err := ta.Authenticate([]byte(string(challenge)+":"+codes[0]), "")
+	if err != nil || done.Uid != rec.Uid || done.AuthLevel != rec.AuthLevel {
+		t.Fatal("Authenticate:", done, err)
+	}
+	if _, _, err = ta.Authenticate([]byte(string(challenge)+":"+codes[1]), ""); err != types.ErrFailed {
+		t.Error("Challenge is accepted twice:", err)
+	}
+	// The used recovery code is saved.
+	if _, err = ta.UpdateRecord(rec, []byte("delete:"+codes[0]), ""); err == nil {
+		t.Error("Recovery code is accepted after use")
+	}
+
+	// The challenge fails after the limit of wrong codes even if the next code is valid.
+	challenge, _, err = ta.GenSecret(rec)
+	if err != nil {
+		t.Fatal("GenSecret:", err)
+	}
+	// Failures report the user, so they are counted against the account.
+	for i := 0; i < 2; i++ {
+		if done, _, err = ta.Authenticate([]byte(string(challenge)+":wrong-code"), ""); err != types.ErrFailed ||
+			done == nil || done.Uid != rec.Uid {
+			t.Error("Wrong code:", done, err)
+		}
+	}
+	if _, _, err = ta.Authenticate([]byte(string(challenge)+":"+codes[1]), ""); err != types.ErrFailed {
+		t.Error("Code is accepted after too many attempts:", err)
+	}
+
+	if _, _, err = ta.Authenticate([]byte(codes[1]), ""); err != types.ErrMalformed {
+		t.Error("Response without challenge:", err)
+	}
+}
+
+// Users who are not enrolled are not challenged.
+func TestChallengeNotEnrolled(t *testing.T) {
+	ta := newAuthenticator(t, `{}`)
+	rec, codes := enroll(t, ta)
+	if _, err := ta.UpdateRecord(rec, []byte("delete:"+codes[0]), ""); err != nil {
+		t.Fatal("Delete:", err)
+	}
+	if challenge, _, err := ta.GenSecret(rec); challenge != nil || err != nil {
+		t.Error("GenSecret for not enrolled user:", challenge, err)
+	}
+}
@@ -0,0 +1,71 @@
+// Package cdc defines events describing changes of persisted objects and an interface which must be
+// implemented by sinks delivering the events to external systems, e.g. analytics or search pipelines.
+package cdc
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds of changed objects.
+const (
+	// User record, identified by User.
+	ObjUser = "user"
+	// Topic record, identified by Topic.
+	ObjTopic = "topic"
+	// Subscription, identified by Topic and User.
+	ObjSub = "sub"
+	// Message, identified by Topic and SeqId. Deletions identify messages by ranges in Data.
+	ObjMessage = "msg"
+	// Reaction to a message, identified by Topic, SeqId and User.
+	ObjReaction = "react"
+	// Record of an uploaded file, identified by Id.
+	ObjFile = "file"
+)
+
+// Operations.
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// Event is a change of a persisted object.
+type Event struct {
+	// Position of the event in the outbox. Offsets increase in the order the events were recorded.
+	Offset string `json:"offset"`
+	// Time of the change.
+	Ts time.Time `json:"ts"`
+	// Kind of the changed object, one of Obj* constants.
+	Object string `json:"obj"`
+	// What was done to the object, one of Op* constants.
+	Op string `json:"op"`
+
+	// Keys of the changed object, see Obj* constants.
+	Id    string `json:"id,omitempty"`
+	Topic string `json:"topic,omitempty"`
+	User  string `json:"user,omitempty"`
+	SeqId int    `json:"seq,omitempty"`
+
+	// The object is deleted permanently.
+	Hard bool `json:"hard,omitempty"`
+	// The created object or the updated fields.
+	Data json.RawMessage `json:"data,omitempty"`
+	// Data is omitted because it's too large: the object should be read from the database.
+	Truncated bool `json:"trunc,omitempty"`
+}
+
+// Sink is an interface which must be implemented by event sinks.
+type Sink interface {
+	// Init initializes the sink.
+	Init(jsconf string) error
+
+	// Close flushes and releases resources used by the sink.
+	Close() error
+
+	// Deliver delivers events in the order given. The events are considered delivered when the call returns
+	// nil. Otherwise the same events are delivered again later. Events may also be delivered again after a
+	// restart, so the receiver must tolerate duplicates, e.g. by skipping offsets it has seen already. Events
+	// recorded late by other cluster nodes may follow events with higher offsets.
+	Deliver(events []Event) error
+}
@@ -0,0 +1,92 @@
+// Package file implements github.com/volvlabs/towncryer-chat-server/server/cdc interface by appending
+// events to a local file as newline-delimited JSON, one event per line.
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/volvlabs/towncryer-chat-server/server/cdc"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+)
+
+const sinkName = "file"
+
+type configType struct {
+	// Path to the file. The file is created if missing and appended to otherwise.
+	Path string `json:"path"`
+}
+
+type sink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// Init checks that the file can be written to.
+func (s *sink) Init(jsconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if config.Path == "" {
+		return errors.New("missing file path")
+	}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0700); err != nil {
+		return err
+	}
+	s.path = config.Path
+
+	f, err := s.open()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Close is a no-op: the file is open only while events are written.
+func (s *sink) Close() error {
+	return nil
+}
+
+// Deliver appends events to the file and flushes it to disk. The file is reopened on every call
+// so it can be rotated by an external tool.
+func (s *sink) Deliver(events []cdc.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range events {
+		if err = enc.Encode(&events[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *sink) open() (*os.File, error) {
+	return os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+func init() {
+	store.RegisterChangeSink(sinkName, &sink{})
+}
@@ -0,0 +1,117 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/cdc"
+)
+
+// readEvents reads all events from the file.
+func readEvents(t *testing.T, path string) []cdc.Event {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer f.Close()
+
+	var events []cdc.Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event cdc.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Malformed line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal("Scan:", err)
+	}
+	return events
+}
+
+func testEvents(offsets ...string) []cdc.Event {
+	var events []cdc.Event
+	for _, offset := range offsets {
+		events = append(events, cdc.Event{
+			Offset: offset,
+			Ts:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Object: cdc.ObjMessage,
+			Op:     cdc.OpCreate,
+			Topic:  "grpTest",
+			SeqId:  1,
+			Data:   json.RawMessage(`{"content":"hello"}`),
+		})
+	}
+	return events
+}
+
+func TestInit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nested", "changes.ndjson")
+
+	s := &sink{}
+	config, _ := json.Marshal(map[string]string{"path": path})
+	if err := s.Init(string(config)); err != nil {
+		t.Fatal("Init:", err)
+	}
+	// The file and its directory are created.
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Error("File is not created:", err)
+	}
+
+	if err := (&sink{}).Init(`{}`); err == nil {
+		t.Error("Init without path: expected error")
+	}
+	if err := (&sink{}).Init(`{"path":`); err == nil {
+		t.Error("Init with malformed config: expected error")
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changes.ndjson")
+	s := &sink{}
+	config, _ := json.Marshal(map[string]string{"path": path})
+	if err := s.Init(string(config)); err != nil {
+		t.Fatal("Init:", err)
+	}
+
+	// Events are appended, one per line.
+	if err := s.Deliver(testEvents("1", "2")); err != nil {
+		t.Fatal("Deliver:", err)
+	}
+	if err := s.Deliver(testEvents("3")); err != nil {
+		t.Fatal("Deliver:", err)
+	}
+	if got, want := readEvents(t, path), testEvents("1", "2", "3"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Events: expected %+v, got %+v", want, got)
+	}
+
+	// The file can be rotated between deliveries.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal("Rename:", err)
+	}
+	if err := s.Deliver(testEvents("4")); err != nil {
+		t.Fatal("Deliver after rotation:", err)
+	}
+	if got, want := readEvents(t, path), testEvents("4"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Events after rotation: expected %+v, got %+v", want, got)
+	}
+
+	// Failure is reported so the events are delivered again.
+	if err := os.Remove(path); err != nil {
+		t.Fatal("Remove:", err)
+	}
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal("Mkdir:", err)
+	}
+	if err := s.Deliver(testEvents("5")); err == nil {
+		t.Error("Deliver to a directory: expected error")
+	}
+}
@@ -147,6 +147,9 @@ type ClusterSess struct {
 	// Session ID
 	Sid string
 
+	// ID of the login with a revocable token
+	LoginId string
+
 	// Background session
 	Background bool
 }
@@ -529,6 +532,7 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 			proxyReq:    msg.ReqType,
 			background:  msg.Sess.Background,
 			uid:         msg.Sess.Uid,
+			loginId:     msg.Sess.LoginId,
 		}
 	}
 
@@ -651,6 +655,12 @@ func (c *Cluster) Route(msg *ClusterRoute, rejected *bool) error {
 
 // UserCacheUpdate endpoint receives updates to user's cached values as well as sends push notifications.
 func (c *Cluster) UserCacheUpdate(msg *UserCacheReq, rejected *bool) error {
+	if len(msg.Logins) > 0 {
+		// Logins are revoked. Evict sessions which use them.
+		globals.sessionStore.EvictLogins(msg.UserId, msg.Logins, msg.SkipSid)
+		return nil
+	}
+
 	if msg.Gone {
 		// User is deleted. Evict all user's sessions.
 		globals.sessionStore.EvictUser(msg.UserId, "")
@@ -732,6 +742,12 @@ func (c *Cluster) routeUserReq(req *UserCacheReq) error {
 		for _, n := range c.nodes {
 			reqByNode[n.name] = r
 		}
+	} else if len(req.Logins) > 0 {
+		// User's sessions could be connected to any node.
+		r := &UserCacheReq{Node: c.thisNodeName, UserId: req.UserId, Logins: req.Logins, SkipSid: req.SkipSid}
+		for _, n := range c.nodes {
+			reqByNode[n.name] = r
+		}
 	}
 
 	if len(reqByNode) > 0 {
@@ -850,6 +866,7 @@ func (c *Cluster) makeClusterReq(reqType ProxyReqType, msg *ClientComMessage, to
 			DeviceID:    sess.deviceID,
 			Platform:    sess.platf,
 			Sid:         sess.sid,
+			LoginId:     sess.loginId,
 			Background:  sess.background,
 		}
 	}
@@ -32,6 +32,16 @@ type MsgGetOpts struct {
 	BeforeId int `json:"before,omitempty"`
 	// Limit the number of messages loaded
 	Limit int `json:"limit,omitempty"`
+	// Load revision history of the message with this ID
+	Hist int `json:"hist,omitempty"`
+	// Load only replies in the thread started by the message with this ID
+	Thread int `json:"thread,omitempty"`
+	// Full-text search query: words which must be present in the message
+	Query string `json:"query,omitempty"`
+	// ID of the message to report delivery and read status for
+	SeqId int `json:"seq,omitempty"`
+	// Return results for users with IDs greater than this one, used for paging
+	After string `json:"after,omitempty"`
 }
 
 // MsgGetQuery is a topic metadata or data query.
@@ -42,10 +52,16 @@ type MsgGetQuery struct {
 	Desc *MsgGetOpts `json:"desc,omitempty"`
 	// Parameters of "sub" request: User, Topic, IfModifiedSince, Limit.
 	Sub *MsgGetOpts `json:"sub,omitempty"`
-	// Parameters of "data" request: Since, Before, Limit.
+	// Parameters of "data" request: Since, Before, Limit, Hist, Thread.
 	Data *MsgGetOpts `json:"data,omitempty"`
 	// Parameters of "del" request: Since, Before, Limit.
 	Del *MsgGetOpts `json:"del,omitempty"`
+	// Parameters of "react" request: Since, Before.
+	React *MsgGetOpts `json:"react,omitempty"`
+	// Parameters of "search" request: Query, Topic, Limit.
+	Search *MsgGetOpts `json:"search,omitempty"`
+	// Parameters of "rcpt" request: SeqId, User, After, Limit.
+	Rcpt *MsgGetOpts `json:"rcpt,omitempty"`
 }
 
 // MsgSetSub is a payload in set.sub request to update current subscription or invite another user, {sub.what} == "sub".
@@ -63,6 +79,8 @@ type MsgSetDesc struct {
 	Public     any                `json:"public,omitempty"`  // description of the user or topic
 	Trusted    any                `json:"trusted,omitempty"` // trusted (system-provided) user or topic data
 	Private    any                `json:"private,omitempty"` // per-subscription private data
+	Pinned     []int              `json:"pinned,omitempty"`  // IDs of pinned messages, group topics only
+	MsgTTL     *int               `json:"msgttl,omitempty"`  // lifetime of messages in seconds, 0 to disable
 }
 
 // MsgCredClient is an account credential such as email or phone number.
@@ -190,6 +208,13 @@ const (
 	constMsgMetaTags
 	constMsgMetaDel
 	constMsgMetaCred
+	constMsgMetaReact
+	constMsgMetaThread
+	constMsgMetaSched
+	constMsgMetaSearch
+	constMsgMetaRcpt
+	constMsgMetaExport
+	constMsgMetaLogin
 )
 
 const (
@@ -198,11 +223,13 @@ const (
 	constMsgDelSub
 	constMsgDelUser
 	constMsgDelCred
+	constMsgDelSched
+	constMsgDelLogin
 )
 
 func parseMsgClientMeta(params string) int {
 	var bits int
-	parts := strings.SplitN(params, " ", 8)
+	parts := strings.SplitN(params, " ", 10)
 	for _, p := range parts {
 		switch p {
 		case "desc":
@@ -217,6 +244,20 @@ func parseMsgClientMeta(params string) int {
 			bits |= constMsgMetaDel
 		case "cred":
 			bits |= constMsgMetaCred
+		case "react":
+			bits |= constMsgMetaReact
+		case "thread":
+			bits |= constMsgMetaThread
+		case "sched":
+			bits |= constMsgMetaSched
+		case "search":
+			bits |= constMsgMetaSearch
+		case "rcpt":
+			bits |= constMsgMetaRcpt
+		case "export":
+			bits |= constMsgMetaExport
+		case "login":
+			bits |= constMsgMetaLogin
 		default:
 			// ignore unknown
 		}
@@ -236,6 +277,10 @@ func parseMsgClientDel(params string) int {
 		return constMsgDelUser
 	case "cred":
 		return constMsgDelCred
+	case "sched":
+		return constMsgDelSched
+	case "login":
+		return constMsgDelLogin
 	default:
 		// ignore
 	}
@@ -262,6 +307,18 @@ type MsgClientPub struct {
 	NoEcho  bool           `json:"noecho,omitempty"`
 	Head    map[string]any `json:"head,omitempty"`
 	Content any            `json:"content"`
+	// Publish the message at the given time instead of now.
+	SendAt *time.Time `json:"sendat,omitempty"`
+	// Publish a copy of an earlier message from this or another topic instead of Content.
+	Forward *MsgForward `json:"forward,omitempty"`
+}
+
+// MsgForward references the message to forward.
+type MsgForward struct {
+	// Topic of the message as seen by the sender.
+	Topic string `json:"topic"`
+	// ID of the message.
+	SeqId int `json:"seq"`
 }
 
 // MsgClientGet is a query of topic state {get}.
@@ -288,6 +345,8 @@ type MsgClientDel struct {
 	// * "sub" to delete a subscription to topic.
 	// * "user" to delete or disable user.
 	// * "cred" to delete credential (email or phone)
+	// * "sched" to delete a scheduled message.
+	// * "login" to revoke a login.
 	What string `json:"what"`
 	// Delete messages with these IDs (either one by one or a set of ranges)
 	DelSeq []MsgDelRange `json:"delseq,omitempty"`
@@ -295,6 +354,10 @@ type MsgClientDel struct {
 	User string `json:"user,omitempty"`
 	// Credential to delete
 	Cred *MsgCredClient `json:"cred,omitempty"`
+	// ID of the scheduled message to delete.
+	Sched string `json:"sched,omitempty"`
+	// ID of the login to revoke or "*" to revoke all logins except the current one.
+	Login string `json:"login,omitempty"`
 	// Request to hard-delete objects (i.e. delete messages for all users), if such option is available.
 	Hard bool `json:"hard,omitempty"`
 }
@@ -303,7 +366,8 @@ type MsgClientDel struct {
 type MsgClientNote struct {
 	// There is no Id -- server will not akn {ping} packets, they are "fire and forget"
 	Topic string `json:"topic"`
-	// what is being reported: "recv" - message received, "read" - message read, "kp" - typing notification
+	// what is being reported: "recv" - message received, "read" - message read, "kp" - typing notification,
+	// "react" - reaction to a message.
 	What string `json:"what"`
 	// Server-issued message ID being reported
 	SeqId int `json:"seq,omitempty"`
@@ -311,6 +375,10 @@ type MsgClientNote struct {
 	Unread int `json:"unread,omitempty"`
 	// Call event.
 	Event string `json:"event,omitempty"`
+	// Reaction to the message SeqId, empty to remove the reaction.
+	React string `json:"react,omitempty"`
+	// Thread where the "read" SeqId is located. Zero if the read is reported for the whole topic.
+	Thread int `json:"thread,omitempty"`
 	// Arbitrary json payload (used in video calls).
 	Payload json.RawMessage `json:"payload,omitempty"`
 }
@@ -361,6 +429,10 @@ type ClientComMessage struct {
 	sess *Session
 	// The message is initialized (true) as opposite to being used as a wrapper for session.
 	init bool
+	// ID of the scheduled message being published, zero for ordinary messages.
+	sched types.Uid
+	// The message is a request to delete messages which have outlived the topic's message TTL.
+	expired bool
 }
 
 /****************************************************************
@@ -389,6 +461,24 @@ type MsgCredServer struct {
 	Done bool `json:"done,omitempty"`
 }
 
+// MsgLogin is a login of the user which can be revoked.
+type MsgLogin struct {
+	// ID of the login.
+	Id string `json:"id"`
+	// Client which logged in.
+	UserAgent  string `json:"ua,omitempty"`
+	RemoteAddr string `json:"ip,omitempty"`
+	DeviceId   string `json:"dev,omitempty"`
+	// Time of the login.
+	CreatedAt time.Time `json:"created"`
+	// Time when the client last logged in with the token.
+	LastSeen time.Time `json:"seen"`
+	// Expiration time of the token.
+	Expires time.Time `json:"expires"`
+	// This is the login of the requesting session.
+	Current bool `json:"current,omitempty"`
+}
+
 // MsgAccessMode is a definition of access mode.
 type MsgAccessMode struct {
 	// Access mode requested by the user
@@ -445,6 +535,10 @@ type MsgTopicDesc struct {
 	Trusted any `json:"trusted,omitempty"`
 	// Per-subscription private data
 	Private any `json:"private,omitempty"`
+	// IDs of pinned messages, most recently pinned first
+	Pinned []int `json:"pinned,omitempty"`
+	// Lifetime of messages in seconds
+	MsgTTL int `json:"msgttl,omitempty"`
 }
 
 func (src *MsgTopicDesc) describe() string {
@@ -565,6 +659,86 @@ type MsgDelValues struct {
 	DelSeq []MsgDelRange `json:"delseq,omitempty"`
 }
 
+// MsgReaction is an aggregate of identical reactions to a message.
+type MsgReaction struct {
+	// Reaction value, usually an emoji.
+	Value string `json:"val"`
+	// Number of users who reacted with this value.
+	Count int `json:"count"`
+	// IDs of users who reacted with this value. Not reported in channels.
+	Users []string `json:"users,omitempty"`
+}
+
+// MsgMessageReactions is a list of reactions to one message.
+type MsgMessageReactions struct {
+	SeqId int           `json:"seq"`
+	React []MsgReaction `json:"react"`
+}
+
+// MsgThreadStatus is a summary of replies in one thread as seen by the requester.
+type MsgThreadStatus struct {
+	// ID of the message which started the thread.
+	Thread int `json:"thread"`
+	// Number of replies in the thread.
+	Count int `json:"count"`
+	// ID of the latest reply.
+	LastSeqId int `json:"last"`
+	// ID of the latest reply read by the requester.
+	ReadSeqId int `json:"read,omitempty"`
+	// Number of unread replies.
+	Unread int `json:"unread,omitempty"`
+}
+
+// MsgScheduledMessage is a message waiting to be published at a later time.
+type MsgScheduledMessage struct {
+	// ID of the scheduled message.
+	Id string `json:"id"`
+	// Time when the message was scheduled.
+	CreatedAt *time.Time `json:"created,omitempty"`
+	// Time when the message will be published.
+	SendAt *time.Time `json:"sendat"`
+	// Message headers.
+	Head map[string]any `json:"head,omitempty"`
+	// Message payload.
+	Content any `json:"content"`
+}
+
+// MsgSearchHit is a message found by full-text search.
+type MsgSearchHit struct {
+	// Topic where the message was found.
+	Topic string `json:"topic"`
+	// ID of the message.
+	SeqId int `json:"seq"`
+	// Sender of the message.
+	From string `json:"from,omitempty"`
+	// Time when the message was sent.
+	Timestamp *time.Time `json:"ts,omitempty"`
+	// Fragment of message text around the matching words.
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// MsgRcptValues reports which members of a group topic have received and read a message.
+type MsgRcptValues struct {
+	// ID of the message.
+	SeqId int `json:"seq"`
+	// Number of members who have received the message.
+	Recv int `json:"recv,omitempty"`
+	// Number of members who have read the message.
+	Read int `json:"read,omitempty"`
+	// Delivery status for individual members, one page ordered by user ID.
+	Users []MsgMemberRcpt `json:"users,omitempty"`
+}
+
+// MsgMemberRcpt is the delivery status of a message for one member of a group topic.
+type MsgMemberRcpt struct {
+	// ID of the member.
+	User string `json:"user"`
+	// ID of the latest message received by the member.
+	RecvSeqId int `json:"recv,omitempty"`
+	// ID of the latest message read by the member.
+	ReadSeqId int `json:"read,omitempty"`
+}
+
 // MsgServerCtrl is a server control message {ctrl}.
 type MsgServerCtrl struct {
 	Id     string `json:"id,omitempty"`
@@ -599,6 +773,8 @@ type MsgServerData struct {
 	SeqId     int            `json:"seq"`
 	Head      map[string]any `json:"head,omitempty"`
 	Content   any            `json:"content"`
+	// Aggregated reactions to the message.
+	React []MsgReaction `json:"react,omitempty"`
 }
 
 // Deep-shallow copy.
@@ -719,6 +895,18 @@ type MsgServerMeta struct {
 	Tags []string `json:"tags,omitempty"`
 	// Account credentials, 'me' only.
 	Cred []*MsgCredServer `json:"cred,omitempty"`
+	// Aggregated reactions to messages.
+	React []MsgMessageReactions `json:"react,omitempty"`
+	// Summaries of threads of replies.
+	Thread []MsgThreadStatus `json:"thread,omitempty"`
+	// Requester's messages scheduled for publishing at a later time.
+	Sched []MsgScheduledMessage `json:"sched,omitempty"`
+	// Messages found by full-text search, 'fnd' only.
+	Search []MsgSearchHit `json:"search,omitempty"`
+	// Delivery and read status of a message in a group topic.
+	Rcpt *MsgRcptValues `json:"rcpt,omitempty"`
+	// Logins with revocable tokens, 'me' only.
+	Login []MsgLogin `json:"login,omitempty"`
 }
 
 // Deep-shallow copy of meta message. Deep copy of Id and Topic fields, shallow copy of payload.
@@ -754,6 +942,27 @@ func (src *MsgServerMeta) describe() string {
 		x, _ := json.Marshal(src.Cred)
 		s += " cred=[" + string(x) + "]"
 	}
+	if src.React != nil {
+		x, _ := json.Marshal(src.React)
+		s += " react=" + string(x)
+	}
+	if src.Thread != nil {
+		x, _ := json.Marshal(src.Thread)
+		s += " thread=" + string(x)
+	}
+	if src.Sched != nil {
+		s += " sched=[" + strconv.Itoa(len(src.Sched)) + "]"
+	}
+	if src.Search != nil {
+		s += " search=[" + strconv.Itoa(len(src.Search)) + "]"
+	}
+	if src.Rcpt != nil {
+		s += " rcpt={seq=" + strconv.Itoa(src.Rcpt.SeqId) + " recv=" + strconv.Itoa(src.Rcpt.Recv) +
+			" read=" + strconv.Itoa(src.Rcpt.Read) + " users=[" + strconv.Itoa(len(src.Rcpt.Users)) + "]}"
+	}
+	if src.Login != nil {
+		s += " login=[" + strconv.Itoa(len(src.Login)) + "]"
+	}
 	return s
 }
 
@@ -765,12 +974,17 @@ type MsgServerInfo struct {
 	Src string `json:"src,omitempty"`
 	// ID of the user who originated the message.
 	From string `json:"from,omitempty"`
-	// The event being reported: "rcpt" - message received, "read" - message read, "kp" - typing notification, "call" - video call.
+	// The event being reported: "rcpt" - message received, "read" - message read, "kp" - typing notification, "call" - video call,
+	// "react" - reaction to a message, "sched" - scheduled message was not published.
 	What string `json:"what"`
 	// Server-issued message ID being reported.
 	SeqId int `json:"seq,omitempty"`
-	// Call event.
+	// Call event or "rejected" for "sched".
 	Event string `json:"event,omitempty"`
+	// Reaction to the message SeqId, empty if the reaction was removed.
+	React string `json:"react,omitempty"`
+	// Thread where the "read" SeqId is located.
+	Thread int `json:"thread,omitempty"`
 	// Arbitrary json payload (used by video calls).
 	Payload json.RawMessage `json:"payload,omitempty"`
 
@@ -800,6 +1014,12 @@ func (src *MsgServerInfo) describe() string {
 	if src.SeqId > 0 {
 		s += " seq=" + strconv.Itoa(src.SeqId)
 	}
+	if src.React != "" {
+		s += " react=" + src.React
+	}
+	if src.Thread > 0 {
+		s += " thread=" + strconv.Itoa(src.Thread)
+	}
 	if len(src.Payload) > 0 {
 		s += " payload=<..." + strconv.Itoa(len(src.Payload)) + " bytes ...>"
 	}
@@ -1267,6 +1487,22 @@ func ErrAuthUnknownScheme(id, topic string, ts time.Time) *ServerComMessage {
 	}
 }
 
+// ErrTooManyRequests the action is blocked for some time after too many failed attempts
+// with explicit server and incoming request timestamps (429).
+func ErrTooManyRequests(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Id:        id,
+			Code:      http.StatusTooManyRequests, // 429
+			Text:      "too many requests",
+			Topic:     topic,
+			Timestamp: serverTs,
+		},
+		Id:        id,
+		Timestamp: incomingReqTs,
+	}
+}
+
 // ErrPermissionDenied user is authenticated but operation is not permitted (403).
 func ErrPermissionDenied(id, topic string, ts time.Time) *ServerComMessage {
 	return ErrPermissionDeniedExplicitTs(id, topic, ts, ts)
@@ -145,11 +145,20 @@ type Adapter interface {
 	FindUsers(user t.Uid, req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error)
 	// FindTopics searches for group topics given a list of tags.
 	FindTopics(req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error)
+	// MessageSearch finds messages in the given topics with PlainText containing all of the given lowercase
+	// words, most recent first. Messages soft-deleted by forUser are skipped. Only Topic, SeqId, From, CreatedAt
+	// and PlainText of the returned messages are filled.
+	MessageSearch(topics []string, forUser t.Uid, words []string, opts *t.QueryOpt) ([]t.Message, error)
 
 	// Messages
 
 	// MessageSave saves message to database
 	MessageSave(msg *t.Message) error
+	// MessageEdit replaces head and content of an existing message identified by msg.Topic and msg.SeqId,
+	// saving the previous version as a revision.
+	MessageEdit(msg *t.Message) error
+	// MessageGetRevisions returns earlier revisions of the message, oldest first.
+	MessageGetRevisions(topic string, seqId int) ([]t.Message, error)
 	// MessageGetAll returns messages matching the query
 	MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error)
 	// MessageDeleteList marks messages as deleted.
@@ -157,6 +166,48 @@ type Adapter interface {
 	MessageDeleteList(topic string, toDel *t.DelMessage) error
 	// MessageGetDeleted returns a list of deleted message Ids.
 	MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error)
+	// MessageGetExpired finds topics with Topic.MsgTTL set which have messages older than the TTL as of 'now'.
+	// Returns up to 'limit' topic names mapped to the range of seq IDs of such messages. Already hard-deleted
+	// messages are ignored. If 'accept' is not nil, only topics it accepts are checked.
+	MessageGetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]t.Range, error)
+	// MessageArchive replaces live messages of the topic with seq IDs in the range with stubs: DelId is set
+	// to MsgDelIdArchived, the content and earlier revisions are removed. The stubs are linked to the file
+	// 'segment' which holds the content and the revisions, if the segment is given. If 'unchangedSince' is
+	// not zero and any message in the range was edited or deleted at or after that time, nothing is changed
+	// and ErrConflict is returned.
+	MessageArchive(topic string, rng t.Range, segment string, unchangedSince time.Time) error
+
+	// Threads
+
+	// ThreadReadUpdate records the latest reply in the thread read by the user. The value is never decreased.
+	ThreadReadUpdate(topic string, user t.Uid, thread, readSeqId int) error
+	// ThreadGetAll returns summaries of all threads in the topic as seen by the given user.
+	ThreadGetAll(topic string, forUser t.Uid) ([]t.ThreadStatus, error)
+
+	// Scheduled messages
+
+	// SchedMsgSave saves a message for delivery at a later time.
+	SchedMsgSave(msg *t.ScheduledMessage) error
+	// SchedMsgGetAll returns pending scheduled messages sent by the given user to the topic, earliest first.
+	SchedMsgGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error)
+	// SchedMsgGet returns the scheduled message with the given ID or t.ErrNotFound.
+	SchedMsgGet(id t.Uid) (*t.ScheduledMessage, error)
+	// SchedMsgGetDue returns up to 'limit' scheduled messages with SendAt before the given time, earliest first.
+	// If 'accept' is not nil, only messages to topics it accepts are returned and skipped messages don't count
+	// towards the limit.
+	SchedMsgGetDue(before time.Time, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error)
+	// SchedMsgDelete deletes a scheduled message. If user is not zero, the message is deleted only if it was
+	// sent by the user. Returns t.ErrNotFound if nothing was deleted.
+	SchedMsgDelete(id, user t.Uid) error
+
+	// Reactions
+
+	// ReactionUpsert creates or replaces user's reaction to a message.
+	ReactionUpsert(r *t.Reaction) error
+	// ReactionDelete removes user's reaction to a message.
+	ReactionDelete(topic string, seqId int, user t.Uid) error
+	// ReactionGetAll returns reactions to messages with seq IDs in range [opts.Since, opts.Before).
+	ReactionGetAll(topic string, opts *t.QueryOpt) ([]t.Reaction, error)
 
 	// Devices (for push notifications)
 
@@ -179,8 +230,11 @@ type Adapter interface {
 	// unused records with UpdatedAt before olderThan.
 	// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
 	FileDeleteUnused(olderThan time.Time, limit int) ([]string, error)
-	// FileLinkAttachments connects given topic or message to the file record IDs from the list.
+	// FileLinkAttachments connects given topic, user or message to the file record IDs from the list.
+	// If the message is given, the topic is optional and is the topic of the message.
 	FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error
+	// FileRelinkMessages moves links of messages of the topic from the file 'oldFid' to the file 'newFid'.
+	FileRelinkMessages(topic, oldFid, newFid string) error
 
 	// Persistent cache management.
 
@@ -192,4 +246,70 @@ type Adapter interface {
 	PCacheDelete(key string) error
 	// PCacheExpire expires older entries with the specified key prefix.
 	PCacheExpire(keyPrefix string, olderThan time.Time) error
+
+	// Outbox of change events, see store.Changes.
+
+	// WithOutbox returns an adapter which makes changes like this one and adds the entries of the outbox
+	// to the outbox table in the transaction of the first change made through it. Returns nil if the
+	// adapter cannot write to the outbox table in its transactions.
+	WithOutbox(outbox *Outbox) Adapter
+	// OutboxAdd adds entries to the outbox table outside of any transaction.
+	OutboxAdd(entries []OutboxEntry) error
+	// OutboxGet returns up to 'limit' entries of the outbox table ordered by offset.
+	OutboxGet(limit int) ([]OutboxEntry, error)
+	// OutboxDelete deletes entries with the given offsets from the outbox table.
+	OutboxDelete(offsets []string) error
+
+	// Data export, e.g. for migration to another database. The records are returned page by page in an
+	// adapter-specific stable order. The key of the last record of a page is passed as 'after' to get the
+	// next page, a zero value to get the first page. Attachments are loaded.
+
+	// UserExport returns up to 'limit' users, including soft-deleted, which follow the user 'after'.
+	UserExport(after t.Uid, limit int) ([]t.User, error)
+	// AuthExport returns all authentication records of the user.
+	AuthExport(uid t.Uid) ([]AuthRecord, error)
+	// TopicExport returns up to 'limit' topics, including soft-deleted, which follow the topic 'after'.
+	TopicExport(after string, limit int) ([]t.Topic, error)
+	// MessageExport returns up to 'limit' messages of the topic with seq IDs greater than 'after', in
+	// ascending order. Hard-deleted messages are skipped, soft-deleted are returned. Archived messages
+	// are returned as stubs with DelId set to MsgDelIdArchived. If 'from' is not zero, only messages
+	// sent by that user are returned.
+	MessageExport(topic string, from t.Uid, after, limit int) ([]t.Message, error)
+	// FileExport returns up to 'limit' file records which follow the file 'after'.
+	FileExport(after string, limit int) ([]t.FileDef, error)
+	// PCacheExport returns up to 'limit' persistent cache entries which follow the key 'after'.
+	// The database version record is not an entry and is skipped.
+	PCacheExport(after string, limit int) ([]PCacheEntry, error)
+}
+
+// AuthRecord is an authentication record of a user.
+type AuthRecord struct {
+	Scheme  string
+	Unique  string
+	AuthLvl auth.Level
+	Secret  []byte
+	Expires time.Time
+}
+
+// OutboxEntry is a change event in the outbox table.
+type OutboxEntry struct {
+	// Offset of the event, unique, increasing in the order the events are recorded.
+	Offset string
+	// Serialized event.
+	Event string
+}
+
+// Outbox holds change events to be added to the outbox table in the transaction of a change.
+type Outbox struct {
+	// Entries returns the events. It's called when the change is made but not committed yet, so the events
+	// can describe the objects as written.
+	Entries func() []OutboxEntry
+	// Written is set by the adapter when the entries are added in the transaction of the change.
+	Written bool
+}
+
+// PCacheEntry is a persistent cache entry.
+type PCacheEntry struct {
+	Key   string
+	Value string
 }
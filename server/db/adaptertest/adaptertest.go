@@ -0,0 +1,2184 @@
+// Package adaptertest is a conformance test suite for database adapters. The suite exercises every
+// method of adapter.Adapter through the interface only, so the same expectations are checked against
+// all adapters. Each adapter package invokes the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		adp, err := adaptertest.OpenStore(adapterName, adaptertest.Config(adapterName, defaultConfig))
+//		if err != nil {
+//			t.Skip("database is not available:", err)
+//		}
+//		adaptertest.Run(t, adp)
+//	}
+//
+// The suite recreates the database many times: never point it to a database with real data.
+package adaptertest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// 16-byte key for XTEA used by the SQL adapters to convert between Uids and database IDs.
+var uidKey = []byte("la6YsO+bNX/+XIkO")
+
+// Config returns adapter configuration from the TINODE_TEST_<NAME> environment variable, such as
+// TINODE_TEST_MYSQL, or the fallback value if the variable is not set.
+func Config(name, fallback string) json.RawMessage {
+	if config := os.Getenv("TINODE_TEST_" + strings.ToUpper(name)); config != "" {
+		return json.RawMessage(config)
+	}
+	return json.RawMessage(fallback)
+}
+
+// OpenStore opens a registered adapter through the store. The store initializes the Uid generator
+// which the SQL adapters need to convert Uids to database IDs. Some adapters connect lazily or
+// tolerate a missing database in Open, so the database is (re)created to make sure it's usable.
+func OpenStore(name string, config json.RawMessage) (adapter.Adapter, error) {
+	storeConfig, _ := json.Marshal(map[string]any{
+		"uid_key":     uidKey,
+		"use_adapter": name,
+		"adapters":    map[string]json.RawMessage{name: config},
+	})
+	err := store.Store.Open(1, storeConfig)
+	adp := store.Store.GetAdapter()
+	if adp == nil || !adp.IsOpen() {
+		if err == nil {
+			err = errors.New("adapter '" + name + "' is not open")
+		}
+		return nil, err
+	}
+	// Version mismatch is expected: the database is created here.
+	if err = adp.CreateDb(true); err != nil {
+		adp.Close()
+		return nil, err
+	}
+	return adp, nil
+}
+
+// Run runs the conformance suite against an open adapter. The database is recreated before each
+// group of tests. The adapter is closed when the suite completes.
+func Run(t *testing.T, adp adapter.Adapter) {
+	s := &suite{
+		adp: adp,
+		// Use fixed timestamp to make tests more predictable.
+		now: time.Date(2021, time.June, 12, 11, 39, 24, 0, time.UTC),
+	}
+	if err := s.uGen.Init(11, uidKey); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("General", s.testGeneral)
+	t.Run("Users", s.testUsers)
+	t.Run("Auth", s.testAuth)
+	t.Run("Credentials", s.testCredentials)
+	t.Run("Topics", s.testTopics)
+	t.Run("Subscriptions", s.testSubscriptions)
+	t.Run("TopicsForUser", s.testTopicsForUser)
+	t.Run("UsersForTopic", s.testUsersForTopic)
+	t.Run("Messages", s.testMessages)
+	t.Run("MessageEdit", s.testMessageEdit)
+	t.Run("MessageSearch", s.testMessageSearch)
+	t.Run("MessageGetExpired", s.testMessageGetExpired)
+	t.Run("MessageArchive", s.testMessageArchive)
+	t.Run("Threads", s.testThreads)
+	t.Run("ScheduledMessages", s.testScheduledMessages)
+	t.Run("Reactions", s.testReactions)
+	t.Run("Devices", s.testDevices)
+	t.Run("Files", s.testFiles)
+	t.Run("PCache", s.testPCache)
+	t.Run("Outbox", s.testOutbox)
+	t.Run("Export", s.testExport)
+	t.Run("UserDelete", s.testUserDelete)
+
+	if err := adp.Close(); err != nil {
+		t.Error("Close:", err)
+	}
+	if adp.IsOpen() {
+		t.Error("Adapter is open after Close")
+	}
+}
+
+type suite struct {
+	adp  adapter.Adapter
+	uGen types.UidGenerator
+	now  time.Time
+}
+
+// at returns a timestamp the given number of minutes after the suite's reference time.
+func (s *suite) at(minutes int) time.Time {
+	return s.now.Add(time.Duration(minutes) * time.Minute)
+}
+
+// reset recreates the database.
+func (s *suite) reset(t *testing.T) {
+	t.Helper()
+	if err := s.adp.CreateDb(true); err != nil {
+		t.Fatal("CreateDb:", err)
+	}
+}
+
+func (s *suite) createUser(t *testing.T, name string, tags ...string) *types.User {
+	t.Helper()
+	user := &types.User{
+		ObjHeader: types.ObjHeader{CreatedAt: s.now, UpdatedAt: s.now},
+		State:     types.StateOK,
+		Access:    types.DefaultAccess{Auth: types.ModeCAuth, Anon: types.ModeNone},
+		Public:    map[string]any{"fn": name},
+		Tags:      tags,
+	}
+	user.SetUid(s.uGen.Get())
+	if err := s.adp.UserCreate(user); err != nil {
+		t.Fatal("UserCreate:", err)
+	}
+	return user
+}
+
+func (s *suite) createTopic(t *testing.T, owner *types.User, tags ...string) *types.Topic {
+	t.Helper()
+	topic := &types.Topic{
+		ObjHeader: types.ObjHeader{Id: "grp" + s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+		TouchedAt: s.now,
+		Access:    types.DefaultAccess{Auth: types.ModeCPublic, Anon: types.ModeNone},
+		Public:    map[string]any{"fn": "Topic " + strings.Join(tags, " ")},
+		Tags:      tags,
+	}
+	if owner != nil {
+		topic.Owner = owner.Id
+	}
+	if err := s.adp.TopicCreate(topic); err != nil {
+		t.Fatal("TopicCreate:", err)
+	}
+	if owner != nil {
+		s.subscribe(t, topic.Id, owner, types.ModeCFull, s.now)
+	}
+	return topic
+}
+
+func (s *suite) subscribe(t *testing.T, topic string, user *types.User, mode types.AccessMode,
+	updatedAt time.Time) *types.Subscription {
+	t.Helper()
+	sub := &types.Subscription{
+		ObjHeader: types.ObjHeader{CreatedAt: s.now, UpdatedAt: updatedAt},
+		User:      user.Id,
+		Topic:     topic,
+		ModeWant:  mode,
+		ModeGiven: mode,
+		Private:   map[string]any{"comment": "private of " + user.Id},
+	}
+	if err := s.adp.TopicShare([]*types.Subscription{sub}); err != nil {
+		t.Fatal("TopicShare:", err)
+	}
+	return sub
+}
+
+// createP2P creates a p2p topic between two users.
+func (s *suite) createP2P(t *testing.T, initiator, invited *types.User) string {
+	t.Helper()
+	name := initiator.Uid().P2PName(invited.Uid())
+	sub1 := &types.Subscription{
+		ObjHeader: types.ObjHeader{CreatedAt: s.now, UpdatedAt: s.now},
+		User:      initiator.Id,
+		Topic:     name,
+		ModeWant:  types.ModeCP2P,
+		ModeGiven: types.ModeCP2P,
+	}
+	sub1.SetTouchedAt(s.now)
+	sub2 := &types.Subscription{
+		ObjHeader: types.ObjHeader{CreatedAt: s.now, UpdatedAt: s.now},
+		User:      invited.Id,
+		Topic:     name,
+		ModeWant:  types.ModeCP2P,
+		ModeGiven: types.ModeCP2P,
+	}
+	if err := s.adp.TopicCreateP2P(sub1, sub2); err != nil {
+		t.Fatal("TopicCreateP2P:", err)
+	}
+	return name
+}
+
+// saveMessages saves messages with seq IDs 1..count to the topic, one message per second.
+func (s *suite) saveMessages(t *testing.T, topic string, count int, from ...*types.User) []*types.Message {
+	t.Helper()
+	var msgs []*types.Message
+	for i := 1; i <= count; i++ {
+		createdAt := s.now.Add(time.Duration(i) * time.Second)
+		msg := &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: createdAt, UpdatedAt: createdAt},
+			SeqId:     i,
+			Topic:     topic,
+			From:      from[i%len(from)].Id,
+			Head:      types.MessageHeaders{"mime": "text/plain"},
+			Content:   "message " + numbers[i],
+			PlainText: "message " + numbers[i],
+		}
+		msg.SetUid(s.uGen.Get())
+		if err := s.adp.MessageSave(msg); err != nil {
+			t.Fatal("MessageSave:", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := s.adp.TopicUpdateOnMessage(topic, msgs[len(msgs)-1]); err != nil {
+		t.Fatal("TopicUpdateOnMessage:", err)
+	}
+	return msgs
+}
+
+var numbers = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten"}
+
+func (s *suite) deleteMessages(t *testing.T, topic string, forUser *types.User, delId int, ranges ...types.Range) {
+	t.Helper()
+	toDel := &types.DelMessage{
+		ObjHeader:   types.ObjHeader{Id: s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+		Topic:       topic,
+		DelId:       delId,
+		SeqIdRanges: ranges,
+	}
+	if forUser != nil {
+		toDel.DeletedFor = forUser.Id
+	}
+	if err := s.adp.MessageDeleteList(topic, toDel); err != nil {
+		t.Fatal("MessageDeleteList:", err)
+	}
+}
+
+// ================== General =====================================
+
+func (s *suite) testGeneral(t *testing.T) {
+	s.reset(t)
+
+	if !s.adp.IsOpen() {
+		t.Fatal("Adapter is not open")
+	}
+	if s.adp.GetName() == "" {
+		t.Error("Adapter name is empty")
+	}
+	if version, err := s.adp.GetDbVersion(); err != nil || version != s.adp.Version() {
+		t.Error(mismatch("GetDbVersion", version, s.adp.Version()), err)
+	}
+	if err := s.adp.CheckDbVersion(); err != nil {
+		t.Error("CheckDbVersion:", err)
+	}
+	if err := s.adp.UpgradeDb(); err != nil {
+		t.Error("UpgradeDb:", err)
+	}
+	if err := s.adp.SetMaxResults(1024); err != nil {
+		t.Error("SetMaxResults:", err)
+	}
+	// Stats are adapter-specific. Just make sure the call does not fail.
+	s.adp.Stats()
+}
+
+// ================== Users =======================================
+
+func (s *suite) testUsers(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice", "alice")
+	bob := s.createUser(t, "Bob", "bob")
+	carol := s.createUser(t, "Carol", "carol")
+
+	// Adapters return driver-specific errors for duplicate objects.
+	if err := s.adp.UserCreate(alice); err == nil {
+		t.Error("UserCreate duplicate: expected error")
+	}
+
+	got, err := s.adp.UserGet(alice.Uid())
+	if err != nil || got == nil {
+		t.Fatal("UserGet:", got, err)
+	}
+	if got.Id != alice.Id || got.State != types.StateOK || got.Access != alice.Access ||
+		!got.CreatedAt.Equal(alice.CreatedAt) || !got.UpdatedAt.Equal(alice.UpdatedAt) ||
+		!jsonEqual(got.Public, alice.Public) || !reflect.DeepEqual([]string(got.Tags), []string(alice.Tags)) {
+		t.Error(mismatch("User", got, alice))
+	}
+
+	// Not found is not an error.
+	if got, err = s.adp.UserGet(s.uGen.Get()); err != nil || got != nil {
+		t.Error("UserGet not found:", got, err)
+	}
+
+	all, err := s.adp.UserGetAll(alice.Uid(), bob.Uid(), s.uGen.Get())
+	if err != nil || len(all) != 2 {
+		t.Error(mismatch("UserGetAll length", len(all), 2), err)
+	}
+
+	update := map[string]any{
+		"UserAgent": "Test Agent v0.11",
+		"LastSeen":  s.at(5),
+		"UpdatedAt": s.at(5),
+	}
+	if err := s.adp.UserUpdate(alice.Uid(), update); err != nil {
+		t.Fatal("UserUpdate:", err)
+	}
+	got, _ = s.adp.UserGet(alice.Uid())
+	if got.UserAgent != "Test Agent v0.11" || got.LastSeen == nil || !got.LastSeen.Equal(s.at(5)) ||
+		!got.UpdatedAt.Equal(s.at(5)) {
+		t.Error(mismatch("Updated user", got, update))
+	}
+
+	// Tags are kept in the order of addition.
+	tags, err := s.adp.UserUpdateTags(alice.Uid(), []string{"tag1", "Alice"}, nil, nil)
+	if want := []string{"alice", "tag1", "Alice"}; err != nil || !reflect.DeepEqual(tags, want) {
+		t.Error(mismatch("Tags after add", tags, want), err)
+	}
+	tags, _ = s.adp.UserUpdateTags(alice.Uid(), nil, []string{"alice", "tag1", "tag2"}, nil)
+	if want := []string{"Alice"}; !reflect.DeepEqual(tags, want) {
+		t.Error(mismatch("Tags after remove", tags, want))
+	}
+	tags, _ = s.adp.UserUpdateTags(alice.Uid(), nil, nil, []string{"Alice", "tag111", "tag333"})
+	if want := []string{"Alice", "tag111", "tag333"}; !reflect.DeepEqual(tags, want) {
+		t.Error(mismatch("Tags after reset", tags, want))
+	}
+	tags, _ = s.adp.UserUpdateTags(alice.Uid(), []string{"tag1", "Alice"}, []string{"alice", "tag1", "tag2"}, nil)
+	if want := []string{"Alice", "tag111", "tag333"}; !reflect.DeepEqual(tags, want) {
+		t.Error(mismatch("Tags after add and remove", tags, want))
+	}
+	if got, _ = s.adp.UserGet(alice.Uid()); !reflect.DeepEqual([]string(got.Tags), tags) {
+		t.Error(mismatch("Stored tags", got.Tags, tags))
+	}
+
+	// The caller is never found.
+	found, err := s.adp.FindUsers(alice.Uid(), [][]string{{"Alice", "bob", "carol"}}, nil, true)
+	if err != nil || len(found) != 2 {
+		t.Fatal(mismatch("FindUsers length", len(found), 2), err)
+	}
+	// Users with more matching tags come first.
+	found, _ = s.adp.FindUsers(carol.Uid(), [][]string{{"bob", "Alice"}}, []string{"tag111", "tag333"}, true)
+	if len(found) != 2 || found[0].User != alice.Id || found[1].User != bob.Id {
+		t.Fatal(mismatch("FindUsers order", found, []string{alice.Id, bob.Id}))
+	}
+	if want := []string{"Alice", "tag111", "tag333"}; !jsonEqual(found[0].Private, want) {
+		t.Error(mismatch("FindUsers matched tags", found[0].Private, want))
+	}
+	if !jsonEqual(found[1].GetPublic(), bob.Public) {
+		t.Error(mismatch("FindUsers public", found[1].GetPublic(), bob.Public))
+	}
+	// All required tags must be present.
+	found, _ = s.adp.FindUsers(carol.Uid(), [][]string{{"bob", "Alice"}, {"tag111"}}, nil, true)
+	if len(found) != 1 || found[0].User != alice.Id {
+		t.Error(mismatch("FindUsers with required tags", found, alice.Id))
+	}
+
+	// Unread count: bob has 10-4 unread, carol has no R permission.
+	topic := s.createTopic(t, alice)
+	s.subscribe(t, topic.Id, bob, types.ModeCPublic, s.now)
+	s.subscribe(t, topic.Id, carol, types.ModeCSelf, s.now)
+	s.saveMessages(t, topic.Id, 10, alice)
+	if err := s.adp.SubsUpdate(topic.Id, bob.Uid(), map[string]any{"ReadSeqId": 4}); err != nil {
+		t.Fatal("SubsUpdate:", err)
+	}
+	stranger := s.uGen.Get()
+	counts, err := s.adp.UserUnreadCount(alice.Uid(), bob.Uid(), carol.Uid(), stranger)
+	want := map[types.Uid]int{alice.Uid(): 10, bob.Uid(): 6, carol.Uid(): 0, stranger: 0}
+	if err != nil || !reflect.DeepEqual(counts, want) {
+		t.Error(mismatch("UserUnreadCount", counts, want), err)
+	}
+
+	// Suspending a user suspends the topics the user owns.
+	if err := s.adp.UserUpdate(alice.Uid(), map[string]any{"State": types.StateSuspended, "StateAt": s.at(6)}); err != nil {
+		t.Fatal("UserUpdate state:", err)
+	}
+	if got, _ := s.adp.TopicGet(topic.Id); got == nil || got.State != types.StateSuspended {
+		t.Error("Topic of a suspended user is not suspended:", got)
+	}
+	if found, _ = s.adp.FindUsers(carol.Uid(), [][]string{{"bob", "Alice"}}, nil, true); len(found) != 1 {
+		t.Error(mismatch("FindUsers active only", len(found), 1))
+	}
+	if found, _ = s.adp.FindUsers(carol.Uid(), [][]string{{"bob", "Alice"}}, nil, false); len(found) != 2 {
+		t.Error(mismatch("FindUsers all", len(found), 2))
+	}
+
+	// Bob has a validated credential, alice has logged in: only carol is unvalidated.
+	if _, err := s.adp.CredUpsert(&types.Credential{
+		ObjHeader: types.ObjHeader{CreatedAt: s.now, UpdatedAt: s.now},
+		User:      bob.Id,
+		Method:    "email",
+		Value:     "bob@example.com",
+		Done:      true,
+	}); err != nil {
+		t.Fatal("CredUpsert:", err)
+	}
+	unvalidated, err := s.adp.UserGetUnvalidated(s.at(60), 10)
+	if want := []types.Uid{carol.Uid()}; err != nil || !reflect.DeepEqual(unvalidated, want) {
+		t.Error(mismatch("UserGetUnvalidated", unvalidated, want), err)
+	}
+	if unvalidated, _ = s.adp.UserGetUnvalidated(s.now, 10); len(unvalidated) != 0 {
+		t.Error(mismatch("UserGetUnvalidated before creation", unvalidated, nil))
+	}
+}
+
+// ================== Authentication ==============================
+
+func (s *suite) testAuth(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	expires := s.at(24 * 60)
+
+	if err := s.adp.AuthAddRecord(alice.Uid(), "basic", "basic:alice", auth.LevelAuth,
+		[]byte("alice"), expires); err != nil {
+		t.Fatal("AuthAddRecord:", err)
+	}
+	if err := s.adp.AuthAddRecord(bob.Uid(), "basic", "basic:bob", auth.LevelAuth,
+		[]byte("bob"), expires); err != nil {
+		t.Fatal("AuthAddRecord:", err)
+	}
+	if err := s.adp.AuthAddRecord(bob.Uid(), "basic", "basic:alice", auth.LevelAuth,
+		[]byte("bob"), expires); err != types.ErrDuplicate {
+		t.Error("AuthAddRecord duplicate: expected ErrDuplicate, got", err)
+	}
+
+	uid, authLvl, secret, exp, err := s.adp.AuthGetUniqueRecord("basic:alice")
+	if err != nil || uid != alice.Uid() || authLvl != auth.LevelAuth || string(secret) != "alice" ||
+		!exp.Equal(expires) {
+		t.Error(mismatch("AuthGetUniqueRecord", []any{uid, authLvl, secret, exp},
+			[]any{alice.Uid(), auth.LevelAuth, "alice", expires}), err)
+	}
+	// Not found is not an error.
+	if uid, _, _, _, err = s.adp.AuthGetUniqueRecord("basic:nobody"); err != nil || !uid.IsZero() {
+		t.Error("AuthGetUniqueRecord not found:", uid, err)
+	}
+
+	unique, authLvl, secret, exp, err := s.adp.AuthGetRecord(bob.Uid(), "basic")
+	if err != nil || unique != "basic:bob" || authLvl != auth.LevelAuth || string(secret) != "bob" ||
+		!exp.Equal(expires) {
+		t.Error(mismatch("AuthGetRecord", []any{unique, authLvl, secret, exp},
+			[]any{"basic:bob", auth.LevelAuth, "bob", expires}), err)
+	}
+	if _, _, _, _, err = s.adp.AuthGetRecord(bob.Uid(), "token"); err != types.ErrNotFound {
+		t.Error("AuthGetRecord not found: expected ErrNotFound, got", err)
+	}
+
+	// Only non-zero values are updated.
+	if err := s.adp.AuthUpdRecord(bob.Uid(), "basic", "", auth.LevelRoot, []byte("secret"),
+		time.Time{}); err != nil {
+		t.Fatal("AuthUpdRecord:", err)
+	}
+	unique, authLvl, secret, exp, _ = s.adp.AuthGetRecord(bob.Uid(), "basic")
+	if unique != "basic:bob" || authLvl != auth.LevelRoot || string(secret) != "secret" || !exp.Equal(expires) {
+		t.Error(mismatch("Updated auth record", []any{unique, authLvl, secret, exp},
+			[]any{"basic:bob", auth.LevelRoot, "secret", expires}))
+	}
+	if err := s.adp.AuthUpdRecord(bob.Uid(), "basic", "basic:bob2", auth.LevelAuth, nil,
+		time.Time{}); err != nil {
+		t.Fatal("AuthUpdRecord unique:", err)
+	}
+	if uid, _, _, _, _ = s.adp.AuthGetUniqueRecord("basic:bob"); !uid.IsZero() {
+		t.Error("Old unique is still present:", uid)
+	}
+	if uid, _, secret, _, _ = s.adp.AuthGetUniqueRecord("basic:bob2"); uid != bob.Uid() || string(secret) != "secret" {
+		t.Error(mismatch("Record with new unique", []any{uid, secret}, []any{bob.Uid(), "secret"}))
+	}
+
+	if err := s.adp.AuthAddRecord(alice.Uid(), "token", "token:alice", auth.LevelAuth, []byte("token"), expires); err != nil {
+		t.Fatal("AuthAddRecord:", err)
+	}
+	if err := s.adp.AuthDelScheme(alice.Uid(), "token"); err != nil {
+		t.Fatal("AuthDelScheme:", err)
+	}
+	if _, _, _, _, err = s.adp.AuthGetRecord(alice.Uid(), "token"); err != types.ErrNotFound {
+		t.Error("Scheme is not deleted:", err)
+	}
+	if _, _, _, _, err = s.adp.AuthGetRecord(alice.Uid(), "basic"); err != nil {
+		t.Error("Other scheme is deleted:", err)
+	}
+
+	if count, err := s.adp.AuthDelAllRecords(alice.Uid()); err != nil || count != 1 {
+		t.Error(mismatch("AuthDelAllRecords", count, 1), err)
+	}
+	if count, err := s.adp.AuthDelAllRecords(s.uGen.Get()); err != nil || count != 0 {
+		t.Error(mismatch("AuthDelAllRecords not found", count, 0), err)
+	}
+}
+
+// ================== Credentials =================================
+
+func (s *suite) testCredentials(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+
+	newCred := func(user *types.User, method, value string, done bool) *types.Credential {
+		return &types.Credential{
+			ObjHeader: types.ObjHeader{CreatedAt: s.now, UpdatedAt: s.now},
+			User:      user.Id,
+			Method:    method,
+			Value:     value,
+			Resp:      "123456",
+			Done:      done,
+		}
+	}
+
+	if inserted, err := s.adp.CredUpsert(newCred(alice, "email", "alice@example.com", true)); err != nil || !inserted {
+		t.Fatal("CredUpsert validated:", inserted, err)
+	}
+	// Validated credential cannot be claimed by another user.
+	if _, err := s.adp.CredUpsert(newCred(bob, "email", "alice@example.com", false)); err != types.ErrDuplicate {
+		t.Error("CredUpsert duplicate: expected ErrDuplicate, got", err)
+	}
+	if _, err := s.adp.CredUpsert(newCred(bob, "email", "alice@example.com", true)); err != types.ErrDuplicate {
+		t.Error("CredUpsert validated duplicate: expected ErrDuplicate, got", err)
+	}
+	if uid, err := s.adp.UserGetByCred("email", "alice@example.com"); err != nil || uid != alice.Uid() {
+		t.Error(mismatch("UserGetByCred", uid, alice.Uid()), err)
+	}
+	if uid, err := s.adp.UserGetByCred("email", "nobody@example.com"); err != nil || !uid.IsZero() {
+		t.Error("UserGetByCred not found:", uid, err)
+	}
+
+	if inserted, err := s.adp.CredUpsert(newCred(bob, "tel", "+15551234567", false)); err != nil || !inserted {
+		t.Fatal("CredUpsert unvalidated:", inserted, err)
+	}
+	if inserted, err := s.adp.CredUpsert(newCred(bob, "tel", "+15551234567", false)); err != nil || inserted {
+		t.Error("CredUpsert same unvalidated: expected update, got", inserted, err)
+	}
+	// Unvalidated credential is not used for lookups.
+	if uid, _ := s.adp.UserGetByCred("tel", "+15551234567"); !uid.IsZero() {
+		t.Error("UserGetByCred found unvalidated credential:", uid)
+	}
+
+	// New unvalidated value replaces the old one.
+	if inserted, err := s.adp.CredUpsert(newCred(bob, "tel", "+15557654321", false)); err != nil || !inserted {
+		t.Fatal("CredUpsert another unvalidated:", inserted, err)
+	}
+	active, err := s.adp.CredGetActive(bob.Uid(), "tel")
+	if err != nil || active == nil || active.Value != "+15557654321" || active.Done || active.Resp != "123456" {
+		t.Fatal(mismatch("CredGetActive", active, "+15557654321"), err)
+	}
+	if all, _ := s.adp.CredGetAll(bob.Uid(), "tel", false); len(all) != 1 {
+		t.Error(mismatch("CredGetAll after replace", len(all), 1))
+	}
+	// Not found: adapters report it either as types.ErrNotFound or as nil credential.
+	if got, err := s.adp.CredGetActive(alice.Uid(), "tel"); err != types.ErrNotFound && (err != nil || got != nil) {
+		t.Error("CredGetActive not found:", got, err)
+	}
+
+	if err := s.adp.CredFail(bob.Uid(), "tel"); err != nil {
+		t.Fatal("CredFail:", err)
+	}
+	if active, _ = s.adp.CredGetActive(bob.Uid(), "tel"); active == nil || active.Retries != 1 {
+		t.Error("CredFail did not increment retries:", active)
+	}
+
+	if err := s.adp.CredConfirm(bob.Uid(), "tel"); err != nil {
+		t.Fatal("CredConfirm:", err)
+	}
+	if uid, _ := s.adp.UserGetByCred("tel", "+15557654321"); uid != bob.Uid() {
+		t.Error(mismatch("UserGetByCred confirmed", uid, bob.Uid()))
+	}
+	if got, _ := s.adp.CredGetActive(bob.Uid(), "tel"); got != nil {
+		t.Error("Confirmed credential is still active:", got)
+	}
+
+	s.adp.CredUpsert(newCred(bob, "email", "bob@example.com", false))
+	if all, _ := s.adp.CredGetAll(bob.Uid(), "", false); len(all) != 2 {
+		t.Error(mismatch("CredGetAll", len(all), 2))
+	}
+	if all, _ := s.adp.CredGetAll(bob.Uid(), "", true); len(all) != 1 || all[0].Value != "+15557654321" {
+		t.Error(mismatch("CredGetAll validated", all, "+15557654321"))
+	}
+	if all, _ := s.adp.CredGetAll(bob.Uid(), "email", false); len(all) != 1 || all[0].Done {
+		t.Error(mismatch("CredGetAll email", all, "bob@example.com"))
+	}
+
+	if err := s.adp.CredDel(alice.Uid(), "email", "alice@example.com"); err != nil {
+		t.Fatal("CredDel:", err)
+	}
+	if uid, _ := s.adp.UserGetByCred("email", "alice@example.com"); !uid.IsZero() {
+		t.Error("Deleted credential is found:", uid)
+	}
+	if err := s.adp.CredDel(bob.Uid(), "", ""); err != nil {
+		t.Fatal("CredDel all:", err)
+	}
+	if all, _ := s.adp.CredGetAll(bob.Uid(), "", false); len(all) != 0 {
+		t.Error("Credentials are not deleted:", all)
+	}
+}
+
+// ================== Topics ======================================
+
+func (s *suite) testTopics(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	carol := s.createUser(t, "Carol")
+
+	topic := s.createTopic(t, alice, "travel", "zxcv")
+	if err := s.adp.TopicCreate(topic); err == nil {
+		t.Error("TopicCreate duplicate: expected error")
+	}
+	s.subscribe(t, topic.Id, bob, types.ModeCPublic, s.now)
+
+	got, err := s.adp.TopicGet(topic.Id)
+	if err != nil || got == nil {
+		t.Fatal("TopicGet:", got, err)
+	}
+	if got.Id != topic.Id || got.Owner != alice.Id || got.Access != topic.Access || got.State != types.StateOK ||
+		!got.CreatedAt.Equal(topic.CreatedAt) || !got.TouchedAt.Equal(topic.TouchedAt) ||
+		!jsonEqual(got.Public, topic.Public) || !reflect.DeepEqual([]string(got.Tags), []string(topic.Tags)) {
+		t.Error(mismatch("Topic", got, topic))
+	}
+	if got, err = s.adp.TopicGet("grpNotFound"); err != nil || got != nil {
+		t.Error("TopicGet not found:", got, err)
+	}
+
+	p2p := s.createP2P(t, alice, bob)
+	if got, _ = s.adp.TopicGet(p2p); got == nil || got.Owner != "" {
+		t.Error("P2P topic:", got)
+	}
+	if sub, _ := s.adp.SubscriptionGet(p2p, bob.Uid(), false); sub == nil || sub.ModeGiven != types.ModeCP2P {
+		t.Error("P2P subscription:", sub)
+	}
+
+	if own, err := s.adp.OwnTopics(alice.Uid()); err != nil || !reflect.DeepEqual(own, []string{topic.Id}) {
+		t.Error(mismatch("OwnTopics", own, []string{topic.Id}), err)
+	}
+	if err := s.adp.TopicOwnerChange(topic.Id, bob.Uid()); err != nil {
+		t.Fatal("TopicOwnerChange:", err)
+	}
+	if got, _ = s.adp.TopicGet(topic.Id); got.Owner != bob.Id {
+		t.Error(mismatch("Owner", got.Owner, bob.Id))
+	}
+	if own, _ := s.adp.OwnTopics(alice.Uid()); len(own) != 0 {
+		t.Error("OwnTopics of the former owner:", own)
+	}
+
+	update := map[string]any{
+		"UpdatedAt": s.at(10),
+		"Public":    map[string]any{"fn": "Renamed"},
+		"Access":    types.DefaultAccess{Auth: types.ModeCReadOnly, Anon: types.ModeNone},
+	}
+	if err := s.adp.TopicUpdate(topic.Id, update); err != nil {
+		t.Fatal("TopicUpdate:", err)
+	}
+	got, _ = s.adp.TopicGet(topic.Id)
+	if !got.UpdatedAt.Equal(s.at(10)) || !jsonEqual(got.Public, update["Public"]) || got.Access != update["Access"] {
+		t.Error(mismatch("Updated topic", got, update))
+	}
+
+	msg := &types.Message{ObjHeader: types.ObjHeader{CreatedAt: s.at(20)}, SeqId: 66}
+	if err := s.adp.TopicUpdateOnMessage(topic.Id, msg); err != nil {
+		t.Fatal("TopicUpdateOnMessage:", err)
+	}
+	if got, _ = s.adp.TopicGet(topic.Id); got.SeqId != 66 || !got.TouchedAt.Equal(s.at(20)) {
+		t.Error(mismatch("TopicUpdateOnMessage", []any{got.SeqId, got.TouchedAt}, []any{66, s.at(20)}))
+	}
+
+	s.createTopic(t, carol, "qwer")
+	found, err := s.adp.FindTopics([][]string{{"travel", "qwer"}}, nil, true)
+	if err != nil || len(found) != 2 {
+		t.Error(mismatch("FindTopics", len(found), 2), err)
+	}
+	found, _ = s.adp.FindTopics([][]string{{"travel"}}, []string{"zxcv"}, true)
+	if len(found) != 1 || found[0].Topic != topic.Id || !jsonEqual(found[0].Private, []string{"travel", "zxcv"}) {
+		t.Error(mismatch("FindTopics one", found, topic.Id))
+	}
+
+	// Channel: subscriptions of readers use the chnXXX name.
+	channel := &types.Topic{
+		ObjHeader: types.ObjHeader{Id: "grp" + s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+		TouchedAt: s.now,
+		UseBt:     true,
+		Owner:     alice.Id,
+		Tags:      []string{"channel"},
+	}
+	if err := s.adp.TopicCreate(channel); err != nil {
+		t.Fatal("TopicCreate channel:", err)
+	}
+	chnName := types.GrpToChn(channel.Id)
+	s.subscribe(t, chnName, carol, types.ModeCChnReader, s.now)
+	if chans, err := s.adp.ChannelsForUser(carol.Uid()); err != nil || !reflect.DeepEqual(chans, []string{chnName}) {
+		t.Error(mismatch("ChannelsForUser", chans, []string{chnName}), err)
+	}
+	if found, _ = s.adp.FindTopics([][]string{{"channel"}}, nil, true); len(found) != 1 || found[0].Topic != chnName {
+		t.Error(mismatch("FindTopics channel", found, chnName))
+	}
+
+	// Soft delete: the topic is marked as deleted, subscriptions are disabled.
+	if err := s.adp.TopicDelete(topic.Id, false, false); err != nil {
+		t.Fatal("TopicDelete soft:", err)
+	}
+	if got, _ = s.adp.TopicGet(topic.Id); got == nil || got.State != types.StateDeleted || got.StateAt == nil {
+		t.Error("Topic is not soft-deleted:", got)
+	}
+	if sub, _ := s.adp.SubscriptionGet(topic.Id, alice.Uid(), false); sub != nil {
+		t.Error("Subscription to soft-deleted topic:", sub)
+	}
+	if sub, _ := s.adp.SubscriptionGet(topic.Id, alice.Uid(), true); sub == nil || sub.DeletedAt == nil {
+		t.Error("Subscription to soft-deleted topic is not marked as deleted:", sub)
+	}
+	if found, _ = s.adp.FindTopics([][]string{{"travel", "qwer"}}, nil, true); len(found) != 1 {
+		t.Error(mismatch("FindTopics active only", len(found), 1))
+	}
+
+	// Hard delete of a channel also deletes subscriptions of channel readers.
+	if err := s.adp.TopicDelete(channel.Id, true, true); err != nil {
+		t.Fatal("TopicDelete hard:", err)
+	}
+	if got, _ = s.adp.TopicGet(channel.Id); got != nil {
+		t.Error("Topic is not hard-deleted:", got)
+	}
+	if sub, _ := s.adp.SubscriptionGet(chnName, carol.Uid(), true); sub != nil {
+		t.Error("Channel subscription is not deleted:", sub)
+	}
+	if chans, _ := s.adp.ChannelsForUser(carol.Uid()); len(chans) != 0 {
+		t.Error("ChannelsForUser after delete:", chans)
+	}
+}
+
+// ================== Subscriptions ===============================
+
+func (s *suite) testSubscriptions(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	topic := s.createTopic(t, alice)
+	var members []*types.User
+	for i := 1; i <= 4; i++ {
+		user := s.createUser(t, "Member "+numbers[i])
+		s.subscribe(t, topic.Id, user, types.ModeCPublic, s.at(i))
+		members = append(members, user)
+	}
+
+	sub, err := s.adp.SubscriptionGet(topic.Id, members[0].Uid(), false)
+	if err != nil || sub == nil {
+		t.Fatal("SubscriptionGet:", sub, err)
+	}
+	if sub.User != members[0].Id || sub.Topic != topic.Id || sub.ModeWant != types.ModeCPublic ||
+		sub.ModeGiven != types.ModeCPublic || !sub.UpdatedAt.Equal(s.at(1)) || sub.DeletedAt != nil ||
+		!jsonEqual(sub.Private, map[string]any{"comment": "private of " + members[0].Id}) {
+		t.Error(mismatch("Subscription", sub, members[0].Id))
+	}
+	if sub, err = s.adp.SubscriptionGet(topic.Id, s.uGen.Get(), false); err != nil || sub != nil {
+		t.Error("SubscriptionGet not found:", sub, err)
+	}
+
+	if subs, err := s.adp.SubsForUser(alice.Uid()); err != nil || len(subs) != 1 || subs[0].Topic != topic.Id {
+		t.Error(mismatch("SubsForUser", subs, topic.Id), err)
+	}
+	if subs, err := s.adp.SubsForUser(s.uGen.Get()); err != nil || len(subs) != 0 {
+		t.Error("SubsForUser not found:", subs, err)
+	}
+
+	if subs, err := s.adp.SubsForTopic(topic.Id, false, nil); err != nil || len(subs) != 5 {
+		t.Error(mismatch("SubsForTopic", len(subs), 5), err)
+	}
+	if subs, _ := s.adp.SubsForTopic(topic.Id, false, &types.QueryOpt{Limit: 2}); len(subs) != 2 {
+		t.Error(mismatch("SubsForTopic with limit", len(subs), 2))
+	}
+	if subs, _ := s.adp.SubsForTopic(topic.Id, false, &types.QueryOpt{User: members[1].Uid()}); len(subs) != 1 ||
+		subs[0].User != members[1].Id {
+		t.Error(mismatch("SubsForTopic one user", subs, members[1].Id))
+	}
+	if subs, _ := s.adp.SubsForTopic("grpNotFound", false, nil); len(subs) != 0 {
+		t.Error("SubsForTopic not found:", subs)
+	}
+
+	// Update one subscription.
+	if err := s.adp.SubsUpdate(topic.Id, members[0].Uid(), map[string]any{
+		"UpdatedAt": s.at(10),
+		"ModeWant":  types.ModeCReadOnly,
+		"RecvSeqId": 7,
+		"ReadSeqId": 5,
+		"Private":   map[string]any{"comment": "updated"},
+	}); err != nil {
+		t.Fatal("SubsUpdate:", err)
+	}
+	sub, _ = s.adp.SubscriptionGet(topic.Id, members[0].Uid(), false)
+	if !sub.UpdatedAt.Equal(s.at(10)) || sub.ModeWant != types.ModeCReadOnly || sub.RecvSeqId != 7 ||
+		sub.ReadSeqId != 5 || !jsonEqual(sub.Private, map[string]any{"comment": "updated"}) {
+		t.Error(mismatch("Updated subscription", sub, "updated"))
+	}
+	if sub, _ = s.adp.SubscriptionGet(topic.Id, members[1].Uid(), false); sub.ReadSeqId != 0 {
+		t.Error("Other subscription is updated:", sub)
+	}
+
+	// Update all subscriptions.
+	if err := s.adp.SubsUpdate(topic.Id, types.ZeroUid, map[string]any{"UpdatedAt": s.at(20)}); err != nil {
+		t.Fatal("SubsUpdate all:", err)
+	}
+	subs, _ := s.adp.SubsForTopic(topic.Id, false, nil)
+	for _, sub := range subs {
+		if !sub.UpdatedAt.Equal(s.at(20)) {
+			t.Error(mismatch("UpdatedAt of "+sub.User, sub.UpdatedAt, s.at(20)))
+		}
+	}
+
+	// Soft-delete subscription.
+	if err := s.adp.SubsDelete(topic.Id, members[3].Uid()); err != nil {
+		t.Fatal("SubsDelete:", err)
+	}
+	if sub, _ = s.adp.SubscriptionGet(topic.Id, members[3].Uid(), false); sub != nil {
+		t.Error("Deleted subscription is returned:", sub)
+	}
+	if sub, _ = s.adp.SubscriptionGet(topic.Id, members[3].Uid(), true); sub == nil || sub.DeletedAt == nil {
+		t.Error("Deleted subscription is not marked as deleted:", sub)
+	}
+	if subs, _ = s.adp.SubsForTopic(topic.Id, false, nil); len(subs) != 4 {
+		t.Error(mismatch("SubsForTopic after delete", len(subs), 4))
+	}
+	if subs, _ = s.adp.SubsForTopic(topic.Id, true, nil); len(subs) != 5 {
+		t.Error(mismatch("SubsForTopic with deleted", len(subs), 5))
+	}
+	if subs, _ = s.adp.SubsForUser(members[3].Uid()); len(subs) != 0 {
+		t.Error("SubsForUser returns deleted subscription:", subs)
+	}
+
+	// Sharing the topic again restores the subscription.
+	s.subscribe(t, topic.Id, members[3], types.ModeCReadOnly, s.at(30))
+	if sub, _ = s.adp.SubscriptionGet(topic.Id, members[3].Uid(), false); sub == nil || sub.ModeGiven != types.ModeCReadOnly {
+		t.Error("Subscription is not restored:", sub)
+	}
+}
+
+// ================== TopicsForUser ===============================
+
+func (s *suite) testTopicsForUser(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+
+	// Three group topics touched 0, 10, 20 minutes after the reference time.
+	var grps []*types.Topic
+	for i := 0; i < 3; i++ {
+		topic := s.createTopic(t, alice, "topic"+numbers[i])
+		if err := s.adp.TopicUpdate(topic.Id, map[string]any{"TouchedAt": s.at(i * 10)}); err != nil {
+			t.Fatal("TopicUpdate:", err)
+		}
+		grps = append(grps, topic)
+	}
+	p2p := s.createP2P(t, alice, bob)
+	// Subscription to 'me' is never returned.
+	s.subscribe(t, alice.Uid().UserId(), alice, types.ModeCSelf, s.now)
+
+	subs, err := s.adp.TopicsForUser(alice.Uid(), false, nil)
+	if err != nil || len(subs) != 4 {
+		t.Fatal(mismatch("TopicsForUser", topicNames(subs), []string{grps[0].Id, grps[1].Id, grps[2].Id, p2p}), err)
+	}
+	for _, sub := range subs {
+		if sub.Topic == p2p {
+			if sub.GetWith() != bob.Uid().UserId() || !jsonEqual(sub.GetPublic(), bob.Public) {
+				t.Error(mismatch("P2P subscription", []any{sub.GetWith(), sub.GetPublic()},
+					[]any{bob.Uid().UserId(), bob.Public}))
+			}
+		} else if sub.Topic == grps[2].Id {
+			if !sub.GetTouchedAt().Equal(s.at(20)) || !jsonEqual(sub.GetPublic(), grps[2].Public) {
+				t.Error(mismatch("Group subscription", []any{sub.GetTouchedAt(), sub.GetPublic()},
+					[]any{s.at(20), grps[2].Public}))
+			}
+		}
+	}
+
+	if subs, _ = s.adp.TopicsForUser(alice.Uid(), false, &types.QueryOpt{Limit: 2}); len(subs) != 2 {
+		t.Error(mismatch("TopicsForUser with limit", len(subs), 2))
+	}
+	if subs, _ = s.adp.TopicsForUser(alice.Uid(), false, &types.QueryOpt{Topic: grps[1].Id}); len(subs) != 1 ||
+		subs[0].Topic != grps[1].Id {
+		t.Error(mismatch("TopicsForUser one topic", topicNames(subs), grps[1].Id))
+	}
+
+	// IfModifiedSince: only topics touched later are returned, earliest first.
+	ims := s.at(5)
+	subs, _ = s.adp.TopicsForUser(alice.Uid(), false, &types.QueryOpt{IfModifiedSince: &ims})
+	if want := []string{grps[1].Id, grps[2].Id}; !reflect.DeepEqual(topicNames(subs), want) {
+		t.Error(mismatch("TopicsForUser IMS", topicNames(subs), want))
+	}
+	// Paging with IfModifiedSince.
+	subs, _ = s.adp.TopicsForUser(alice.Uid(), false, &types.QueryOpt{IfModifiedSince: &ims, Limit: 1})
+	if want := []string{grps[1].Id}; !reflect.DeepEqual(topicNames(subs), want) {
+		t.Fatal(mismatch("TopicsForUser IMS page 1", topicNames(subs), want))
+	}
+	ims = subs[0].LastModified()
+	subs, _ = s.adp.TopicsForUser(alice.Uid(), false, &types.QueryOpt{IfModifiedSince: &ims, Limit: 1})
+	if want := []string{grps[2].Id}; !reflect.DeepEqual(topicNames(subs), want) {
+		t.Fatal(mismatch("TopicsForUser IMS page 2", topicNames(subs), want))
+	}
+	ims = subs[0].LastModified()
+	if subs, _ = s.adp.TopicsForUser(alice.Uid(), false, &types.QueryOpt{IfModifiedSince: &ims, Limit: 1}); len(subs) != 0 {
+		t.Error(mismatch("TopicsForUser IMS page 3", topicNames(subs), nil))
+	}
+
+	// Deleted topics are returned only when requested.
+	if err := s.adp.TopicDelete(grps[0].Id, false, false); err != nil {
+		t.Fatal("TopicDelete:", err)
+	}
+	if subs, _ = s.adp.TopicsForUser(alice.Uid(), false, nil); len(subs) != 3 {
+		t.Error(mismatch("TopicsForUser after delete", len(subs), 3))
+	}
+	if subs, _ = s.adp.TopicsForUser(alice.Uid(), true, nil); len(subs) != 4 {
+		t.Error(mismatch("TopicsForUser with deleted", len(subs), 4))
+	}
+}
+
+// ================== UsersForTopic ===============================
+
+func (s *suite) testUsersForTopic(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	carol := s.createUser(t, "Carol")
+	topic := s.createTopic(t, alice)
+	s.subscribe(t, topic.Id, bob, types.ModeCPublic, s.now)
+	s.subscribe(t, topic.Id, carol, types.ModeCPublic, s.now)
+
+	subs, err := s.adp.UsersForTopic(topic.Id, false, nil)
+	if err != nil || len(subs) != 3 {
+		t.Fatal(mismatch("UsersForTopic", len(subs), 3), err)
+	}
+	for _, sub := range subs {
+		if sub.User == carol.Id && !jsonEqual(sub.GetPublic(), carol.Public) {
+			t.Error(mismatch("Public", sub.GetPublic(), carol.Public))
+		}
+	}
+	if subs, _ = s.adp.UsersForTopic(topic.Id, false, &types.QueryOpt{Limit: 2}); len(subs) != 2 {
+		t.Error(mismatch("UsersForTopic with limit", len(subs), 2))
+	}
+	subs, _ = s.adp.UsersForTopic(topic.Id, false, &types.QueryOpt{User: bob.Uid()})
+	if len(subs) != 1 || subs[0].User != bob.Id || !jsonEqual(subs[0].GetPublic(), bob.Public) ||
+		!jsonEqual(subs[0].Private, map[string]any{"comment": "private of " + bob.Id}) {
+		t.Error(mismatch("UsersForTopic one user", subs, bob.Id))
+	}
+
+	// Subscriptions of deleted users are returned only when requested.
+	if err := s.adp.UserDelete(carol.Uid(), false); err != nil {
+		t.Fatal("UserDelete:", err)
+	}
+	if subs, _ = s.adp.UsersForTopic(topic.Id, false, nil); len(subs) != 2 {
+		t.Error(mismatch("UsersForTopic after delete", len(subs), 2))
+	}
+	if subs, _ = s.adp.UsersForTopic(topic.Id, true, nil); len(subs) != 3 {
+		t.Error(mismatch("UsersForTopic with deleted", len(subs), 3))
+	}
+
+	// Each p2p subscriber gets Public of the other user.
+	p2p := s.createP2P(t, alice, bob)
+	subs, _ = s.adp.UsersForTopic(p2p, false, nil)
+	if len(subs) != 2 {
+		t.Fatal(mismatch("UsersForTopic p2p", len(subs), 2))
+	}
+	for _, sub := range subs {
+		other := alice
+		if sub.User == alice.Id {
+			other = bob
+		}
+		if !jsonEqual(sub.GetPublic(), other.Public) {
+			t.Error(mismatch("P2P public of "+sub.User, sub.GetPublic(), other.Public))
+		}
+	}
+}
+
+// ================== Messages ====================================
+
+func (s *suite) testMessages(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	topic := s.createTopic(t, alice)
+	s.subscribe(t, topic.Id, bob, types.ModeCPublic, s.now)
+	msgs := s.saveMessages(t, topic.Id, 10, alice, bob)
+
+	got, err := s.adp.MessageGetAll(topic.Id, alice.Uid(), nil)
+	if want := []int{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}; err != nil || !reflect.DeepEqual(seqIds(got), want) {
+		t.Fatal(mismatch("MessageGetAll", seqIds(got), want), err)
+	}
+	msg := got[6]
+	if msg.Topic != topic.Id || msg.From != msgs[3].From || !msg.CreatedAt.Equal(msgs[3].CreatedAt) ||
+		!jsonEqual(msg.Content, msgs[3].Content) || !jsonEqual(msg.Head, msgs[3].Head) || msg.DelId != 0 {
+		t.Error(mismatch("Message", msg, msgs[3]))
+	}
+
+	// Paging from the most recent message back.
+	for _, tc := range []struct {
+		opts types.QueryOpt
+		want []int
+	}{
+		{types.QueryOpt{Limit: 3}, []int{10, 9, 8}},
+		{types.QueryOpt{Before: 8, Limit: 3}, []int{7, 6, 5}},
+		{types.QueryOpt{Since: 3, Before: 5}, []int{4, 3}},
+		{types.QueryOpt{Since: 9}, []int{10, 9}},
+	} {
+		opts := tc.opts
+		if got, _ = s.adp.MessageGetAll(topic.Id, alice.Uid(), &opts); !reflect.DeepEqual(seqIds(got), tc.want) {
+			t.Error(mismatch("MessageGetAll "+queryString(&opts), seqIds(got), tc.want))
+		}
+	}
+
+	// Soft-delete for bob, then hard-delete for everyone.
+	s.deleteMessages(t, topic.Id, bob, 1, types.Range{Low: 2}, types.Range{Low: 5, Hi: 7})
+	s.deleteMessages(t, topic.Id, nil, 2, types.Range{Low: 8, Hi: 10})
+
+	if got, _ = s.adp.MessageGetAll(topic.Id, alice.Uid(), nil); !reflect.DeepEqual(seqIds(got), []int{10, 7, 6, 5, 4, 3, 2, 1}) {
+		t.Error(mismatch("MessageGetAll after delete", seqIds(got), []int{10, 7, 6, 5, 4, 3, 2, 1}))
+	}
+	if got, _ = s.adp.MessageGetAll(topic.Id, bob.Uid(), nil); !reflect.DeepEqual(seqIds(got), []int{10, 7, 4, 3, 1}) {
+		t.Error(mismatch("MessageGetAll after delete for user", seqIds(got), []int{10, 7, 4, 3, 1}))
+	}
+	if got, _ = s.adp.MessageGetAll(topic.Id, bob.Uid(), &types.QueryOpt{Before: 7, Limit: 2}); !reflect.DeepEqual(seqIds(got), []int{4, 3}) {
+		t.Error(mismatch("MessageGetAll page after delete", seqIds(got), []int{4, 3}))
+	}
+
+	forBob := types.DelMessage{
+		Topic:       topic.Id,
+		DeletedFor:  bob.Id,
+		DelId:       1,
+		SeqIdRanges: []types.Range{{Low: 2}, {Low: 5, Hi: 7}},
+	}
+	forAll := types.DelMessage{
+		Topic:       topic.Id,
+		DelId:       2,
+		SeqIdRanges: []types.Range{{Low: 8, Hi: 10}},
+	}
+	for _, tc := range []struct {
+		user *types.User
+		opts *types.QueryOpt
+		want []types.DelMessage
+	}{
+		{bob, nil, []types.DelMessage{forBob, forAll}},
+		{alice, nil, []types.DelMessage{forAll}},
+		{bob, &types.QueryOpt{Since: 2}, []types.DelMessage{forAll}},
+		{bob, &types.QueryOpt{Before: 2}, []types.DelMessage{forBob}},
+		{bob, &types.QueryOpt{Since: 1, Before: 3}, []types.DelMessage{forBob, forAll}},
+		{bob, &types.QueryOpt{Since: 3}, nil},
+	} {
+		dmsgs, err := s.adp.MessageGetDeleted(topic.Id, tc.user.Uid(), tc.opts)
+		if err != nil || !delMessagesEqual(dmsgs, tc.want) {
+			t.Error(mismatch("MessageGetDeleted for "+tc.user.Id+" "+queryString(tc.opts), dmsgs, tc.want), err)
+		}
+	}
+
+	// Message with the same seq ID cannot be saved twice.
+	if err := s.adp.MessageSave(msgs[0]); err == nil {
+		t.Error("MessageSave duplicate: expected error")
+	}
+
+	// Delete all messages.
+	if err := s.adp.MessageDeleteList(topic.Id, nil); err != nil {
+		t.Fatal("MessageDeleteList all:", err)
+	}
+	if got, _ = s.adp.MessageGetAll(topic.Id, alice.Uid(), nil); len(got) != 0 {
+		t.Error("Messages are not deleted:", seqIds(got))
+	}
+
+	// Hard-deleting a topic deletes its messages.
+	s.saveMessages(t, topic.Id, 3, alice)
+	if err := s.adp.TopicDelete(topic.Id, false, true); err != nil {
+		t.Fatal("TopicDelete:", err)
+	}
+	if got, _ = s.adp.MessageGetAll(topic.Id, alice.Uid(), nil); len(got) != 0 {
+		t.Error("Messages of deleted topic:", seqIds(got))
+	}
+}
+
+func (s *suite) testMessageEdit(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	topic := s.createTopic(t, alice)
+	msgs := s.saveMessages(t, topic.Id, 3, alice)
+
+	edited := &types.Message{
+		ObjHeader: types.ObjHeader{CreatedAt: msgs[1].CreatedAt, UpdatedAt: s.at(1)},
+		SeqId:     2,
+		Topic:     topic.Id,
+		From:      alice.Id,
+		Head:      types.MessageHeaders{"mime": "text/x-drafty"},
+		Content:   map[string]any{"txt": "edited"},
+		PlainText: "edited",
+	}
+	if err := s.adp.MessageEdit(edited); err != nil {
+		t.Fatal("MessageEdit:", err)
+	}
+	edited.UpdatedAt = s.at(2)
+	edited.Content = map[string]any{"txt": "edited again"}
+	if err := s.adp.MessageEdit(edited); err != nil {
+		t.Fatal("MessageEdit:", err)
+	}
+
+	got, _ := s.adp.MessageGetAll(topic.Id, alice.Uid(), &types.QueryOpt{Since: 2, Before: 3})
+	if len(got) != 1 || !jsonEqual(got[0].Content, edited.Content) || !got[0].UpdatedAt.Equal(s.at(2)) ||
+		!got[0].CreatedAt.Equal(msgs[1].CreatedAt) {
+		t.Fatal(mismatch("Edited message", got, edited))
+	}
+
+	revs, err := s.adp.MessageGetRevisions(topic.Id, 2)
+	if err != nil || len(revs) != 2 {
+		t.Fatal(mismatch("MessageGetRevisions", len(revs), 2), err)
+	}
+	if !jsonEqual(revs[0].Content, msgs[1].Content) || !jsonEqual(revs[0].Head, msgs[1].Head) ||
+		!revs[0].CreatedAt.Equal(msgs[1].UpdatedAt) || revs[0].From != alice.Id {
+		t.Error(mismatch("Revision 1", revs[0], msgs[1]))
+	}
+	if !jsonEqual(revs[1].Content, map[string]any{"txt": "edited"}) || !revs[1].CreatedAt.Equal(s.at(1)) {
+		t.Error(mismatch("Revision 2", revs[1], "edited"))
+	}
+	if revs, _ = s.adp.MessageGetRevisions(topic.Id, 1); len(revs) != 0 {
+		t.Error("Revisions of unedited message:", revs)
+	}
+
+	// Deleted messages cannot be edited and have no revisions.
+	s.deleteMessages(t, topic.Id, nil, 1, types.Range{Low: 2})
+	if err := s.adp.MessageEdit(edited); err != types.ErrNotFound {
+		t.Error("MessageEdit deleted: expected ErrNotFound, got", err)
+	}
+	if revs, _ = s.adp.MessageGetRevisions(topic.Id, 2); len(revs) != 0 {
+		t.Error("Revisions of deleted message:", revs)
+	}
+	edited.SeqId = 10
+	if err := s.adp.MessageEdit(edited); err != types.ErrNotFound {
+		t.Error("MessageEdit not found: expected ErrNotFound, got", err)
+	}
+}
+
+func (s *suite) testMessageSearch(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	topic1 := s.createTopic(t, alice)
+	topic2 := s.createTopic(t, alice)
+	s.saveMessages(t, topic1.Id, 10, alice, bob)
+	s.saveMessages(t, topic2.Id, 3, bob)
+
+	topics := []string{topic1.Id, topic2.Id}
+	got, err := s.adp.MessageSearch(topics, alice.Uid(), []string{"message"}, nil)
+	if err != nil || len(got) != 13 {
+		t.Fatal(mismatch("MessageSearch", len(got), 13), err)
+	}
+	// Most recent first.
+	for i := 1; i < len(got); i++ {
+		if got[i].CreatedAt.After(got[i-1].CreatedAt) {
+			t.Fatal("MessageSearch results are not ordered by time:", got)
+		}
+	}
+	got, _ = s.adp.MessageSearch(topics, alice.Uid(), []string{"message", "seven"}, nil)
+	if len(got) != 1 || got[0].Topic != topic1.Id || got[0].SeqId != 7 || got[0].From != bob.Id ||
+		got[0].PlainText != "message seven" {
+		t.Error(mismatch("MessageSearch all words", got, 7))
+	}
+	// Case-insensitive substrings.
+	if got, _ = s.adp.MessageSearch([]string{topic1.Id}, alice.Uid(), []string{"t"}, &types.QueryOpt{Limit: 3}); !reflect.DeepEqual(seqIds(got), []int{10, 8, 3}) {
+		t.Error(mismatch("MessageSearch with limit", seqIds(got), []int{10, 8, 3}))
+	}
+	if got, _ = s.adp.MessageSearch([]string{topic1.Id}, alice.Uid(), []string{"MESSAGE", "EIGHT"}, nil); len(got) != 1 {
+		t.Error(mismatch("MessageSearch case-insensitive", len(got), 1))
+	}
+
+	// Deleted messages are not found.
+	s.deleteMessages(t, topic1.Id, bob, 1, types.Range{Low: 10})
+	s.deleteMessages(t, topic1.Id, nil, 2, types.Range{Low: 8})
+	if got, _ = s.adp.MessageSearch([]string{topic1.Id}, bob.Uid(), []string{"t"}, nil); !reflect.DeepEqual(seqIds(got), []int{3, 2}) {
+		t.Error(mismatch("MessageSearch after delete", seqIds(got), []int{3, 2}))
+	}
+	if got, _ = s.adp.MessageSearch([]string{topic1.Id}, alice.Uid(), []string{"t"}, nil); !reflect.DeepEqual(seqIds(got), []int{10, 3, 2}) {
+		t.Error(mismatch("MessageSearch after delete for other user", seqIds(got), []int{10, 3, 2}))
+	}
+
+	if got, _ = s.adp.MessageSearch(nil, alice.Uid(), []string{"message"}, nil); len(got) != 0 {
+		t.Error("MessageSearch without topics:", got)
+	}
+	if got, _ = s.adp.MessageSearch(topics, alice.Uid(), nil, nil); len(got) != 0 {
+		t.Error("MessageSearch without words:", got)
+	}
+}
+
+func (s *suite) testMessageGetExpired(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	expiring := s.createTopic(t, alice)
+	permanent := s.createTopic(t, alice)
+	single := s.createTopic(t, alice)
+	for _, topic := range []*types.Topic{expiring, single} {
+		if err := s.adp.TopicUpdate(topic.Id, map[string]any{"MsgTTL": 60}); err != nil {
+			t.Fatal("TopicUpdate:", err)
+		}
+	}
+	// Messages are created 1..5 seconds after the reference time.
+	s.saveMessages(t, expiring.Id, 5, alice)
+	s.saveMessages(t, permanent.Id, 5, alice)
+	s.saveMessages(t, single.Id, 1, alice)
+	s.deleteMessages(t, expiring.Id, nil, 1, types.Range{Low: 1})
+
+	expired, err := s.adp.MessageGetExpired(s.now.Add(63500*time.Millisecond), nil, 10)
+	want := map[string]types.Range{expiring.Id: {Low: 2, Hi: 4}, single.Id: {Low: 1}}
+	if err != nil || !reflect.DeepEqual(expired, want) {
+		t.Error(mismatch("MessageGetExpired", expired, want), err)
+	}
+	if expired, _ = s.adp.MessageGetExpired(s.now.Add(63500*time.Millisecond), nil, 1); len(expired) != 1 {
+		t.Error(mismatch("MessageGetExpired with limit", len(expired), 1))
+	}
+	// Rejected topics are skipped and don't count towards the limit.
+	for _, name := range []string{expiring.Id, single.Id} {
+		accept := func(topic string) bool { return topic == name }
+		expired, err = s.adp.MessageGetExpired(s.now.Add(63500*time.Millisecond), accept, 1)
+		if want := map[string]types.Range{name: want[name]}; err != nil || !reflect.DeepEqual(expired, want) {
+			t.Error(mismatch("MessageGetExpired with filter", expired, want), err)
+		}
+	}
+	if expired, _ = s.adp.MessageGetExpired(s.at(1), nil, 10); len(expired) != 0 {
+		t.Error("MessageGetExpired too early:", expired)
+	}
+}
+
+func (s *suite) testMessageArchive(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	topic := s.createTopic(t, alice)
+	msgs := s.saveMessages(t, topic.Id, 6, alice)
+	edited := *msgs[1]
+	edited.UpdatedAt = s.at(1)
+	edited.Content = "edited"
+	if err := s.adp.MessageEdit(&edited); err != nil {
+		t.Fatal("MessageEdit:", err)
+	}
+	s.deleteMessages(t, topic.Id, nil, 1, types.Range{Low: 3})
+
+	segment := s.createSegment(t, "uploads/segment.gz")
+
+	// Messages were edited and deleted after the segment was written.
+	if err := s.adp.MessageArchive(topic.Id, types.Range{Low: 1, Hi: 5}, segment.Id, s.at(1)); err != types.ErrConflict {
+		t.Fatal("MessageArchive changed: expected ErrConflict, got", err)
+	}
+	got, err := s.adp.MessageGetAll(topic.Id, alice.Uid(), nil)
+	if want := []int{6, 5, 4, 2, 1}; err != nil || !reflect.DeepEqual(seqIds(got), want) {
+		t.Error(mismatch("MessageGetAll after conflict", seqIds(got), want), err)
+	}
+
+	// Hard deletes use the current time.
+	unchangedSince := types.TimeNow().Add(time.Second)
+	if err := s.adp.MessageArchive(topic.Id, types.Range{Low: 1, Hi: 5}, segment.Id, unchangedSince); err != nil {
+		t.Fatal("MessageArchive:", err)
+	}
+	// Archiving the same range again changes nothing.
+	if err := s.adp.MessageArchive(topic.Id, types.Range{Low: 1, Hi: 5}, segment.Id, unchangedSince); err != nil {
+		t.Error("MessageArchive repeated:", err)
+	}
+	if err := s.adp.MessageArchive(topic.Id, types.Range{Low: 5, Hi: 5}, segment.Id, time.Time{}); err != types.ErrMalformed {
+		t.Error("MessageArchive empty range: expected ErrMalformed, got", err)
+	}
+
+	got, err = s.adp.MessageGetAll(topic.Id, alice.Uid(), nil)
+	if want := []int{6, 5}; err != nil || !reflect.DeepEqual(seqIds(got), want) {
+		t.Error(mismatch("MessageGetAll archived", seqIds(got), want), err)
+	}
+	// Archived messages are exported as stubs.
+	got, err = s.adp.MessageExport(topic.Id, types.ZeroUid, 0, 10)
+	if want := []int{1, 2, 4, 5, 6}; err != nil || !reflect.DeepEqual(seqIds(got), want) {
+		t.Fatal(mismatch("MessageExport archived", seqIds(got), want), err)
+	}
+	if got[1].DelId != types.MsgDelIdArchived || got[1].Content != nil || got[1].PlainText != "" ||
+		!reflect.DeepEqual(got[1].Attachments, types.StringSlice{segment.Id}) {
+		t.Error(mismatch("Archived stub", got[1], types.MsgDelIdArchived))
+	}
+	if got[3].DelId != 0 || got[3].Content != msgs[4].Content {
+		t.Error(mismatch("Live message", got[3], msgs[4]))
+	}
+	if revs, _ := s.adp.MessageGetRevisions(topic.Id, 2); len(revs) != 0 {
+		t.Error("Revisions of archived message:", revs)
+	}
+	edited.Content = "edited again"
+	if err := s.adp.MessageEdit(&edited); err != types.ErrNotFound {
+		t.Error("MessageEdit archived: expected ErrNotFound, got", err)
+	}
+
+	// The segment is used by the archived messages.
+	if locs, _ := s.adp.FileDeleteUnused(time.Now().Add(time.Minute), 10); len(locs) != 0 {
+		t.Error("FileDeleteUnused deleted the segment:", locs)
+	}
+
+	// Stubs can be created without the segment, e.g. on import.
+	if err := s.adp.MessageArchive(topic.Id, types.Range{Low: 5, Hi: 6}, "", time.Time{}); err != nil {
+		t.Fatal("MessageArchive without segment:", err)
+	}
+	got, _ = s.adp.MessageExport(topic.Id, types.ZeroUid, 4, 10)
+	if len(got) != 2 || got[0].DelId != types.MsgDelIdArchived || len(got[0].Attachments) != 0 {
+		t.Error(mismatch("Stub without segment", got, types.MsgDelIdArchived))
+	}
+
+	// The stubs are moved to a rewritten segment.
+	rewritten := s.createSegment(t, "uploads/rewritten.gz")
+	if err := s.adp.FileRelinkMessages(topic.Id, segment.Id, rewritten.Id); err != nil {
+		t.Fatal("FileRelinkMessages:", err)
+	}
+	locs, err := s.adp.FileDeleteUnused(time.Now().Add(time.Minute), 10)
+	if want := []string{segment.Location}; err != nil || !reflect.DeepEqual(locs, want) {
+		t.Error(mismatch("FileDeleteUnused after relink", locs, want), err)
+	}
+
+	// Hard-deleted stubs release the segment.
+	s.deleteMessages(t, topic.Id, nil, 2, types.Range{Low: 1, Hi: 5})
+	locs, err = s.adp.FileDeleteUnused(time.Now().Add(time.Minute), 10)
+	if want := []string{rewritten.Location}; err != nil || !reflect.DeepEqual(locs, want) {
+		t.Error(mismatch("FileDeleteUnused after hard delete", locs, want), err)
+	}
+	got, _ = s.adp.MessageExport(topic.Id, types.ZeroUid, 0, 10)
+	if len(got) == 0 || got[0].SeqId < 5 {
+		t.Error(mismatch("MessageExport after hard delete", seqIds(got), "5.."))
+	}
+}
+
+// createSegment creates a record of an uploaded archive segment.
+func (s *suite) createSegment(t *testing.T, location string) *types.FileDef {
+	t.Helper()
+	segment := &types.FileDef{
+		ObjHeader: types.ObjHeader{Id: s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+		Status:    types.UploadStarted,
+		MimeType:  "application/gzip",
+		Location:  location,
+	}
+	if err := s.adp.FileStartUpload(segment); err != nil {
+		t.Fatal("FileStartUpload:", err)
+	}
+	if _, err := s.adp.FileFinishUpload(segment, true, 100); err != nil {
+		t.Fatal("FileFinishUpload:", err)
+	}
+	return segment
+}
+
+// ================== Threads =====================================
+
+func (s *suite) testThreads(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	topic := s.createTopic(t, alice)
+
+	// Thread 1: replies 2, 3, 4. Thread 5: reply 6.
+	for seq, thread := range []int{0, 0, 1, 1, 1, 0, 5} {
+		if seq == 0 {
+			continue
+		}
+		msg := &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: s.now, UpdatedAt: s.now},
+			SeqId:     seq,
+			Topic:     topic.Id,
+			From:      alice.Id,
+			Thread:    thread,
+			Content:   "message " + numbers[seq],
+		}
+		msg.SetUid(s.uGen.Get())
+		if err := s.adp.MessageSave(msg); err != nil {
+			t.Fatal("MessageSave:", err)
+		}
+	}
+
+	if err := s.adp.ThreadReadUpdate(topic.Id, bob.Uid(), 1, 3); err != nil {
+		t.Fatal("ThreadReadUpdate:", err)
+	}
+	// The value is never decreased.
+	if err := s.adp.ThreadReadUpdate(topic.Id, bob.Uid(), 1, 2); err != nil {
+		t.Fatal("ThreadReadUpdate:", err)
+	}
+
+	threads, err := s.adp.ThreadGetAll(topic.Id, bob.Uid())
+	want := []types.ThreadStatus{
+		{Thread: 1, Count: 3, LastSeqId: 4, ReadSeqId: 3, Unread: 1},
+		{Thread: 5, Count: 1, LastSeqId: 6, ReadSeqId: 0, Unread: 1},
+	}
+	if err != nil || !reflect.DeepEqual(threads, want) {
+		t.Error(mismatch("ThreadGetAll", threads, want), err)
+	}
+
+	// Deleted replies are not counted.
+	s.deleteMessages(t, topic.Id, bob, 1, types.Range{Low: 4})
+	s.deleteMessages(t, topic.Id, nil, 2, types.Range{Low: 6})
+	threads, _ = s.adp.ThreadGetAll(topic.Id, bob.Uid())
+	want = []types.ThreadStatus{{Thread: 1, Count: 2, LastSeqId: 3, ReadSeqId: 3, Unread: 0}}
+	if !reflect.DeepEqual(threads, want) {
+		t.Error(mismatch("ThreadGetAll after delete", threads, want))
+	}
+	threads, _ = s.adp.ThreadGetAll(topic.Id, alice.Uid())
+	want = []types.ThreadStatus{{Thread: 1, Count: 3, LastSeqId: 4, ReadSeqId: 0, Unread: 3}}
+	if !reflect.DeepEqual(threads, want) {
+		t.Error(mismatch("ThreadGetAll for other user", threads, want))
+	}
+}
+
+// ================== Scheduled messages ==========================
+
+func (s *suite) testScheduledMessages(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	topic := s.createTopic(t, alice)
+
+	newSchedMsg := func(from *types.User, sendAt time.Time) *types.ScheduledMessage {
+		msg := &types.ScheduledMessage{
+			ObjHeader: types.ObjHeader{Id: s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+			SendAt:    sendAt,
+			Topic:     topic.Id,
+			From:      from.Id,
+			Head:      types.MessageHeaders{"mime": "text/x-drafty"},
+			Content:   map[string]any{"txt": "scheduled"},
+		}
+		if err := s.adp.SchedMsgSave(msg); err != nil {
+			t.Fatal("SchedMsgSave:", err)
+		}
+		return msg
+	}
+	late := newSchedMsg(alice, s.at(3))
+	early := newSchedMsg(alice, s.at(1))
+	other := newSchedMsg(bob, s.at(2))
+
+	got, err := s.adp.SchedMsgGetAll(topic.Id, alice.Uid())
+	if err != nil || len(got) != 2 || got[0].Id != early.Id || got[1].Id != late.Id {
+		t.Fatal(mismatch("SchedMsgGetAll", got, []string{early.Id, late.Id}), err)
+	}
+	if got[0].Topic != topic.Id || got[0].From != alice.Id || !got[0].SendAt.Equal(s.at(1)) ||
+		!jsonEqual(got[0].Content, early.Content) || !jsonEqual(got[0].Head, early.Head) {
+		t.Error(mismatch("Scheduled message", got[0], early))
+	}
+
+	msg, err := s.adp.SchedMsgGet(late.Uid())
+	if err != nil || msg.Id != late.Id || msg.From != alice.Id || !msg.SendAt.Equal(s.at(3)) ||
+		!jsonEqual(msg.Content, late.Content) {
+		t.Error(mismatch("SchedMsgGet", msg, late), err)
+	}
+	if _, err = s.adp.SchedMsgGet(types.Uid(12345)); err != types.ErrNotFound {
+		t.Error("SchedMsgGet missing: expected ErrNotFound, got", err)
+	}
+
+	got, _ = s.adp.SchedMsgGetDue(s.at(2).Add(time.Second), nil, 10)
+	if len(got) != 2 || got[0].Id != early.Id || got[1].Id != other.Id {
+		t.Error(mismatch("SchedMsgGetDue", got, []string{early.Id, other.Id}))
+	}
+	if got, _ = s.adp.SchedMsgGetDue(s.at(10), nil, 1); len(got) != 1 || got[0].Id != early.Id {
+		t.Error(mismatch("SchedMsgGetDue with limit", got, early.Id))
+	}
+
+	// Messages to rejected topics are skipped and don't count towards the limit.
+	topic2 := s.createTopic(t, alice)
+	for i := 0; i < 3; i++ {
+		if err := s.adp.SchedMsgSave(&types.ScheduledMessage{
+			ObjHeader: types.ObjHeader{Id: s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+			SendAt:    s.at(0),
+			Topic:     topic2.Id,
+			From:      alice.Id,
+			Content:   "skipped",
+		}); err != nil {
+			t.Fatal("SchedMsgSave:", err)
+		}
+	}
+	accept := func(name string) bool { return name == topic.Id }
+	if got, _ = s.adp.SchedMsgGetDue(s.at(10), accept, 2); len(got) != 2 || got[0].Id != early.Id || got[1].Id != other.Id {
+		t.Error(mismatch("SchedMsgGetDue with filter", got, []string{early.Id, other.Id}))
+	}
+	if got, _ = s.adp.SchedMsgGetDue(s.at(10), nil, 10); len(got) != 6 {
+		t.Error(mismatch("SchedMsgGetDue of all topics", len(got), 6))
+	}
+
+	if err := s.adp.SchedMsgDelete(late.Uid(), bob.Uid()); err != types.ErrNotFound {
+		t.Error("SchedMsgDelete by other user: expected ErrNotFound, got", err)
+	}
+	if err := s.adp.SchedMsgDelete(late.Uid(), alice.Uid()); err != nil {
+		t.Error("SchedMsgDelete:", err)
+	}
+	if err := s.adp.SchedMsgDelete(late.Uid(), alice.Uid()); err != types.ErrNotFound {
+		t.Error("SchedMsgDelete twice: expected ErrNotFound, got", err)
+	}
+	if err := s.adp.SchedMsgDelete(other.Uid(), types.ZeroUid); err != nil {
+		t.Error("SchedMsgDelete by any user:", err)
+	}
+	if got, _ = s.adp.SchedMsgGetDue(s.at(10), accept, 10); len(got) != 1 || got[0].Id != early.Id {
+		t.Error(mismatch("SchedMsgGetDue after delete", got, early.Id))
+	}
+}
+
+// ================== Reactions ===================================
+
+func (s *suite) testReactions(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	topic := s.createTopic(t, alice)
+	s.saveMessages(t, topic.Id, 3, alice)
+
+	react := func(user *types.User, seq int, value string) {
+		if err := s.adp.ReactionUpsert(&types.Reaction{
+			CreatedAt: s.at(seq),
+			Topic:     topic.Id,
+			SeqId:     seq,
+			User:      user.Id,
+			Value:     value,
+		}); err != nil {
+			t.Fatal("ReactionUpsert:", err)
+		}
+	}
+	react(alice, 1, "👍")
+	react(bob, 1, "❤️")
+	react(alice, 3, "😂")
+	// Replaces the earlier reaction.
+	react(alice, 1, "🔥")
+
+	got, err := s.adp.ReactionGetAll(topic.Id, nil)
+	if err != nil || len(got) != 3 {
+		t.Fatal(mismatch("ReactionGetAll", got, 3), err)
+	}
+	values := make(map[string]string)
+	for _, r := range got {
+		values[strconv.Itoa(r.SeqId)+r.User] = r.Value
+	}
+	want := map[string]string{strconv.Itoa(1) + alice.Id: "🔥", strconv.Itoa(1) + bob.Id: "❤️", strconv.Itoa(3) + alice.Id: "😂"}
+	if !reflect.DeepEqual(values, want) {
+		t.Error(mismatch("Reactions", values, want))
+	}
+	if got[2].SeqId != 3 {
+		t.Error("Reactions are not ordered by seq ID:", got)
+	}
+
+	if got, _ = s.adp.ReactionGetAll(topic.Id, &types.QueryOpt{Since: 2}); len(got) != 1 || got[0].SeqId != 3 {
+		t.Error(mismatch("ReactionGetAll since", got, 3))
+	}
+	if got, _ = s.adp.ReactionGetAll(topic.Id, &types.QueryOpt{Before: 3}); len(got) != 2 {
+		t.Error(mismatch("ReactionGetAll before", len(got), 2))
+	}
+
+	if err := s.adp.ReactionDelete(topic.Id, 1, bob.Uid()); err != nil {
+		t.Fatal("ReactionDelete:", err)
+	}
+	if got, _ = s.adp.ReactionGetAll(topic.Id, &types.QueryOpt{Since: 1, Before: 2}); len(got) != 1 || got[0].User != alice.Id {
+		t.Error(mismatch("ReactionGetAll after delete", got, alice.Id))
+	}
+}
+
+// ================== Devices =====================================
+
+func (s *suite) testDevices(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+
+	android := &types.DeviceDef{DeviceId: "2934ujfoviwj09ntf094", Platform: "Android", LastSeen: s.now, Lang: "en_US"}
+	ios := &types.DeviceDef{DeviceId: "pogpjb023b09gfdmp", Platform: "iOS", LastSeen: s.now, Lang: "en_US"}
+
+	if err := s.adp.DeviceUpsert(alice.Uid(), android); err != nil {
+		t.Fatal("DeviceUpsert:", err)
+	}
+	android.Platform = "Web"
+	android.LastSeen = s.at(1)
+	if err := s.adp.DeviceUpsert(alice.Uid(), android); err != nil {
+		t.Fatal("DeviceUpsert update:", err)
+	}
+	if err := s.adp.DeviceUpsert(alice.Uid(), ios); err != nil {
+		t.Fatal("DeviceUpsert:", err)
+	}
+
+	devs, count, err := s.adp.DeviceGetAll(alice.Uid(), bob.Uid())
+	if err != nil || count != 2 || len(devs[alice.Uid()]) != 2 {
+		t.Fatal(mismatch("DeviceGetAll", devs, 2), err)
+	}
+	for _, dev := range devs[alice.Uid()] {
+		if dev.DeviceId == android.DeviceId && (dev.Platform != "Web" || !dev.LastSeen.Equal(s.at(1)) || dev.Lang != "en_US") {
+			t.Error(mismatch("Updated device", dev, android))
+		}
+	}
+
+	// Device ID is unique: registering it for another user removes it from the previous one.
+	if err := s.adp.DeviceUpsert(bob.Uid(), android); err != nil {
+		t.Fatal("DeviceUpsert other user:", err)
+	}
+	devs, count, _ = s.adp.DeviceGetAll(alice.Uid(), bob.Uid())
+	if count != 2 || len(devs[alice.Uid()]) != 1 || devs[bob.Uid()][0].DeviceId != android.DeviceId {
+		t.Error(mismatch("DeviceGetAll after move", devs, android.DeviceId))
+	}
+
+	if err := s.adp.DeviceDelete(bob.Uid(), android.DeviceId); err != nil {
+		t.Fatal("DeviceDelete:", err)
+	}
+	if err := s.adp.DeviceDelete(alice.Uid(), ""); err != nil {
+		t.Fatal("DeviceDelete all:", err)
+	}
+	if _, count, _ = s.adp.DeviceGetAll(alice.Uid(), bob.Uid()); count != 0 {
+		t.Error(mismatch("DeviceGetAll after delete", count, 0))
+	}
+}
+
+// ================== Files =======================================
+
+func (s *suite) testFiles(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	topic := s.createTopic(t, alice)
+	msgs := s.saveMessages(t, topic.Id, 1, alice)
+
+	var files []*types.FileDef
+	for i := 1; i <= 6; i++ {
+		fd := &types.FileDef{
+			ObjHeader: types.ObjHeader{Id: s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+			Status:    types.UploadStarted,
+			User:      alice.Id,
+			MimeType:  "image/png",
+			Location:  "uploads/file" + strconv.Itoa(i) + ".png",
+		}
+		if err := s.adp.FileStartUpload(fd); err != nil {
+			t.Fatal("FileStartUpload:", err)
+		}
+		files = append(files, fd)
+	}
+
+	got, err := s.adp.FileGet(files[0].Id)
+	if err != nil || got == nil || got.Status != types.UploadStarted || got.User != alice.Id ||
+		got.MimeType != "image/png" || got.Location != files[0].Location {
+		t.Fatal(mismatch("FileGet", got, files[0]), err)
+	}
+	if got, err = s.adp.FileGet(s.uGen.GetStr()); err != nil || got != nil {
+		t.Error("FileGet not found:", got, err)
+	}
+
+	for _, fd := range files[:5] {
+		if got, err = s.adp.FileFinishUpload(fd, true, 100); err != nil || got.Status != types.UploadCompleted || got.Size != 100 {
+			t.Fatal(mismatch("FileFinishUpload", got, types.UploadCompleted), err)
+		}
+	}
+	if got, _ = s.adp.FileGet(files[0].Id); got.Status != types.UploadCompleted || got.Size != 100 {
+		t.Error(mismatch("Completed file", got, types.UploadCompleted))
+	}
+	// Failed uploads are deleted.
+	if got, err = s.adp.FileFinishUpload(files[5], false, 0); err != nil || got.Status != types.UploadFailed {
+		t.Error(mismatch("FileFinishUpload failed", got, types.UploadFailed), err)
+	}
+	if got, _ = s.adp.FileGet(files[5].Id); got != nil {
+		t.Error("Failed upload is not deleted:", got)
+	}
+
+	if err := s.adp.FileLinkAttachments("", types.ZeroUid, msgs[0].Uid(), []string{files[0].Id, files[1].Id}); err != nil {
+		t.Fatal("FileLinkAttachments message:", err)
+	}
+	if err := s.adp.FileLinkAttachments(topic.Id, types.ZeroUid, types.ZeroUid, []string{files[2].Id}); err != nil {
+		t.Fatal("FileLinkAttachments topic:", err)
+	}
+	if err := s.adp.FileLinkAttachments("", alice.Uid(), types.ZeroUid, []string{files[3].Id}); err != nil {
+		t.Fatal("FileLinkAttachments user:", err)
+	}
+	if err := s.adp.FileLinkAttachments("", types.ZeroUid, msgs[0].Uid(), nil); err != types.ErrMalformed {
+		t.Error("FileLinkAttachments without files: expected ErrMalformed, got", err)
+	}
+
+	// Files updated after the cutoff are not deleted. Completion of upload sets the current time.
+	locs, err := s.adp.FileDeleteUnused(s.now, 10)
+	if err != nil || len(locs) != 0 {
+		t.Error("FileDeleteUnused deleted new files:", locs, err)
+	}
+	// Only the unlinked file is deleted.
+	locs, _ = s.adp.FileDeleteUnused(time.Now().Add(time.Minute), 10)
+	if want := []string{files[4].Location}; !reflect.DeepEqual(locs, want) {
+		t.Error(mismatch("FileDeleteUnused", locs, want))
+	}
+
+	// A new avatar replaces the old one which becomes unused.
+	if err := s.adp.FileLinkAttachments("", alice.Uid(), types.ZeroUid, []string{files[1].Id}); err != nil {
+		t.Fatal("FileLinkAttachments user:", err)
+	}
+	if locs, _ = s.adp.FileDeleteUnused(time.Time{}, 10); !reflect.DeepEqual(locs, []string{files[3].Location}) {
+		t.Error(mismatch("FileDeleteUnused replaced avatar", locs, []string{files[3].Location}))
+	}
+
+	// Files of hard-deleted messages are unused.
+	s.deleteMessages(t, topic.Id, nil, 1, types.Range{Low: 1})
+	locs, _ = s.adp.FileDeleteUnused(time.Time{}, 10)
+	sort.Strings(locs)
+	if want := []string{files[0].Location}; !reflect.DeepEqual(locs, want) {
+		t.Error(mismatch("FileDeleteUnused deleted message", locs, want))
+	}
+}
+
+// ================== Persistent cache ============================
+
+func (s *suite) testPCache(t *testing.T) {
+	s.reset(t)
+
+	if err := s.adp.PCacheUpsert("test:key1", "value1", true); err != nil {
+		t.Fatal("PCacheUpsert:", err)
+	}
+	if err := s.adp.PCacheUpsert("test:key1", "value2", true); err != types.ErrDuplicate {
+		t.Error("PCacheUpsert duplicate: expected ErrDuplicate, got", err)
+	}
+	if value, err := s.adp.PCacheGet("test:key1"); err != nil || value != "value1" {
+		t.Error(mismatch("PCacheGet", value, "value1"), err)
+	}
+	if err := s.adp.PCacheUpsert("test:key1", "value2", false); err != nil {
+		t.Fatal("PCacheUpsert update:", err)
+	}
+	if value, _ := s.adp.PCacheGet("test:key1"); value != "value2" {
+		t.Error(mismatch("PCacheGet updated", value, "value2"))
+	}
+	if _, err := s.adp.PCacheGet("test:nothing"); err != types.ErrNotFound {
+		t.Error("PCacheGet not found: expected ErrNotFound, got", err)
+	}
+
+	if err := s.adp.PCacheDelete("test:key1"); err != nil {
+		t.Fatal("PCacheDelete:", err)
+	}
+	if _, err := s.adp.PCacheGet("test:key1"); err != types.ErrNotFound {
+		t.Error("Deleted entry is found:", err)
+	}
+
+	s.adp.PCacheUpsert("test:key2", "value", false)
+	s.adp.PCacheUpsert("other:key3", "value", false)
+	// Entries are time-stamped with the current time.
+	if err := s.adp.PCacheExpire("test:", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal("PCacheExpire:", err)
+	}
+	if _, err := s.adp.PCacheGet("test:key2"); err != nil {
+		t.Error("New entry is expired:", err)
+	}
+	if err := s.adp.PCacheExpire("test:", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal("PCacheExpire:", err)
+	}
+	if _, err := s.adp.PCacheGet("test:key2"); err != types.ErrNotFound {
+		t.Error("Entry is not expired:", err)
+	}
+	if _, err := s.adp.PCacheGet("other:key3"); err != nil {
+		t.Error("Entry with another prefix is expired:", err)
+	}
+}
+
+// ================== Outbox of change events ======================
+
+// outboxOffsets returns offsets of all entries of the outbox table.
+func (s *suite) outboxOffsets(t *testing.T) []string {
+	t.Helper()
+	entries, err := s.adp.OutboxGet(100)
+	if err != nil {
+		t.Fatal("OutboxGet:", err)
+	}
+	var offsets []string
+	for _, entry := range entries {
+		offsets = append(offsets, entry.Offset)
+	}
+	return offsets
+}
+
+// withOutbox returns an adapter which adds a single event with the given offset in the transaction of the
+// next change.
+func (s *suite) withOutbox(t *testing.T, offset string) (adapter.Adapter, *adapter.Outbox) {
+	t.Helper()
+	outbox := &adapter.Outbox{Entries: func() []adapter.OutboxEntry {
+		return []adapter.OutboxEntry{{Offset: offset, Event: `{"offset":"` + offset + `"}`}}
+	}}
+	return s.adp.WithOutbox(outbox), outbox
+}
+
+func (s *suite) testOutbox(t *testing.T) {
+	s.reset(t)
+
+	if txAdp, _ := s.withOutbox(t, "0"); txAdp == nil {
+		// Events are kept in the persistent cache.
+		if _, err := s.adp.OutboxGet(10); err != types.ErrUnsupported {
+			t.Error("OutboxGet without outbox table: expected ErrUnsupported, got", err)
+		}
+		return
+	}
+
+	if err := s.adp.OutboxAdd([]adapter.OutboxEntry{{Offset: "2", Event: "{}"}, {Offset: "1", Event: "{}"}}); err != nil {
+		t.Fatal("OutboxAdd:", err)
+	}
+	if got, want := s.outboxOffsets(t), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Error(mismatch("OutboxGet", got, want))
+	}
+	if entries, err := s.adp.OutboxGet(1); err != nil || len(entries) != 1 || entries[0].Offset != "1" ||
+		entries[0].Event != "{}" {
+		t.Error(mismatch("OutboxGet limit", entries, "[{1 {}}]"), err)
+	}
+
+	// Events are added in the transaction of a multi-statement change.
+	alice := s.createUser(t, "Alice")
+	txAdp, outbox := s.withOutbox(t, "3")
+	if err := txAdp.UserUpdate(alice.Uid(), map[string]any{"UserAgent": "test"}); err != nil {
+		t.Fatal("UserUpdate with outbox:", err)
+	}
+	if !outbox.Written {
+		t.Error("UserUpdate: outbox is not written")
+	}
+	// And of a single-statement change.
+	txAdp, outbox = s.withOutbox(t, "4")
+	if err := txAdp.FileStartUpload(&types.FileDef{
+		ObjHeader: types.ObjHeader{Id: s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+		Status:    types.UploadStarted,
+		User:      alice.Id,
+		MimeType:  "image/png",
+		Location:  "uploads/outbox.png",
+	}); err != nil {
+		t.Fatal("FileStartUpload with outbox:", err)
+	}
+	if !outbox.Written {
+		t.Error("FileStartUpload: outbox is not written")
+	}
+	// Events of failed changes are rolled back with the change.
+	txAdp, outbox = s.withOutbox(t, "5")
+	if err := txAdp.SubsDelete("grpNothing", alice.Uid()); err != types.ErrNotFound {
+		t.Error("SubsDelete not found: expected ErrNotFound, got", err)
+	}
+	if outbox.Written {
+		t.Error("SubsDelete not found: outbox is written")
+	}
+	// Only the first change made through the adapter adds the events.
+	if err := txAdp.UserUpdate(alice.Uid(), map[string]any{"UserAgent": "test2"}); err != nil {
+		t.Fatal("UserUpdate with outbox:", err)
+	}
+	if err := txAdp.UserUpdate(alice.Uid(), map[string]any{"UserAgent": "test3"}); err != nil {
+		t.Fatal("UserUpdate with written outbox:", err)
+	}
+	if got, want := s.outboxOffsets(t), []string{"1", "2", "3", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Error(mismatch("OutboxGet after changes", got, want))
+	}
+
+	if err := s.adp.OutboxDelete([]string{"1", "3", "9"}); err != nil {
+		t.Fatal("OutboxDelete:", err)
+	}
+	if got, want := s.outboxOffsets(t), []string{"2", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Error(mismatch("OutboxGet after delete", got, want))
+	}
+	if err := s.adp.OutboxDelete(nil); err != nil {
+		t.Error("OutboxDelete nothing:", err)
+	}
+}
+
+// ================== Data export =================================
+
+func (s *suite) testExport(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	carol := s.createUser(t, "Carol")
+	if err := s.adp.UserDelete(carol.Uid(), false); err != nil {
+		t.Fatal("UserDelete:", err)
+	}
+	if err := s.adp.AuthAddRecord(alice.Uid(), "basic", "alice", auth.LevelAuth, []byte("secret"), time.Time{}); err != nil {
+		t.Fatal("AuthAddRecord:", err)
+	}
+	topic := s.createTopic(t, alice)
+	other := s.createTopic(t, bob)
+	msgs := s.saveMessages(t, topic.Id, 5, alice, bob)
+
+	var files []string
+	for i := 1; i <= 3; i++ {
+		fd := &types.FileDef{
+			ObjHeader: types.ObjHeader{Id: s.uGen.GetStr(), CreatedAt: s.now, UpdatedAt: s.now},
+			Status:    types.UploadStarted,
+			User:      alice.Id,
+			MimeType:  "image/png",
+			Location:  "uploads/export" + strconv.Itoa(i) + ".png",
+		}
+		if err := s.adp.FileStartUpload(fd); err != nil {
+			t.Fatal("FileStartUpload:", err)
+		}
+		files = append(files, fd.Id)
+	}
+	if err := s.adp.FileLinkAttachments("", alice.Uid(), types.ZeroUid, files[0:1]); err != nil {
+		t.Fatal("FileLinkAttachments user:", err)
+	}
+	if err := s.adp.FileLinkAttachments(topic.Id, types.ZeroUid, types.ZeroUid, files[1:2]); err != nil {
+		t.Fatal("FileLinkAttachments topic:", err)
+	}
+	if err := s.adp.FileLinkAttachments("", types.ZeroUid, msgs[0].Uid(), files[1:3]); err != nil {
+		t.Fatal("FileLinkAttachments message:", err)
+	}
+	// Hard-deleted messages are not exported, soft-deleted are.
+	s.deleteMessages(t, topic.Id, nil, 1, types.Range{Low: 2})
+	s.deleteMessages(t, topic.Id, bob, 2, types.Range{Low: 3})
+
+	// Users, including soft-deleted, are returned page by page.
+	var users []types.User
+	var after types.Uid
+	for {
+		page, err := s.adp.UserExport(after, 2)
+		if err != nil {
+			t.Fatal("UserExport:", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		users = append(users, page...)
+		after = types.ParseUid(page[len(page)-1].Id)
+	}
+	userIds := map[string]*types.User{}
+	for i := range users {
+		userIds[users[i].Id] = &users[i]
+	}
+	if len(users) != 3 || len(userIds) != 3 || userIds[carol.Id] == nil {
+		t.Fatal(mismatch("UserExport", users, []string{alice.Id, bob.Id, carol.Id}))
+	}
+	if got := userIds[alice.Id]; !jsonEqual(got.Public, alice.Public) ||
+		!reflect.DeepEqual([]string(got.Attachments), files[0:1]) {
+		t.Error(mismatch("UserExport alice", got, alice))
+	}
+	if got := userIds[carol.Id]; got.State != types.StateDeleted {
+		t.Error(mismatch("UserExport deleted state", got.State, types.StateDeleted))
+	}
+
+	records, err := s.adp.AuthExport(alice.Uid())
+	if err != nil || len(records) != 1 || records[0].Scheme != "basic" || records[0].Unique != "alice" ||
+		records[0].AuthLvl != auth.LevelAuth || string(records[0].Secret) != "secret" {
+		t.Error(mismatch("AuthExport", records, "basic:alice"), err)
+	}
+	if records, err = s.adp.AuthExport(bob.Uid()); err != nil || len(records) != 0 {
+		t.Error(mismatch("AuthExport none", records, nil), err)
+	}
+
+	var topics []types.Topic
+	for afterTopic := ""; ; {
+		page, err := s.adp.TopicExport(afterTopic, 1)
+		if err != nil {
+			t.Fatal("TopicExport:", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		topics = append(topics, page...)
+		afterTopic = page[len(page)-1].Id
+	}
+	names := map[string]*types.Topic{}
+	for i := range topics {
+		names[topics[i].Id] = &topics[i]
+	}
+	// The 'sys' topic is created with the database.
+	if len(topics) != 3 || names[topic.Id] == nil || names[other.Id] == nil || names["sys"] == nil {
+		t.Fatal(mismatch("TopicExport", topics, []string{topic.Id, other.Id, "sys"}))
+	}
+	if got := names[topic.Id]; got.Owner != alice.Id || got.SeqId != 5 ||
+		!reflect.DeepEqual([]string(got.Attachments), files[1:2]) {
+		t.Error(mismatch("TopicExport topic", got, topic))
+	}
+
+	var exported []types.Message
+	for seq := 0; ; {
+		page, err := s.adp.MessageExport(topic.Id, types.ZeroUid, seq, 2)
+		if err != nil {
+			t.Fatal("MessageExport:", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		exported = append(exported, page...)
+		seq = page[len(page)-1].SeqId
+	}
+	if got, want := seqIds(exported), []int{1, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatal(mismatch("MessageExport", got, want))
+	}
+	if got := exported[0]; got.From != bob.Id || got.Content != "message one" || got.PlainText != "message one" {
+		t.Error(mismatch("MessageExport message", got, msgs[0]))
+	}
+	if got := exported[0].Attachments; len(got) != 2 || !reflect.DeepEqual(sortedStrings(got), sortedStrings(files[1:3])) {
+		t.Error(mismatch("MessageExport attachments", got, files[1:3]))
+	}
+	// Only messages of the sender.
+	page, err := s.adp.MessageExport(topic.Id, bob.Uid(), 0, 0)
+	if want := []int{1, 3, 5}; err != nil || !reflect.DeepEqual(seqIds(page), want) {
+		t.Error(mismatch("MessageExport from", seqIds(page), want), err)
+	}
+	if page, err = s.adp.MessageExport(topic.Id, bob.Uid(), 3, 1); err != nil || !reflect.DeepEqual(seqIds(page), []int{5}) {
+		t.Error(mismatch("MessageExport from after", seqIds(page), []int{5}), err)
+	}
+	if page, err := s.adp.MessageExport(other.Id, types.ZeroUid, 0, 0); err != nil || len(page) != 0 {
+		t.Error(mismatch("MessageExport empty", page, nil), err)
+	}
+
+	var fileIds []string
+	for afterFile := ""; ; {
+		page, err := s.adp.FileExport(afterFile, 2)
+		if err != nil {
+			t.Fatal("FileExport:", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, fd := range page {
+			if fd.User != alice.Id || fd.MimeType != "image/png" {
+				t.Error(mismatch("FileExport file", fd, alice.Id))
+			}
+			fileIds = append(fileIds, fd.Id)
+		}
+		afterFile = page[len(page)-1].Id
+	}
+	if got := sortedStrings(fileIds); !reflect.DeepEqual(got, sortedStrings(files)) {
+		t.Error(mismatch("FileExport", got, files))
+	}
+
+	for _, key := range []string{"test:b", "test:a", "test:c"} {
+		if err := s.adp.PCacheUpsert(key, "value "+key, false); err != nil {
+			t.Fatal("PCacheUpsert:", err)
+		}
+	}
+	var entries []adapter.PCacheEntry
+	for afterKey := ""; ; {
+		page, err := s.adp.PCacheExport(afterKey, 2)
+		if err != nil {
+			t.Fatal("PCacheExport:", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		entries = append(entries, page...)
+		afterKey = page[len(page)-1].Key
+	}
+	want := []adapter.PCacheEntry{
+		{Key: "test:a", Value: "value test:a"},
+		{Key: "test:b", Value: "value test:b"},
+		{Key: "test:c", Value: "value test:c"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Error(mismatch("PCacheExport", entries, want))
+	}
+}
+
+// ================== User deletion ===============================
+
+func (s *suite) testUserDelete(t *testing.T) {
+	s.reset(t)
+
+	alice := s.createUser(t, "Alice")
+	bob := s.createUser(t, "Bob")
+	carol := s.createUser(t, "Carol")
+	owned := s.createTopic(t, alice)
+	s.subscribe(t, owned.Id, bob, types.ModeCPublic, s.now)
+	other := s.createTopic(t, carol)
+	s.subscribe(t, other.Id, alice, types.ModeCPublic, s.now)
+	s.subscribe(t, other.Id, bob, types.ModeCPublic, s.now)
+	p2p := s.createP2P(t, alice, carol)
+
+	// Soft delete: the user, topics owned by the user and p2p topics are marked as deleted.
+	if err := s.adp.UserDelete(alice.Uid(), false); err != nil {
+		t.Fatal("UserDelete soft:", err)
+	}
+	if got, _ := s.adp.UserGet(alice.Uid()); got != nil {
+		t.Error("Soft-deleted user is returned:", got)
+	}
+	if got, _ := s.adp.UserGetAll(alice.Uid()); len(got) != 0 {
+		t.Error("Soft-deleted user is returned:", got)
+	}
+	for _, name := range []string{owned.Id, p2p} {
+		if got, _ := s.adp.TopicGet(name); got == nil || got.State != types.StateDeleted {
+			t.Error("Topic of soft-deleted user is not deleted:", name, got)
+		}
+	}
+	if got, _ := s.adp.TopicGet(other.Id); got == nil || got.State != types.StateOK {
+		t.Error("Topic of another user is deleted:", got)
+	}
+	if subs, _ := s.adp.SubsForUser(alice.Uid()); len(subs) != 0 {
+		t.Error("Subscriptions of soft-deleted user:", subs)
+	}
+	if sub, _ := s.adp.SubscriptionGet(owned.Id, bob.Uid(), false); sub != nil {
+		t.Error("Subscription to deleted topic:", sub)
+	}
+	if sub, _ := s.adp.SubscriptionGet(p2p, carol.Uid(), false); sub != nil {
+		t.Error("Subscription to deleted p2p topic:", sub)
+	}
+	if sub, _ := s.adp.SubscriptionGet(other.Id, bob.Uid(), false); sub == nil {
+		t.Error("Subscription of another user is deleted")
+	}
+
+	// Hard delete: all user's data is removed.
+	s.adp.AuthAddRecord(bob.Uid(), "basic", "basic:bob", auth.LevelAuth, []byte("bob"), time.Time{})
+	s.adp.CredUpsert(&types.Credential{User: bob.Id, Method: "email", Value: "bob@example.com", Done: true})
+	s.adp.DeviceUpsert(bob.Uid(), &types.DeviceDef{DeviceId: "bobs-device", Platform: "Web", LastSeen: s.now})
+	bobs := s.createTopic(t, bob)
+	s.saveMessages(t, bobs.Id, 2, bob)
+
+	if err := s.adp.UserDelete(bob.Uid(), true); err != nil {
+		t.Fatal("UserDelete hard:", err)
+	}
+	if got, _ := s.adp.UserGet(bob.Uid()); got != nil {
+		t.Error("Hard-deleted user is returned:", got)
+	}
+	if _, _, _, _, err := s.adp.AuthGetRecord(bob.Uid(), "basic"); err != types.ErrNotFound {
+		t.Error("Auth record of hard-deleted user:", err)
+	}
+	if uid, _ := s.adp.UserGetByCred("email", "bob@example.com"); !uid.IsZero() {
+		t.Error("Credential of hard-deleted user:", uid)
+	}
+	if _, count, _ := s.adp.DeviceGetAll(bob.Uid()); count != 0 {
+		t.Error("Devices of hard-deleted user:", count)
+	}
+	if got, _ := s.adp.TopicGet(bobs.Id); got != nil {
+		t.Error("Topic of hard-deleted user:", got)
+	}
+	if got, _ := s.adp.MessageGetAll(bobs.Id, carol.Uid(), nil); len(got) != 0 {
+		t.Error("Messages in topic of hard-deleted user:", seqIds(got))
+	}
+	if sub, _ := s.adp.SubscriptionGet(other.Id, bob.Uid(), true); sub != nil {
+		t.Error("Subscription of hard-deleted user:", sub)
+	}
+}
+
+// ================================================================
+
+func mismatch(key string, got, want any) string {
+	return fmt.Sprintf("%v mismatch:\nGot  = %+v\nWant = %+v", key, got, want)
+}
+
+// jsonEqual compares values by their JSON representation: adapters may return JSON values as
+// different types.
+func jsonEqual(a, b any) bool {
+	ja, err1 := json.Marshal(a)
+	jb, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(ja) == string(jb)
+}
+
+func seqIds(msgs []types.Message) []int {
+	var ids []int
+	for _, msg := range msgs {
+		ids = append(ids, msg.SeqId)
+	}
+	return ids
+}
+
+func topicNames(subs []types.Subscription) []string {
+	var names []string
+	for _, sub := range subs {
+		names = append(names, sub.Topic)
+	}
+	return names
+}
+
+func delMessagesEqual(got, want []types.DelMessage) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i].Topic != want[i].Topic || got[i].DeletedFor != want[i].DeletedFor || got[i].DelId != want[i].DelId ||
+			!reflect.DeepEqual(got[i].SeqIdRanges, want[i].SeqIdRanges) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedStrings(src []string) []string {
+	dst := append([]string{}, src...)
+	sort.Strings(dst)
+	return dst
+}
+
+func queryString(opts *types.QueryOpt) string {
+	if opts == nil {
+		return "(nil)"
+	}
+	return fmt.Sprintf("(since=%d before=%d limit=%d)", opts.Since, opts.Before, opts.Limit)
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -96,3 +97,71 @@ func TestSelectEarliestUpdatedSubs(t *testing.T) {
 		t.Error("Count & date limited query returned wrong results. Expected:", expectedOrder, "; Got:", sortOrder)
 	}
 }
+
+func TestReplicasPick(t *testing.T) {
+	r := NewReplicas([]string{"replica1", "replica2"}, 0)
+
+	// Round robin between healthy replicas.
+	if got := []int{r.Pick("grpTest"), r.Pick("grpTest"), r.Pick("grpTest")}; got[0] != 0 || got[1] != 1 || got[2] != 0 {
+		t.Errorf("Expected round robin [0 1 0], got %v", got)
+	}
+
+	// Lagging and failing replicas are not used.
+	r.Update(0, DefaultReplicaMaxLag+time.Second, nil)
+	if got := r.Pick("grpTest"); got != 1 {
+		t.Errorf("Expected the second replica, got %d", got)
+	}
+	r.Update(1, 0, errors.New("connection refused"))
+	if got := r.Pick("grpTest"); got != -1 {
+		t.Errorf("Expected the primary when no replica is healthy, got %d", got)
+	}
+
+	// Recently written data is read from the primary.
+	r.Update(0, 0, nil)
+	r.Update(1, 0, nil)
+	r.Wrote("grpTest", "usrAlice")
+	if got := r.Pick("grpTest"); got != -1 {
+		t.Errorf("Expected the primary after a write to the topic, got %d", got)
+	}
+	if got := r.Pick("usrAlice"); got != -1 {
+		t.Errorf("Expected the primary after a write for the user, got %d", got)
+	}
+	if got := r.Pick("grpOther"); got < 0 {
+		t.Errorf("Expected a replica for another topic, got %d", got)
+	}
+	// The write is old enough to be replicated.
+	r.writes["grpTest"] = time.Now().Add(-2 * ReplicaCheckPeriod)
+	if got := r.Pick("grpTest"); got < 0 {
+		t.Errorf("Expected a replica after the write is replicated, got %d", got)
+	}
+
+	stats, primaryReads := r.Stats()
+	if len(stats) != 2 || primaryReads != 3 {
+		t.Fatalf("Expected 2 replicas and 3 primary reads, got %d, %d", len(stats), primaryReads)
+	}
+	if !stats[0].Healthy || stats[1].Error != "" || stats[0].Reads+stats[1].Reads != 6 {
+		t.Errorf("Unexpected replica stats %+v", stats)
+	}
+}
+
+func TestReplicasHealthCheck(t *testing.T) {
+	r := NewReplicas([]string{"replica1"}, time.Second)
+	checked := make(chan bool, 1)
+	r.Start(func(i int) (time.Duration, error) {
+		select {
+		case checked <- true:
+		default:
+		}
+		return 2 * time.Second, nil
+	})
+	<-checked
+	r.Stop()
+
+	stats, _ := r.Stats()
+	if stats[0].Healthy || stats[0].Lag != 2 || stats[0].CheckedAt.IsZero() {
+		t.Errorf("Expected the lagging replica to be unhealthy, got %+v", stats[0])
+	}
+	if got := r.Pick("grpTest"); got != -1 {
+		t.Errorf("Expected the primary, got %d", got)
+	}
+}
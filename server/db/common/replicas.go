@@ -0,0 +1,179 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How often to check health and lag of replicas.
+	ReplicaCheckPeriod = 5 * time.Second
+	// Default maximum replication lag of a usable replica.
+	DefaultReplicaMaxLag = 10 * time.Second
+)
+
+// ReplicaStats is the health of a read replica as reported in adapter stats.
+type ReplicaStats struct {
+	// Host of the replica (without credentials).
+	Host string `json:"host"`
+	// The replica answered the last health check and is not lagging too much.
+	Healthy bool `json:"healthy"`
+	// Replication lag in seconds at the time of the last check.
+	Lag float64 `json:"lag"`
+	// Time of the last health check.
+	CheckedAt time.Time `json:"checked_at"`
+	// Error returned by the last health check.
+	Error string `json:"error,omitempty"`
+	// Number of queries routed to the replica.
+	Reads int64 `json:"reads"`
+}
+
+// Replicas routes read queries between read replicas of a database. Replicas which fail health
+// checks or lag more than the configured limit are not used. Reads of data written recently
+// through this instance are routed to the primary to make sure the writes are visible.
+type Replicas struct {
+	lock   sync.Mutex
+	stats  []ReplicaStats
+	lags   []time.Duration
+	next   int
+	maxLag time.Duration
+	// Time of the last write by key: topic name or user ID.
+	writes map[string]time.Time
+	// Reads routed to the primary.
+	primaryReads int64
+
+	stop chan bool
+	done chan bool
+}
+
+// NewReplicas creates a router for replicas with the given hosts. Replicas are considered
+// healthy until the first check.
+func NewReplicas(hosts []string, maxLag time.Duration) *Replicas {
+	if maxLag <= 0 {
+		maxLag = DefaultReplicaMaxLag
+	}
+	r := &Replicas{
+		stats:  make([]ReplicaStats, len(hosts)),
+		lags:   make([]time.Duration, len(hosts)),
+		maxLag: maxLag,
+		writes: make(map[string]time.Time),
+	}
+	for i, host := range hosts {
+		r.stats[i] = ReplicaStats{Host: host, Healthy: true}
+	}
+	return r
+}
+
+// Pick returns the index of the replica to read data of the given keys from or -1 to read from the primary.
+func (r *Replicas) Pick(keys ...string) int {
+	if r == nil {
+		return -1
+	}
+
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for n := 0; n < len(r.stats); n++ {
+		i := (r.next + n) % len(r.stats)
+		if !r.stats[i].Healthy || r.recentlyWritten(keys, now, r.lags[i]) {
+			continue
+		}
+		r.next = i + 1
+		r.stats[i].Reads++
+		return i
+	}
+	r.primaryReads++
+	return -1
+}
+
+// recentlyWritten checks if any of the keys was written too recently to be available on a replica with the given lag.
+func (r *Replicas) recentlyWritten(keys []string, now time.Time, lag time.Duration) bool {
+	for _, key := range keys {
+		// The lag could have grown since the last check.
+		if at, ok := r.writes[key]; ok && now.Sub(at) <= lag+ReplicaCheckPeriod {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrote records that data of the given keys was just written to the primary.
+func (r *Replicas) Wrote(keys ...string) {
+	if r == nil {
+		return
+	}
+
+	now := time.Now()
+	r.lock.Lock()
+	for _, key := range keys {
+		r.writes[key] = now
+	}
+	r.lock.Unlock()
+}
+
+// Update records the result of a health check of the replica.
+func (r *Replicas) Update(i int, lag time.Duration, err error) {
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.lags[i] = lag
+	r.stats[i].Lag = lag.Seconds()
+	r.stats[i].CheckedAt = now
+	r.stats[i].Healthy = err == nil && lag <= r.maxLag
+	if err != nil {
+		r.stats[i].Error = err.Error()
+	} else {
+		r.stats[i].Error = ""
+	}
+
+	// Writes older than the max lag no longer affect routing.
+	for key, at := range r.writes {
+		if now.Sub(at) > r.maxLag+ReplicaCheckPeriod {
+			delete(r.writes, key)
+		}
+	}
+}
+
+// Stats returns the health of replicas and the number of reads routed to the primary.
+func (r *Replicas) Stats() ([]ReplicaStats, int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := make([]ReplicaStats, len(r.stats))
+	copy(stats, r.stats)
+	return stats, r.primaryReads
+}
+
+// Start runs health checks of replicas every ReplicaCheckPeriod until Stop is called.
+// The check returns the replication lag of the replica with the given index.
+func (r *Replicas) Start(check func(i int) (time.Duration, error)) {
+	stop, done := make(chan bool), make(chan bool)
+	r.stop, r.done = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(ReplicaCheckPeriod)
+		defer ticker.Stop()
+		for {
+			for i := range r.stats {
+				lag, err := check(i)
+				r.Update(i, lag, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates health checks and waits for the running check to complete.
+func (r *Replicas) Stop() {
+	if r != nil && r.stop != nil {
+		close(r.stop)
+		<-r.done
+		r.stop = nil
+	}
+}
@@ -0,0 +1,3150 @@
+// Package memory is a database adapter which keeps all data in the process memory. It's intended
+// for tests and demos: the data is not persisted anywhere and is lost when the adapter is closed.
+// The adapter mimics the behaviour of the SQL adapters, including soft deletion of users, topics,
+// subscriptions and messages.
+//
+// The adapter registers itself with the store only when the server is built with the 'memory' tag.
+// Tests may use GetTestAdapter to obtain an unregistered instance.
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	adp "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/db/common"
+	t "github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// adapter holds the in-memory database.
+type adapter struct {
+	// Guards access to the database.
+	lock sync.RWMutex
+	// The database, nil when the adapter is closed.
+	db *database
+	// Maximum number of records to return
+	maxResults int
+	// Maximum number of message records to return
+	maxMessageResults int
+}
+
+const (
+	adpVersion = 120
+
+	adapterName = "memory"
+
+	defaultMaxResults = 1024
+	// This is capped by the Session's send queue limit (128).
+	defaultMaxMessageResults = 100
+)
+
+// Records stored in the database. All records carry an ID which is assigned sequentially
+// like AUTOINCREMENT in SQL. The ID defines the order in which records are returned when
+// the interface does not specify any particular order.
+
+type userRecord struct {
+	id   int64
+	user t.User
+}
+
+type authRecord struct {
+	id      int64
+	unique  string
+	user    t.Uid
+	scheme  string
+	authLvl auth.Level
+	secret  []byte
+	expires time.Time
+}
+
+type credRecord struct {
+	id   int64
+	user t.Uid
+	cred t.Credential
+	// "method:value" for validated credentials, "user:method:value" for unvalidated. Must be unique.
+	synthetic string
+	deletedAt *time.Time
+}
+
+type topicRecord struct {
+	id    int64
+	topic t.Topic
+}
+
+type subRecord struct {
+	id   int64
+	user t.Uid
+	sub  t.Subscription
+}
+
+type msgRecord struct {
+	id  int64
+	msg t.Message
+}
+
+type revisionRecord struct {
+	createdAt time.Time
+	head      t.MessageHeaders
+	content   any
+}
+
+type dellogRecord struct {
+	deletedFor t.Uid
+	delId      int
+	low        int
+	hi         int
+}
+
+type threadReadKey struct {
+	topic  string
+	user   t.Uid
+	thread int
+}
+
+type schedRecord struct {
+	user t.Uid
+	msg  t.ScheduledMessage
+}
+
+type reactionRecord struct {
+	user t.Uid
+	r    t.Reaction
+}
+
+type deviceRecord struct {
+	user t.Uid
+	def  t.DeviceDef
+}
+
+type fileRecord struct {
+	id int64
+	fd t.FileDef
+}
+
+// fileLink connects an uploaded file to a message, a topic, a user or a scheduled message.
+// The link is removed together with the object it points to.
+type fileLink struct {
+	file  t.Uid
+	msgId t.Uid
+	topic string
+	user  t.Uid
+	sched t.Uid
+}
+
+type kvRecord struct {
+	createdAt time.Time
+	value     string
+}
+
+// database is the collection of all data.
+type database struct {
+	// The last assigned record ID.
+	lastId int64
+
+	users map[t.Uid]*userRecord
+	auth  []*authRecord
+	creds []*credRecord
+
+	topics map[string]*topicRecord
+	// Subscriptions: topic name -> user -> subscription.
+	subs map[string]map[t.Uid]*subRecord
+
+	// Messages: topic name -> messages in the order of saving.
+	messages map[string][]*msgRecord
+	// Earlier revisions of edited messages: message ID -> revisions, oldest first.
+	revisions map[int64][]*revisionRecord
+	// Log of message deletions: topic name -> ranges of deleted messages in the order of deletion.
+	dellog      map[string][]*dellogRecord
+	threadReads map[threadReadKey]int
+	schedMsgs   map[t.Uid]*schedRecord
+	// Reactions: topic name -> reactions in the order of creation.
+	reactions map[string][]*reactionRecord
+
+	devices   []*deviceRecord
+	files     map[t.Uid]*fileRecord
+	fileLinks []*fileLink
+
+	kvmeta map[string]*kvRecord
+}
+
+func newDatabase() *database {
+	db := &database{
+		users:       make(map[t.Uid]*userRecord),
+		topics:      make(map[string]*topicRecord),
+		subs:        make(map[string]map[t.Uid]*subRecord),
+		messages:    make(map[string][]*msgRecord),
+		revisions:   make(map[int64][]*revisionRecord),
+		dellog:      make(map[string][]*dellogRecord),
+		threadReads: make(map[threadReadKey]int),
+		schedMsgs:   make(map[t.Uid]*schedRecord),
+		reactions:   make(map[string][]*reactionRecord),
+		files:       make(map[t.Uid]*fileRecord),
+		kvmeta:      make(map[string]*kvRecord),
+	}
+
+	// Create system topic 'sys'.
+	now := t.TimeNow()
+	db.topics["sys"] = &topicRecord{
+		id: db.nextId(),
+		topic: t.Topic{
+			ObjHeader: t.ObjHeader{Id: "sys", CreatedAt: now, UpdatedAt: now},
+			TouchedAt: now,
+			Access:    t.DefaultAccess{Auth: t.ModeNone, Anon: t.ModeNone},
+			Public:    map[string]any{"fn": "System"},
+		},
+	}
+
+	return db
+}
+
+// nextId returns a new sequential record ID.
+func (db *database) nextId() int64 {
+	db.lastId++
+	return db.lastId
+}
+
+// Open initializes the adapter. The database is created empty.
+func (a *adapter) Open(jsonconfig json.RawMessage) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.db != nil {
+		return errors.New("memory adapter is already open")
+	}
+
+	// The adapter has no configuration options, but the config must be valid if present.
+	if len(jsonconfig) > 0 {
+		var config map[string]any
+		if err := json.Unmarshal(jsonconfig, &config); err != nil {
+			return errors.New("memory adapter failed to parse config: " + err.Error())
+		}
+	}
+
+	if a.maxResults <= 0 {
+		a.maxResults = defaultMaxResults
+	}
+	a.maxMessageResults = defaultMaxMessageResults
+
+	a.db = newDatabase()
+	return nil
+}
+
+// Close drops all data.
+func (a *adapter) Close() error {
+	a.lock.Lock()
+	a.db = nil
+	a.lock.Unlock()
+	return nil
+}
+
+// IsOpen returns true if the adapter is ready for use.
+func (a *adapter) IsOpen() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.db != nil
+}
+
+// GetDbVersion returns current database version.
+func (a *adapter) GetDbVersion() (int, error) {
+	if !a.IsOpen() {
+		return -1, errors.New("Database not initialized")
+	}
+	return adpVersion, nil
+}
+
+// CheckDbVersion checks whether the actual DB version matches the expected version of this adapter.
+func (a *adapter) CheckDbVersion() error {
+	version, err := a.GetDbVersion()
+	if err != nil {
+		return err
+	}
+
+	if version != adpVersion {
+		return errors.New("Invalid database version " + strconv.Itoa(version) +
+			". Expected " + strconv.Itoa(adpVersion))
+	}
+
+	return nil
+}
+
+// Version returns adapter version.
+func (a *adapter) Version() int {
+	return adpVersion
+}
+
+// Stats returns the number of stored records by type.
+func (a *adapter) Stats() any {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if a.db == nil {
+		return nil
+	}
+
+	var subs, msgs int
+	for _, tsubs := range a.db.subs {
+		subs += len(tsubs)
+	}
+	for _, tmsgs := range a.db.messages {
+		msgs += len(tmsgs)
+	}
+	return map[string]int{
+		"users":         len(a.db.users),
+		"topics":        len(a.db.topics),
+		"subscriptions": subs,
+		"messages":      msgs,
+		"files":         len(a.db.files),
+	}
+}
+
+// GetName returns string that adapter uses to register itself with store.
+func (a *adapter) GetName() string {
+	return adapterName
+}
+
+// SetMaxResults configures how many results can be returned in a single DB call.
+func (a *adapter) SetMaxResults(val int) error {
+	if val <= 0 {
+		a.maxResults = defaultMaxResults
+	} else {
+		a.maxResults = val
+	}
+
+	return nil
+}
+
+// CreateDb initializes the storage. The in-memory database is always created anew, all
+// existing data is discarded regardless of the value of 'reset'.
+func (a *adapter) CreateDb(reset bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.db == nil {
+		return errors.New("memory adapter is not open")
+	}
+
+	a.db = newDatabase()
+	return nil
+}
+
+// UpgradeDb upgrades the database, if necessary. The in-memory database is always current.
+func (a *adapter) UpgradeDb() error {
+	_, err := a.GetDbVersion()
+	return err
+}
+
+// User management
+
+// UserCreate creates a new user. Returns t.ErrDuplicate if the user already exists.
+func (a *adapter) UserCreate(user *t.User) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	uid := user.Uid()
+	if _, ok := a.db.users[uid]; ok {
+		return t.ErrDuplicate
+	}
+	if hasDuplicates(user.Tags) {
+		return t.ErrDuplicate
+	}
+
+	a.db.users[uid] = &userRecord{id: a.db.nextId(), user: t.User{
+		ObjHeader: t.ObjHeader{Id: uid.String(), CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt},
+		State:     user.State,
+		StateAt:   copyTime(user.StateAt),
+		Access:    user.Access,
+		LastSeen:  copyTime(user.LastSeen),
+		UserAgent: user.UserAgent,
+		Public:    copyJSON(user.Public),
+		Trusted:   copyJSON(user.Trusted),
+		Tags:      copyStrings(user.Tags),
+	}}
+
+	return nil
+}
+
+// AuthAddRecord adds user's authentication record.
+func (a *adapter) AuthAddRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, rec := range a.db.auth {
+		if rec.unique == unique || (rec.user == uid && rec.scheme == scheme) {
+			return t.ErrDuplicate
+		}
+	}
+
+	a.db.auth = append(a.db.auth, &authRecord{
+		id:      a.db.nextId(),
+		unique:  unique,
+		user:    uid,
+		scheme:  scheme,
+		authLvl: authLvl,
+		secret:  append([]byte(nil), secret...),
+		expires: expires,
+	})
+	return nil
+}
+
+// deleteAuth deletes authentication records matching the filter. Returns the number of deleted records.
+func (db *database) deleteAuth(filter func(rec *authRecord) bool) int {
+	var keep []*authRecord
+	for _, rec := range db.auth {
+		if !filter(rec) {
+			keep = append(keep, rec)
+		}
+	}
+	count := len(db.auth) - len(keep)
+	db.auth = keep
+	return count
+}
+
+// AuthDelScheme deletes an existing authentication scheme for the user.
+func (a *adapter) AuthDelScheme(user t.Uid, scheme string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.db.deleteAuth(func(rec *authRecord) bool {
+		return rec.user == user && rec.scheme == scheme
+	})
+	return nil
+}
+
+// AuthDelAllRecords deletes all authentication records for the user.
+func (a *adapter) AuthDelAllRecords(user t.Uid) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.db.deleteAuth(func(rec *authRecord) bool {
+		return rec.user == user
+	}), nil
+}
+
+// AuthUpdRecord updates user's authentication unique, secret, auth level.
+func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var found *authRecord
+	for _, rec := range a.db.auth {
+		if rec.user == uid && rec.scheme == scheme {
+			found = rec
+		} else if unique != "" && rec.unique == unique {
+			return t.ErrDuplicate
+		}
+	}
+	if found == nil {
+		return t.ErrNotFound
+	}
+
+	found.authLvl = authLvl
+	if unique != "" {
+		found.unique = unique
+	}
+	if len(secret) > 0 {
+		found.secret = append([]byte(nil), secret...)
+	}
+	if !expires.IsZero() {
+		found.expires = expires
+	}
+	return nil
+}
+
+// AuthGetRecord retrieves user's authentication record.
+func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, rec := range a.db.auth {
+		if rec.user == uid && rec.scheme == scheme {
+			return rec.unique, rec.authLvl, append([]byte(nil), rec.secret...), rec.expires, nil
+		}
+	}
+	// Nothing found - use standard error.
+	return "", 0, nil, time.Time{}, t.ErrNotFound
+}
+
+// AuthGetUniqueRecord retrieves user's authentication record by the unique value.
+func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte, time.Time, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, rec := range a.db.auth {
+		if rec.unique == unique {
+			return rec.user, rec.authLvl, append([]byte(nil), rec.secret...), rec.expires, nil
+		}
+	}
+	// Nothing found - not an error.
+	return t.ZeroUid, 0, nil, time.Time{}, nil
+}
+
+// UserGet fetches a single user by user id. If user is not found or soft-deleted it returns (nil, nil).
+func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if rec := a.db.users[uid]; rec != nil && rec.user.State != t.StateDeleted {
+		return copyUser(&rec.user), nil
+	}
+	return nil, nil
+}
+
+// UserGetAll fetches users by IDs skipping those which are not found or soft-deleted.
+func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var users []t.User
+	for _, uid := range uniqueUids(ids) {
+		if rec := a.db.users[uid]; rec != nil && rec.user.State != t.StateDeleted {
+			users = append(users, *copyUser(&rec.user))
+		}
+	}
+	return users, nil
+}
+
+// UserDelete deletes specified user: wipes completely (hard-delete) or marks as deleted.
+func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	db := a.db
+	now := t.TimeNow()
+
+	if hard {
+		// Delete user's devices.
+		db.deleteDevices(uid, "")
+
+		// Delete user's subscriptions in all topics and records of messages soft-deleted for the user.
+		for _, tsubs := range db.subs {
+			delete(tsubs, uid)
+		}
+		for topic := range db.dellog {
+			db.deleteDellog(topic, func(rec *dellogRecord) bool {
+				return rec.deletedFor == uid
+			})
+		}
+
+		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
+		// Just leave the messages there marked as sent by "not found" user.
+
+		// Delete user's reactions to messages, positions in threads and scheduled messages.
+		for topic := range db.reactions {
+			db.deleteReactions(topic, func(rec *reactionRecord) bool {
+				return rec.user == uid
+			})
+		}
+		for key := range db.threadReads {
+			if key.user == uid {
+				delete(db.threadReads, key)
+			}
+		}
+		for id, rec := range db.schedMsgs {
+			if rec.user == uid {
+				db.deleteSchedMsg(id)
+			}
+		}
+
+		// Delete topics where the user is the owner with all their messages and subscriptions.
+		for name, rec := range db.topics {
+			if t.ParseUid(rec.topic.Owner) == uid {
+				db.deleteTopic(name, []string{name})
+			}
+		}
+
+		// Delete user's authentication records and credentials.
+		db.deleteAuth(func(rec *authRecord) bool {
+			return rec.user == uid
+		})
+		db.deleteCreds(func(rec *credRecord) bool {
+			return rec.user == uid
+		})
+
+		db.deleteFileLinks(func(link *fileLink) bool {
+			return link.user == uid
+		})
+		delete(db.users, uid)
+	} else {
+		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
+		for _, tsubs := range db.subs {
+			if rec := tsubs[uid]; rec != nil && rec.sub.DeletedAt == nil {
+				rec.sub.UpdatedAt = now
+				rec.sub.DeletedAt = copyTime(&now)
+			}
+		}
+
+		for name, rec := range db.topics {
+			if t.ParseUid(rec.topic.Owner) == uid {
+				// Disable group topics where the user is the owner and all subscriptions to them.
+				db.disableSubs(name, now)
+			} else if t.GetTopicCat(name) == t.TopicCatP2P && db.subs[name][uid] != nil {
+				// Disable p2p topics with the user and the other user's subscription.
+				db.disableSubs(name, now)
+			} else {
+				continue
+			}
+			rec.topic.UpdatedAt = now
+			rec.topic.TouchedAt = now
+			rec.topic.State = t.StateDeleted
+			rec.topic.StateAt = copyTime(&now)
+		}
+
+		// Disable user.
+		if rec := db.users[uid]; rec != nil {
+			rec.user.UpdatedAt = now
+			rec.user.State = t.StateDeleted
+			rec.user.StateAt = copyTime(&now)
+		}
+	}
+
+	return nil
+}
+
+// UserUpdate updates user object.
+func (a *adapter) UserUpdate(uid t.Uid, update map[string]any) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rec := a.db.users[uid]
+	if rec == nil {
+		return nil
+	}
+
+	user := rec.user
+	if err := applyUpdate(&user, update); err != nil {
+		return err
+	}
+	if hasDuplicates(user.Tags) {
+		return t.ErrDuplicate
+	}
+	rec.user = user
+
+	if state, ok := update["State"]; ok {
+		return a.db.topicStateForUser(uid, update["StateAt"], state)
+	}
+
+	return nil
+}
+
+// topicStateForUser is called by UserUpdate when the update contains state change.
+func (db *database) topicStateForUser(uid t.Uid, stateAt, update any) error {
+	state, ok := update.(t.ObjState)
+	if !ok {
+		return t.ErrMalformed
+	}
+
+	now, _ := stateAt.(time.Time)
+	if now.IsZero() {
+		now = t.TimeNow()
+	}
+
+	// Change state of all topics where the user is the owner and p2p topics with the user.
+	for name, rec := range db.topics {
+		if rec.topic.State == t.StateDeleted {
+			continue
+		}
+		if t.ParseUid(rec.topic.Owner) == uid ||
+			(t.GetTopicCat(name) == t.TopicCatP2P && db.subs[name][uid] != nil) {
+			rec.topic.State = state
+			rec.topic.StateAt = copyTime(&now)
+		}
+	}
+
+	// Subscriptions don't need to be updated:
+	// subscriptions of a disabled user are not disabled and still can be manipulated.
+
+	return nil
+}
+
+// UserUpdateTags adds, removes, or resets user's tags.
+func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rec := a.db.users[uid]
+	if rec == nil {
+		return nil, nil
+	}
+
+	tags := []string(rec.user.Tags)
+	if reset != nil {
+		// Duplicates are not allowed when resetting.
+		if hasDuplicates(reset) {
+			return nil, t.ErrDuplicate
+		}
+		tags = nil
+		add = reset
+		remove = nil
+	}
+
+	allTags := copyStrings(tags)
+	for _, tag := range add {
+		if !contains(allTags, tag) {
+			allTags = append(allTags, tag)
+		}
+	}
+	var result []string
+	for _, tag := range allTags {
+		if !contains(remove, tag) {
+			result = append(result, tag)
+		}
+	}
+
+	rec.user.Tags = result
+	return copyStrings(result), nil
+}
+
+// UserGetByCred returns user ID for the given validated credential.
+func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	synth := method + ":" + value
+	for _, rec := range a.db.creds {
+		if rec.synthetic == synth {
+			return rec.user, nil
+		}
+	}
+	// Not found is not an error.
+	return t.ZeroUid, nil
+}
+
+// UserUnreadCount returns the total number of unread messages in all topics with
+// the R permission.
+func (a *adapter) UserUnreadCount(ids ...t.Uid) (map[t.Uid]int, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	counts := make(map[t.Uid]int, len(ids))
+	for _, uid := range ids {
+		// Ensure all original uids are always present.
+		counts[uid] = 0
+	}
+
+	for name, tsubs := range a.db.subs {
+		top := a.db.topics[name]
+		if top == nil || top.topic.State == t.StateDeleted {
+			continue
+		}
+		for uid, rec := range tsubs {
+			if _, ok := counts[uid]; !ok || rec.sub.DeletedAt != nil {
+				continue
+			}
+			if rec.sub.ModeWant.IsReader() && rec.sub.ModeGiven.IsReader() {
+				counts[uid] += top.topic.SeqId - rec.sub.ReadSeqId
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// UserGetUnvalidated returns a list of uids which have never logged in, have no
+// validated credentials and haven't been updated since lastUpdatedBefore.
+func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]t.Uid, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	validated := make(map[t.Uid]bool)
+	for _, rec := range a.db.creds {
+		if rec.cred.Done {
+			validated[rec.user] = true
+		}
+	}
+
+	var found []*userRecord
+	for uid, rec := range a.db.users {
+		if rec.user.LastSeen == nil && rec.user.UpdatedAt.Before(lastUpdatedBefore) && !validated[uid] {
+			found = append(found, rec)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].user.UpdatedAt.Equal(found[j].user.UpdatedAt) {
+			return found[i].id < found[j].id
+		}
+		return found[i].user.UpdatedAt.Before(found[j].user.UpdatedAt)
+	})
+
+	var uids []t.Uid
+	for _, rec := range found {
+		if len(uids) >= limit {
+			break
+		}
+		uids = append(uids, rec.user.Uid())
+	}
+	return uids, nil
+}
+
+// Topic management
+
+func (db *database) topicCreate(topic *t.Topic) error {
+	if _, ok := db.topics[topic.Id]; ok {
+		return t.ErrDuplicate
+	}
+	if hasDuplicates(topic.Tags) {
+		return t.ErrDuplicate
+	}
+
+	db.topics[topic.Id] = &topicRecord{id: db.nextId(), topic: *copyTopic(topic)}
+	return nil
+}
+
+// TopicCreate saves topic object to database.
+func (a *adapter) TopicCreate(topic *t.Topic) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.db.topicCreate(topic)
+}
+
+// If undelete = true - update subscription on duplicate key, otherwise ignore the duplicate.
+func (db *database) createSubscription(sub *t.Subscription, undelete bool) {
+	uid := t.ParseUid(sub.User)
+
+	tsubs := db.subs[sub.Topic]
+	if tsubs == nil {
+		tsubs = make(map[t.Uid]*subRecord)
+		db.subs[sub.Topic] = tsubs
+	}
+
+	if rec := tsubs[uid]; rec != nil {
+		rec.sub.CreatedAt = sub.CreatedAt
+		rec.sub.UpdatedAt = sub.UpdatedAt
+		rec.sub.DeletedAt = nil
+		rec.sub.ModeWant = sub.ModeWant
+		rec.sub.ModeGiven = sub.ModeGiven
+		rec.sub.DelId = 0
+		rec.sub.RecvSeqId = 0
+		rec.sub.ReadSeqId = 0
+		if !undelete {
+			rec.sub.Private = copyJSON(sub.Private)
+		}
+	} else {
+		tsubs[uid] = &subRecord{id: db.nextId(), user: uid, sub: t.Subscription{
+			ObjHeader: t.ObjHeader{CreatedAt: sub.CreatedAt, UpdatedAt: sub.UpdatedAt},
+			User:      uid.String(),
+			Topic:     sub.Topic,
+			DelId:     sub.DelId,
+			RecvSeqId: sub.RecvSeqId,
+			ReadSeqId: sub.ReadSeqId,
+			ModeWant:  sub.ModeWant,
+			ModeGiven: sub.ModeGiven,
+			Private:   copyJSON(sub.Private),
+		}}
+	}
+
+	if (sub.ModeGiven & sub.ModeWant).IsOwner() {
+		if top := db.topics[sub.Topic]; top != nil {
+			top.topic.Owner = uid.String()
+		}
+	}
+}
+
+// TopicCreateP2P given two users creates a p2p topic.
+func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.db.topics[initiator.Topic]; ok {
+		return t.ErrDuplicate
+	}
+
+	a.db.createSubscription(initiator, false)
+	a.db.createSubscription(invited, true)
+
+	topic := &t.Topic{ObjHeader: t.ObjHeader{Id: initiator.Topic}}
+	topic.ObjHeader.MergeTimes(&initiator.ObjHeader)
+	topic.TouchedAt = initiator.GetTouchedAt()
+	return a.db.topicCreate(topic)
+}
+
+// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
+func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if rec := a.db.topics[topic]; rec != nil {
+		return copyTopic(&rec.topic), nil
+	}
+	return nil, nil
+}
+
+// sortedSubs returns subscriptions matching the filter in the order of creation.
+func (db *database) sortedSubs(filter func(rec *subRecord) bool) []*subRecord {
+	var found []*subRecord
+	for _, tsubs := range db.subs {
+		for _, rec := range tsubs {
+			if filter(rec) {
+				found = append(found, rec)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].id < found[j].id
+	})
+	return found
+}
+
+// TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
+// Reads and denormalizes Public value.
+func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	limit := 0
+	ims := time.Time{}
+	var onlyTopic string
+	if opts != nil {
+		onlyTopic = opts.Topic
+
+		// Apply the limit only when the client does not manage the cache (or cold start).
+		// Otherwise have to get all subscriptions and do a manual join with users/topics.
+		if opts.IfModifiedSince == nil {
+			if opts.Limit > 0 && opts.Limit < a.maxResults {
+				limit = opts.Limit
+			} else {
+				limit = a.maxResults
+			}
+		} else {
+			ims = *opts.IfModifiedSince
+		}
+	} else {
+		limit = a.maxResults
+	}
+
+	// Fetch ALL user's subscriptions, even those which has not been modified recently.
+	// We are going to use these subscriptions to fetch topics and users which may have been modified recently.
+	found := a.db.sortedSubs(func(rec *subRecord) bool {
+		return rec.user == uid && (keepDeleted || rec.sub.DeletedAt == nil) &&
+			(onlyTopic == "" || rec.sub.Topic == onlyTopic)
+	})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	// Keeping the order of subscriptions.
+	var order []string
+	join := make(map[string]t.Subscription)
+	for _, rec := range found {
+		sub := *copySub(&rec.sub)
+		tname := sub.Topic
+		tcat := t.GetTopicCat(tname)
+
+		if tcat == t.TopicCatMe || tcat == t.TopicCatFnd {
+			// One of 'me', 'fnd' subscriptions, skip. Don't skip 'sys' subscription.
+			continue
+		} else if tcat == t.TopicCatP2P {
+			// P2P subscription, find the other user to get user.Public and user.Trusted.
+			uid1, uid2, _ := t.ParseP2P(tname)
+			if uid1 == uid {
+				sub.SetWith(uid2.UserId())
+			} else {
+				sub.SetWith(uid1.UserId())
+			}
+		} else if tcat == t.TopicCatGrp {
+			// Maybe convert channel name to topic name.
+			tname = t.ChnToGrp(tname)
+		}
+		if _, ok := join[tname]; !ok {
+			order = append(order, tname)
+		}
+		join[tname] = sub
+	}
+
+	var subs []t.Subscription
+	if len(join) == 0 {
+		return subs, nil
+	}
+
+	subs = make([]t.Subscription, 0, len(join))
+	for _, tname := range order {
+		sub := join[tname]
+
+		// Join with the topic.
+		if top := a.db.topics[tname]; top != nil && (keepDeleted || top.topic.State != t.StateDeleted) &&
+			(ims.IsZero() || top.topic.TouchedAt.After(ims)) {
+			// Check if sub.UpdatedAt needs to be adjusted to earlier or later time.
+			sub.UpdatedAt = common.SelectLatestTime(sub.UpdatedAt, top.topic.UpdatedAt)
+			sub.SetState(top.topic.State)
+			sub.SetTouchedAt(top.topic.TouchedAt)
+			sub.SetSeqId(top.topic.SeqId)
+			if t.GetTopicCat(sub.Topic) == t.TopicCatGrp {
+				sub.SetPublic(copyJSON(top.topic.Public))
+				sub.SetTrusted(copyJSON(top.topic.Trusted))
+			}
+		}
+
+		// Join p2p subscription with the other user. Ignoring ims: we need all users to get LastSeen and UserAgent.
+		if t.GetTopicCat(tname) == t.TopicCatP2P {
+			if usr2 := a.db.users[t.ParseUserId(sub.GetWith())]; usr2 != nil &&
+				(keepDeleted || usr2.user.State != t.StateDeleted) {
+				sub.UpdatedAt = common.SelectLatestTime(sub.UpdatedAt, usr2.user.UpdatedAt)
+				sub.SetState(usr2.user.State)
+				sub.SetPublic(copyJSON(usr2.user.Public))
+				sub.SetTrusted(copyJSON(usr2.user.Trusted))
+				sub.SetDefaultAccess(usr2.user.Access.Auth, usr2.user.Access.Anon)
+				sub.SetLastSeenAndUA(usr2.user.LastSeen, usr2.user.UserAgent)
+			}
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return common.SelectEarliestUpdatedSubs(subs, opts, a.maxResults), nil
+}
+
+// UsersForTopic loads users subscribed to the given topic.
+// The difference between UsersForTopic vs SubsForTopic is that the former loads user.Public,
+// the latter does not.
+func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	tcat := t.GetTopicCat(topic)
+
+	limit := a.maxResults
+	var oneUser t.Uid
+	if opts != nil {
+		// Ignore IfModifiedSince: loading all entries because a topic cannot have too many subscribers.
+		// Those unmodified will be stripped of Public & Private.
+		oneUser = opts.User
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	found := a.db.sortedSubs(func(rec *subRecord) bool {
+		if rec.sub.Topic != topic {
+			return false
+		}
+		// Users which do not exist are skipped.
+		usr := a.db.users[rec.user]
+		if usr == nil {
+			return false
+		}
+		if !keepDeleted {
+			// Filter out rows with users deleted.
+			if usr.user.State == t.StateDeleted {
+				return false
+			}
+			// For p2p topics we must load all subscriptions including deleted.
+			// Otherwise it will be impossible to swipe Public values.
+			if tcat != t.TopicCatP2P && rec.sub.DeletedAt != nil {
+				return false
+			}
+		}
+		// For p2p topics we have to fetch both users otherwise public cannot be swapped.
+		return oneUser.IsZero() || tcat == t.TopicCatP2P || rec.user == oneUser
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	var subs []t.Subscription
+	for _, rec := range found {
+		usr := a.db.users[rec.user]
+		sub := *copySub(&rec.sub)
+		sub.SetPublic(copyJSON(usr.user.Public))
+		sub.SetTrusted(copyJSON(usr.user.Trusted))
+		sub.SetLastSeenAndUA(usr.user.LastSeen, usr.user.UserAgent)
+		subs = append(subs, sub)
+	}
+
+	if tcat == t.TopicCatP2P && len(subs) > 0 {
+		// Swap public & lastSeen values of P2P topics as expected.
+		if len(subs) == 1 {
+			// The other user is deleted, nothing we can do.
+			subs[0].SetPublic(nil)
+			subs[0].SetTrusted(nil)
+			subs[0].SetLastSeenAndUA(nil, "")
+		} else {
+			tmp := subs[0].GetPublic()
+			subs[0].SetPublic(subs[1].GetPublic())
+			subs[1].SetPublic(tmp)
+
+			tmp = subs[0].GetTrusted()
+			subs[0].SetTrusted(subs[1].GetTrusted())
+			subs[1].SetTrusted(tmp)
+
+			lastSeen := subs[0].GetLastSeen()
+			userAgent := subs[0].GetUserAgent()
+			subs[0].SetLastSeenAndUA(subs[1].GetLastSeen(), subs[1].GetUserAgent())
+			subs[1].SetLastSeenAndUA(lastSeen, userAgent)
+		}
+
+		// Remove deleted and unneeded subscriptions
+		if !keepDeleted || !oneUser.IsZero() {
+			var xsubs []t.Subscription
+			for i := range subs {
+				if (subs[i].DeletedAt != nil && !keepDeleted) || (!oneUser.IsZero() && subs[i].Uid() != oneUser) {
+					continue
+				}
+				xsubs = append(xsubs, subs[i])
+			}
+			subs = xsubs
+		}
+	}
+
+	return subs, nil
+}
+
+// OwnTopics loads a slice of topic names where the user is the owner.
+func (a *adapter) OwnTopics(uid t.Uid) ([]string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var found []*topicRecord
+	for _, rec := range a.db.topics {
+		if t.ParseUid(rec.topic.Owner) == uid {
+			found = append(found, rec)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].id < found[j].id
+	})
+
+	var names []string
+	for _, rec := range found {
+		names = append(names, rec.topic.Id)
+	}
+	return names, nil
+}
+
+// ChannelsForUser loads a slice of topic names where the user is a channel reader and notifications (P) are enabled.
+func (a *adapter) ChannelsForUser(uid t.Uid) ([]string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var names []string
+	for _, rec := range a.db.sortedSubs(func(rec *subRecord) bool {
+		return rec.user == uid && strings.HasPrefix(rec.sub.Topic, "chn") && rec.sub.DeletedAt == nil &&
+			rec.sub.ModeWant.IsPresencer() && rec.sub.ModeGiven.IsPresencer()
+	}) {
+		names = append(names, rec.sub.Topic)
+	}
+	return names, nil
+}
+
+// TopicShare creates topic subscriptions.
+func (a *adapter) TopicShare(shares []*t.Subscription) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, sub := range shares {
+		a.db.createSubscription(sub, true)
+	}
+	return nil
+}
+
+// disableSubs marks all subscriptions to the topic as deleted.
+func (db *database) disableSubs(topic string, now time.Time) {
+	for _, rec := range db.subs[topic] {
+		rec.sub.UpdatedAt = now
+		rec.sub.DeletedAt = copyTime(&now)
+	}
+}
+
+// deleteTopic hard-deletes the topic, its messages and subscriptions listed under the given names.
+func (db *database) deleteTopic(topic string, names []string) {
+	for _, name := range names {
+		delete(db.subs, name)
+	}
+	db.deleteMessages(topic, nil)
+	db.deleteFileLinks(func(link *fileLink) bool {
+		return link.topic == topic
+	})
+	delete(db.topics, topic)
+}
+
+// TopicDelete deletes specified topic.
+func (a *adapter) TopicDelete(topic string, isChan, hard bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// If the topic is a channel, must try to delete subscriptions under both grpXXX and chnXXX names.
+	names := []string{topic}
+	if isChan {
+		names = append(names, t.GrpToChn(topic))
+	}
+
+	if hard {
+		a.db.deleteTopic(topic, names)
+	} else {
+		now := t.TimeNow()
+		for _, name := range names {
+			a.db.disableSubs(name, now)
+		}
+		if rec := a.db.topics[topic]; rec != nil {
+			rec.topic.UpdatedAt = now
+			rec.topic.TouchedAt = now
+			rec.topic.State = t.StateDeleted
+			rec.topic.StateAt = copyTime(&now)
+		}
+	}
+	return nil
+}
+
+// TopicUpdateOnMessage updates topic's SeqId and TouchedAt.
+func (a *adapter) TopicUpdateOnMessage(topic string, msg *t.Message) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if rec := a.db.topics[topic]; rec != nil {
+		rec.topic.SeqId = msg.SeqId
+		rec.topic.TouchedAt = msg.CreatedAt
+	}
+	return nil
+}
+
+// TopicUpdate updates topic record.
+func (a *adapter) TopicUpdate(topic string, update map[string]any) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rec := a.db.topics[topic]
+	if rec == nil {
+		return nil
+	}
+
+	if t, u := update["TouchedAt"], update["UpdatedAt"]; t == nil && u != nil {
+		update["TouchedAt"] = u
+	}
+	tt := rec.topic
+	if err := applyUpdate(&tt, update); err != nil {
+		return err
+	}
+	if hasDuplicates(tt.Tags) {
+		return t.ErrDuplicate
+	}
+	rec.topic = tt
+	return nil
+}
+
+// TopicOwnerChange updates topic's owner.
+func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if rec := a.db.topics[topic]; rec != nil {
+		rec.topic.Owner = newOwner.String()
+	}
+	return nil
+}
+
+// Topic subscriptions
+
+// SubscriptionGet reads a subscription of a user to a topic.
+func (a *adapter) SubscriptionGet(topic string, user t.Uid, keepDeleted bool) (*t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	rec := a.db.subs[topic][user]
+	if rec == nil || (!keepDeleted && rec.sub.DeletedAt != nil) {
+		return nil, nil
+	}
+	return copySub(&rec.sub), nil
+}
+
+// SubsForUser loads all user's subscriptions. Does NOT load Public or Private values and does
+// not load deleted subscriptions.
+func (a *adapter) SubsForUser(forUser t.Uid) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var subs []t.Subscription
+	for _, rec := range a.db.sortedSubs(func(rec *subRecord) bool {
+		return rec.user == forUser && rec.sub.DeletedAt == nil
+	}) {
+		sub := *copySub(&rec.sub)
+		sub.Private = nil
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// SubsForTopic fetches all subsciptions for a topic. Does NOT load Public value.
+func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	limit := a.maxResults
+	var oneUser t.Uid
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+		oneUser = opts.User
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	var subs []t.Subscription
+	for _, rec := range a.db.sortedSubs(func(rec *subRecord) bool {
+		return rec.sub.Topic == topic && (keepDeleted || rec.sub.DeletedAt == nil) &&
+			(oneUser.IsZero() || rec.user == oneUser)
+	}) {
+		if len(subs) >= limit {
+			break
+		}
+		subs = append(subs, *copySub(&rec.sub))
+	}
+	return subs, nil
+}
+
+// SubsUpdate updates one or multiple subscriptions to a topic.
+func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]any) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Validate the update first so it's applied to all subscriptions or none.
+	var probe t.Subscription
+	if err := applyUpdate(&probe, update); err != nil {
+		return err
+	}
+
+	for uid, rec := range a.db.subs[topic] {
+		if user.IsZero() || uid == user {
+			applyUpdate(&rec.sub, update)
+		}
+	}
+	return nil
+}
+
+// SubsDelete marks subscription as deleted.
+func (a *adapter) SubsDelete(topic string, user t.Uid) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rec := a.db.subs[topic][user]
+	if rec == nil || rec.sub.DeletedAt != nil {
+		return t.ErrNotFound
+	}
+
+	now := t.TimeNow()
+	rec.sub.UpdatedAt = now
+	rec.sub.DeletedAt = &now
+
+	// Remove records of messages soft-deleted by this user.
+	a.db.deleteDellog(topic, func(rec *dellogRecord) bool {
+		return rec.deletedFor == user
+	})
+	return nil
+}
+
+// Search
+
+// findMatch is an object found by tags.
+type findMatch struct {
+	id      int64
+	tags    []string
+	matches int
+}
+
+// matchTags checks if the given tags satisfy the query. Returns the number of matched tags, zero if
+// the tags don't satisfy the query.
+func matchTags(tags []string, req [][]string, index map[string]struct{}) int {
+	matches := 0
+	for _, tag := range tags {
+		if _, ok := index[tag]; ok {
+			matches++
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	// At least one of the tags from each required disjunction must be present.
+	for _, reqDisjunction := range req {
+		if len(reqDisjunction) == 0 {
+			continue
+		}
+		found := false
+		for _, tag := range reqDisjunction {
+			if contains(tags, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0
+		}
+	}
+	return matches
+}
+
+// foundTags returns the tags which are present in the index.
+func foundTags(tags []string, index map[string]struct{}) []string {
+	found := make([]string, 0, 1)
+	for _, tag := range tags {
+		if _, ok := index[tag]; ok {
+			found = append(found, tag)
+		}
+	}
+	return found
+}
+
+// sortMatches orders matches by the number of matched tags from high to low and trims the result at the limit.
+func sortMatches[T any](matches []T, key func(T) findMatch, limit int) []T {
+	sort.SliceStable(matches, func(i, j int) bool {
+		mi, mj := key(matches[i]), key(matches[j])
+		if mi.matches == mj.matches {
+			return mi.id < mj.id
+		}
+		return mi.matches > mj.matches
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// FindUsers returns a list of users who match given tags, such as "email:jdoe@example.com" or "tel:+18003287448".
+func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	index := make(map[string]struct{})
+	for _, tag := range append(t.FlattenDoubleSlice(req), opt...) {
+		index[tag] = struct{}{}
+	}
+
+	type userMatch struct {
+		findMatch
+		rec *userRecord
+	}
+	var found []userMatch
+	for id, rec := range a.db.users {
+		if id == uid || (activeOnly && rec.user.State != t.StateOK) {
+			// Skip the callee and inactive users.
+			continue
+		}
+		if matches := matchTags(rec.user.Tags, req, index); matches > 0 {
+			found = append(found, userMatch{findMatch{rec.id, rec.user.Tags, matches}, rec})
+		}
+	}
+	found = sortMatches(found, func(m userMatch) findMatch { return m.findMatch }, a.maxResults)
+
+	var subs []t.Subscription
+	for _, m := range found {
+		var sub t.Subscription
+		sub.CreatedAt = m.rec.user.CreatedAt
+		sub.UpdatedAt = m.rec.user.UpdatedAt
+		sub.User = m.rec.user.Id
+		sub.SetPublic(copyJSON(m.rec.user.Public))
+		sub.SetTrusted(copyJSON(m.rec.user.Trusted))
+		sub.SetDefaultAccess(m.rec.user.Access.Auth, m.rec.user.Access.Anon)
+		sub.Private = foundTags(m.tags, index)
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// FindTopics returns a list of topics with matching tags.
+func (a *adapter) FindTopics(req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	index := make(map[string]struct{})
+	for _, tag := range append(t.FlattenDoubleSlice(req), opt...) {
+		index[tag] = struct{}{}
+	}
+
+	type topicMatch struct {
+		findMatch
+		rec *topicRecord
+	}
+	var found []topicMatch
+	for _, rec := range a.db.topics {
+		if activeOnly && rec.topic.State != t.StateOK {
+			continue
+		}
+		if matches := matchTags(rec.topic.Tags, req, index); matches > 0 {
+			found = append(found, topicMatch{findMatch{rec.id, rec.topic.Tags, matches}, rec})
+		}
+	}
+	found = sortMatches(found, func(m topicMatch) findMatch { return m.findMatch }, a.maxResults)
+
+	var subs []t.Subscription
+	for _, m := range found {
+		var sub t.Subscription
+		sub.CreatedAt = m.rec.topic.CreatedAt
+		sub.UpdatedAt = m.rec.topic.UpdatedAt
+		sub.Topic = m.rec.topic.Id
+		if m.rec.topic.UseBt {
+			sub.Topic = t.GrpToChn(sub.Topic)
+		}
+		sub.SetPublic(copyJSON(m.rec.topic.Public))
+		sub.SetTrusted(copyJSON(m.rec.topic.Trusted))
+		sub.SetDefaultAccess(m.rec.topic.Access.Auth, m.rec.topic.Access.Anon)
+		sub.Private = foundTags(m.tags, index)
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// isDeletedFor checks if the message is soft-deleted for the given user.
+func (db *database) isDeletedFor(topic string, seqId int, forUser t.Uid) bool {
+	for _, rec := range db.dellog[topic] {
+		if rec.deletedFor == forUser && seqId >= rec.low && seqId < rec.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// MessageSearch finds messages in the given topics which contain all of the given words.
+func (a *adapter) MessageSearch(topics []string, forUser t.Uid, words []string, opts *t.QueryOpt) ([]t.Message, error) {
+	if len(topics) == 0 || len(words) == 0 {
+		return nil, nil
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	limit := a.maxMessageResults
+	if opts != nil && opts.Limit > 0 && opts.Limit < limit {
+		limit = opts.Limit
+	}
+
+	var found []*msgRecord
+	for _, topic := range uniqueStrings(topics) {
+		for _, rec := range a.db.messages[topic] {
+			if rec.msg.DelId != 0 || a.db.isDeletedFor(topic, rec.msg.SeqId, forUser) {
+				continue
+			}
+			// All words are required to be present as substrings.
+			text := strings.ToLower(rec.msg.PlainText)
+			matched := true
+			for _, word := range words {
+				if !strings.Contains(text, strings.ToLower(word)) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				found = append(found, rec)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].msg.CreatedAt.Equal(found[j].msg.CreatedAt) {
+			return found[i].id > found[j].id
+		}
+		return found[i].msg.CreatedAt.After(found[j].msg.CreatedAt)
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	var msgs []t.Message
+	for _, rec := range found {
+		msgs = append(msgs, t.Message{
+			ObjHeader: t.ObjHeader{CreatedAt: rec.msg.CreatedAt},
+			SeqId:     rec.msg.SeqId,
+			Topic:     rec.msg.Topic,
+			From:      rec.msg.From,
+			PlainText: rec.msg.PlainText,
+		})
+	}
+	return msgs, nil
+}
+
+// Messages
+
+// MessageSave saves message to database. The ID of the message is replaced with the sequential ID
+// assigned by the database.
+func (a *adapter) MessageSave(msg *t.Message) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.db.findMessage(msg.Topic, msg.SeqId) != nil {
+		return t.ErrDuplicate
+	}
+
+	id := a.db.nextId()
+	a.db.messages[msg.Topic] = append(a.db.messages[msg.Topic], &msgRecord{id: id, msg: t.Message{
+		ObjHeader: t.ObjHeader{CreatedAt: msg.CreatedAt, UpdatedAt: msg.UpdatedAt},
+		SeqId:     msg.SeqId,
+		Topic:     msg.Topic,
+		From:      t.ParseUid(msg.From).String(),
+		Thread:    msg.Thread,
+		Head:      copyHead(msg.Head),
+		Content:   copyJSON(msg.Content),
+		PlainText: msg.PlainText,
+	}})
+	// Replacing ID given by store by ID given by the DB.
+	msg.SetUid(t.Uid(id))
+	return nil
+}
+
+// findMessage finds a message by topic and seq ID.
+func (db *database) findMessage(topic string, seqId int) *msgRecord {
+	for _, rec := range db.messages[topic] {
+		if rec.msg.SeqId == seqId {
+			return rec
+		}
+	}
+	return nil
+}
+
+// MessageEdit replaces head and content of an existing message. The previous version is saved as a revision.
+func (a *adapter) MessageEdit(msg *t.Message) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rec := a.db.findMessage(msg.Topic, msg.SeqId)
+	if rec == nil || rec.msg.DelId != 0 {
+		return t.ErrNotFound
+	}
+
+	// Revision timestamp is the time when the previous version was written.
+	a.db.revisions[rec.id] = append(a.db.revisions[rec.id], &revisionRecord{
+		createdAt: rec.msg.UpdatedAt,
+		head:      rec.msg.Head,
+		content:   rec.msg.Content,
+	})
+
+	rec.msg.UpdatedAt = msg.UpdatedAt
+	rec.msg.Head = copyHead(msg.Head)
+	rec.msg.Content = copyJSON(msg.Content)
+	rec.msg.PlainText = msg.PlainText
+
+	msg.SetUid(t.Uid(rec.id))
+	return nil
+}
+
+// MessageGetRevisions returns earlier revisions of the given message, oldest first.
+func (a *adapter) MessageGetRevisions(topic string, seqId int) ([]t.Message, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	rec := a.db.findMessage(topic, seqId)
+	if rec == nil || rec.msg.DelId != 0 {
+		return nil, nil
+	}
+
+	var revs []t.Message
+	for _, rev := range a.db.revisions[rec.id] {
+		revs = append(revs, t.Message{
+			ObjHeader: t.ObjHeader{CreatedAt: rev.createdAt, UpdatedAt: rev.createdAt},
+			SeqId:     seqId,
+			Topic:     topic,
+			From:      rec.msg.From,
+			Head:      copyHead(rev.head),
+			Content:   copyJSON(rev.content),
+		})
+	}
+	return revs, nil
+}
+
+// MessageGetAll returns messages matching the query, the most recent first.
+func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var limit = a.maxMessageResults
+	var lower = 0
+	var upper = 1<<31 - 1
+	var thread = 0
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			// Tinode API requires inclusive-exclusive ranges.
+			upper = opts.Before - 1
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+		thread = opts.Thread
+	}
+
+	var found []*msgRecord
+	for _, rec := range a.db.messages[topic] {
+		if rec.msg.DelId != 0 || rec.msg.SeqId < lower || rec.msg.SeqId > upper ||
+			(thread > 0 && rec.msg.Thread != thread) || a.db.isDeletedFor(topic, rec.msg.SeqId, forUser) {
+			continue
+		}
+		found = append(found, rec)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].msg.SeqId > found[j].msg.SeqId
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	msgs := make([]t.Message, 0, len(found))
+	for _, rec := range found {
+		msgs = append(msgs, t.Message{
+			ObjHeader: t.ObjHeader{CreatedAt: rec.msg.CreatedAt, UpdatedAt: rec.msg.UpdatedAt},
+			SeqId:     rec.msg.SeqId,
+			Topic:     rec.msg.Topic,
+			From:      rec.msg.From,
+			Thread:    rec.msg.Thread,
+			Head:      copyHead(rec.msg.Head),
+			Content:   copyJSON(rec.msg.Content),
+		})
+	}
+	return msgs, nil
+}
+
+// MessageGetDeleted returns ranges of deleted messages.
+func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var limit = a.maxResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 1 {
+			// DelRange is inclusive-exclusive.
+			upper = opts.Before - 1
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	var found []*dellogRecord
+	for _, rec := range a.db.dellog[topic] {
+		if rec.delId >= lower && rec.delId <= upper && (rec.deletedFor.IsZero() || rec.deletedFor == forUser) {
+			found = append(found, rec)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].delId < found[j].delId
+	})
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	var dmsgs []t.DelMessage
+	var dmsg t.DelMessage
+	for _, rec := range found {
+		if rec.delId != dmsg.DelId {
+			if dmsg.DelId > 0 {
+				dmsgs = append(dmsgs, dmsg)
+			}
+			dmsg = t.DelMessage{
+				Topic:      topic,
+				DeletedFor: rec.deletedFor.String(),
+				DelId:      rec.delId,
+			}
+		}
+		hi := rec.hi
+		if hi <= rec.low+1 {
+			hi = 0
+		}
+		dmsg.SeqIdRanges = append(dmsg.SeqIdRanges, t.Range{Low: rec.low, Hi: hi})
+	}
+	if dmsg.DelId > 0 {
+		dmsgs = append(dmsgs, dmsg)
+	}
+
+	return dmsgs, nil
+}
+
+// MessageGetExpired finds topics with messages which have outlived the topic's message TTL.
+// If 'accept' is not nil, only topics it accepts are checked.
+func (a *adapter) MessageGetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]t.Range, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var topics []*topicRecord
+	for _, rec := range a.db.topics {
+		if rec.topic.MsgTTL > 0 && rec.topic.State != t.StateDeleted && (accept == nil || accept(rec.topic.Id)) {
+			topics = append(topics, rec)
+		}
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].id < topics[j].id
+	})
+
+	expired := make(map[string]t.Range)
+	for _, top := range topics {
+		if len(expired) >= limit {
+			break
+		}
+		ttl := time.Duration(top.topic.MsgTTL) * time.Second
+		low, hi := 0, 0
+		for _, rec := range a.db.messages[top.topic.Id] {
+			if rec.msg.DelId != 0 || !rec.msg.CreatedAt.Add(ttl).Before(now) {
+				continue
+			}
+			if low == 0 || rec.msg.SeqId < low {
+				low = rec.msg.SeqId
+			}
+			if rec.msg.SeqId > hi {
+				hi = rec.msg.SeqId
+			}
+		}
+		if low == 0 {
+			continue
+		}
+		if hi > low {
+			// Range is inclusive-exclusive.
+			hi++
+		} else {
+			hi = 0
+		}
+		expired[top.topic.Id] = t.Range{Low: low, Hi: hi}
+	}
+	return expired, nil
+}
+
+// MessageArchive replaces live messages in the range with stubs linked to the segment file.
+func (a *adapter) MessageArchive(topic string, rng t.Range, segment string, unchangedSince time.Time) error {
+	fid := t.ParseUid(segment)
+	if (segment != "" && fid.IsZero()) || rng.Hi <= rng.Low {
+		return t.ErrMalformed
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.db.files[fid]; !ok && !fid.IsZero() {
+		return t.ErrNotFound
+	}
+
+	if !unchangedSince.IsZero() {
+		for _, rec := range a.db.messages[topic] {
+			if rec.msg.SeqId < rng.Low || rec.msg.SeqId >= rng.Hi {
+				continue
+			}
+			if !rec.msg.UpdatedAt.Before(unchangedSince) ||
+				(rec.msg.DeletedAt != nil && !rec.msg.DeletedAt.Before(unchangedSince)) {
+				return t.ErrConflict
+			}
+		}
+	}
+
+	for _, rec := range a.db.messages[topic] {
+		if rec.msg.DelId != 0 || rec.msg.SeqId < rng.Low || rec.msg.SeqId >= rng.Hi {
+			continue
+		}
+		// Earlier revisions are kept in the segment.
+		delete(a.db.revisions, rec.id)
+
+		rec.msg.DelId = t.MsgDelIdArchived
+		rec.msg.Head = nil
+		rec.msg.Content = nil
+		rec.msg.PlainText = ""
+		if !fid.IsZero() {
+			a.db.fileLinks = append(a.db.fileLinks, &fileLink{file: fid, msgId: t.Uid(rec.id)})
+		}
+	}
+	return nil
+}
+
+// deleteDellog removes the deletion log records of the topic which match the filter.
+func (db *database) deleteDellog(topic string, filter func(rec *dellogRecord) bool) {
+	var keep []*dellogRecord
+	for _, rec := range db.dellog[topic] {
+		if !filter(rec) {
+			keep = append(keep, rec)
+		}
+	}
+	if len(keep) > 0 {
+		db.dellog[topic] = keep
+	} else {
+		delete(db.dellog, topic)
+	}
+}
+
+// deleteReactions removes the reactions in the topic which match the filter.
+func (db *database) deleteReactions(topic string, filter func(rec *reactionRecord) bool) {
+	var keep []*reactionRecord
+	for _, rec := range db.reactions[topic] {
+		if !filter(rec) {
+			keep = append(keep, rec)
+		}
+	}
+	if len(keep) > 0 {
+		db.reactions[topic] = keep
+	} else {
+		delete(db.reactions, topic)
+	}
+}
+
+// deleteMessages deletes messages: hard-deletes all messages of the topic when toDel is nil,
+// otherwise logs the deletion and, if the deletion is not for one user only, clears the messages.
+func (db *database) deleteMessages(topic string, toDel *t.DelMessage) {
+	if toDel == nil {
+		// Whole topic is being deleted, thus also deleting all messages.
+		delete(db.dellog, topic)
+		delete(db.reactions, topic)
+		for key := range db.threadReads {
+			if key.topic == topic {
+				delete(db.threadReads, key)
+			}
+		}
+		for id, rec := range db.schedMsgs {
+			if rec.msg.Topic == topic {
+				db.deleteSchedMsg(id)
+			}
+		}
+		for _, rec := range db.messages[topic] {
+			db.deleteMessageRefs(rec.id)
+		}
+		delete(db.messages, topic)
+		return
+	}
+
+	// Only some messages are being deleted. Start with making log entries.
+	forUser := t.ParseUid(toDel.DeletedFor)
+	for _, rng := range toDel.SeqIdRanges {
+		if rng.Hi == 0 {
+			// Dellog must contain valid Low and *Hi*.
+			rng.Hi = rng.Low + 1
+		}
+		db.dellog[topic] = append(db.dellog[topic], &dellogRecord{
+			deletedFor: forUser,
+			delId:      toDel.DelId,
+			low:        rng.Low,
+			hi:         rng.Hi,
+		})
+	}
+
+	if toDel.DeletedFor != "" {
+		return
+	}
+
+	// Hard-deleting messages requires updates to the messages.
+	now := t.TimeNow()
+	for _, rec := range db.messages[topic] {
+		if rec.msg.DeletedAt != nil || !inRanges(rec.msg.SeqId, toDel.SeqIdRanges) {
+			continue
+		}
+		seqId := rec.msg.SeqId
+		db.deleteReactions(topic, func(r *reactionRecord) bool {
+			return r.r.SeqId == seqId
+		})
+		// Earlier revisions are deleted together with the message.
+		db.deleteMessageRefs(rec.id)
+
+		rec.msg.DeletedAt = copyTime(&now)
+		rec.msg.DelId = toDel.DelId
+		rec.msg.Head = nil
+		rec.msg.Content = nil
+		rec.msg.PlainText = ""
+	}
+}
+
+// deleteMessageRefs deletes revisions and file links of the message.
+func (db *database) deleteMessageRefs(id int64) {
+	delete(db.revisions, id)
+	db.deleteFileLinks(func(link *fileLink) bool {
+		return link.msgId == t.Uid(id)
+	})
+}
+
+// MessageDeleteList deletes messages in the given topic with seqIds from the list.
+func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.db.deleteMessages(topic, toDel)
+	return nil
+}
+
+// Threads
+
+// ThreadReadUpdate records the latest reply in the thread read by the user. The value is never decreased.
+func (a *adapter) ThreadReadUpdate(topic string, user t.Uid, thread, readSeqId int) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := threadReadKey{topic: topic, user: user, thread: thread}
+	if readSeqId > a.db.threadReads[key] {
+		a.db.threadReads[key] = readSeqId
+	} else if _, ok := a.db.threadReads[key]; !ok {
+		a.db.threadReads[key] = readSeqId
+	}
+	return nil
+}
+
+// ThreadGetAll returns summaries of all threads in the topic as seen by the given user.
+func (a *adapter) ThreadGetAll(topic string, forUser t.Uid) ([]t.ThreadStatus, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	summary := make(map[int]*t.ThreadStatus)
+	for _, rec := range a.db.messages[topic] {
+		if rec.msg.DelId != 0 || rec.msg.Thread <= 0 || a.db.isDeletedFor(topic, rec.msg.SeqId, forUser) {
+			continue
+		}
+		ts := summary[rec.msg.Thread]
+		if ts == nil {
+			ts = &t.ThreadStatus{
+				Thread:    rec.msg.Thread,
+				ReadSeqId: a.db.threadReads[threadReadKey{topic: topic, user: forUser, thread: rec.msg.Thread}],
+			}
+			summary[rec.msg.Thread] = ts
+		}
+		ts.Count++
+		if rec.msg.SeqId > ts.LastSeqId {
+			ts.LastSeqId = rec.msg.SeqId
+		}
+		if rec.msg.SeqId > ts.ReadSeqId {
+			ts.Unread++
+		}
+	}
+
+	var threads []t.ThreadStatus
+	for _, ts := range summary {
+		threads = append(threads, *ts)
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		return threads[i].Thread < threads[j].Thread
+	})
+	return threads, nil
+}
+
+// Scheduled messages
+
+// SchedMsgSave saves a message for delivery at a later time.
+func (a *adapter) SchedMsgSave(msg *t.ScheduledMessage) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	id := msg.Uid()
+	if _, ok := a.db.schedMsgs[id]; ok {
+		return t.ErrDuplicate
+	}
+
+	from := t.ParseUid(msg.From)
+	a.db.schedMsgs[id] = &schedRecord{user: from, msg: t.ScheduledMessage{
+		ObjHeader:   t.ObjHeader{Id: id.String(), CreatedAt: msg.CreatedAt, UpdatedAt: msg.UpdatedAt},
+		SendAt:      msg.SendAt,
+		Topic:       msg.Topic,
+		From:        from.String(),
+		Head:        copyHead(msg.Head),
+		Content:     copyJSON(msg.Content),
+		Attachments: copyStrings(msg.Attachments),
+	}}
+
+	// Link attachments to the scheduled message to protect them from garbage collection.
+	for _, fid := range msg.Attachments {
+		a.db.fileLinks = append(a.db.fileLinks, &fileLink{file: t.ParseUid(fid), sched: id})
+	}
+	return nil
+}
+
+// schedMsgQuery returns scheduled messages matching the filter, earliest first.
+func (a *adapter) schedMsgQuery(filter func(rec *schedRecord) bool, limit int) []t.ScheduledMessage {
+	var found []*schedRecord
+	for _, rec := range a.db.schedMsgs {
+		if filter(rec) {
+			found = append(found, rec)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].msg.SendAt.Equal(found[j].msg.SendAt) {
+			return found[i].msg.Id < found[j].msg.Id
+		}
+		return found[i].msg.SendAt.Before(found[j].msg.SendAt)
+	})
+	if limit >= 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	var msgs []t.ScheduledMessage
+	for _, rec := range found {
+		msg := rec.msg
+		msg.Head = copyHead(msg.Head)
+		msg.Content = copyJSON(msg.Content)
+		msg.Attachments = copyStrings(msg.Attachments)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// SchedMsgGetAll returns pending scheduled messages sent by the given user to the topic, earliest first.
+func (a *adapter) SchedMsgGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.schedMsgQuery(func(rec *schedRecord) bool {
+		return rec.msg.Topic == topic && rec.user == user
+	}, -1), nil
+}
+
+// SchedMsgGet returns the scheduled message with the given ID.
+func (a *adapter) SchedMsgGet(id t.Uid) (*t.ScheduledMessage, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	rec := a.db.schedMsgs[id]
+	if rec == nil {
+		return nil, t.ErrNotFound
+	}
+	msg := rec.msg
+	msg.Head = copyHead(msg.Head)
+	msg.Content = copyJSON(msg.Content)
+	msg.Attachments = copyStrings(msg.Attachments)
+	return &msg, nil
+}
+
+// SchedMsgGetDue returns up to 'limit' scheduled messages with SendAt before the given time, earliest first.
+// If 'accept' is not nil, only messages to topics it accepts are returned.
+func (a *adapter) SchedMsgGetDue(before time.Time, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.schedMsgQuery(func(rec *schedRecord) bool {
+		return rec.msg.SendAt.Before(before) && (accept == nil || accept(rec.msg.Topic))
+	}, limit), nil
+}
+
+// deleteSchedMsg deletes a scheduled message with its file links.
+func (db *database) deleteSchedMsg(id t.Uid) {
+	delete(db.schedMsgs, id)
+	db.deleteFileLinks(func(link *fileLink) bool {
+		return link.sched == id
+	})
+}
+
+// SchedMsgDelete deletes a scheduled message. If user is not zero, the message is deleted only if it was
+// sent by the user.
+func (a *adapter) SchedMsgDelete(id, user t.Uid) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rec := a.db.schedMsgs[id]
+	if rec == nil || (!user.IsZero() && rec.user != user) {
+		return t.ErrNotFound
+	}
+	a.db.deleteSchedMsg(id)
+	return nil
+}
+
+// Reactions
+
+// ReactionUpsert creates or replaces user's reaction to a message.
+func (a *adapter) ReactionUpsert(r *t.Reaction) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	user := t.ParseUid(r.User)
+	for _, rec := range a.db.reactions[r.Topic] {
+		if rec.r.SeqId == r.SeqId && rec.user == user {
+			rec.r.CreatedAt = r.CreatedAt
+			rec.r.Value = r.Value
+			return nil
+		}
+	}
+
+	a.db.reactions[r.Topic] = append(a.db.reactions[r.Topic], &reactionRecord{user: user, r: t.Reaction{
+		CreatedAt: r.CreatedAt,
+		Topic:     r.Topic,
+		SeqId:     r.SeqId,
+		User:      user.String(),
+		Value:     r.Value,
+	}})
+	return nil
+}
+
+// ReactionDelete removes user's reaction to a message.
+func (a *adapter) ReactionDelete(topic string, seqId int, user t.Uid) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.db.deleteReactions(topic, func(rec *reactionRecord) bool {
+		return rec.r.SeqId == seqId && rec.user == user
+	})
+	return nil
+}
+
+// ReactionGetAll returns reactions to messages with seq IDs in range [opts.Since, opts.Before).
+func (a *adapter) ReactionGetAll(topic string, opts *t.QueryOpt) ([]t.Reaction, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			upper = opts.Before - 1
+		}
+	}
+
+	var reacts []t.Reaction
+	for _, rec := range a.db.reactions[topic] {
+		if rec.r.SeqId >= lower && rec.r.SeqId <= upper {
+			reacts = append(reacts, rec.r)
+		}
+	}
+	// Reactions are kept in the order of creation.
+	sort.SliceStable(reacts, func(i, j int) bool {
+		return reacts[i].SeqId < reacts[j].SeqId
+	})
+	return reacts, nil
+}
+
+// Devices (for push notifications)
+
+// DeviceUpsert creates or updates a device record.
+func (a *adapter) DeviceUpsert(uid t.Uid, def *t.DeviceDef) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Ensure uniqueness of the device ID: delete all records of the device ID.
+	var keep []*deviceRecord
+	for _, rec := range a.db.devices {
+		if rec.def.DeviceId != def.DeviceId {
+			keep = append(keep, rec)
+		}
+	}
+	// Actually add/update DeviceId for the new user.
+	a.db.devices = append(keep, &deviceRecord{user: uid, def: *def})
+	return nil
+}
+
+// DeviceGetAll returns all devices for a given set of users.
+func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	want := make(map[t.Uid]bool, len(uids))
+	for _, uid := range uids {
+		want[uid] = true
+	}
+
+	result := make(map[t.Uid][]t.DeviceDef)
+	count := 0
+	for _, rec := range a.db.devices {
+		if want[rec.user] {
+			result[rec.user] = append(result[rec.user], rec.def)
+			count++
+		}
+	}
+	return result, count, nil
+}
+
+// deleteDevices deletes one or all devices of the user. Returns t.ErrNotFound if nothing was deleted.
+func (db *database) deleteDevices(uid t.Uid, deviceID string) error {
+	var keep []*deviceRecord
+	for _, rec := range db.devices {
+		if rec.user != uid || (deviceID != "" && rec.def.DeviceId != deviceID) {
+			keep = append(keep, rec)
+		}
+	}
+	if len(keep) == len(db.devices) {
+		return t.ErrNotFound
+	}
+	db.devices = keep
+	return nil
+}
+
+// DeviceDelete deletes a device record. If deviceID is empty, all user's devices are deleted.
+func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.db.deleteDevices(uid, deviceID)
+}
+
+// Credential management
+
+// CredUpsert adds or updates a validation record. Returns true if inserted, false if updated.
+// 1. if credential is validated:
+// 1.1 Hard-delete unconfirmed equivalent record, if exists.
+// 1.2 Insert new. Report error if duplicate.
+// 2. if credential is not validated:
+// 2.1 Check if validated equivalent exist. If so, report an error.
+// 2.2 Soft-delete all unvalidated records of the same method.
+// 2.3 Undelete existing credential. Return if successful.
+// 2.4 Insert new credential record.
+func (a *adapter) CredUpsert(cred *t.Credential) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	db := a.db
+	now := t.TimeNow()
+	uid := t.ParseUid(cred.User)
+
+	// Enforce uniqueness: if credential is confirmed, "method:value" must be unique.
+	// if credential is not yet confirmed, "userid:method:value" is unique.
+	synth := cred.Method + ":" + cred.Value
+
+	if !cred.Done {
+		// Check if this credential is already validated.
+		if db.findCred(synth) != nil {
+			return false, t.ErrDuplicate
+		}
+		// We are going to insert new record.
+		synth = cred.User + ":" + synth
+
+		// Adding new unvalidated credential. Deactivate all unvalidated records of this user and method.
+		for _, rec := range db.creds {
+			if rec.user == uid && rec.cred.Method == cred.Method && !rec.cred.Done {
+				rec.deletedAt = copyTime(&now)
+			}
+		}
+		// Assume that the record exists and try to update it: undelete, update timestamp and response value.
+		if rec := db.findCred(synth); rec != nil {
+			rec.cred.UpdatedAt = cred.UpdatedAt
+			rec.cred.Resp = cred.Resp
+			rec.cred.Done = false
+			rec.deletedAt = nil
+			return false, nil
+		}
+	} else {
+		// Hard-deleting unconformed record if it exists.
+		if db.findCred(synth) != nil {
+			return true, t.ErrDuplicate
+		}
+		unconfirmed := cred.User + ":" + synth
+		db.deleteCreds(func(rec *credRecord) bool {
+			return rec.synthetic == unconfirmed
+		})
+	}
+
+	// Add new record.
+	if db.findCred(synth) != nil {
+		return true, t.ErrDuplicate
+	}
+	db.creds = append(db.creds, &credRecord{
+		id:   db.nextId(),
+		user: uid,
+		cred: t.Credential{
+			ObjHeader: t.ObjHeader{CreatedAt: cred.CreatedAt, UpdatedAt: cred.UpdatedAt},
+			User:      uid.String(),
+			Method:    cred.Method,
+			Value:     cred.Value,
+			Resp:      cred.Resp,
+			Done:      cred.Done,
+		},
+		synthetic: synth,
+	})
+	return true, nil
+}
+
+// findCred finds a credential by its synthetic unique value.
+func (db *database) findCred(synthetic string) *credRecord {
+	for _, rec := range db.creds {
+		if rec.synthetic == synthetic {
+			return rec
+		}
+	}
+	return nil
+}
+
+// deleteCreds hard-deletes credentials matching the filter. Returns the number of deleted records.
+func (db *database) deleteCreds(filter func(rec *credRecord) bool) int {
+	var keep []*credRecord
+	for _, rec := range db.creds {
+		if !filter(rec) {
+			keep = append(keep, rec)
+		}
+	}
+	count := len(db.creds) - len(keep)
+	db.creds = keep
+	return count
+}
+
+// CredDel deletes credentials of the given user. If method is blank all credentials are removed.
+// If value is blank all credentials of the given the method are removed.
+// 1. If user is being deleted, hard-delete all records (method == "")
+// 2. If one value is being deleted:
+// 2.1 Delete it if it's valiated or if there were no attempts at validation
+// (otherwise it could be used to circumvent the limit on validation attempts).
+// 2.2 In that case mark it as soft-deleted.
+func (a *adapter) CredDel(uid t.Uid, method, value string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	matches := func(rec *credRecord) bool {
+		return rec.user == uid && (method == "" || rec.cred.Method == method) &&
+			(value == "" || rec.cred.Value == value)
+	}
+
+	if method == "" {
+		// Case 1
+		if a.db.deleteCreds(matches) == 0 {
+			return t.ErrNotFound
+		}
+		return nil
+	}
+
+	// Case 2.1
+	if a.db.deleteCreds(func(rec *credRecord) bool {
+		return matches(rec) && (rec.cred.Done || rec.cred.Retries == 0)
+	}) > 0 {
+		return nil
+	}
+
+	// Case 2.2
+	now := t.TimeNow()
+	count := 0
+	for _, rec := range a.db.creds {
+		if matches(rec) {
+			rec.deletedAt = copyTime(&now)
+			count++
+		}
+	}
+	if count == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// CredConfirm marks given credential method as confirmed.
+func (a *adapter) CredConfirm(uid t.Uid, method string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var found []*credRecord
+	for _, rec := range a.db.creds {
+		if rec.user == uid && rec.cred.Method == method && rec.deletedAt == nil && !rec.cred.Done {
+			if a.db.findCred(rec.cred.Method+":"+rec.cred.Value) != nil {
+				return t.ErrDuplicate
+			}
+			found = append(found, rec)
+		}
+	}
+	if len(found) == 0 {
+		return t.ErrNotFound
+	}
+
+	now := t.TimeNow()
+	for _, rec := range found {
+		rec.cred.UpdatedAt = now
+		rec.cred.Done = true
+		rec.synthetic = rec.cred.Method + ":" + rec.cred.Value
+	}
+	return nil
+}
+
+// CredFail increments failure count of the given validation method.
+func (a *adapter) CredFail(uid t.Uid, method string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := t.TimeNow()
+	for _, rec := range a.db.creds {
+		if rec.user == uid && rec.cred.Method == method && !rec.cred.Done {
+			rec.cred.UpdatedAt = now
+			rec.cred.Retries++
+		}
+	}
+	return nil
+}
+
+// CredGetActive returns currently active unvalidated credential of the given user and method.
+func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, rec := range a.db.creds {
+		if rec.user == uid && rec.deletedAt == nil && rec.cred.Method == method && !rec.cred.Done {
+			cred := rec.cred
+			return &cred, nil
+		}
+	}
+	return nil, nil
+}
+
+// CredGetAll returns credential records for the given user and method, all or validated only.
+func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.Credential, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var credentials []t.Credential
+	for _, rec := range a.db.creds {
+		if rec.user == uid && rec.deletedAt == nil && (method == "" || rec.cred.Method == method) &&
+			(!validatedOnly || rec.cred.Done) {
+			credentials = append(credentials, rec.cred)
+		}
+	}
+	return credentials, nil
+}
+
+// File upload records. The files are stored outside of the database.
+
+// FileStartUpload initializes a file upload.
+func (a *adapter) FileStartUpload(fd *t.FileDef) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	id := fd.Uid()
+	if _, ok := a.db.files[id]; ok {
+		return t.ErrDuplicate
+	}
+
+	a.db.files[id] = &fileRecord{id: a.db.nextId(), fd: t.FileDef{
+		ObjHeader: t.ObjHeader{Id: id.String(), CreatedAt: fd.CreatedAt, UpdatedAt: fd.UpdatedAt},
+		Status:    fd.Status,
+		User:      t.ParseUid(fd.User).String(),
+		MimeType:  fd.MimeType,
+		Size:      fd.Size,
+		Location:  fd.Location,
+	}}
+	return nil
+}
+
+// FileFinishUpload marks file upload as completed, successfully or otherwise.
+func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.FileDef, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := t.TimeNow()
+	id := fd.Uid()
+	if success {
+		if rec := a.db.files[id]; rec != nil {
+			rec.fd.UpdatedAt = now
+			rec.fd.Status = t.UploadCompleted
+			rec.fd.Size = size
+		}
+		fd.Status = t.UploadCompleted
+		fd.Size = size
+	} else {
+		// Deleting the record: there is no value in keeping it in the DB.
+		a.db.deleteFile(id)
+		fd.Status = t.UploadFailed
+		fd.Size = 0
+	}
+	fd.UpdatedAt = now
+
+	return fd, nil
+}
+
+// deleteFile deletes a file record with all its links.
+func (db *database) deleteFile(id t.Uid) {
+	delete(db.files, id)
+	db.deleteFileLinks(func(link *fileLink) bool {
+		return link.file == id
+	})
+}
+
+// FileGet fetches a record of a specific file.
+func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if rec := a.db.files[id]; rec != nil {
+		fd := rec.fd
+		return &fd, nil
+	}
+	return nil, nil
+}
+
+// FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
+// unused records with UpdatedAt before olderThan.
+// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
+func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	used := make(map[t.Uid]bool)
+	for _, link := range a.db.fileLinks {
+		used[link.file] = true
+	}
+
+	var found []*fileRecord
+	for id, rec := range a.db.files {
+		if !used[id] && (olderThan.IsZero() || rec.fd.UpdatedAt.Before(olderThan)) {
+			found = append(found, rec)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].id < found[j].id
+	})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	var locations []string
+	for _, rec := range found {
+		if rec.fd.Location != "" {
+			locations = append(locations, rec.fd.Location)
+		}
+		delete(a.db.files, rec.fd.Uid())
+	}
+	return locations, nil
+}
+
+// deleteFileLinks deletes file links matching the filter.
+func (db *database) deleteFileLinks(filter func(link *fileLink) bool) {
+	var keep []*fileLink
+	for _, link := range db.fileLinks {
+		if !filter(link) {
+			keep = append(keep, link)
+		}
+	}
+	db.fileLinks = keep
+}
+
+// FileLinkAttachments connects given topic or message to the file record IDs from the list.
+func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
+	if len(fids) == 0 || (topic == "" && msgId.IsZero() && userId.IsZero()) {
+		return t.ErrMalformed
+	}
+
+	if msgId.IsZero() {
+		// Only one attachment per topic or user is permitted at this time.
+		fids = fids[0:1]
+	}
+
+	var ids []t.Uid
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return t.ErrMalformed
+		}
+		ids = append(ids, id)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Only existing files can be linked.
+	for _, id := range ids {
+		if _, ok := a.db.files[id]; !ok {
+			return t.ErrNotFound
+		}
+	}
+
+	var link fileLink
+	if !msgId.IsZero() {
+		link.msgId = msgId
+	} else if topic != "" {
+		link.topic = topic
+	} else {
+		link.user = userId
+	}
+
+	// Unlink earlier uploads on the same topic or user allowing them to be garbage-collected.
+	if msgId.IsZero() {
+		a.db.deleteFileLinks(func(l *fileLink) bool {
+			return l.msgId.IsZero() && l.sched.IsZero() && l.topic == link.topic && l.user == link.user
+		})
+	}
+
+	for _, id := range ids {
+		l := link
+		l.file = id
+		a.db.fileLinks = append(a.db.fileLinks, &l)
+	}
+	return nil
+}
+
+// FileRelinkMessages moves links of messages of the topic from one file to another.
+func (a *adapter) FileRelinkMessages(topic, oldFid, newFid string) error {
+	oldId, newId := t.ParseUid(oldFid), t.ParseUid(newFid)
+	if oldId.IsZero() || newId.IsZero() {
+		return t.ErrMalformed
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.db.files[newId]; !ok {
+		return t.ErrNotFound
+	}
+
+	msgIds := make(map[t.Uid]bool)
+	for _, rec := range a.db.messages[topic] {
+		msgIds[t.Uid(rec.id)] = true
+	}
+	for _, l := range a.db.fileLinks {
+		if l.file == oldId && msgIds[l.msgId] {
+			l.file = newId
+		}
+	}
+	return nil
+}
+
+// Persistent cache management.
+
+// PCacheGet reads a persistet cache entry.
+func (a *adapter) PCacheGet(key string) (string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if rec := a.db.kvmeta[key]; rec != nil {
+		return rec.value, nil
+	}
+	return "", t.ErrNotFound
+}
+
+// PCacheUpsert creates or updates a persistent cache entry.
+func (a *adapter) PCacheUpsert(key string, value string, failOnDuplicate bool) error {
+	if strings.Contains(key, "%") {
+		// Do not allow % in keys: keep the same constraints as the SQL adapters.
+		return t.ErrMalformed
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, ok := a.db.kvmeta[key]; ok && failOnDuplicate {
+		return t.ErrDuplicate
+	}
+	a.db.kvmeta[key] = &kvRecord{createdAt: t.TimeNow(), value: value}
+	return nil
+}
+
+// PCacheDelete deletes one persistent cache entry.
+func (a *adapter) PCacheDelete(key string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	delete(a.db.kvmeta, key)
+	return nil
+}
+
+// PCacheExpire expires old entries with the given key prefix.
+func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
+	if keyPrefix == "" {
+		return t.ErrMalformed
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for key, rec := range a.db.kvmeta {
+		if strings.HasPrefix(key, keyPrefix) && rec.createdAt.Before(olderThan) {
+			delete(a.db.kvmeta, key)
+		}
+	}
+	return nil
+}
+
+// WithOutbox is not supported: the data is not persisted. Change events are added to the persistent cache
+// after the change.
+func (a *adapter) WithOutbox(outbox *adp.Outbox) adp.Adapter {
+	return nil
+}
+
+// OutboxAdd is not supported.
+func (a *adapter) OutboxAdd(entries []adp.OutboxEntry) error {
+	return t.ErrUnsupported
+}
+
+// OutboxGet is not supported.
+func (a *adapter) OutboxGet(limit int) ([]adp.OutboxEntry, error) {
+	return nil, t.ErrUnsupported
+}
+
+// OutboxDelete is not supported.
+func (a *adapter) OutboxDelete(offsets []string) error {
+	return t.ErrUnsupported
+}
+
+// Data export.
+
+// attachments returns IDs of the files linked by the filter.
+func (db *database) attachments(filter func(link *fileLink) bool) t.StringSlice {
+	var fids t.StringSlice
+	for _, link := range db.fileLinks {
+		if filter(link) {
+			fids = append(fids, link.file.String())
+		}
+	}
+	return fids
+}
+
+// UserExport returns a page of users ordered by ID, including soft-deleted.
+func (a *adapter) UserExport(after t.Uid, limit int) ([]t.User, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var found []*userRecord
+	for uid, rec := range a.db.users {
+		if uid > after {
+			found = append(found, rec)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].user.Uid() < found[j].user.Uid()
+	})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	users := make([]t.User, 0, len(found))
+	for _, rec := range found {
+		user := copyUser(&rec.user)
+		uid := user.Uid()
+		user.Attachments = a.db.attachments(func(link *fileLink) bool {
+			return link.user == uid
+		})
+		users = append(users, *user)
+	}
+	return users, nil
+}
+
+// AuthExport returns all authentication records of the user.
+func (a *adapter) AuthExport(uid t.Uid) ([]adp.AuthRecord, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var records []adp.AuthRecord
+	for _, rec := range a.db.auth {
+		if rec.user == uid {
+			records = append(records, adp.AuthRecord{
+				Scheme:  rec.scheme,
+				Unique:  rec.unique,
+				AuthLvl: rec.authLvl,
+				Secret:  append([]byte(nil), rec.secret...),
+				Expires: rec.expires,
+			})
+		}
+	}
+	return records, nil
+}
+
+// TopicExport returns a page of topics ordered by name, including soft-deleted.
+func (a *adapter) TopicExport(after string, limit int) ([]t.Topic, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var names []string
+	for name := range a.db.topics {
+		if name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+	}
+
+	topics := make([]t.Topic, 0, len(names))
+	for _, name := range names {
+		topic := copyTopic(&a.db.topics[name].topic)
+		topic.Attachments = a.db.attachments(func(link *fileLink) bool {
+			return link.topic == name
+		})
+		topics = append(topics, *topic)
+	}
+	return topics, nil
+}
+
+// MessageExport returns a page of messages of the topic ordered by seq ID.
+func (a *adapter) MessageExport(topic string, from t.Uid, after, limit int) ([]t.Message, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var found []*msgRecord
+	for _, rec := range a.db.messages[topic] {
+		if rec.msg.DelId <= 0 && rec.msg.SeqId > after && (from.IsZero() || rec.msg.From == from.String()) {
+			found = append(found, rec)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].msg.SeqId < found[j].msg.SeqId
+	})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	msgs := make([]t.Message, 0, len(found))
+	for _, rec := range found {
+		msg := t.Message{
+			ObjHeader: t.ObjHeader{CreatedAt: rec.msg.CreatedAt, UpdatedAt: rec.msg.UpdatedAt},
+			DelId:     rec.msg.DelId,
+			SeqId:     rec.msg.SeqId,
+			Topic:     rec.msg.Topic,
+			From:      rec.msg.From,
+			Thread:    rec.msg.Thread,
+			Head:      copyHead(rec.msg.Head),
+			Content:   copyJSON(rec.msg.Content),
+			PlainText: rec.msg.PlainText,
+		}
+		msgId := t.Uid(rec.id)
+		msg.SetUid(msgId)
+		msg.Attachments = a.db.attachments(func(link *fileLink) bool {
+			return link.msgId == msgId
+		})
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// FileExport returns a page of file records ordered by ID.
+func (a *adapter) FileExport(after string, limit int) ([]t.FileDef, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	from := t.ParseUid(after)
+	var found []*fileRecord
+	for id, rec := range a.db.files {
+		if id > from {
+			found = append(found, rec)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].fd.Uid() < found[j].fd.Uid()
+	})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+
+	files := make([]t.FileDef, 0, len(found))
+	for _, rec := range found {
+		files = append(files, rec.fd)
+	}
+	return files, nil
+}
+
+// PCacheExport returns a page of persistent cache entries ordered by key.
+func (a *adapter) PCacheExport(after string, limit int) ([]adp.PCacheEntry, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var keys []string
+	for key := range a.db.kvmeta {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	entries := make([]adp.PCacheEntry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, adp.PCacheEntry{Key: key, Value: a.db.kvmeta[key].value})
+	}
+	return entries, nil
+}
+
+// Helper functions
+
+// applyUpdate assigns values from the update map to the fields of the object with the same names.
+// Names are case-insensitive like column names in SQL.
+func applyUpdate(obj any, update map[string]any) error {
+	dst := reflect.ValueOf(obj).Elem()
+	for name, val := range update {
+		field := dst.FieldByNameFunc(func(fname string) bool {
+			return strings.EqualFold(fname, name)
+		})
+		if !field.IsValid() || !field.CanSet() {
+			return errors.New("memory: unknown field '" + name + "'")
+		}
+
+		switch strings.ToLower(name) {
+		case "public", "trusted", "private":
+			// Values are stored the same way as in a JSON column.
+			val = copyJSON(val)
+		}
+
+		if val == nil {
+			field.Set(reflect.Zero(field.Type()))
+			continue
+		}
+
+		src := reflect.ValueOf(val)
+		if src.Kind() == reflect.Ptr && field.Kind() == reflect.Ptr {
+			// Don't keep pointers to caller's values.
+			if src.IsNil() {
+				field.Set(reflect.Zero(field.Type()))
+				continue
+			}
+			src = src.Elem()
+		}
+
+		ftype := field.Type()
+		if ftype.Kind() == reflect.Ptr {
+			// Such as time.Time assigned to *time.Time.
+			ftype = ftype.Elem()
+		}
+		if src.Type().AssignableTo(ftype) {
+			// Pass.
+		} else if src.Kind() == ftype.Kind() && src.Type().ConvertibleTo(ftype) {
+			// Such as int to t.ObjState or []string to t.StringSlice.
+			src = src.Convert(ftype)
+		} else if ftype.Kind() == reflect.Interface {
+			// Pass.
+		} else {
+			return errors.New("memory: invalid value of '" + name + "'")
+		}
+
+		if ftype.Kind() == reflect.Slice && !src.IsNil() {
+			// Don't keep references to caller's slices.
+			src = reflect.AppendSlice(reflect.MakeSlice(ftype, 0, src.Len()), src)
+		}
+
+		if field.Kind() == reflect.Ptr {
+			ptr := reflect.New(ftype)
+			ptr.Elem().Set(src)
+			field.Set(ptr)
+		} else {
+			field.Set(src)
+		}
+	}
+	return nil
+}
+
+// copyJSON creates a deep copy of a value. The copy is the same as the value after a round trip
+// through a JSON column of an SQL database.
+func copyJSON(src any) any {
+	if src == nil {
+		return nil
+	}
+
+	jval, err := json.Marshal(src)
+	if err != nil {
+		return nil
+	}
+	var out any
+	json.Unmarshal(jval, &out)
+	return out
+}
+
+func copyHead(src t.MessageHeaders) t.MessageHeaders {
+	if src == nil {
+		return nil
+	}
+	head, _ := copyJSON(map[string]any(src)).(map[string]any)
+	return head
+}
+
+func copyTime(src *time.Time) *time.Time {
+	if src == nil {
+		return nil
+	}
+	tm := *src
+	return &tm
+}
+
+func copyStrings(src []string) t.StringSlice {
+	if src == nil {
+		return nil
+	}
+	return append(t.StringSlice{}, src...)
+}
+
+func copyUser(src *t.User) *t.User {
+	user := *src
+	user.SetUid(src.Uid())
+	user.StateAt = copyTime(src.StateAt)
+	user.LastSeen = copyTime(src.LastSeen)
+	user.Public = copyJSON(src.Public)
+	user.Trusted = copyJSON(src.Trusted)
+	user.Tags = copyStrings(src.Tags)
+	return &user
+}
+
+func copyTopic(src *t.Topic) *t.Topic {
+	return &t.Topic{
+		ObjHeader: t.ObjHeader{Id: src.Id, CreatedAt: src.CreatedAt, UpdatedAt: src.UpdatedAt},
+		State:     src.State,
+		StateAt:   copyTime(src.StateAt),
+		TouchedAt: src.TouchedAt,
+		UseBt:     src.UseBt,
+		Owner:     t.ParseUid(src.Owner).String(),
+		Access:    src.Access,
+		SeqId:     src.SeqId,
+		DelId:     src.DelId,
+		Public:    copyJSON(src.Public),
+		Trusted:   copyJSON(src.Trusted),
+		Tags:      copyStrings(src.Tags),
+		Pinned:    append(t.IntSlice(nil), src.Pinned...),
+		MsgTTL:    src.MsgTTL,
+	}
+}
+
+func copySub(src *t.Subscription) *t.Subscription {
+	return &t.Subscription{
+		ObjHeader: t.ObjHeader{CreatedAt: src.CreatedAt, UpdatedAt: src.UpdatedAt},
+		User:      src.User,
+		Topic:     src.Topic,
+		DeletedAt: copyTime(src.DeletedAt),
+		DelId:     src.DelId,
+		RecvSeqId: src.RecvSeqId,
+		ReadSeqId: src.ReadSeqId,
+		ModeWant:  src.ModeWant,
+		ModeGiven: src.ModeGiven,
+		Private:   copyJSON(src.Private),
+	}
+}
+
+// inRanges checks if the seq ID falls into one of the ranges.
+func inRanges(seqId int, ranges []t.Range) bool {
+	for _, r := range ranges {
+		if seqId == r.Low || (seqId > r.Low && seqId < r.Hi) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, val string) bool {
+	for _, s := range list {
+		if s == val {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDuplicates(list []string) bool {
+	seen := make(map[string]struct{}, len(list))
+	for _, s := range list {
+		if _, ok := seen[s]; ok {
+			return true
+		}
+		seen[s] = struct{}{}
+	}
+	return false
+}
+
+func uniqueStrings(list []string) []string {
+	var out []string
+	for _, s := range list {
+		if !contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func uniqueUids(list []t.Uid) []t.Uid {
+	var out []t.Uid
+	seen := make(map[t.Uid]struct{}, len(list))
+	for _, uid := range list {
+		if _, ok := seen[uid]; !ok {
+			seen[uid] = struct{}{}
+			out = append(out, uid)
+		}
+	}
+	return out
+}
+
+// GetTestAdapter returns a new unregistered adapter object. It's used for running tests.
+func GetTestAdapter() *adapter {
+	return &adapter{}
+}
@@ -0,0 +1,335 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+func openAdapter(t *testing.T) *adapter {
+	t.Helper()
+	adp := GetTestAdapter()
+	if err := adp.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.CheckDbVersion(); err != nil {
+		t.Fatal(err)
+	}
+	return adp
+}
+
+func createUser(t *testing.T, adp *adapter, id types.Uid, fn string, tags ...string) {
+	t.Helper()
+	now := types.TimeNow()
+	user := &types.User{
+		ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+		Access:    types.DefaultAccess{Auth: types.ModeCP2P, Anon: types.ModeNone},
+		Public:    map[string]any{"fn": fn},
+		Tags:      tags,
+	}
+	user.SetUid(id)
+	if err := adp.UserCreate(user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	adp := openAdapter(t)
+	defer adp.Close()
+
+	createUser(t, adp, 1, "Alice", "email:alice@example.com", "alice")
+	createUser(t, adp, 2, "Bob", "email:bob@example.com")
+
+	user := &types.User{}
+	user.SetUid(1)
+	if err := adp.UserCreate(user); err != types.ErrDuplicate {
+		t.Fatal("Expected duplicate error, got", err)
+	}
+
+	got, err := adp.UserGet(1)
+	if err != nil || got == nil || got.Id != types.Uid(1).String() {
+		t.Fatal("Failed to get user", got, err)
+	}
+	// Returned objects must not share data with the database.
+	got.Public.(map[string]any)["fn"] = "Mallory"
+	got.Tags[0] = "mallory"
+	got, _ = adp.UserGet(1)
+	if got.Public.(map[string]any)["fn"] != "Alice" || got.Tags[0] != "email:alice@example.com" {
+		t.Fatal("Stored user is modified", got.Public, got.Tags)
+	}
+
+	if err := adp.UserUpdate(1, map[string]any{"UserAgent": "test", "LastSeen": types.TimeNow()}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = adp.UserGet(1)
+	if got.UserAgent != "test" || got.LastSeen == nil {
+		t.Fatal("User not updated", got.UserAgent, got.LastSeen)
+	}
+	if err := adp.UserUpdate(1, map[string]any{"NoSuchField": 1}); err == nil {
+		t.Fatal("Expected error updating unknown field")
+	}
+
+	tags, err := adp.UserUpdateTags(1, []string{"tag1", "alice"}, []string{"email:alice@example.com"}, nil)
+	if err != nil || len(tags) != 2 || tags[0] != "alice" || tags[1] != "tag1" {
+		t.Fatal("Unexpected tags", tags, err)
+	}
+
+	subs, err := adp.FindUsers(2, [][]string{{"alice", "bob"}}, []string{"tag1"}, true)
+	if err != nil || len(subs) != 1 || subs[0].User != types.Uid(1).String() {
+		t.Fatal("Unexpected find result", subs, err)
+	}
+	if found := subs[0].Private.([]string); len(found) != 2 {
+		t.Fatal("Unexpected found tags", found)
+	}
+
+	if err := adp.AuthAddRecord(1, "basic", "basic:alice", auth.LevelAuth, []byte("secret"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.AuthAddRecord(2, "basic", "basic:alice", auth.LevelAuth, nil, time.Time{}); err != types.ErrDuplicate {
+		t.Fatal("Expected duplicate error, got", err)
+	}
+	if uid, _, _, _, err := adp.AuthGetUniqueRecord("basic:alice"); err != nil || uid != 1 {
+		t.Fatal("Unexpected auth record", uid, err)
+	}
+
+	// Soft-deleted users are not returned.
+	if err := adp.UserDelete(2, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := adp.UserGet(2); got != nil {
+		t.Fatal("Soft-deleted user returned", got)
+	}
+	if users, _ := adp.UserGetAll(1, 2); len(users) != 1 {
+		t.Fatal("Expected one user, got", len(users))
+	}
+
+	// Hard-deleted user is gone with the auth records.
+	if err := adp.UserDelete(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := adp.AuthGetRecord(1, "basic"); err != types.ErrNotFound {
+		t.Fatal("Expected auth record to be deleted, got", err)
+	}
+}
+
+func TestP2PTopic(t *testing.T) {
+	adp := openAdapter(t)
+	defer adp.Close()
+
+	createUser(t, adp, 1, "Alice")
+	createUser(t, adp, 2, "Bob")
+
+	now := types.TimeNow()
+	topic := types.Uid(1).P2PName(2)
+	initiator := &types.Subscription{
+		ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+		User:      types.Uid(1).String(),
+		Topic:     topic,
+		ModeWant:  types.ModeCP2P,
+		ModeGiven: types.ModeCP2P,
+		Private:   map[string]any{"comment": "mine"},
+	}
+	invited := &types.Subscription{
+		ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+		User:      types.Uid(2).String(),
+		Topic:     topic,
+		ModeWant:  types.ModeCP2P,
+		ModeGiven: types.ModeCP2P,
+	}
+	if err := adp.TopicCreateP2P(initiator, invited); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.TopicCreateP2P(initiator, invited); err != types.ErrDuplicate {
+		t.Fatal("Expected duplicate error, got", err)
+	}
+
+	subs, err := adp.TopicsForUser(1, false, nil)
+	if err != nil || len(subs) != 1 {
+		t.Fatal("Unexpected subscriptions", subs, err)
+	}
+	if subs[0].GetWith() != types.Uid(2).UserId() || subs[0].GetPublic().(map[string]any)["fn"] != "Bob" {
+		t.Fatal("P2P subscription is not joined with the other user", subs[0].GetWith(), subs[0].GetPublic())
+	}
+
+	// Public values of p2p subscribers are swapped.
+	subs, _ = adp.UsersForTopic(topic, false, nil)
+	if len(subs) != 2 || subs[0].User != types.Uid(1).String() ||
+		subs[0].GetPublic().(map[string]any)["fn"] != "Bob" ||
+		subs[0].Private.(map[string]any)["comment"] != "mine" {
+		t.Fatal("Unexpected p2p subscription", subs)
+	}
+
+	if err := adp.SubsUpdate(topic, 1, map[string]any{"ReadSeqId": 3, "RecvSeqId": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if sub, _ := adp.SubscriptionGet(topic, 1, false); sub.ReadSeqId != 3 || sub.RecvSeqId != 3 {
+		t.Fatal("Subscription not updated", sub)
+	}
+
+	// Soft-deleting a user deletes the p2p topic and both subscriptions.
+	adp.UserDelete(2, false)
+	if top, _ := adp.TopicGet(topic); top == nil || top.State != types.StateDeleted {
+		t.Fatal("P2P topic not deleted", top)
+	}
+	if sub, _ := adp.SubscriptionGet(topic, 1, false); sub != nil {
+		t.Fatal("P2P subscription not deleted", sub)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	adp := openAdapter(t)
+	defer adp.Close()
+
+	now := types.TimeNow()
+	topic := "grpTest"
+	for i := 1; i <= 5; i++ {
+		msg := &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			SeqId:     i,
+			Topic:     topic,
+			From:      types.Uid(1).String(),
+			Content:   "message",
+			PlainText: "message",
+		}
+		if err := adp.MessageSave(msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Uid().IsZero() {
+			t.Fatal("Message ID not assigned")
+		}
+	}
+	if err := adp.MessageSave(&types.Message{SeqId: 1, Topic: topic}); err != types.ErrDuplicate {
+		t.Fatal("Expected duplicate error, got", err)
+	}
+
+	msgs, _ := adp.MessageGetAll(topic, 1, &types.QueryOpt{Since: 2, Before: 5, Limit: 2})
+	if len(msgs) != 2 || msgs[0].SeqId != 4 || msgs[1].SeqId != 3 {
+		t.Fatal("Unexpected messages", msgs)
+	}
+
+	// Delete for one user.
+	adp.MessageDeleteList(topic, &types.DelMessage{
+		Topic:       topic,
+		DeletedFor:  types.Uid(2).String(),
+		DelId:       1,
+		SeqIdRanges: []types.Range{{Low: 1, Hi: 3}},
+	})
+	// Delete for all.
+	adp.MessageDeleteList(topic, &types.DelMessage{
+		Topic:       topic,
+		DelId:       2,
+		SeqIdRanges: []types.Range{{Low: 5}},
+	})
+
+	if msgs, _ = adp.MessageGetAll(topic, 1, nil); len(msgs) != 4 {
+		t.Fatal("Expected 4 messages for user 1, got", len(msgs))
+	}
+	if msgs, _ = adp.MessageGetAll(topic, 2, nil); len(msgs) != 2 {
+		t.Fatal("Expected 2 messages for user 2, got", len(msgs))
+	}
+
+	dmsgs, _ := adp.MessageGetDeleted(topic, 2, nil)
+	if len(dmsgs) != 2 || dmsgs[0].DelId != 1 || dmsgs[0].SeqIdRanges[0].Hi != 3 ||
+		dmsgs[1].DeletedFor != "" || dmsgs[1].SeqIdRanges[0].Hi != 0 {
+		t.Fatal("Unexpected deleted ranges", dmsgs)
+	}
+	if dmsgs, _ = adp.MessageGetDeleted(topic, 1, &types.QueryOpt{Since: 2}); len(dmsgs) != 1 {
+		t.Fatal("Unexpected deleted ranges for user 1", dmsgs)
+	}
+
+	// Hard-deleting the topic removes all messages.
+	adp.TopicDelete(topic, false, true)
+	if msgs, _ = adp.MessageGetAll(topic, 1, nil); len(msgs) != 0 {
+		t.Fatal("Messages not deleted", msgs)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	adp := openAdapter(t)
+	defer adp.Close()
+
+	uid := types.Uid(1)
+	cred := &types.Credential{User: uid.String(), Method: "email", Value: "alice@example.com", Resp: "123456"}
+	if inserted, err := adp.CredUpsert(cred); !inserted || err != nil {
+		t.Fatal("Credential not inserted", inserted, err)
+	}
+	if active, _ := adp.CredGetActive(uid, "email"); active == nil || active.Resp != "123456" {
+		t.Fatal("Unexpected active credential", active)
+	}
+	adp.CredFail(uid, "email")
+	if err := adp.CredConfirm(uid, "email"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := adp.UserGetByCred("email", "alice@example.com"); found != uid {
+		t.Fatal("User not found by credential", found)
+	}
+
+	// Validated credential cannot be claimed by another user.
+	other := &types.Credential{User: types.Uid(2).String(), Method: "email", Value: "alice@example.com"}
+	if _, err := adp.CredUpsert(other); err != types.ErrDuplicate {
+		t.Fatal("Expected duplicate error, got", err)
+	}
+
+	if err := adp.CredDel(uid, "email", "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if creds, _ := adp.CredGetAll(uid, "", false); len(creds) != 0 {
+		t.Fatal("Credential not deleted", creds)
+	}
+	if err := adp.CredDel(uid, "", ""); err != types.ErrNotFound {
+		t.Fatal("Expected not found error, got", err)
+	}
+}
+
+func TestFilesAndCache(t *testing.T) {
+	adp := openAdapter(t)
+	defer adp.Close()
+
+	now := types.TimeNow()
+	for i, loc := range []string{"file1", "file2"} {
+		fd := &types.FileDef{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			Status:    types.UploadStarted,
+			User:      types.Uid(1).String(),
+			Location:  loc,
+		}
+		fd.SetUid(types.Uid(i + 10))
+		if err := adp.FileStartUpload(fd); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := adp.FileFinishUpload(fd, true, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fd, err := adp.FileGet(types.Uid(10).String()); err != nil || fd.Status != types.UploadCompleted || fd.Size != 100 {
+		t.Fatal("Unexpected file record", fd, err)
+	}
+	if err := adp.FileLinkAttachments("", types.ZeroUid, 5, []string{types.Uid(10).String()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.FileLinkAttachments("grpTest", types.ZeroUid, types.ZeroUid, []string{types.Uid(99).String()}); err != types.ErrNotFound {
+		t.Fatal("Expected not found error, got", err)
+	}
+	if locs, _ := adp.FileDeleteUnused(time.Time{}, 0); len(locs) != 1 || locs[0] != "file2" {
+		t.Fatal("Unexpected unused files", locs)
+	}
+
+	if err := adp.PCacheUpsert("key1", "value1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.PCacheUpsert("key1", "value2", true); err != types.ErrDuplicate {
+		t.Fatal("Expected duplicate error, got", err)
+	}
+	if err := adp.PCacheUpsert("key%", "value", false); err != types.ErrMalformed {
+		t.Fatal("Expected malformed error, got", err)
+	}
+	if val, err := adp.PCacheGet("key1"); err != nil || val != "value1" {
+		t.Fatal("Unexpected cache value", val, err)
+	}
+	adp.PCacheExpire("key", time.Now().Add(time.Minute))
+	if _, err := adp.PCacheGet("key1"); err != types.ErrNotFound {
+		t.Fatal("Expected not found error, got", err)
+	}
+}
@@ -0,0 +1,11 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/db/adaptertest"
+)
+
+func TestConformance(t *testing.T) {
+	adaptertest.Run(t, openAdapter(t))
+}
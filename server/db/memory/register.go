@@ -0,0 +1,12 @@
+//go:build memory
+// +build memory
+
+package memory
+
+import (
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+)
+
+func init() {
+	store.RegisterAdapter(&adapter{})
+}
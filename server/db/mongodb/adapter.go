@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	adp "github.com/volvlabs/towncryer-chat-server/server/db"
 	"github.com/volvlabs/towncryer-chat-server/server/db/common"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
 	t "github.com/volvlabs/towncryer-chat-server/server/store/types"
@@ -41,7 +42,7 @@ const (
 	defaultHost     = "localhost:27017"
 	defaultDatabase = "tinode"
 
-	adpVersion  = 113
+	adpVersion  = 120
 	adapterName = "mongodb"
 
 	defaultMaxResults = 1024
@@ -370,6 +371,11 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "messages",
 			IndexOpts:  mdb.IndexModel{Keys: b.D{{"topic", 1}, {"seqid", 1}}},
 		},
+		// Compound index of 'topic - thread - seqid' for selecting replies in a thread.
+		{
+			Collection: "messages",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"topic", 1}, {"thread", 1}, {"seqid", 1}}},
+		},
 		// Compound index of hard-deleted messages
 		{
 			Collection: "messages",
@@ -381,6 +387,62 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "messages",
 			IndexOpts:  mdb.IndexModel{Keys: b.D{{"topic", 1}, {"deletedfor.user", 1}, {"deletedfor.delid", 1}}},
 		},
+		// Full-text index of message text. Language is 'none' to skip stemming and stop words.
+		{
+			Collection: "messages",
+			IndexOpts: mdb.IndexModel{
+				Keys:    b.D{{"plaintext", "text"}},
+				Options: mdbopts.Index().SetDefaultLanguage("none"),
+			},
+		},
+
+		// Earlier revisions of edited messages
+		// Compound index of 'topic - seqid' for selecting revisions of a message.
+		{
+			Collection: "msgrevisions",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"topic", 1}, {"seqid", 1}}},
+		},
+
+		// Reactions to messages
+		// Compound index of 'topic - seqid' for selecting reactions to a range of messages.
+		{
+			Collection: "reactions",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"topic", 1}, {"seqid", 1}}},
+		},
+		// Index on 'user' for deleting reactions of a deleted user.
+		{
+			Collection: "reactions",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"user", 1}}},
+		},
+
+		// Positions of users in threads
+		// Compound index of 'topic - user' for selecting user's positions in threads of a topic.
+		{
+			Collection: "threadreads",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"topic", 1}, {"user", 1}}},
+		},
+		// Index on 'user' for deleting positions of a deleted user.
+		{
+			Collection: "threadreads",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"user", 1}}},
+		},
+
+		// Messages scheduled for delivery at a later time
+		// Index on 'sendat' for finding messages which are due for delivery.
+		{
+			Collection: "schedmsgs",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"sendat", 1}}},
+		},
+		// Compound index of 'topic - from' for selecting user's scheduled messages in a topic.
+		{
+			Collection: "schedmsgs",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"topic", 1}, {"from", 1}}},
+		},
+		// Index on 'from' for deleting scheduled messages of a deleted user.
+		{
+			Collection: "schedmsgs",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{"from", 1}}},
+		},
 
 		// Log of deleted messages
 		// Compound index of 'topic - delid'
@@ -531,6 +593,96 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 113 {
+		// Create compound index on msgrevisions(topic,seqid) for selecting revisions of edited messages.
+		if _, err = a.db.Collection("msgrevisions").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.D{{"topic", 1}, {"seqid", 1}}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Create indexes on reactions(topic,seqid) and reactions(user).
+		if _, err = a.db.Collection("reactions").Indexes().CreateMany(a.ctx, []mdb.IndexModel{
+			{Keys: b.D{{"topic", 1}, {"seqid", 1}}},
+			{Keys: b.D{{"user", 1}}},
+		}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Create compound index on messages(topic,thread,seqid) for selecting replies in a thread.
+		if _, err = a.db.Collection("messages").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.D{{"topic", 1}, {"thread", 1}, {"seqid", 1}}}); err != nil {
+			return err
+		}
+
+		// Create indexes on threadreads(topic,user) and threadreads(user).
+		if _, err = a.db.Collection("threadreads").Indexes().CreateMany(a.ctx, []mdb.IndexModel{
+			{Keys: b.D{{"topic", 1}, {"user", 1}}},
+			{Keys: b.D{{"user", 1}}},
+		}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Topics.Pinned is added on first use. Just bump the version to keep in line with MySQL.
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Create indexes on schedmsgs(sendat), schedmsgs(topic,from) and schedmsgs(from).
+		if _, err = a.db.Collection("schedmsgs").Indexes().CreateMany(a.ctx, []mdb.IndexModel{
+			{Keys: b.D{{"sendat", 1}}},
+			{Keys: b.D{{"topic", 1}, {"from", 1}}},
+			{Keys: b.D{{"from", 1}}},
+		}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Topics.MsgTTL is added on first use. Just bump the version to keep in line with MySQL.
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Create full-text index on messages(plaintext). Messages sent before the upgrade are not indexed.
+		if _, err = a.db.Collection("messages").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{
+				Keys:    b.D{{"plaintext", "text"}},
+				Options: mdbopts.Index().SetDefaultLanguage("none"),
+			}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -691,6 +843,38 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 					return err
 				}
 
+				// Delete earlier revisions of edited messages.
+				err = a.decFileUseCounter(sc, "msgrevisions", b.M{"topic": b.M{"$in": topicIds}})
+				if err != nil {
+					return err
+				}
+				_, err = a.db.Collection("msgrevisions").DeleteMany(sc, topicFilter)
+				if err != nil {
+					return err
+				}
+
+				// Delete reactions to messages.
+				_, err = a.db.Collection("reactions").DeleteMany(sc, topicFilter)
+				if err != nil {
+					return err
+				}
+
+				// Delete positions in threads.
+				_, err = a.db.Collection("threadreads").DeleteMany(sc, topicFilter)
+				if err != nil {
+					return err
+				}
+
+				// Delete scheduled messages.
+				err = a.decFileUseCounter(sc, "schedmsgs", b.M{"topic": b.M{"$in": topicIds}})
+				if err != nil {
+					return err
+				}
+				_, err = a.db.Collection("schedmsgs").DeleteMany(sc, topicFilter)
+				if err != nil {
+					return err
+				}
+
 				// Delete subscriptions
 				_, err = a.db.Collection("subscriptions").DeleteMany(sc, topicFilter)
 				if err != nil {
@@ -703,6 +887,22 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 				}
 			}
 
+			// Delete user's reactions to messages and positions in threads in other topics.
+			if _, err = a.db.Collection("reactions").DeleteMany(sc, b.M{"user": forUser}); err != nil {
+				return err
+			}
+			if _, err = a.db.Collection("threadreads").DeleteMany(sc, b.M{"user": forUser}); err != nil {
+				return err
+			}
+
+			// Delete messages the user scheduled for later delivery.
+			if err = a.decFileUseCounter(sc, "schedmsgs", b.M{"from": forUser}); err != nil {
+				return err
+			}
+			if _, err = a.db.Collection("schedmsgs").DeleteMany(sc, b.M{"from": forUser}); err != nil {
+				return err
+			}
+
 			// Select all other topics where the user is a subscriber.
 			topicIds, err = a.db.Collection("subscriptions").Distinct(sc, "topic", b.M{"user": forUser})
 			if err != nil {
@@ -2183,6 +2383,42 @@ func (a *adapter) FindTopics(req [][]string, opt []string, activeOnly bool) ([]t
 	return subs, nil
 }
 
+// MessageSearch finds messages in the given topics which contain all of the given words.
+func (a *adapter) MessageSearch(topics []string, forUser t.Uid, words []string, opts *t.QueryOpt) ([]t.Message, error) {
+	if len(topics) == 0 || len(words) == 0 {
+		return nil, nil
+	}
+
+	limit := a.maxMessageResults
+	if opts != nil && opts.Limit > 0 && opts.Limit < limit {
+		limit = opts.Limit
+	}
+
+	// Each word is quoted to make it required.
+	filter := b.M{
+		"topic":           b.M{"$in": topics},
+		"delid":           b.M{"$exists": false},
+		"deletedfor.user": b.M{"$ne": forUser.String()},
+		"$text":           b.M{"$search": `"` + strings.Join(words, `" "`) + `"`},
+	}
+	findOpts := mdbopts.Find().
+		SetSort(b.D{{"createdat", -1}}).
+		SetProjection(b.M{"createdat": 1, "seqid": 1, "topic": 1, "from": 1, "plaintext": 1}).
+		SetLimit(int64(limit))
+
+	cur, err := a.db.Collection("messages").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var msgs []t.Message
+	if err = cur.All(a.ctx, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
 // Messages
 
 // MessageSave saves message to database
@@ -2191,6 +2427,75 @@ func (a *adapter) MessageSave(msg *t.Message) error {
 	return err
 }
 
+// MessageEdit replaces head and content of an existing message. The previous version is saved as a revision.
+func (a *adapter) MessageEdit(msg *t.Message) error {
+	var current b.M
+	findOpts := mdbopts.FindOne().SetProjection(b.M{"deletedfor": 0})
+	if err := a.db.Collection("messages").FindOne(a.ctx,
+		b.M{"topic": msg.Topic, "seqid": msg.SeqId, "delid": b.M{"$exists": false}}, findOpts).
+		Decode(&current); err != nil {
+		if err == mdb.ErrNoDocuments {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+
+	// Revision timestamp is the time when the previous version was written.
+	// Attachments are copied to the revision so their use counters can be decremented when the message is deleted.
+	revision := b.M{
+		"createdat": current["updatedat"],
+		"msgid":     current["_id"],
+		"topic":     msg.Topic,
+		"seqid":     msg.SeqId,
+		"from":      current["from"],
+		"head":      current["head"],
+		"content":   current["content"],
+	}
+	if attachments, ok := current["attachments"]; ok {
+		revision["attachments"] = attachments
+	}
+	if _, err := a.db.Collection("msgrevisions").InsertOne(a.ctx, revision); err != nil {
+		return err
+	}
+
+	if _, err := a.db.Collection("messages").UpdateOne(a.ctx,
+		b.M{"_id": current["_id"]},
+		b.M{
+			"$set":   b.M{"updatedat": msg.UpdatedAt, "head": msg.Head, "content": msg.Content, "plaintext": msg.PlainText},
+			"$unset": b.M{"attachments": ""},
+		}); err != nil {
+		return err
+	}
+
+	msg.Id, _ = current["_id"].(string)
+	return nil
+}
+
+// MessageGetRevisions returns earlier revisions of the given message, oldest first.
+func (a *adapter) MessageGetRevisions(topic string, seqId int) ([]t.Message, error) {
+	findOpts := mdbopts.Find().
+		SetSort(b.D{{"createdat", 1}, {"_id", 1}}).
+		SetProjection(b.M{"_id": 0, "msgid": 0, "attachments": 0})
+	cur, err := a.db.Collection("msgrevisions").Find(a.ctx, b.M{"topic": topic, "seqid": seqId}, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var revs []t.Message
+	for cur.Next(a.ctx) {
+		var rev t.Message
+		if err = cur.Decode(&rev); err != nil {
+			return nil, err
+		}
+		rev.UpdatedAt = rev.CreatedAt
+		rev.Content = unmarshalBsonD(rev.Content)
+		revs = append(revs, rev)
+	}
+
+	return revs, nil
+}
+
 // MessageGetAll returns messages matching the query
 func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
 	var limit = a.maxMessageResults
@@ -2218,7 +2523,12 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 	} else {
 		filter["seqid"] = b.M{"$gte": lower, "$lt": upper}
 	}
+	if opts != nil && opts.Thread > 0 {
+		filter["thread"] = opts.Thread
+	}
 	findOpts := mdbopts.Find().SetSort(b.D{{"topic", -1}, {"seqid", -1}})
+	// Text for full-text search is not needed.
+	findOpts.SetProjection(b.M{"plaintext": 0})
 	findOpts.SetLimit(int64(limit))
 
 	cur, err := a.db.Collection("messages").Find(a.ctx, filter, findOpts)
@@ -2257,6 +2567,28 @@ func (a *adapter) messagesHardDelete(topic string) error {
 		return err
 	}
 
+	if err = a.decFileUseCounter(a.ctx, "msgrevisions", filter); err != nil {
+		return err
+	}
+
+	if _, err = a.db.Collection("msgrevisions").DeleteMany(a.ctx, filter); err != nil {
+		return err
+	}
+
+	if _, err = a.db.Collection("reactions").DeleteMany(a.ctx, filter); err != nil {
+		return err
+	}
+
+	if _, err = a.db.Collection("threadreads").DeleteMany(a.ctx, filter); err != nil {
+		return err
+	}
+
+	if err = a.decFileUseCounter(a.ctx, "schedmsgs", filter); err != nil {
+		return err
+	}
+
+	_, err = a.db.Collection("schedmsgs").DeleteMany(a.ctx, filter)
+
 	return err
 }
 
@@ -2298,9 +2630,28 @@ func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) error {
 	}
 
 	if toDel.DeletedFor == "" {
+		// Earlier revisions are deleted together with the message.
+		revFilter := copyBsonMap(filter)
+		delete(revFilter, "delid")
+
+		// Stubs of archived messages are hard-deleted too, releasing the archive segments.
+		delete(filter, "delid")
+		filter["deletedat"] = nil
 		if err = a.decFileUseCounter(a.ctx, "messages", filter); err != nil {
 			return err
 		}
+
+		if err = a.decFileUseCounter(a.ctx, "msgrevisions", revFilter); err != nil {
+			return err
+		}
+		if _, err = a.db.Collection("msgrevisions").DeleteMany(a.ctx, revFilter); err != nil {
+			return err
+		}
+		// Reactions use the same filter as revisions.
+		if _, err = a.db.Collection("reactions").DeleteMany(a.ctx, revFilter); err != nil {
+			return err
+		}
+
 		// Hard-delete individual messages. Message is not deleted but all fields with content
 		// are replaced with nulls.
 		_, err = a.db.Collection("messages").UpdateMany(a.ctx, filter, b.M{"$set": b.M{
@@ -2309,6 +2660,7 @@ func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) error {
 			"from":        "",
 			"head":        nil,
 			"content":     nil,
+			"plaintext":   nil,
 			"attachments": nil}})
 	} else {
 		// Soft-deleting: adding DelId to DeletedFor
@@ -2374,6 +2726,383 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, nil
 }
 
+// MessageGetExpired finds topics with messages which have outlived the topic's message TTL.
+// If 'accept' is not nil, only topics it accepts are checked.
+func (a *adapter) MessageGetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]t.Range, error) {
+	cur, err := a.db.Collection("topics").Find(a.ctx,
+		b.M{"msgttl": b.M{"$gt": 0}, "state": b.M{"$ne": t.StateDeleted}},
+		mdbopts.Find().SetProjection(b.M{"_id": 1, "msgttl": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	// Returns seq ID of the first or the last expired message.
+	findSeqId := func(filter b.M, order int) (int, error) {
+		var msg t.Message
+		err := a.db.Collection("messages").FindOne(a.ctx, filter,
+			mdbopts.FindOne().SetSort(b.D{{"seqid", order}}).SetProjection(b.M{"seqid": 1})).Decode(&msg)
+		return msg.SeqId, err
+	}
+
+	expired := make(map[string]t.Range)
+	for len(expired) < limit && cur.Next(a.ctx) {
+		var topic struct {
+			Id     string `bson:"_id"`
+			MsgTTL int    `bson:"msgttl"`
+		}
+		if err = cur.Decode(&topic); err != nil {
+			return nil, err
+		}
+		if accept != nil && !accept(topic.Id) {
+			continue
+		}
+
+		filter := b.M{
+			"topic": topic.Id,
+			// Skip already hard-deleted messages.
+			"delid":     b.M{"$exists": false},
+			"createdat": b.M{"$lt": now.Add(-time.Duration(topic.MsgTTL) * time.Second)},
+		}
+		low, err := findSeqId(filter, 1)
+		if err != nil {
+			if err == mdb.ErrNoDocuments {
+				// No expired messages in this topic.
+				continue
+			}
+			return nil, err
+		}
+		hi, err := findSeqId(filter, -1)
+		if err != nil {
+			return nil, err
+		}
+		if hi > low {
+			// Range is inclusive-exclusive.
+			hi++
+		} else {
+			hi = 0
+		}
+		expired[topic.Id] = t.Range{Low: low, Hi: hi}
+	}
+
+	return expired, cur.Err()
+}
+
+// MessageArchive replaces live messages in the range with stubs linked to the segment file.
+func (a *adapter) MessageArchive(topic string, rng t.Range, segment string, unchangedSince time.Time) error {
+	if (segment != "" && t.ParseUid(segment).IsZero()) || rng.Hi <= rng.Low {
+		return t.ErrMalformed
+	}
+
+	update := b.M{"$set": b.M{
+		"delid":     t.MsgDelIdArchived,
+		"head":      nil,
+		"content":   nil,
+		"plaintext": nil}}
+	if segment != "" {
+		count, err := a.db.Collection("fileuploads").CountDocuments(a.ctx, b.M{"_id": segment})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return t.ErrNotFound
+		}
+		update["$push"] = b.M{"attachments": segment}
+	}
+
+	filter := b.M{
+		"topic": topic,
+		"seqid": b.M{"$gte": rng.Low, "$lt": rng.Hi},
+		// Skip hard-deleted and already archived messages.
+		"delid": b.M{"$exists": false},
+	}
+	if !unchangedSince.IsZero() {
+		// There are no transactions: the check is not atomic. A message edited after the check is
+		// left as is to keep the edit.
+		count, err := a.db.Collection("messages").CountDocuments(a.ctx, b.M{
+			"topic": topic,
+			"seqid": b.M{"$gte": rng.Low, "$lt": rng.Hi},
+			"$or": b.A{
+				b.M{"updatedat": b.M{"$gte": unchangedSince}},
+				b.M{"deletedat": b.M{"$gte": unchangedSince}},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return t.ErrConflict
+		}
+		filter["updatedat"] = b.M{"$lt": unchangedSince}
+	}
+
+	// Earlier revisions are kept in the segment.
+	revFilter := b.M{"topic": topic, "seqid": b.M{"$gte": rng.Low, "$lt": rng.Hi}}
+	err := a.decFileUseCounter(a.ctx, "msgrevisions", revFilter)
+	if err != nil {
+		return err
+	}
+	if _, err = a.db.Collection("msgrevisions").DeleteMany(a.ctx, revFilter); err != nil {
+		return err
+	}
+
+	res, err := a.db.Collection("messages").UpdateMany(a.ctx, filter, update)
+	if err != nil || res.ModifiedCount == 0 || segment == "" {
+		return err
+	}
+
+	_, err = a.db.Collection("fileuploads").UpdateOne(a.ctx,
+		b.M{"_id": segment},
+		b.M{
+			"$set": b.M{"updatedat": t.TimeNow()},
+			"$inc": b.M{"usecount": 1},
+		},
+	)
+	return err
+}
+
+// Threads.
+
+// ThreadReadUpdate records the latest reply in the thread read by the user. The value is never decreased.
+func (a *adapter) ThreadReadUpdate(topic string, user t.Uid, thread, readSeqId int) error {
+	_, err := a.db.Collection("threadreads").UpdateOne(a.ctx,
+		b.M{"_id": topic + ":" + user.String() + ":" + strconv.Itoa(thread)},
+		b.M{
+			"$setOnInsert": b.M{"topic": topic, "user": user.String(), "thread": thread},
+			"$max":         b.M{"readseqid": readSeqId},
+		},
+		mdbopts.Update().SetUpsert(true))
+	return err
+}
+
+// ThreadGetAll returns summaries of all threads in the topic as seen by the given user.
+func (a *adapter) ThreadGetAll(topic string, forUser t.Uid) ([]t.ThreadStatus, error) {
+	requester := forUser.String()
+
+	// User's positions in threads.
+	cur, err := a.db.Collection("threadreads").Find(a.ctx, b.M{"topic": topic, "user": requester},
+		mdbopts.Find().SetProjection(b.M{"_id": 0, "thread": 1, "readseqid": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var reads []struct {
+		Thread    int `bson:"thread"`
+		ReadSeqId int `bson:"readseqid"`
+	}
+	err = cur.All(a.ctx, &reads)
+	if err != nil {
+		return nil, err
+	}
+	readSeq := make(map[int]int, len(reads))
+	for _, r := range reads {
+		readSeq[r.Thread] = r.ReadSeqId
+	}
+
+	// All replies available to the user, ordered by thread.
+	cur, err = a.db.Collection("messages").Find(a.ctx,
+		b.M{
+			"topic":           topic,
+			"thread":          b.M{"$gt": 0},
+			"delid":           b.M{"$exists": false},
+			"deletedfor.user": b.M{"$ne": requester},
+		},
+		mdbopts.Find().
+			SetSort(b.D{{"topic", 1}, {"thread", 1}, {"seqid", 1}}).
+			SetProjection(b.M{"_id": 0, "thread": 1, "seqid": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var threads []t.ThreadStatus
+	for cur.Next(a.ctx) {
+		var reply struct {
+			Thread int `bson:"thread"`
+			SeqId  int `bson:"seqid"`
+		}
+		if err = cur.Decode(&reply); err != nil {
+			return nil, err
+		}
+		if len(threads) == 0 || threads[len(threads)-1].Thread != reply.Thread {
+			threads = append(threads, t.ThreadStatus{Thread: reply.Thread, ReadSeqId: readSeq[reply.Thread]})
+		}
+		ts := &threads[len(threads)-1]
+		ts.Count++
+		ts.LastSeqId = reply.SeqId
+		if reply.SeqId > ts.ReadSeqId {
+			ts.Unread++
+		}
+	}
+
+	return threads, nil
+}
+
+// Scheduled messages.
+
+// SchedMsgSave saves a message for delivery at a later time.
+func (a *adapter) SchedMsgSave(msg *t.ScheduledMessage) error {
+	if _, err := a.db.Collection("schedmsgs").InsertOne(a.ctx, msg); err != nil {
+		return err
+	}
+
+	if len(msg.Attachments) > 0 {
+		// Increment use counter of attachments to protect them from garbage collection.
+		ids := make([]any, len(msg.Attachments))
+		for i, id := range msg.Attachments {
+			ids[i] = id
+		}
+		if _, err := a.db.Collection("fileuploads").UpdateMany(a.ctx,
+			b.M{"_id": b.M{"$in": ids}},
+			b.M{
+				"$set": b.M{"updatedat": msg.CreatedAt},
+				"$inc": b.M{"usecount": 1},
+			},
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schedMsgFind returns scheduled messages matching the filter, earliest first. If 'accept' is not nil, messages
+// to topics it does not accept are skipped and at most 'limit' messages are returned.
+func (a *adapter) schedMsgFind(filter b.M, findOpts *mdbopts.FindOptions, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error) {
+	cur, err := a.db.Collection("schedmsgs").Find(a.ctx, filter, findOpts.SetSort(b.D{{"sendat", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var msgs []t.ScheduledMessage
+	for cur.Next(a.ctx) {
+		var msg t.ScheduledMessage
+		if err = cur.Decode(&msg); err != nil {
+			return nil, err
+		}
+		if accept != nil && !accept(msg.Topic) {
+			continue
+		}
+		msg.Content = unmarshalBsonD(msg.Content)
+		msgs = append(msgs, msg)
+		if accept != nil && len(msgs) >= limit {
+			break
+		}
+	}
+
+	return msgs, nil
+}
+
+// SchedMsgGetAll returns pending scheduled messages sent by the given user to the topic, earliest first.
+func (a *adapter) SchedMsgGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error) {
+	return a.schedMsgFind(b.M{"topic": topic, "from": user.String()}, mdbopts.Find(), nil, 0)
+}
+
+// SchedMsgGet returns the scheduled message with the given ID.
+func (a *adapter) SchedMsgGet(id t.Uid) (*t.ScheduledMessage, error) {
+	msgs, err := a.schedMsgFind(b.M{"_id": id.String()}, mdbopts.Find(), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, t.ErrNotFound
+	}
+	return &msgs[0], nil
+}
+
+// SchedMsgGetDue returns up to 'limit' scheduled messages with SendAt before the given time, earliest first.
+// If 'accept' is not nil, only messages to topics it accepts are returned.
+func (a *adapter) SchedMsgGetDue(before time.Time, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error) {
+	findOpts := mdbopts.Find()
+	if accept == nil {
+		findOpts.SetLimit(int64(limit))
+	}
+	// Skipped messages don't count towards the limit: read until enough messages are accepted.
+	return a.schedMsgFind(b.M{"sendat": b.M{"$lt": before}}, findOpts, accept, limit)
+}
+
+// SchedMsgDelete deletes a scheduled message. If user is not zero, the message is deleted only if it was
+// sent by the user.
+func (a *adapter) SchedMsgDelete(id, user t.Uid) error {
+	filter := b.M{"_id": id.String()}
+	if !user.IsZero() {
+		filter["from"] = user.String()
+	}
+
+	var msg t.ScheduledMessage
+	if err := a.db.Collection("schedmsgs").FindOneAndDelete(a.ctx, filter).Decode(&msg); err != nil {
+		if err == mdb.ErrNoDocuments {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+
+	if len(msg.Attachments) > 0 {
+		ids := make([]any, len(msg.Attachments))
+		for i, id := range msg.Attachments {
+			ids[i] = id
+		}
+		_, err := a.db.Collection("fileuploads").UpdateMany(a.ctx,
+			b.M{"_id": b.M{"$in": ids}},
+			b.M{"$inc": b.M{"usecount": -1}})
+		return err
+	}
+	return nil
+}
+
+// Reactions.
+
+// ReactionUpsert creates or replaces user's reaction to a message.
+func (a *adapter) ReactionUpsert(r *t.Reaction) error {
+	id := r.Topic + ":" + strconv.Itoa(r.SeqId) + ":" + r.User
+	_, err := a.db.Collection("reactions").ReplaceOne(a.ctx, b.M{"_id": id},
+		b.M{
+			"_id":       id,
+			"createdat": r.CreatedAt,
+			"topic":     r.Topic,
+			"seqid":     r.SeqId,
+			"user":      r.User,
+			"value":     r.Value,
+		}, mdbopts.Replace().SetUpsert(true))
+	return err
+}
+
+// ReactionDelete removes user's reaction to a message.
+func (a *adapter) ReactionDelete(topic string, seqId int, user t.Uid) error {
+	_, err := a.db.Collection("reactions").DeleteOne(a.ctx,
+		b.M{"_id": topic + ":" + strconv.Itoa(seqId) + ":" + user.String()})
+	return err
+}
+
+// ReactionGetAll returns reactions to messages with seq IDs in range [opts.Since, opts.Before).
+func (a *adapter) ReactionGetAll(topic string, opts *t.QueryOpt) ([]t.Reaction, error) {
+	seqFilter := b.M{"$gte": 0}
+	if opts != nil {
+		seqFilter["$gte"] = opts.Since
+		if opts.Before > 0 {
+			seqFilter["$lt"] = opts.Before
+		}
+	}
+	findOpts := mdbopts.Find().
+		SetSort(b.D{{"seqid", 1}, {"createdat", 1}}).
+		SetProjection(b.M{"_id": 0})
+	cur, err := a.db.Collection("reactions").Find(a.ctx, b.M{"topic": topic, "seqid": seqFilter}, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var reacts []t.Reaction
+	for cur.Next(a.ctx) {
+		var r t.Reaction
+		if err = cur.Decode(&r); err != nil {
+			return nil, err
+		}
+		reacts = append(reacts, r)
+	}
+
+	return reacts, nil
+}
+
 // Devices (for push notifications).
 
 // DeviceUpsert creates or updates a device record.
@@ -2596,6 +3325,39 @@ func (a *adapter) decFileUseCounter(ctx context.Context, collection string, msgF
 	return err
 }
 
+// FileRelinkMessages moves links of messages of the topic from one file to another.
+func (a *adapter) FileRelinkMessages(topic, oldFid, newFid string) error {
+	if t.ParseUid(oldFid).IsZero() || t.ParseUid(newFid).IsZero() {
+		return t.ErrMalformed
+	}
+
+	res, err := a.db.Collection("messages").UpdateMany(a.ctx,
+		b.M{"topic": topic, "attachments": oldFid},
+		b.M{"$set": b.M{"attachments.$": newFid}})
+	if err != nil || res.ModifiedCount == 0 {
+		return err
+	}
+
+	now := t.TimeNow()
+	if _, err = a.db.Collection("fileuploads").UpdateOne(a.ctx,
+		b.M{"_id": newFid},
+		b.M{
+			"$set": b.M{"updatedat": now},
+			"$inc": b.M{"usecount": 1},
+		},
+	); err != nil {
+		return err
+	}
+	_, err = a.db.Collection("fileuploads").UpdateOne(a.ctx,
+		b.M{"_id": oldFid},
+		b.M{
+			"$set": b.M{"updatedat": now},
+			"$inc": b.M{"usecount": -1},
+		},
+	)
+	return err
+}
+
 // FileLinkAttachments connects given topic or message to the file record IDs from the list.
 func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
 	if len(fids) == 0 || (topic == "" && userId.IsZero() && msgId.IsZero()) {
@@ -2728,6 +3490,158 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 	return err
 }
 
+// WithOutbox is not supported: the adapter does not use transactions. Change events are added to the
+// persistent cache after the change.
+func (a *adapter) WithOutbox(outbox *adp.Outbox) adp.Adapter {
+	return nil
+}
+
+// OutboxAdd is not supported.
+func (a *adapter) OutboxAdd(entries []adp.OutboxEntry) error {
+	return t.ErrUnsupported
+}
+
+// OutboxGet is not supported.
+func (a *adapter) OutboxGet(limit int) ([]adp.OutboxEntry, error) {
+	return nil, t.ErrUnsupported
+}
+
+// OutboxDelete is not supported.
+func (a *adapter) OutboxDelete(offsets []string) error {
+	return t.ErrUnsupported
+}
+
+// Data export.
+
+// exportPage loads a page of documents ordered by _id which follow the given ID.
+func (a *adapter) exportPage(collection string, filter b.M, after string, limit int, result any) error {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+	filter["_id"] = b.M{"$gt": after}
+	findOpts := mdbopts.Find().SetSort(b.D{{"_id", 1}}).SetLimit(int64(limit))
+	cur, err := a.db.Collection(collection).Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return err
+	}
+	return cur.All(a.ctx, result)
+}
+
+// UserExport returns a page of users ordered by ID, including soft-deleted.
+func (a *adapter) UserExport(after t.Uid, limit int) ([]t.User, error) {
+	var users []t.User
+	if err := a.exportPage("users", b.M{}, after.String(), limit, &users); err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Public = unmarshalBsonD(users[i].Public)
+		users[i].Trusted = unmarshalBsonD(users[i].Trusted)
+	}
+	return users, nil
+}
+
+// AuthExport returns all authentication records of the user.
+func (a *adapter) AuthExport(uid t.Uid) ([]adp.AuthRecord, error) {
+	cur, err := a.db.Collection("auth").Find(a.ctx, b.M{"userid": uid.String()},
+		mdbopts.Find().SetSort(b.D{{"_id", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var records []adp.AuthRecord
+	for cur.Next(a.ctx) {
+		var record struct {
+			Id      string `bson:"_id"`
+			Scheme  string
+			AuthLvl auth.Level
+			Secret  []byte
+			Expires time.Time
+		}
+		if err = cur.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, adp.AuthRecord{
+			Scheme:  record.Scheme,
+			Unique:  record.Id,
+			AuthLvl: record.AuthLvl,
+			Secret:  record.Secret,
+			Expires: record.Expires,
+		})
+	}
+	return records, cur.Err()
+}
+
+// TopicExport returns a page of topics ordered by name, including soft-deleted.
+func (a *adapter) TopicExport(after string, limit int) ([]t.Topic, error) {
+	var topics []t.Topic
+	if err := a.exportPage("topics", b.M{}, after, limit, &topics); err != nil {
+		return nil, err
+	}
+	for i := range topics {
+		topics[i].Public = unmarshalBsonD(topics[i].Public)
+		topics[i].Trusted = unmarshalBsonD(topics[i].Trusted)
+	}
+	return topics, nil
+}
+
+// MessageExport returns a page of messages of the topic ordered by seq ID.
+func (a *adapter) MessageExport(topic string, from t.Uid, after, limit int) ([]t.Message, error) {
+	if limit <= 0 {
+		limit = a.maxMessageResults
+	}
+	filter := b.M{
+		"topic": topic,
+		"seqid": b.M{"$gt": after},
+		// Live and archived messages.
+		"delid": b.M{"$not": b.M{"$gt": 0}},
+	}
+	if !from.IsZero() {
+		filter["from"] = from.String()
+	}
+	findOpts := mdbopts.Find().SetSort(b.D{{"topic", 1}, {"seqid", 1}}).SetLimit(int64(limit))
+	cur, err := a.db.Collection("messages").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	if err = cur.All(a.ctx, &msgs); err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		msgs[i].Content = unmarshalBsonD(msgs[i].Content)
+	}
+	return msgs, nil
+}
+
+// FileExport returns a page of file records ordered by ID.
+func (a *adapter) FileExport(after string, limit int) ([]t.FileDef, error) {
+	var files []t.FileDef
+	if err := a.exportPage("fileuploads", b.M{}, after, limit, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// PCacheExport returns a page of persistent cache entries ordered by key.
+func (a *adapter) PCacheExport(after string, limit int) ([]adp.PCacheEntry, error) {
+	var records []struct {
+		Key   string `bson:"_id"`
+		Value string
+	}
+	// The version record has a numeric value, skip it.
+	if err := a.exportPage("kvmeta", b.M{"value": b.M{"$type": "string"}}, after, limit, &records); err != nil {
+		return nil, err
+	}
+
+	entries := make([]adp.PCacheEntry, len(records))
+	for i, rec := range records {
+		entries[i] = adp.PCacheEntry{Key: rec.Key, Value: rec.Value}
+	}
+	return entries, nil
+}
+
 func (a *adapter) isDbInitialized() bool {
 	var result map[string]int
 
@@ -0,0 +1,24 @@
+//go:build mongodb
+// +build mongodb
+
+package mongodb
+
+import (
+	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/db/adaptertest"
+)
+
+// The test requires a running database server, it's skipped if the server is not available.
+// The database is dropped and re-created. Transactions require a replica set. Configuration
+// can be overridden with the TINODE_TEST_MONGODB environment variable. Run with:
+//
+//	go test -tags mongodb ./db/mongodb/
+func TestConformance(t *testing.T) {
+	adp, err := adaptertest.OpenStore(adapterName, adaptertest.Config(adapterName,
+		`{"uri": "mongodb://localhost:27017/?replicaSet=rs0&serverSelectionTimeoutMS=5000", "database": "tinode_test"}`))
+	if err != nil {
+		t.Skip("database is not available:", err)
+	}
+	adaptertest.Run(t, adp)
+}
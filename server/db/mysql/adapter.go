@@ -18,6 +18,7 @@ import (
 	ms "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	adp "github.com/volvlabs/towncryer-chat-server/server/db"
 	"github.com/volvlabs/towncryer-chat-server/server/db/common"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
 	t "github.com/volvlabs/towncryer-chat-server/server/store/types"
@@ -38,13 +39,20 @@ type adapter struct {
 	sqlTimeout time.Duration
 	// DB transaction timeout.
 	txTimeout time.Duration
+
+	// Change events to add to the outbox table in the transaction of the next change, see WithOutbox.
+	outbox *adp.Outbox
+
+	// Read replicas and routing of queries between them.
+	replicas   []*sqlx.DB
+	readRouter *common.Replicas
 }
 
 const (
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
 	defaultDatabase = "tinode"
 
-	adpVersion = 113
+	adpVersion = 121
 
 	adapterName = "mysql"
 
@@ -77,6 +85,19 @@ type configType struct {
 	// DB request timeout (in seconds).
 	// If 0 (or negative), no timeout is applied.
 	SqlTimeout int `json:"sql_timeout,omitempty"`
+
+	// DSNs of read replicas.
+	Replicas []string `json:"replicas,omitempty"`
+	// Replicas lagging behind the primary by more than this number of seconds are not used.
+	ReplicaMaxLag int `json:"replica_max_lag,omitempty"`
+}
+
+// Adapter stats when read replicas are configured.
+type replicatedStats struct {
+	Primary sql.DBStats
+	// Number of queries which could use a replica but were sent to the primary.
+	PrimaryReads int64
+	Replicas     []common.ReplicaStats
 }
 
 func (a *adapter) getContext() (context.Context, context.CancelFunc) {
@@ -176,10 +197,104 @@ func (a *adapter) Open(jsonconfig json.RawMessage) error {
 			// We allocate txTimeoutMultiplier times sqlTimeout for transactions.
 			a.txTimeout = time.Duration(float64(config.SqlTimeout)*txTimeoutMultiplier) * time.Second
 		}
+		if len(config.Replicas) > 0 {
+			err = a.openReplicas(&config)
+		}
 	}
 	return err
 }
 
+// openReplicas initializes connections to read replicas and starts health checks.
+// Unavailable replicas are not an error: they are not used until they recover.
+func (a *adapter) openReplicas(config *configType) error {
+	var hosts []string
+	for _, dsn := range config.Replicas {
+		dsn = strings.TrimPrefix(dsn, "mysql://")
+		cfg, err := ms.ParseDSN(dsn)
+		if err != nil {
+			return errors.New("mysql adapter failed to parse replica DSN: " + err.Error())
+		}
+		db, err := sqlx.Open("mysql", dsn)
+		if err != nil {
+			return err
+		}
+		if config.MaxOpenConns > 0 {
+			db.SetMaxOpenConns(config.MaxOpenConns)
+		}
+		if config.MaxIdleConns > 0 {
+			db.SetMaxIdleConns(config.MaxIdleConns)
+		}
+		if config.ConnMaxLifetime > 0 {
+			db.SetConnMaxLifetime(time.Duration(config.ConnMaxLifetime) * time.Second)
+		}
+		a.replicas = append(a.replicas, db)
+		hosts = append(hosts, cfg.Addr)
+	}
+
+	a.readRouter = common.NewReplicas(hosts, time.Duration(config.ReplicaMaxLag)*time.Second)
+	a.readRouter.Start(a.replicaLag)
+	return nil
+}
+
+// replicaLag returns replication lag of the replica.
+func (a *adapter) replicaLag(i int) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.ReplicaCheckPeriod)
+	defer cancel()
+
+	rows, err := a.replicas[i].QueryxContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		// MySQL before 8.0.22.
+		rows, err = a.replicas[i].QueryxContext(ctx, "SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		// Not a replica, e.g. a node of a multi-primary cluster.
+		return 0, rows.Err()
+	}
+	status := make(map[string]any)
+	if err = rows.MapScan(status); err != nil {
+		return 0, err
+	}
+	for _, col := range []string{"Seconds_Behind_Source", "Seconds_Behind_Master"} {
+		val, ok := status[col]
+		if !ok {
+			continue
+		}
+		var lag int
+		switch val := val.(type) {
+		case nil:
+			return 0, errors.New("replication is not running")
+		case []byte:
+			lag, err = strconv.Atoi(string(val))
+		case int64:
+			lag = int(val)
+		default:
+			err = errors.New("unexpected type of replication lag")
+		}
+		return time.Duration(lag) * time.Second, err
+	}
+	return 0, errors.New("replication lag is not reported")
+}
+
+// reader returns a connection for reading data of the given topics or users.
+func (a *adapter) reader(keys ...string) *sqlx.DB {
+	if i := a.readRouter.Pick(keys...); i >= 0 {
+		return a.replicas[i]
+	}
+	return a.db
+}
+
+// wroteSubs records that the subscriptions were just written to the primary.
+func (a *adapter) wroteSubs(subs ...*t.Subscription) {
+	for _, sub := range subs {
+		a.readRouter.Wrote(sub.Topic, t.ParseUid(sub.User).UserId())
+	}
+}
+
 // Close closes the underlying database connection
 func (a *adapter) Close() error {
 	var err error
@@ -188,6 +303,12 @@ func (a *adapter) Close() error {
 		a.db = nil
 		a.version = -1
 	}
+	a.readRouter.Stop()
+	a.readRouter = nil
+	for _, db := range a.replicas {
+		db.Close()
+	}
+	a.replicas = nil
 	return err
 }
 
@@ -258,7 +379,11 @@ func (a *adapter) Stats() any {
 	if a.db == nil {
 		return nil
 	}
-	return a.db.Stats()
+	if a.readRouter == nil {
+		return a.db.Stats()
+	}
+	replicas, primaryReads := a.readRouter.Stats()
+	return &replicatedStats{Primary: a.db.Stats(), PrimaryReads: primaryReads, Replicas: replicas}
 }
 
 // GetName returns string that adapter uses to register itself with store.
@@ -409,6 +534,8 @@ func (a *adapter) CreateDb(reset bool) error {
 			public    JSON,
 			trusted   JSON,
 			tags      JSON,
+			pinned    JSON,
+			msgttl    INT DEFAULT 0,
 			PRIMARY KEY(id),
 			UNIQUE INDEX topics_name(name),
 			INDEX topics_owner(owner),
@@ -471,15 +598,91 @@ func (a *adapter) CreateDb(reset bool) error {
 			seqid     INT NOT NULL,
 			topic     CHAR(25) NOT NULL,` +
 			"`from`   BIGINT NOT NULL," +
-			`head     JSON,
+			`thread   INT NOT NULL DEFAULT 0,
+			head      JSON,
 			content   JSON,
+			plaintext TEXT,
 			PRIMARY KEY(id),
 			FOREIGN KEY(topic) REFERENCES topics(name),
-			UNIQUE INDEX messages_topic_seqid(topic, seqid)
+			UNIQUE INDEX messages_topic_seqid(topic, seqid),
+			INDEX messages_topic_thread_seqid(topic, thread, seqid),
+			INDEX messages_topic_createdat(topic, createdat),
+			FULLTEXT INDEX messages_plaintext(plaintext)
 		);`); err != nil {
 		return err
 	}
 
+	// Positions of users in threads.
+	if _, err = tx.Exec(
+		`CREATE TABLE threadreads(
+			id        INT NOT NULL AUTO_INCREMENT,
+			topic     CHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			thread    INT NOT NULL,
+			readseqid INT NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name),
+			UNIQUE INDEX threadreads_topic_userid_thread(topic, userid, thread),
+			INDEX threadreads_userid(userid)
+		)`); err != nil {
+		return err
+	}
+
+	// Earlier revisions of edited messages.
+	if _, err = tx.Exec(
+		`CREATE TABLE msgrevisions(
+			id        INT NOT NULL AUTO_INCREMENT,
+			createdat DATETIME(3) NOT NULL,
+			msgid     INT NOT NULL,
+			seqid     INT NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			head      JSON,
+			content   JSON,
+			PRIMARY KEY(id),
+			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+			INDEX msgrevisions_topic_seqid(topic, seqid)
+		)`); err != nil {
+		return err
+	}
+
+	// Reactions to messages, one per user per message.
+	if _, err = tx.Exec(
+		`CREATE TABLE reactions(
+			id        INT NOT NULL AUTO_INCREMENT,
+			createdat DATETIME(3) NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			userid    BIGINT NOT NULL,
+			value     VARCHAR(32) NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name),
+			UNIQUE INDEX reactions_topic_seqid_userid(topic, seqid, userid),
+			INDEX reactions_userid(userid)
+		)`); err != nil {
+		return err
+	}
+
+	// Messages scheduled for delivery at a later time.
+	if _, err = tx.Exec(
+		`CREATE TABLE schedmsgs(
+			id          BIGINT NOT NULL,
+			createdat   DATETIME(3) NOT NULL,
+			updatedat   DATETIME(3) NOT NULL,
+			sendat      DATETIME(3) NOT NULL,
+			topic       CHAR(25) NOT NULL,
+			userid      BIGINT NOT NULL,
+			head        JSON,
+			content     JSON,
+			attachments JSON,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name),
+			INDEX schedmsgs_sendat(sendat),
+			INDEX schedmsgs_topic_userid(topic, userid),
+			INDEX schedmsgs_userid(userid)
+		)`); err != nil {
+		return err
+	}
+
 	// Deletion log
 	if _, err = tx.Exec(
 		`CREATE TABLE dellog(
@@ -547,11 +750,23 @@ func (a *adapter) CreateDb(reset bool) error {
 			msgid     INT,
 			topic     CHAR(25),
 			userid    BIGINT,
+			schedid   BIGINT,
 			PRIMARY KEY(id),
 			FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
 			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
 			FOREIGN KEY(topic) REFERENCES topics(name) ON DELETE CASCADE,
-			FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE
+			FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY(schedid) REFERENCES schedmsgs(id) ON DELETE CASCADE
+		)`); err != nil {
+		return err
+	}
+
+	// Change events which are not delivered yet, keyed by offset.
+	if _, err = tx.Exec(
+		`CREATE TABLE outbox(
+			id    VARCHAR(64) NOT NULL,
+			event TEXT NOT NULL,
+			PRIMARY KEY(id)
 		)`); err != nil {
 		return err
 	}
@@ -776,6 +991,197 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		// Table for storing earlier revisions of edited messages.
+		if _, err := a.db.Exec(
+			`CREATE TABLE msgrevisions(
+				id        INT NOT NULL AUTO_INCREMENT,
+				createdat DATETIME(3) NOT NULL,
+				msgid     INT NOT NULL,
+				seqid     INT NOT NULL,
+				topic     CHAR(25) NOT NULL,
+				head      JSON,
+				content   JSON,
+				PRIMARY KEY(id),
+				FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+				INDEX msgrevisions_topic_seqid(topic, seqid)
+			)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		// Table for storing reactions to messages.
+		if _, err := a.db.Exec(
+			`CREATE TABLE reactions(
+				id        INT NOT NULL AUTO_INCREMENT,
+				createdat DATETIME(3) NOT NULL,
+				topic     CHAR(25) NOT NULL,
+				seqid     INT NOT NULL,
+				userid    BIGINT NOT NULL,
+				value     VARCHAR(32) NOT NULL,
+				PRIMARY KEY(id),
+				FOREIGN KEY(topic) REFERENCES topics(name),
+				UNIQUE INDEX reactions_topic_seqid_userid(topic, seqid, userid),
+				INDEX reactions_userid(userid)
+			)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Add parent reference to messages.
+		if _, err := a.db.Exec("ALTER TABLE messages ADD thread INT NOT NULL DEFAULT 0 AFTER `from`," +
+			" ADD INDEX messages_topic_thread_seqid(topic, thread, seqid)"); err != nil {
+			return err
+		}
+
+		// Table for storing positions of users in threads.
+		if _, err := a.db.Exec(
+			`CREATE TABLE threadreads(
+				id        INT NOT NULL AUTO_INCREMENT,
+				topic     CHAR(25) NOT NULL,
+				userid    BIGINT NOT NULL,
+				thread    INT NOT NULL,
+				readseqid INT NOT NULL,
+				PRIMARY KEY(id),
+				FOREIGN KEY(topic) REFERENCES topics(name),
+				UNIQUE INDEX threadreads_topic_userid_thread(topic, userid, thread),
+				INDEX threadreads_userid(userid)
+			)`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+
+		// Add list of pinned messages to topics.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD pinned JSON AFTER tags"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Perform database upgrade from version 117 to version 118.
+
+		// Table for storing messages scheduled for delivery at a later time.
+		if _, err := a.db.Exec(
+			`CREATE TABLE schedmsgs(
+				id          BIGINT NOT NULL,
+				createdat   DATETIME(3) NOT NULL,
+				updatedat   DATETIME(3) NOT NULL,
+				sendat      DATETIME(3) NOT NULL,
+				topic       CHAR(25) NOT NULL,
+				userid      BIGINT NOT NULL,
+				head        JSON,
+				content     JSON,
+				attachments JSON,
+				PRIMARY KEY(id),
+				FOREIGN KEY(topic) REFERENCES topics(name),
+				INDEX schedmsgs_sendat(sendat),
+				INDEX schedmsgs_topic_userid(topic, userid),
+				INDEX schedmsgs_userid(userid)
+			)`); err != nil {
+			return err
+		}
+
+		// Attachments of scheduled messages must not be garbage collected.
+		if _, err := a.db.Exec("ALTER TABLE filemsglinks ADD schedid BIGINT"); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec("ALTER TABLE filemsglinks ADD FOREIGN KEY(schedid) REFERENCES schedmsgs(id) ON DELETE CASCADE"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Perform database upgrade from version 118 to version 119.
+
+		// Add lifetime of messages to topics.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD msgttl INT DEFAULT 0 AFTER pinned"); err != nil {
+			return err
+		}
+
+		// Index for finding expired messages.
+		if _, err := a.db.Exec("ALTER TABLE messages ADD INDEX messages_topic_createdat(topic, createdat)"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+
+		// Add full-text index of message content. Messages sent before the upgrade are not indexed.
+		if _, err := a.db.Exec("ALTER TABLE messages ADD plaintext TEXT AFTER content"); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec("CREATE FULLTEXT INDEX messages_plaintext ON messages(plaintext)"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 120 {
+		// Perform database upgrade from version 120 to version 121.
+
+		// Outbox of change events.
+		if _, err := a.db.Exec(
+			`CREATE TABLE outbox(
+				id    VARCHAR(64) NOT NULL,
+				event TEXT NOT NULL,
+				PRIMARY KEY(id)
+			)`); err != nil {
+			return err
+		}
+
+		// Move undelivered events from the persistent cache, where they were kept before.
+		if _, err := a.db.Exec("INSERT INTO outbox(id,event) " +
+			"SELECT SUBSTRING(`key`,5),`value` FROM kvmeta WHERE `key` LIKE 'cdc:%'"); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec("DELETE FROM kvmeta WHERE `key` LIKE 'cdc:%'"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 121); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -870,6 +1276,9 @@ func (a *adapter) UserCreate(user *t.User) error {
 		return err
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -1130,11 +1539,35 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 
 		// Delete topics where the user is the owner.
 
+		// Delete user's reactions to messages and positions in threads.
+		if _, err = tx.Exec("DELETE FROM reactions WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM threadreads WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+		// Delete messages the user scheduled for later delivery.
+		if _, err = tx.Exec("DELETE FROM schedmsgs WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
 		// First delete all messages in those topics.
 		if _, err = tx.Exec("DELETE dellog FROM dellog LEFT JOIN topics ON topics.name=dellog.topic WHERE topics.owner=?",
 			decoded_uid); err != nil {
 			return err
 		}
+		if _, err = tx.Exec("DELETE reactions FROM reactions LEFT JOIN topics ON topics.name=reactions.topic WHERE topics.owner=?",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE threadreads FROM threadreads LEFT JOIN topics ON topics.name=threadreads.topic WHERE topics.owner=?",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE schedmsgs FROM schedmsgs LEFT JOIN topics ON topics.name=schedmsgs.topic WHERE topics.owner=?",
+			decoded_uid); err != nil {
+			return err
+		}
 		if _, err = tx.Exec("DELETE messages FROM messages LEFT JOIN topics ON topics.name=messages.topic WHERE topics.owner=?",
 			decoded_uid); err != nil {
 			return err
@@ -1214,6 +1647,9 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 		}
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -1296,6 +1732,9 @@ func (a *adapter) UserUpdate(uid t.Uid, update map[string]any) error {
 		}
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -1485,6 +1924,9 @@ func (a *adapter) TopicCreate(topic *t.Topic) error {
 	if err != nil {
 		return err
 	}
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -1520,6 +1962,8 @@ func createSubscription(tx *sqlx.Tx, sub *t.Subscription, undelete bool) error {
 
 // TopicCreateP2P given two users creates a p2p topic
 func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
+	a.wroteSubs(initiator, invited)
+
 	ctx, cancel := a.getContextForTx()
 	if cancel != nil {
 		defer cancel()
@@ -1552,6 +1996,9 @@ func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
 		return err
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -1564,7 +2011,7 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 	// Fetch topic by name
 	var tt = new(t.Topic)
 	err := a.db.GetContext(ctx, tt,
-		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags "+
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags,pinned,msgttl "+
 			"FROM topics WHERE name=?",
 		topic)
 
@@ -1586,6 +2033,8 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 // TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
 // Reads and denormalizes Public value.
 func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	db := a.reader(uid.UserId())
+
 	// Fetch ALL user's subscriptions, even those which has not been modified recently.
 	// We are going to use these subscriptions to fetch topics and users which may have been modified recently.
 	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
@@ -1628,7 +2077,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.QueryxContext(ctx, q, args...)
+	rows, err := db.QueryxContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -1710,13 +2159,13 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 				args = append(args, limit)
 			}
 		}
-		q = a.db.Rebind(q)
+		q = db.Rebind(q)
 
 		ctx2, cancel2 := a.getContext()
 		if cancel2 != nil {
 			defer cancel2()
 		}
-		rows, err = a.db.QueryxContext(ctx2, q, args...)
+		rows, err = db.QueryxContext(ctx2, q, args...)
 		if err != nil {
 			return nil, err
 		}
@@ -1763,13 +2212,13 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 
 		// Ignoring ims: we need all users to get LastSeen and UserAgent.
 
-		q = a.db.Rebind(q)
+		q = db.Rebind(q)
 
 		ctx3, cancel3 := a.getContext()
 		if cancel3 != nil {
 			defer cancel3()
 		}
-		rows, err = a.db.QueryxContext(ctx3, q, args...)
+		rows, err = db.QueryxContext(ctx3, q, args...)
 		if err != nil {
 			return nil, err
 		}
@@ -1813,6 +2262,8 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 // The difference between UsersForTopic vs SubsForTopic is that the former loads user.Public,
 // the latter does not.
 func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	db := a.reader(topic)
+
 	tcat := t.GetTopicCat(topic)
 
 	// Fetch all subscribed users. The number of users is not large
@@ -1859,7 +2310,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.QueryxContext(ctx, q, args...)
+	rows, err := db.QueryxContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -1969,6 +2420,8 @@ func (a *adapter) ChannelsForUser(uid t.Uid) ([]string, error) {
 }
 
 func (a *adapter) TopicShare(shares []*t.Subscription) error {
+	a.wroteSubs(shares...)
+
 	ctx, cancel := a.getContextForTx()
 	if cancel != nil {
 		defer cancel()
@@ -1990,6 +2443,9 @@ func (a *adapter) TopicShare(shares []*t.Subscription) error {
 		}
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -2049,6 +2505,9 @@ func (a *adapter) TopicDelete(topic string, isChan, hard bool) error {
 			return err
 		}
 	}
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -2102,6 +2561,9 @@ func (a *adapter) TopicUpdate(topic string, update map[string]any) error {
 		}
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -2110,8 +2572,10 @@ func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
 	if cancel != nil {
 		defer cancel()
 	}
-	_, err := a.db.ExecContext(ctx, "UPDATE topics SET owner=? WHERE name=?", store.DecodeUid(newOwner), topic)
-	return err
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		_, err := db.ExecContext(ctx, "UPDATE topics SET owner=? WHERE name=?", store.DecodeUid(newOwner), topic)
+		return err
+	})
 }
 
 // Get a subscription of a user to a topic.
@@ -2179,6 +2643,8 @@ func (a *adapter) SubsForUser(forUser t.Uid) ([]t.Subscription, error) {
 // The difference between UsersForTopic vs SubsForTopic is that the former loads user.public+trusted,
 // the latter does not.
 func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	db := a.reader(topic)
+
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
 		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
 
@@ -2208,7 +2674,7 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.QueryxContext(ctx, q, args...)
+	rows, err := db.QueryxContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -2234,6 +2700,8 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 
 // SubsUpdate updates one or multiple subscriptions to a topic.
 func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]any) error {
+	a.readRouter.Wrote(topic, user.UserId())
+
 	ctx, cancel := a.getContextForTx()
 	if cancel != nil {
 		defer cancel()
@@ -2262,11 +2730,16 @@ func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]any) er
 		return err
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
 // SubsDelete marks subscription as deleted.
 func (a *adapter) SubsDelete(topic string, user t.Uid) error {
+	a.readRouter.Wrote(topic, user.UserId())
+
 	tx, err := a.db.Begin()
 	if err != nil {
 		return err
@@ -2305,6 +2778,9 @@ func (a *adapter) SubsDelete(topic string, user t.Uid) error {
 		return err
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -2532,34 +3008,165 @@ func (a *adapter) FindTopics(req [][]string, opt []string, activeOnly bool) ([]t
 
 }
 
-// Messages
-func (a *adapter) MessageSave(msg *t.Message) error {
+// MessageSearch finds messages in the given topics which contain all of the given words.
+func (a *adapter) MessageSearch(topics []string, forUser t.Uid, words []string, opts *t.QueryOpt) ([]t.Message, error) {
+	if len(topics) == 0 || len(words) == 0 {
+		return nil, nil
+	}
+
+	limit := a.maxMessageResults
+	if opts != nil && opts.Limit > 0 && opts.Limit < limit {
+		limit = opts.Limit
+	}
+
+	// Boolean mode: all words are required.
+	match := "+" + strings.Join(words, " +")
+	query, args, _ := sqlx.In("SELECT m.createdat,m.seqid,m.topic,m.`from`,m.plaintext"+
+		" FROM messages AS m LEFT JOIN dellog AS d"+
+		" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+		" WHERE m.delid=0 AND m.topic IN (?) AND MATCH(m.plaintext) AGAINST(? IN BOOLEAN MODE)"+
+		" AND d.deletedfor IS NULL ORDER BY m.createdat DESC LIMIT ?",
+		store.DecodeUid(forUser), topics, match, limit)
+
 	ctx, cancel := a.getContext()
 	if cancel != nil {
 		defer cancel()
 	}
-	// store assignes message ID, but we don't use it. Message IDs are not used anywhere.
-	// Using a sequential ID provided by the database.
-	res, err := a.db.ExecContext(
-		ctx,
-		"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content) VALUES(?,?,?,?,?,?,?)",
-		msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
-		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, toJSON(msg.Content))
+	rows, err := a.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		msg.From = encodeUidString(msg.From).String()
+		msgs = append(msgs, msg)
+	}
 	if err == nil {
-		id, _ := res.LastInsertId()
-		// Replacing ID given by store by ID given by the DB.
-		msg.SetUid(t.Uid(id))
+		err = rows.Err()
 	}
-	return err
+	rows.Close()
+	return msgs, err
 }
 
-func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
-	var limit = a.maxMessageResults
-	var lower = 0
-	var upper = 1<<31 - 1
+// Messages
+func (a *adapter) MessageSave(msg *t.Message) error {
+	a.readRouter.Wrote(msg.Topic)
 
-	if opts != nil {
-		if opts.Since > 0 {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	// store assignes message ID, but we don't use it. Message IDs are not used anywhere.
+	// Using a sequential ID provided by the database.
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		res, err := db.ExecContext(
+			ctx,
+			"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,thread,head,content,plaintext) VALUES(?,?,?,?,?,?,?,?,?)",
+			msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
+			store.DecodeUid(t.ParseUid(msg.From)), msg.Thread, msg.Head, toJSON(msg.Content), msg.PlainText)
+		if err == nil {
+			id, _ := res.LastInsertId()
+			// Replacing ID given by store by ID given by the DB.
+			msg.SetUid(t.Uid(id))
+		}
+		return err
+	})
+}
+
+// MessageEdit replaces head and content of an existing message. The previous version is saved as a revision.
+func (a *adapter) MessageEdit(msg *t.Message) (err error) {
+	a.readRouter.Wrote(msg.Topic)
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var id int64
+	if err = tx.GetContext(ctx, &id, "SELECT id FROM messages WHERE topic=? AND seqid=? AND delid=0 FOR UPDATE",
+		msg.Topic, msg.SeqId); err != nil {
+		if err == sql.ErrNoRows {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+
+	// Revision timestamp is the time when the previous version was written.
+	if _, err = tx.ExecContext(ctx,
+		"INSERT INTO msgrevisions(createdat,msgid,seqid,topic,head,content) "+
+			"SELECT updatedat,id,seqid,topic,head,content FROM messages WHERE id=?", id); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE messages SET updatedat=?,head=?,content=?,plaintext=? WHERE id=?",
+		msg.UpdatedAt, msg.Head, toJSON(msg.Content), msg.PlainText, id); err != nil {
+		return err
+	}
+
+	msg.SetUid(t.Uid(id))
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MessageGetRevisions returns earlier revisions of the given message, oldest first.
+func (a *adapter) MessageGetRevisions(topic string, seqId int) ([]t.Message, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT r.createdat,r.seqid,r.topic,m.`from`,r.head,r.content"+
+			" FROM msgrevisions AS r INNER JOIN messages AS m ON m.id=r.msgid"+
+			" WHERE r.topic=? AND r.seqid=? AND m.delid=0 ORDER BY r.id",
+		topic, seqId)
+	if err != nil {
+		return nil, err
+	}
+
+	var revs []t.Message
+	for rows.Next() {
+		var rev t.Message
+		if err = rows.StructScan(&rev); err != nil {
+			break
+		}
+		rev.UpdatedAt = rev.CreatedAt
+		rev.From = encodeUidString(rev.From).String()
+		rev.Content = fromJSON(rev.Content)
+		revs = append(revs, rev)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return revs, err
+}
+
+func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
+	db := a.reader(topic)
+
+	var limit = a.maxMessageResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
 			lower = opts.Since
 		}
 		if opts.Before > 0 {
@@ -2573,18 +3180,26 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 	}
 
 	unum := store.DecodeUid(forUser)
+	args := []any{unum, topic, lower, upper}
+	threadFilter := ""
+	if opts != nil && opts.Thread > 0 {
+		threadFilter = " AND m.thread=?"
+		args = append(args, opts.Thread)
+	}
+	args = append(args, limit)
+
 	ctx, cancel := a.getContext()
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.QueryxContext(
+	rows, err := db.QueryxContext(
 		ctx,
-		"SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content"+
+		"SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.thread,m.head,m.content"+
 			" FROM messages AS m LEFT JOIN dellog AS d"+
 			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
-			" WHERE m.delid=0 AND m.topic=? AND m.seqid BETWEEN ? AND ? AND d.deletedfor IS NULL"+
+			" WHERE m.delid=0 AND m.topic=? AND m.seqid BETWEEN ? AND ?"+threadFilter+" AND d.deletedfor IS NULL"+
 			" ORDER BY m.seqid DESC LIMIT ?",
-		unum, topic, lower, upper, limit)
+		args...)
 
 	if err != nil {
 		return nil, err
@@ -2609,6 +3224,8 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 
 // Get ranges of deleted messages
 func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
+	db := a.reader(topic)
+
 	var limit = a.maxResults
 	var lower = 0
 	var upper = 1<<31 - 1
@@ -2632,7 +3249,7 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.QueryxContext(ctx, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=? AND delid BETWEEN ? AND ?"+
+	rows, err := db.QueryxContext(ctx, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=? AND delid BETWEEN ? AND ?"+
 		" AND (deletedFor=0 OR deletedFor=?)"+
 		" ORDER BY delid LIMIT ?", topic, lower, upper, store.DecodeUid(forUser), limit)
 	if err != nil {
@@ -2686,11 +3303,145 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, err
 }
 
+// MessageGetExpired finds topics with messages which have outlived the topic's message TTL.
+// If 'accept' is not nil, only topics it accepts are checked.
+func (a *adapter) MessageGetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]t.Range, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Messages expire at different times in different topics. Find topics with TTL first, then use
+	// the (topic, createdat) index to find expired messages in each of them.
+	rows, err := a.db.QueryContext(ctx, "SELECT name,msgttl FROM topics WHERE msgttl>0 AND state!=?", t.StateDeleted)
+	if err != nil {
+		return nil, err
+	}
+	type topicTTL struct {
+		name string
+		ttl  int
+	}
+	var topics []topicTTL
+	for rows.Next() {
+		var tt topicTTL
+		if err = rows.Scan(&tt.name, &tt.ttl); err != nil {
+			break
+		}
+		if accept == nil || accept(tt.name) {
+			topics = append(topics, tt)
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make(map[string]t.Range)
+	for _, tt := range topics {
+		if len(expired) >= limit {
+			break
+		}
+		var low, hi sql.NullInt64
+		err = a.db.QueryRowContext(ctx, "SELECT MIN(seqid),MAX(seqid) FROM messages WHERE topic=? AND createdat<? AND delid=0",
+			tt.name, now.Add(-time.Duration(tt.ttl)*time.Second)).Scan(&low, &hi)
+		if err != nil {
+			return nil, err
+		}
+		if !low.Valid {
+			// No expired messages in this topic.
+			continue
+		}
+		rng := t.Range{Low: int(low.Int64)}
+		if hi.Int64 > low.Int64 {
+			// Range is inclusive-exclusive.
+			rng.Hi = int(hi.Int64) + 1
+		}
+		expired[tt.name] = rng
+	}
+	return expired, nil
+}
+
+// MessageArchive replaces live messages in the range with stubs linked to the segment file.
+func (a *adapter) MessageArchive(topic string, rng t.Range, segment string, unchangedSince time.Time) (err error) {
+	fid := t.ParseUid(segment)
+	if (segment != "" && fid.IsZero()) || rng.Hi <= rng.Low {
+		return t.ErrMalformed
+	}
+
+	a.readRouter.Wrote(topic)
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	where := "m.topic=? AND m.seqid>=? AND m.seqid<? AND m.delid=0"
+	args := []any{topic, rng.Low, rng.Hi}
+
+	// Earlier revisions are kept in the segment.
+	_, err = tx.Exec("DELETE r.* FROM msgrevisions AS r INNER JOIN messages AS m ON m.id=r.msgid WHERE "+
+		where, args...)
+	if err != nil {
+		return err
+	}
+
+	if !fid.IsZero() {
+		_, err = tx.Exec("INSERT INTO filemsglinks(createdat,fileid,msgid) SELECT ?,?,m.id FROM messages AS m WHERE "+
+			where, append([]any{t.TimeNow(), store.DecodeUid(fid)}, args...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE messages AS m SET m.delid=?,m.head=NULL,m.content=NULL,m.plaintext=NULL WHERE "+
+		where, append([]any{t.MsgDelIdArchived}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	if !unchangedSince.IsZero() {
+		// Checking after the update: earlier edits are visible, later ones wait for the row locks.
+		var changed int
+		err = tx.Get(&changed, "SELECT COUNT(*) FROM messages WHERE topic=? AND seqid>=? AND seqid<? AND "+
+			"(updatedat>=? OR deletedat>=?)", topic, rng.Low, rng.Hi, unchangedSince, unchangedSince)
+		if err != nil {
+			return err
+		}
+		if changed > 0 {
+			return t.ErrConflict
+		}
+	}
+
+	return tx.Commit()
+}
+
 func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
 	var err error
 	if toDel == nil {
 		// Whole topic is being deleted, thus also deleting all messages.
 		_, err = tx.Exec("DELETE FROM dellog WHERE topic=?", topic)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM reactions WHERE topic=?", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM threadreads WHERE topic=?", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schedmsgs WHERE topic=?", topic)
+		}
 		if err == nil {
 			_, err = tx.Exec("DELETE FROM messages WHERE topic=?", topic)
 		}
@@ -2749,7 +3500,20 @@ func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
 				return err
 			}
 
-			_, err = tx.Exec("UPDATE messages AS m SET m.deletedAt=?,m.delId=?,m.head=NULL,m.content=NULL WHERE "+
+			// Earlier revisions are deleted together with the message.
+			_, err = tx.Exec("DELETE r.* FROM msgrevisions AS r INNER JOIN messages AS m ON m.id=r.msgid WHERE "+
+				where, args...)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("DELETE r.* FROM reactions AS r INNER JOIN messages AS m "+
+				"ON m.topic=r.topic AND m.seqid=r.seqid WHERE "+where, args...)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("UPDATE messages AS m SET m.deletedAt=?,m.delId=?,m.head=NULL,m.content=NULL,m.plaintext=NULL WHERE "+
 				where,
 				append([]any{t.TimeNow(), toDel.DelId}, args...)...)
 		}
@@ -2760,6 +3524,8 @@ func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
 
 // MessageDeleteList deletes messages in the given topic with seqIds from the list
 func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err error) {
+	a.readRouter.Wrote(topic)
+
 	ctx, cancel := a.getContextForTx()
 	if cancel != nil {
 		defer cancel()
@@ -2775,11 +3541,262 @@ func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err erro
 		}
 	}()
 
-	if err = messageDeleteList(tx, topic, toDel); err != nil {
-		return err
+	if err = messageDeleteList(tx, topic, toDel); err != nil {
+		return err
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ThreadReadUpdate records the latest reply in the thread read by the user. The value is never decreased.
+func (a *adapter) ThreadReadUpdate(topic string, user t.Uid, thread, readSeqId int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx,
+		"INSERT INTO threadreads(topic,userid,thread,readseqid) VALUES(?,?,?,?) "+
+			"ON DUPLICATE KEY UPDATE readseqid=GREATEST(readseqid,?)",
+		topic, store.DecodeUid(user), thread, readSeqId, readSeqId)
+	return err
+}
+
+// ThreadGetAll returns summaries of all threads in the topic as seen by the given user.
+func (a *adapter) ThreadGetAll(topic string, forUser t.Uid) ([]t.ThreadStatus, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	unum := store.DecodeUid(forUser)
+	rows, err := a.db.QueryContext(ctx,
+		"SELECT m.thread,COUNT(*),MAX(m.seqid),COALESCE(MAX(tr.readseqid),0),"+
+			"SUM(m.seqid>COALESCE(tr.readseqid,0))"+
+			" FROM messages AS m LEFT JOIN threadreads AS tr"+
+			" ON tr.topic=m.topic AND tr.thread=m.thread AND tr.userid=?"+
+			" LEFT JOIN dellog AS d"+
+			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+			" WHERE m.delid=0 AND m.topic=? AND m.thread>0 AND d.deletedfor IS NULL"+
+			" GROUP BY m.thread ORDER BY m.thread",
+		unum, unum, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var threads []t.ThreadStatus
+	for rows.Next() {
+		var ts t.ThreadStatus
+		if err = rows.Scan(&ts.Thread, &ts.Count, &ts.LastSeqId, &ts.ReadSeqId, &ts.Unread); err != nil {
+			break
+		}
+		threads = append(threads, ts)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return threads, err
+}
+
+// SchedMsgSave saves a message for delivery at a later time.
+func (a *adapter) SchedMsgSave(msg *t.ScheduledMessage) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	id := store.DecodeUid(msg.Uid())
+	if _, err = tx.Exec(
+		"INSERT INTO schedmsgs(id,createdat,updatedat,sendat,topic,userid,head,content,attachments) "+
+			"VALUES(?,?,?,?,?,?,?,?,?)",
+		id, msg.CreatedAt, msg.UpdatedAt, msg.SendAt, msg.Topic, decodeUidString(msg.From),
+		msg.Head, toJSON(msg.Content), msg.Attachments); err != nil {
+		return err
+	}
+
+	// Link attachments to the scheduled message to protect them from garbage collection.
+	for _, fid := range msg.Attachments {
+		if _, err = tx.Exec("INSERT INTO filemsglinks(createdat,fileid,schedid) VALUES(?,?,?)",
+			msg.CreatedAt, decodeUidString(fid), id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// schedMsgQuery returns scheduled messages selected by the query. If 'accept' is not nil, messages to topics
+// it does not accept are skipped and at most 'limit' messages are returned.
+func (a *adapter) schedMsgQuery(accept func(topic string) bool, limit int, query string, args ...any) ([]t.ScheduledMessage, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT id,createdat,updatedat,sendat,topic,userid AS `from`,head,content,attachments FROM schedmsgs"+
+			query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.ScheduledMessage
+	for rows.Next() {
+		var msg t.ScheduledMessage
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		if accept != nil && !accept(msg.Topic) {
+			continue
+		}
+		msg.SetUid(encodeUidString(msg.Id))
+		msg.From = encodeUidString(msg.From).String()
+		msg.Content = fromJSON(msg.Content)
+		msgs = append(msgs, msg)
+		if accept != nil && len(msgs) >= limit {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return msgs, err
+}
+
+// SchedMsgGetAll returns pending scheduled messages sent by the given user to the topic, earliest first.
+func (a *adapter) SchedMsgGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error) {
+	return a.schedMsgQuery(nil, 0, " WHERE topic=? AND userid=? ORDER BY sendat", topic, store.DecodeUid(user))
+}
+
+// SchedMsgGet returns the scheduled message with the given ID.
+func (a *adapter) SchedMsgGet(id t.Uid) (*t.ScheduledMessage, error) {
+	msgs, err := a.schedMsgQuery(nil, 0, " WHERE id=?", store.DecodeUid(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, t.ErrNotFound
+	}
+	return &msgs[0], nil
+}
+
+// SchedMsgGetDue returns up to 'limit' scheduled messages with SendAt before the given time, earliest first.
+// If 'accept' is not nil, only messages to topics it accepts are returned.
+func (a *adapter) SchedMsgGetDue(before time.Time, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error) {
+	if accept == nil {
+		return a.schedMsgQuery(nil, 0, " WHERE sendat<? ORDER BY sendat LIMIT ?", before, limit)
+	}
+	// Skipped messages don't count towards the limit: read until enough messages are accepted.
+	return a.schedMsgQuery(accept, limit, " WHERE sendat<? ORDER BY sendat", before)
+}
+
+// SchedMsgDelete deletes a scheduled message. If user is not zero, the message is deleted only if it was
+// sent by the user.
+func (a *adapter) SchedMsgDelete(id, user t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query := "DELETE FROM schedmsgs WHERE id=?"
+	args := []any{store.DecodeUid(id)}
+	if !user.IsZero() {
+		query += " AND userid=?"
+		args = append(args, store.DecodeUid(user))
+	}
+	// filemsglinks will be deleted because of ON DELETE CASCADE
+	res, err := a.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// ReactionUpsert creates or replaces user's reaction to a message.
+func (a *adapter) ReactionUpsert(r *t.Reaction) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		_, err := db.ExecContext(ctx,
+			"INSERT INTO reactions(createdat,topic,seqid,userid,value) VALUES(?,?,?,?,?) "+
+				"ON DUPLICATE KEY UPDATE createdat=?,value=?",
+			r.CreatedAt, r.Topic, r.SeqId, decodeUidString(r.User), r.Value, r.CreatedAt, r.Value)
+		return err
+	})
+}
+
+// ReactionDelete removes user's reaction to a message.
+func (a *adapter) ReactionDelete(topic string, seqId int, user t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		_, err := db.ExecContext(ctx, "DELETE FROM reactions WHERE topic=? AND seqid=? AND userid=?",
+			topic, seqId, store.DecodeUid(user))
+		return err
+	})
+}
+
+// ReactionGetAll returns reactions to messages with seq IDs in range [opts.Since, opts.Before).
+func (a *adapter) ReactionGetAll(topic string, opts *t.QueryOpt) ([]t.Reaction, error) {
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			upper = opts.Before - 1
+		}
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT createdat,topic,seqid,userid AS user,value FROM reactions"+
+			" WHERE topic=? AND seqid BETWEEN ? AND ? ORDER BY seqid,id",
+		topic, lower, upper)
+	if err != nil {
+		return nil, err
+	}
+
+	var reacts []t.Reaction
+	for rows.Next() {
+		var r t.Reaction
+		if err = rows.StructScan(&r); err != nil {
+			break
+		}
+		r.User = encodeUidString(r.User).String()
+		reacts = append(reacts, r)
 	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
 
-	return tx.Commit()
+	return reacts, err
 }
 
 func deviceHasher(deviceID string) string {
@@ -3179,12 +4196,14 @@ func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 	} else {
 		user = 0
 	}
-	_, err := a.db.ExecContext(ctx,
-		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location) "+
-			"VALUES(?,?,?,?,?,?,?,?)",
-		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
-		fd.Status, fd.MimeType, fd.Size, fd.Location)
-	return err
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		_, err := db.ExecContext(ctx,
+			"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location) "+
+				"VALUES(?,?,?,?,?,?,?,?)",
+			store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
+			fd.Status, fd.MimeType, fd.Size, fd.Location)
+		return err
+	})
 }
 
 // FileFinishUpload marks file upload as completed, successfully or otherwise
@@ -3225,6 +4244,9 @@ func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.
 	}
 	fd.UpdatedAt = now
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return nil, err
+	}
 	return fd, tx.Commit()
 }
 
@@ -3395,6 +4417,22 @@ func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []
 	return tx.Commit()
 }
 
+// FileRelinkMessages moves links of messages of the topic from one file to another.
+func (a *adapter) FileRelinkMessages(topic, oldFid, newFid string) error {
+	oldId, newId := t.ParseUid(oldFid), t.ParseUid(newFid)
+	if oldId.IsZero() || newId.IsZero() {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "UPDATE filemsglinks AS l INNER JOIN messages AS m ON m.id=l.msgid "+
+		"SET l.fileid=? WHERE l.fileid=? AND m.topic=?", store.DecodeUid(newId), store.DecodeUid(oldId), topic)
+	return err
+}
+
 // PCacheGet reads a persistet cache entry.
 func (a *adapter) PCacheGet(key string) (string, error) {
 	ctx, cancel := a.getContext()
@@ -3464,6 +4502,373 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 	return err
 }
 
+// WithOutbox returns a copy of the adapter which adds the events of the outbox to the outbox table in
+// the transaction of the next change.
+func (a *adapter) WithOutbox(outbox *adp.Outbox) adp.Adapter {
+	tx := *a
+	tx.outbox = outbox
+	return &tx
+}
+
+// OutboxAdd adds change events to the outbox table.
+func (a *adapter) OutboxAdd(entries []adp.OutboxEntry) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return outboxInsert(ctx, a.db, entries)
+}
+
+// OutboxGet returns the oldest change events from the outbox table.
+func (a *adapter) OutboxGet(limit int) ([]adp.OutboxEntry, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT id,event FROM outbox ORDER BY id LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []adp.OutboxEntry
+	for rows.Next() {
+		var entry adp.OutboxEntry
+		if err = rows.Scan(&entry.Offset, &entry.Event); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// OutboxDelete deletes delivered change events from the outbox table.
+func (a *adapter) OutboxDelete(offsets []string) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query, args, _ := sqlx.In("DELETE FROM outbox WHERE id IN (?)", offsets)
+	_, err := a.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// outboxWrite adds pending change events to the outbox table in the transaction of the change.
+func (a *adapter) outboxWrite(ctx context.Context, tx sqlx.ExecerContext) error {
+	if a.outbox == nil || a.outbox.Written {
+		return nil
+	}
+	if err := outboxInsert(ctx, tx, a.outbox.Entries()); err != nil {
+		return err
+	}
+	a.outbox.Written = true
+	return nil
+}
+
+// inOutboxTx makes a change with a single statement. If change events are pending, the statement is
+// executed in a transaction which also adds the events to the outbox table.
+func (a *adapter) inOutboxTx(ctx context.Context, change func(db sqlx.ExecerContext) error) error {
+	if a.outbox == nil || a.outbox.Written {
+		return change(a.db)
+	}
+
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = change(tx); err == nil {
+		err = a.outboxWrite(ctx, tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func outboxInsert(ctx context.Context, db sqlx.ExecerContext, entries []adp.OutboxEntry) error {
+	for _, entry := range entries {
+		if _, err := db.ExecContext(ctx, "INSERT INTO outbox(id,event) VALUES(?,?)", entry.Offset, entry.Event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Data export.
+
+// attachments loads IDs of files linked to the objects with the given IDs. The 'linkBy' is the
+// column which holds the object ID: msgid, topic or userid. The result is keyed by object ID.
+func (a *adapter) attachments(ctx context.Context, linkBy string, ids []any) (map[string]t.StringSlice, error) {
+	result := make(map[string]t.StringSlice)
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	q, args, _ := sqlx.In("SELECT "+linkBy+",fileid FROM filemsglinks WHERE "+linkBy+" IN (?) ORDER BY id", ids)
+	rows, err := a.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var linkId string
+		var fid int64
+		if err = rows.Scan(&linkId, &fid); err != nil {
+			return nil, err
+		}
+		result[linkId] = append(result[linkId], store.EncodeUid(fid).String())
+	}
+	return result, rows.Err()
+}
+
+// UserExport returns a page of users ordered by ID, including soft-deleted.
+func (a *adapter) UserExport(after t.Uid, limit int) ([]t.User, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT * FROM users WHERE id>? ORDER BY id LIMIT ?",
+		store.DecodeUid(after), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []t.User
+	var ids []any
+	for rows.Next() {
+		var user t.User
+		if err = rows.StructScan(&user); err != nil {
+			break
+		}
+		ids = append(ids, user.Id)
+		user.SetUid(encodeUidString(user.Id))
+		user.Public = fromJSON(user.Public)
+		user.Trusted = fromJSON(user.Trusted)
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "userid", ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Attachments = attachments[strconv.FormatInt(store.DecodeUid(users[i].Uid()), 10)]
+	}
+	return users, nil
+}
+
+// AuthExport returns all authentication records of the user.
+func (a *adapter) AuthExport(uid t.Uid) ([]adp.AuthRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT scheme,uname,authlvl,secret,expires FROM auth WHERE userid=? ORDER BY id",
+		store.DecodeUid(uid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []adp.AuthRecord
+	for rows.Next() {
+		var rec adp.AuthRecord
+		var expires *time.Time
+		if err = rows.Scan(&rec.Scheme, &rec.Unique, &rec.AuthLvl, &rec.Secret, &expires); err != nil {
+			return nil, err
+		}
+		if expires != nil {
+			rec.Expires = *expires
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// TopicExport returns a page of topics ordered by name, including soft-deleted.
+func (a *adapter) TopicExport(after string, limit int) ([]t.Topic, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags,pinned,msgttl "+
+			"FROM topics WHERE name>? ORDER BY name LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []t.Topic
+	var names []any
+	for rows.Next() {
+		var tt t.Topic
+		if err = rows.StructScan(&tt); err != nil {
+			break
+		}
+		tt.Owner = encodeUidString(tt.Owner).String()
+		tt.Public = fromJSON(tt.Public)
+		tt.Trusted = fromJSON(tt.Trusted)
+		topics = append(topics, tt)
+		names = append(names, tt.Id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "topic", names)
+	if err != nil {
+		return nil, err
+	}
+	for i := range topics {
+		topics[i].Attachments = attachments[topics[i].Id]
+	}
+	return topics, nil
+}
+
+// MessageExport returns a page of messages of the topic ordered by seq ID.
+func (a *adapter) MessageExport(topic string, from t.Uid, after, limit int) ([]t.Message, error) {
+	if limit <= 0 {
+		limit = a.maxMessageResults
+	}
+
+	where := "topic=? AND seqid>? AND delid<=0"
+	args := []any{topic, after}
+	if !from.IsZero() {
+		where += " AND `from`=?"
+		args = append(args, store.DecodeUid(from))
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT id,createdat,updatedat,deletedat,delid,seqid,topic,`from`,thread,head,content,COALESCE(plaintext,'') AS plaintext"+
+			" FROM messages WHERE "+where+" ORDER BY seqid LIMIT ?",
+		append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	var ids []any
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		ids = append(ids, msg.Id)
+		id, _ := strconv.ParseInt(msg.Id, 10, 64)
+		msg.SetUid(t.Uid(id))
+		msg.From = encodeUidString(msg.From).String()
+		msg.Content = fromJSON(msg.Content)
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "msgid", ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		msgs[i].Attachments = attachments[strconv.FormatInt(int64(msgs[i].Uid()), 10)]
+	}
+	return msgs, nil
+}
+
+// FileExport returns a page of file records ordered by ID.
+func (a *adapter) FileExport(after string, limit int) ([]t.FileDef, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
+		"FROM fileuploads WHERE id>? ORDER BY id LIMIT ?", store.DecodeUid(t.ParseUid(after)), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []t.FileDef
+	for rows.Next() {
+		var fd t.FileDef
+		if err = rows.StructScan(&fd); err != nil {
+			return nil, err
+		}
+		fd.Id = encodeUidString(fd.Id).String()
+		fd.User = encodeUidString(fd.User).String()
+		files = append(files, fd)
+	}
+	return files, rows.Err()
+}
+
+// PCacheExport returns a page of persistent cache entries ordered by key.
+func (a *adapter) PCacheExport(after string, limit int) ([]adp.PCacheEntry, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT `key`,`value` FROM kvmeta WHERE `key`>? AND `key`!='version' ORDER BY `key` LIMIT ?",
+		after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []adp.PCacheEntry
+	for rows.Next() {
+		var entry adp.PCacheEntry
+		if err = rows.Scan(&entry.Key, &entry.Value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
 // Helper functions
 
 // Check if MySQL error is a Error Code: 1062. Duplicate entry ... for key ...
@@ -0,0 +1,24 @@
+//go:build mysql
+// +build mysql
+
+package mysql
+
+import (
+	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/db/adaptertest"
+)
+
+// The test requires a running database server, it's skipped if the server is not available.
+// The database is dropped and re-created. Configuration can be overridden with the
+// TINODE_TEST_MYSQL environment variable. Run with:
+//
+//	go test -tags mysql ./db/mysql/
+func TestConformance(t *testing.T) {
+	adp, err := adaptertest.OpenStore(adapterName, adaptertest.Config(adapterName,
+		`{"User": "root", "Net": "tcp", "Addr": "localhost", "DBName": "tinode_test", "Collation": "utf8mb4_unicode_ci", "ParseTime": true}`))
+	if err != nil {
+		t.Skip("database is not available:", err)
+	}
+	adaptertest.Run(t, adp)
+}
@@ -25,6 +25,14 @@ CREATE TABLE kvmeta(
 
 INSERT INTO kvmeta(`key`, `value`) VALUES("version", "100");
 
+# Change events which are not delivered yet, keyed by offset.
+CREATE TABLE outbox(
+	id			VARCHAR(64) NOT NULL,
+	event		TEXT NOT NULL,
+
+	PRIMARY KEY(id)
+);
+
 CREATE TABLE users(
 	id 			BIGINT NOT NULL,
 	createdat 	DATETIME(3) NOT NULL,
@@ -102,6 +110,8 @@ CREATE TABLE topics(
 	delid		INT DEFAULT 0,
 	public		JSON,
 	tags		JSON, -- Denormalized array of tags
+	pinned		JSON, -- Array of IDs of pinned messages
+	msgttl		INT DEFAULT 0, -- Lifetime of messages in seconds, 0 = forever
 
 	PRIMARY KEY(id),
 	UNIQUE INDEX topics_name (name),
@@ -153,12 +163,81 @@ CREATE TABLE messages(
 	seqid 		INT NOT NULL,
 	topic 		CHAR(25) NOT NULL,
 	`from` 		BIGINT NOT NULL,
+	thread 		INT NOT NULL DEFAULT 0,
+	head 		JSON,
+	content 	JSON,
+	plaintext	TEXT, -- Text of the message for full-text search
+
+	PRIMARY KEY(id),
+	FOREIGN KEY(topic) REFERENCES topics(name),
+	UNIQUE INDEX messages_topic_seqid (topic, seqid),
+	INDEX messages_topic_thread_seqid (topic, thread, seqid),
+	INDEX messages_topic_createdat (topic, createdat),
+	FULLTEXT INDEX messages_plaintext (plaintext)
+);
+
+# Positions of users in threads: the latest reply read by the user
+CREATE TABLE threadreads(
+	id 			INT NOT NULL AUTO_INCREMENT,
+	topic 		CHAR(25) NOT NULL,
+	userid 		BIGINT NOT NULL,
+	thread 		INT NOT NULL,
+	readseqid 	INT NOT NULL,
+
+	PRIMARY KEY(id),
+	FOREIGN KEY(topic) REFERENCES topics(name),
+	UNIQUE INDEX threadreads_topic_userid_thread (topic, userid, thread),
+	INDEX threadreads_userid (userid)
+);
+
+# Earlier revisions of edited messages
+CREATE TABLE msgrevisions(
+	id 			INT NOT NULL AUTO_INCREMENT,
+	createdat 	DATETIME(3) NOT NULL,
+	msgid 		INT NOT NULL,
+	seqid 		INT NOT NULL,
+	topic 		CHAR(25) NOT NULL,
 	head 		JSON,
 	content 	JSON,
 
+	PRIMARY KEY(id),
+	FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+	INDEX msgrevisions_topic_seqid (topic, seqid)
+);
+
+# Reactions to messages, one per user per message
+CREATE TABLE reactions(
+	id 			INT NOT NULL AUTO_INCREMENT,
+	createdat 	DATETIME(3) NOT NULL,
+	topic 		CHAR(25) NOT NULL,
+	seqid 		INT NOT NULL,
+	userid 		BIGINT NOT NULL,
+	value 		VARCHAR(32) NOT NULL,
+
+	PRIMARY KEY(id),
+	FOREIGN KEY(topic) REFERENCES topics(name),
+	UNIQUE INDEX reactions_topic_seqid_userid (topic, seqid, userid),
+	INDEX reactions_userid (userid)
+);
+
+# Messages scheduled for delivery at a later time
+CREATE TABLE schedmsgs(
+	id			BIGINT NOT NULL,
+	createdat	DATETIME(3) NOT NULL,
+	updatedat	DATETIME(3) NOT NULL,
+	sendat		DATETIME(3) NOT NULL,
+	topic		CHAR(25) NOT NULL,
+	userid		BIGINT NOT NULL,
+	head		JSON,
+	content		JSON,
+	attachments	JSON,
+
 	PRIMARY KEY(id),
 	FOREIGN KEY(topic) REFERENCES topics(name),
-	UNIQUE INDEX messages_topic_seqid (topic, seqid)
+	# Used by the scheduler to find messages which are due for delivery
+	INDEX schedmsgs_sendat(sendat),
+	INDEX schedmsgs_topic_userid(topic, userid),
+	INDEX schedmsgs_userid(userid)
 );
 
 # Deletion log
@@ -222,10 +301,12 @@ CREATE TABLE filemsglinks(
 	msgid		INT,
 	topic		CHAR(25),
 	userid		BIGINT,
+	schedid		BIGINT,
 
 	PRIMARY KEY(id),
 	FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
 	FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
 	FOREIGN KEY(topicid) REFERENCES topics(id) ON DELETE CASCADE,
-	FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE
+	FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(schedid) REFERENCES schedmsgs(id) ON DELETE CASCADE
 );
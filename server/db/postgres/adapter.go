@@ -22,6 +22,7 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/jmoiron/sqlx"
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	adp "github.com/volvlabs/towncryer-chat-server/server/db"
 	"github.com/volvlabs/towncryer-chat-server/server/db/common"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
 	t "github.com/volvlabs/towncryer-chat-server/server/store/types"
@@ -43,10 +44,17 @@ type adapter struct {
 	sqlTimeout time.Duration
 	// DB transaction timeout.
 	txTimeout time.Duration
+
+	// Change events to add to the outbox table in the transaction of the next change, see WithOutbox.
+	outbox *adp.Outbox
+
+	// Read replicas and routing of queries between them.
+	replicas   []*pgxpool.Pool
+	readRouter *common.Replicas
 }
 
 const (
-	adpVersion  = 113
+	adpVersion  = 121
 	adapterName = "postgres"
 
 	defaultMaxResults = 1024
@@ -81,6 +89,19 @@ type configType struct {
 	// DB request timeout (in seconds).
 	// If 0 (or negative), no timeout is applied.
 	SqlTimeout int `json:"sql_timeout,omitempty"`
+
+	// DSNs of read replicas.
+	Replicas []string `json:"replicas,omitempty"`
+	// Replicas lagging behind the primary by more than this number of seconds are not used.
+	ReplicaMaxLag int `json:"replica_max_lag,omitempty"`
+}
+
+// Adapter stats when read replicas are configured.
+type replicatedStats struct {
+	Primary *pgxpool.Stat
+	// Number of queries which could use a replica but were sent to the primary.
+	PrimaryReads int64
+	Replicas     []common.ReplicaStats
 }
 
 func (a *adapter) getContext() (context.Context, context.CancelFunc) {
@@ -172,10 +193,71 @@ func (a *adapter) Open(jsonconfig json.RawMessage) error {
 			// We allocate txTimeoutMultiplier times sqlTimeout for transactions.
 			a.txTimeout = time.Duration(float64(config.SqlTimeout)*txTimeoutMultiplier) * time.Second
 		}
+		if len(config.Replicas) > 0 {
+			err = a.openReplicas(&config)
+		}
 	}
 	return err
 }
 
+// openReplicas initializes connections to read replicas and starts health checks.
+// Unavailable replicas are not an error: they are not used until they recover.
+func (a *adapter) openReplicas(config *configType) error {
+	var hosts []string
+	for _, dsn := range config.Replicas {
+		poolConfig, err := pgxpool.ParseConfig(dsn)
+		if err != nil {
+			return errors.New("postgres adapter failed to parse replica DSN: " + err.Error())
+		}
+		if config.MaxOpenConns > 0 {
+			poolConfig.MaxConns = int32(config.MaxOpenConns)
+		}
+		if config.ConnMaxLifetime > 0 {
+			poolConfig.MaxConnLifetime = time.Duration(config.ConnMaxLifetime) * time.Second
+		}
+		poolConfig.LazyConnect = true
+		db, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
+		if err != nil {
+			return err
+		}
+		a.replicas = append(a.replicas, db)
+		hosts = append(hosts, poolConfig.ConnConfig.Host)
+	}
+
+	a.readRouter = common.NewReplicas(hosts, time.Duration(config.ReplicaMaxLag)*time.Second)
+	a.readRouter.Start(a.replicaLag)
+	return nil
+}
+
+// replicaLag returns replication lag of the replica.
+func (a *adapter) replicaLag(i int) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), common.ReplicaCheckPeriod)
+	defer cancel()
+
+	// The time since the last replayed transaction is the lag only if there is more to replay,
+	// otherwise the replica is just idle.
+	var lag float64
+	err := a.replicas[i].QueryRow(ctx, "SELECT CASE WHEN NOT pg_is_in_recovery() "+
+		"OR pg_last_wal_receive_lsn()=pg_last_wal_replay_lsn() THEN 0 "+
+		"ELSE COALESCE(EXTRACT(EPOCH FROM now()-pg_last_xact_replay_timestamp()),0) END::float8").Scan(&lag)
+	return time.Duration(lag * float64(time.Second)), err
+}
+
+// reader returns a connection pool for reading data of the given topics or users.
+func (a *adapter) reader(keys ...string) *pgxpool.Pool {
+	if i := a.readRouter.Pick(keys...); i >= 0 {
+		return a.replicas[i]
+	}
+	return a.db
+}
+
+// wroteSubs records that the subscriptions were just written to the primary.
+func (a *adapter) wroteSubs(subs ...*t.Subscription) {
+	for _, sub := range subs {
+		a.readRouter.Wrote(sub.Topic, t.ParseUid(sub.User).UserId())
+	}
+}
+
 // Close closes the underlying database connection
 func (a *adapter) Close() error {
 	if a.db != nil {
@@ -183,6 +265,12 @@ func (a *adapter) Close() error {
 		a.db = nil
 		a.version = -1
 	}
+	a.readRouter.Stop()
+	a.readRouter = nil
+	for _, db := range a.replicas {
+		db.Close()
+	}
+	a.replicas = nil
 	return nil
 }
 
@@ -254,7 +342,11 @@ func (a *adapter) Stats() any {
 	if a.db == nil {
 		return nil
 	}
-	return a.db.Stat()
+	if a.readRouter == nil {
+		return a.db.Stat()
+	}
+	replicas, primaryReads := a.readRouter.Stats()
+	return &replicatedStats{Primary: a.db.Stat(), PrimaryReads: primaryReads, Replicas: replicas}
 }
 
 // GetName returns string that adapter uses to register itself with store.
@@ -413,6 +505,8 @@ func (a *adapter) CreateDb(reset bool) error {
 			public    JSON,
 			trusted   JSON,
 			tags      JSON,
+			pinned    JSON,
+			msgttl    INT DEFAULT 0,
 			PRIMARY KEY(id)
 		);
 		CREATE UNIQUE INDEX topics_name ON topics(name);
@@ -475,12 +569,88 @@ func (a *adapter) CreateDb(reset bool) error {
 			seqid     INT NOT NULL,
 			topic     VARCHAR(25) NOT NULL,
 			"from"    BIGINT NOT NULL,
+			thread    INT NOT NULL DEFAULT 0,
+			head      JSON,
+			content   JSON,
+			plaintext TEXT,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		);
+		CREATE UNIQUE INDEX messages_topic_seqid ON messages(topic, seqid);
+		CREATE INDEX messages_topic_thread_seqid ON messages(topic, thread, seqid);
+		CREATE INDEX messages_topic_createdat ON messages(topic, createdat);
+		CREATE INDEX messages_plaintext ON messages USING GIN(to_tsvector('simple', plaintext));`); err != nil {
+		return err
+	}
+
+	// Positions of users in threads.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE threadreads(
+			id        SERIAL NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			thread    INT NOT NULL,
+			readseqid INT NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		);
+		CREATE UNIQUE INDEX threadreads_topic_userid_thread ON threadreads(topic, userid, thread);
+		CREATE INDEX threadreads_userid ON threadreads(userid);`); err != nil {
+		return err
+	}
+
+	// Earlier revisions of edited messages.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE msgrevisions(
+			id        SERIAL NOT NULL,
+			createdat TIMESTAMP(3) NOT NULL,
+			msgid     INT NOT NULL,
+			seqid     INT NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
 			head      JSON,
 			content   JSON,
 			PRIMARY KEY(id),
+			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE
+		);
+		CREATE INDEX msgrevisions_topic_seqid ON msgrevisions(topic, seqid);`); err != nil {
+		return err
+	}
+
+	// Reactions to messages, one per user per message.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE reactions(
+			id        SERIAL NOT NULL,
+			createdat TIMESTAMP(3) NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			userid    BIGINT NOT NULL,
+			value     VARCHAR(32) NOT NULL,
+			PRIMARY KEY(id),
 			FOREIGN KEY(topic) REFERENCES topics(name)
 		);
-		CREATE UNIQUE INDEX messages_topic_seqid ON messages(topic, seqid);`); err != nil {
+		CREATE UNIQUE INDEX reactions_topic_seqid_userid ON reactions(topic, seqid, userid);
+		CREATE INDEX reactions_userid ON reactions(userid);`); err != nil {
+		return err
+	}
+
+	// Messages scheduled for delivery at a later time.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE schedmsgs(
+			id          BIGINT NOT NULL,
+			createdat   TIMESTAMP(3) NOT NULL,
+			updatedat   TIMESTAMP(3) NOT NULL,
+			sendat      TIMESTAMP(3) NOT NULL,
+			topic       VARCHAR(25) NOT NULL,
+			userid      BIGINT NOT NULL,
+			head        JSON,
+			content     JSON,
+			attachments JSON,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		);
+		CREATE INDEX schedmsgs_sendat ON schedmsgs(sendat);
+		CREATE INDEX schedmsgs_topic_userid ON schedmsgs(topic, userid);
+		CREATE INDEX schedmsgs_userid ON schedmsgs(userid);`); err != nil {
 		return err
 	}
 
@@ -551,11 +721,23 @@ func (a *adapter) CreateDb(reset bool) error {
 			msgid     INT,
 			topic     VARCHAR(25),
 			userid    BIGINT,
+			schedid   BIGINT,
 			PRIMARY KEY(id),
 			FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
 			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
 			FOREIGN KEY(topic) REFERENCES topics(name) ON DELETE CASCADE,
-			FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE
+			FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY(schedid) REFERENCES schedmsgs(id) ON DELETE CASCADE
+		);`); err != nil {
+		return err
+	}
+
+	// Change events which are not delivered yet, keyed by offset.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE outbox(
+			id    VARCHAR(64) NOT NULL,
+			event TEXT NOT NULL,
+			PRIMARY KEY(id)
 		);`); err != nil {
 		return err
 	}
@@ -628,6 +810,197 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+
+		// Table for storing earlier revisions of edited messages.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE msgrevisions(
+				id        SERIAL NOT NULL,
+				createdat TIMESTAMP(3) NOT NULL,
+				msgid     INT NOT NULL,
+				seqid     INT NOT NULL,
+				topic     VARCHAR(25) NOT NULL,
+				head      JSON,
+				content   JSON,
+				PRIMARY KEY(id),
+				FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE
+			);
+			CREATE INDEX msgrevisions_topic_seqid ON msgrevisions(topic, seqid);`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+
+		// Table for storing reactions to messages.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE reactions(
+				id        SERIAL NOT NULL,
+				createdat TIMESTAMP(3) NOT NULL,
+				topic     VARCHAR(25) NOT NULL,
+				seqid     INT NOT NULL,
+				userid    BIGINT NOT NULL,
+				value     VARCHAR(32) NOT NULL,
+				PRIMARY KEY(id),
+				FOREIGN KEY(topic) REFERENCES topics(name)
+			);
+			CREATE UNIQUE INDEX reactions_topic_seqid_userid ON reactions(topic, seqid, userid);
+			CREATE INDEX reactions_userid ON reactions(userid);`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+
+		// Add parent reference to messages.
+		if _, err := a.db.Exec(ctx,
+			`ALTER TABLE messages ADD thread INT NOT NULL DEFAULT 0;
+			CREATE INDEX messages_topic_thread_seqid ON messages(topic, thread, seqid);`); err != nil {
+			return err
+		}
+
+		// Table for storing positions of users in threads.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE threadreads(
+				id        SERIAL NOT NULL,
+				topic     VARCHAR(25) NOT NULL,
+				userid    BIGINT NOT NULL,
+				thread    INT NOT NULL,
+				readseqid INT NOT NULL,
+				PRIMARY KEY(id),
+				FOREIGN KEY(topic) REFERENCES topics(name)
+			);
+			CREATE UNIQUE INDEX threadreads_topic_userid_thread ON threadreads(topic, userid, thread);
+			CREATE INDEX threadreads_userid ON threadreads(userid);`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+
+		// Add list of pinned messages to topics.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE topics ADD pinned JSON"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Perform database upgrade from version 117 to version 118.
+
+		// Table for storing messages scheduled for delivery at a later time.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE schedmsgs(
+				id          BIGINT NOT NULL,
+				createdat   TIMESTAMP(3) NOT NULL,
+				updatedat   TIMESTAMP(3) NOT NULL,
+				sendat      TIMESTAMP(3) NOT NULL,
+				topic       VARCHAR(25) NOT NULL,
+				userid      BIGINT NOT NULL,
+				head        JSON,
+				content     JSON,
+				attachments JSON,
+				PRIMARY KEY(id),
+				FOREIGN KEY(topic) REFERENCES topics(name)
+			);
+			CREATE INDEX schedmsgs_sendat ON schedmsgs(sendat);
+			CREATE INDEX schedmsgs_topic_userid ON schedmsgs(topic, userid);
+			CREATE INDEX schedmsgs_userid ON schedmsgs(userid);`); err != nil {
+			return err
+		}
+
+		// Attachments of scheduled messages must not be garbage collected.
+		if _, err := a.db.Exec(ctx,
+			"ALTER TABLE filemsglinks ADD schedid BIGINT REFERENCES schedmsgs(id) ON DELETE CASCADE"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Perform database upgrade from version 118 to version 119.
+
+		// Add lifetime of messages to topics.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE topics ADD msgttl INT DEFAULT 0"); err != nil {
+			return err
+		}
+
+		// Index for finding expired messages.
+		if _, err := a.db.Exec(ctx, "CREATE INDEX messages_topic_createdat ON messages(topic, createdat)"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+
+		// Add full-text index of message content. Messages sent before the upgrade are not indexed.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE messages ADD plaintext TEXT"); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec(ctx,
+			"CREATE INDEX messages_plaintext ON messages USING GIN(to_tsvector('simple', plaintext))"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 120 {
+		// Perform database upgrade from version 120 to version 121.
+
+		// Outbox of change events.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE outbox(
+				id    VARCHAR(64) NOT NULL,
+				event TEXT NOT NULL,
+				PRIMARY KEY(id)
+			)`); err != nil {
+			return err
+		}
+
+		// Move undelivered events from the persistent cache, where they were kept before.
+		if _, err := a.db.Exec(ctx, `INSERT INTO outbox(id,event) `+
+			`SELECT SUBSTRING("key",5),"value" FROM kvmeta WHERE "key" LIKE 'cdc:%'`); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec(ctx, `DELETE FROM kvmeta WHERE "key" LIKE 'cdc:%'`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 121); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -713,6 +1086,9 @@ func (a *adapter) UserCreate(user *t.User) error {
 		return err
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -978,11 +1354,35 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 
 		// Delete topics where the user is the owner.
 
+		// Delete user's reactions to messages and positions in threads.
+		if _, err = tx.Exec(ctx, "DELETE FROM reactions WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM threadreads WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+		// Delete messages the user scheduled for later delivery.
+		if _, err = tx.Exec(ctx, "DELETE FROM schedmsgs WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
 		// First delete all messages in those topics.
 		if _, err = tx.Exec(ctx, "DELETE FROM dellog USING topics WHERE topics.name=dellog.topic AND topics.owner=$1",
 			decoded_uid); err != nil {
 			return err
 		}
+		if _, err = tx.Exec(ctx, "DELETE FROM reactions USING topics WHERE topics.name=reactions.topic AND topics.owner=$1",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM threadreads USING topics WHERE topics.name=threadreads.topic AND topics.owner=$1",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM schedmsgs USING topics WHERE topics.name=schedmsgs.topic AND topics.owner=$1",
+			decoded_uid); err != nil {
+			return err
+		}
 		if _, err = tx.Exec(ctx, "DELETE FROM messages USING topics WHERE topics.name=messages.topic AND topics.owner=$1",
 			decoded_uid); err != nil {
 			return err
@@ -1062,6 +1462,9 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 		}
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -1146,6 +1549,9 @@ func (a *adapter) UserUpdate(uid t.Uid, update map[string]any) error {
 		}
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -1343,6 +1749,9 @@ func (a *adapter) TopicCreate(topic *t.Topic) error {
 	if err != nil {
 		return err
 	}
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -1391,6 +1800,8 @@ func createSubscription(ctx context.Context, tx pgx.Tx, sub *t.Subscription, und
 
 // TopicCreateP2P given two users creates a p2p topic
 func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
+	a.wroteSubs(initiator, invited)
+
 	ctx, cancel := a.getContextForTx()
 	if cancel != nil {
 		defer cancel()
@@ -1423,6 +1834,9 @@ func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
 		return err
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -1436,10 +1850,10 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 	var tt = new(t.Topic)
 	var owner int64
 	err := a.db.QueryRow(ctx,
-		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags "+
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags,pinned,msgttl "+
 			"FROM topics WHERE name=$1",
 		topic).Scan(&tt.CreatedAt, &tt.UpdatedAt, &tt.State, &tt.StateAt, &tt.TouchedAt, &tt.Id,
-		&tt.UseBt, &tt.Access, &owner, &tt.SeqId, &tt.DelId, &tt.Public, &tt.Trusted, &tt.Tags)
+		&tt.UseBt, &tt.Access, &owner, &tt.SeqId, &tt.DelId, &tt.Public, &tt.Trusted, &tt.Tags, &tt.Pinned, &tt.MsgTTL)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			// Nothing found - clear the error
@@ -1456,6 +1870,8 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 // TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
 // Reads and denormalizes Public value.
 func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	db := a.reader(uid.UserId())
+
 	// Fetch ALL user's subscriptions, even those which has not been modified recently.
 	// We are going to use these subscriptions to fetch topics and users which may have been modified recently.
 	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
@@ -1499,7 +1915,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.Query(ctx, q, args...)
+	rows, err := db.Query(ctx, q, args...)
 
 	if err != nil {
 		rows.Close()
@@ -1592,7 +2008,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 		if cancel2 != nil {
 			defer cancel2()
 		}
-		rows, err = a.db.Query(ctx2, q, newargs...)
+		rows, err = db.Query(ctx2, q, newargs...)
 		if err != nil {
 			rows.Close()
 			return nil, err
@@ -1649,7 +2065,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 			defer cancel3()
 		}
 
-		rows, err = a.db.Query(ctx3, q, newargs...)
+		rows, err = db.Query(ctx3, q, newargs...)
 		if err != nil {
 			return nil, err
 		}
@@ -1696,6 +2112,8 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 // The difference between UsersForTopic vs SubsForTopic is that the former loads user.Public,
 // the latter does not.
 func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	db := a.reader(topic)
+
 	tcat := t.GetTopicCat(topic)
 
 	// Fetch all subscribed users. The number of users is not large
@@ -1743,7 +2161,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.Query(ctx, q, args...)
+	rows, err := db.Query(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -1856,6 +2274,8 @@ func (a *adapter) ChannelsForUser(uid t.Uid) ([]string, error) {
 }
 
 func (a *adapter) TopicShare(shares []*t.Subscription) error {
+	a.wroteSubs(shares...)
+
 	ctx, cancel := a.getContextForTx()
 	if cancel != nil {
 		defer cancel()
@@ -1877,6 +2297,9 @@ func (a *adapter) TopicShare(shares []*t.Subscription) error {
 		}
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -1935,6 +2358,9 @@ func (a *adapter) TopicDelete(topic string, isChan, hard bool) error {
 			return err
 		}
 	}
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -1988,6 +2414,9 @@ func (a *adapter) TopicUpdate(topic string, update map[string]any) error {
 		}
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -1996,8 +2425,10 @@ func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
 	if cancel != nil {
 		defer cancel()
 	}
-	_, err := a.db.Exec(ctx, "UPDATE topics SET owner=$1 WHERE name=$2", store.DecodeUid(newOwner), topic)
-	return err
+	return a.inOutboxTx(ctx, func(db pgxQuerier) error {
+		_, err := db.Exec(ctx, "UPDATE topics SET owner=$1 WHERE name=$2", store.DecodeUid(newOwner), topic)
+		return err
+	})
 }
 
 // Get a subscription of a user to a topic.
@@ -2076,6 +2507,8 @@ func (a *adapter) SubsForUser(forUser t.Uid) ([]t.Subscription, error) {
 // The difference between UsersForTopic vs SubsForTopic is that the former loads user.public+trusted,
 // the latter does not.
 func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	db := a.reader(topic)
+
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
 		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
 
@@ -2107,7 +2540,7 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.Query(ctx, q, args...)
+	rows, err := db.Query(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -2137,6 +2570,8 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 
 // SubsUpdate updates one or multiple subscriptions to a topic.
 func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]any) error {
+	a.readRouter.Wrote(topic, user.UserId())
+
 	ctx, cancel := a.getContextForTx()
 	if cancel != nil {
 		defer cancel()
@@ -2166,11 +2601,16 @@ func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]any) er
 		return err
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
 // SubsDelete marks subscription as deleted.
 func (a *adapter) SubsDelete(topic string, user t.Uid) error {
+	a.readRouter.Wrote(topic, user.UserId())
+
 	ctx, cancel := a.getContext()
 	if cancel != nil {
 		defer cancel()
@@ -2209,6 +2649,9 @@ func (a *adapter) SubsDelete(topic string, user t.Uid) error {
 		return err
 	}
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
@@ -2429,71 +2872,40 @@ func (a *adapter) FindTopics(req [][]string, opt []string, activeOnly bool) ([]t
 
 }
 
-// Messages
-func (a *adapter) MessageSave(msg *t.Message) error {
-	ctx, cancel := a.getContext()
-	if cancel != nil {
-		defer cancel()
-	}
-	// store assignes message ID, but we don't use it. Message IDs are not used anywhere.
-	// Using a sequential ID provided by the database.
-	var id int
-	err := a.db.QueryRow(ctx,
-		`INSERT INTO messages(createdAt,updatedAt,seqid,topic,"from",head,content) VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING id`,
-		msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
-		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, toJSON(msg.Content)).Scan(&id)
-	if err == nil {
-		// Replacing ID given by store by ID given by the DB.
-		msg.SetUid(t.Uid(id))
+// MessageSearch finds messages in the given topics which contain all of the given words.
+func (a *adapter) MessageSearch(topics []string, forUser t.Uid, words []string, opts *t.QueryOpt) ([]t.Message, error) {
+	if len(topics) == 0 || len(words) == 0 {
+		return nil, nil
 	}
-	return err
-}
-
-func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
-	var limit = a.maxMessageResults
-	var lower = 0
-	var upper = 1<<31 - 1
-
-	if opts != nil {
-		if opts.Since > 0 {
-			lower = opts.Since
-		}
-		if opts.Before > 0 {
-			// MySQL BETWEEN is inclusive-inclusive, Tinode API requires inclusive-exclusive, thus -1
-			upper = opts.Before - 1
-		}
 
-		if opts.Limit > 0 && opts.Limit < limit {
-			limit = opts.Limit
-		}
+	limit := a.maxMessageResults
+	if opts != nil && opts.Limit > 0 && opts.Limit < limit {
+		limit = opts.Limit
 	}
 
-	unum := store.DecodeUid(forUser)
-
 	ctx, cancel := a.getContext()
 	if cancel != nil {
 		defer cancel()
 	}
 
-	rows, err := a.db.Query(
-		ctx,
-		`SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m."from",m.head,m.content`+
+	// The 'simple' configuration does not stem words, so it works for any language.
+	rows, err := a.db.Query(ctx,
+		`SELECT m.createdat,m.seqid,m.topic,m."from",m.plaintext`+
 			" FROM messages AS m LEFT JOIN dellog AS d"+
 			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=$1"+
-			" WHERE m.delid=0 AND m.topic=$2 AND m.seqid BETWEEN $3 AND $4 AND d.deletedfor IS NULL"+
-			" ORDER BY m.seqid DESC LIMIT $5",
-		unum, topic, lower, upper, limit)
+			" WHERE m.delid=0 AND m.topic=ANY($2) AND to_tsvector('simple', m.plaintext) @@ to_tsquery('simple', $3)"+
+			" AND d.deletedfor IS NULL ORDER BY m.createdat DESC LIMIT $4",
+		store.DecodeUid(forUser), topics, strings.Join(words, " & "), limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	msgs := make([]t.Message, 0, limit)
+	var msgs []t.Message
 	for rows.Next() {
 		var msg t.Message
 		var from int64
-		if err = rows.Scan(&msg.CreatedAt, &msg.UpdatedAt, &msg.DeletedAt, &msg.DelId, &msg.SeqId,
-			&msg.Topic, &from, &msg.Head, &msg.Content); err != nil {
+		if err = rows.Scan(&msg.CreatedAt, &msg.SeqId, &msg.Topic, &from, &msg.PlainText); err != nil {
 			break
 		}
 		msg.From = store.EncodeUid(from).String()
@@ -2506,20 +2918,192 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 	return msgs, err
 }
 
-// Get ranges of deleted messages
-func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
-	var limit = a.maxResults
-	var lower = 0
-	var upper = 1<<31 - 1
+// Messages
+func (a *adapter) MessageSave(msg *t.Message) error {
+	a.readRouter.Wrote(msg.Topic)
 
-	if opts != nil {
-		if opts.Since > 0 {
-			lower = opts.Since
-		}
-		if opts.Before > 1 {
-			// DelRange is inclusive-exclusive, while BETWEEN is inclusive-inclisive.
-			upper = opts.Before - 1
-		}
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	// store assignes message ID, but we don't use it. Message IDs are not used anywhere.
+	// Using a sequential ID provided by the database.
+	return a.inOutboxTx(ctx, func(db pgxQuerier) error {
+		var id int
+		err := db.QueryRow(ctx,
+			`INSERT INTO messages(createdAt,updatedAt,seqid,topic,"from",thread,head,content,plaintext) `+
+				`VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING id`,
+			msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
+			store.DecodeUid(t.ParseUid(msg.From)), msg.Thread, msg.Head, toJSON(msg.Content), msg.PlainText).Scan(&id)
+		if err == nil {
+			// Replacing ID given by store by ID given by the DB.
+			msg.SetUid(t.Uid(id))
+		}
+		return err
+	})
+}
+
+// MessageEdit replaces head and content of an existing message. The previous version is saved as a revision.
+func (a *adapter) MessageEdit(msg *t.Message) (err error) {
+	a.readRouter.Wrote(msg.Topic)
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var id int
+	if err = tx.QueryRow(ctx, "SELECT id FROM messages WHERE topic=$1 AND seqid=$2 AND delid=0 FOR UPDATE",
+		msg.Topic, msg.SeqId).Scan(&id); err != nil {
+		if err == pgx.ErrNoRows {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+
+	// Revision timestamp is the time when the previous version was written.
+	if _, err = tx.Exec(ctx,
+		"INSERT INTO msgrevisions(createdat,msgid,seqid,topic,head,content) "+
+			"SELECT updatedat,id,seqid,topic,head,content FROM messages WHERE id=$1", id); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(ctx, "UPDATE messages SET updatedat=$1,head=$2,content=$3,plaintext=$4 WHERE id=$5",
+		msg.UpdatedAt, msg.Head, toJSON(msg.Content), msg.PlainText, id); err != nil {
+		return err
+	}
+
+	msg.SetUid(t.Uid(id))
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// MessageGetRevisions returns earlier revisions of the given message, oldest first.
+func (a *adapter) MessageGetRevisions(topic string, seqId int) ([]t.Message, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		`SELECT r.createdat,r.seqid,r.topic,m."from",r.head,r.content`+
+			" FROM msgrevisions AS r INNER JOIN messages AS m ON m.id=r.msgid"+
+			" WHERE r.topic=$1 AND r.seqid=$2 AND m.delid=0 ORDER BY r.id",
+		topic, seqId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revs []t.Message
+	for rows.Next() {
+		var rev t.Message
+		var from int64
+		if err = rows.Scan(&rev.CreatedAt, &rev.SeqId, &rev.Topic, &from, &rev.Head, &rev.Content); err != nil {
+			break
+		}
+		rev.UpdatedAt = rev.CreatedAt
+		rev.From = store.EncodeUid(from).String()
+		revs = append(revs, rev)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return revs, err
+}
+
+func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
+	db := a.reader(topic)
+
+	var limit = a.maxMessageResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			// MySQL BETWEEN is inclusive-inclusive, Tinode API requires inclusive-exclusive, thus -1
+			upper = opts.Before - 1
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	unum := store.DecodeUid(forUser)
+	args := []any{unum, topic, lower, upper, limit}
+	threadFilter := ""
+	if opts != nil && opts.Thread > 0 {
+		threadFilter = " AND m.thread=$6"
+		args = append(args, opts.Thread)
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := db.Query(
+		ctx,
+		`SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m."from",m.thread,m.head,m.content`+
+			" FROM messages AS m LEFT JOIN dellog AS d"+
+			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=$1"+
+			" WHERE m.delid=0 AND m.topic=$2 AND m.seqid BETWEEN $3 AND $4"+threadFilter+" AND d.deletedfor IS NULL"+
+			" ORDER BY m.seqid DESC LIMIT $5",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := make([]t.Message, 0, limit)
+	for rows.Next() {
+		var msg t.Message
+		var from int64
+		if err = rows.Scan(&msg.CreatedAt, &msg.UpdatedAt, &msg.DeletedAt, &msg.DelId, &msg.SeqId,
+			&msg.Topic, &from, &msg.Thread, &msg.Head, &msg.Content); err != nil {
+			break
+		}
+		msg.From = store.EncodeUid(from).String()
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return msgs, err
+}
+
+// Get ranges of deleted messages
+func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
+	db := a.reader(topic)
+
+	var limit = a.maxResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 1 {
+			// DelRange is inclusive-exclusive, while BETWEEN is inclusive-inclisive.
+			upper = opts.Before - 1
+		}
 
 		if opts.Limit > 0 && opts.Limit < limit {
 			limit = opts.Limit
@@ -2531,7 +3115,7 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	if cancel != nil {
 		defer cancel()
 	}
-	rows, err := a.db.Query(ctx, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=$1 AND delid BETWEEN $2 AND $3"+
+	rows, err := db.Query(ctx, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=$1 AND delid BETWEEN $2 AND $3"+
 		" AND (deletedFor=0 OR deletedFor=$4) ORDER BY delid LIMIT $5",
 		topic, lower, upper, store.DecodeUid(forUser), limit)
 	if err != nil {
@@ -2585,11 +3169,145 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, err
 }
 
+// MessageGetExpired finds topics with messages which have outlived the topic's message TTL.
+// If 'accept' is not nil, only topics it accepts are checked.
+func (a *adapter) MessageGetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]t.Range, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Messages expire at different times in different topics. Find topics with TTL first, then use
+	// the (topic, createdat) index to find expired messages in each of them.
+	rows, err := a.db.Query(ctx, "SELECT name,msgttl FROM topics WHERE msgttl>0 AND state!=$1", t.StateDeleted)
+	if err != nil {
+		return nil, err
+	}
+	type topicTTL struct {
+		name string
+		ttl  int
+	}
+	var topics []topicTTL
+	for rows.Next() {
+		var tt topicTTL
+		if err = rows.Scan(&tt.name, &tt.ttl); err != nil {
+			break
+		}
+		if accept == nil || accept(tt.name) {
+			topics = append(topics, tt)
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make(map[string]t.Range)
+	for _, tt := range topics {
+		if len(expired) >= limit {
+			break
+		}
+		var low, hi *int
+		err = a.db.QueryRow(ctx, "SELECT MIN(seqid),MAX(seqid) FROM messages WHERE topic=$1 AND createdat<$2 AND delid=0",
+			tt.name, now.Add(-time.Duration(tt.ttl)*time.Second)).Scan(&low, &hi)
+		if err != nil {
+			return nil, err
+		}
+		if low == nil {
+			// No expired messages in this topic.
+			continue
+		}
+		rng := t.Range{Low: *low}
+		if *hi > *low {
+			// Range is inclusive-exclusive.
+			rng.Hi = *hi + 1
+		}
+		expired[tt.name] = rng
+	}
+	return expired, nil
+}
+
+// MessageArchive replaces live messages in the range with stubs linked to the segment file.
+func (a *adapter) MessageArchive(topic string, rng t.Range, segment string, unchangedSince time.Time) (err error) {
+	fid := t.ParseUid(segment)
+	if (segment != "" && fid.IsZero()) || rng.Hi <= rng.Low {
+		return t.ErrMalformed
+	}
+
+	a.readRouter.Wrote(topic)
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	where := "m.topic=? AND m.seqid>=? AND m.seqid<? AND m.delid=0"
+	args := []any{topic, rng.Low, rng.Hi}
+
+	// Earlier revisions are kept in the segment.
+	query, newargs := expandQuery("DELETE FROM msgrevisions AS r USING messages AS m WHERE m.id=r.msgid AND "+
+		where, args...)
+	if _, err = tx.Exec(ctx, query, newargs...); err != nil {
+		return err
+	}
+
+	if !fid.IsZero() {
+		query, newargs = expandQuery("INSERT INTO filemsglinks(createdat,fileid,msgid) SELECT ?::TIMESTAMP(3),?::BIGINT,m.id "+
+			"FROM messages AS m WHERE "+where, append([]any{t.TimeNow(), store.DecodeUid(fid)}, args...)...)
+		if _, err = tx.Exec(ctx, query, newargs...); err != nil {
+			return err
+		}
+	}
+
+	query, newargs = expandQuery("UPDATE messages AS m SET delid=?,head=NULL,content=NULL,plaintext=NULL WHERE "+
+		where, append([]any{t.MsgDelIdArchived}, args...)...)
+	if _, err = tx.Exec(ctx, query, newargs...); err != nil {
+		return err
+	}
+
+	if !unchangedSince.IsZero() {
+		// Checking after the update: earlier edits are visible, later ones wait for the row locks.
+		var changed int
+		err = tx.QueryRow(ctx, "SELECT COUNT(*) FROM messages WHERE topic=$1 AND seqid>=$2 AND seqid<$3 AND "+
+			"(updatedat>=$4 OR deletedat>=$4)", topic, rng.Low, rng.Hi, unchangedSince).Scan(&changed)
+		if err != nil {
+			return err
+		}
+		if changed > 0 {
+			return t.ErrConflict
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
 func messageDeleteList(ctx context.Context, tx pgx.Tx, topic string, toDel *t.DelMessage) error {
 	var err error
 	if toDel == nil {
 		// Whole topic is being deleted, thus also deleting all messages.
 		_, err = tx.Exec(ctx, "DELETE FROM dellog WHERE topic=$1", topic)
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM reactions WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM threadreads WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM schedmsgs WHERE topic=$1", topic)
+		}
 		if err == nil {
 			_, err = tx.Exec(ctx, "DELETE FROM messages WHERE topic=$1", topic)
 		}
@@ -2646,7 +3364,22 @@ func messageDeleteList(ctx context.Context, tx pgx.Tx, topic string, toDel *t.De
 				return err
 			}
 
-			query, newargs = expandQuery("UPDATE messages AS m SET deletedat=?,delid=?,head=NULL,content=NULL WHERE "+
+			// Earlier revisions are deleted together with the message.
+			query, newargs = expandQuery("DELETE FROM msgrevisions AS r USING messages AS m WHERE m.id=r.msgid AND "+
+				where, args...)
+			_, err = tx.Exec(ctx, query, newargs...)
+			if err != nil {
+				return err
+			}
+
+			query, newargs = expandQuery("DELETE FROM reactions AS r USING messages AS m "+
+				"WHERE m.topic=r.topic AND m.seqid=r.seqid AND "+where, args...)
+			_, err = tx.Exec(ctx, query, newargs...)
+			if err != nil {
+				return err
+			}
+
+			query, newargs = expandQuery("UPDATE messages AS m SET deletedat=?,delid=?,head=NULL,content=NULL,plaintext=NULL WHERE "+
 				where, t.TimeNow(), toDel.DelId, args)
 
 			_, err = tx.Exec(ctx, query, newargs...)
@@ -2658,6 +3391,8 @@ func messageDeleteList(ctx context.Context, tx pgx.Tx, topic string, toDel *t.De
 
 // MessageDeleteList deletes messages in the given topic with seqIds from the list
 func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err error) {
+	a.readRouter.Wrote(topic)
+
 	ctx, cancel := a.getContextForTx()
 	if cancel != nil {
 		defer cancel()
@@ -2673,11 +3408,265 @@ func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err erro
 		}
 	}()
 
-	if err = messageDeleteList(ctx, tx, topic, toDel); err != nil {
-		return err
+	if err = messageDeleteList(ctx, tx, topic, toDel); err != nil {
+		return err
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ThreadReadUpdate records the latest reply in the thread read by the user. The value is never decreased.
+func (a *adapter) ThreadReadUpdate(topic string, user t.Uid, thread, readSeqId int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO threadreads(topic,userid,thread,readseqid) VALUES($1,$2,$3,$4) "+
+			"ON CONFLICT(topic,userid,thread) DO UPDATE SET readseqid=GREATEST(threadreads.readseqid,EXCLUDED.readseqid)",
+		topic, store.DecodeUid(user), thread, readSeqId)
+	return err
+}
+
+// ThreadGetAll returns summaries of all threads in the topic as seen by the given user.
+func (a *adapter) ThreadGetAll(topic string, forUser t.Uid) ([]t.ThreadStatus, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT m.thread,COUNT(*),MAX(m.seqid),COALESCE(MAX(tr.readseqid),0),"+
+			"SUM(CASE WHEN m.seqid>COALESCE(tr.readseqid,0) THEN 1 ELSE 0 END)"+
+			" FROM messages AS m LEFT JOIN threadreads AS tr"+
+			" ON tr.topic=m.topic AND tr.thread=m.thread AND tr.userid=$1"+
+			" LEFT JOIN dellog AS d"+
+			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=$1"+
+			" WHERE m.delid=0 AND m.topic=$2 AND m.thread>0 AND d.deletedfor IS NULL"+
+			" GROUP BY m.thread ORDER BY m.thread",
+		store.DecodeUid(forUser), topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var threads []t.ThreadStatus
+	for rows.Next() {
+		var ts t.ThreadStatus
+		var count, unread int64
+		if err = rows.Scan(&ts.Thread, &count, &ts.LastSeqId, &ts.ReadSeqId, &unread); err != nil {
+			break
+		}
+		ts.Count, ts.Unread = int(count), int(unread)
+		threads = append(threads, ts)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return threads, err
+}
+
+// SchedMsgSave saves a message for delivery at a later time.
+func (a *adapter) SchedMsgSave(msg *t.ScheduledMessage) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	id := store.DecodeUid(msg.Uid())
+	if _, err = tx.Exec(ctx,
+		"INSERT INTO schedmsgs(id,createdat,updatedat,sendat,topic,userid,head,content,attachments) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)",
+		id, msg.CreatedAt, msg.UpdatedAt, msg.SendAt, msg.Topic, decodeUidString(msg.From),
+		msg.Head, toJSON(msg.Content), msg.Attachments); err != nil {
+		return err
+	}
+
+	// Link attachments to the scheduled message to protect them from garbage collection.
+	for _, fid := range msg.Attachments {
+		if _, err = tx.Exec(ctx, "INSERT INTO filemsglinks(createdat,fileid,schedid) VALUES($1,$2,$3)",
+			msg.CreatedAt, decodeUidString(fid), id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// schedMsgQuery returns scheduled messages selected by the query. If 'accept' is not nil, messages to topics
+// it does not accept are skipped and at most 'limit' messages are returned.
+func (a *adapter) schedMsgQuery(accept func(topic string) bool, limit int, query string, args ...any) ([]t.ScheduledMessage, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT id,createdat,updatedat,sendat,topic,userid,head,content,attachments FROM schedmsgs"+
+			query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []t.ScheduledMessage
+	for rows.Next() {
+		var msg t.ScheduledMessage
+		var id, from int64
+		if err = rows.Scan(&id, &msg.CreatedAt, &msg.UpdatedAt, &msg.SendAt, &msg.Topic, &from,
+			&msg.Head, &msg.Content, &msg.Attachments); err != nil {
+			break
+		}
+		if accept != nil && !accept(msg.Topic) {
+			continue
+		}
+		msg.SetUid(store.EncodeUid(id))
+		msg.From = store.EncodeUid(from).String()
+		msgs = append(msgs, msg)
+		if accept != nil && len(msgs) >= limit {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return msgs, err
+}
+
+// SchedMsgGetAll returns pending scheduled messages sent by the given user to the topic, earliest first.
+func (a *adapter) SchedMsgGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error) {
+	return a.schedMsgQuery(nil, 0, " WHERE topic=$1 AND userid=$2 ORDER BY sendat", topic, store.DecodeUid(user))
+}
+
+// SchedMsgGet returns the scheduled message with the given ID.
+func (a *adapter) SchedMsgGet(id t.Uid) (*t.ScheduledMessage, error) {
+	msgs, err := a.schedMsgQuery(nil, 0, " WHERE id=$1", store.DecodeUid(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, t.ErrNotFound
+	}
+	return &msgs[0], nil
+}
+
+// SchedMsgGetDue returns up to 'limit' scheduled messages with SendAt before the given time, earliest first.
+// If 'accept' is not nil, only messages to topics it accepts are returned.
+func (a *adapter) SchedMsgGetDue(before time.Time, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error) {
+	if accept == nil {
+		return a.schedMsgQuery(nil, 0, " WHERE sendat<$1 ORDER BY sendat LIMIT $2", before, limit)
+	}
+	// Skipped messages don't count towards the limit: read until enough messages are accepted.
+	return a.schedMsgQuery(accept, limit, " WHERE sendat<$1 ORDER BY sendat", before)
+}
+
+// SchedMsgDelete deletes a scheduled message. If user is not zero, the message is deleted only if it was
+// sent by the user.
+func (a *adapter) SchedMsgDelete(id, user t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query := "DELETE FROM schedmsgs WHERE id=$1"
+	args := []any{store.DecodeUid(id)}
+	if !user.IsZero() {
+		query += " AND userid=$2"
+		args = append(args, store.DecodeUid(user))
+	}
+	// filemsglinks will be deleted because of ON DELETE CASCADE
+	res, err := a.db.Exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// ReactionUpsert creates or replaces user's reaction to a message.
+func (a *adapter) ReactionUpsert(r *t.Reaction) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return a.inOutboxTx(ctx, func(db pgxQuerier) error {
+		_, err := db.Exec(ctx,
+			"INSERT INTO reactions(createdat,topic,seqid,userid,value) VALUES($1,$2,$3,$4,$5) "+
+				"ON CONFLICT(topic,seqid,userid) DO UPDATE SET createdat=$1,value=$5",
+			r.CreatedAt, r.Topic, r.SeqId, decodeUidString(r.User), r.Value)
+		return err
+	})
+}
+
+// ReactionDelete removes user's reaction to a message.
+func (a *adapter) ReactionDelete(topic string, seqId int, user t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return a.inOutboxTx(ctx, func(db pgxQuerier) error {
+		_, err := db.Exec(ctx, "DELETE FROM reactions WHERE topic=$1 AND seqid=$2 AND userid=$3",
+			topic, seqId, store.DecodeUid(user))
+		return err
+	})
+}
+
+// ReactionGetAll returns reactions to messages with seq IDs in range [opts.Since, opts.Before).
+func (a *adapter) ReactionGetAll(topic string, opts *t.QueryOpt) ([]t.Reaction, error) {
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			upper = opts.Before - 1
+		}
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT createdat,topic,seqid,userid,value FROM reactions"+
+			" WHERE topic=$1 AND seqid BETWEEN $2 AND $3 ORDER BY seqid,id",
+		topic, lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reacts []t.Reaction
+	for rows.Next() {
+		var r t.Reaction
+		var userId int64
+		if err = rows.Scan(&r.CreatedAt, &r.Topic, &r.SeqId, &userId, &r.Value); err != nil {
+			break
+		}
+		r.User = store.EncodeUid(userId).String()
+		reacts = append(reacts, r)
+	}
+	if err == nil {
+		err = rows.Err()
 	}
 
-	return tx.Commit(ctx)
+	return reacts, err
 }
 
 func deviceHasher(deviceID string) string {
@@ -3091,12 +4080,14 @@ func (a *adapter) FileStartUpload(fd *t.FileDef) error {
 	if fd.User != "" {
 		user = store.DecodeUid(t.ParseUid(fd.User))
 	}
-	_, err := a.db.Exec(ctx,
-		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location) "+
-			"VALUES($1,$2,$3,$4,$5,$6,$7,$8)",
-		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
-		fd.Status, fd.MimeType, fd.Size, fd.Location)
-	return err
+	return a.inOutboxTx(ctx, func(db pgxQuerier) error {
+		_, err := db.Exec(ctx,
+			"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location) "+
+				"VALUES($1,$2,$3,$4,$5,$6,$7,$8)",
+			store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
+			fd.Status, fd.MimeType, fd.Size, fd.Location)
+		return err
+	})
 }
 
 // FileFinishUpload marks file upload as completed, successfully or otherwise
@@ -3137,6 +4128,9 @@ func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.
 	}
 	fd.UpdatedAt = now
 
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return nil, err
+	}
 	return fd, tx.Commit(ctx)
 }
 
@@ -3313,6 +4307,22 @@ func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []
 	return tx.Commit(ctx)
 }
 
+// FileRelinkMessages moves links of messages of the topic from one file to another.
+func (a *adapter) FileRelinkMessages(topic, oldFid, newFid string) error {
+	oldId, newId := t.ParseUid(oldFid), t.ParseUid(newFid)
+	if oldId.IsZero() || newId.IsZero() {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "UPDATE filemsglinks AS l SET fileid=$1 FROM messages AS m "+
+		"WHERE m.id=l.msgid AND l.fileid=$2 AND m.topic=$3", store.DecodeUid(newId), store.DecodeUid(oldId), topic)
+	return err
+}
+
 // PCacheGet reads a persistet cache entry.
 func (a *adapter) PCacheGet(key string) (string, error) {
 	ctx, cancel := a.getContext()
@@ -3382,6 +4392,382 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 	return err
 }
 
+// WithOutbox returns a copy of the adapter which adds the events of the outbox to the outbox table in
+// the transaction of the next change.
+func (a *adapter) WithOutbox(outbox *adp.Outbox) adp.Adapter {
+	tx := *a
+	tx.outbox = outbox
+	return &tx
+}
+
+// OutboxAdd adds change events to the outbox table.
+func (a *adapter) OutboxAdd(entries []adp.OutboxEntry) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return outboxInsert(ctx, a.db, entries)
+}
+
+// OutboxGet returns the oldest change events from the outbox table.
+func (a *adapter) OutboxGet(limit int) ([]adp.OutboxEntry, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT id,event FROM outbox ORDER BY id LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []adp.OutboxEntry
+	for rows.Next() {
+		var entry adp.OutboxEntry
+		if err = rows.Scan(&entry.Offset, &entry.Event); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// OutboxDelete deletes delivered change events from the outbox table.
+func (a *adapter) OutboxDelete(offsets []string) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "DELETE FROM outbox WHERE id=ANY($1)", offsets)
+	return err
+}
+
+// outboxWrite adds pending change events to the outbox table in the transaction of the change.
+func (a *adapter) outboxWrite(ctx context.Context, tx pgx.Tx) error {
+	if a.outbox == nil || a.outbox.Written {
+		return nil
+	}
+	if err := outboxInsert(ctx, tx, a.outbox.Entries()); err != nil {
+		return err
+	}
+	a.outbox.Written = true
+	return nil
+}
+
+// pgxQuerier is the connection pool or a transaction.
+type pgxQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// inOutboxTx makes a change with a single statement. If change events are pending, the statement is
+// executed in a transaction which also adds the events to the outbox table.
+func (a *adapter) inOutboxTx(ctx context.Context, change func(db pgxQuerier) error) error {
+	if a.outbox == nil || a.outbox.Written {
+		return change(a.db)
+	}
+
+	tx, err := a.db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	if err = change(tx); err == nil {
+		err = a.outboxWrite(ctx, tx)
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func outboxInsert(ctx context.Context, db pgxQuerier, entries []adp.OutboxEntry) error {
+	for _, entry := range entries {
+		if _, err := db.Exec(ctx, "INSERT INTO outbox(id,event) VALUES($1,$2)", entry.Offset, entry.Event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Data export.
+
+// attachments loads IDs of files linked to the objects with the given IDs. The 'linkBy' is the
+// column which holds the object ID: msgid, topic or userid. The result is keyed by object ID
+// converted to string.
+func (a *adapter) attachments(ctx context.Context, linkBy string, ids any) (map[string]t.StringSlice, error) {
+	rows, err := a.db.Query(ctx, "SELECT "+linkBy+"::TEXT,fileid FROM filemsglinks WHERE "+linkBy+"=ANY($1) ORDER BY id", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]t.StringSlice)
+	for rows.Next() {
+		var linkId string
+		var fid int64
+		if err = rows.Scan(&linkId, &fid); err != nil {
+			return nil, err
+		}
+		result[linkId] = append(result[linkId], store.EncodeUid(fid).String())
+	}
+	return result, rows.Err()
+}
+
+// UserExport returns a page of users ordered by ID, including soft-deleted.
+func (a *adapter) UserExport(after t.Uid, limit int) ([]t.User, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT * FROM users WHERE id>$1 ORDER BY id LIMIT $2",
+		store.DecodeUid(after), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []t.User
+	var ids []int64
+	for rows.Next() {
+		var user t.User
+		var id int64
+		if err = rows.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access,
+			&user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags); err != nil {
+			break
+		}
+		ids = append(ids, id)
+		user.SetUid(store.EncodeUid(id))
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "userid", ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Attachments = attachments[strconv.FormatInt(ids[i], 10)]
+	}
+	return users, nil
+}
+
+// AuthExport returns all authentication records of the user.
+func (a *adapter) AuthExport(uid t.Uid) ([]adp.AuthRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT scheme,uname,authlvl,secret,expires FROM auth WHERE userid=$1 ORDER BY id",
+		store.DecodeUid(uid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []adp.AuthRecord
+	for rows.Next() {
+		var rec adp.AuthRecord
+		var expires *time.Time
+		if err = rows.Scan(&rec.Scheme, &rec.Unique, &rec.AuthLvl, &rec.Secret, &expires); err != nil {
+			return nil, err
+		}
+		if expires != nil {
+			rec.Expires = *expires
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// TopicExport returns a page of topics ordered by name, including soft-deleted.
+func (a *adapter) TopicExport(after string, limit int) ([]t.Topic, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags,pinned,msgttl "+
+			"FROM topics WHERE name>$1 ORDER BY name LIMIT $2", after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []t.Topic
+	var names []string
+	for rows.Next() {
+		var tt t.Topic
+		var owner int64
+		if err = rows.Scan(&tt.CreatedAt, &tt.UpdatedAt, &tt.State, &tt.StateAt, &tt.TouchedAt, &tt.Id,
+			&tt.UseBt, &tt.Access, &owner, &tt.SeqId, &tt.DelId, &tt.Public, &tt.Trusted, &tt.Tags,
+			&tt.Pinned, &tt.MsgTTL); err != nil {
+			break
+		}
+		tt.Owner = store.EncodeUid(owner).String()
+		topics = append(topics, tt)
+		names = append(names, tt.Id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "topic", names)
+	if err != nil {
+		return nil, err
+	}
+	for i := range topics {
+		topics[i].Attachments = attachments[topics[i].Id]
+	}
+	return topics, nil
+}
+
+// MessageExport returns a page of messages of the topic ordered by seq ID.
+func (a *adapter) MessageExport(topic string, from t.Uid, after, limit int) ([]t.Message, error) {
+	if limit <= 0 {
+		limit = a.maxMessageResults
+	}
+
+	where := "topic=$1 AND seqid>$2 AND delid<=0"
+	args := []any{topic, after}
+	if !from.IsZero() {
+		where += ` AND "from"=$3`
+		args = append(args, store.DecodeUid(from))
+	}
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		`SELECT id,createdat,updatedat,deletedat,delid,seqid,topic,"from",thread,head,content,plaintext`+
+			" FROM messages WHERE "+where+" ORDER BY seqid LIMIT $"+strconv.Itoa(len(args)),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	var ids []int64
+	for rows.Next() {
+		var msg t.Message
+		var id, from int64
+		var plaintext *string
+		if err = rows.Scan(&id, &msg.CreatedAt, &msg.UpdatedAt, &msg.DeletedAt, &msg.DelId, &msg.SeqId,
+			&msg.Topic, &from, &msg.Thread, &msg.Head, &msg.Content, &plaintext); err != nil {
+			break
+		}
+		ids = append(ids, id)
+		msg.SetUid(t.Uid(id))
+		msg.From = store.EncodeUid(from).String()
+		if plaintext != nil {
+			msg.PlainText = *plaintext
+		}
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "msgid", ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		msgs[i].Attachments = attachments[strconv.FormatInt(ids[i], 10)]
+	}
+	return msgs, nil
+}
+
+// FileExport returns a page of file records ordered by ID.
+func (a *adapter) FileExport(after string, limit int) ([]t.FileDef, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
+		"FROM fileuploads WHERE id>$1 ORDER BY id LIMIT $2", store.DecodeUid(t.ParseUid(after)), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []t.FileDef
+	for rows.Next() {
+		var fd t.FileDef
+		var id, userId int64
+		if err = rows.Scan(&id, &fd.CreatedAt, &fd.UpdatedAt, &userId, &fd.Status, &fd.MimeType,
+			&fd.Size, &fd.Location); err != nil {
+			return nil, err
+		}
+		fd.SetUid(store.EncodeUid(id))
+		fd.User = store.EncodeUid(userId).String()
+		files = append(files, fd)
+	}
+	return files, rows.Err()
+}
+
+// PCacheExport returns a page of persistent cache entries ordered by key.
+func (a *adapter) PCacheExport(after string, limit int) ([]adp.PCacheEntry, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, `SELECT "key","value" FROM kvmeta WHERE "key">$1 AND "key"!='version' ORDER BY "key" LIMIT $2`,
+		after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []adp.PCacheEntry
+	for rows.Next() {
+		var entry adp.PCacheEntry
+		if err = rows.Scan(&entry.Key, &entry.Value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
 // Helper functions
 
 // Check if MySQL error is a Error Code: 1062. Duplicate entry ... for key ...
@@ -0,0 +1,24 @@
+//go:build postgres
+// +build postgres
+
+package postgres
+
+import (
+	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/db/adaptertest"
+)
+
+// The test requires a running database server, it's skipped if the server is not available.
+// The database is dropped and re-created. Configuration can be overridden with the
+// TINODE_TEST_POSTGRES environment variable. Run with:
+//
+//	go test -tags postgres ./db/postgres/
+func TestConformance(t *testing.T) {
+	adp, err := adaptertest.OpenStore(adapterName, adaptertest.Config(adapterName,
+		`{"user": "postgres", "passwd": "postgres", "host": "localhost", "port": "5432", "dbname": "tinode_test"}`))
+	if err != nil {
+		t.Skip("database is not available:", err)
+	}
+	adaptertest.Run(t, adp)
+}
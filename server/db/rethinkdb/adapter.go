@@ -8,11 +8,13 @@ import (
 	"encoding/json"
 	"errors"
 	"hash/fnv"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	adp "github.com/volvlabs/towncryer-chat-server/server/db"
 	"github.com/volvlabs/towncryer-chat-server/server/db/common"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
 	t "github.com/volvlabs/towncryer-chat-server/server/store/types"
@@ -34,7 +36,7 @@ const (
 	defaultHost     = "localhost:28015"
 	defaultDatabase = "tinode"
 
-	adpVersion = 113
+	adpVersion = 120
 
 	adapterName = "rethinkdb"
 
@@ -352,6 +354,14 @@ func (a *adapter) CreateDb(reset bool) error {
 		}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	// Compound index of topic - thread - seqID for selecting replies in a thread. Messages which are not
+	// replies do not have the Thread field and are not indexed.
+	if _, err := rdb.DB(a.dbName).Table("messages").IndexCreateFunc("Topic_Thread_SeqId",
+		func(row rdb.Term) any {
+			return []any{row.Field("Topic"), row.Field("Thread"), row.Field("SeqId")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
 	// Compound index of hard-deleted messages
 	if _, err := rdb.DB(a.dbName).Table("messages").IndexCreateFunc("Topic_DelId",
 		func(row rdb.Term) any {
@@ -370,6 +380,70 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Earlier revisions of edited messages.
+	if _, err := rdb.DB(a.dbName).TableCreate("msgrevisions").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Compound index of topic - seqID for selecting revisions of a message.
+	if _, err := rdb.DB(a.dbName).Table("msgrevisions").IndexCreateFunc("Topic_SeqId",
+		func(row rdb.Term) any {
+			return []any{row.Field("Topic"), row.Field("SeqId")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Reactions to messages, one per user per message. Primary key is Topic:SeqId:User.
+	if _, err := rdb.DB(a.dbName).TableCreate("reactions", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Compound index of topic - seqID for selecting reactions to a range of messages.
+	if _, err := rdb.DB(a.dbName).Table("reactions").IndexCreateFunc("Topic_SeqId",
+		func(row rdb.Term) any {
+			return []any{row.Field("Topic"), row.Field("SeqId")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index for deleting reactions of a deleted user.
+	if _, err := rdb.DB(a.dbName).Table("reactions").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Positions of users in threads. Primary key is Topic:User:Thread.
+	if _, err := rdb.DB(a.dbName).TableCreate("threadreads", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Compound index of topic - user for selecting user's positions in threads of a topic.
+	if _, err := rdb.DB(a.dbName).Table("threadreads").IndexCreateFunc("Topic_User",
+		func(row rdb.Term) any {
+			return []any{row.Field("Topic"), row.Field("User")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index for deleting positions of a deleted user.
+	if _, err := rdb.DB(a.dbName).Table("threadreads").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Messages scheduled for delivery at a later time.
+	if _, err := rdb.DB(a.dbName).TableCreate("schedmsgs", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index for finding messages which are due for delivery.
+	if _, err := rdb.DB(a.dbName).Table("schedmsgs").IndexCreate("SendAt").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Compound index of topic - sender for selecting user's scheduled messages in a topic.
+	if _, err := rdb.DB(a.dbName).Table("schedmsgs").IndexCreateFunc("Topic_From",
+		func(row rdb.Term) any {
+			return []any{row.Field("Topic"), row.Field("From")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index for deleting scheduled messages of a deleted user.
+	if _, err := rdb.DB(a.dbName).Table("schedmsgs").IndexCreate("From").RunWrite(a.conn); err != nil {
+		return err
+	}
+
 	// Log of deleted messages
 	if _, err := rdb.DB(a.dbName).TableCreate("dellog", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
 		return err
@@ -557,6 +631,118 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 113 {
+		// Table for storing earlier revisions of edited messages.
+		if _, err := rdb.DB(a.dbName).TableCreate("msgrevisions").RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err := rdb.DB(a.dbName).Table("msgrevisions").IndexCreateFunc("Topic_SeqId",
+			func(row rdb.Term) any {
+				return []any{row.Field("Topic"), row.Field("SeqId")}
+			}).RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Table for storing reactions to messages.
+		if _, err := rdb.DB(a.dbName).TableCreate("reactions", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err := rdb.DB(a.dbName).Table("reactions").IndexCreateFunc("Topic_SeqId",
+			func(row rdb.Term) any {
+				return []any{row.Field("Topic"), row.Field("SeqId")}
+			}).RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err := rdb.DB(a.dbName).Table("reactions").IndexCreate("User").RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Index for selecting replies in a thread.
+		if _, err := rdb.DB(a.dbName).Table("messages").IndexCreateFunc("Topic_Thread_SeqId",
+			func(row rdb.Term) any {
+				return []any{row.Field("Topic"), row.Field("Thread"), row.Field("SeqId")}
+			}).RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		// Table for storing positions of users in threads.
+		if _, err := rdb.DB(a.dbName).TableCreate("threadreads", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err := rdb.DB(a.dbName).Table("threadreads").IndexCreateFunc("Topic_User",
+			func(row rdb.Term) any {
+				return []any{row.Field("Topic"), row.Field("User")}
+			}).RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err := rdb.DB(a.dbName).Table("threadreads").IndexCreate("User").RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Topics.Pinned is added on first use. Just bump the version to keep in line with MySQL.
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Table for storing messages scheduled for delivery at a later time.
+		if _, err := rdb.DB(a.dbName).TableCreate("schedmsgs", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+			return err
+		}
+		// Index for finding messages which are due for delivery.
+		if _, err := rdb.DB(a.dbName).Table("schedmsgs").IndexCreate("SendAt").RunWrite(a.conn); err != nil {
+			return err
+		}
+		// Compound index of topic - sender for selecting user's scheduled messages in a topic.
+		if _, err := rdb.DB(a.dbName).Table("schedmsgs").IndexCreateFunc("Topic_From",
+			func(row rdb.Term) any {
+				return []any{row.Field("Topic"), row.Field("From")}
+			}).RunWrite(a.conn); err != nil {
+			return err
+		}
+		// Index for deleting scheduled messages of a deleted user.
+		if _, err := rdb.DB(a.dbName).Table("schedmsgs").IndexCreate("From").RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Topics.MsgTTL is added on first use. Just bump the version to keep in line with MySQL.
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Messages.PlainText is added on first use. Just bump the version to keep in line with MySQL.
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -833,6 +1019,41 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 						[]any{topic.Field("Id"), rdb.MinVal},
 						[]any{topic.Field("Id"), rdb.MaxVal},
 						rdb.BetweenOpts{Index: "Topic_SeqId"}).Delete(),
+					// Delete earlier revisions of edited messages
+					rdb.DB(a.dbName).Table("msgrevisions").Between(
+						[]any{topic.Field("Id"), rdb.MinVal},
+						[]any{topic.Field("Id"), rdb.MaxVal},
+						rdb.BetweenOpts{Index: "Topic_SeqId"}).Delete(),
+					// Delete reactions to messages
+					rdb.DB(a.dbName).Table("reactions").Between(
+						[]any{topic.Field("Id"), rdb.MinVal},
+						[]any{topic.Field("Id"), rdb.MaxVal},
+						rdb.BetweenOpts{Index: "Topic_SeqId"}).Delete(),
+					// Delete positions in threads
+					rdb.DB(a.dbName).Table("threadreads").Between(
+						[]any{topic.Field("Id"), rdb.MinVal},
+						[]any{topic.Field("Id"), rdb.MaxVal},
+						rdb.BetweenOpts{Index: "Topic_User"}).Delete(),
+					// Decrement scheduled message attachments UseCounter
+					rdb.DB(a.dbName).Table("fileuploads").GetAll(
+						rdb.Args(
+							rdb.DB(a.dbName).Table("schedmsgs").Between(
+								[]any{topic.Field("Id"), rdb.MinVal},
+								[]any{topic.Field("Id"), rdb.MaxVal},
+								rdb.BetweenOpts{Index: "Topic_From"}).
+								Filter(func(msg rdb.Term) rdb.Term {
+									return msg.HasFields("Attachments")
+								}).
+								ConcatMap(func(row rdb.Term) any { return row.Field("Attachments") }).
+								CoerceTo("array"))).
+						Update(func(fu rdb.Term) any {
+							return map[string]any{"UseCount": fu.Field("UseCount").Default(1).Sub(1)}
+						}),
+					// Delete scheduled messages
+					rdb.DB(a.dbName).Table("schedmsgs").Between(
+						[]any{topic.Field("Id"), rdb.MinVal},
+						[]any{topic.Field("Id"), rdb.MaxVal},
+						rdb.BetweenOpts{Index: "Topic_From"}).Delete(),
 					// Delete subscriptions
 					rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("Topic", topic.Field("Id")).Delete(),
 				})
@@ -840,6 +1061,25 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 			return err
 		}
 
+		// Delete user's reactions and positions in threads in other topics.
+		if _, err = rdb.DB(a.dbName).Table("reactions").GetAllByIndex("User", uid.String()).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err = rdb.DB(a.dbName).Table("threadreads").GetAllByIndex("User", uid.String()).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+
+		// Delete messages the user scheduled for later delivery.
+		sched := rdb.DB(a.dbName).Table("schedmsgs").GetAllByIndex("From", uid.String())
+		if err = a.decFileUseCounter(sched); err != nil {
+			return err
+		}
+		if _, err = sched.Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+
 		// And finally delete the topics.
 		if _, err = rdb.DB(a.dbName).Table("topics").GetAllByIndex("Owner", uid.String()).
 			Delete().RunWrite(a.conn); err != nil {
@@ -2027,6 +2267,61 @@ func (a *adapter) FindTopics(req [][]string, opt []string, activeOnly bool) ([]t
 
 }
 
+// MessageSearch finds messages in the given topics which contain all of the given words.
+// RethinkDB has no full-text index, the messages are scanned.
+func (a *adapter) MessageSearch(topics []string, forUser t.Uid, words []string, opts *t.QueryOpt) ([]t.Message, error) {
+	if len(topics) == 0 || len(words) == 0 {
+		return nil, nil
+	}
+
+	limit := a.maxMessageResults
+	if opts != nil && opts.Limit > 0 && opts.Limit < limit {
+		limit = opts.Limit
+	}
+
+	var perTopic []any
+	for _, topic := range topics {
+		perTopic = append(perTopic, rdb.DB(a.dbName).Table("messages").
+			Between([]any{topic, rdb.MinVal}, []any{topic, rdb.MaxVal}, rdb.BetweenOpts{Index: "Topic_SeqId"}))
+	}
+
+	requester := forUser.String()
+	cursor, err := rdb.Union(perTopic...).
+		// Skip hard-deleted messages
+		Filter(rdb.Row.HasFields("DelId").Not()).
+		// Skip messages soft-deleted for the current user
+		Filter(func(row rdb.Term) any {
+			return rdb.Not(row.Field("DeletedFor").Default([]any{}).Contains(
+				func(df rdb.Term) any {
+					return df.Field("User").Eq(requester)
+				}))
+		}).
+		// Message must contain every word.
+		Filter(func(row rdb.Term) any {
+			text := row.Field("PlainText").Default("")
+			var match []any
+			for _, word := range words {
+				match = append(match, text.Match("(?i)"+regexp.QuoteMeta(word)).Ne(nil))
+			}
+			return rdb.And(match...)
+		}).
+		OrderBy(rdb.Desc("CreatedAt")).
+		Limit(limit).
+		Pluck("Topic", "SeqId", "From", "CreatedAt", "PlainText").
+		Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var msgs []t.Message
+	if err = cursor.All(&msgs); err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
 // Messages
 
 // MessageSave saves message to DB.
@@ -2035,6 +2330,85 @@ func (a *adapter) MessageSave(msg *t.Message) error {
 	return err
 }
 
+// MessageEdit replaces head and content of an existing message. The previous version is saved as a revision.
+func (a *adapter) MessageEdit(msg *t.Message) error {
+	cursor, err := rdb.DB(a.dbName).Table("messages").
+		GetAllByIndex("Topic_SeqId", []any{msg.Topic, msg.SeqId}).
+		// Hard-deleted messages cannot be edited.
+		Filter(rdb.Row.HasFields("DelId").Not()).
+		Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return t.ErrNotFound
+	}
+
+	var current map[string]any
+	if err = cursor.One(&current); err != nil {
+		if err == rdb.ErrEmptyResult {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+
+	// Revision timestamp is the time when the previous version was written.
+	// Attachments are copied to the revision so their use counters can be decremented when the message is deleted.
+	revision := map[string]any{
+		"CreatedAt": current["UpdatedAt"],
+		"MsgId":     current["Id"],
+		"Topic":     msg.Topic,
+		"SeqId":     msg.SeqId,
+		"From":      current["From"],
+		"Head":      current["Head"],
+		"Content":   current["Content"],
+	}
+	if attachments, ok := current["Attachments"]; ok {
+		revision["Attachments"] = attachments
+	}
+	if _, err = rdb.DB(a.dbName).Table("msgrevisions").Insert(revision).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	if _, err = rdb.DB(a.dbName).Table("messages").Get(current["Id"]).
+		Replace(rdb.Row.Without("Attachments").Merge(map[string]any{
+			"UpdatedAt": msg.UpdatedAt,
+			"Head":      msg.Head,
+			"Content":   msg.Content,
+			"PlainText": msg.PlainText,
+		})).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	msg.Id, _ = current["Id"].(string)
+	return nil
+}
+
+// MessageGetRevisions returns earlier revisions of the given message, oldest first.
+func (a *adapter) MessageGetRevisions(topic string, seqId int) ([]t.Message, error) {
+	cursor, err := rdb.DB(a.dbName).Table("msgrevisions").
+		GetAllByIndex("Topic_SeqId", []any{topic, seqId}).
+		OrderBy("CreatedAt").
+		Without("id", "MsgId", "Attachments").
+		Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var revs []t.Message
+	if err = cursor.All(&revs); err != nil {
+		return nil, err
+	}
+	for i := range revs {
+		revs[i].UpdatedAt = revs[i].CreatedAt
+	}
+
+	return revs, nil
+}
+
 // MessageGetAll retrieves all messages available to the given user.
 func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
 
@@ -2057,14 +2431,22 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 		}
 	}
 
-	lower = []any{topic, lower}
-	upper = []any{topic, upper}
+	index := "Topic_SeqId"
+	if opts != nil && opts.Thread > 0 {
+		// Replies in one thread.
+		index = "Topic_Thread_SeqId"
+		lower = []any{topic, opts.Thread, lower}
+		upper = []any{topic, opts.Thread, upper}
+	} else {
+		lower = []any{topic, lower}
+		upper = []any{topic, upper}
+	}
 
 	requester := forUser.String()
 	cursor, err := rdb.DB(a.dbName).Table("messages").
-		Between(lower, upper, rdb.BetweenOpts{Index: "Topic_SeqId"}).
+		Between(lower, upper, rdb.BetweenOpts{Index: index}).
 		// Ordering by index must come before filtering
-		OrderBy(rdb.OrderByOpts{Index: rdb.Desc("Topic_SeqId")}).
+		OrderBy(rdb.OrderByOpts{Index: rdb.Desc(index)}).
 		// Skip hard-deleted messages
 		Filter(rdb.Row.HasFields("DelId").Not()).
 		// Skip messages soft-deleted for the current user
@@ -2135,31 +2517,222 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, nil
 }
 
-// messagesHardDelete deletes all messages in the topic.
-func (a *adapter) messagesHardDelete(topic string) error {
-	var err error
-
-	// TODO: handle file uploads
-
-	if _, err = rdb.DB(a.dbName).Table("dellog").Between(
-		[]any{topic, rdb.MinVal},
-		[]any{topic, rdb.MaxVal},
-		rdb.BetweenOpts{Index: "Topic_DelId"}).Delete().RunWrite(a.conn); err != nil {
-		return err
+// MessageGetExpired finds topics with messages which have outlived the topic's message TTL.
+// If 'accept' is not nil, only topics it accepts are checked.
+func (a *adapter) MessageGetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]t.Range, error) {
+	cursor, err := rdb.DB(a.dbName).Table("topics").
+		Filter(rdb.Row.Field("MsgTTL").Default(0).Gt(0).And(rdb.Row.Field("State").Ne(t.StateDeleted))).
+		Pluck("Id", "MsgTTL").Run(a.conn)
+	if err != nil {
+		return nil, err
 	}
+	defer cursor.Close()
 
-	q := rdb.DB(a.dbName).Table("messages").Between(
-		[]any{topic, rdb.MinVal},
-		[]any{topic, rdb.MaxVal},
-		rdb.BetweenOpts{Index: "Topic_SeqId"})
+	// Returns seq ID of the first or the last expired message in the topic, or 0 if there are none.
+	findSeqId := func(topic string, olderThan time.Time, order func(args ...any) rdb.Term) (int, error) {
+		cur, err := rdb.DB(a.dbName).Table("messages").
+			Between([]any{topic, rdb.MinVal}, []any{topic, rdb.MaxVal},
+				rdb.BetweenOpts{Index: "Topic_SeqId"}).
+			OrderBy(rdb.OrderByOpts{Index: order("Topic_SeqId")}).
+			// Skip already hard-deleted messages.
+			Filter(rdb.Row.HasFields("DelId").Not().And(rdb.Row.Field("CreatedAt").Lt(olderThan))).
+			Limit(1).Field("SeqId").Run(a.conn)
+		if err != nil {
+			return 0, err
+		}
+		defer cur.Close()
 
-	if err = a.decFileUseCounter(q); err != nil {
-		return err
+		var seqId int
+		if !cur.IsNil() {
+			err = cur.One(&seqId)
+		}
+		return seqId, err
 	}
 
-	_, err = q.Delete().RunWrite(a.conn)
+	expired := make(map[string]t.Range)
+	var topic struct {
+		Id     string
+		MsgTTL int
+	}
+	for len(expired) < limit && cursor.Next(&topic) {
+		if accept != nil && !accept(topic.Id) {
+			continue
+		}
+		olderThan := now.Add(-time.Duration(topic.MsgTTL) * time.Second)
+		low, err := findSeqId(topic.Id, olderThan, rdb.Asc)
+		if err != nil {
+			return nil, err
+		}
+		if low == 0 {
+			// No expired messages in this topic.
+			continue
+		}
+		hi, err := findSeqId(topic.Id, olderThan, rdb.Desc)
+		if err != nil {
+			return nil, err
+		}
+		if hi > low {
+			// Range is inclusive-exclusive.
+			hi++
+		} else {
+			hi = 0
+		}
+		expired[topic.Id] = t.Range{Low: low, Hi: hi}
+	}
 
-	return err
+	return expired, cursor.Err()
+}
+
+// MessageArchive replaces live messages in the range with stubs linked to the segment file.
+func (a *adapter) MessageArchive(topic string, rng t.Range, segment string, unchangedSince time.Time) error {
+	if (segment != "" && t.ParseUid(segment).IsZero()) || rng.Hi <= rng.Low {
+		return t.ErrMalformed
+	}
+
+	if segment != "" {
+		cursor, err := rdb.DB(a.dbName).Table("fileuploads").Get(segment).Run(a.conn)
+		if err != nil {
+			return err
+		}
+		found := !cursor.IsNil()
+		cursor.Close()
+		if !found {
+			return t.ErrNotFound
+		}
+	}
+
+	// Selects records in the range from a table indexed by Topic_SeqId.
+	selectRange := func(table string) rdb.Term {
+		return rdb.DB(a.dbName).Table(table).Between(
+			[]any{topic, rng.Low},
+			[]any{topic, rng.Hi},
+			rdb.BetweenOpts{Index: "Topic_SeqId"})
+	}
+
+	// Skip hard-deleted and already archived messages.
+	messages := selectRange("messages").Filter(rdb.Row.HasFields("DelId").Not())
+	if !unchangedSince.IsZero() {
+		// There are no transactions: the check is not atomic. A message edited after the check is
+		// left as is to keep the edit.
+		cursor, err := selectRange("messages").Filter(func(row rdb.Term) any {
+			return row.Field("UpdatedAt").Ge(unchangedSince).Or(
+				row.Field("DeletedAt").Default(nil).Ne(nil).And(row.Field("DeletedAt").Ge(unchangedSince)))
+		}).Count().Run(a.conn)
+		if err != nil {
+			return err
+		}
+		var count int
+		err = cursor.One(&count)
+		cursor.Close()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return t.ErrConflict
+		}
+		messages = messages.Filter(rdb.Row.Field("UpdatedAt").Lt(unchangedSince))
+	}
+
+	// Earlier revisions are kept in the segment.
+	revisions := selectRange("msgrevisions")
+	err := a.decFileUseCounter(revisions)
+	if err != nil {
+		return err
+	}
+	if _, err = revisions.Delete().RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	res, err := messages.
+		Replace(func(row rdb.Term) any {
+			stub := map[string]any{"DelId": t.MsgDelIdArchived}
+			if segment != "" {
+				stub["Attachments"] = row.Field("Attachments").Default([]any{}).Append(segment)
+			}
+			return row.Without("Head", "Content", "PlainText").Merge(stub)
+		}).
+		RunWrite(a.conn)
+	if err != nil || res.Replaced == 0 || segment == "" {
+		return err
+	}
+
+	_, err = rdb.DB(a.dbName).Table("fileuploads").Get(segment).
+		Update(map[string]any{
+			"UpdatedAt": t.TimeNow(),
+			"UseCount":  rdb.Row.Field("UseCount").Default(0).Add(1),
+		}).RunWrite(a.conn)
+	return err
+}
+
+// messagesHardDelete deletes all messages in the topic.
+func (a *adapter) messagesHardDelete(topic string) error {
+	var err error
+
+	// TODO: handle file uploads
+
+	if _, err = rdb.DB(a.dbName).Table("dellog").Between(
+		[]any{topic, rdb.MinVal},
+		[]any{topic, rdb.MaxVal},
+		rdb.BetweenOpts{Index: "Topic_DelId"}).Delete().RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	q := rdb.DB(a.dbName).Table("messages").Between(
+		[]any{topic, rdb.MinVal},
+		[]any{topic, rdb.MaxVal},
+		rdb.BetweenOpts{Index: "Topic_SeqId"})
+
+	if err = a.decFileUseCounter(q); err != nil {
+		return err
+	}
+
+	if _, err = q.Delete().RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Delete earlier revisions of edited messages.
+	q = rdb.DB(a.dbName).Table("msgrevisions").Between(
+		[]any{topic, rdb.MinVal},
+		[]any{topic, rdb.MaxVal},
+		rdb.BetweenOpts{Index: "Topic_SeqId"})
+
+	if err = a.decFileUseCounter(q); err != nil {
+		return err
+	}
+
+	if _, err = q.Delete().RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Delete reactions to messages.
+	if _, err = rdb.DB(a.dbName).Table("reactions").Between(
+		[]any{topic, rdb.MinVal},
+		[]any{topic, rdb.MaxVal},
+		rdb.BetweenOpts{Index: "Topic_SeqId"}).Delete().RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Delete positions in threads.
+	if _, err = rdb.DB(a.dbName).Table("threadreads").Between(
+		[]any{topic, rdb.MinVal},
+		[]any{topic, rdb.MaxVal},
+		rdb.BetweenOpts{Index: "Topic_User"}).Delete().RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	// Delete scheduled messages.
+	q = rdb.DB(a.dbName).Table("schedmsgs").Between(
+		[]any{topic, rdb.MinVal},
+		[]any{topic, rdb.MaxVal},
+		rdb.BetweenOpts{Index: "Topic_From"})
+
+	if err = a.decFileUseCounter(q); err != nil {
+		return err
+	}
+
+	_, err = q.Delete().RunWrite(a.conn)
+
+	return err
 }
 
 // MessageDeleteList deletes messages in the given topic with seqIds from the list.
@@ -2179,33 +2752,53 @@ func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) error {
 			return err
 		}
 
-		query := rdb.DB(a.dbName).Table("messages")
-		if len(toDel.SeqIdRanges) > 1 || toDel.SeqIdRanges[0].Hi <= toDel.SeqIdRanges[0].Low {
-			for _, rng := range toDel.SeqIdRanges {
-				if rng.Hi == 0 {
-					indexVals = append(indexVals, []any{topic, rng.Low})
-				} else {
-					for i := rng.Low; i <= rng.Hi; i++ {
-						indexVals = append(indexVals, []any{topic, i})
+		// Selects records with the given seq IDs from a table indexed by Topic_SeqId.
+		selectSeqIds := func(table string) rdb.Term {
+			query := rdb.DB(a.dbName).Table(table)
+			if len(toDel.SeqIdRanges) > 1 || toDel.SeqIdRanges[0].Hi <= toDel.SeqIdRanges[0].Low {
+				if indexVals == nil {
+					for _, rng := range toDel.SeqIdRanges {
+						if rng.Hi == 0 {
+							indexVals = append(indexVals, []any{topic, rng.Low})
+						} else {
+							for i := rng.Low; i <= rng.Hi; i++ {
+								indexVals = append(indexVals, []any{topic, i})
+							}
+						}
 					}
 				}
+				return query.GetAllByIndex("Topic_SeqId", indexVals...)
 			}
-			query = query.GetAllByIndex("Topic_SeqId", indexVals...)
-		} else {
 			// Optimizing for a special case of single range low..hi
-			query = query.Between(
+			return query.Between(
 				[]any{topic, toDel.SeqIdRanges[0].Low},
 				[]any{topic, toDel.SeqIdRanges[0].Hi},
 				rdb.BetweenOpts{Index: "Topic_SeqId", RightBound: "closed"})
 		}
+
 		// Skip already hard-deleted messages.
-		query = query.Filter(rdb.Row.HasFields("DelId").Not())
+		query := selectSeqIds("messages").Filter(rdb.Row.HasFields("DelId").Not())
 		if toDel.DeletedFor == "" {
-			// First decrement use counter for attachments.
-			if err = a.decFileUseCounter(query); err == nil {
+			// Stubs of archived messages are hard-deleted too, releasing the archive segments.
+			query = selectSeqIds("messages").Filter(rdb.Row.HasFields("DeletedAt").Not())
+
+			// Earlier revisions are deleted together with the message.
+			revisions := selectSeqIds("msgrevisions")
+			if err = a.decFileUseCounter(revisions); err == nil {
+				_, err = revisions.Delete().RunWrite(a.conn)
+			}
+			// Reactions are deleted too.
+			if err == nil {
+				_, err = selectSeqIds("reactions").Delete().RunWrite(a.conn)
+			}
+			// Then decrement use counter for attachments.
+			if err == nil {
+				err = a.decFileUseCounter(query)
+			}
+			if err == nil {
 				// Hard-delete individual messages. Message is not deleted but all fields with personal content
 				// are removed.
-				_, err = query.Replace(rdb.Row.Without("Head", "From", "Content", "Attachments").Merge(
+				_, err = query.Replace(rdb.Row.Without("Head", "From", "Content", "Attachments", "PlainText").Merge(
 					map[string]any{
 						"DeletedAt": t.TimeNow(), "DelId": toDel.DelId})).
 					RunWrite(a.conn)
@@ -2237,6 +2830,253 @@ func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) error {
 	return err
 }
 
+// ThreadReadUpdate records the latest reply in the thread read by the user. The value is never decreased.
+func (a *adapter) ThreadReadUpdate(topic string, user t.Uid, thread, readSeqId int) error {
+	_, err := rdb.DB(a.dbName).Table("threadreads").Insert(map[string]any{
+		"Id":        topic + ":" + user.String() + ":" + strconv.Itoa(thread),
+		"Topic":     topic,
+		"User":      user.String(),
+		"Thread":    thread,
+		"ReadSeqId": readSeqId,
+	}, rdb.InsertOpts{Conflict: func(id, oldDoc, newDoc rdb.Term) any {
+		return oldDoc.Merge(map[string]any{
+			"ReadSeqId": rdb.Branch(newDoc.Field("ReadSeqId").Gt(oldDoc.Field("ReadSeqId")),
+				newDoc.Field("ReadSeqId"), oldDoc.Field("ReadSeqId")),
+		})
+	}}).RunWrite(a.conn)
+	return err
+}
+
+// ThreadGetAll returns summaries of all threads in the topic as seen by the given user.
+func (a *adapter) ThreadGetAll(topic string, forUser t.Uid) ([]t.ThreadStatus, error) {
+	requester := forUser.String()
+
+	// User's positions in threads.
+	cursor, err := rdb.DB(a.dbName).Table("threadreads").
+		GetAllByIndex("Topic_User", []any{topic, requester}).
+		Pluck("Thread", "ReadSeqId").
+		Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	var reads []struct {
+		Thread    int
+		ReadSeqId int
+	}
+	err = cursor.All(&reads)
+	cursor.Close()
+	if err != nil {
+		return nil, err
+	}
+	readSeq := make(map[int]int, len(reads))
+	for _, r := range reads {
+		readSeq[r.Thread] = r.ReadSeqId
+	}
+
+	// All replies available to the user, ordered by thread.
+	cursor, err = rdb.DB(a.dbName).Table("messages").
+		Between([]any{topic, rdb.MinVal, rdb.MinVal}, []any{topic, rdb.MaxVal, rdb.MaxVal},
+			rdb.BetweenOpts{Index: "Topic_Thread_SeqId"}).
+		OrderBy(rdb.OrderByOpts{Index: "Topic_Thread_SeqId"}).
+		Filter(rdb.Row.HasFields("DelId").Not()).
+		Filter(func(row rdb.Term) any {
+			return rdb.Not(row.Field("DeletedFor").Default([]any{}).Contains(
+				func(df rdb.Term) any {
+					return df.Field("User").Eq(requester)
+				}))
+		}).
+		Pluck("Thread", "SeqId").
+		Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var threads []t.ThreadStatus
+	var reply struct {
+		Thread int
+		SeqId  int
+	}
+	for cursor.Next(&reply) {
+		if len(threads) == 0 || threads[len(threads)-1].Thread != reply.Thread {
+			threads = append(threads, t.ThreadStatus{Thread: reply.Thread, ReadSeqId: readSeq[reply.Thread]})
+		}
+		ts := &threads[len(threads)-1]
+		ts.Count++
+		ts.LastSeqId = reply.SeqId
+		if reply.SeqId > ts.ReadSeqId {
+			ts.Unread++
+		}
+	}
+
+	return threads, cursor.Err()
+}
+
+// SchedMsgSave saves a message for delivery at a later time.
+func (a *adapter) SchedMsgSave(msg *t.ScheduledMessage) error {
+	if _, err := rdb.DB(a.dbName).Table("schedmsgs").Insert(msg).RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	if len(msg.Attachments) > 0 {
+		// Increment use counter of attachments to protect them from garbage collection.
+		ids := make([]any, len(msg.Attachments))
+		for i, id := range msg.Attachments {
+			ids[i] = id
+		}
+		if _, err := rdb.DB(a.dbName).Table("fileuploads").GetAll(ids...).
+			Update(map[string]any{
+				"UpdatedAt": msg.CreatedAt,
+				"UseCount":  rdb.Row.Field("UseCount").Default(0).Add(1),
+			}).RunWrite(a.conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schedMsgQuery returns scheduled messages selected by the query. If 'accept' is not nil, messages to topics
+// it does not accept are skipped and at most 'limit' messages are returned.
+func (a *adapter) schedMsgQuery(q rdb.Term, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error) {
+	cursor, err := q.Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var msgs []t.ScheduledMessage
+	var msg t.ScheduledMessage
+	for cursor.Next(&msg) {
+		if accept == nil || accept(msg.Topic) {
+			msgs = append(msgs, msg)
+			if accept != nil && len(msgs) >= limit {
+				break
+			}
+		}
+		msg = t.ScheduledMessage{}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// SchedMsgGetAll returns pending scheduled messages sent by the given user to the topic, earliest first.
+func (a *adapter) SchedMsgGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error) {
+	return a.schedMsgQuery(rdb.DB(a.dbName).Table("schedmsgs").
+		GetAllByIndex("Topic_From", []any{topic, user.String()}).
+		OrderBy("SendAt"), nil, 0)
+}
+
+// SchedMsgGet returns the scheduled message with the given ID.
+func (a *adapter) SchedMsgGet(id t.Uid) (*t.ScheduledMessage, error) {
+	msgs, err := a.schedMsgQuery(rdb.DB(a.dbName).Table("schedmsgs").GetAll(id.String()), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, t.ErrNotFound
+	}
+	return &msgs[0], nil
+}
+
+// SchedMsgGetDue returns up to 'limit' scheduled messages with SendAt before the given time, earliest first.
+// If 'accept' is not nil, only messages to topics it accepts are returned.
+func (a *adapter) SchedMsgGetDue(before time.Time, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error) {
+	q := rdb.DB(a.dbName).Table("schedmsgs").
+		Between(rdb.MinVal, before, rdb.BetweenOpts{Index: "SendAt"}).
+		OrderBy(rdb.OrderByOpts{Index: "SendAt"})
+	if accept == nil {
+		q = q.Limit(limit)
+	}
+	// Skipped messages don't count towards the limit: read until enough messages are accepted.
+	return a.schedMsgQuery(q, accept, limit)
+}
+
+// SchedMsgDelete deletes a scheduled message. If user is not zero, the message is deleted only if it was
+// sent by the user.
+func (a *adapter) SchedMsgDelete(id, user t.Uid) error {
+	// Must use GetAll to produce array result expected by decFileUseCounter.
+	q := rdb.DB(a.dbName).Table("schedmsgs").GetAll(id.String())
+	if !user.IsZero() {
+		q = q.Filter(rdb.Row.Field("From").Eq(user.String()))
+	}
+
+	resp, err := q.Delete(rdb.DeleteOpts{ReturnChanges: true}).RunWrite(a.conn)
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return t.ErrNotFound
+	}
+
+	// Decrement use counter of attachments of the deleted message.
+	var ids []any
+	for _, change := range resp.Changes {
+		if old, ok := change.OldValue.(map[string]any); ok {
+			if attachments, ok := old["Attachments"].([]any); ok {
+				ids = append(ids, attachments...)
+			}
+		}
+	}
+	if len(ids) > 0 {
+		_, err = rdb.DB(a.dbName).Table("fileuploads").GetAll(ids...).
+			Update(map[string]any{"UseCount": rdb.Row.Field("UseCount").Default(1).Sub(1)}).
+			RunWrite(a.conn)
+	}
+	return err
+}
+
+// ReactionUpsert creates or replaces user's reaction to a message.
+func (a *adapter) ReactionUpsert(r *t.Reaction) error {
+	_, err := rdb.DB(a.dbName).Table("reactions").Insert(map[string]any{
+		"Id":        r.Topic + ":" + strconv.Itoa(r.SeqId) + ":" + r.User,
+		"CreatedAt": r.CreatedAt,
+		"Topic":     r.Topic,
+		"SeqId":     r.SeqId,
+		"User":      r.User,
+		"Value":     r.Value,
+	}, rdb.InsertOpts{Conflict: "replace"}).RunWrite(a.conn)
+	return err
+}
+
+// ReactionDelete removes user's reaction to a message.
+func (a *adapter) ReactionDelete(topic string, seqId int, user t.Uid) error {
+	_, err := rdb.DB(a.dbName).Table("reactions").
+		Get(topic + ":" + strconv.Itoa(seqId) + ":" + user.String()).Delete().RunWrite(a.conn)
+	return err
+}
+
+// ReactionGetAll returns reactions to messages with seq IDs in range [opts.Since, opts.Before).
+func (a *adapter) ReactionGetAll(topic string, opts *t.QueryOpt) ([]t.Reaction, error) {
+	var lower, upper any = rdb.MinVal, rdb.MaxVal
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			upper = opts.Before
+		}
+	}
+
+	cursor, err := rdb.DB(a.dbName).Table("reactions").
+		Between([]any{topic, lower}, []any{topic, upper}, rdb.BetweenOpts{Index: "Topic_SeqId"}).
+		OrderBy("SeqId", "CreatedAt").
+		Without("Id").
+		Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var reacts []t.Reaction
+	if err = cursor.All(&reacts); err != nil {
+		return nil, err
+	}
+
+	return reacts, nil
+}
+
 func deviceHasher(deviceID string) string {
 	// Generate custom key as [64-bit hash of device id] to ensure predictable
 	// length of the key
@@ -2615,6 +3455,41 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// FileRelinkMessages moves links of messages of the topic from one file to another.
+func (a *adapter) FileRelinkMessages(topic, oldFid, newFid string) error {
+	if t.ParseUid(oldFid).IsZero() || t.ParseUid(newFid).IsZero() {
+		return t.ErrMalformed
+	}
+
+	res, err := rdb.DB(a.dbName).Table("messages").
+		Between([]any{topic, rdb.MinVal}, []any{topic, rdb.MaxVal}, rdb.BetweenOpts{Index: "Topic_SeqId"}).
+		Filter(rdb.Row.Field("Attachments").Default([]any{}).Contains(oldFid)).
+		Update(func(row rdb.Term) any {
+			return map[string]any{"Attachments": row.Field("Attachments").Map(func(fid rdb.Term) any {
+				return rdb.Branch(fid.Eq(oldFid), newFid, fid)
+			})}
+		}).
+		RunWrite(a.conn)
+	if err != nil || res.Replaced == 0 {
+		return err
+	}
+
+	now := t.TimeNow()
+	if _, err = rdb.DB(a.dbName).Table("fileuploads").Get(newFid).
+		Update(map[string]any{
+			"UpdatedAt": now,
+			"UseCount":  rdb.Row.Field("UseCount").Default(0).Add(1),
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	_, err = rdb.DB(a.dbName).Table("fileuploads").Get(oldFid).
+		Update(map[string]any{
+			"UpdatedAt": now,
+			"UseCount":  rdb.Row.Field("UseCount").Default(1).Sub(1),
+		}).RunWrite(a.conn)
+	return err
+}
+
 // FileLinkAttachments connects given topic or message to the file record IDs from the list.
 func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
 	if len(fids) == 0 || (topic == "" && userId.IsZero() && msgId.IsZero()) {
@@ -2834,6 +3709,157 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 	return err
 }
 
+// WithOutbox is not supported: RethinkDB has no transactions. Change events are added to the persistent cache
+// after the change.
+func (a *adapter) WithOutbox(outbox *adp.Outbox) adp.Adapter {
+	return nil
+}
+
+// OutboxAdd is not supported.
+func (a *adapter) OutboxAdd(entries []adp.OutboxEntry) error {
+	return t.ErrUnsupported
+}
+
+// OutboxGet is not supported.
+func (a *adapter) OutboxGet(limit int) ([]adp.OutboxEntry, error) {
+	return nil, t.ErrUnsupported
+}
+
+// OutboxDelete is not supported.
+func (a *adapter) OutboxDelete(offsets []string) error {
+	return t.ErrUnsupported
+}
+
+// Data export.
+
+// exportPage loads a page of documents ordered by the primary key which follow the given key.
+// Documents are optionally filtered by the 'filter'.
+func (a *adapter) exportPage(table string, filter any, after string, limit int, result any) error {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+	query := rdb.DB(a.dbName).Table(table).
+		Between(after, rdb.MaxVal, rdb.BetweenOpts{LeftBound: "open"}).
+		OrderBy(rdb.OrderByOpts{Index: rdb.Asc(primaryKey(table))})
+	if filter != nil {
+		query = query.Filter(filter)
+	}
+	cursor, err := query.Limit(limit).Run(a.conn)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	return cursor.All(result)
+}
+
+// primaryKey returns the name of the primary key of the exportable table.
+func primaryKey(table string) string {
+	if table == "kvmeta" {
+		return "key"
+	}
+	return "Id"
+}
+
+// UserExport returns a page of users ordered by ID, including soft-deleted.
+func (a *adapter) UserExport(after t.Uid, limit int) ([]t.User, error) {
+	var users []t.User
+	if err := a.exportPage("users", nil, after.String(), limit, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// AuthExport returns all authentication records of the user.
+func (a *adapter) AuthExport(uid t.Uid) ([]adp.AuthRecord, error) {
+	cursor, err := rdb.DB(a.dbName).Table("auth").GetAllByIndex("userid", uid.String()).
+		OrderBy("unique").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var records []authRecord
+	if err = cursor.All(&records); err != nil {
+		return nil, err
+	}
+
+	result := make([]adp.AuthRecord, len(records))
+	for i, rec := range records {
+		result[i] = adp.AuthRecord{
+			Scheme:  rec.Scheme,
+			Unique:  rec.Unique,
+			AuthLvl: rec.AuthLvl,
+			Secret:  rec.Secret,
+			Expires: rec.Expires,
+		}
+	}
+	return result, nil
+}
+
+// TopicExport returns a page of topics ordered by name, including soft-deleted.
+func (a *adapter) TopicExport(after string, limit int) ([]t.Topic, error) {
+	var topics []t.Topic
+	if err := a.exportPage("topics", nil, after, limit, &topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// MessageExport returns a page of messages of the topic ordered by seq ID.
+func (a *adapter) MessageExport(topic string, from t.Uid, after, limit int) ([]t.Message, error) {
+	if limit <= 0 {
+		limit = a.maxMessageResults
+	}
+	q := rdb.DB(a.dbName).Table("messages").
+		Between([]any{topic, after}, []any{topic, rdb.MaxVal},
+			rdb.BetweenOpts{Index: "Topic_SeqId", LeftBound: "open"}).
+		OrderBy(rdb.OrderByOpts{Index: "Topic_SeqId"}).
+		// Skip hard-deleted messages, keep archived.
+		Filter(rdb.Row.Field("DelId").Default(0).Le(0))
+	if !from.IsZero() {
+		q = q.Filter(rdb.Row.Field("From").Eq(from.String()))
+	}
+	cursor, err := q.Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var msgs []t.Message
+	if err = cursor.All(&msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// FileExport returns a page of file records ordered by ID.
+func (a *adapter) FileExport(after string, limit int) ([]t.FileDef, error) {
+	var files []t.FileDef
+	if err := a.exportPage("fileuploads", nil, after, limit, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// PCacheExport returns a page of persistent cache entries ordered by key.
+func (a *adapter) PCacheExport(after string, limit int) ([]adp.PCacheEntry, error) {
+	var records []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	// The version record has a numeric value, skip it.
+	if err := a.exportPage("kvmeta", rdb.Row.Field("value").TypeOf().Eq("STRING"), after, limit, &records); err != nil {
+		return nil, err
+	}
+
+	entries := make([]adp.PCacheEntry, len(records))
+	for i, rec := range records {
+		entries[i] = adp.PCacheEntry{Key: rec.Key, Value: rec.Value}
+	}
+	return entries, nil
+}
+
 // Checks if the given error is 'Database not found'.
 func isMissingDb(err error) bool {
 	if err == nil {
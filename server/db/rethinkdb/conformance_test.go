@@ -0,0 +1,24 @@
+//go:build rethinkdb
+// +build rethinkdb
+
+package rethinkdb
+
+import (
+	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/db/adaptertest"
+)
+
+// The test requires a running database server, it's skipped if the server is not available.
+// The database is dropped and re-created. Configuration can be overridden with the
+// TINODE_TEST_RETHINKDB environment variable. Run with:
+//
+//	go test -tags rethinkdb ./db/rethinkdb/
+func TestConformance(t *testing.T) {
+	adp, err := adaptertest.OpenStore(adapterName, adaptertest.Config(adapterName,
+		`{"addresses": "localhost:28015", "database": "tinode_test", "timeout": 5}`))
+	if err != nil {
+		t.Skip("database is not available:", err)
+	}
+	adaptertest.Run(t, adp)
+}
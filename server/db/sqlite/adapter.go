@@ -0,0 +1,4390 @@
+//go:build sqlite
+// +build sqlite
+
+// Package sqlite is a database adapter for SQLite.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	adp "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/db/common"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	t "github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// adapter holds SQLite connection data.
+type adapter struct {
+	db     *sqlx.DB
+	dsn    string
+	dbPath string
+	config configType
+	// Maximum number of records to return
+	maxResults int
+	// Maximum number of message records to return
+	maxMessageResults int
+	version           int
+
+	// Single query timeout.
+	sqlTimeout time.Duration
+	// DB transaction timeout.
+	txTimeout time.Duration
+
+	// Change events to add to the outbox table in the transaction of the next change, see WithOutbox.
+	outbox *adp.Outbox
+}
+
+const (
+	defaultDatabase = "./tinode.db"
+	// Wait for the database lock for up to 5 seconds before failing with SQLITE_BUSY.
+	defaultBusyTimeout = 5000
+
+	adpVersion = 121
+
+	adapterName = "sqlite"
+
+	defaultMaxResults = 1024
+	// This is capped by the Session's send queue limit (128).
+	defaultMaxMessageResults = 100
+
+	// If DB request timeout is specified,
+	// we allocate txTimeoutMultiplier times more time for transactions.
+	txTimeoutMultiplier = 1.5
+)
+
+type configType struct {
+	// Path to the database file. The file is created if it does not exist.
+	Database string `json:"database,omitempty"`
+	// How long to wait for a lock held by another connection (in milliseconds).
+	BusyTimeout int `json:"busy_timeout,omitempty"`
+
+	// Connection pool settings.
+	//
+	// Maximum number of open connections to the database.
+	MaxOpenConns int `json:"max_open_conns,omitempty"`
+	// Maximum number of connections in the idle connection pool.
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// Maximum amount of time a connection may be reused (in seconds).
+	ConnMaxLifetime int `json:"conn_max_lifetime,omitempty"`
+
+	// DB request timeout (in seconds).
+	// If 0 (or negative), no timeout is applied.
+	SqlTimeout int `json:"sql_timeout,omitempty"`
+}
+
+func (a *adapter) getContext() (context.Context, context.CancelFunc) {
+	if a.sqlTimeout > 0 {
+		return context.WithTimeout(context.Background(), a.sqlTimeout)
+	}
+	return context.Background(), nil
+}
+
+func (a *adapter) getContextForTx() (context.Context, context.CancelFunc) {
+	if a.txTimeout > 0 {
+		return context.WithTimeout(context.Background(), a.txTimeout)
+	}
+	return context.Background(), nil
+}
+
+// Open initializes database session
+func (a *adapter) Open(jsonconfig json.RawMessage) error {
+	if a.db != nil {
+		return errors.New("sqlite adapter is already connected")
+	}
+
+	if len(jsonconfig) < 2 {
+		return errors.New("adapter sqlite missing config")
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsonconfig, &config); err != nil {
+		return errors.New("sqlite adapter failed to parse config: " + err.Error())
+	}
+
+	a.dbPath = config.Database
+	if a.dbPath == "" {
+		a.dbPath = defaultDatabase
+	}
+	if config.BusyTimeout <= 0 {
+		config.BusyTimeout = defaultBusyTimeout
+	}
+
+	// Foreign keys are disabled in SQLite by default, enable them.
+	// Write-ahead log allows readers to proceed concurrently with a writer.
+	// Transactions take the write lock immediately to avoid deadlocks on lock upgrade.
+	params := url.Values{}
+	params.Set("_foreign_keys", "1")
+	params.Set("_busy_timeout", strconv.Itoa(config.BusyTimeout))
+	params.Set("_journal_mode", "WAL")
+	params.Set("_txlock", "immediate")
+	a.dsn = "file:" + a.dbPath + "?" + params.Encode()
+	a.config = config
+
+	if a.maxResults <= 0 {
+		a.maxResults = defaultMaxResults
+	}
+
+	if a.maxMessageResults <= 0 {
+		a.maxMessageResults = defaultMaxMessageResults
+	}
+
+	if config.SqlTimeout > 0 {
+		a.sqlTimeout = time.Duration(config.SqlTimeout) * time.Second
+		// We allocate txTimeoutMultiplier times sqlTimeout for transactions.
+		a.txTimeout = time.Duration(float64(config.SqlTimeout)*txTimeoutMultiplier) * time.Second
+	}
+
+	return a.connect()
+}
+
+// connect opens the database file and configures the connection pool.
+func (a *adapter) connect() error {
+	var err error
+	a.db, err = sqlx.Open("sqlite3", a.dsn)
+	if err != nil {
+		return err
+	}
+
+	// Actually opening the database file.
+	if err = a.db.Ping(); err != nil {
+		a.db.Close()
+		a.db = nil
+		return err
+	}
+
+	if a.config.MaxOpenConns > 0 {
+		a.db.SetMaxOpenConns(a.config.MaxOpenConns)
+	}
+	if a.config.MaxIdleConns > 0 {
+		a.db.SetMaxIdleConns(a.config.MaxIdleConns)
+	}
+	if a.config.ConnMaxLifetime > 0 {
+		a.db.SetConnMaxLifetime(time.Duration(a.config.ConnMaxLifetime) * time.Second)
+	}
+	return nil
+}
+
+// Close closes the underlying database connection
+func (a *adapter) Close() error {
+	var err error
+	if a.db != nil {
+		err = a.db.Close()
+		a.db = nil
+		a.version = -1
+	}
+	return err
+}
+
+// IsOpen returns true if connection to database has been established. It does not check if
+// connection is actually live.
+func (a *adapter) IsOpen() bool {
+	return a.db != nil
+}
+
+// GetDbVersion returns current database version.
+func (a *adapter) GetDbVersion() (int, error) {
+	if a.version > 0 {
+		return a.version, nil
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var vers int
+	err := a.db.GetContext(ctx, &vers, "SELECT `value` FROM kvmeta WHERE `key`='version'")
+	if err != nil {
+		if isMissingTable(err) || err == sql.ErrNoRows {
+			err = errors.New("Database not initialized")
+		}
+		return -1, err
+	}
+
+	a.version = vers
+
+	return vers, nil
+}
+
+func (a *adapter) updateDbVersion(v int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	a.version = -1
+	if _, err := a.db.ExecContext(ctx, "UPDATE kvmeta SET `value`=? WHERE `key`='version'", v); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CheckDbVersion checks whether the actual DB version matches the expected version of this adapter.
+func (a *adapter) CheckDbVersion() error {
+	version, err := a.GetDbVersion()
+	if err != nil {
+		return err
+	}
+
+	if version != adpVersion {
+		return errors.New("Invalid database version " + strconv.Itoa(version) +
+			". Expected " + strconv.Itoa(adpVersion))
+	}
+
+	return nil
+}
+
+// Version returns adapter version.
+func (adapter) Version() int {
+	return adpVersion
+}
+
+// DB connection stats object.
+func (a *adapter) Stats() any {
+	if a.db == nil {
+		return nil
+	}
+	return a.db.Stats()
+}
+
+// GetName returns string that adapter uses to register itself with store.
+func (a *adapter) GetName() string {
+	return adapterName
+}
+
+// SetMaxResults configures how many results can be returned in a single DB call.
+func (a *adapter) SetMaxResults(val int) error {
+	if val <= 0 {
+		a.maxResults = defaultMaxResults
+	} else {
+		a.maxResults = val
+	}
+
+	return nil
+}
+
+// CreateDb initializes the storage.
+func (a *adapter) CreateDb(reset bool) error {
+	var err error
+	var tx *sql.Tx
+
+	if reset {
+		// The database is just a file: delete it together with the write-ahead log and start over.
+		a.db.Close()
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err = os.Remove(a.dbPath + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err = a.connect(); err != nil {
+			return err
+		}
+	}
+
+	if tx, err = a.db.Begin(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// SQLite has no JSON column type. JSON is stored as BLOB.
+	// Timestamps must be declared as DATETIME (without precision) to be returned as time.Time.
+	statements := []string{
+		`CREATE TABLE users(
+			id        INTEGER NOT NULL PRIMARY KEY,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			state     SMALLINT NOT NULL DEFAULT 0,
+			stateat   DATETIME,
+			access    BLOB,
+			lastseen  DATETIME,
+			useragent VARCHAR(255) DEFAULT '',
+			public    BLOB,
+			trusted   BLOB,
+			tags      BLOB
+		)`,
+		`CREATE INDEX users_state_stateat ON users(state, stateat)`,
+		`CREATE INDEX users_lastseen_updatedat ON users(lastseen, updatedat)`,
+
+		// Indexed user tags.
+		`CREATE TABLE usertags(
+			id     INTEGER PRIMARY KEY AUTOINCREMENT,
+			userid BIGINT NOT NULL,
+			tag    VARCHAR(96) NOT NULL,
+			FOREIGN KEY(userid) REFERENCES users(id)
+		)`,
+		`CREATE INDEX usertags_tag ON usertags(tag)`,
+		`CREATE UNIQUE INDEX usertags_userid_tag ON usertags(userid, tag)`,
+
+		// Indexed devices. Normalized into a separate table.
+		`CREATE TABLE devices(
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			userid   BIGINT NOT NULL,
+			hash     CHAR(16) NOT NULL,
+			deviceid TEXT NOT NULL,
+			platform VARCHAR(32),
+			lastseen DATETIME NOT NULL,
+			lang     VARCHAR(8),
+			FOREIGN KEY(userid) REFERENCES users(id)
+		)`,
+		`CREATE UNIQUE INDEX devices_hash ON devices(hash)`,
+
+		// Authentication records for the basic authentication scheme.
+		`CREATE TABLE auth(
+			id      INTEGER PRIMARY KEY AUTOINCREMENT,
+			uname   VARCHAR(32) NOT NULL,
+			userid  BIGINT NOT NULL,
+			scheme  VARCHAR(16) NOT NULL,
+			authlvl INT NOT NULL,
+			secret  VARCHAR(255) NOT NULL,
+			expires DATETIME,
+			FOREIGN KEY(userid) REFERENCES users(id)
+		)`,
+		`CREATE UNIQUE INDEX auth_userid_scheme ON auth(userid, scheme)`,
+		`CREATE UNIQUE INDEX auth_uname ON auth(uname)`,
+
+		// Topics
+		`CREATE TABLE topics(
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			state     SMALLINT NOT NULL DEFAULT 0,
+			stateat   DATETIME,
+			touchedat DATETIME,
+			name      CHAR(25) NOT NULL,
+			usebt     TINYINT DEFAULT 0,
+			owner     BIGINT NOT NULL DEFAULT 0,
+			access    BLOB,
+			seqid     INT NOT NULL DEFAULT 0,
+			delid     INT DEFAULT 0,
+			public    BLOB,
+			trusted   BLOB,
+			tags      BLOB,
+			pinned    BLOB,
+			msgttl    INT DEFAULT 0
+		)`,
+		`CREATE UNIQUE INDEX topics_name ON topics(name)`,
+		`CREATE INDEX topics_owner ON topics(owner)`,
+		`CREATE INDEX topics_state_stateat ON topics(state, stateat)`,
+
+		// Indexed topic tags.
+		`CREATE TABLE topictags(
+			id    INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic CHAR(25) NOT NULL,
+			tag   VARCHAR(96) NOT NULL,
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		)`,
+		`CREATE INDEX topictags_tag ON topictags(tag)`,
+		`CREATE UNIQUE INDEX topictags_userid_tag ON topictags(topic, tag)`,
+
+		// Subscriptions
+		`CREATE TABLE subscriptions(
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			deletedat DATETIME,
+			userid    BIGINT NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			delid     INT DEFAULT 0,
+			recvseqid INT DEFAULT 0,
+			readseqid INT DEFAULT 0,
+			modewant  CHAR(8),
+			modegiven CHAR(8),
+			private   BLOB,
+			FOREIGN KEY(userid) REFERENCES users(id)
+		)`,
+		`CREATE UNIQUE INDEX subscriptions_topic_userid ON subscriptions(topic, userid)`,
+		`CREATE INDEX subscriptions_topic ON subscriptions(topic)`,
+		`CREATE INDEX subscriptions_userid ON subscriptions(userid)`,
+		`CREATE INDEX subscriptions_deletedat ON subscriptions(deletedat)`,
+
+		// Messages. There is no full-text index: search falls back to a scan with LIKE.
+		`CREATE TABLE messages(
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			deletedat DATETIME,
+			delid     INT DEFAULT 0,
+			seqid     INT NOT NULL,
+			topic     CHAR(25) NOT NULL,` +
+			"`from`   BIGINT NOT NULL," +
+			`thread   INT NOT NULL DEFAULT 0,
+			head      BLOB,
+			content   BLOB,
+			plaintext TEXT,
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		)`,
+		`CREATE UNIQUE INDEX messages_topic_seqid ON messages(topic, seqid)`,
+		`CREATE INDEX messages_topic_thread_seqid ON messages(topic, thread, seqid)`,
+		`CREATE INDEX messages_topic_createdat ON messages(topic, createdat)`,
+
+		// Positions of users in threads.
+		`CREATE TABLE threadreads(
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic     CHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			thread    INT NOT NULL,
+			readseqid INT NOT NULL,
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		)`,
+		`CREATE UNIQUE INDEX threadreads_topic_userid_thread ON threadreads(topic, userid, thread)`,
+		`CREATE INDEX threadreads_userid ON threadreads(userid)`,
+
+		// Earlier revisions of edited messages.
+		`CREATE TABLE msgrevisions(
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			msgid     INT NOT NULL,
+			seqid     INT NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			head      BLOB,
+			content   BLOB,
+			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX msgrevisions_topic_seqid ON msgrevisions(topic, seqid)`,
+		`CREATE INDEX msgrevisions_msgid ON msgrevisions(msgid)`,
+
+		// Reactions to messages, one per user per message.
+		`CREATE TABLE reactions(
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			userid    BIGINT NOT NULL,
+			value     VARCHAR(32) NOT NULL,
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		)`,
+		`CREATE UNIQUE INDEX reactions_topic_seqid_userid ON reactions(topic, seqid, userid)`,
+		`CREATE INDEX reactions_userid ON reactions(userid)`,
+
+		// Messages scheduled for delivery at a later time.
+		`CREATE TABLE schedmsgs(
+			id          INTEGER NOT NULL PRIMARY KEY,
+			createdat   DATETIME NOT NULL,
+			updatedat   DATETIME NOT NULL,
+			sendat      DATETIME NOT NULL,
+			topic       CHAR(25) NOT NULL,
+			userid      BIGINT NOT NULL,
+			head        BLOB,
+			content     BLOB,
+			attachments BLOB,
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		)`,
+		`CREATE INDEX schedmsgs_sendat ON schedmsgs(sendat)`,
+		`CREATE INDEX schedmsgs_topic_userid ON schedmsgs(topic, userid)`,
+		`CREATE INDEX schedmsgs_userid ON schedmsgs(userid)`,
+
+		// Deletion log
+		`CREATE TABLE dellog(
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic      CHAR(25) NOT NULL,
+			deletedfor BIGINT NOT NULL DEFAULT 0,
+			delid      INT NOT NULL,
+			low        INT NOT NULL,
+			hi         INT NOT NULL,
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		)`,
+		`CREATE INDEX dellog_topic_delid_deletedfor ON dellog(topic, delid, deletedfor)`,
+		`CREATE INDEX dellog_topic_deletedfor_low_hi ON dellog(topic, deletedfor, low, hi)`,
+		`CREATE INDEX dellog_deletedfor ON dellog(deletedfor)`,
+
+		// User credentials
+		`CREATE TABLE credentials(
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			deletedat DATETIME,
+			method    VARCHAR(16) NOT NULL,
+			value     VARCHAR(128) NOT NULL,
+			synthetic VARCHAR(192) NOT NULL,
+			userid    BIGINT NOT NULL,
+			resp      VARCHAR(255),
+			done      TINYINT NOT NULL DEFAULT 0,
+			retries   INT NOT NULL DEFAULT 0,
+			FOREIGN KEY(userid) REFERENCES users(id)
+		)`,
+		`CREATE UNIQUE INDEX credentials_uniqueness ON credentials(synthetic)`,
+
+		// Records of uploaded files.
+		// Don't add FOREIGN KEY on userid. It's not needed and it will break user deletion.
+		// Using INDEX rather than FK on topic because it's either 'topics' or 'users' reference.
+		`CREATE TABLE fileuploads(
+			id        INTEGER NOT NULL PRIMARY KEY,
+			createdat DATETIME NOT NULL,
+			updatedat DATETIME NOT NULL,
+			userid    BIGINT,
+			status    INT NOT NULL,
+			mimetype  VARCHAR(255) NOT NULL,
+			size      BIGINT NOT NULL,
+			location  VARCHAR(2048) NOT NULL
+		)`,
+		`CREATE INDEX fileuploads_status ON fileuploads(status)`,
+
+		// Links between uploaded files and the topics, users or messages they are attached to.
+		`CREATE TABLE filemsglinks(
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			createdat DATETIME NOT NULL,
+			fileid    BIGINT NOT NULL,
+			msgid     INT,
+			topic     CHAR(25),
+			userid    BIGINT,
+			schedid   BIGINT,
+			FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY(topic) REFERENCES topics(name) ON DELETE CASCADE,
+			FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY(schedid) REFERENCES schedmsgs(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX filemsglinks_fileid ON filemsglinks(fileid)`,
+		`CREATE INDEX filemsglinks_msgid ON filemsglinks(msgid)`,
+
+		// Change events which are not delivered yet, keyed by offset.
+		`CREATE TABLE outbox(
+			id    VARCHAR(64) NOT NULL PRIMARY KEY,
+			event TEXT NOT NULL
+		)`,
+
+		`CREATE TABLE kvmeta(` +
+			"`key`       VARCHAR(64) NOT NULL PRIMARY KEY," +
+			"createdat   DATETIME," +
+			"`value`     TEXT" +
+			`)`,
+		"CREATE INDEX kvmeta_createdat_key ON kvmeta(createdat, `key`)",
+	}
+
+	for _, stmt := range statements {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	// Create system topic 'sys'.
+	if err = createSystemTopic(tx); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("INSERT INTO kvmeta(`key`, `value`) VALUES('version',?)", adpVersion); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpgradeDb upgrades the database, if necessary.
+func (a *adapter) UpgradeDb() error {
+	bumpVersion := func(a *adapter, x int) error {
+		if err := a.updateDbVersion(x); err != nil {
+			return err
+		}
+		_, err := a.GetDbVersion()
+		return err
+	}
+
+	// The SQLite schema was introduced at version 120.
+	if _, err := a.GetDbVersion(); err != nil {
+		return err
+	}
+
+	if a.version == 120 {
+		// Perform database upgrade from version 120 to version 121.
+
+		// Outbox of change events.
+		if _, err := a.db.Exec(
+			`CREATE TABLE outbox(
+				id    VARCHAR(64) NOT NULL PRIMARY KEY,
+				event TEXT NOT NULL
+			)`); err != nil {
+			return err
+		}
+
+		// Move undelivered events from the persistent cache, where they were kept before.
+		if _, err := a.db.Exec("INSERT INTO outbox(id,event) " +
+			"SELECT SUBSTR(`key`,5),`value` FROM kvmeta WHERE `key` LIKE 'cdc:%'"); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec("DELETE FROM kvmeta WHERE `key` LIKE 'cdc:%'"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 121); err != nil {
+			return err
+		}
+	}
+
+	if a.version != adpVersion {
+		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
+			". DB is still at " + strconv.Itoa(a.version))
+	}
+	return nil
+}
+
+func createSystemTopic(tx *sql.Tx) error {
+	now := t.TimeNow()
+	// JSON is passed as []byte to be stored as BLOB like all other JSON values.
+	query := `INSERT INTO topics(createdat,updatedat,state,touchedat,name,access,public)
+				VALUES(?,?,?,?,'sys',?,?)`
+	_, err := tx.Exec(query, now, now, t.StateOK, now,
+		[]byte(`{"Auth": "N","Anon": "N"}`), []byte(`{"fn": "System"}`))
+	return err
+}
+
+func addTags(tx *sqlx.Tx, table, keyName string, keyVal any, tags []string, ignoreDups bool) error {
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	var insert *sql.Stmt
+	var err error
+	insert, err = tx.Prepare("INSERT INTO " + table + "(" + keyName + ",tag) VALUES(?,?)")
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		_, err = insert.Exec(keyVal, tag)
+
+		if err != nil {
+			if isDupe(err) {
+				if ignoreDups {
+					continue
+				}
+				return t.ErrDuplicate
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeTags(tx *sqlx.Tx, table, keyName string, keyVal any, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	var args []any
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+
+	query, args, _ := sqlx.In("DELETE FROM "+table+" WHERE "+keyName+"=? AND tag IN (?)", keyVal, args)
+	query = tx.Rebind(query)
+	_, err := tx.Exec(query, args...)
+
+	return err
+}
+
+// UserCreate creates a new user. Returns error and true if error is due to duplicate user name,
+// false for any other error
+func (a *adapter) UserCreate(user *t.User) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(user.Uid())
+	if _, err = tx.Exec("INSERT INTO users(id,createdat,updatedat,state,stateat,access,lastseen,useragent,public,trusted,tags) "+
+		"VALUES(?,?,?,?,?,?,?,?,?,?,?)",
+		decoded_uid,
+		user.CreatedAt, user.UpdatedAt,
+		user.State, user.StateAt, user.Access,
+		user.LastSeen, user.UserAgent,
+		toJSON(user.Public), toJSON(user.Trusted), user.Tags); err != nil {
+		return err
+	}
+
+	// Save user's tags to a separate table to make user findable.
+	if err = addTags(tx, "usertags", "userid", decoded_uid, user.Tags, false); err != nil {
+		return err
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Add user's authentication record
+func (a *adapter) AuthAddRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	var exp *time.Time
+	if !expires.IsZero() {
+		exp = &expires
+	}
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "INSERT INTO auth(uname,userid,scheme,authLvl,secret,expires) VALUES(?,?,?,?,?,?)",
+		unique, store.DecodeUid(uid), scheme, authLvl, secret, exp)
+	if err != nil {
+		if isDupe(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+// AuthDelScheme deletes an existing authentication scheme for the user.
+func (a *adapter) AuthDelScheme(user t.Uid, scheme string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "DELETE FROM auth WHERE userid=? AND scheme=?", store.DecodeUid(user), scheme)
+	return err
+}
+
+// AuthDelAllRecords deletes all authentication records for the user.
+func (a *adapter) AuthDelAllRecords(user t.Uid) (int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.ExecContext(ctx, "DELETE FROM auth WHERE userid=?", store.DecodeUid(user))
+	if err != nil {
+		return 0, err
+	}
+	count, _ := res.RowsAffected()
+
+	return int(count), nil
+}
+
+// Update user's authentication unique, secret, auth level.
+func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	params := []string{"authLvl=?"}
+	args := []any{authLvl}
+
+	if unique != "" {
+		params = append(params, "uname=?")
+		args = append(args, unique)
+	}
+	if len(secret) > 0 {
+		params = append(params, "secret=?")
+		args = append(args, secret)
+	}
+	if !expires.IsZero() {
+		params = append(params, "expires=?")
+		args = append(args, expires)
+	}
+	args = append(args, store.DecodeUid(uid), scheme)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	sql := "UPDATE auth SET " + strings.Join(params, ",") + " WHERE userid=? AND scheme=?"
+	resp, err := a.db.ExecContext(ctx, sql, args...)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+
+	if count, _ := resp.RowsAffected(); count <= 0 {
+		return t.ErrNotFound
+	}
+
+	return err
+}
+
+// Retrieve user's authentication record
+func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
+	var expires time.Time
+
+	var record struct {
+		Uname   string
+		Authlvl auth.Level
+		Secret  []byte
+		Expires *time.Time
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	if err := a.db.GetContext(ctx, &record, "SELECT uname,secret,expires,authlvl FROM auth WHERE userid=? AND scheme=?",
+		store.DecodeUid(uid), scheme); err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - use standard error.
+			err = t.ErrNotFound
+		}
+		return "", 0, nil, expires, err
+	}
+
+	if record.Expires != nil {
+		expires = *record.Expires
+	}
+
+	return record.Uname, record.Authlvl, record.Secret, expires, nil
+}
+
+// Retrieve user's authentication record
+func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte, time.Time, error) {
+	var expires time.Time
+
+	var record struct {
+		Userid  int64
+		Authlvl auth.Level
+		Secret  []byte
+		Expires *time.Time
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	if err := a.db.GetContext(ctx, &record, "SELECT userid,secret,expires,authlvl FROM auth WHERE uname=?", unique); err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return t.ZeroUid, 0, nil, expires, err
+	}
+
+	if record.Expires != nil {
+		expires = *record.Expires
+	}
+
+	return store.EncodeUid(record.Userid), record.Authlvl, record.Secret, expires, nil
+}
+
+// UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
+func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var user t.User
+	err := a.db.GetContext(ctx, &user, "SELECT * FROM users WHERE id=? AND state!=?", store.DecodeUid(uid), t.StateDeleted)
+	if err == nil {
+		user.SetUid(uid)
+		user.Public = fromJSON(user.Public)
+		user.Trusted = fromJSON(user.Trusted)
+		return &user, nil
+	}
+
+	if err == sql.ErrNoRows {
+		// Clear the error if user does not exist or marked as soft-deleted.
+		return nil, nil
+	}
+
+	return nil, err
+}
+
+func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
+	uids := make([]any, len(ids))
+	for i, id := range ids {
+		uids[i] = store.DecodeUid(id)
+	}
+
+	var users []t.User
+	q, uids, _ := sqlx.In("SELECT * FROM users WHERE id IN (?) AND state!=?", uids, t.StateDeleted)
+	q = a.db.Rebind(q)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, q, uids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var user t.User
+		if err = rows.StructScan(&user); err != nil {
+			users = nil
+			break
+		}
+
+		if user.State == t.StateDeleted {
+			continue
+		}
+
+		user.SetUid(encodeUidString(user.Id))
+		user.Public = fromJSON(user.Public)
+		user.Trusted = fromJSON(user.Trusted)
+
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return users, err
+}
+
+// UserDelete deletes specified user: wipes completely (hard-delete) or marks as deleted.
+// TODO: report when the user is not found.
+func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	now := t.TimeNow()
+	decoded_uid := store.DecodeUid(uid)
+
+	if hard {
+		// Delete user's devices
+		// t.ErrNotFound = user has no devices.
+		if err = deviceDelete(tx, uid, ""); err != nil && err != t.ErrNotFound {
+			return err
+		}
+
+		// Delete user's subscriptions in all topics.
+		if err = subsDelForUser(tx, uid, true); err != nil {
+			return err
+		}
+
+		// Delete records of messages soft-deleted for the user.
+		if _, err = tx.Exec("DELETE FROM dellog WHERE deletedfor=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
+		// Just leave the messages there marked as sent by "not found" user.
+
+		// Delete topics where the user is the owner.
+
+		// Delete user's reactions to messages and positions in threads.
+		if _, err = tx.Exec("DELETE FROM reactions WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM threadreads WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+		// Delete messages the user scheduled for later delivery.
+		if _, err = tx.Exec("DELETE FROM schedmsgs WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// First delete all messages in those topics.
+		if _, err = tx.Exec("DELETE FROM dellog WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM reactions WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM threadreads WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM schedmsgs WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM messages WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete all subscriptions.
+		if _, err = tx.Exec("DELETE FROM subscriptions WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete topic tags.
+		if _, err = tx.Exec("DELETE FROM topictags WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			decoded_uid); err != nil {
+			return err
+		}
+
+		// And finally delete the topics.
+		if _, err = tx.Exec("DELETE FROM topics WHERE owner=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's authentication records.
+		if _, err = tx.Exec("DELETE FROM auth WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete all credentials.
+		if err = credDel(tx, uid, "", ""); err != nil && err != t.ErrNotFound {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM users WHERE id=?", decoded_uid); err != nil {
+			return err
+		}
+	} else {
+		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
+		if err = subsDelForUser(tx, uid, false); err != nil {
+			return err
+		}
+
+		// Disable all subscriptions to topics where the user is the owner.
+		if _, err = tx.Exec("UPDATE subscriptions SET updatedat=?, deletedat=? "+
+			"WHERE topic IN (SELECT name FROM topics WHERE owner=?)",
+			now, now, decoded_uid); err != nil {
+			return err
+		}
+		// Disable group topics where the user is the owner.
+		if _, err = tx.Exec("UPDATE topics SET updatedat=?,touchedat=?,state=?,stateat=? WHERE owner=?",
+			now, now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+		// Disable p2p topics with the user (p2p topic's owner is 0).
+		if _, err = tx.Exec("UPDATE topics SET updatedat=?,touchedat=?,state=?,stateat=? "+
+			"WHERE owner=0 AND name IN (SELECT topic FROM subscriptions WHERE userid=?)",
+			now, now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+
+		// Disable the other user's subscription to a disabled p2p topic.
+		if _, err = tx.Exec("UPDATE subscriptions SET updatedat=?, deletedat=? "+
+			"WHERE topic IN (SELECT topic FROM subscriptions WHERE userid=? AND topic LIKE 'p2p%')",
+			now, now, decoded_uid); err != nil {
+			return err
+		}
+
+		// Disable user.
+		if _, err = tx.Exec("UPDATE users SET updatedat=?, state=?, stateat=? WHERE id=?",
+			now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// topicStateForUser is called by UserUpdate when the update contains state change.
+func (a *adapter) topicStateForUser(tx *sqlx.Tx, decoded_uid int64, now time.Time, update any) error {
+	var err error
+
+	state, ok := update.(t.ObjState)
+	if !ok {
+		return t.ErrMalformed
+	}
+
+	if now.IsZero() {
+		now = t.TimeNow()
+	}
+
+	// Change state of all topics where the user is the owner.
+	if _, err = tx.Exec("UPDATE topics SET state=?, stateat=? WHERE owner=? AND state!=?",
+		state, now, decoded_uid, t.StateDeleted); err != nil {
+		return err
+	}
+
+	// Change state of p2p topics with the user (p2p topic's owner is 0)
+	if _, err = tx.Exec("UPDATE topics SET state=?, stateat=? "+
+		"WHERE owner=0 AND name IN (SELECT topic FROM subscriptions WHERE userid=?) AND state!=?",
+		state, now, decoded_uid, t.StateDeleted); err != nil {
+		return err
+	}
+
+	// Subscriptions don't need to be updated:
+	// subscriptions of a disabled user are not disabled and still can be manipulated.
+
+	return nil
+}
+
+// UserUpdate updates user object.
+func (a *adapter) UserUpdate(uid t.Uid, update map[string]any) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	cols, args := updateByMap(update)
+	decoded_uid := store.DecodeUid(uid)
+	args = append(args, decoded_uid)
+	_, err = tx.Exec("UPDATE users SET "+strings.Join(cols, ",")+" WHERE id=?", args...)
+	if err != nil {
+		return err
+	}
+
+	if state, ok := update["State"]; ok {
+		now, _ := update["StateAt"].(time.Time)
+		err = a.topicStateForUser(tx, decoded_uid, now, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tags are also stored in a separate table
+	if tags := extractTags(update); tags != nil {
+		// First delete all user tags
+		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
+		if err != nil {
+			return err
+		}
+		// Now insert new tags
+		err = addTags(tx, "usertags", "userid", decoded_uid, tags, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UserUpdateTags adds or resets user's tags
+func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+
+	if reset != nil {
+		// Delete all tags first if resetting.
+		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
+		if err != nil {
+			return nil, err
+		}
+		add = reset
+		remove = nil
+	}
+
+	// Now insert new tags. Ignore duplicates if resetting.
+	err = addTags(tx, "usertags", "userid", decoded_uid, add, reset == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete tags.
+	err = removeTags(tx, "usertags", "userid", decoded_uid, remove)
+	if err != nil {
+		return nil, err
+	}
+
+	var allTags []string
+	err = tx.Select(&allTags, "SELECT tag FROM usertags WHERE userid=? ORDER BY id", decoded_uid)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE users SET tags=? WHERE id=?", t.StringSlice(allTags), decoded_uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return allTags, tx.Commit()
+}
+
+// UserGetByCred returns user ID for the given validated credential.
+func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var decoded_uid int64
+	err := a.db.GetContext(ctx, &decoded_uid, "SELECT userid FROM credentials WHERE synthetic=?", method+":"+value)
+	if err == nil {
+		return store.EncodeUid(decoded_uid), nil
+	}
+
+	if err == sql.ErrNoRows {
+		// Clear the error if user does not exist
+		return t.ZeroUid, nil
+	}
+	return t.ZeroUid, err
+}
+
+// UserUnreadCount returns the total number of unread messages in all topics with
+// the R permission. If read fails, the counts are still returned with the original
+// user IDs but with the unread count undefined and non-nil error.
+func (a *adapter) UserUnreadCount(ids ...t.Uid) (map[t.Uid]int, error) {
+	uids := make([]any, len(ids))
+	counts := make(map[t.Uid]int, len(ids))
+	for i, id := range ids {
+		uids[i] = store.DecodeUid(id)
+		// Ensure all original uids are always present.
+		counts[id] = 0
+	}
+
+	q, uids, _ := sqlx.In("SELECT s.userid, SUM(t.seqid)-SUM(s.readseqid) AS unreadcount FROM topics AS t, subscriptions AS s "+
+		"WHERE s.userid IN (?) AND t.name=s.topic AND s.deletedat IS NULL AND t.state!=? AND "+
+		"INSTR(s.modewant, 'R')>0 AND INSTR(s.modegiven, 'R')>0 GROUP BY s.userid", uids, t.StateDeleted)
+	q = a.db.Rebind(q)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.QueryxContext(ctx, q, uids...)
+	if err != nil {
+		return counts, err
+	}
+
+	var userId int64
+	var unreadCount int
+	for rows.Next() {
+		if err = rows.Scan(&userId, &unreadCount); err != nil {
+			break
+		}
+		counts[store.EncodeUid(userId)] = unreadCount
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return counts, err
+}
+
+// UserGetUnvalidated returns a list of uids which have never logged in, have no
+// validated credentials and haven't been updated since lastUpdatedBefore.
+func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]t.Uid, error) {
+	var uids []t.Uid
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT u.id, IFNULL(SUM(c.done),0) AS total FROM users AS u "+
+			"LEFT JOIN credentials AS c ON u.id=c.userid WHERE u.lastseen IS NULL AND u.updatedat<? "+
+			"GROUP BY u.id, u.updatedat HAVING total=0 ORDER BY u.updatedat ASC LIMIT ?", lastUpdatedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var userId int64
+		var unused int
+		if err = rows.Scan(&userId, &unused); err != nil {
+			break
+		}
+		uids = append(uids, store.EncodeUid(userId))
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return uids, err
+}
+
+// *****************************
+
+func (a *adapter) topicCreate(tx *sqlx.Tx, topic *t.Topic) error {
+	_, err := tx.Exec("INSERT INTO topics(createdat,updatedat,touchedat,state,stateat,name,usebt,owner,access,"+
+		"seqid,delid,public,trusted,tags,pinned,msgttl) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		topic.CreatedAt, topic.UpdatedAt, topic.TouchedAt, topic.State, topic.StateAt, topic.Id, topic.UseBt,
+		store.DecodeUid(t.ParseUid(topic.Owner)), topic.Access, topic.SeqId, topic.DelId,
+		toJSON(topic.Public), toJSON(topic.Trusted), topic.Tags, topic.Pinned, topic.MsgTTL)
+	if err != nil {
+		return err
+	}
+
+	// Save topic's tags to a separate table to make topic findable.
+	return addTags(tx, "topictags", "topic", topic.Id, topic.Tags, false)
+}
+
+// TopicCreate saves topic object to database.
+func (a *adapter) TopicCreate(topic *t.Topic) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = a.topicCreate(tx, topic)
+	if err != nil {
+		return err
+	}
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// If undelete = true - update subscription on duplicate key, otherwise ignore the duplicate.
+func createSubscription(tx *sqlx.Tx, sub *t.Subscription, undelete bool) error {
+
+	isOwner := (sub.ModeGiven & sub.ModeWant).IsOwner()
+
+	jpriv := toJSON(sub.Private)
+	decoded_uid := store.DecodeUid(t.ParseUid(sub.User))
+	_, err := tx.Exec(
+		"INSERT INTO subscriptions(createdat,updatedat,deletedat,userid,topic,delid,recvseqid,readseqid,"+
+			"modeWant,modeGiven,private) VALUES(?,?,NULL,?,?,?,?,?,?,?,?)",
+		sub.CreatedAt, sub.UpdatedAt, decoded_uid, sub.Topic, sub.DelId, sub.RecvSeqId, sub.ReadSeqId,
+		sub.ModeWant.String(), sub.ModeGiven.String(), jpriv)
+
+	if err != nil && isDupe(err) {
+		if undelete {
+			_, err = tx.Exec("UPDATE subscriptions SET createdat=?,updatedat=?,deletedat=NULL,modeWant=?,modeGiven=?,"+
+				"delid=0,recvseqid=0,readseqid=0 WHERE topic=? AND userid=?",
+				sub.CreatedAt, sub.UpdatedAt, sub.ModeWant.String(), sub.ModeGiven.String(), sub.Topic, decoded_uid)
+		} else {
+			_, err = tx.Exec("UPDATE subscriptions SET createdat=?,updatedat=?,deletedat=NULL,modeWant=?,modeGiven=?,"+
+				"delid=0,recvseqid=0,readseqid=0,private=? WHERE topic=? AND userid=?",
+				sub.CreatedAt, sub.UpdatedAt, sub.ModeWant.String(), sub.ModeGiven.String(), jpriv,
+				sub.Topic, decoded_uid)
+		}
+	}
+	if err == nil && isOwner {
+		_, err = tx.Exec("UPDATE topics SET owner=? WHERE name=?", decoded_uid, sub.Topic)
+	}
+	return err
+}
+
+// TopicCreateP2P given two users creates a p2p topic
+func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = createSubscription(tx, initiator, false)
+	if err != nil {
+		return err
+	}
+
+	err = createSubscription(tx, invited, true)
+	if err != nil {
+		return err
+	}
+
+	topic := &t.Topic{ObjHeader: t.ObjHeader{Id: initiator.Topic}}
+	topic.ObjHeader.MergeTimes(&initiator.ObjHeader)
+	topic.TouchedAt = initiator.GetTouchedAt()
+	err = a.topicCreate(tx, topic)
+	if err != nil {
+		return err
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
+func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	// Fetch topic by name
+	var tt = new(t.Topic)
+	err := a.db.GetContext(ctx, tt,
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags,pinned,msgttl "+
+			"FROM topics WHERE name=?",
+		topic)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return nil, err
+	}
+
+	tt.Owner = encodeUidString(tt.Owner).String()
+	tt.Public = fromJSON(tt.Public)
+	tt.Trusted = fromJSON(tt.Trusted)
+
+	return tt, nil
+}
+
+// TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
+// Reads and denormalizes Public value.
+func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	// Fetch ALL user's subscriptions, even those which has not been modified recently.
+	// We are going to use these subscriptions to fetch topics and users which may have been modified recently.
+	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
+		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+	args := []any{store.DecodeUid(uid)}
+	if !keepDeleted {
+		// Filter out deleted rows.
+		q += " AND deletedat IS NULL"
+	}
+
+	limit := 0
+	ims := time.Time{}
+	if opts != nil {
+		if opts.Topic != "" {
+			q += " AND topic=?"
+			args = append(args, opts.Topic)
+		}
+
+		// Apply the limit only when the client does not manage the cache (or cold start).
+		// Otherwise have to get all subscriptions and do a manual join with users/topics.
+		if opts.IfModifiedSince == nil {
+			if opts.Limit > 0 && opts.Limit < a.maxResults {
+				limit = opts.Limit
+			} else {
+				limit = a.maxResults
+			}
+		} else {
+			ims = *opts.IfModifiedSince
+		}
+	} else {
+		limit = a.maxResults
+	}
+
+	if limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch subscriptions. Two queries are needed: users table (p2p) and topics table (grp).
+	// Prepare a list of separate subscriptions to users vs topics
+	join := make(map[string]t.Subscription) // Keeping these to make a join with table for .private and .access
+	topq := make([]any, 0, 16)
+	usrq := make([]any, 0, 16)
+	for rows.Next() {
+		var sub t.Subscription
+		if err = rows.StructScan(&sub); err != nil {
+			break
+		}
+		tname := sub.Topic
+		sub.User = uid.String()
+		tcat := t.GetTopicCat(tname)
+
+		if tcat == t.TopicCatMe || tcat == t.TopicCatFnd {
+			// One of 'me', 'fnd' subscriptions, skip. Don't skip 'sys' subscription.
+			continue
+		} else if tcat == t.TopicCatP2P {
+			// P2P subscription, find the other user to get user.Public and user.Trusted.
+			uid1, uid2, _ := t.ParseP2P(tname)
+			if uid1 == uid {
+				usrq = append(usrq, store.DecodeUid(uid2))
+				sub.SetWith(uid2.UserId())
+			} else {
+				usrq = append(usrq, store.DecodeUid(uid1))
+				sub.SetWith(uid1.UserId())
+			}
+			topq = append(topq, tname)
+		} else {
+			// Group or 'sys' subscription.
+			if tcat == t.TopicCatGrp {
+				// Maybe convert channel name to topic name.
+				tname = t.ChnToGrp(tname)
+			}
+			topq = append(topq, tname)
+		}
+		sub.Private = fromJSON(sub.Private)
+		join[tname] = sub
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []t.Subscription
+	if len(join) == 0 {
+		return subs, nil
+	}
+
+	// Fetch grp topics and join to subscriptions.
+	if len(topq) > 0 {
+		q = "SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,seqid,delid,public,trusted,tags " +
+			"FROM topics WHERE name IN (?)"
+
+		q, args, _ = sqlx.In(q, topq)
+
+		if !keepDeleted {
+			// Optionally skip deleted topics.
+			q += " AND state!=?"
+			args = append(args, t.StateDeleted)
+		}
+
+		if !ims.IsZero() {
+			// Use cache timestamp if provided: get newer entries only.
+			q += " AND touchedat>?"
+			args = append(args, ims)
+
+			if limit > 0 && limit < len(topq) {
+				// No point in fetching more than the requested limit.
+				q += " ORDER BY touchedat LIMIT ?"
+				args = append(args, limit)
+			}
+		}
+		q = a.db.Rebind(q)
+
+		ctx2, cancel2 := a.getContext()
+		if cancel2 != nil {
+			defer cancel2()
+		}
+		rows, err = a.db.QueryxContext(ctx2, q, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		var top t.Topic
+		for rows.Next() {
+			if err = rows.StructScan(&top); err != nil {
+				break
+			}
+
+			sub := join[top.Id]
+			// Check if sub.UpdatedAt needs to be adjusted to earlier or later time.
+			sub.UpdatedAt = common.SelectLatestTime(sub.UpdatedAt, top.UpdatedAt)
+			sub.SetState(top.State)
+			sub.SetTouchedAt(top.TouchedAt)
+			sub.SetSeqId(top.SeqId)
+			if t.GetTopicCat(sub.Topic) == t.TopicCatGrp {
+				sub.SetPublic(fromJSON(top.Public))
+				sub.SetTrusted(fromJSON(top.Trusted))
+			}
+			// Put back the updated value of a subsription, will process further below
+			join[top.Id] = sub
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Fetch p2p users and join to p2p subscriptions.
+	if len(usrq) > 0 {
+		q = "SELECT id,state,createdat,updatedat,state,stateat,access,lastseen,useragent,public,trusted,tags " +
+			"FROM users WHERE id IN (?)"
+		q, args, _ = sqlx.In(q, usrq)
+		if !keepDeleted {
+			// Optionally skip deleted users.
+			q += " AND state!=?"
+			args = append(args, t.StateDeleted)
+		}
+
+		// Ignoring ims: we need all users to get LastSeen and UserAgent.
+
+		q = a.db.Rebind(q)
+
+		ctx3, cancel3 := a.getContext()
+		if cancel3 != nil {
+			defer cancel3()
+		}
+		rows, err = a.db.QueryxContext(ctx3, q, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var usr2 t.User
+			if err = rows.StructScan(&usr2); err != nil {
+				break
+			}
+
+			joinOn := uid.P2PName(encodeUidString(usr2.Id))
+			if sub, ok := join[joinOn]; ok {
+				sub.UpdatedAt = common.SelectLatestTime(sub.UpdatedAt, usr2.UpdatedAt)
+				sub.SetState(usr2.State)
+				sub.SetPublic(fromJSON(usr2.Public))
+				sub.SetTrusted(fromJSON(usr2.Trusted))
+				sub.SetDefaultAccess(usr2.Access.Auth, usr2.Access.Anon)
+				sub.SetLastSeenAndUA(usr2.LastSeen, usr2.UserAgent)
+				join[joinOn] = sub
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	subs = make([]t.Subscription, 0, len(join))
+	for _, sub := range join {
+		subs = append(subs, sub)
+	}
+
+	return common.SelectEarliestUpdatedSubs(subs, opts, a.maxResults), nil
+}
+
+// UsersForTopic loads users subscribed to the given topic.
+// The difference between UsersForTopic vs SubsForTopic is that the former loads user.Public,
+// the latter does not.
+func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	tcat := t.GetTopicCat(topic)
+
+	// Fetch all subscribed users. The number of users is not large
+	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
+		s.readseqid,s.modewant,s.modegiven,u.public,u.trusted,u.lastseen,u.useragent,s.private
+		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id
+		WHERE s.topic=?`
+	args := []any{topic}
+	if !keepDeleted {
+		// Filter out rows with users deleted
+		q += " AND u.state!=?"
+		args = append(args, t.StateDeleted)
+
+		// For p2p topics we must load all subscriptions including deleted.
+		// Otherwise it will be impossible to swipe Public values.
+		if tcat != t.TopicCatP2P {
+			// Filter out deleted subscriptions.
+			q += " AND s.deletedat IS NULL"
+		}
+	}
+
+	limit := a.maxResults
+	var oneUser t.Uid
+	if opts != nil {
+		// Ignore IfModifiedSince: loading all entries because a topic cannot have too many subscribers.
+		// Those unmodified will be stripped of Public & Private.
+
+		if !opts.User.IsZero() {
+			// For p2p topics we have to fetch both users otherwise public cannot be swapped.
+			if tcat != t.TopicCatP2P {
+				q += " AND s.userid=?"
+				args = append(args, store.DecodeUid(opts.User))
+			}
+			oneUser = opts.User
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	q += " LIMIT ?"
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch subscriptions
+	var sub t.Subscription
+	var subs []t.Subscription
+	var lastSeen sql.NullTime
+	var userAgent string
+	var public, trusted any
+	for rows.Next() {
+		if err = rows.Scan(
+			&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt,
+			&sub.User, &sub.Topic, &sub.DelId, &sub.RecvSeqId,
+			&sub.ReadSeqId, &sub.ModeWant, &sub.ModeGiven,
+			&public, &trusted, &lastSeen, &userAgent, &sub.Private); err != nil {
+			break
+		}
+
+		sub.User = encodeUidString(sub.User).String()
+		sub.Private = fromJSON(sub.Private)
+		sub.SetPublic(fromJSON(public))
+		sub.SetTrusted(fromJSON(trusted))
+		sub.SetLastSeenAndUA(&lastSeen.Time, userAgent)
+		subs = append(subs, sub)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err == nil && tcat == t.TopicCatP2P && len(subs) > 0 {
+		// Swap public & lastSeen values of P2P topics as expected.
+		if len(subs) == 1 {
+			// The other user is deleted, nothing we can do.
+			subs[0].SetPublic(nil)
+			subs[0].SetTrusted(nil)
+			subs[0].SetLastSeenAndUA(nil, "")
+		} else {
+			tmp := subs[0].GetPublic()
+			subs[0].SetPublic(subs[1].GetPublic())
+			subs[1].SetPublic(tmp)
+
+			tmp = subs[0].GetTrusted()
+			subs[0].SetTrusted(subs[1].GetTrusted())
+			subs[1].SetTrusted(tmp)
+
+			lastSeen := subs[0].GetLastSeen()
+			userAgent = subs[0].GetUserAgent()
+			subs[0].SetLastSeenAndUA(subs[1].GetLastSeen(), subs[1].GetUserAgent())
+			subs[1].SetLastSeenAndUA(lastSeen, userAgent)
+		}
+
+		// Remove deleted and unneeded subscriptions
+		if !keepDeleted || !oneUser.IsZero() {
+			var xsubs []t.Subscription
+			for i := range subs {
+				if (subs[i].DeletedAt != nil && !keepDeleted) || (!oneUser.IsZero() && subs[i].Uid() != oneUser) {
+					continue
+				}
+				xsubs = append(xsubs, subs[i])
+			}
+			subs = xsubs
+		}
+	}
+
+	return subs, err
+}
+
+// topicNamesForUser reads a slice of strings using provided query.
+func (a *adapter) topicNamesForUser(uid t.Uid, sqlQuery string) ([]string, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, sqlQuery, store.DecodeUid(uid))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	var name string
+	for rows.Next() {
+		if err = rows.Scan(&name); err != nil {
+			break
+		}
+		names = append(names, name)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return names, err
+}
+
+// OwnTopics loads a slice of topic names where the user is the owner.
+func (a *adapter) OwnTopics(uid t.Uid) ([]string, error) {
+	return a.topicNamesForUser(uid, "SELECT name FROM topics WHERE owner=?")
+}
+
+// ChannelsForUser loads a slice of topic names where the user is a channel reader and notifications (P) are enabled.
+func (a *adapter) ChannelsForUser(uid t.Uid) ([]string, error) {
+	return a.topicNamesForUser(uid,
+		"SELECT topic FROM subscriptions WHERE userid=? AND topic LIKE 'chn%' "+
+			"AND INSTR(modewant, 'P')>0 AND INSTR(modegiven, 'P')>0 AND deletedat IS NULL")
+}
+
+func (a *adapter) TopicShare(shares []*t.Subscription) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, sub := range shares {
+		err = createSubscription(tx, sub, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TopicDelete deletes specified topic.
+func (a *adapter) TopicDelete(topic string, isChan, hard bool) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// If the topic is a channel, must try to delete subscriptions under both grpXXX and chnXXX names.
+	args := []any{topic}
+	if isChan {
+		args = append(args, t.GrpToChn(topic))
+	}
+
+	if hard {
+		// Delete subscriptions. If this is a channel, delete both group subscriptions and channel subscriptions.
+		q, args, _ := sqlx.In("DELETE FROM subscriptions WHERE topic IN (?)", args)
+		q = tx.Rebind(q)
+		if _, err = tx.Exec(q, args...); err != nil {
+			return err
+		}
+
+		if err = messageDeleteList(tx, topic, nil); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM topictags WHERE topic=?", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM topics WHERE name=?", topic); err != nil {
+			return err
+		}
+	} else {
+		now := t.TimeNow()
+
+		q, args, _ := sqlx.In("UPDATE subscriptions SET updatedat=?,deletedat=? WHERE topic IN (?)", now, now, args)
+		q = tx.Rebind(q)
+		if _, err = tx.Exec(q, args...); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("UPDATE topics SET updatedat=?,touchedat=?,state=?,stateat=? WHERE name=?",
+			now, now, t.StateDeleted, now, topic); err != nil {
+			return err
+		}
+	}
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (a *adapter) TopicUpdateOnMessage(topic string, msg *t.Message) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "UPDATE topics SET seqid=?,touchedat=? WHERE name=?", msg.SeqId, msg.CreatedAt, topic)
+
+	return err
+}
+
+func (a *adapter) TopicUpdate(topic string, update map[string]any) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if t, u := update["TouchedAt"], update["UpdatedAt"]; t == nil && u != nil {
+		update["TouchedAt"] = u
+	}
+	cols, args := updateByMap(update)
+	args = append(args, topic)
+	_, err = tx.Exec("UPDATE topics SET "+strings.Join(cols, ",")+" WHERE name=?", args...)
+	if err != nil {
+		return err
+	}
+
+	// Tags are also stored in a separate table
+	if tags := extractTags(update); tags != nil {
+		// First delete all user tags
+		_, err = tx.Exec("DELETE FROM topictags WHERE topic=?", topic)
+		if err != nil {
+			return err
+		}
+		// Now insert new tags
+		err = addTags(tx, "topictags", "topic", topic, tags, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		_, err := db.ExecContext(ctx, "UPDATE topics SET owner=? WHERE name=?", store.DecodeUid(newOwner), topic)
+		return err
+	})
+}
+
+// Get a subscription of a user to a topic.
+func (a *adapter) SubscriptionGet(topic string, user t.Uid, keepDeleted bool) (*t.Subscription, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var sub t.Subscription
+	err := a.db.GetContext(ctx, &sub, `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
+		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=? AND userid=?`,
+		topic, store.DecodeUid(user))
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return nil, err
+	}
+
+	if !keepDeleted && sub.DeletedAt != nil {
+		return nil, nil
+	}
+
+	sub.User = encodeUidString(sub.User).String()
+	sub.Private = fromJSON(sub.Private)
+
+	return &sub, nil
+}
+
+// SubsForUser loads all user's subscriptions. Does NOT load Public or Private values and does
+// not load deleted subscriptions.
+func (a *adapter) SubsForUser(forUser t.Uid) ([]t.Subscription, error) {
+	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
+		readseqid,modewant,modegiven FROM subscriptions WHERE userid=? AND deletedat IS NULL`
+	args := []any{store.DecodeUid(forUser)}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []t.Subscription
+	var ss t.Subscription
+	for rows.Next() {
+		if err = rows.StructScan(&ss); err != nil {
+			break
+		}
+		ss.User = forUser.String()
+		subs = append(subs, ss)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return subs, err
+}
+
+// SubsForTopic fetches all subsciptions for a topic. Does NOT load Public value.
+// The difference between UsersForTopic vs SubsForTopic is that the former loads user.public+trusted,
+// the latter does not.
+func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
+		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
+
+	args := []any{topic}
+	if !keepDeleted {
+		// Filter out deleted rows.
+		q += " AND deletedat IS NULL"
+	}
+	limit := a.maxResults
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+
+		if !opts.User.IsZero() {
+			q += " AND userid=?"
+			args = append(args, store.DecodeUid(opts.User))
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	q += " LIMIT ?"
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []t.Subscription
+	var ss t.Subscription
+	for rows.Next() {
+		if err = rows.StructScan(&ss); err != nil {
+			break
+		}
+
+		ss.User = encodeUidString(ss.User).String()
+		ss.Private = fromJSON(ss.Private)
+		subs = append(subs, ss)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return subs, err
+}
+
+// SubsUpdate updates one or multiple subscriptions to a topic.
+func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]any) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	cols, args := updateByMap(update)
+	q := "UPDATE subscriptions SET " + strings.Join(cols, ",") + " WHERE topic=?"
+	args = append(args, topic)
+	if !user.IsZero() {
+		// Update just one topic subscription
+		q += " AND userid=?"
+		args = append(args, store.DecodeUid(user))
+	}
+
+	if _, err = tx.Exec(q, args...); err != nil {
+		return err
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SubsDelete marks subscription as deleted.
+func (a *adapter) SubsDelete(topic string, user t.Uid) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	decoded_id := store.DecodeUid(user)
+	now := t.TimeNow()
+	res, err := tx.ExecContext(ctx,
+		"UPDATE subscriptions SET updatedat=?,deletedat=? WHERE topic=? AND userid=? AND deletedat IS NULL",
+		now, now, topic, decoded_id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err == nil && affected == 0 {
+		// ensure tx.Rollback() above is ran
+		err = t.ErrNotFound
+		return err
+	}
+
+	// Remove records of messages soft-deleted by this user.
+	_, err = tx.Exec("DELETE FROM dellog WHERE topic=? AND deletedfor=?", topic, decoded_id)
+	if err != nil {
+		return err
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// subsDelForUser marks user's subscriptions as deleted.
+func subsDelForUser(tx *sqlx.Tx, user t.Uid, hard bool) error {
+	var err error
+	if hard {
+		_, err = tx.Exec("DELETE FROM subscriptions WHERE userid=?", store.DecodeUid(user))
+	} else {
+		now := t.TimeNow()
+		_, err = tx.Exec("UPDATE subscriptions SET updatedat=?,deletedat=? WHERE userid=? AND deletedat IS NULL",
+			now, now, store.DecodeUid(user))
+	}
+	return err
+}
+
+// SubsDelForUser marks user's subscriptions as deleted.
+func (a *adapter) SubsDelForUser(user t.Uid, hard bool) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = subsDelForUser(tx, user, hard); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+// Returns a list of users who match given tags, such as "email:jdoe@example.com" or "tel:+18003287448".
+// Searching the 'users.Tags' for the given tags using respective index.
+func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error) {
+	index := make(map[string]struct{})
+	var args []any
+	stateConstraint := ""
+	if activeOnly {
+		args = append(args, t.StateOK)
+		stateConstraint = "u.state=? AND "
+	}
+	allReq := t.FlattenDoubleSlice(req)
+	for _, tag := range append(allReq, opt...) {
+		args = append(args, tag)
+		index[tag] = struct{}{}
+	}
+
+	query := "SELECT u.id,u.createdat,u.updatedat,u.access,u.public,u.trusted,u.tags,COUNT(*) AS matches " +
+		"FROM users AS u LEFT JOIN usertags AS t ON t.userid=u.id " +
+		"WHERE " + stateConstraint + "t.tag IN (?" + strings.Repeat(",?", len(allReq)+len(opt)-1) + ") " +
+		"GROUP BY u.id,u.createdat,u.updatedat,u.access,u.public,u.trusted,u.tags "
+	if len(allReq) > 0 {
+		query += "HAVING"
+		first := true
+		for _, reqDisjunction := range req {
+			if len(reqDisjunction) > 0 {
+				if !first {
+					query += " AND"
+				} else {
+					first = false
+				}
+				// At least one of the tags must be present.
+				query += " COUNT(t.tag IN (?" + strings.Repeat(",?", len(reqDisjunction)-1) + ") OR NULL)>=1 "
+				for _, tag := range reqDisjunction {
+					args = append(args, tag)
+				}
+			}
+		}
+	}
+	query += "ORDER BY matches DESC LIMIT ?"
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	// Get users matched by tags, sort by number of matches from high to low.
+	rows, err := a.db.QueryxContext(ctx, query, append(args, a.maxResults)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var userId int64
+	var public, trusted any
+	var access t.DefaultAccess
+	var userTags t.StringSlice
+	var ignored int
+	var sub t.Subscription
+	var subs []t.Subscription
+	thisUser := store.DecodeUid(uid)
+	for rows.Next() {
+		if err = rows.Scan(&userId, &sub.CreatedAt, &sub.UpdatedAt, &access,
+			&public, &trusted, &userTags, &ignored); err != nil {
+			subs = nil
+			break
+		}
+
+		if userId == thisUser {
+			// Skip the callee
+			continue
+		}
+		sub.User = store.EncodeUid(userId).String()
+		sub.SetPublic(fromJSON(public))
+		sub.SetTrusted(fromJSON(trusted))
+		sub.SetDefaultAccess(access.Auth, access.Anon)
+		foundTags := make([]string, 0, 1)
+		for _, tag := range userTags {
+			if _, ok := index[tag]; ok {
+				foundTags = append(foundTags, tag)
+			}
+		}
+		sub.Private = foundTags
+		subs = append(subs, sub)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return subs, err
+
+}
+
+// Returns a list of topics with matching tags.
+// Searching the 'topics.Tags' for the given tags using respective index.
+func (a *adapter) FindTopics(req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error) {
+	index := make(map[string]struct{})
+	var args []any
+	stateConstraint := ""
+	if activeOnly {
+		args = append(args, t.StateOK)
+		stateConstraint = "t.state=? AND "
+	}
+	var allReq []string
+	for _, el := range req {
+		allReq = append(allReq, el...)
+	}
+	for _, tag := range append(allReq, opt...) {
+		args = append(args, tag)
+		index[tag] = struct{}{}
+	}
+
+	query := "SELECT t.name AS topic,t.createdat,t.updatedat,t.usebt,t.access,t.public,t.trusted,t.tags,COUNT(*) AS matches " +
+		"FROM topics AS t LEFT JOIN topictags AS tt ON t.name=tt.topic " +
+		"WHERE " + stateConstraint + "tt.tag IN (?" + strings.Repeat(",?", len(allReq)+len(opt)-1) + ") " +
+		"GROUP BY t.name,t.createdat,t.updatedat,t.usebt,t.access,t.public,t.trusted,t.tags "
+	if len(allReq) > 0 {
+		query += "HAVING"
+		first := true
+		for _, reqDisjunction := range req {
+			if len(reqDisjunction) > 0 {
+				if !first {
+					query += " AND"
+				} else {
+					first = false
+				}
+				// At least one of the tags must be present.
+				query += " COUNT(tt.tag IN (?" + strings.Repeat(",?", len(reqDisjunction)-1) + ") OR NULL)>=1 "
+				for _, tag := range reqDisjunction {
+					args = append(args, tag)
+				}
+			}
+		}
+	}
+	query += "ORDER BY matches DESC LIMIT ?"
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, query, append(args, a.maxResults)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var access t.DefaultAccess
+	var public, trusted any
+	var topicTags t.StringSlice
+	var ignored int
+	var isChan int
+	var sub t.Subscription
+	var subs []t.Subscription
+	for rows.Next() {
+		if err = rows.Scan(&sub.Topic, &sub.CreatedAt, &sub.UpdatedAt, &isChan, &access,
+			&public, &trusted, &topicTags, &ignored); err != nil {
+			subs = nil
+			break
+		}
+
+		if isChan != 0 {
+			sub.Topic = t.GrpToChn(sub.Topic)
+		}
+		sub.SetPublic(fromJSON(public))
+		sub.SetTrusted(fromJSON(trusted))
+		sub.SetDefaultAccess(access.Auth, access.Anon)
+		foundTags := make([]string, 0, 1)
+		for _, tag := range topicTags {
+			if _, ok := index[tag]; ok {
+				foundTags = append(foundTags, tag)
+			}
+		}
+		sub.Private = foundTags
+		subs = append(subs, sub)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+
+}
+
+// MessageSearch finds messages in the given topics which contain all of the given words.
+func (a *adapter) MessageSearch(topics []string, forUser t.Uid, words []string, opts *t.QueryOpt) ([]t.Message, error) {
+	if len(topics) == 0 || len(words) == 0 {
+		return nil, nil
+	}
+
+	limit := a.maxMessageResults
+	if opts != nil && opts.Limit > 0 && opts.Limit < limit {
+		limit = opts.Limit
+	}
+
+	// There is no full-text index: all words are required to be present as substrings.
+	// LIKE is case-insensitive for ASCII characters only.
+	var match []string
+	args := []any{store.DecodeUid(forUser), topics}
+	for _, word := range words {
+		match = append(match, " AND m.plaintext LIKE ? ESCAPE '\\'")
+		args = append(args, "%"+likeEscaper.Replace(word)+"%")
+	}
+	args = append(args, limit)
+	query, args, _ := sqlx.In("SELECT m.createdat,m.seqid,m.topic,m.`from`,m.plaintext"+
+		" FROM messages AS m LEFT JOIN dellog AS d"+
+		" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+		" WHERE m.delid=0 AND m.topic IN (?)"+strings.Join(match, "")+
+		" AND d.deletedfor IS NULL ORDER BY m.createdat DESC LIMIT ?", args...)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		msg.From = encodeUidString(msg.From).String()
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	return msgs, err
+}
+
+// Messages
+func (a *adapter) MessageSave(msg *t.Message) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	// store assignes message ID, but we don't use it. Message IDs are not used anywhere.
+	// Using a sequential ID provided by the database.
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		res, err := db.ExecContext(
+			ctx,
+			"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,thread,head,content,plaintext) VALUES(?,?,?,?,?,?,?,?,?)",
+			msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
+			store.DecodeUid(t.ParseUid(msg.From)), msg.Thread, msg.Head, toJSON(msg.Content), msg.PlainText)
+		if err == nil {
+			id, _ := res.LastInsertId()
+			// Replacing ID given by store by ID given by the DB.
+			msg.SetUid(t.Uid(id))
+		}
+		return err
+	})
+}
+
+// MessageEdit replaces head and content of an existing message. The previous version is saved as a revision.
+func (a *adapter) MessageEdit(msg *t.Message) (err error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var id int64
+	if err = tx.GetContext(ctx, &id, "SELECT id FROM messages WHERE topic=? AND seqid=? AND delid=0",
+		msg.Topic, msg.SeqId); err != nil {
+		if err == sql.ErrNoRows {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+
+	// Revision timestamp is the time when the previous version was written.
+	if _, err = tx.ExecContext(ctx,
+		"INSERT INTO msgrevisions(createdat,msgid,seqid,topic,head,content) "+
+			"SELECT updatedat,id,seqid,topic,head,content FROM messages WHERE id=?", id); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE messages SET updatedat=?,head=?,content=?,plaintext=? WHERE id=?",
+		msg.UpdatedAt, msg.Head, toJSON(msg.Content), msg.PlainText, id); err != nil {
+		return err
+	}
+
+	msg.SetUid(t.Uid(id))
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MessageGetRevisions returns earlier revisions of the given message, oldest first.
+func (a *adapter) MessageGetRevisions(topic string, seqId int) ([]t.Message, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT r.createdat,r.seqid,r.topic,m.`from`,r.head,r.content"+
+			" FROM msgrevisions AS r INNER JOIN messages AS m ON m.id=r.msgid"+
+			" WHERE r.topic=? AND r.seqid=? AND m.delid=0 ORDER BY r.id",
+		topic, seqId)
+	if err != nil {
+		return nil, err
+	}
+
+	var revs []t.Message
+	for rows.Next() {
+		var rev t.Message
+		if err = rows.StructScan(&rev); err != nil {
+			break
+		}
+		rev.UpdatedAt = rev.CreatedAt
+		rev.From = encodeUidString(rev.From).String()
+		rev.Content = fromJSON(rev.Content)
+		revs = append(revs, rev)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return revs, err
+}
+
+func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
+	var limit = a.maxMessageResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			// SQLite BETWEEN is inclusive-inclusive, Tinode API requires inclusive-exclusive, thus -1
+			upper = opts.Before - 1
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	unum := store.DecodeUid(forUser)
+	args := []any{unum, topic, lower, upper}
+	threadFilter := ""
+	if opts != nil && opts.Thread > 0 {
+		threadFilter = " AND m.thread=?"
+		args = append(args, opts.Thread)
+	}
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(
+		ctx,
+		"SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.thread,m.head,m.content"+
+			" FROM messages AS m LEFT JOIN dellog AS d"+
+			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+			" WHERE m.delid=0 AND m.topic=? AND m.seqid BETWEEN ? AND ?"+threadFilter+" AND d.deletedfor IS NULL"+
+			" ORDER BY m.seqid DESC LIMIT ?",
+		args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]t.Message, 0, limit)
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		msg.From = encodeUidString(msg.From).String()
+		msg.Content = fromJSON(msg.Content)
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	return msgs, err
+}
+
+// Get ranges of deleted messages
+func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
+	var limit = a.maxResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 1 {
+			// DelRange is inclusive-exclusive, while BETWEEN is inclusive-inclisive.
+			upper = opts.Before - 1
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	// Fetch log of deletions
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=? AND delid BETWEEN ? AND ?"+
+		" AND (deletedFor=0 OR deletedFor=?)"+
+		" ORDER BY delid LIMIT ?", topic, lower, upper, store.DecodeUid(forUser), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var dellog struct {
+		Topic      string
+		Deletedfor int64
+		Delid      int
+		Low        int
+		Hi         int
+	}
+	var dmsgs []t.DelMessage
+	var dmsg t.DelMessage
+	for rows.Next() {
+		if err = rows.StructScan(&dellog); err != nil {
+			dmsgs = nil
+			break
+		}
+
+		if dellog.Delid != dmsg.DelId {
+			if dmsg.DelId > 0 {
+				dmsgs = append(dmsgs, dmsg)
+			}
+			dmsg.DelId = dellog.Delid
+			dmsg.Topic = dellog.Topic
+			if dellog.Deletedfor > 0 {
+				dmsg.DeletedFor = store.EncodeUid(dellog.Deletedfor).String()
+			} else {
+				dmsg.DeletedFor = ""
+			}
+			dmsg.SeqIdRanges = nil
+		}
+		if dellog.Hi <= dellog.Low+1 {
+			dellog.Hi = 0
+		}
+		dmsg.SeqIdRanges = append(dmsg.SeqIdRanges, t.Range{Low: dellog.Low, Hi: dellog.Hi})
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err == nil {
+		if dmsg.DelId > 0 {
+			dmsgs = append(dmsgs, dmsg)
+		}
+	}
+
+	return dmsgs, err
+}
+
+// MessageGetExpired finds topics with messages which have outlived the topic's message TTL.
+// If 'accept' is not nil, only topics it accepts are checked.
+func (a *adapter) MessageGetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]t.Range, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Messages expire at different times in different topics. Find topics with TTL first, then use
+	// the (topic, createdat) index to find expired messages in each of them.
+	rows, err := a.db.QueryContext(ctx, "SELECT name,msgttl FROM topics WHERE msgttl>0 AND state!=?", t.StateDeleted)
+	if err != nil {
+		return nil, err
+	}
+	type topicTTL struct {
+		name string
+		ttl  int
+	}
+	var topics []topicTTL
+	for rows.Next() {
+		var tt topicTTL
+		if err = rows.Scan(&tt.name, &tt.ttl); err != nil {
+			break
+		}
+		if accept == nil || accept(tt.name) {
+			topics = append(topics, tt)
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := make(map[string]t.Range)
+	for _, tt := range topics {
+		if len(expired) >= limit {
+			break
+		}
+		var low, hi sql.NullInt64
+		err = a.db.QueryRowContext(ctx, "SELECT MIN(seqid),MAX(seqid) FROM messages WHERE topic=? AND createdat<? AND delid=0",
+			tt.name, now.Add(-time.Duration(tt.ttl)*time.Second)).Scan(&low, &hi)
+		if err != nil {
+			return nil, err
+		}
+		if !low.Valid {
+			// No expired messages in this topic.
+			continue
+		}
+		rng := t.Range{Low: int(low.Int64)}
+		if hi.Int64 > low.Int64 {
+			// Range is inclusive-exclusive.
+			rng.Hi = int(hi.Int64) + 1
+		}
+		expired[tt.name] = rng
+	}
+	return expired, nil
+}
+
+// MessageArchive replaces live messages in the range with stubs linked to the segment file.
+func (a *adapter) MessageArchive(topic string, rng t.Range, segment string, unchangedSince time.Time) (err error) {
+	fid := t.ParseUid(segment)
+	if (segment != "" && fid.IsZero()) || rng.Hi <= rng.Low {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	where := "topic=? AND seqid>=? AND seqid<? AND delid=0"
+	args := []any{topic, rng.Low, rng.Hi}
+
+	// Earlier revisions are kept in the segment.
+	_, err = tx.Exec("DELETE FROM msgrevisions WHERE msgid IN (SELECT id FROM messages WHERE "+
+		where+")", args...)
+	if err != nil {
+		return err
+	}
+
+	if !fid.IsZero() {
+		_, err = tx.Exec("INSERT INTO filemsglinks(createdat,fileid,msgid) SELECT ?,?,id FROM messages WHERE "+
+			where, append([]any{t.TimeNow(), store.DecodeUid(fid)}, args...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE messages SET delid=?,head=NULL,content=NULL,plaintext=NULL WHERE "+
+		where, append([]any{t.MsgDelIdArchived}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	if !unchangedSince.IsZero() {
+		var changed int
+		err = tx.Get(&changed, "SELECT COUNT(*) FROM messages WHERE topic=? AND seqid>=? AND seqid<? AND "+
+			"(updatedat>=? OR deletedat>=?)", topic, rng.Low, rng.Hi, unchangedSince, unchangedSince)
+		if err != nil {
+			return err
+		}
+		if changed > 0 {
+			return t.ErrConflict
+		}
+	}
+
+	return tx.Commit()
+}
+
+func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
+	var err error
+	if toDel == nil {
+		// Whole topic is being deleted, thus also deleting all messages.
+		_, err = tx.Exec("DELETE FROM dellog WHERE topic=?", topic)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM reactions WHERE topic=?", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM threadreads WHERE topic=?", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM schedmsgs WHERE topic=?", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM messages WHERE topic=?", topic)
+		}
+		// filemsglinks will be deleted because of ON DELETE CASCADE
+
+	} else {
+		// Only some messages are being deleted
+		// Start with making log entries
+		forUser := decodeUidString(toDel.DeletedFor)
+		var insert *sql.Stmt
+		if insert, err = tx.Prepare(
+			"INSERT INTO dellog(topic,deletedfor,delid,low,hi) VALUES(?,?,?,?,?)"); err != nil {
+			return err
+		}
+
+		// Counter of deleted messages
+		seqCount := 0
+		for _, rng := range toDel.SeqIdRanges {
+			if rng.Hi == 0 {
+				// Dellog must contain valid Low and *Hi*.
+				rng.Hi = rng.Low + 1
+			}
+			seqCount += rng.Hi - rng.Low
+			if _, err = insert.Exec(topic, forUser, toDel.DelId, rng.Low, rng.Hi); err != nil {
+				break
+			}
+		}
+
+		if err == nil && toDel.DeletedFor == "" {
+			// Hard-deleting messages requires updates to the messages table
+			where := "topic=? AND "
+			args := []any{topic}
+			if len(toDel.SeqIdRanges) > 1 || toDel.SeqIdRanges[0].Hi == 0 {
+				for _, r := range toDel.SeqIdRanges {
+					if r.Hi == 0 {
+						args = append(args, r.Low)
+					} else {
+						for i := r.Low; i < r.Hi; i++ {
+							args = append(args, i)
+						}
+					}
+				}
+
+				where += "seqid IN (?" + strings.Repeat(",?", seqCount-1) + ")"
+			} else {
+				// Optimizing for a special case of single range low..hi.
+				where += "seqid BETWEEN ? AND ?"
+				// SQLite's BETWEEN is inclusive-inclusive thus decrement Hi by 1.
+				args = append(args, toDel.SeqIdRanges[0].Low, toDel.SeqIdRanges[0].Hi-1)
+			}
+			where += " AND deletedat IS NULL"
+
+			_, err = tx.Exec("DELETE FROM filemsglinks WHERE msgid IN (SELECT id FROM messages WHERE "+
+				where+")", args...)
+			if err != nil {
+				return err
+			}
+
+			// Earlier revisions are deleted together with the message.
+			_, err = tx.Exec("DELETE FROM msgrevisions WHERE msgid IN (SELECT id FROM messages WHERE "+
+				where+")", args...)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("DELETE FROM reactions WHERE topic=? AND seqid IN (SELECT seqid FROM messages WHERE "+
+				where+")", append([]any{topic}, args...)...)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("UPDATE messages SET deletedat=?,delid=?,head=NULL,content=NULL,plaintext=NULL WHERE "+
+				where,
+				append([]any{t.TimeNow(), toDel.DelId}, args...)...)
+		}
+	}
+
+	return err
+}
+
+// MessageDeleteList deletes messages in the given topic with seqIds from the list
+func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if err = messageDeleteList(tx, topic, toDel); err != nil {
+		return err
+	}
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ThreadReadUpdate records the latest reply in the thread read by the user. The value is never decreased.
+func (a *adapter) ThreadReadUpdate(topic string, user t.Uid, thread, readSeqId int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx,
+		"INSERT INTO threadreads(topic,userid,thread,readseqid) VALUES(?,?,?,?) "+
+			"ON CONFLICT(topic,userid,thread) DO UPDATE SET readseqid=MAX(readseqid,excluded.readseqid)",
+		topic, store.DecodeUid(user), thread, readSeqId)
+	return err
+}
+
+// ThreadGetAll returns summaries of all threads in the topic as seen by the given user.
+func (a *adapter) ThreadGetAll(topic string, forUser t.Uid) ([]t.ThreadStatus, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	unum := store.DecodeUid(forUser)
+	rows, err := a.db.QueryContext(ctx,
+		"SELECT m.thread,COUNT(*),MAX(m.seqid),COALESCE(MAX(tr.readseqid),0),"+
+			"SUM(m.seqid>COALESCE(tr.readseqid,0))"+
+			" FROM messages AS m LEFT JOIN threadreads AS tr"+
+			" ON tr.topic=m.topic AND tr.thread=m.thread AND tr.userid=?"+
+			" LEFT JOIN dellog AS d"+
+			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+			" WHERE m.delid=0 AND m.topic=? AND m.thread>0 AND d.deletedfor IS NULL"+
+			" GROUP BY m.thread ORDER BY m.thread",
+		unum, unum, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var threads []t.ThreadStatus
+	for rows.Next() {
+		var ts t.ThreadStatus
+		if err = rows.Scan(&ts.Thread, &ts.Count, &ts.LastSeqId, &ts.ReadSeqId, &ts.Unread); err != nil {
+			break
+		}
+		threads = append(threads, ts)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return threads, err
+}
+
+// SchedMsgSave saves a message for delivery at a later time.
+func (a *adapter) SchedMsgSave(msg *t.ScheduledMessage) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	id := store.DecodeUid(msg.Uid())
+	if _, err = tx.Exec(
+		"INSERT INTO schedmsgs(id,createdat,updatedat,sendat,topic,userid,head,content,attachments) "+
+			"VALUES(?,?,?,?,?,?,?,?,?)",
+		id, msg.CreatedAt, msg.UpdatedAt, msg.SendAt, msg.Topic, decodeUidString(msg.From),
+		msg.Head, toJSON(msg.Content), msg.Attachments); err != nil {
+		return err
+	}
+
+	// Link attachments to the scheduled message to protect them from garbage collection.
+	for _, fid := range msg.Attachments {
+		if _, err = tx.Exec("INSERT INTO filemsglinks(createdat,fileid,schedid) VALUES(?,?,?)",
+			msg.CreatedAt, decodeUidString(fid), id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// schedMsgQuery returns scheduled messages selected by the query. If 'accept' is not nil, messages to topics
+// it does not accept are skipped and at most 'limit' messages are returned.
+func (a *adapter) schedMsgQuery(accept func(topic string) bool, limit int, query string, args ...any) ([]t.ScheduledMessage, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT id,createdat,updatedat,sendat,topic,userid AS `from`,head,content,attachments FROM schedmsgs"+
+			query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.ScheduledMessage
+	for rows.Next() {
+		var msg t.ScheduledMessage
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		if accept != nil && !accept(msg.Topic) {
+			continue
+		}
+		msg.SetUid(encodeUidString(msg.Id))
+		msg.From = encodeUidString(msg.From).String()
+		msg.Content = fromJSON(msg.Content)
+		msgs = append(msgs, msg)
+		if accept != nil && len(msgs) >= limit {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return msgs, err
+}
+
+// SchedMsgGetAll returns pending scheduled messages sent by the given user to the topic, earliest first.
+func (a *adapter) SchedMsgGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error) {
+	return a.schedMsgQuery(nil, 0, " WHERE topic=? AND userid=? ORDER BY sendat", topic, store.DecodeUid(user))
+}
+
+// SchedMsgGet returns the scheduled message with the given ID.
+func (a *adapter) SchedMsgGet(id t.Uid) (*t.ScheduledMessage, error) {
+	msgs, err := a.schedMsgQuery(nil, 0, " WHERE id=?", store.DecodeUid(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, t.ErrNotFound
+	}
+	return &msgs[0], nil
+}
+
+// SchedMsgGetDue returns up to 'limit' scheduled messages with SendAt before the given time, earliest first.
+// If 'accept' is not nil, only messages to topics it accepts are returned.
+func (a *adapter) SchedMsgGetDue(before time.Time, accept func(topic string) bool, limit int) ([]t.ScheduledMessage, error) {
+	if accept == nil {
+		return a.schedMsgQuery(nil, 0, " WHERE sendat<? ORDER BY sendat LIMIT ?", before, limit)
+	}
+	// Skipped messages don't count towards the limit: read until enough messages are accepted.
+	return a.schedMsgQuery(accept, limit, " WHERE sendat<? ORDER BY sendat", before)
+}
+
+// SchedMsgDelete deletes a scheduled message. If user is not zero, the message is deleted only if it was
+// sent by the user.
+func (a *adapter) SchedMsgDelete(id, user t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query := "DELETE FROM schedmsgs WHERE id=?"
+	args := []any{store.DecodeUid(id)}
+	if !user.IsZero() {
+		query += " AND userid=?"
+		args = append(args, store.DecodeUid(user))
+	}
+	// filemsglinks will be deleted because of ON DELETE CASCADE
+	res, err := a.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// ReactionUpsert creates or replaces user's reaction to a message.
+func (a *adapter) ReactionUpsert(r *t.Reaction) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		_, err := db.ExecContext(ctx,
+			"INSERT INTO reactions(createdat,topic,seqid,userid,value) VALUES(?,?,?,?,?) "+
+				"ON CONFLICT(topic,seqid,userid) DO UPDATE SET createdat=excluded.createdat,value=excluded.value",
+			r.CreatedAt, r.Topic, r.SeqId, decodeUidString(r.User), r.Value)
+		return err
+	})
+}
+
+// ReactionDelete removes user's reaction to a message.
+func (a *adapter) ReactionDelete(topic string, seqId int, user t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		_, err := db.ExecContext(ctx, "DELETE FROM reactions WHERE topic=? AND seqid=? AND userid=?",
+			topic, seqId, store.DecodeUid(user))
+		return err
+	})
+}
+
+// ReactionGetAll returns reactions to messages with seq IDs in range [opts.Since, opts.Before).
+func (a *adapter) ReactionGetAll(topic string, opts *t.QueryOpt) ([]t.Reaction, error) {
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			upper = opts.Before - 1
+		}
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT createdat,topic,seqid,userid AS user,value FROM reactions"+
+			" WHERE topic=? AND seqid BETWEEN ? AND ? ORDER BY seqid,id",
+		topic, lower, upper)
+	if err != nil {
+		return nil, err
+	}
+
+	var reacts []t.Reaction
+	for rows.Next() {
+		var r t.Reaction
+		if err = rows.StructScan(&r); err != nil {
+			break
+		}
+		r.User = encodeUidString(r.User).String()
+		reacts = append(reacts, r)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return reacts, err
+}
+
+func deviceHasher(deviceID string) string {
+	// Generate custom key as [64-bit hash of device id] to ensure predictable
+	// length of the key
+	hasher := fnv.New64()
+	hasher.Write([]byte(deviceID))
+	return strconv.FormatUint(uint64(hasher.Sum64()), 16)
+}
+
+// Device management for push notifications
+func (a *adapter) DeviceUpsert(uid t.Uid, def *t.DeviceDef) error {
+	hash := deviceHasher(def.DeviceId)
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Ensure uniqueness of the device ID: delete all records of the device ID
+	_, err = tx.Exec("DELETE FROM devices WHERE hash=?", hash)
+	if err != nil {
+		return err
+	}
+
+	// Actually add/update DeviceId for the new user
+	_, err = tx.Exec("INSERT INTO devices(userid, hash, deviceId, platform, lastseen, lang) VALUES(?,?,?,?,?,?)",
+		store.DecodeUid(uid), hash, def.DeviceId, def.Platform, def.LastSeen, def.Lang)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
+	var unums []any
+	for _, uid := range uids {
+		unums = append(unums, store.DecodeUid(uid))
+	}
+
+	q, unums, _ := sqlx.In("SELECT userid,deviceid,platform,lastseen,lang FROM devices WHERE userid IN (?)", unums)
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, q, unums...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var device struct {
+		Userid   int64
+		Deviceid string
+		Platform string
+		Lastseen time.Time
+		Lang     string
+	}
+
+	result := make(map[t.Uid][]t.DeviceDef)
+	count := 0
+	for rows.Next() {
+		if err = rows.StructScan(&device); err != nil {
+			break
+		}
+		uid := store.EncodeUid(device.Userid)
+		udev := result[uid]
+		udev = append(udev, t.DeviceDef{
+			DeviceId: device.Deviceid,
+			Platform: device.Platform,
+			LastSeen: device.Lastseen,
+			Lang:     device.Lang,
+		})
+		result[uid] = udev
+		count++
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	return result, count, err
+}
+
+func deviceDelete(tx *sqlx.Tx, uid t.Uid, deviceID string) error {
+	var err error
+	var res sql.Result
+	if deviceID == "" {
+		res, err = tx.Exec("DELETE FROM devices WHERE userid=?", store.DecodeUid(uid))
+	} else {
+		res, err = tx.Exec("DELETE FROM devices WHERE userid=? AND hash=?", store.DecodeUid(uid), deviceHasher(deviceID))
+	}
+
+	if err == nil {
+		if count, _ := res.RowsAffected(); count == 0 {
+			err = t.ErrNotFound
+		}
+	}
+
+	return err
+}
+
+func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = deviceDelete(tx, uid, deviceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Credential management
+
+// CredUpsert adds or updates a validation record. Returns true if inserted, false if updated.
+// 1. if credential is validated:
+// 1.1 Hard-delete unconfirmed equivalent record, if exists.
+// 1.2 Insert new. Report error if duplicate.
+// 2. if credential is not validated:
+// 2.1 Check if validated equivalent exist. If so, report an error.
+// 2.2 Soft-delete all unvalidated records of the same method.
+// 2.3 Undelete existing credential. Return if successful.
+// 2.4 Insert new credential record.
+func (a *adapter) CredUpsert(cred *t.Credential) (bool, error) {
+	var err error
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	now := t.TimeNow()
+	userId := decodeUidString(cred.User)
+
+	// Enforce uniqueness: if credential is confirmed, "method:value" must be unique.
+	// if credential is not yet confirmed, "userid:method:value" is unique.
+	synth := cred.Method + ":" + cred.Value
+
+	if !cred.Done {
+		// Check if this credential is already validated.
+		var done bool
+		err = tx.Get(&done, "SELECT done FROM credentials WHERE synthetic=?", synth)
+		if err == nil {
+			// Assign err to ensure closing of a transaction.
+			err = t.ErrDuplicate
+			return false, err
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+		// We are going to insert new record.
+		synth = cred.User + ":" + synth
+
+		// Adding new unvalidated credential. Deactivate all unvalidated records of this user and method.
+		_, err = tx.Exec("UPDATE credentials SET deletedat=? WHERE userid=? AND method=? AND done=FALSE",
+			now, userId, cred.Method)
+		if err != nil {
+			return false, err
+		}
+		// Assume that the record exists and try to update it: undelete, update timestamp and response value.
+		res, err := tx.Exec("UPDATE credentials SET updatedat=?,deletedat=NULL,resp=?,done=0 WHERE synthetic=?",
+			cred.UpdatedAt, cred.Resp, synth)
+		if err != nil {
+			return false, err
+		}
+		// If record was updated, then all is fine.
+		if numrows, _ := res.RowsAffected(); numrows > 0 {
+			return false, tx.Commit()
+		}
+	} else {
+		// Hard-deleting unconformed record if it exists.
+		_, err = tx.Exec("DELETE FROM credentials WHERE synthetic=?", cred.User+":"+synth)
+		if err != nil {
+			return false, err
+		}
+	}
+	// Add new record.
+	_, err = tx.Exec("INSERT INTO credentials(createdat,updatedat,method,value,synthetic,userid,resp,done) "+
+		"VALUES(?,?,?,?,?,?,?,?)",
+		cred.CreatedAt, cred.UpdatedAt, cred.Method, cred.Value, synth, userId, cred.Resp, cred.Done)
+	if err != nil {
+		if isDupe(err) {
+			return true, t.ErrDuplicate
+		}
+		return true, err
+	}
+	return true, tx.Commit()
+}
+
+// credDel deletes given validation method or all methods of the given user.
+// 1. If user is being deleted, hard-delete all records (method == "")
+// 2. If one value is being deleted:
+// 2.1 Delete it if it's valiated or if there were no attempts at validation
+// (otherwise it could be used to circumvent the limit on validation attempts).
+// 2.2 In that case mark it as soft-deleted.
+func credDel(tx *sqlx.Tx, uid t.Uid, method, value string) error {
+	constraints := " WHERE userid=?"
+	args := []any{store.DecodeUid(uid)}
+
+	if method != "" {
+		constraints += " AND method=?"
+		args = append(args, method)
+
+		if value != "" {
+			constraints += " AND value=?"
+			args = append(args, value)
+		}
+	}
+
+	var err error
+	var res sql.Result
+	if method == "" {
+		// Case 1
+		res, err = tx.Exec("DELETE FROM credentials"+constraints, args...)
+		if err == nil {
+			if count, _ := res.RowsAffected(); count == 0 {
+				err = t.ErrNotFound
+			}
+		}
+		return err
+	}
+
+	// Case 2.1
+	res, err = tx.Exec("DELETE FROM credentials"+constraints+" AND (done=true OR retries=0)", args...)
+	if err != nil {
+		return err
+	}
+	if count, _ := res.RowsAffected(); count > 0 {
+		return nil
+	}
+
+	// Case 2.2
+	args = append([]any{t.TimeNow()}, args...)
+	res, err = tx.Exec("UPDATE credentials SET deletedat=?"+constraints, args...)
+	if err == nil {
+		if count, _ := res.RowsAffected(); count >= 0 {
+			err = t.ErrNotFound
+		}
+	}
+
+	return err
+}
+
+// CredDel deletes either credentials of the given user. If method is blank all
+// credentials are removed. If value is blank all credentials of the given the
+// method are removed.
+func (a *adapter) CredDel(uid t.Uid, method, value string) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = credDel(tx, uid, method, value)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CredConfirm marks given credential method as confirmed.
+func (a *adapter) CredConfirm(uid t.Uid, method string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.ExecContext(
+		ctx,
+		"UPDATE credentials SET updatedat=?,done=true,synthetic=method||':'||value "+
+			"WHERE userid=? AND method=? AND deletedat IS NULL AND done=false",
+		t.TimeNow(), store.DecodeUid(uid), method)
+	if err != nil {
+		if isDupe(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	if numrows, _ := res.RowsAffected(); numrows < 1 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// CredFail increments failure count of the given validation method.
+func (a *adapter) CredFail(uid t.Uid, method string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "UPDATE credentials SET updatedat=?,retries=retries+1 WHERE userid=? AND method=? AND done=false",
+		t.TimeNow(), store.DecodeUid(uid), method)
+	return err
+}
+
+// CredGetActive returns currently active unvalidated credential of the given user and method.
+func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var cred t.Credential
+	err := a.db.GetContext(ctx, &cred, "SELECT createdat,updatedat,method,value,resp,done,retries "+
+		"FROM credentials WHERE userid=? AND deletedat IS NULL AND method=? AND done=false",
+		store.DecodeUid(uid), method)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return nil, err
+	}
+	cred.User = uid.String()
+
+	return &cred, nil
+}
+
+// CredGetAll returns credential records for the given user and method, all or validated only.
+func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.Credential, error) {
+	query := "SELECT createdat,updatedat,method,value,resp,done,retries FROM credentials WHERE userid=? AND deletedat IS NULL"
+	args := []any{store.DecodeUid(uid)}
+	if method != "" {
+		query += " AND method=?"
+		args = append(args, method)
+	}
+	if validatedOnly {
+		query += " AND done=true"
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var credentials []t.Credential
+	err := a.db.SelectContext(ctx, &credentials, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	user := uid.String()
+	for i := range credentials {
+		credentials[i].User = user
+	}
+
+	return credentials, err
+}
+
+// FileUploads
+
+// FileStartUpload initializes a file upload
+func (a *adapter) FileStartUpload(fd *t.FileDef) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var user any
+	if fd.User != "" {
+		user = store.DecodeUid(t.ParseUid(fd.User))
+	} else {
+		user = 0
+	}
+	return a.inOutboxTx(ctx, func(db sqlx.ExecerContext) error {
+		_, err := db.ExecContext(ctx,
+			"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location) "+
+				"VALUES(?,?,?,?,?,?,?,?)",
+			store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
+			fd.Status, fd.MimeType, fd.Size, fd.Location)
+		return err
+	})
+}
+
+// FileFinishUpload marks file upload as completed, successfully or otherwise
+func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.FileDef, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	now := t.TimeNow()
+	if success {
+		_, err = tx.ExecContext(ctx, "UPDATE fileuploads SET updatedat=?,status=?,size=? WHERE id=?",
+			now, t.UploadCompleted, size, store.DecodeUid(fd.Uid()))
+		if err != nil {
+			return nil, err
+		}
+
+		fd.Status = t.UploadCompleted
+		fd.Size = size
+	} else {
+		// Deleting the record: there is no value in keeping it in the DB.
+		_, err = tx.ExecContext(ctx, "DELETE FROM fileuploads WHERE id=?", store.DecodeUid(fd.Uid()))
+		if err != nil {
+			return nil, err
+		}
+
+		fd.Status = t.UploadFailed
+		fd.Size = 0
+	}
+	fd.UpdatedAt = now
+
+	if err = a.outboxWrite(ctx, tx); err != nil {
+		return nil, err
+	}
+	return fd, tx.Commit()
+}
+
+// FileGet fetches a record of a specific file
+func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var fd t.FileDef
+	err := a.db.GetContext(ctx, &fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
+		"FROM fileuploads WHERE id=?", store.DecodeUid(id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fd.Id = encodeUidString(fd.Id).String()
+	fd.User = encodeUidString(fd.User).String()
+
+	return &fd, nil
+
+}
+
+// FileDeleteUnused deletes file upload records.
+func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Garbage collecting entries which as either marked as deleted, or lack message references, or have no user assigned.
+	query := "SELECT fu.id,fu.location FROM fileuploads AS fu LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id " +
+		"WHERE fml.id IS NULL"
+	var args []any
+	if !olderThan.IsZero() {
+		query += " AND fu.updatedat<?"
+		args = append(args, olderThan)
+	}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []string
+	var ids []any
+	for rows.Next() {
+		var id int
+		var loc string
+		if err = rows.Scan(&id, &loc); err != nil {
+			break
+		}
+		if loc != "" {
+			locations = append(locations, loc)
+		}
+		ids = append(ids, id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		query, ids, _ = sqlx.In("DELETE FROM fileuploads WHERE id IN (?)", ids)
+		_, err = tx.Exec(query, ids...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return locations, tx.Commit()
+}
+
+// FileLinkAttachments connects given topic or message to the file record IDs from the list.
+func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
+	if len(fids) == 0 || (topic == "" && msgId.IsZero() && userId.IsZero()) {
+		return t.ErrMalformed
+	}
+	now := t.TimeNow()
+
+	var args []any
+	var linkId any
+	var linkBy string
+	if !msgId.IsZero() {
+		linkBy = "msgid"
+		linkId = int64(msgId)
+	} else if topic != "" {
+		linkBy = "topic"
+		linkId = topic
+		// Only one attachment per topic is permitted at this time.
+		fids = fids[0:1]
+	} else {
+		linkBy = "userid"
+		linkId = store.DecodeUid(userId)
+		// Only one attachment per user is permitted at this time.
+		fids = fids[0:1]
+	}
+
+	// Decoded ids
+	var dids []any
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return t.ErrMalformed
+		}
+		dids = append(dids, store.DecodeUid(id))
+	}
+
+	for _, id := range dids {
+		// createdat,fileid,[msgid|topic|userid]
+		args = append(args, now, id, linkId)
+	}
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Unlink earlier uploads on the same topic or user allowing them to be garbage-collected.
+	if msgId.IsZero() {
+		sql := "DELETE FROM filemsglinks WHERE " + linkBy + "=?"
+		_, err = tx.Exec(sql, linkId)
+		if err != nil {
+			return err
+		}
+	}
+
+	sql := "INSERT INTO filemsglinks(createdat,fileid," + linkBy + ") VALUES (?,?,?)"
+	_, err = tx.Exec(sql+strings.Repeat(",(?,?,?)", len(dids)-1), args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FileRelinkMessages moves links of messages of the topic from one file to another.
+func (a *adapter) FileRelinkMessages(topic, oldFid, newFid string) error {
+	oldId, newId := t.ParseUid(oldFid), t.ParseUid(newFid)
+	if oldId.IsZero() || newId.IsZero() {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.ExecContext(ctx, "UPDATE filemsglinks SET fileid=? WHERE fileid=? AND "+
+		"msgid IN (SELECT id FROM messages WHERE topic=?)", store.DecodeUid(newId), store.DecodeUid(oldId), topic)
+	return err
+}
+
+// PCacheGet reads a persistet cache entry.
+func (a *adapter) PCacheGet(key string) (string, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var value string
+	if err := a.db.GetContext(ctx, &value, "SELECT `value` FROM kvmeta WHERE `key`=? LIMIT 1", key); err != nil {
+		if err == sql.ErrNoRows {
+			return "", t.ErrNotFound
+		}
+		return "", err
+	}
+	return value, nil
+}
+
+// PCacheUpsert creates or updates a persistent cache entry.
+func (a *adapter) PCacheUpsert(key string, value string, failOnDuplicate bool) error {
+	if strings.Contains(key, "%") {
+		// Do not allow % in keys: it interferes with LIKE query.
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var action string
+	if failOnDuplicate {
+		action = "INSERT"
+	} else {
+		action = "REPLACE"
+	}
+
+	_, err := a.db.ExecContext(ctx, action+" INTO kvmeta(`key`,createdat,`value`) VALUES(?,?,?)", key, t.TimeNow(), value)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// PCacheDelete deletes one persistent cache entry.
+func (a *adapter) PCacheDelete(key string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	_, err := a.db.ExecContext(ctx, "DELETE FROM kvmeta WHERE `key`=?", key)
+	return err
+}
+
+// PCacheExpire expires old entries with the given key prefix.
+func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
+	if keyPrefix == "" {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	_, err := a.db.ExecContext(ctx, "DELETE FROM kvmeta WHERE `key` LIKE ? AND createdat<?", keyPrefix+"%", olderThan)
+	return err
+}
+
+// WithOutbox returns a copy of the adapter which adds the events of the outbox to the outbox table in
+// the transaction of the next change.
+func (a *adapter) WithOutbox(outbox *adp.Outbox) adp.Adapter {
+	tx := *a
+	tx.outbox = outbox
+	return &tx
+}
+
+// OutboxAdd adds change events to the outbox table.
+func (a *adapter) OutboxAdd(entries []adp.OutboxEntry) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	return outboxInsert(ctx, a.db, entries)
+}
+
+// OutboxGet returns the oldest change events from the outbox table.
+func (a *adapter) OutboxGet(limit int) ([]adp.OutboxEntry, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT id,event FROM outbox ORDER BY id LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []adp.OutboxEntry
+	for rows.Next() {
+		var entry adp.OutboxEntry
+		if err = rows.Scan(&entry.Offset, &entry.Event); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// OutboxDelete deletes delivered change events from the outbox table.
+func (a *adapter) OutboxDelete(offsets []string) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query, args, _ := sqlx.In("DELETE FROM outbox WHERE id IN (?)", offsets)
+	_, err := a.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// outboxWrite adds pending change events to the outbox table in the transaction of the change.
+func (a *adapter) outboxWrite(ctx context.Context, tx sqlx.ExecerContext) error {
+	if a.outbox == nil || a.outbox.Written {
+		return nil
+	}
+	if err := outboxInsert(ctx, tx, a.outbox.Entries()); err != nil {
+		return err
+	}
+	a.outbox.Written = true
+	return nil
+}
+
+// inOutboxTx makes a change with a single statement. If change events are pending, the statement is
+// executed in a transaction which also adds the events to the outbox table.
+func (a *adapter) inOutboxTx(ctx context.Context, change func(db sqlx.ExecerContext) error) error {
+	if a.outbox == nil || a.outbox.Written {
+		return change(a.db)
+	}
+
+	tx, err := a.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = change(tx); err == nil {
+		err = a.outboxWrite(ctx, tx)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func outboxInsert(ctx context.Context, db sqlx.ExecerContext, entries []adp.OutboxEntry) error {
+	for _, entry := range entries {
+		if _, err := db.ExecContext(ctx, "INSERT INTO outbox(id,event) VALUES(?,?)", entry.Offset, entry.Event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Data export.
+
+// attachments loads IDs of files linked to the objects with the given IDs. The 'linkBy' is the
+// column which holds the object ID: msgid, topic or userid. The result is keyed by object ID.
+func (a *adapter) attachments(ctx context.Context, linkBy string, ids []any) (map[string]t.StringSlice, error) {
+	result := make(map[string]t.StringSlice)
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	q, args, _ := sqlx.In("SELECT "+linkBy+",fileid FROM filemsglinks WHERE "+linkBy+" IN (?) ORDER BY id", ids)
+	rows, err := a.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var linkId string
+		var fid int64
+		if err = rows.Scan(&linkId, &fid); err != nil {
+			return nil, err
+		}
+		result[linkId] = append(result[linkId], store.EncodeUid(fid).String())
+	}
+	return result, rows.Err()
+}
+
+// UserExport returns a page of users ordered by ID, including soft-deleted.
+func (a *adapter) UserExport(after t.Uid, limit int) ([]t.User, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT * FROM users WHERE id>? ORDER BY id LIMIT ?",
+		store.DecodeUid(after), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []t.User
+	var ids []any
+	for rows.Next() {
+		var user t.User
+		if err = rows.StructScan(&user); err != nil {
+			break
+		}
+		ids = append(ids, user.Id)
+		user.SetUid(encodeUidString(user.Id))
+		user.Public = fromJSON(user.Public)
+		user.Trusted = fromJSON(user.Trusted)
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "userid", ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		users[i].Attachments = attachments[strconv.FormatInt(store.DecodeUid(users[i].Uid()), 10)]
+	}
+	return users, nil
+}
+
+// AuthExport returns all authentication records of the user.
+func (a *adapter) AuthExport(uid t.Uid) ([]adp.AuthRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT scheme,uname,authlvl,secret,expires FROM auth WHERE userid=? ORDER BY id",
+		store.DecodeUid(uid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []adp.AuthRecord
+	for rows.Next() {
+		var rec adp.AuthRecord
+		var expires *time.Time
+		if err = rows.Scan(&rec.Scheme, &rec.Unique, &rec.AuthLvl, &rec.Secret, &expires); err != nil {
+			return nil, err
+		}
+		if expires != nil {
+			rec.Expires = *expires
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// TopicExport returns a page of topics ordered by name, including soft-deleted.
+func (a *adapter) TopicExport(after string, limit int) ([]t.Topic, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,trusted,tags,pinned,msgttl "+
+			"FROM topics WHERE name>? ORDER BY name LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []t.Topic
+	var names []any
+	for rows.Next() {
+		var tt t.Topic
+		if err = rows.StructScan(&tt); err != nil {
+			break
+		}
+		tt.Owner = encodeUidString(tt.Owner).String()
+		tt.Public = fromJSON(tt.Public)
+		tt.Trusted = fromJSON(tt.Trusted)
+		topics = append(topics, tt)
+		names = append(names, tt.Id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "topic", names)
+	if err != nil {
+		return nil, err
+	}
+	for i := range topics {
+		topics[i].Attachments = attachments[topics[i].Id]
+	}
+	return topics, nil
+}
+
+// MessageExport returns a page of messages of the topic ordered by seq ID.
+func (a *adapter) MessageExport(topic string, from t.Uid, after, limit int) ([]t.Message, error) {
+	if limit <= 0 {
+		limit = a.maxMessageResults
+	}
+
+	where := "topic=? AND seqid>? AND delid<=0"
+	args := []any{topic, after}
+	if !from.IsZero() {
+		where += " AND `from`=?"
+		args = append(args, store.DecodeUid(from))
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx,
+		"SELECT id,createdat,updatedat,deletedat,delid,seqid,topic,`from`,thread,head,content,COALESCE(plaintext,'') AS plaintext"+
+			" FROM messages WHERE "+where+" ORDER BY seqid LIMIT ?",
+		append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	var ids []any
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		ids = append(ids, msg.Id)
+		id, _ := strconv.ParseInt(msg.Id, 10, 64)
+		msg.SetUid(t.Uid(id))
+		msg.From = encodeUidString(msg.From).String()
+		msg.Content = fromJSON(msg.Content)
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := a.attachments(ctx, "msgid", ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		msgs[i].Attachments = attachments[strconv.FormatInt(int64(msgs[i].Uid()), 10)]
+	}
+	return msgs, nil
+}
+
+// FileExport returns a page of file records ordered by ID.
+func (a *adapter) FileExport(after string, limit int) ([]t.FileDef, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
+		"FROM fileuploads WHERE id>? ORDER BY id LIMIT ?", store.DecodeUid(t.ParseUid(after)), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []t.FileDef
+	for rows.Next() {
+		var fd t.FileDef
+		if err = rows.StructScan(&fd); err != nil {
+			return nil, err
+		}
+		fd.Id = encodeUidString(fd.Id).String()
+		fd.User = encodeUidString(fd.User).String()
+		files = append(files, fd)
+	}
+	return files, rows.Err()
+}
+
+// PCacheExport returns a page of persistent cache entries ordered by key.
+func (a *adapter) PCacheExport(after string, limit int) ([]adp.PCacheEntry, error) {
+	if limit <= 0 {
+		limit = a.maxResults
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.QueryxContext(ctx, "SELECT `key`,`value` FROM kvmeta WHERE `key`>? AND `key`!='version' ORDER BY `key` LIMIT ?",
+		after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []adp.PCacheEntry
+	for rows.Next() {
+		var entry adp.PCacheEntry
+		if err = rows.Scan(&entry.Key, &entry.Value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Helper functions
+
+// Check if SQLite error is a violation of a UNIQUE or PRIMARY KEY constraint.
+func isDupe(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	sqlerr, ok := err.(sqlite3.Error)
+	return ok && (sqlerr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqlerr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
+
+func isMissingTable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	sqlerr, ok := err.(sqlite3.Error)
+	return ok && sqlerr.Code == sqlite3.ErrError && strings.HasPrefix(sqlerr.Error(), "no such table")
+}
+
+// Escapes wildcard characters in LIKE patterns.
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+// Convert to JSON before storing to JSON field.
+func toJSON(src any) []byte {
+	if src == nil {
+		return nil
+	}
+
+	jval, _ := json.Marshal(src)
+	return jval
+}
+
+// Deserialize JSON data from DB.
+func fromJSON(src any) any {
+	if src == nil {
+		return nil
+	}
+	var bb []byte
+	switch src := src.(type) {
+	case []byte:
+		bb = src
+	case string:
+		bb = []byte(src)
+	default:
+		return nil
+	}
+	var out any
+	json.Unmarshal(bb, &out)
+	return out
+}
+
+// UIDs are stored as decoded int64 values. Take decoded string representation of int64, produce UID.
+func encodeUidString(str string) t.Uid {
+	unum, _ := strconv.ParseInt(str, 10, 64)
+	return store.EncodeUid(unum)
+}
+
+func decodeUidString(str string) int64 {
+	uid := t.ParseUid(str)
+	return store.DecodeUid(uid)
+}
+
+// Convert update to a list of columns and arguments.
+func updateByMap(update map[string]any) (cols []string, args []any) {
+	for col, arg := range update {
+		col = strings.ToLower(col)
+		if col == "public" || col == "trusted" || col == "private" {
+			arg = toJSON(arg)
+		}
+		cols = append(cols, col+"=?")
+		args = append(args, arg)
+	}
+	return
+}
+
+// If Tags field is updated, get the tags so tags table cab be updated too.
+func extractTags(update map[string]any) []string {
+	var tags []string
+
+	if val := update["Tags"]; val != nil {
+		tags, _ = val.(t.StringSlice)
+	}
+
+	return []string(tags)
+}
+
+func init() {
+	store.RegisterAdapter(&adapter{})
+}
@@ -0,0 +1,8 @@
+//go:build !sqlite
+// +build !sqlite
+
+// This file is needed for conditional compilation. It's used when
+// the build tag 'sqlite' is not defined. Otherwise the adapter.go
+// is compiled.
+
+package sqlite
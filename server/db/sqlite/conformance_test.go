@@ -0,0 +1,24 @@
+//go:build sqlite
+// +build sqlite
+
+package sqlite
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/db/adaptertest"
+)
+
+// Run with:
+//
+//	go test -tags sqlite ./db/sqlite/
+func TestConformance(t *testing.T) {
+	config, _ := json.Marshal(map[string]string{"database": filepath.Join(t.TempDir(), "conformance.db")})
+	adp, err := adaptertest.OpenStore(adapterName, config)
+	if err != nil {
+		t.Fatal("failed to open database:", err)
+	}
+	adaptertest.Run(t, adp)
+}
@@ -0,0 +1,307 @@
+-- THIS SCHEMA FILE IS FOR REFERENCE/DOCUMENTATION ONLY!
+-- DO NOT USE IT TO INITIALIZE THE DATABASE.
+-- Use tinode-db to create the database file. Read installation instructions first.
+
+-- Foreign keys must be enabled on every connection: PRAGMA foreign_keys=ON;
+
+CREATE TABLE users(
+	id        INTEGER NOT NULL PRIMARY KEY,
+	createdat DATETIME NOT NULL,
+	updatedat DATETIME NOT NULL,
+	state     SMALLINT NOT NULL DEFAULT 0,
+	stateat   DATETIME,
+	access    BLOB,
+	lastseen  DATETIME,
+	useragent VARCHAR(255) DEFAULT '',
+	public    BLOB,
+	trusted   BLOB,
+	tags      BLOB
+);
+
+CREATE INDEX users_state_stateat ON users(state, stateat);
+
+CREATE INDEX users_lastseen_updatedat ON users(lastseen, updatedat);
+
+-- Indexed user tags.
+CREATE TABLE usertags(
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	userid BIGINT NOT NULL,
+	tag    VARCHAR(96) NOT NULL,
+	FOREIGN KEY(userid) REFERENCES users(id)
+);
+
+CREATE INDEX usertags_tag ON usertags(tag);
+
+CREATE UNIQUE INDEX usertags_userid_tag ON usertags(userid, tag);
+
+-- Indexed devices. Normalized into a separate table.
+CREATE TABLE devices(
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	userid   BIGINT NOT NULL,
+	hash     CHAR(16) NOT NULL,
+	deviceid TEXT NOT NULL,
+	platform VARCHAR(32),
+	lastseen DATETIME NOT NULL,
+	lang     VARCHAR(8),
+	FOREIGN KEY(userid) REFERENCES users(id)
+);
+
+CREATE UNIQUE INDEX devices_hash ON devices(hash);
+
+-- Authentication records for the basic authentication scheme.
+CREATE TABLE auth(
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	uname   VARCHAR(32) NOT NULL,
+	userid  BIGINT NOT NULL,
+	scheme  VARCHAR(16) NOT NULL,
+	authlvl INT NOT NULL,
+	secret  VARCHAR(255) NOT NULL,
+	expires DATETIME,
+	FOREIGN KEY(userid) REFERENCES users(id)
+);
+
+CREATE UNIQUE INDEX auth_userid_scheme ON auth(userid, scheme);
+
+CREATE UNIQUE INDEX auth_uname ON auth(uname);
+
+-- Topics
+CREATE TABLE topics(
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	createdat DATETIME NOT NULL,
+	updatedat DATETIME NOT NULL,
+	state     SMALLINT NOT NULL DEFAULT 0,
+	stateat   DATETIME,
+	touchedat DATETIME,
+	name      CHAR(25) NOT NULL,
+	usebt     TINYINT DEFAULT 0,
+	owner     BIGINT NOT NULL DEFAULT 0,
+	access    BLOB,
+	seqid     INT NOT NULL DEFAULT 0,
+	delid     INT DEFAULT 0,
+	public    BLOB,
+	trusted   BLOB,
+	tags      BLOB,
+	pinned    BLOB,
+	msgttl    INT DEFAULT 0
+);
+
+CREATE UNIQUE INDEX topics_name ON topics(name);
+
+CREATE INDEX topics_owner ON topics(owner);
+
+CREATE INDEX topics_state_stateat ON topics(state, stateat);
+
+-- Indexed topic tags.
+CREATE TABLE topictags(
+	id    INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic CHAR(25) NOT NULL,
+	tag   VARCHAR(96) NOT NULL,
+	FOREIGN KEY(topic) REFERENCES topics(name)
+);
+
+CREATE INDEX topictags_tag ON topictags(tag);
+
+CREATE UNIQUE INDEX topictags_userid_tag ON topictags(topic, tag);
+
+-- Subscriptions
+CREATE TABLE subscriptions(
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	createdat DATETIME NOT NULL,
+	updatedat DATETIME NOT NULL,
+	deletedat DATETIME,
+	userid    BIGINT NOT NULL,
+	topic     CHAR(25) NOT NULL,
+	delid     INT DEFAULT 0,
+	recvseqid INT DEFAULT 0,
+	readseqid INT DEFAULT 0,
+	modewant  CHAR(8),
+	modegiven CHAR(8),
+	private   BLOB,
+	FOREIGN KEY(userid) REFERENCES users(id)
+);
+
+CREATE UNIQUE INDEX subscriptions_topic_userid ON subscriptions(topic, userid);
+
+CREATE INDEX subscriptions_topic ON subscriptions(topic);
+
+CREATE INDEX subscriptions_userid ON subscriptions(userid);
+
+CREATE INDEX subscriptions_deletedat ON subscriptions(deletedat);
+
+-- Messages. There is no full-text index: search falls back to a scan with LIKE.
+CREATE TABLE messages(
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	createdat DATETIME NOT NULL,
+	updatedat DATETIME NOT NULL,
+	deletedat DATETIME,
+	delid     INT DEFAULT 0,
+	seqid     INT NOT NULL,
+	topic     CHAR(25) NOT NULL,
+	`from`    BIGINT NOT NULL,
+	thread    INT NOT NULL DEFAULT 0,
+	head      BLOB,
+	content   BLOB,
+	plaintext TEXT,
+	FOREIGN KEY(topic) REFERENCES topics(name)
+);
+
+CREATE UNIQUE INDEX messages_topic_seqid ON messages(topic, seqid);
+
+CREATE INDEX messages_topic_thread_seqid ON messages(topic, thread, seqid);
+CREATE INDEX messages_topic_createdat ON messages(topic, createdat);
+
+-- Positions of users in threads.
+CREATE TABLE threadreads(
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic     CHAR(25) NOT NULL,
+	userid    BIGINT NOT NULL,
+	thread    INT NOT NULL,
+	readseqid INT NOT NULL,
+	FOREIGN KEY(topic) REFERENCES topics(name)
+);
+
+CREATE UNIQUE INDEX threadreads_topic_userid_thread ON threadreads(topic, userid, thread);
+
+CREATE INDEX threadreads_userid ON threadreads(userid);
+
+-- Earlier revisions of edited messages.
+CREATE TABLE msgrevisions(
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	createdat DATETIME NOT NULL,
+	msgid     INT NOT NULL,
+	seqid     INT NOT NULL,
+	topic     CHAR(25) NOT NULL,
+	head      BLOB,
+	content   BLOB,
+	FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+CREATE INDEX msgrevisions_topic_seqid ON msgrevisions(topic, seqid);
+
+CREATE INDEX msgrevisions_msgid ON msgrevisions(msgid);
+
+-- Reactions to messages, one per user per message.
+CREATE TABLE reactions(
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	createdat DATETIME NOT NULL,
+	topic     CHAR(25) NOT NULL,
+	seqid     INT NOT NULL,
+	userid    BIGINT NOT NULL,
+	value     VARCHAR(32) NOT NULL,
+	FOREIGN KEY(topic) REFERENCES topics(name)
+);
+
+CREATE UNIQUE INDEX reactions_topic_seqid_userid ON reactions(topic, seqid, userid);
+
+CREATE INDEX reactions_userid ON reactions(userid);
+
+-- Messages scheduled for delivery at a later time.
+CREATE TABLE schedmsgs(
+	id          INTEGER NOT NULL PRIMARY KEY,
+	createdat   DATETIME NOT NULL,
+	updatedat   DATETIME NOT NULL,
+	sendat      DATETIME NOT NULL,
+	topic       CHAR(25) NOT NULL,
+	userid      BIGINT NOT NULL,
+	head        BLOB,
+	content     BLOB,
+	attachments BLOB,
+	FOREIGN KEY(topic) REFERENCES topics(name)
+);
+
+CREATE INDEX schedmsgs_sendat ON schedmsgs(sendat);
+
+CREATE INDEX schedmsgs_topic_userid ON schedmsgs(topic, userid);
+
+CREATE INDEX schedmsgs_userid ON schedmsgs(userid);
+
+-- Deletion log
+CREATE TABLE dellog(
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	topic      CHAR(25) NOT NULL,
+	deletedfor BIGINT NOT NULL DEFAULT 0,
+	delid      INT NOT NULL,
+	low        INT NOT NULL,
+	hi         INT NOT NULL,
+	FOREIGN KEY(topic) REFERENCES topics(name)
+);
+
+CREATE INDEX dellog_topic_delid_deletedfor ON dellog(topic, delid, deletedfor);
+
+CREATE INDEX dellog_topic_deletedfor_low_hi ON dellog(topic, deletedfor, low, hi);
+
+CREATE INDEX dellog_deletedfor ON dellog(deletedfor);
+
+-- User credentials
+CREATE TABLE credentials(
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	createdat DATETIME NOT NULL,
+	updatedat DATETIME NOT NULL,
+	deletedat DATETIME,
+	method    VARCHAR(16) NOT NULL,
+	value     VARCHAR(128) NOT NULL,
+	synthetic VARCHAR(192) NOT NULL,
+	userid    BIGINT NOT NULL,
+	resp      VARCHAR(255),
+	done      TINYINT NOT NULL DEFAULT 0,
+	retries   INT NOT NULL DEFAULT 0,
+	FOREIGN KEY(userid) REFERENCES users(id)
+);
+
+CREATE UNIQUE INDEX credentials_uniqueness ON credentials(synthetic);
+
+-- Records of uploaded files.
+-- Don't add FOREIGN KEY on userid. It's not needed and it will break user deletion.
+-- Using INDEX rather than FK on topic because it's either 'topics' or 'users' reference.
+CREATE TABLE fileuploads(
+	id        INTEGER NOT NULL PRIMARY KEY,
+	createdat DATETIME NOT NULL,
+	updatedat DATETIME NOT NULL,
+	userid    BIGINT,
+	status    INT NOT NULL,
+	mimetype  VARCHAR(255) NOT NULL,
+	size      BIGINT NOT NULL,
+	location  VARCHAR(2048) NOT NULL
+);
+
+CREATE INDEX fileuploads_status ON fileuploads(status);
+
+-- Links between uploaded files and the topics, users or messages they are attached to.
+CREATE TABLE filemsglinks(
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	createdat DATETIME NOT NULL,
+	fileid    BIGINT NOT NULL,
+	msgid     INT,
+	topic     CHAR(25),
+	userid    BIGINT,
+	schedid   BIGINT,
+	FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+	FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY(topic) REFERENCES topics(name) ON DELETE CASCADE,
+	FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(schedid) REFERENCES schedmsgs(id) ON DELETE CASCADE
+);
+
+CREATE INDEX filemsglinks_fileid ON filemsglinks(fileid);
+
+CREATE INDEX filemsglinks_msgid ON filemsglinks(msgid);
+
+-- Change events which are not delivered yet, keyed by offset.
+CREATE TABLE outbox(
+	id    VARCHAR(64) NOT NULL PRIMARY KEY,
+	event TEXT NOT NULL
+);
+
+CREATE TABLE kvmeta(
+	`key`     VARCHAR(64) NOT NULL PRIMARY KEY,
+	createdat DATETIME,
+	`value`   TEXT
+);
+
+CREATE INDEX kvmeta_createdat_key ON kvmeta(createdat, `key`);
+
+INSERT INTO topics(createdat,updatedat,state,touchedat,name,access,public)
+	VALUES(datetime('now'),datetime('now'),0,datetime('now'),'sys',
+		CAST('{"Auth": "N","Anon": "N"}' AS BLOB),CAST('{"fn": "System"}' AS BLOB));
+
+INSERT INTO kvmeta(`key`, `value`) VALUES('version', '121');
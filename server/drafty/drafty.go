@@ -130,6 +130,22 @@ func PlainText(content any) (string, error) {
 	return strings.TrimSpace(string(state.txt)), nil
 }
 
+// Attachments returns references to out-of-band files (the 'ref' field of entities) in the drafty document.
+func Attachments(content any) []string {
+	doc, err := decodeAsDrafty(content)
+	if err != nil || doc == nil {
+		return nil
+	}
+
+	var refs []string
+	for i := range doc.Ent {
+		if ref, ok := doc.Ent[i].Data["ref"].(string); ok && ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
 // styleToSpan converts Drafty style to internal representation.
 func (s *span) styleToSpan(in *style) error {
 	s.tp = in.Tp
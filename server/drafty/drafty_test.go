@@ -181,3 +181,25 @@ func TestPreview(t *testing.T) {
 		}
 	}
 }
+
+func TestAttachments(t *testing.T) {
+	var val any
+	json.Unmarshal([]byte(`{
+		"txt":"Two files",
+		"ent":[
+			{"data":{"mime":"image/jpeg","name":"roses.jpg","ref":"/v0/file/s/sFmjlQ_kA6A.jpg"},"tp":"IM"},
+			{"data":{"url":"https://tinode.co"},"tp":"LN"},
+			{"data":{"mime":"text/plain","name":"notes.txt","ref":"/v0/file/s/1aGxNqoAQnY.txt"},"tp":"EX"}
+		],
+		"fmt":[{"at":-1,"key":0},{"len":3,"key":1},{"at":-1,"key":2}]
+	}`), &val)
+
+	refs := Attachments(val)
+	if len(refs) != 2 || refs[0] != "/v0/file/s/sFmjlQ_kA6A.jpg" || refs[1] != "/v0/file/s/1aGxNqoAQnY.txt" {
+		t.Errorf("Unexpected attachments %v", refs)
+	}
+
+	if refs := Attachments("Plain text"); refs != nil {
+		t.Errorf("Plain text must have no attachments, got %v", refs)
+	}
+}
@@ -0,0 +1,306 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Export of user's own data: the user record, credentials, subscriptions,
+ *    messages authored by the user and uploaded files are written to a zip
+ *    archive which the user downloads through the media handler.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/media"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+const (
+	// MIME type which marks uploaded files as archives of exported data. The archives are
+	// ordinary zip files.
+	exportMimeType = "application/x-tinode-export+zip"
+	// Number of messages to read from the database at once.
+	exportPageSize = 512
+)
+
+// Users with an export in progress. Only one export per user can run at a time.
+var exportsInProgress sync.Map
+
+// exportedUser is the content of user.json in the archive.
+type exportedUser struct {
+	User        *types.User      `json:"user"`
+	Credentials []*MsgCredServer `json:"credentials,omitempty"`
+}
+
+// replyGetExport starts export of the user's data. The response with the URL of
+// the archive is sent once the archive is ready.
+func (t *Topic) replyGetExport(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for data export")
+	}
+
+	mh := store.Store.GetMediaHandler()
+	if mh == nil {
+		sess.queueOut(ErrNotImplementedReply(msg, now))
+		return errors.New("media handler is not configured")
+	}
+
+	if _, busy := exportsInProgress.LoadOrStore(asUid, true); busy {
+		sess.queueOut(ErrLockedReply(msg, now))
+		return errors.New("data export already in progress")
+	}
+
+	id, topic, ts := msg.Id, t.original(asUid), msg.Timestamp
+	go func() {
+		defer exportsInProgress.Delete(asUid)
+
+		url, expires, err := exportUserData(mh, asUid)
+		now := types.TimeNow()
+		if err != nil {
+			logs.Warn.Println("data export failed", asUid, err)
+			sess.queueOut(decodeStoreErrorExplicitTs(err, id, topic, now, ts, nil))
+			return
+		}
+		sess.queueOut(NoErrParamsExplicitTs(id, topic, now, ts, map[string]string{
+			"what":    "export",
+			"url":     url,
+			"expires": expires.Format(types.TimeFormatRFC3339),
+		}))
+	}()
+
+	return nil
+}
+
+// exportUserData writes the archive of user's data and uploads it to the media handler.
+// Returns the URL of the archive and the time when it's going to be deleted.
+func exportUserData(mh media.Handler, uid types.Uid) (string, time.Time, error) {
+	tmp, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	if err = writeUserData(mh, tmp, uid); err != nil {
+		return "", time.Time{}, err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return "", time.Time{}, err
+	}
+
+	fdef := &types.FileDef{
+		ObjHeader: types.ObjHeader{
+			Id: store.Store.GetUidString(),
+		},
+		User:     uid.String(),
+		MimeType: exportMimeType,
+	}
+	fdef.InitTimes()
+
+	// The archive is never attached to anything, so it's deleted by the garbage collector.
+	expires := exportExpires(fdef)
+
+	url, size, err := mh.Upload(fdef, tmp)
+	if err != nil {
+		store.Files.FinishUpload(fdef, false, 0)
+		return "", time.Time{}, err
+	}
+
+	if _, err = store.Files.FinishUpload(fdef, true, size); err != nil {
+		// Best effort cleanup.
+		mh.Delete([]string{fdef.Location})
+		return "", time.Time{}, err
+	}
+
+	logs.Info.Println("data export: ok", uid, fdef.Id, size)
+	return url, expires, nil
+}
+
+// writeUserData writes user's data to a zip archive.
+func writeUserData(mh media.Handler, w io.Writer, uid types.Uid) error {
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return types.ErrUserNotFound
+	}
+
+	screds, err := store.Users.GetAllCreds(uid, "", false)
+	if err != nil {
+		return err
+	}
+	var creds []*MsgCredServer
+	for _, sc := range screds {
+		creds = append(creds, &MsgCredServer{Method: sc.Method, Value: sc.Value, Done: sc.Done})
+	}
+
+	subs, err := store.Users.GetTopics(uid, nil)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+
+	if err = writeZipJSON(zw, "user.json", &exportedUser{User: user, Credentials: creds}); err != nil {
+		return err
+	}
+	if err = writeZipJSON(zw, "subscriptions.json", subs); err != nil {
+		return err
+	}
+
+	// Files uploaded by the user: the avatar and attachments to messages.
+	var fids []string
+	if fid := avatarFileId(mh, user.Public); !fid.IsZero() {
+		fids = append(fids, fid.String())
+	}
+
+	// Messages are written one per line.
+	out, err := zw.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	seen := make(map[string]bool)
+	for _, sub := range subs {
+		topic := sub.Topic
+		if strings.HasPrefix(topic, "usr") {
+			topic = uid.P2PName(types.ParseUserId(topic))
+		}
+		if seen[topic] || !(strings.HasPrefix(topic, "grp") || strings.HasPrefix(topic, "p2p")) {
+			continue
+		}
+		seen[topic] = true
+
+		for after := 0; ; {
+			msgs, err := store.Messages.Export(topic, uid, after, exportPageSize)
+			if err != nil {
+				return err
+			}
+			for i := range msgs {
+				if err = enc.Encode(&msgs[i]); err != nil {
+					return err
+				}
+				fids = append(fids, msgs[i].Attachments...)
+			}
+			if len(msgs) < exportPageSize {
+				break
+			}
+			after = msgs[len(msgs)-1].SeqId
+		}
+	}
+
+	var files []*types.FileDef
+	seen = make(map[string]bool)
+	for _, fid := range fids {
+		if seen[fid] {
+			continue
+		}
+		seen[fid] = true
+
+		fd, err := store.Files.Get(fid)
+		if err != nil {
+			return err
+		}
+		if fd == nil || fd.User != uid.String() || fd.Status != types.UploadCompleted {
+			// Attachments uploaded by someone else or not uploaded at all.
+			continue
+		}
+		if err = writeZipFile(zw, mh, fd); err != nil {
+			// Keep the file record even if the content is not available, e.g. the handler cannot download.
+			logs.Warn.Println("data export: file content skipped", fid, err)
+		}
+		// Location is internal.
+		fd.Location = ""
+		files = append(files, fd)
+	}
+	if err = writeZipJSON(zw, "files.json", files); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// writeZipJSON writes a single JSON document to the archive.
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	out, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(out).Encode(v)
+}
+
+// writeZipFile copies content of an uploaded file to the archive as files/<id><.ext>.
+func writeZipFile(zw *zip.Writer, mh media.Handler, fd *types.FileDef) error {
+	_, rsc, err := mh.Download(fd.Id)
+	if err != nil {
+		return err
+	}
+	defer rsc.Close()
+
+	name := "files/" + fd.Id
+	if ext, _ := mime.ExtensionsByType(fd.MimeType); len(ext) > 0 {
+		name += ext[0]
+	}
+	out, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, rsc)
+	return err
+}
+
+// avatarFileId extracts ID of the uploaded avatar from user's public data.
+func avatarFileId(mh media.Handler, public any) types.Uid {
+	pub, _ := public.(map[string]any)
+	photo, _ := pub["photo"].(map[string]any)
+	if ref, _ := photo["ref"].(string); ref != "" {
+		return mh.GetIdFromUrl(ref)
+	}
+	return types.ZeroUid
+}
+
+// exportExpires returns the time when the archive of exported data stops being available.
+func exportExpires(fd *types.FileDef) time.Time {
+	return fd.CreatedAt.Add(unusedFileLifetime)
+}
+
+// checkExportAccess checks if the user is allowed to download the file. Archives of exported
+// data can be downloaded by their owners only and only until they expire, even if the garbage
+// collector has not deleted them yet. Other files are not restricted.
+func checkExportAccess(fid, uid types.Uid, now time.Time) error {
+	if fid.IsZero() {
+		return nil
+	}
+
+	fd, err := store.Files.Get(fid.String())
+	if err != nil {
+		return err
+	}
+	if fd == nil || fd.MimeType != exportMimeType {
+		// Missing files are reported by the media handler.
+		return nil
+	}
+	if fd.User != uid.String() || !now.Before(exportExpires(fd)) {
+		// Don't disclose existence of the file.
+		return types.ErrNotFound
+	}
+	return nil
+}
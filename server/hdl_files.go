@@ -30,6 +30,9 @@ import (
 // See https://www.iana.org/assignments/media-types/media-types.xhtml
 var allowedMimeTypes = []string{"application/", "audio/", "font/", "image/", "text/", "video/"}
 
+// Uploaded files which are not attached to anything are garbage-collected after this period.
+const unusedFileLifetime = time.Hour
+
 func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 	now := types.TimeNow()
 	enc := json.NewEncoder(wrt)
@@ -96,6 +99,12 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Archives of exported user data are available to their owners only.
+	if err = checkExportAccess(mh.GetIdFromUrl(req.URL.String()), uid, now); err != nil {
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
 	// Check if media handler redirects or adds headers.
 	headers, statusCode, err := mh.Headers(req, true)
 	if err != nil {
@@ -355,7 +364,7 @@ func largeFileRunGarbageCollection(period time.Duration, blockSize int) chan<- b
 		for {
 			select {
 			case <-gcTicker:
-				if err := store.Files.DeleteUnused(time.Now().Add(-time.Hour), blockSize); err != nil {
+				if err := store.Files.DeleteUnused(time.Now().Add(-unusedFileLifetime), blockSize); err != nil {
 					logs.Warn.Println("media gc:", err)
 				}
 			case <-stop:
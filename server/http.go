@@ -361,10 +361,16 @@ func authHttpRequest(req *http.Request) (types.Uid, []byte, error) {
 		}
 
 		if authhdl := store.Store.GetLogicalAuthHandler(authMethod); authhdl != nil {
-			rec, challenge, err := authhdl.Authenticate(decodedSecret[:n], getRemoteAddr(req))
+			rec, challenge, _, err := globals.loginLimiter.authenticate(authhdl, decodedSecret[:n], getRemoteAddr(req))
 			if err != nil {
 				return uid, nil, err
 			}
+			if challenge == nil {
+				// Users enrolled in the second factor must pass it here too, like in the websocket login.
+				if challenge, err = secondFactorChallenge(authMethod, rec); err != nil {
+					return uid, nil, err
+				}
+			}
 			if challenge != nil {
 				return uid, challenge, nil
 			}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/auth/mock_auth"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/mock_store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// testAPIKey sets the API key salt for the duration of the test and returns a valid key.
+func testAPIKey(t *testing.T) string {
+	realSalt := globals.apiKeySalt
+	globals.apiKeySalt = []byte("test-api-key-salt")
+	t.Cleanup(func() { globals.apiKeySalt = realSalt })
+
+	data := make([]byte, apikeyLength)
+	data[0] = 1
+	signed := apikeyVersion + apikeyAppID + apikeySequence + apikeyWho
+	hasher := hmac.New(md5.New, globals.apiKeySalt)
+	hasher.Write(data[:signed])
+	copy(data[signed:], hasher.Sum(nil))
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+// Users enrolled in the second factor cannot download files with just the password. Token logins
+// have passed the second factor already.
+func TestLargeFileServeSecondFactor(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	basic := mock_auth.NewMockAuthHandler(ctrl)
+	token := mock_auth.NewMockAuthHandler(ctrl)
+	totp := mock_auth.NewMockAuthHandler(ctrl)
+
+	realStore, realSecondFactor := store.Store, globals.secondFactor
+	store.Store = ss
+	globals.secondFactor = totp
+	defer func() {
+		store.Store = realStore
+		globals.secondFactor = realSecondFactor
+		ctrl.Finish()
+	}()
+
+	uid := types.Uid(1)
+	rec := &auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth}
+	password := []byte("alice:alice123")
+	ss.EXPECT().GetMediaHandler().Return(nil)
+	ss.EXPECT().GetLogicalAuthHandler("basic").Return(basic).AnyTimes()
+	basic.EXPECT().Authenticate(password, gomock.Any()).Return(rec, nil, nil)
+	totp.EXPECT().GenSecret(rec).Return([]byte("<==challenge==>"), time.Now().Add(time.Minute), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/v0/file/s/abcdef.png", nil)
+	req.Header.Set("X-Tinode-APIKey", testAPIKey(t))
+	req.Header.Set("X-Tinode-Auth", "basic "+base64.StdEncoding.EncodeToString(password))
+	wrt := httptest.NewRecorder()
+	largeFileServe(wrt, req)
+
+	var resp ServerComMessage
+	if err := json.NewDecoder(wrt.Body).Decode(&resp); err != nil || resp.Ctrl == nil {
+		t.Fatal("Invalid response:", wrt.Body.String(), err)
+	}
+	if wrt.Code != http.StatusMultipleChoices || resp.Ctrl.Text != "challenge" {
+		t.Error("Download with the password only: expected challenge, got", wrt.Code, resp.Ctrl.Text)
+	}
+
+	ss.EXPECT().GetLogicalAuthHandler("token").Return(token).AnyTimes()
+	token.EXPECT().Authenticate([]byte("<==auth-token==>"), gomock.Any()).Return(rec, nil, nil)
+	req = httptest.NewRequest(http.MethodGet, "/v0/file/s/abcdef.png", nil)
+	req.Header.Set("X-Tinode-Auth", "token "+base64.StdEncoding.EncodeToString([]byte("<==auth-token==>")))
+	if got, challenge, err := authHttpRequest(req); got != uid || challenge != nil || err != nil {
+		t.Error("Token authentication:", got, challenge, err)
+	}
+}
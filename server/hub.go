@@ -10,6 +10,7 @@
 package main
 
 import (
+	"math/rand"
 	"strings"
 	"sync"
 	"time"
@@ -198,6 +199,26 @@ func (h *Hub) run() {
 				go topicInit(t, join, h)
 			} else {
 				// Topic found.
+				if join.Pub != nil {
+					// A scheduled message is due. Topic will check if it can be published.
+					select {
+					case t.clientMsg <- join:
+					default:
+						// The message will be retried on the next pass of the scheduler.
+						logs.Err.Println("hub.join loop: topic's broadcast queue full", join.RcptTo)
+					}
+					continue
+				}
+				if join.expired {
+					// Some messages have outlived the topic's message TTL.
+					select {
+					case t.meta <- join:
+					default:
+						// The messages will be deleted on the next pass of the garbage collector.
+						logs.Err.Println("hub.join loop: topic's meta queue full", join.RcptTo)
+					}
+					continue
+				}
 				if t.isInactive() {
 					// Topic is either not ready or being deleted.
 					if join.sess.inflightReqs != nil {
@@ -863,3 +884,259 @@ func replyOfflineTopicSetSub(sess *Session, msg *ClientComMessage) {
 		sess.queueOut(InfoNotModifiedReply(msg, now))
 	}
 }
+
+// runScheduler periodically publishes scheduled messages which are due, up to 'blockSize' messages per pass.
+// Returns channel which can be used to stop the process.
+func (h *Hub) runScheduler(period time.Duration, blockSize int) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the scheduler must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.publishScheduled(blockSize)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// publishScheduled sends due scheduled messages to their topics, loading the topics if necessary.
+// Messages are published by the master node of the topic only: each node reads messages to its own topics,
+// so messages waiting for other nodes don't hold them back. The topic claims the message before publishing it,
+// so the message is published once even if it's sent more than once.
+func (h *Hub) publishScheduled(limit int) {
+	msgs, err := store.Messages.GetScheduledDue(types.TimeNow(), func(topic string) bool {
+		return !globals.cluster.isRemoteTopic(topic)
+	}, limit)
+	if err != nil {
+		logs.Warn.Println("hub: failed to read scheduled messages:", err)
+		return
+	}
+
+	for i := range msgs {
+		sm := &msgs[i]
+		msg := &ClientComMessage{
+			Pub: &MsgClientPub{
+				Topic:   sm.Topic,
+				Head:    sm.Head,
+				Content: sm.Content,
+			},
+			Original:  sm.Topic,
+			RcptTo:    sm.Topic,
+			AsUser:    types.ParseUid(sm.From).UserId(),
+			AuthLvl:   int(auth.LevelAuth),
+			Timestamp: types.TimeNow(),
+			sched:     sm.Uid(),
+		}
+		if len(sm.Attachments) > 0 {
+			// File IDs are accepted in place of attachment URLs.
+			msg.Extra = &MsgClientExtra{Attachments: sm.Attachments}
+		}
+
+		select {
+		case h.join <- msg:
+		default:
+			// Hub is busy. Remaining messages will be published on the next pass.
+			logs.Warn.Println("hub: join queue full, scheduled messages postponed")
+			return
+		}
+	}
+}
+
+// runMessageGc runs every 'period' and deletes messages which have outlived the message TTL of their topics
+// in up to 'blockSize' topics. Returns channel which can be used to stop the process.
+func (h *Hub) runMessageGc(period time.Duration, blockSize int) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the gc must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes:
+		// 0.75 * period + rand(0, 0.5) * period.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		gcTicker := time.NewTicker(period)
+		defer gcTicker.Stop()
+		logs.Info.Printf("Expired message GC started with period %s, block size %d",
+			period.Round(time.Second), blockSize)
+		for {
+			select {
+			case <-gcTicker.C:
+				h.deleteExpired(blockSize)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// deleteExpired asks topics to hard-delete messages which have outlived the topic's message TTL, loading
+// the topics if necessary. The topic deletes the messages as if it were a {del} request, so subscribers are
+// notified and attachments are released as usual. Messages are deleted by the master node of the topic only:
+// each node checks its own topics, so topics of other nodes don't hold them back.
+func (h *Hub) deleteExpired(limit int) {
+	expired, err := store.Messages.GetExpired(types.TimeNow(), func(topic string) bool {
+		return !globals.cluster.isRemoteTopic(topic)
+	}, limit)
+	if err != nil {
+		logs.Warn.Println("Expired message GC error:", err)
+		return
+	}
+
+	for topic, rng := range expired {
+		msg := &ClientComMessage{
+			Del: &MsgClientDel{
+				Topic:  topic,
+				What:   "msg",
+				DelSeq: []MsgDelRange{{LowId: rng.Low, HiId: rng.Hi}},
+				Hard:   true,
+			},
+			Original:  topic,
+			RcptTo:    topic,
+			AuthLvl:   int(auth.LevelRoot),
+			MetaWhat:  constMsgDelMsg,
+			Timestamp: types.TimeNow(),
+			expired:   true,
+		}
+
+		select {
+		case h.join <- msg:
+		default:
+			// Hub is busy. Remaining messages will be deleted on the next pass.
+			logs.Warn.Println("hub: join queue full, deletion of expired messages postponed")
+			return
+		}
+	}
+}
+
+// runLoginGc runs every 'period' and deletes records of logins with expired tokens. Returns channel which
+// can be used to stop the process.
+func (h *Hub) runLoginGc(period time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the gc must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes:
+		// 0.75 * period + rand(0, 0.5) * period.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		gcTicker := time.NewTicker(period)
+		defer gcTicker.Stop()
+		logs.Info.Printf("Expired login GC started with period %s", period.Round(time.Second))
+		for {
+			select {
+			case <-gcTicker.C:
+				if err := store.Logins.Expire(time.Now()); err != nil {
+					logs.Warn.Println("Expired login GC error:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// runMessageArchiver runs every 'period' and moves messages older than 'olderThan' to archive segments of
+// 'segmentSize' messages in up to 'blockSize' topics. Returns channel which can be used to stop the process.
+func (h *Hub) runMessageArchiver(period time.Duration, blockSize int, olderThan time.Duration, segmentSize int) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the archiver must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes:
+		// 0.75 * period + rand(0, 0.5) * period.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Message archiver started with period %s, block size %d, segment size %d",
+			period.Round(time.Second), blockSize, segmentSize)
+		// Name of the last checked topic. Topics are checked in a loop.
+		var after string
+		for {
+			select {
+			case <-ticker.C:
+				after = archiveMessages(after, blockSize, types.TimeNow().Add(-olderThan), segmentSize)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// runChangeDelivery runs every 'period' and delivers recorded changes to the sink in blocks of 'blockSize'
+// events. Returns channel which can be used to stop the process.
+func (h *Hub) runChangeDelivery(period time.Duration, blockSize int) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the delivery must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Delivery of changes started with period %s, block size %d",
+			period.Round(time.Second), blockSize)
+		for {
+			select {
+			case <-ticker.C:
+				// Changes are delivered by one node in the cluster so they are delivered in order.
+				if globals.cluster.isRemoteTopic(changeDeliveryKey) {
+					continue
+				}
+				for {
+					count, err := store.Changes.Deliver(blockSize)
+					if err != nil {
+						logs.Warn.Println("Failed to deliver changes:", err)
+					}
+					if count < blockSize {
+						break
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// archiveMessages archives old messages in up to 'limit' topics following the topic 'after'. Messages are
+// archived by the master node of the topic only. Topics with message TTL are skipped: their messages are
+// deleted instead. Returns the name of the last checked topic or an empty string when all topics are checked.
+func archiveMessages(after string, limit int, olderThan time.Time, segmentSize int) string {
+	topics, err := store.Topics.Export(after, limit)
+	if err != nil {
+		logs.Warn.Println("Message archiver error:", err)
+		return after
+	}
+
+	for i := range topics {
+		topic := &topics[i]
+		if topic.State == types.StateDeleted || topic.MsgTTL > 0 || topic.SeqId < segmentSize ||
+			globals.cluster.isRemoteTopic(topic.Id) {
+			continue
+		}
+		for {
+			count, err := store.Messages.Archive(topic.Id, olderThan, segmentSize)
+			if err != nil {
+				logs.Warn.Printf("topic[%s]: failed to archive messages: %v", topic.Id, err)
+			}
+			if count == 0 {
+				break
+			}
+			// The loaded topic must read the archive from now on.
+			if t := globals.hub.topicGet(topic.Id); t != nil {
+				t.archived.Store(true)
+			}
+		}
+	}
+
+	if len(topics) < limit {
+		return ""
+	}
+	return topics[len(topics)-1].Id
+}
@@ -65,6 +65,11 @@ func topicInit(t *Topic, join *ClientComMessage, h *Hub) {
 		logs.Err.Println("init_topic: failed to load or create topic:", join.RcptTo, err)
 		join.sess.queueOut(decodeStoreErrorExplicitTs(err, join.Id, t.xoriginal, timestamp, join.Timestamp, nil))
 
+		if !join.sched.IsZero() && (err == types.ErrTopicNotFound || err == types.ErrNotFound) {
+			// The topic of the scheduled message is gone. Drop the message.
+			store.Messages.DeleteScheduled(join.sched, types.ZeroUid)
+		}
+
 		// Re-queue pending requests to join the topic.
 		for len(t.reg) > 0 {
 			h.join <- (<-t.reg)
@@ -102,6 +107,14 @@ func topicInit(t *Topic, join *ClientComMessage, h *Hub) {
 
 	t.computePerUserAcsUnion()
 
+	if t.cat == types.TopicCatP2P || t.cat == types.TopicCatGrp {
+		// The flag could have been set by the archiver already, don't clear it. If the archive
+		// cannot be checked, check it on every read.
+		if archived, err := store.Messages.HasArchive(t.name); archived || err != nil {
+			t.archived.Store(true)
+		}
+	}
+
 	// prevent newly initialized topics to go live while shutdown in progress
 	if globals.shuttingDown {
 		h.topicDel(join.RcptTo)
@@ -121,6 +134,12 @@ func topicInit(t *Topic, join *ClientComMessage, h *Hub) {
 	if join.Sub != nil {
 		subscribeReqIssued = true
 		t.reg <- join
+	} else if join.Pub != nil {
+		// The topic was loaded to publish a scheduled message.
+		t.clientMsg <- join
+	} else if join.Del != nil {
+		// The topic was loaded to delete expired messages.
+		t.meta <- join
 	}
 
 	t.markPaused(false)
@@ -261,6 +280,7 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 		}
 		t.lastID = stopic.SeqId
 		t.delID = stopic.DelId
+		t.msgTTL = stopic.MsgTTL
 	}
 
 	// t.owner is blank for p2p topics
@@ -273,6 +293,12 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 
 	// t.public and t.trusted are not used for p2p topics since each user get a different public/trusted.
 
+	if pktsub == nil && (stopic == nil || len(subs) != 2) {
+		// The topic is being loaded without a subscription request, e.g. to publish a scheduled message.
+		// Such a request cannot create the topic or subscriptions.
+		return types.ErrNotFound
+	}
+
 	if stopic != nil && len(subs) == 2 {
 		// Case 4.
 		for i := 0; i < 2; i++ {
@@ -648,6 +674,8 @@ func initTopicGrp(t *Topic) error {
 
 	t.public = stopic.Public
 	t.trusted = stopic.Trusted
+	t.pinned = stopic.Pinned
+	t.msgTTL = stopic.MsgTTL
 
 	t.created = stopic.CreatedAt
 	t.updated = stopic.UpdatedAt
@@ -0,0 +1,279 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Throttling of failed login attempts: per-account and per-IP failure counters
+ *    with exponentially growing lockouts.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+const (
+	// Prefix of persistent cache keys of failure counters.
+	loginFailPrefix = "loginfail:"
+	// Keys of per-account counters: <prefix>u:<uid>.
+	loginFailUserPrefix = loginFailPrefix + "u:"
+	// Keys of per-IP counters: <prefix>ip:<address>.
+	loginFailIPPrefix = loginFailPrefix + "ip:"
+)
+
+// lockoutSchemes are real names of authenticators which check secrets entered by the user. Only logins
+// by these schemes are rejected when the account is locked and count towards locking it. A token must
+// not be rejected: otherwise anyone could log out the owner of the account by guessing the password.
+var lockoutSchemes = map[string]bool{"basic": true, "code": true, "totp": true}
+
+// loginLimiter counts failed logins per account and per IP address. Counters are kept in
+// the persistent cache, so they are shared by all nodes of a cluster.
+//
+// The persistent cache has no atomic increment. Counters are updated under a lock, so failures on one
+// node are all counted, but concurrent updates from different nodes may overwrite each other. Then some
+// failures are lost and the lockout starts a few attempts later than configured.
+type loginLimiter struct {
+	mu sync.Mutex
+
+	accountFailures int
+	ipFailures      int
+	lockout         time.Duration
+	maxLockout      time.Duration
+	resetAfter      time.Duration
+}
+
+// loginFailures is a failure counter saved in the persistent cache.
+type loginFailures struct {
+	// Number of failures since the counter was reset.
+	Count int `json:"n"`
+	// Time of the latest failure.
+	Last time.Time `json:"last"`
+	// Logins are rejected until this time.
+	Until time.Time `json:"until"`
+}
+
+func newLoginLimiter(conf *loginLimitConfig) *loginLimiter {
+	if conf.AccountFailures <= 0 || conf.IPFailures <= 0 || conf.Lockout <= 0 ||
+		conf.MaxLockout < conf.Lockout || conf.ResetAfter <= 0 {
+		logs.Err.Fatalln("Invalid login rate limiter config")
+	}
+	return &loginLimiter{
+		accountFailures: conf.AccountFailures,
+		ipFailures:      conf.IPFailures,
+		lockout:         time.Duration(conf.Lockout) * time.Second,
+		maxLockout:      time.Duration(conf.MaxLockout) * time.Second,
+		resetAfter:      time.Duration(conf.ResetAfter) * time.Second,
+	}
+}
+
+// remoteHost strips the port from the address of the client.
+func remoteHost(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// authenticate calls the authenticator unless logins from the address are blocked, then counts
+// the failure or rejects the login if the account is blocked. The counter of the account is not reset
+// here: the login may require the second factor, see succeeded. The limiter may be nil: then the
+// authenticator is called directly.
+// Returns auth record, challenge, remaining lockout time, error. The error is ErrTooManyAttempts
+// if the login is blocked.
+func (ll *loginLimiter) authenticate(hdl auth.AuthHandler, secret []byte, remoteAddr string) (*auth.Rec,
+	[]byte, time.Duration, error) {
+	if ll == nil {
+		rec, challenge, err := hdl.Authenticate(secret, remoteAddr)
+		return rec, challenge, 0, err
+	}
+
+	host := remoteHost(remoteAddr)
+	if host != "" {
+		failures, err := ll.get(loginFailIPPrefix + host)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if left := failures.lockedFor(); left > 0 {
+			return nil, nil, left, types.ErrTooManyAttempts
+		}
+	}
+
+	rec, challenge, err := hdl.Authenticate(secret, remoteAddr)
+	if rec == nil || rec.Uid.IsZero() || !lockoutSchemes[hdl.GetRealName()] {
+		if err == types.ErrFailed {
+			ll.failed(types.ZeroUid, host)
+		}
+		return rec, challenge, 0, err
+	}
+
+	// The account is known. Logins to a blocked account are rejected even if the secret is valid.
+	key := loginFailUserPrefix + rec.Uid.String()
+	failures, ferr := ll.get(key)
+	if ferr != nil {
+		return nil, nil, 0, ferr
+	}
+	if left := failures.lockedFor(); left > 0 {
+		return nil, nil, left, types.ErrTooManyAttempts
+	}
+
+	if err == types.ErrFailed {
+		ll.failed(rec.Uid, host)
+	}
+	return rec, challenge, 0, err
+}
+
+// succeeded resets the counter of the account when the login is completed, i.e. after the second
+// factor if one is required. The limiter may be nil.
+func (ll *loginLimiter) succeeded(hdl auth.AuthHandler, uid types.Uid) {
+	if ll == nil || !lockoutSchemes[hdl.GetRealName()] {
+		return
+	}
+	if _, err := ll.unlock(uid); err != nil {
+		logs.Warn.Println("login limiter: failed to reset counter", uid, err)
+	}
+}
+
+// failed counts a failed login from the given host, to the given account if uid is not zero.
+// The user is notified when the account gets locked.
+func (ll *loginLimiter) failed(uid types.Uid, host string) {
+	if host != "" {
+		if _, err := ll.count(loginFailIPPrefix+host, ll.ipFailures); err != nil {
+			logs.Warn.Println("login limiter: failed to count failure", host, err)
+		}
+	}
+	if uid.IsZero() {
+		return
+	}
+
+	failures, err := ll.count(loginFailUserPrefix+uid.String(), ll.accountFailures)
+	if err != nil {
+		logs.Warn.Println("login limiter: failed to count failure", uid, err)
+		return
+	}
+	if failures.Count == ll.accountFailures {
+		// The account is locked for the first time since the counter was reset.
+		logs.Info.Println("login limiter: account locked", uid, host)
+		go notifyUserLockout(uid, failures.Until)
+	}
+}
+
+// unlock resets the counter of the account. Returns true if the account was locked.
+func (ll *loginLimiter) unlock(uid types.Uid) (bool, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	key := loginFailUserPrefix + uid.String()
+	failures, err := ll.get(key)
+	if err != nil || failures == nil {
+		return false, err
+	}
+	if err = store.PCache.Delete(key); err != nil && err != types.ErrNotFound {
+		return false, err
+	}
+	return failures.lockedFor() > 0, nil
+}
+
+// get reads the counter. Returns nil if the counter does not exist or has been reset.
+func (ll *loginLimiter) get(key string) (*loginFailures, error) {
+	val, err := store.PCache.Get(key)
+	if err == types.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var failures loginFailures
+	if err = json.Unmarshal([]byte(val), &failures); err != nil {
+		// Corrupted counter, treat as missing.
+		return nil, nil
+	}
+
+	// The counter is reset when the last failure or lockout is old enough.
+	last := failures.Last
+	if failures.Until.After(last) {
+		last = failures.Until
+	}
+	if time.Since(last) > ll.resetAfter {
+		return nil, nil
+	}
+	return &failures, nil
+}
+
+// lockedFor returns the remaining time of the lockout or 0 if logins are not blocked.
+func (failures *loginFailures) lockedFor() time.Duration {
+	if failures == nil {
+		return 0
+	}
+	if left := time.Until(failures.Until); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// count increments the counter and locks the key once the number of failures reaches the limit.
+// The lockout duration doubles with each following failure.
+func (ll *loginLimiter) count(key string, limit int) (*loginFailures, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	failures, err := ll.get(key)
+	if err != nil {
+		return nil, err
+	}
+	// Not rounded: the lockout must not end later than configured.
+	now := time.Now().UTC()
+	if failures == nil {
+		failures = &loginFailures{}
+		// Remove stale counters once in a while.
+		store.PCache.Expire(loginFailPrefix, now.Add(-ll.resetAfter-ll.maxLockout))
+	}
+
+	failures.Count++
+	failures.Last = now
+	if failures.Count >= limit {
+		lockout := ll.lockout
+		for i := limit; i < failures.Count && lockout < ll.maxLockout; i++ {
+			lockout *= 2
+		}
+		if lockout > ll.maxLockout {
+			lockout = ll.maxLockout
+		}
+		failures.Until = now.Add(lockout)
+	}
+
+	val, err := json.Marshal(failures)
+	if err != nil {
+		return nil, err
+	}
+	return failures, store.PCache.Upsert(key, string(val), false)
+}
+
+// notifyUserLockout informs the user that the account is locked using validators of user's
+// confirmed credentials, such as email.
+func notifyUserLockout(uid types.Uid, until time.Time) {
+	creds, err := store.Users.GetAllCreds(uid, "", true)
+	if err != nil {
+		logs.Warn.Println("login limiter: failed to read credentials", uid, err)
+		return
+	}
+	for i := range creds {
+		validator := store.Store.GetValidator(creds[i].Method)
+		if validator == nil {
+			continue
+		}
+		// The language of the user is unknown: the session belongs to someone else. Use the default.
+		err := validator.NotifyLockout(creds[i].Value, "", until)
+		if err != nil && err != types.ErrUnsupported {
+			logs.Warn.Println("login limiter: failed to notify user", uid, creds[i].Method, err)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/auth/mock_auth"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/mock_store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// testPCache is an in-memory persistent cache.
+type testPCache struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+func (pc *testPCache) Get(key string) (string, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if val, ok := pc.entries[key]; ok {
+		return val, nil
+	}
+	return "", types.ErrNotFound
+}
+
+func (pc *testPCache) Upsert(key string, value string, failOnDuplicate bool) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if _, ok := pc.entries[key]; ok && failOnDuplicate {
+		return types.ErrDuplicate
+	}
+	pc.entries[key] = value
+	return nil
+}
+
+func (pc *testPCache) Delete(key string) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	delete(pc.entries, key)
+	return nil
+}
+
+func (pc *testPCache) Expire(keyPrefix string, olderThan time.Time) error {
+	return nil
+}
+
+// limiterTest holds the limiter and mocks of the store. Notifications about locked accounts are
+// sent to the 'notified' channel.
+type limiterTest struct {
+	ll       *loginLimiter
+	ctrl     *gomock.Controller
+	uu       *mock_store.MockUsersPersistenceInterface
+	notified chan types.Uid
+}
+
+func newLimiterTest(t *testing.T, accountFailures, ipFailures int) *limiterTest {
+	ctrl := gomock.NewController(t)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	lt := &limiterTest{
+		ll: newLoginLimiter(&loginLimitConfig{
+			AccountFailures: accountFailures,
+			IPFailures:      ipFailures,
+			Lockout:         60,
+			MaxLockout:      240,
+			ResetAfter:      3600,
+		}),
+		ctrl:     ctrl,
+		uu:       uu,
+		notified: make(chan types.Uid, 10),
+	}
+	uu.EXPECT().GetAllCreds(gomock.Any(), "", true).DoAndReturn(
+		func(uid types.Uid, method string, validatedOnly bool) ([]types.Credential, error) {
+			lt.notified <- uid
+			return nil, nil
+		}).AnyTimes()
+
+	realCache, realUsers := store.PCache, store.Users
+	store.PCache = &testPCache{entries: make(map[string]string)}
+	store.Users = uu
+	t.Cleanup(func() {
+		store.PCache = realCache
+		store.Users = realUsers
+	})
+	return lt
+}
+
+// handler returns a mock authenticator which accepts the secret "valid" as the given user.
+// Other secrets fail: for the user if 'known' is true, for an unknown user otherwise.
+func (lt *limiterTest) handler(realName string, uid types.Uid, known bool) *mock_auth.MockAuthHandler {
+	hdl := mock_auth.NewMockAuthHandler(lt.ctrl)
+	hdl.EXPECT().GetRealName().Return(realName).AnyTimes()
+	hdl.EXPECT().Authenticate(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+			if string(secret) == "valid" {
+				return &auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth}, nil, nil
+			}
+			if known {
+				return &auth.Rec{Uid: uid}, nil, types.ErrFailed
+			}
+			return nil, nil, types.ErrFailed
+		}).AnyTimes()
+	return hdl
+}
+
+// fail makes failed attempts.
+func (lt *limiterTest) fail(t *testing.T, hdl auth.AuthHandler, remoteAddr string, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if _, _, _, err := lt.ll.authenticate(hdl, []byte("wrong"), remoteAddr); err != types.ErrFailed {
+			t.Fatalf("Attempt %d: expected ErrFailed, got %v", i+1, err)
+		}
+	}
+}
+
+// The account is locked after the limit of failures, even for the valid secret. Token logins
+// are not affected.
+func TestLoginLimiterLockout(t *testing.T) {
+	lt := newLimiterTest(t, 3, 100)
+	uid := types.Uid(1)
+	basic := lt.handler("basic", uid, true)
+
+	lt.fail(t, basic, "10.0.0.1:1000", 2)
+	if _, _, _, err := lt.ll.authenticate(basic, []byte("valid"), "10.0.0.2:1000"); err != nil {
+		t.Fatal("Valid login before lockout:", err)
+	}
+	lt.fail(t, basic, "10.0.0.1:1000", 1)
+	select {
+	case notified := <-lt.notified:
+		if notified != uid {
+			t.Error("Notified wrong user", notified)
+		}
+	case <-time.After(time.Second):
+		t.Error("User is not notified about the lockout")
+	}
+
+	// Attempts from any address are rejected.
+	rec, _, lockout, err := lt.ll.authenticate(basic, []byte("valid"), "10.0.0.3:1000")
+	if err != types.ErrTooManyAttempts || rec != nil || lockout <= 50*time.Second || lockout > 60*time.Second {
+		t.Errorf("Login to locked account: %v, lockout %v, %v", err, lockout, rec)
+	}
+	for _, scheme := range []string{"code", "totp"} {
+		if _, _, _, err = lt.ll.authenticate(lt.handler(scheme, uid, true), []byte("valid"), ""); err != types.ErrTooManyAttempts {
+			t.Errorf("Login to locked account by %s: expected ErrTooManyAttempts, got %v", scheme, err)
+		}
+	}
+	if rec, _, _, err = lt.ll.authenticate(lt.handler("token", uid, true), []byte("valid"), ""); err != nil || rec.Uid != uid {
+		t.Error("Token login to locked account:", rec, err)
+	}
+	// Token failures do not count towards the lockout.
+	other := types.Uid(2)
+	lt.fail(t, lt.handler("token", other, true), "", 5)
+	if _, _, _, err = lt.ll.authenticate(lt.handler("basic", other, true), []byte("valid"), ""); err != nil {
+		t.Error("Account is locked by token failures:", err)
+	}
+}
+
+// The lockout doubles with each failure after the limit up to the maximum.
+func TestLoginLimiterBackoff(t *testing.T) {
+	lt := newLimiterTest(t, 2, 100)
+	want := []time.Duration{0, time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute}
+	for i, lockout := range want {
+		failures, err := lt.ll.count(loginFailUserPrefix+"test", 2)
+		if err != nil {
+			t.Fatal("count:", err)
+		}
+		if failures.Count != i+1 {
+			t.Errorf("Failure %d: count %d", i+1, failures.Count)
+		}
+		if got := failures.Until.Sub(failures.Last); (lockout == 0 && !failures.Until.IsZero()) ||
+			(lockout > 0 && got != lockout) {
+			t.Errorf("Failure %d: expected lockout %v, got %v", i+1, lockout, got)
+		}
+	}
+
+	// Concurrent failures are all counted.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lt.ll.count(loginFailIPPrefix+"10.0.0.1", 100)
+		}()
+	}
+	wg.Wait()
+	if failures, err := lt.ll.get(loginFailIPPrefix + "10.0.0.1"); err != nil || failures.Count != 20 {
+		t.Error("Concurrent failures:", failures, err)
+	}
+}
+
+// The counter is reset only when the login is completed, not when the first factor succeeds.
+func TestLoginLimiterReset(t *testing.T) {
+	lt := newLimiterTest(t, 3, 100)
+	uid := types.Uid(1)
+	basic := lt.handler("basic", uid, true)
+	key := loginFailUserPrefix + uid.String()
+
+	lt.fail(t, basic, "", 2)
+	if _, _, _, err := lt.ll.authenticate(basic, []byte("valid"), ""); err != nil {
+		t.Fatal("Valid login:", err)
+	}
+	if failures, _ := lt.ll.get(key); failures == nil || failures.Count != 2 {
+		t.Fatal("Counter is reset by the first factor:", failures)
+	}
+	// The second factor fails: the account is locked.
+	totp := lt.handler("totp", uid, true)
+	lt.fail(t, totp, "", 1)
+	if _, _, _, err := lt.ll.authenticate(totp, []byte("valid"), ""); err != types.ErrTooManyAttempts {
+		t.Error("Second factor to locked account: expected ErrTooManyAttempts, got", err)
+	}
+	<-lt.notified
+
+	if _, err := lt.ll.unlock(uid); err != nil {
+		t.Fatal("unlock:", err)
+	}
+	lt.fail(t, basic, "", 2)
+	// Completed token login does not reset the counter, completed login with the password does.
+	lt.ll.succeeded(lt.handler("token", uid, true), uid)
+	if failures, _ := lt.ll.get(key); failures == nil || failures.Count != 2 {
+		t.Error("Counter is reset by a token login:", failures)
+	}
+	lt.ll.succeeded(basic, uid)
+	if failures, _ := lt.ll.get(key); failures != nil {
+		t.Error("Counter is not reset by completed login:", failures)
+	}
+}
+
+// totpOnce initializes the registered TOTP authenticator, which can be initialized only once.
+var totpOnce sync.Once
+
+// Wrong TOTP codes are counted against the account: guessing from many addresses locks it.
+func TestLoginLimiterTotp(t *testing.T) {
+	lt := newLimiterTest(t, 3, 2)
+	uid := types.Uid(1)
+	lt.uu.EXPECT().GetAuthRecord(uid, "totp").Return(uid.UserId(), auth.LevelNone, []byte("{}"), time.Time{}, nil).AnyTimes()
+
+	totp := store.Store.GetAuthHandler("totp")
+	totpOnce.Do(func() {
+		if err := totp.Init(json.RawMessage("{}"), "totp"); err != nil {
+			t.Fatal("Init totp:", err)
+		}
+	})
+
+	// Each attempt requests a fresh challenge with the password and guesses from a new address.
+	guess := func(i int) error {
+		challenge, _, err := totp.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth})
+		if err != nil || challenge == nil {
+			t.Fatal("GenSecret:", challenge, err)
+		}
+		_, _, _, err = lt.ll.authenticate(totp, []byte(string(challenge)+":000000"), fmt.Sprintf("10.0.%d.1:1000", i))
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := guess(i); err != types.ErrFailed {
+			t.Fatalf("Guess %d: expected ErrFailed, got %v", i+1, err)
+		}
+	}
+	select {
+	case notified := <-lt.notified:
+		if notified != uid {
+			t.Error("Notified wrong user", notified)
+		}
+	case <-time.After(time.Second):
+		t.Error("User is not notified about the lockout")
+	}
+	if err := guess(3); err != types.ErrTooManyAttempts {
+		t.Error("Guess to locked account: expected ErrTooManyAttempts, got", err)
+	}
+}
+
+// Addresses are locked regardless of the account.
+func TestLoginLimiterIP(t *testing.T) {
+	lt := newLimiterTest(t, 100, 3)
+	unknown := lt.handler("basic", types.ZeroUid, false)
+
+	lt.fail(t, unknown, "10.0.0.1:1000", 2)
+	lt.fail(t, lt.handler("basic", types.Uid(1), true), "10.0.0.1:2000", 1)
+
+	// The authenticator is not called for a locked address.
+	hdl := mock_auth.NewMockAuthHandler(lt.ctrl)
+	_, _, lockout, err := lt.ll.authenticate(hdl, []byte("valid"), "10.0.0.1:3000")
+	if err != types.ErrTooManyAttempts || lockout <= 0 {
+		t.Error("Login from locked address:", err, lockout)
+	}
+	if _, _, _, err = lt.ll.authenticate(lt.handler("basic", types.Uid(2), true), []byte("valid"), "10.0.0.2:1000"); err != nil {
+		t.Error("Login from another address:", err)
+	}
+	select {
+	case uid := <-lt.notified:
+		t.Error("Account is locked by failures from the address", uid)
+	default:
+	}
+}
+
+// Account is unlocked by the administrator.
+func TestLoginLimiterUnlock(t *testing.T) {
+	lt := newLimiterTest(t, 2, 100)
+	uid := types.Uid(1)
+	basic := lt.handler("basic", uid, true)
+
+	if unlocked, err := lt.ll.unlock(uid); unlocked || err != nil {
+		t.Error("Unlock account without failures:", unlocked, err)
+	}
+	lt.fail(t, basic, "", 1)
+	if unlocked, err := lt.ll.unlock(uid); unlocked || err != nil {
+		t.Error("Unlock account which is not locked:", unlocked, err)
+	}
+
+	lt.fail(t, basic, "", 2)
+	<-lt.notified
+	if unlocked, err := lt.ll.unlock(uid); !unlocked || err != nil {
+		t.Error("Unlock locked account:", unlocked, err)
+	}
+	if _, _, _, err := lt.ll.authenticate(basic, []byte("valid"), ""); err != nil {
+		t.Error("Login after unlock:", err)
+	}
+}
+
+// Temporary credentials in {acc} are subject to the account lockout.
+func TestDispatchAccTmpAuthLocked(t *testing.T) {
+	lt := newLimiterTest(t, 1, 100)
+	ss := mock_store.NewMockPersistentStorageInterface(lt.ctrl)
+	realStore := store.Store
+	store.Store = ss
+	globals.loginLimiter = lt.ll
+	defer func() {
+		store.Store = realStore
+		globals.loginLimiter = nil
+	}()
+
+	uid := types.Uid(1)
+	code := lt.handler("code", uid, true)
+	ss.EXPECT().GetLogicalAuthHandler("code").Return(code).Times(2)
+
+	s := &Session{
+		send: make(chan any, 10),
+		ver:  16,
+	}
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	for _, secret := range []string{"wrong", "valid"} {
+		s.dispatch(&ClientComMessage{
+			Acc: &MsgClientAcc{
+				Id:        "123",
+				User:      uid.UserId(),
+				TmpScheme: "code",
+				TmpSecret: []byte(secret),
+			},
+		})
+	}
+	close(s.send)
+	wg.Wait()
+	<-lt.notified
+
+	verifyResponseCodes(&r, []int{401, 429}, t)
+	if len(r.messages) == 2 {
+		params := r.messages[1].(*ServerComMessage).Ctrl.Params.(map[string]any)
+		if retry, _ := params["retry"].(int); retry < 1 || retry > 61 {
+			t.Error("Retry after:", params["retry"])
+		}
+	}
+}
@@ -31,14 +31,19 @@ import (
 	_ "github.com/volvlabs/towncryer-chat-server/server/auth/anon"
 	_ "github.com/volvlabs/towncryer-chat-server/server/auth/basic"
 	_ "github.com/volvlabs/towncryer-chat-server/server/auth/code"
+	_ "github.com/volvlabs/towncryer-chat-server/server/auth/oidc"
+	_ "github.com/volvlabs/towncryer-chat-server/server/auth/passkey"
 	_ "github.com/volvlabs/towncryer-chat-server/server/auth/rest"
 	_ "github.com/volvlabs/towncryer-chat-server/server/auth/token"
+	_ "github.com/volvlabs/towncryer-chat-server/server/auth/totp"
 
 	// Database backends
+	_ "github.com/volvlabs/towncryer-chat-server/server/db/memory"
 	_ "github.com/volvlabs/towncryer-chat-server/server/db/mongodb"
 	_ "github.com/volvlabs/towncryer-chat-server/server/db/mysql"
 	_ "github.com/volvlabs/towncryer-chat-server/server/db/postgres"
 	_ "github.com/volvlabs/towncryer-chat-server/server/db/rethinkdb"
+	_ "github.com/volvlabs/towncryer-chat-server/server/db/sqlite"
 
 	"github.com/volvlabs/towncryer-chat-server/server/logs"
 
@@ -58,6 +63,12 @@ import (
 	// File upload handlers
 	_ "github.com/volvlabs/towncryer-chat-server/server/media/fs"
 	_ "github.com/volvlabs/towncryer-chat-server/server/media/s3"
+
+	// Message search indexes
+	_ "github.com/volvlabs/towncryer-chat-server/server/search/disk"
+
+	// Sinks of change events
+	_ "github.com/volvlabs/towncryer-chat-server/server/cdc/file"
 )
 
 const (
@@ -87,6 +98,27 @@ const (
 	minTagLength = 2
 	// maxTagLength is the maximum length of a tag in runes. Longer tags are trimmed.
 	maxTagLength = 96
+	// maxReactionLength is the maximum length of a reaction to a message in runes. A reaction is a single
+	// grapheme, but an emoji grapheme may consist of several runes. Longer reactions are rejected.
+	maxReactionLength = 16
+	// maxPinnedMessages is the maximum number of pinned messages in a topic.
+	maxPinnedMessages = 16
+
+	// schedulerPeriod is how often to check for scheduled messages which are due for publishing.
+	schedulerPeriod = time.Second * 5
+	// schedulerBlockSize is the maximum number of scheduled messages to publish in one pass.
+	schedulerBlockSize = 256
+
+	// msgGcPeriod is how often to check for messages which have outlived the message TTL of their topics.
+	msgGcPeriod = time.Minute
+	// msgGcBlockSize is the maximum number of topics to delete expired messages from in one pass.
+	msgGcBlockSize = 64
+
+	// loginGcPeriod is how often to delete records of expired logins.
+	loginGcPeriod = time.Minute * 10
+
+	// changeDeliveryKey is hashed to pick the cluster node which delivers recorded changes.
+	changeDeliveryKey = "cdc"
 
 	// Delay before updating a User Agent
 	uaTimerDelay = time.Second * 5
@@ -157,6 +189,10 @@ var globals struct {
 	validatorClientConfig map[string][]string
 	// Validators required for each auth level.
 	authValidators map[auth.Level][]string
+	// Authenticator of the second factor at login, if configured.
+	secondFactor auth.AuthHandler
+	// Throttling of failed logins, nil if disabled.
+	loginLimiter *loginLimiter
 
 	// Salt used for signing API key.
 	apiKeySalt []byte
@@ -226,6 +262,19 @@ type accountGcConfig struct {
 	GcMinAccountAge int `json:"gc_min_account_age"`
 }
 
+// Message archiver config.
+type msgArchiveConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to run the archiver (seconds).
+	Period int `json:"period"`
+	// Number of topics to check in one pass.
+	BlockSize int `json:"block_size"`
+	// Minimum age of archived messages (days).
+	OlderThan int `json:"older_than"`
+	// Number of messages in one archive segment.
+	SegmentSize int `json:"segment_size"`
+}
+
 // Large file handler config.
 type mediaConfig struct {
 	// The name of the handler to use for file uploads.
@@ -240,6 +289,40 @@ type mediaConfig struct {
 	Handlers map[string]json.RawMessage `json:"handlers"`
 }
 
+type searchConfig struct {
+	// The name of the indexer to use for full-text search of messages instead of the database.
+	UseIndexer string `json:"use_indexer"`
+	// Individual indexer config params to pass to indexers unchanged.
+	Indexers map[string]json.RawMessage `json:"indexers"`
+}
+
+// Change data capture config.
+type cdcConfig struct {
+	// The name of the sink to deliver change events to. Changes are not recorded if blank.
+	UseSink string `json:"use_sink"`
+	// How often to deliver recorded events (seconds).
+	Period int `json:"period"`
+	// Number of events to deliver in one call to the sink.
+	BlockSize int `json:"block_size"`
+	// Individual sink config params to pass to sinks unchanged.
+	Sinks map[string]json.RawMessage `json:"sinks"`
+}
+
+// Login rate limiter config.
+type loginLimitConfig struct {
+	Enabled bool `json:"enabled"`
+	// Number of consecutive failed logins to an account before the account is locked.
+	AccountFailures int `json:"account_failures"`
+	// Number of failed logins from one IP address before the address is locked.
+	IPFailures int `json:"ip_failures"`
+	// Duration of the first lockout (seconds). Each following failure doubles it.
+	Lockout int `json:"lockout"`
+	// Maximum duration of a lockout (seconds).
+	MaxLockout int `json:"max_lockout"`
+	// Failures are forgotten after this long without failures (seconds).
+	ResetAfter int `json:"reset_after"`
+}
+
 // Contentx of the configuration file
 type configType struct {
 	// HTTP(S) address:port to listen on for websocket and long polling clients. Either a
@@ -292,16 +375,20 @@ type configType struct {
 	DefaultCountryCode string `json:"default_country_code"`
 
 	// Configs for subsystems
-	Cluster   json.RawMessage             `json:"cluster_config"`
-	Plugin    json.RawMessage             `json:"plugins"`
-	Store     json.RawMessage             `json:"store_config"`
-	Push      json.RawMessage             `json:"push"`
-	TLS       json.RawMessage             `json:"tls"`
-	Auth      map[string]json.RawMessage  `json:"auth_config"`
-	Validator map[string]*validatorConfig `json:"acc_validation"`
-	AccountGC *accountGcConfig            `json:"acc_gc_config"`
-	Media     *mediaConfig                `json:"media"`
-	WebRTC    json.RawMessage             `json:"webrtc"`
+	Cluster    json.RawMessage             `json:"cluster_config"`
+	Plugin     json.RawMessage             `json:"plugins"`
+	Store      json.RawMessage             `json:"store_config"`
+	Push       json.RawMessage             `json:"push"`
+	TLS        json.RawMessage             `json:"tls"`
+	Auth       map[string]json.RawMessage  `json:"auth_config"`
+	Validator  map[string]*validatorConfig `json:"acc_validation"`
+	AccountGC  *accountGcConfig            `json:"acc_gc_config"`
+	Media      *mediaConfig                `json:"media"`
+	Archive    *msgArchiveConfig           `json:"msg_archive"`
+	Search     *searchConfig               `json:"search"`
+	CDC        *cdcConfig                  `json:"cdc"`
+	LoginLimit *loginLimitConfig           `json:"login_limit"`
+	WebRTC     json.RawMessage             `json:"webrtc"`
 }
 
 func main() {
@@ -444,6 +531,9 @@ func main() {
 			if err := authhdl.Init(jsconf, name); err != nil {
 				logs.Err.Fatalln("Failed to init auth scheme", name+":", err)
 			}
+			if authhdl.GetRealName() == "totp" {
+				globals.secondFactor = authhdl
+			}
 			tags, err := authhdl.RestrictedTags()
 			if err != nil {
 				logs.Err.Fatalln("Failed get restricted tag namespaces (prefixes)", name+":", err)
@@ -457,6 +547,10 @@ func main() {
 		}
 	}
 
+	if config.LoginLimit != nil && config.LoginLimit.Enabled {
+		globals.loginLimiter = newLoginLimiter(config.LoginLimit)
+	}
+
 	// Process validators.
 	for name, vconf := range config.Validator {
 		// Check if validator is restrictive. If so, add validator name to the list of restricted tags.
@@ -584,6 +678,29 @@ func main() {
 		}
 	}
 
+	if config.Search != nil && config.Search.UseIndexer != "" {
+		var conf string
+		if params := config.Search.Indexers[config.Search.UseIndexer]; params != nil {
+			conf = string(params)
+		}
+		if err = store.Store.UseSearchIndexer(config.Search.UseIndexer, conf); err != nil {
+			logs.Err.Fatalf("Failed to init search indexer '%s': %s", config.Search.UseIndexer, err)
+		}
+	}
+
+	if config.CDC != nil && config.CDC.UseSink != "" {
+		if config.CDC.Period <= 0 || config.CDC.BlockSize <= 0 {
+			logs.Err.Fatalln("Invalid change data capture config")
+		}
+		var conf string
+		if params := config.CDC.Sinks[config.CDC.UseSink]; params != nil {
+			conf = string(params)
+		}
+		if err = store.Store.UseChangeSink(config.CDC.UseSink, conf); err != nil {
+			logs.Err.Fatalf("Failed to init change sink '%s': %s", config.CDC.UseSink, err)
+		}
+	}
+
 	// Stale unvalidated user account garbage collection.
 	if config.AccountGC != nil && config.AccountGC.Enabled {
 		if config.AccountGC.GcPeriod <= 0 || config.AccountGC.GcBlockSize <= 0 ||
@@ -618,6 +735,54 @@ func main() {
 	// The hub (the main message router)
 	globals.hub = newHub()
 
+	// Publish scheduled messages when they are due.
+	stopScheduler := globals.hub.runScheduler(schedulerPeriod, schedulerBlockSize)
+	defer func() {
+		stopScheduler <- true
+		logs.Info.Println("Stopped message scheduler")
+	}()
+
+	// Delete messages which have outlived the message TTL of their topics.
+	stopMsgGc := globals.hub.runMessageGc(msgGcPeriod, msgGcBlockSize)
+	defer func() {
+		stopMsgGc <- true
+		logs.Info.Println("Stopped expired message garbage collector")
+	}()
+
+	// Delete records of logins with expired tokens.
+	stopLoginGc := globals.hub.runLoginGc(loginGcPeriod)
+	defer func() {
+		stopLoginGc <- true
+		logs.Info.Println("Stopped expired login garbage collector")
+	}()
+
+	// Move old messages to archive segments kept by the media handler.
+	if config.Archive != nil && config.Archive.Enabled {
+		if config.Media == nil {
+			logs.Err.Fatalln("Message archiver requires a media handler")
+		}
+		if config.Archive.Period <= 0 || config.Archive.BlockSize <= 0 || config.Archive.OlderThan <= 0 ||
+			config.Archive.SegmentSize <= 0 {
+			logs.Err.Fatalln("Invalid message archiver config")
+		}
+		stopArchiver := globals.hub.runMessageArchiver(time.Second*time.Duration(config.Archive.Period),
+			config.Archive.BlockSize, time.Hour*24*time.Duration(config.Archive.OlderThan), config.Archive.SegmentSize)
+		defer func() {
+			stopArchiver <- true
+			logs.Info.Println("Stopped message archiver")
+		}()
+	}
+
+	// Deliver recorded changes to the sink.
+	if config.CDC != nil && config.CDC.UseSink != "" {
+		stopChangeDelivery := globals.hub.runChangeDelivery(time.Second*time.Duration(config.CDC.Period),
+			config.CDC.BlockSize)
+		defer func() {
+			stopChangeDelivery <- true
+			logs.Info.Println("Stopped delivery of changes")
+		}()
+	}
+
 	// Start accepting cluster traffic.
 	if globals.cluster != nil {
 		globals.cluster.start()
@@ -2,6 +2,7 @@
 package s3
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"io"
@@ -241,7 +242,44 @@ func (ah *awshandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, i
 // Download processes request for file download.
 // The returned ReadSeekCloser must be closed after use.
 func (ah *awshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
-	return nil, nil, types.ErrUnsupported
+	fid := ah.GetIdFromUrl(url)
+	if fid.IsZero() {
+		return nil, nil, types.ErrNotFound
+	}
+
+	fd, err := ah.getFileRecord(fid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obj, err := ah.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(ah.conf.BucketName),
+		Key:    aws.String(fd.Location),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			err = types.ErrNotFound
+		}
+		return nil, nil, err
+	}
+	defer obj.Body.Close()
+
+	// The object body cannot seek. Read it into memory: clients download files directly from AWS,
+	// the server only downloads files for its own use.
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fd, bytesReadCloser{bytes.NewReader(data)}, nil
+}
+
+// bytesReadCloser is a ReadSeekCloser over a byte slice.
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
 }
 
 // Delete deletes files from aws by provided slice of locations.
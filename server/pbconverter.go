@@ -40,6 +40,7 @@ func pbServDataSerialize(data *MsgServerData) *pbx.ServerMsg_Data {
 			SeqId:      int32(data.SeqId),
 			Head:       interfaceMapToByteMap(data.Head),
 			Content:    interfaceToBytes(data.Content),
+			React:      pbReactionsSerialize(data.React),
 		},
 	}
 }
@@ -99,6 +100,8 @@ func pbServInfoSerialize(info *MsgServerInfo) *pbx.ServerMsg_Info {
 			What:       pbInfoNoteWhatSerialize(info.What),
 			SeqId:      int32(info.SeqId),
 			Event:      pbCallEventSerialize(info.Event),
+			React:      info.React,
+			Thread:     int32(info.Thread),
 			Payload:    info.Payload,
 		},
 	}
@@ -107,13 +110,18 @@ func pbServInfoSerialize(info *MsgServerInfo) *pbx.ServerMsg_Info {
 func pbServMetaSerialize(meta *MsgServerMeta) *pbx.ServerMsg_Meta {
 	return &pbx.ServerMsg_Meta{
 		Meta: &pbx.ServerMeta{
-			Id:    meta.Id,
-			Topic: meta.Topic,
-			Desc:  pbTopicDescSerialize(meta.Desc),
-			Sub:   pbTopicSubSliceSerialize(meta.Sub),
-			Del:   pbDelValuesSerialize(meta.Del),
-			Tags:  meta.Tags,
-			Cred:  pbServerCredsSerialize(meta.Cred),
+			Id:     meta.Id,
+			Topic:  meta.Topic,
+			Desc:   pbTopicDescSerialize(meta.Desc),
+			Sub:    pbTopicSubSliceSerialize(meta.Sub),
+			Del:    pbDelValuesSerialize(meta.Del),
+			Tags:   meta.Tags,
+			Cred:   pbServerCredsSerialize(meta.Cred),
+			React:  pbMessageReactionsSerialize(meta.React),
+			Thread: pbThreadStatusSerialize(meta.Thread),
+			Sched:  pbScheduledMessagesSerialize(meta.Sched),
+			Search: pbSearchHitsSerialize(meta.Search),
+			Rcpt:   pbRcptValuesSerialize(meta.Rcpt),
 		},
 	}
 }
@@ -163,6 +171,7 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			SeqId:     int(data.GetSeqId()),
 			Head:      byteMapToInterfaceMap(data.GetHead()),
 			Content:   data.GetContent(),
+			React:     pbReactionsDeserialize(data.GetReact()),
 		}
 	} else if pres := pkt.GetPres(); pres != nil {
 		var what string
@@ -212,17 +221,24 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			What:    pbInfoNoteWhatDeserialize(info.GetWhat()),
 			SeqId:   int(info.GetSeqId()),
 			Event:   pbCallEventDeserialize(info.GetEvent()),
+			React:   info.GetReact(),
+			Thread:  int(info.GetThread()),
 			Payload: info.GetPayload(),
 		}
 	} else if meta := pkt.GetMeta(); meta != nil {
 		msg.Meta = &MsgServerMeta{
-			Id:    meta.GetId(),
-			Topic: meta.GetTopic(),
-			Desc:  pbTopicDescDeserialize(meta.GetDesc()),
-			Sub:   pbTopicSubSliceDeserialize(meta.GetSub()),
-			Del:   pbDelValuesDeserialize(meta.GetDel()),
-			Tags:  meta.GetTags(),
-			Cred:  pbServerCredsDeserialize(meta.GetCred()),
+			Id:     meta.GetId(),
+			Topic:  meta.GetTopic(),
+			Desc:   pbTopicDescDeserialize(meta.GetDesc()),
+			Sub:    pbTopicSubSliceDeserialize(meta.GetSub()),
+			Del:    pbDelValuesDeserialize(meta.GetDel()),
+			Tags:   meta.GetTags(),
+			Cred:   pbServerCredsDeserialize(meta.GetCred()),
+			React:  pbMessageReactionsDeserialize(meta.GetReact()),
+			Thread: pbThreadStatusDeserialize(meta.GetThread()),
+			Sched:  pbScheduledMessagesDeserialize(meta.GetSched()),
+			Search: pbSearchHitsDeserialize(meta.GetSearch()),
+			Rcpt:   pbRcptValuesDeserialize(meta.GetRcpt()),
 		}
 	}
 	return &msg
@@ -308,6 +324,8 @@ func pbCliSerialize(msg *ClientComMessage) *pbx.ClientMsg {
 				NoEcho:  msg.Pub.NoEcho,
 				Head:    interfaceMapToByteMap(msg.Pub.Head),
 				Content: interfaceToBytes(msg.Pub.Content),
+				SendAt:  timeToInt64(msg.Pub.SendAt),
+				Forward: pbForwardRefSerialize(msg.Pub.Forward),
 			},
 		}
 	case msg.Get != nil:
@@ -339,6 +357,8 @@ func pbCliSerialize(msg *ClientComMessage) *pbx.ClientMsg {
 			what = pbx.ClientDel_USER
 		case "cred":
 			what = pbx.ClientDel_CRED
+		case "sched":
+			what = pbx.ClientDel_SCHED
 		}
 		pkt.Message = &pbx.ClientMsg_Del{
 			Del: &pbx.ClientDel{
@@ -349,6 +369,7 @@ func pbCliSerialize(msg *ClientComMessage) *pbx.ClientMsg {
 				UserId: msg.Del.User,
 				Cred:   pbClientCredSerialize(msg.Del.Cred),
 				Hard:   msg.Del.Hard,
+				Sched:  msg.Del.Sched,
 			},
 		}
 	case msg.Note != nil:
@@ -359,6 +380,8 @@ func pbCliSerialize(msg *ClientComMessage) *pbx.ClientMsg {
 				SeqId:   int32(msg.Note.SeqId),
 				Unread:  int32(msg.Note.Unread),
 				Event:   pbCallEventSerialize(msg.Note.Event),
+				React:   msg.Note.React,
+				Thread:  int32(msg.Note.Thread),
 				Payload: msg.Note.Payload,
 			},
 		}
@@ -434,6 +457,8 @@ func pbCliDeserialize(pkt *pbx.ClientMsg) *ClientComMessage {
 			NoEcho:  pub.GetNoEcho(),
 			Head:    byteMapToInterfaceMap(pub.GetHead()),
 			Content: bytesToInterface(pub.GetContent()),
+			SendAt:  int64ToTime(pub.GetSendAt()),
+			Forward: pbForwardRefDeserialize(pub.GetForward()),
 		}
 	} else if get := pkt.GetGet(); get != nil {
 		msg.Get = &MsgClientGet{
@@ -459,6 +484,7 @@ func pbCliDeserialize(pkt *pbx.ClientMsg) *ClientComMessage {
 			User:   del.GetUserId(),
 			Cred:   pbClientCredDeserialize(del.GetCred()),
 			Hard:   del.GetHard(),
+			Sched:  del.GetSched(),
 		}
 		switch del.GetWhat() {
 		case pbx.ClientDel_MSG:
@@ -471,6 +497,8 @@ func pbCliDeserialize(pkt *pbx.ClientMsg) *ClientComMessage {
 			msg.Del.What = "user"
 		case pbx.ClientDel_CRED:
 			msg.Del.What = "cred"
+		case pbx.ClientDel_SCHED:
+			msg.Del.What = "sched"
 		}
 	} else if note := pkt.GetNote(); note != nil {
 		msg.Note = &MsgClientNote{
@@ -479,6 +507,8 @@ func pbCliDeserialize(pkt *pbx.ClientMsg) *ClientComMessage {
 			What:    pbInfoNoteWhatDeserialize(note.GetWhat()),
 			Unread:  int(note.GetUnread()),
 			Event:   pbCallEventDeserialize(note.GetEvent()),
+			React:   note.GetReact(),
+			Thread:  int(note.GetThread()),
 			Payload: note.GetPayload(),
 		}
 	}
@@ -533,6 +563,28 @@ func bytesToInterface(in []byte) any {
 	return out
 }
 
+func intSliceToInt32(in []int) []int32 {
+	if in == nil {
+		return nil
+	}
+	out := make([]int32, len(in))
+	for i, val := range in {
+		out[i] = int32(val)
+	}
+	return out
+}
+
+func int32SliceToInt(in []int32) []int {
+	if in == nil {
+		return nil
+	}
+	out := make([]int, len(in))
+	for i, val := range in {
+		out[i] = int(val)
+	}
+	return out
+}
+
 func timeToInt64(ts *time.Time) int64 {
 	if ts != nil {
 		return ts.UnixNano() / int64(time.Millisecond)
@@ -578,6 +630,28 @@ func pbGetQuerySerialize(in *MsgGetQuery) *pbx.GetQuery {
 			BeforeId: int32(in.Data.BeforeId),
 			SinceId:  int32(in.Data.SinceId),
 			Limit:    int32(in.Data.Limit),
+			Thread:   int32(in.Data.Thread),
+		}
+	}
+	if in.React != nil {
+		out.React = &pbx.GetOpts{
+			BeforeId: int32(in.React.BeforeId),
+			SinceId:  int32(in.React.SinceId),
+		}
+	}
+	if in.Search != nil {
+		out.Search = &pbx.GetOpts{
+			Topic: in.Search.Topic,
+			Limit: int32(in.Search.Limit),
+			Query: in.Search.Query,
+		}
+	}
+	if in.Rcpt != nil {
+		out.Rcpt = &pbx.GetOpts{
+			User:  in.Rcpt.User,
+			Limit: int32(in.Rcpt.Limit),
+			SeqId: int32(in.Rcpt.SeqId),
+			After: in.Rcpt.After,
 		}
 	}
 	return out
@@ -609,6 +683,28 @@ func pbGetQueryDeserialize(in *pbx.GetQuery) *MsgGetQuery {
 			BeforeId: int(data.GetBeforeId()),
 			SinceId:  int(data.GetSinceId()),
 			Limit:    int(data.GetLimit()),
+			Thread:   int(data.GetThread()),
+		}
+	}
+	if react := in.GetReact(); react != nil {
+		msg.React = &MsgGetOpts{
+			BeforeId: int(react.GetBeforeId()),
+			SinceId:  int(react.GetSinceId()),
+		}
+	}
+	if search := in.GetSearch(); search != nil {
+		msg.Search = &MsgGetOpts{
+			Topic: search.GetTopic(),
+			Limit: int(search.GetLimit()),
+			Query: search.GetQuery(),
+		}
+	}
+	if rcpt := in.GetRcpt(); rcpt != nil {
+		msg.Rcpt = &MsgGetOpts{
+			User:  rcpt.GetUser(),
+			Limit: int(rcpt.GetLimit()),
+			SeqId: int(rcpt.GetSeqId()),
+			After: rcpt.GetAfter(),
 		}
 	}
 
@@ -620,13 +716,27 @@ func pbSetDescSerialize(in *MsgSetDesc) *pbx.SetDesc {
 		return nil
 	}
 
-	if in.DefaultAcs != nil || in.Public != nil || in.Trusted != nil || in.Private != nil {
-		return &pbx.SetDesc{
+	if in.DefaultAcs != nil || in.Public != nil || in.Trusted != nil || in.Private != nil || in.Pinned != nil ||
+		in.MsgTTL != nil {
+		out := &pbx.SetDesc{
 			DefaultAcs: pbDefaultAcsSerialize(in.DefaultAcs),
 			Public:     interfaceToBytes(in.Public),
 			Trusted:    interfaceToBytes(in.Trusted),
 			Private:    interfaceToBytes(in.Private),
+			Pinned:     intSliceToInt32(in.Pinned),
+		}
+		if in.Pinned != nil && len(in.Pinned) == 0 {
+			// Empty list cannot be distinguished from a missing one: [0] unpins all messages.
+			out.Pinned = []int32{0}
 		}
+		if in.MsgTTL != nil {
+			out.MsgTtl = int32(*in.MsgTTL)
+			if out.MsgTtl == 0 {
+				// Zero cannot be distinguished from a missing value: -1 disables message expiration.
+				out.MsgTtl = -1
+			}
+		}
+		return out
 	}
 
 	return nil
@@ -641,13 +751,23 @@ func pbSetDescDeserialize(in *pbx.SetDesc) *MsgSetDesc {
 	public := in.GetPublic()
 	trusted := in.GetTrusted()
 	private := in.GetPrivate()
+	pinned := int32SliceToInt(in.GetPinned())
+	var msgTTL *int
+	if ttl := int(in.GetMsgTtl()); ttl != 0 {
+		if ttl < 0 {
+			ttl = 0
+		}
+		msgTTL = &ttl
+	}
 
-	if defacs != nil || public != nil || private != nil || trusted != nil {
+	if defacs != nil || public != nil || private != nil || trusted != nil || pinned != nil || msgTTL != nil {
 		return &MsgSetDesc{
 			DefaultAcs: defacs,
 			Public:     bytesToInterface(public),
 			Trusted:    bytesToInterface(trusted),
 			Private:    bytesToInterface(private),
+			Pinned:     pinned,
+			MsgTTL:     msgTTL,
 		}
 	}
 
@@ -733,6 +853,8 @@ func pbInfoNoteWhatSerialize(what string) pbx.InfoNote {
 		out = pbx.InfoNote_RECV
 	case "call":
 		out = pbx.InfoNote_CALL
+	case "react":
+		out = pbx.InfoNote_REACT
 	default:
 		logs.Info.Println("unknown info-note.what", what)
 	}
@@ -750,6 +872,8 @@ func pbInfoNoteWhatDeserialize(what pbx.InfoNote) string {
 		out = "recv"
 	case pbx.InfoNote_CALL:
 		out = "call"
+	case pbx.InfoNote_REACT:
+		out = "react"
 	default:
 	}
 	return out
@@ -872,6 +996,8 @@ func pbTopicDescSerialize(desc *MsgTopicDesc) *pbx.TopicDesc {
 		Public:    interfaceToBytes(desc.Public),
 		Trusted:   interfaceToBytes(desc.Trusted),
 		Private:   interfaceToBytes(desc.Private),
+		Pinned:    intSliceToInt32(desc.Pinned),
+		MsgTtl:    int32(desc.MsgTTL),
 	}
 	if desc.LastSeen != nil {
 		out.LastSeenTime = timeToInt64(desc.LastSeen.When)
@@ -900,6 +1026,8 @@ func pbTopicDescDeserialize(desc *pbx.TopicDesc) *MsgTopicDesc {
 		Public:     bytesToInterface(desc.Public),
 		Trusted:    bytesToInterface(desc.Trusted),
 		Private:    bytesToInterface(desc.Private),
+		Pinned:     int32SliceToInt(desc.GetPinned()),
+		MsgTTL:     int(desc.GetMsgTtl()),
 	}
 
 	if desc.GetLastSeenTime() > 0 {
@@ -926,6 +1054,7 @@ func pbTopicSerializeToDesc(topic *Topic) *pbx.TopicDesc {
 		DelId:   int32(topic.delID),
 		Public:  interfaceToBytes(topic.public),
 		Trusted: interfaceToBytes(topic.trusted),
+		Pinned:  intSliceToInt32(topic.pinned),
 	}
 }
 
@@ -1080,6 +1209,239 @@ func pbDelValuesDeserialize(in *pbx.DelValues) *MsgDelValues {
 	}
 }
 
+func pbReactionsSerialize(in []MsgReaction) []*pbx.Reaction {
+	if in == nil {
+		return nil
+	}
+
+	var out []*pbx.Reaction
+	for _, r := range in {
+		out = append(out, &pbx.Reaction{
+			Value: r.Value,
+			Count: int32(r.Count),
+			Users: r.Users,
+		})
+	}
+	return out
+}
+
+func pbReactionsDeserialize(in []*pbx.Reaction) []MsgReaction {
+	if in == nil {
+		return nil
+	}
+
+	var out []MsgReaction
+	for _, r := range in {
+		out = append(out, MsgReaction{
+			Value: r.GetValue(),
+			Count: int(r.GetCount()),
+			Users: r.GetUsers(),
+		})
+	}
+	return out
+}
+
+func pbMessageReactionsSerialize(in []MsgMessageReactions) []*pbx.MessageReactions {
+	if in == nil {
+		return nil
+	}
+
+	var out []*pbx.MessageReactions
+	for _, mr := range in {
+		out = append(out, &pbx.MessageReactions{
+			SeqId: int32(mr.SeqId),
+			React: pbReactionsSerialize(mr.React),
+		})
+	}
+	return out
+}
+
+func pbMessageReactionsDeserialize(in []*pbx.MessageReactions) []MsgMessageReactions {
+	if in == nil {
+		return nil
+	}
+
+	var out []MsgMessageReactions
+	for _, mr := range in {
+		out = append(out, MsgMessageReactions{
+			SeqId: int(mr.GetSeqId()),
+			React: pbReactionsDeserialize(mr.GetReact()),
+		})
+	}
+	return out
+}
+
+func pbThreadStatusSerialize(in []MsgThreadStatus) []*pbx.ThreadStatus {
+	if in == nil {
+		return nil
+	}
+
+	var out []*pbx.ThreadStatus
+	for _, ts := range in {
+		out = append(out, &pbx.ThreadStatus{
+			Thread:    int32(ts.Thread),
+			Count:     int32(ts.Count),
+			LastSeqId: int32(ts.LastSeqId),
+			ReadSeqId: int32(ts.ReadSeqId),
+			Unread:    int32(ts.Unread),
+		})
+	}
+	return out
+}
+
+func pbThreadStatusDeserialize(in []*pbx.ThreadStatus) []MsgThreadStatus {
+	if in == nil {
+		return nil
+	}
+
+	var out []MsgThreadStatus
+	for _, ts := range in {
+		out = append(out, MsgThreadStatus{
+			Thread:    int(ts.GetThread()),
+			Count:     int(ts.GetCount()),
+			LastSeqId: int(ts.GetLastSeqId()),
+			ReadSeqId: int(ts.GetReadSeqId()),
+			Unread:    int(ts.GetUnread()),
+		})
+	}
+	return out
+}
+
+func pbScheduledMessagesSerialize(in []MsgScheduledMessage) []*pbx.ScheduledMessage {
+	if in == nil {
+		return nil
+	}
+
+	var out []*pbx.ScheduledMessage
+	for i := range in {
+		sm := &in[i]
+		out = append(out, &pbx.ScheduledMessage{
+			Id:        sm.Id,
+			CreatedAt: timeToInt64(sm.CreatedAt),
+			SendAt:    timeToInt64(sm.SendAt),
+			Head:      interfaceMapToByteMap(sm.Head),
+			Content:   interfaceToBytes(sm.Content),
+		})
+	}
+	return out
+}
+
+func pbScheduledMessagesDeserialize(in []*pbx.ScheduledMessage) []MsgScheduledMessage {
+	if in == nil {
+		return nil
+	}
+
+	var out []MsgScheduledMessage
+	for _, sm := range in {
+		out = append(out, MsgScheduledMessage{
+			Id:        sm.GetId(),
+			CreatedAt: int64ToTime(sm.GetCreatedAt()),
+			SendAt:    int64ToTime(sm.GetSendAt()),
+			Head:      byteMapToInterfaceMap(sm.GetHead()),
+			Content:   bytesToInterface(sm.GetContent()),
+		})
+	}
+	return out
+}
+
+func pbForwardRefSerialize(in *MsgForward) *pbx.ForwardRef {
+	if in == nil {
+		return nil
+	}
+	return &pbx.ForwardRef{
+		Topic: in.Topic,
+		SeqId: int32(in.SeqId),
+	}
+}
+
+func pbForwardRefDeserialize(in *pbx.ForwardRef) *MsgForward {
+	if in == nil {
+		return nil
+	}
+	return &MsgForward{
+		Topic: in.GetTopic(),
+		SeqId: int(in.GetSeqId()),
+	}
+}
+
+func pbSearchHitsSerialize(in []MsgSearchHit) []*pbx.SearchHit {
+	if in == nil {
+		return nil
+	}
+
+	var out []*pbx.SearchHit
+	for i := range in {
+		hit := &in[i]
+		out = append(out, &pbx.SearchHit{
+			Topic:      hit.Topic,
+			SeqId:      int32(hit.SeqId),
+			FromUserId: hit.From,
+			Timestamp:  timeToInt64(hit.Timestamp),
+			Snippet:    hit.Snippet,
+		})
+	}
+	return out
+}
+
+func pbSearchHitsDeserialize(in []*pbx.SearchHit) []MsgSearchHit {
+	if in == nil {
+		return nil
+	}
+
+	var out []MsgSearchHit
+	for _, hit := range in {
+		out = append(out, MsgSearchHit{
+			Topic:     hit.GetTopic(),
+			SeqId:     int(hit.GetSeqId()),
+			From:      hit.GetFromUserId(),
+			Timestamp: int64ToTime(hit.GetTimestamp()),
+			Snippet:   hit.GetSnippet(),
+		})
+	}
+	return out
+}
+
+func pbRcptValuesSerialize(in *MsgRcptValues) *pbx.RcptValues {
+	if in == nil {
+		return nil
+	}
+
+	out := &pbx.RcptValues{
+		SeqId: int32(in.SeqId),
+		Recv:  int32(in.Recv),
+		Read:  int32(in.Read),
+	}
+	for i := range in.Users {
+		user := &in.Users[i]
+		out.Users = append(out.Users, &pbx.MemberRcpt{
+			UserId:    user.User,
+			RecvSeqId: int32(user.RecvSeqId),
+			ReadSeqId: int32(user.ReadSeqId),
+		})
+	}
+	return out
+}
+
+func pbRcptValuesDeserialize(in *pbx.RcptValues) *MsgRcptValues {
+	if in == nil {
+		return nil
+	}
+
+	out := &MsgRcptValues{
+		SeqId: int(in.GetSeqId()),
+		Recv:  int(in.GetRecv()),
+		Read:  int(in.GetRead()),
+	}
+	for _, user := range in.GetUsers() {
+		out.Users = append(out.Users, MsgMemberRcpt{
+			User:      user.GetUserId(),
+			RecvSeqId: int(user.GetRecvSeqId()),
+			ReadSeqId: int(user.GetReadSeqId()),
+		})
+	}
+	return out
+}
+
 func pbClientCredSerialize(in *MsgCredClient) *pbx.ClientCred {
 	if in == nil {
 		return nil
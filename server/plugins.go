@@ -594,7 +594,7 @@ func pluginSubscription(sub *types.Subscription, action int) {
 
 // Message accepted for delivery
 func pluginMessage(data *MsgServerData, action int) {
-	if globals.plugins == nil || action != plgActCreate {
+	if globals.plugins == nil || action&(plgActCreate|plgActUpd) == 0 {
 		return
 	}
 
@@ -0,0 +1,495 @@
+// Package disk implements github.com/volvlabs/towncryer-chat-server/server/search interface by keeping an inverted
+// index of messages in memory and persisting it as a journal file in a local directory. Only the word lists are
+// kept in memory, the message texts are read from the journal when needed.
+// The index is local to the node: in a cluster each node indexes messages of the topics it hosts.
+package disk
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/search"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+const (
+	indexerName = "disk"
+
+	journalName = "journal.ndjson"
+
+	// The journal is compacted at startup when more than this fraction of it is taken by
+	// deleted or replaced messages.
+	compactRatio = 0.5
+
+	// Number of results returned when the limit is not given.
+	defaultMaxResults = 100
+)
+
+const (
+	opIndex  = "i"
+	opDelete = "d"
+)
+
+type configType struct {
+	IndexDir string `json:"index_dir"`
+}
+
+// Journal record.
+type record struct {
+	// Operation: opIndex or opDelete.
+	Op    string `json:"op"`
+	Topic string `json:"topic"`
+
+	// Indexed message.
+	SeqId     int        `json:"seq,omitempty"`
+	From      string     `json:"from,omitempty"`
+	CreatedAt *time.Time `json:"ts,omitempty"`
+	Text      string     `json:"text,omitempty"`
+	// Users who deleted the indexed message. Set when the journal is compacted.
+	DeletedFor []string `json:"delfor,omitempty"`
+
+	// Deleted messages: the user who deleted the messages or blank for all users.
+	User string `json:"user,omitempty"`
+	// Deleted messages: ranges of IDs, all messages of the topic if nil.
+	Ranges []types.Range `json:"ranges,omitempty"`
+}
+
+type docKey struct {
+	topic string
+	seq   int
+}
+
+type docInfo struct {
+	from      string
+	createdAt time.Time
+	// Location of the indexing record in the journal.
+	offset, size int64
+	// Users who deleted the message.
+	deletedFor map[string]bool
+}
+
+type indexer struct {
+	mu sync.RWMutex
+
+	dir     string
+	journal *os.File
+	// Size of the journal.
+	end int64
+	// Number of bytes in the journal taken by deleted or replaced messages.
+	garbage int64
+
+	// Indexed messages by topic.
+	topics map[string]map[int]*docInfo
+	// Word -> messages which contain the word.
+	postings map[string]map[docKey]struct{}
+}
+
+// Init opens the journal and loads the index into memory.
+func (ix *indexer) Init(jsconf string) error {
+	var config configType
+	if err := json.Unmarshal([]byte(jsconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if config.IndexDir == "" {
+		return errors.New("missing index location")
+	}
+	ix.dir = config.IndexDir
+	if err := os.MkdirAll(ix.dir, 0700); err != nil {
+		return err
+	}
+
+	if err := ix.load(); err != nil {
+		return err
+	}
+
+	if ix.end > 0 && float64(ix.garbage) > float64(ix.end)*compactRatio {
+		if err := ix.compact(); err != nil {
+			logs.Warn.Println("search: failed to compact the journal", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the journal.
+func (ix *indexer) Close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.journal == nil {
+		return nil
+	}
+	err := ix.journal.Close()
+	ix.journal = nil
+	return err
+}
+
+// Index adds message to the index.
+func (ix *indexer) Index(doc *search.Document) error {
+	createdAt := doc.CreatedAt
+	rec := &record{
+		Op:        opIndex,
+		Topic:     doc.Topic,
+		SeqId:     doc.SeqId,
+		From:      doc.From,
+		CreatedAt: &createdAt,
+		Text:      doc.Text,
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	offset, size, err := ix.write(rec)
+	if err != nil {
+		return err
+	}
+	return ix.apply(rec, offset, size)
+}
+
+// Delete removes messages from the index for one or all users.
+func (ix *indexer) Delete(topic string, forUser types.Uid, ranges []types.Range) error {
+	rec := &record{
+		Op:     opDelete,
+		Topic:  topic,
+		Ranges: ranges,
+	}
+	if !forUser.IsZero() {
+		rec.User = forUser.String()
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if _, ok := ix.topics[topic]; !ok {
+		// Nothing to delete.
+		return nil
+	}
+
+	offset, size, err := ix.write(rec)
+	if err != nil {
+		return err
+	}
+	return ix.apply(rec, offset, size)
+}
+
+// Search finds messages which contain all the words.
+func (ix *indexer) Search(topics []string, forUser types.Uid, words []string, limit int) ([]search.Document, error) {
+	if len(topics) == 0 || len(words) == 0 {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = defaultMaxResults
+	}
+	user := forUser.String()
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if ix.journal == nil {
+		return nil, errors.New("search: index is closed")
+	}
+
+	inTopic := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		inTopic[topic] = true
+	}
+
+	// Start with the rarest word.
+	sets := make([]map[docKey]struct{}, len(words))
+	for i, word := range words {
+		sets[i] = ix.postings[word]
+		if len(sets[i]) == 0 {
+			return nil, nil
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+
+	type hit struct {
+		key  docKey
+		info *docInfo
+	}
+	var hits []hit
+	for key := range sets[0] {
+		if !inTopic[key.topic] {
+			continue
+		}
+		found := true
+		for _, set := range sets[1:] {
+			if _, found = set[key]; !found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		info := ix.topics[key.topic][key.seq]
+		if info.deletedFor[user] {
+			continue
+		}
+		hits = append(hits, hit{key: key, info: info})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].info.createdAt.Equal(hits[j].info.createdAt) {
+			return hits[i].key.seq > hits[j].key.seq
+		}
+		return hits[i].info.createdAt.After(hits[j].info.createdAt)
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	docs := make([]search.Document, len(hits))
+	for i, h := range hits {
+		rec, err := ix.read(h.info)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = search.Document{
+			Topic:     h.key.topic,
+			SeqId:     h.key.seq,
+			From:      h.info.from,
+			CreatedAt: h.info.createdAt,
+			Text:      rec.Text,
+		}
+	}
+
+	return docs, nil
+}
+
+// load opens the journal and replays it. A partially written record at the end of the journal is discarded.
+func (ix *indexer) load() error {
+	ix.topics = make(map[string]map[int]*docInfo)
+	ix.postings = make(map[string]map[docKey]struct{})
+	ix.end = 0
+	ix.garbage = 0
+
+	var err error
+	ix.journal, err = os.OpenFile(filepath.Join(ix.dir, journalName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(ix.journal)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				logs.Warn.Println("search: discarding incomplete record at the end of the journal")
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec record
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return errors.New("search: corrupted journal at " + filepath.Join(ix.dir, journalName))
+		}
+		if err = ix.apply(&rec, ix.end, int64(len(line))); err != nil {
+			return err
+		}
+		ix.end += int64(len(line))
+	}
+
+	if err = ix.journal.Truncate(ix.end); err != nil {
+		return err
+	}
+	_, err = ix.journal.Seek(ix.end, io.SeekStart)
+	return err
+}
+
+// compact rewrites the journal keeping only the messages which are still indexed.
+func (ix *indexer) compact() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	tmpName := filepath.Join(ix.dir, journalName+".tmp")
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, docs := range ix.topics {
+		for _, info := range docs {
+			rec, err := ix.read(info)
+			if err != nil {
+				tmp.Close()
+				return err
+			}
+			rec.DeletedFor = nil
+			for user := range info.deletedFor {
+				rec.DeletedFor = append(rec.DeletedFor, user)
+			}
+			line, _ := json.Marshal(rec)
+			writer.Write(append(line, '\n'))
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	ix.journal.Close()
+	if err = os.Rename(tmpName, filepath.Join(ix.dir, journalName)); err != nil {
+		// Keep using the old journal.
+		if lerr := ix.load(); lerr != nil {
+			return lerr
+		}
+		return err
+	}
+
+	// Reload the index: the offsets of all messages have changed.
+	return ix.load()
+}
+
+// write appends the record to the journal.
+func (ix *indexer) write(rec *record) (int64, int64, error) {
+	if ix.journal == nil {
+		return 0, 0, errors.New("search: index is closed")
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return 0, 0, err
+	}
+	line = append(line, '\n')
+
+	offset := ix.end
+	if _, err = ix.journal.Write(line); err != nil {
+		return 0, 0, err
+	}
+	ix.end += int64(len(line))
+	return offset, int64(len(line)), nil
+}
+
+// read loads the indexing record of the message from the journal.
+func (ix *indexer) read(info *docInfo) (*record, error) {
+	buf := make([]byte, info.size)
+	if _, err := ix.journal.ReadAt(buf, info.offset); err != nil {
+		return nil, err
+	}
+	var rec record
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// apply updates the in-memory index with the record located in the journal at the given offset.
+func (ix *indexer) apply(rec *record, offset, size int64) error {
+	switch rec.Op {
+	case opIndex:
+		key := docKey{topic: rec.Topic, seq: rec.SeqId}
+		if old := ix.topics[rec.Topic][rec.SeqId]; old != nil {
+			// Message was edited.
+			if err := ix.remove(key, old); err != nil {
+				return err
+			}
+		}
+
+		info := &docInfo{
+			from:       rec.From,
+			offset:     offset,
+			size:       size,
+			deletedFor: make(map[string]bool),
+		}
+		if rec.CreatedAt != nil {
+			info.createdAt = *rec.CreatedAt
+		}
+		for _, user := range rec.DeletedFor {
+			info.deletedFor[user] = true
+		}
+
+		docs := ix.topics[rec.Topic]
+		if docs == nil {
+			docs = make(map[int]*docInfo)
+			ix.topics[rec.Topic] = docs
+		}
+		docs[rec.SeqId] = info
+
+		for _, word := range search.Words(rec.Text) {
+			set := ix.postings[word]
+			if set == nil {
+				set = make(map[docKey]struct{})
+				ix.postings[word] = set
+			}
+			set[key] = struct{}{}
+		}
+
+	case opDelete:
+		// Delete records are garbage as soon as they are applied.
+		ix.garbage += size
+
+		for seq, info := range ix.topics[rec.Topic] {
+			if rec.Ranges != nil && !inRanges(seq, rec.Ranges) {
+				continue
+			}
+			if rec.User != "" {
+				info.deletedFor[rec.User] = true
+			} else if err := ix.remove(docKey{topic: rec.Topic, seq: seq}, info); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return errors.New("search: unknown journal operation '" + rec.Op + "'")
+	}
+
+	return nil
+}
+
+// remove deletes the message from the in-memory index.
+func (ix *indexer) remove(key docKey, info *docInfo) error {
+	rec, err := ix.read(info)
+	if err != nil {
+		return err
+	}
+
+	for _, word := range search.Words(rec.Text) {
+		if set := ix.postings[word]; set != nil {
+			delete(set, key)
+			if len(set) == 0 {
+				delete(ix.postings, word)
+			}
+		}
+	}
+
+	docs := ix.topics[key.topic]
+	delete(docs, key.seq)
+	if len(docs) == 0 {
+		delete(ix.topics, key.topic)
+	}
+	ix.garbage += info.size
+
+	return nil
+}
+
+// inRanges checks if seq belongs to one of the ranges. A range with zero Hi contains just Low.
+func inRanges(seq int, ranges []types.Range) bool {
+	for _, r := range ranges {
+		if seq == r.Low || (seq > r.Low && seq < r.Hi) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	store.RegisterSearchIndexer(indexerName, &indexer{})
+}
@@ -0,0 +1,156 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/search"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+func openIndex(t *testing.T, dir string) *indexer {
+	t.Helper()
+	ix := &indexer{}
+	if err := ix.Init(`{"index_dir":"` + dir + `"}`); err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+func seqIds(docs []search.Document) []int {
+	var ids []int
+	for _, doc := range docs {
+		ids = append(ids, doc.SeqId)
+	}
+	return ids
+}
+
+func expectFound(t *testing.T, ix *indexer, topics []string, user types.Uid, words []string, expected ...int) {
+	t.Helper()
+	docs, err := ix.Search(topics, user, words, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := seqIds(docs)
+	if len(found) != len(expected) {
+		t.Fatalf("Search(%v): expected %v, found %v", words, expected, found)
+	}
+	for i := range found {
+		if found[i] != expected[i] {
+			t.Fatalf("Search(%v): expected %v, found %v", words, expected, found)
+		}
+	}
+}
+
+func TestIndexSearchDelete(t *testing.T) {
+	dir := t.TempDir()
+	ix := openIndex(t, dir)
+
+	now := time.Now().UTC().Round(time.Millisecond)
+	texts := []string{"Lunch on Friday?", "No lunch today", "Friday it is, lunch at noon"}
+	for i, text := range texts {
+		if err := ix.Index(&search.Document{
+			Topic:     "grpTest",
+			SeqId:     i + 1,
+			From:      "usr1",
+			CreatedAt: now.Add(time.Duration(i) * time.Minute),
+			Text:      text,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ix.Index(&search.Document{Topic: "grpOther", SeqId: 1, CreatedAt: now, Text: "lunch friday"})
+
+	topics := []string{"grpTest"}
+	user := types.Uid(1)
+
+	// Most recent first, other topics are not searched.
+	expectFound(t, ix, topics, user, []string{"lunch"}, 3, 2, 1)
+	expectFound(t, ix, topics, user, []string{"friday", "lunch"}, 3, 1)
+	expectFound(t, ix, topics, user, []string{"dinner"})
+
+	docs, _ := ix.Search(topics, user, []string{"noon"}, 1)
+	if len(docs) != 1 || docs[0].Text != texts[2] || docs[0].From != "usr1" || !docs[0].CreatedAt.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("Unexpected result %+v", docs)
+	}
+
+	// Edited message replaces the old text.
+	ix.Index(&search.Document{Topic: "grpTest", SeqId: 1, CreatedAt: now, Text: "Dinner on Friday?"})
+	expectFound(t, ix, topics, user, []string{"friday", "lunch"}, 3)
+	expectFound(t, ix, topics, user, []string{"dinner"}, 1)
+
+	// Deleted for one user only.
+	ix.Delete("grpTest", user, []types.Range{{Low: 3}})
+	expectFound(t, ix, topics, user, []string{"lunch"}, 2)
+	expectFound(t, ix, topics, types.Uid(2), []string{"lunch"}, 3, 2)
+
+	// Deleted for everyone.
+	ix.Delete("grpTest", types.ZeroUid, []types.Range{{Low: 2, Hi: 4}})
+	expectFound(t, ix, topics, types.Uid(2), []string{"lunch"})
+
+	// The index is restored from the journal.
+	ix.Close()
+	ix = openIndex(t, dir)
+	expectFound(t, ix, topics, types.Uid(2), []string{"friday"}, 1)
+	expectFound(t, ix, []string{"grpOther"}, user, []string{"friday"}, 1)
+
+	// All messages of the topic.
+	ix.Delete("grpOther", types.ZeroUid, nil)
+	expectFound(t, ix, []string{"grpOther"}, user, []string{"friday"})
+	ix.Close()
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	ix := openIndex(t, dir)
+
+	for i := 1; i <= 10; i++ {
+		ix.Index(&search.Document{Topic: "grpTest", SeqId: i, CreatedAt: time.Now(), Text: "hello world"})
+	}
+	ix.Delete("grpTest", types.Uid(1), []types.Range{{Low: 1}})
+	ix.Delete("grpTest", types.ZeroUid, []types.Range{{Low: 2, Hi: 10}})
+	ix.Close()
+
+	before, _ := os.Stat(filepath.Join(dir, journalName))
+	ix = openIndex(t, dir)
+	defer ix.Close()
+	after, _ := os.Stat(filepath.Join(dir, journalName))
+	if after.Size() >= before.Size() {
+		t.Errorf("Journal is not compacted: %d bytes before, %d after", before.Size(), after.Size())
+	}
+	if ix.garbage != 0 {
+		t.Errorf("Compacted journal has %d bytes of garbage", ix.garbage)
+	}
+
+	// Deletions for a single user survive compaction.
+	expectFound(t, ix, []string{"grpTest"}, types.Uid(1), []string{"hello"}, 10)
+	expectFound(t, ix, []string{"grpTest"}, types.Uid(2), []string{"hello"}, 10, 1)
+}
+
+func TestIncompleteRecord(t *testing.T) {
+	dir := t.TempDir()
+	ix := openIndex(t, dir)
+	ix.Index(&search.Document{Topic: "grpTest", SeqId: 1, CreatedAt: time.Now(), Text: "hello"})
+	ix.Close()
+
+	// Simulate a crash in the middle of writing a record.
+	f, _ := os.OpenFile(filepath.Join(dir, journalName), os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"op":"i","topic":"grpTest","seq":2,"te`)
+	f.Close()
+
+	ix = openIndex(t, dir)
+	defer ix.Close()
+	expectFound(t, ix, []string{"grpTest"}, types.Uid(1), []string{"hello"}, 1)
+
+	// New records are written after the last complete one.
+	ix.Index(&search.Document{Topic: "grpTest", SeqId: 2, CreatedAt: time.Now(), Text: "hello again"})
+	expectFound(t, ix, []string{"grpTest"}, types.Uid(1), []string{"again"}, 2)
+}
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
@@ -0,0 +1,52 @@
+// Package search defines an interface which must be implemented by external full-text indexes of messages.
+package search
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Document is a message as seen by the index.
+type Document struct {
+	// Topic of the message as stored in the DB, i.e. 'p2p' or 'grp', never 'usr' or 'chn'.
+	Topic string
+	// Topic-unique ID of the message.
+	SeqId int
+	// ID of the sender.
+	From string
+	// Time when the message was sent.
+	CreatedAt time.Time
+	// Plain text of the message content.
+	Text string
+}
+
+// Indexer is an interface which must be implemented by message indexes.
+type Indexer interface {
+	// Init initializes the indexer.
+	Init(jsconf string) error
+
+	// Close flushes and releases resources used by the indexer.
+	Close() error
+
+	// Index adds the message to the index replacing the earlier version of the same message, if any.
+	Index(doc *Document) error
+
+	// Delete removes messages from the index. If forUser is not zero, the messages are removed for the given
+	// user only, i.e. they are no longer returned to that user. If ranges are empty, all messages of the topic
+	// are removed.
+	Delete(topic string, forUser types.Uid, ranges []types.Range) error
+
+	// Search finds messages in the given topics which contain all of the given lowercase words, most recent first.
+	// Messages removed for forUser are skipped.
+	Search(topics []string, forUser types.Uid, words []string, limit int) ([]Document, error)
+}
+
+// Words splits text into lowercase words. Anything but letters and digits is a separator.
+func Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -107,6 +107,9 @@ type Session struct {
 	// Authentication level - NONE (unset), ANON, AUTH, ROOT.
 	authLvl auth.Level
 
+	// ID of the login if the session is authenticated with a revocable token.
+	loginId string
+
 	// Time when the long polling session was last refreshed
 	lastTouched time.Time
 
@@ -884,16 +887,35 @@ func (s *Session) acc(msg *ClientComMessage) {
 		if authHdl == nil {
 			logs.Warn.Println("s.acc: unknown authentication scheme", msg.Acc.TmpScheme, s.sid)
 			s.queueOut(ErrAuthUnknownScheme(msg.Id, "", msg.Timestamp))
+			return
 		}
 
+		var lockout time.Duration
 		var err error
-		rec, _, err = authHdl.Authenticate(msg.Acc.TmpSecret, s.remoteAddr)
+		rec, _, lockout, err = globals.loginLimiter.authenticate(authHdl, msg.Acc.TmpSecret, s.remoteAddr)
 		if err != nil {
-			s.queueOut(decodeStoreError(err, msg.Acc.Id, msg.Timestamp,
-				map[string]any{"what": "auth"}))
+			params := map[string]any{"what": "auth"}
+			if err == types.ErrTooManyAttempts {
+				logs.Info.Println("s.acc: blocked after failed attempts", s.remoteAddr, s.sid)
+				params["retry"] = int(lockout.Seconds()) + 1
+			}
+			s.queueOut(decodeStoreError(err, msg.Acc.Id, msg.Timestamp, params))
 			logs.Warn.Println("s.acc: invalid temp auth", err, s.sid)
 			return
 		}
+
+		// Temporary credentials, such as reset codes, do not bypass the second factor. The client
+		// repeats the request with tmpscheme="totp" and the response to the challenge.
+		challenge, err := secondFactorChallenge(msg.Acc.TmpScheme, rec)
+		if err != nil {
+			logs.Warn.Println("s.acc: failed to issue second factor challenge", rec.Uid, err, s.sid)
+			s.queueOut(decodeStoreError(err, msg.Acc.Id, msg.Timestamp, nil))
+			return
+		}
+		if challenge != nil {
+			s.queueOut(InfoChallenge(msg.Acc.Id, msg.Timestamp, challenge))
+			return
+		}
 	}
 
 	if newAcc {
@@ -932,9 +954,14 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
-	rec, challenge, err := handler.Authenticate(msg.Login.Secret, s.remoteAddr)
+	rec, challenge, lockout, err := globals.loginLimiter.authenticate(handler, msg.Login.Secret, s.remoteAddr)
 	if err != nil {
-		resp := decodeStoreError(err, msg.Id, msg.Timestamp, nil)
+		var params map[string]any
+		if err == types.ErrTooManyAttempts {
+			logs.Info.Println("s.login: blocked after failed attempts", s.remoteAddr, s.sid)
+			params = map[string]any{"retry": int(lockout.Seconds()) + 1}
+		}
+		resp := decodeStoreError(err, msg.Id, msg.Timestamp, params)
 		if resp.Ctrl.Code >= 500 {
 			// Log internal errors
 			logs.Warn.Println("s.login: internal", err, s.sid)
@@ -943,6 +970,12 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
+	if rec == nil && challenge != nil {
+		// The user is not known yet, like in the first step of a passkey login.
+		s.queueOut(InfoChallenge(msg.Id, msg.Timestamp, challenge))
+		return
+	}
+
 	// If authenticator did not check user state, it returns state "undef". If so, check user state here.
 	if rec.State == types.StateUndefined {
 		rec.State, err = userGetState(rec.Uid)
@@ -957,12 +990,24 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
+	if challenge == nil && rec.Features&auth.FeatureNoLogin == 0 {
+		// Require the second factor if the user is enrolled.
+		if challenge, err = secondFactorChallenge(msg.Login.Scheme, rec); err != nil {
+			logs.Warn.Println("s.login: failed to issue second factor challenge", rec.Uid, err, s.sid)
+			s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
+			return
+		}
+	}
+
 	if challenge != nil {
 		// Multi-stage authentication. Issue challenge to the client.
 		s.queueOut(InfoChallenge(msg.Id, msg.Timestamp, challenge))
 		return
 	}
 
+	// All authentication steps are completed.
+	globals.loginLimiter.succeeded(handler, rec.Uid)
+
 	var missing []string
 	if rec.Features&auth.FeatureValidated == 0 && len(globals.authValidators[rec.AuthLevel]) > 0 {
 		var validated []string
@@ -980,6 +1025,17 @@ func (s *Session) login(msg *ClientComMessage) {
 	}
 }
 
+// secondFactorChallenge returns a challenge if the user authenticated by the given scheme must also
+// provide the second factor. Token logins are not challenged: tokens are issued after the second factor.
+func secondFactorChallenge(scheme string, rec *auth.Rec) ([]byte, error) {
+	hdl := globals.secondFactor
+	if hdl == nil || scheme == "token" || store.Store.GetLogicalAuthHandler(scheme) == hdl {
+		return nil, nil
+	}
+	challenge, _, err := hdl.GenSecret(rec)
+	return challenge, err
+}
+
 // authSecretReset resets an authentication secret;
 // params: "auth-method-to-reset:credential-method:credential-value",
 // for example: "basic:email:alice@example.com".
@@ -1055,19 +1111,45 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 
 		params["cred"] = missing
 	} else {
-		// Everything is fine, authenticate the session.
+		// Everything is fine, the session is authenticated once the token is issued.
 
 		reply = NoErr(msgID, "", timestamp)
 
 		// Check if the token is suitable for session authentication.
 		if features&auth.FeatureNoLogin == 0 {
-			// Authenticate the session.
-			s.uid = rec.Uid
-			s.authLvl = rec.AuthLevel
 			// Reset expiration time.
 			rec.Lifetime = 0
 		}
 		features |= auth.FeatureValidated
+	}
+
+	// Describe the client in the record of a revocable token. The record is reused if the session
+	// logged in with a token.
+	if rec.Login == nil {
+		rec.Login = &types.Login{}
+	}
+	rec.Login.UserAgent = s.userAgent
+	rec.Login.RemoteAddr = s.remoteAddr
+	rec.Login.DeviceId = s.deviceID
+
+	// GenSecret fails if tokenLifetime is < 0, but it can't be < 0 here, otherwise login would
+	// have failed earlier, or if the record of a revocable token cannot be saved.
+	rec.Features = features
+	token, expires, err := store.Store.GetLogicalAuthHandler("token").GenSecret(rec)
+	if err != nil {
+		logs.Warn.Println("s.onLogin: failed to issue token", err, s.sid)
+		return decodeStoreError(err, msgID, timestamp, nil)
+	}
+	params["token"], params["expires"] = token, expires
+
+	if len(missing) == 0 {
+		if features&auth.FeatureNoLogin == 0 {
+			// Authenticate the session.
+			s.uid = rec.Uid
+			s.authLvl = rec.AuthLevel
+			// Sessions are evicted when the login is revoked.
+			s.loginId = rec.Login.Id
+		}
 
 		// Record deviceId used in this session
 		if s.deviceID != "" {
@@ -1082,11 +1164,6 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 		}
 	}
 
-	// GenSecret fails only if tokenLifetime is < 0. It can't be < 0 here,
-	// otherwise login would have failed earlier.
-	rec.Features = features
-	params["token"], params["expires"], _ = store.Store.GetLogicalAuthHandler("token").GenSecret(rec)
-
 	reply.Ctrl.Params = params
 	return reply
 }
@@ -1269,6 +1346,14 @@ func (s *Session) note(msg *ClientComMessage) {
 		if msg.Note.SeqId <= 0 {
 			return
 		}
+		// Position in a thread can be reported for "read" only.
+		if msg.Note.Thread < 0 || (msg.Note.Thread > 0 && msg.Note.What != "read") {
+			return
+		}
+	case "react":
+		if msg.Note.SeqId <= 0 || !validReaction(msg.Note.React) {
+			return
+		}
 	default:
 		return
 	}
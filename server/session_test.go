@@ -219,6 +219,55 @@ func TestDispatchLogin(t *testing.T) {
 	}
 }
 
+// The login fails if the token cannot be issued.
+func TestDispatchLoginTokenFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	aa := mock_auth.NewMockAuthHandler(ctrl)
+
+	store.Store = ss
+	defer func() {
+		store.Store = nil
+		ctrl.Finish()
+	}()
+
+	secret := "<==auth-secret==>"
+	authRec := &auth.Rec{
+		Uid:       types.Uid(1),
+		AuthLevel: auth.LevelAuth,
+		State:     types.StateOK,
+	}
+	ss.EXPECT().GetLogicalAuthHandler("basic").Return(aa)
+	aa.EXPECT().Authenticate([]byte(secret), gomock.Any()).Return(authRec, nil, nil)
+	ss.EXPECT().GetLogicalAuthHandler("token").Return(aa)
+	aa.EXPECT().GenSecret(authRec).Return(nil, time.Time{}, types.ErrInternal)
+
+	s := &Session{
+		send:    make(chan any, 10),
+		authLvl: auth.LevelAuth,
+		ver:     16,
+	}
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	s.dispatch(&ClientComMessage{
+		Login: &MsgClientLogin{
+			Id:     "123",
+			Scheme: "basic",
+			Secret: []byte(secret),
+		},
+	})
+	close(s.send)
+	wg.Wait()
+
+	verifyResponseCodes(&r, []int{http.StatusInternalServerError}, t)
+	if !s.uid.IsZero() {
+		t.Errorf("Session is authenticated as %s without a token", s.uid)
+	}
+}
+
 func TestDispatchSubscribe(t *testing.T) {
 	uid := types.Uid(1)
 	s := test_makeSession(uid)
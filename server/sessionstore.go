@@ -241,6 +241,33 @@ func (ss *SessionStore) EvictUser(uid types.Uid, skipSid string) {
 	statsSet("LiveSessions", int64(len(ss.sessCache)))
 }
 
+// EvictLogins terminates sessions of a given user authenticated with any of the given logins.
+func (ss *SessionStore) EvictLogins(uid types.Uid, logins []string, skipSid string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	evicted := NoErrEvicted("", "", types.TimeNow())
+	evicted.AsUser = uid.UserId()
+	for _, s := range ss.sessCache {
+		if s.uid != uid || s.isMultiplex() || s.sid == skipSid || s.loginId == "" {
+			continue
+		}
+		for _, id := range logins {
+			if s.loginId == id {
+				_, data := s.serialize(evicted)
+				s.stopSession(data)
+				delete(ss.sessCache, s.sid)
+				if s.proto == LPOLL {
+					ss.lru.Remove(s.lpTracker)
+				}
+				break
+			}
+		}
+	}
+
+	statsSet("LiveSessions", int64(len(ss.sessCache)))
+}
+
 // NodeRestarted removes stale sessions from a restarted cluster node.
 //   - nodeName is the name of affected node
 //   - fingerprint is the new fingerprint of the node.
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+func TestEvictLogins(t *testing.T) {
+	ss := &SessionStore{lru: list.New(), sessCache: make(map[string]*Session)}
+	alice, bob := types.Uid(1), types.Uid(2)
+
+	add := func(sid string, uid types.Uid, loginId string, proto SessionProto) *Session {
+		s := &Session{sid: sid, uid: uid, loginId: loginId, proto: proto, stop: make(chan any, 1)}
+		if proto == LPOLL {
+			s.lpTracker = ss.lru.PushFront(s)
+		}
+		ss.sessCache[sid] = s
+		return s
+	}
+	evicted := []*Session{
+		add("ws", alice, "one", WEBSOCK),
+		add("lp", alice, "one", LPOLL),
+		add("ws2", alice, "two", WEBSOCK),
+	}
+	kept := []*Session{
+		// The session which revoked the logins.
+		add("self", alice, "one", WEBSOCK),
+		add("other-login", alice, "three", WEBSOCK),
+		// Logged in with a non-revocable token or by another scheme.
+		add("no-login", alice, "", WEBSOCK),
+		add("bob", bob, "one", WEBSOCK),
+		add("multi", alice, "one", MULTIPLEX),
+	}
+
+	ss.EvictLogins(alice, []string{"one", "two"}, "self")
+
+	for _, s := range evicted {
+		if _, found := ss.sessCache[s.sid]; found {
+			t.Errorf("Session %s is not evicted", s.sid)
+		}
+		if len(s.stop) != 1 {
+			t.Errorf("Session %s is not stopped", s.sid)
+		}
+	}
+	for _, s := range kept {
+		if _, found := ss.sessCache[s.sid]; !found {
+			t.Errorf("Session %s is evicted", s.sid)
+		}
+		if len(s.stop) != 0 {
+			t.Errorf("Session %s is stopped", s.sid)
+		}
+	}
+	if ss.lru.Len() != 0 {
+		t.Error("Long polling session is left in LRU list")
+	}
+}
@@ -0,0 +1,504 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Archived messages are kept in segment files uploaded through the media handler. A segment holds a
+// contiguous range of messages of one topic as gzip-compressed JSON, one message with its earlier revisions
+// per line. In the database the messages are replaced with stubs which keep seq IDs and links to the segment,
+// so the segment is deleted together with the topic. Hard-deleting archived messages replaces the segment
+// with a new one without them. The list of segments of a topic is kept in the persistent cache.
+
+const (
+	// ArchiveKeyPrefix is the prefix of persistent cache keys with the list of archive segments of a topic.
+	ArchiveKeyPrefix = "msgarchive:"
+	// Number of messages to return when the query has no limit. Same as the default of DB adapters.
+	defaultMessageLimit = 100
+)
+
+// archiveSegment describes one segment file.
+type archiveSegment struct {
+	// Range of seq IDs of archived messages, inclusive-exclusive.
+	Low int `json:"low"`
+	Hi  int `json:"hi"`
+	// ID of the file record.
+	File string `json:"file"`
+	// Number of messages in the segment.
+	Count int `json:"count"`
+}
+
+// archivedMessage is one line of the segment file.
+type archivedMessage struct {
+	types.Message
+	// Earlier revisions of the message, oldest first.
+	Revisions []types.Message `json:"revisions,omitempty"`
+}
+
+// Lists of segments are changed by the archiver and by hard deletes. Both run on the master node of the topic
+// and are serialized by the locks.
+var archiveLocks [64]sync.Mutex
+
+// archiveLock returns the lock for the list of segments of the topic.
+func archiveLock(topic string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return &archiveLocks[h.Sum32()%uint32(len(archiveLocks))]
+}
+
+// Archive moves 'count' oldest messages of the topic to a new segment file, provided all of them were
+// created before 'olderThan'. Returns the number of archived messages, i.e. 0 or 'count'. Nothing is
+// archived if the messages are edited or deleted while the segment is written.
+func (messagesMapper) Archive(topic string, olderThan time.Time, count int) (int, error) {
+	if mediaHandler == nil {
+		return 0, types.ErrUnsupported
+	}
+	if count <= 0 {
+		return 0, types.ErrMalformed
+	}
+
+	// Changes made after this moment are not in the segment.
+	startedAt := types.TimeNow()
+
+	segments, err := archiveSegments(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	// Live messages follow the last segment. Skip the stubs of archived messages.
+	after := 0
+	if len(segments) > 0 {
+		after = segments[len(segments)-1].Hi - 1
+	}
+	var msgs []types.Message
+	for len(msgs) < count {
+		page, err := adp.MessageExport(topic, types.ZeroUid, after, count)
+		if err != nil {
+			return 0, err
+		}
+		for i := range page {
+			if page[i].DelId == 0 {
+				msgs = append(msgs, page[i])
+			}
+		}
+		if len(page) < count {
+			break
+		}
+		after = page[len(page)-1].SeqId
+	}
+	if len(msgs) < count || !msgs[count-1].CreatedAt.Before(olderThan) {
+		// Small segments are not worth the trouble.
+		return 0, nil
+	}
+	msgs = msgs[:count]
+
+	archived := make([]archivedMessage, count)
+	for i := range msgs {
+		archived[i].Message = msgs[i]
+		if msgs[i].UpdatedAt.After(msgs[i].CreatedAt) {
+			if archived[i].Revisions, err = adp.MessageGetRevisions(topic, msgs[i].SeqId); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	fid, err := writeArchiveSegment(archived)
+	if err != nil {
+		return 0, err
+	}
+
+	lock := archiveLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The list could have been changed by a hard delete while the segment was written.
+	if segments, err = archiveSegments(topic); err != nil {
+		return 0, err
+	}
+
+	// The segment must be listed before the messages are replaced with stubs, otherwise the messages
+	// would disappear if the list cannot be updated.
+	seg := archiveSegment{Low: msgs[0].SeqId, Hi: msgs[count-1].SeqId + 1, File: fid, Count: count}
+	if err = saveArchiveSegments(topic, append(segments, seg)); err != nil {
+		// The segment file is not linked to anything. It will be garbage collected.
+		return 0, err
+	}
+
+	if err = adp.MessageArchive(topic, types.Range{Low: seg.Low, Hi: seg.Hi}, fid, startedAt); err != nil {
+		if serr := saveArchiveSegments(topic, segments); serr != nil {
+			logs.Warn.Printf("topic[%s]: failed to restore list of archive segments: %v", topic, serr)
+		}
+		if err == types.ErrConflict {
+			// The messages were changed. They will be archived next time.
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// deleteArchived removes hard-deleted messages from the segments of the topic. Segments are replaced with
+// new ones without the deleted messages or dropped if no messages are left. Replaced segment files are no
+// longer linked to the stubs and will be garbage collected. All messages are deleted if 'ranges' is empty.
+func deleteArchived(topic string, ranges []types.Range) error {
+	lock := archiveLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	segments, err := archiveSegments(topic)
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	if len(ranges) == 0 {
+		return saveArchiveSegments(topic, nil)
+	}
+
+	var keep []archiveSegment
+	for i, seg := range segments {
+		if seg, err = rewriteArchiveSegment(topic, seg, ranges); err != nil {
+			// Segments which were already replaced must be saved.
+			keep = append(keep, segments[i:]...)
+			break
+		}
+		if seg.Count > 0 {
+			keep = append(keep, seg)
+		}
+	}
+	if serr := saveArchiveSegments(topic, keep); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// rewriteArchiveSegment writes a new segment without the messages in the ranges and moves the links of the
+// stubs to it. Returns the updated segment, with zero count if no messages are left.
+func rewriteArchiveSegment(topic string, seg archiveSegment, ranges []types.Range) (archiveSegment, error) {
+	overlaps := false
+	for _, r := range ranges {
+		hi := r.Hi
+		if hi <= r.Low {
+			hi = r.Low + 1
+		}
+		if r.Low < seg.Hi && hi > seg.Low {
+			overlaps = true
+			break
+		}
+	}
+	if !overlaps {
+		return seg, nil
+	}
+
+	archived, err := readArchiveSegment(seg.File)
+	if err != nil {
+		return seg, err
+	}
+	remaining := archived[:0]
+	for i := range archived {
+		if !inRanges(archived[i].SeqId, ranges) {
+			remaining = append(remaining, archived[i])
+		}
+	}
+	if len(remaining) == len(archived) {
+		return seg, nil
+	}
+	if len(remaining) == 0 {
+		// The stubs were hard-deleted and no longer link to the segment.
+		seg.Count = 0
+		return seg, nil
+	}
+
+	fid, err := writeArchiveSegment(remaining)
+	if err != nil {
+		return seg, err
+	}
+	if err = adp.FileRelinkMessages(topic, seg.File, fid); err != nil {
+		return seg, err
+	}
+	seg.File, seg.Count = fid, len(remaining)
+	return seg, nil
+}
+
+// archivedRevisions returns earlier revisions of the archived message, oldest first.
+func archivedRevisions(topic string, seqId int) ([]types.Message, error) {
+	segments, err := archiveSegments(topic)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		if seqId < seg.Low || seqId >= seg.Hi {
+			continue
+		}
+		archived, err := readArchiveSegment(seg.File)
+		if err != nil {
+			return nil, err
+		}
+		for i := range archived {
+			if archived[i].SeqId == seqId {
+				return archived[i].Revisions, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// writeArchiveSegment writes messages to a new segment file. Returns ID of the file.
+func writeArchiveSegment(msgs []archivedMessage) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for i := range msgs {
+		if err := enc.Encode(&msgs[i]); err != nil {
+			return "", err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	fdef := &types.FileDef{
+		ObjHeader: types.ObjHeader{
+			Id: Store.GetUidString(),
+		},
+		MimeType: "application/gzip",
+	}
+	fdef.InitTimes()
+
+	_, size, err := mediaHandler.Upload(fdef, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		Files.FinishUpload(fdef, false, 0)
+		return "", err
+	}
+	if _, err = Files.FinishUpload(fdef, true, size); err != nil {
+		return "", err
+	}
+	return fdef.Id, nil
+}
+
+// readArchiveSegment reads messages from the segment file in ascending order.
+func readArchiveSegment(fid string) ([]archivedMessage, error) {
+	_, rsc, err := mediaHandler.Download(fid)
+	if err != nil {
+		return nil, err
+	}
+	defer rsc.Close()
+
+	zr, err := gzip.NewReader(rsc)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(zr)
+	var msgs []archivedMessage
+	for {
+		var msg archivedMessage
+		if err = dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// archiveSegments reads the list of segments of the topic, oldest first.
+func archiveSegments(topic string) ([]archiveSegment, error) {
+	val, err := adp.PCacheGet(ArchiveKeyPrefix + topic)
+	if err == types.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []archiveSegment
+	if err = json.Unmarshal([]byte(val), &segments); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// saveArchiveSegments replaces the list of segments of the topic.
+func saveArchiveSegments(topic string, segments []archiveSegment) error {
+	if len(segments) == 0 {
+		return adp.PCacheDelete(ArchiveKeyPrefix + topic)
+	}
+	val, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+	return adp.PCacheUpsert(ArchiveKeyPrefix+topic, string(val), false)
+}
+
+// appendArchived fills the page of live messages returned by the adapter with archived messages which
+// match the query. Archived messages are always older than the live ones.
+func appendArchived(topic string, forUser types.Uid, opt *types.QueryOpt, msgs []types.Message) ([]types.Message, error) {
+	var query types.QueryOpt
+	if opt != nil {
+		query = *opt
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultMessageLimit
+	}
+	if len(msgs) >= limit {
+		return msgs, nil
+	}
+	if len(msgs) > 0 {
+		query.Before = msgs[len(msgs)-1].SeqId
+	}
+	if query.Before == 1 || (query.Before > 0 && query.Before <= query.Since) {
+		// Nothing left in the range.
+		return msgs, nil
+	}
+
+	segments, err := archiveSegments(topic)
+	if err != nil {
+		return msgs, err
+	}
+	var found []archiveSegment
+	for _, seg := range segments {
+		if seg.Hi > query.Since && (query.Before == 0 || seg.Low < query.Before) {
+			found = append(found, seg)
+		}
+	}
+	if len(found) == 0 {
+		return msgs, nil
+	}
+
+	if len(msgs) > 0 {
+		// The adapter could have returned fewer messages than requested. Make sure no live
+		// messages are skipped.
+		more, err := adp.MessageGetAll(topic, forUser,
+			&types.QueryOpt{Since: query.Since, Before: query.Before, Thread: query.Thread, Limit: 1})
+		if err != nil || len(more) > 0 {
+			return msgs, err
+		}
+	}
+
+	deleted, err := deletedRanges(topic, forUser)
+	if err != nil {
+		return msgs, err
+	}
+
+	for i := len(found) - 1; i >= 0 && len(msgs) < limit; i-- {
+		archived, err := readArchiveSegment(found[i].File)
+		if err != nil {
+			// Return what's available: failure to read the archive should not block the newer messages.
+			logs.Warn.Printf("topic[%s]: failed to read archived messages %d..%d: %v",
+				topic, found[i].Low, found[i].Hi, err)
+			break
+		}
+		for j := len(archived) - 1; j >= 0 && len(msgs) < limit; j-- {
+			msg := &archived[j]
+			if msg.SeqId < query.Since || (query.Before > 0 && msg.SeqId >= query.Before) ||
+				(query.Thread > 0 && msg.Thread != query.Thread) || inRanges(msg.SeqId, deleted) {
+				continue
+			}
+			// Fields which are not returned for live messages.
+			msg.PlainText = ""
+			msg.Attachments = nil
+			msgs = append(msgs, msg.Message)
+		}
+	}
+	return msgs, nil
+}
+
+// exportArchived replaces stubs of archived messages in the page returned by the adapter with the
+// messages from the archive. Hard-deleted messages are skipped.
+func exportArchived(topic string, msgs []types.Message) ([]types.Message, error) {
+	var segments []archiveSegment
+	var deleted []types.Range
+	// Current segment.
+	var archived []archivedMessage
+	var seg archiveSegment
+
+	out := msgs[:0]
+	for _, msg := range msgs {
+		if msg.DelId != types.MsgDelIdArchived {
+			out = append(out, msg)
+			continue
+		}
+
+		if segments == nil {
+			var err error
+			if segments, err = archiveSegments(topic); err != nil {
+				return nil, err
+			}
+			if deleted, err = deletedRanges(topic, types.ZeroUid); err != nil {
+				return nil, err
+			}
+		}
+		if msg.SeqId < seg.Low || msg.SeqId >= seg.Hi {
+			seg, archived = archiveSegment{}, nil
+			for _, s := range segments {
+				if msg.SeqId >= s.Low && msg.SeqId < s.Hi {
+					seg = s
+					break
+				}
+			}
+			if seg.File == "" {
+				// Stub without a segment.
+				continue
+			}
+			var err error
+			if archived, err = readArchiveSegment(seg.File); err != nil {
+				return nil, err
+			}
+		}
+		if inRanges(msg.SeqId, deleted) {
+			continue
+		}
+		for i := range archived {
+			if archived[i].SeqId == msg.SeqId {
+				out = append(out, archived[i].Message)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// deletedRanges returns ranges of all messages deleted in the topic for everyone or for the given user.
+func deletedRanges(topic string, forUser types.Uid) ([]types.Range, error) {
+	var ranges []types.Range
+	for since := 0; ; {
+		dmsgs, err := adp.MessageGetDeleted(topic, forUser, &types.QueryOpt{Since: since})
+		if err != nil {
+			return nil, err
+		}
+		if len(dmsgs) == 0 {
+			break
+		}
+		next := since
+		for i := range dmsgs {
+			ranges = append(ranges, dmsgs[i].SeqIdRanges...)
+			next = dmsgs[i].DelId
+		}
+		// The ranges of the last delete could be cut by the limit, read them again.
+		if next == since {
+			next++
+		}
+		since = next
+	}
+	return ranges, nil
+}
+
+// inRanges checks if the seq ID falls into any of the ranges.
+func inRanges(seqId int, ranges []types.Range) bool {
+	for _, r := range ranges {
+		if seqId == r.Low || (seqId > r.Low && seqId < r.Hi) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package store_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/media"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// memMedia is a media handler which keeps files in memory.
+type memMedia struct {
+	files map[string][]byte
+}
+
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error { return nil }
+
+func (mm *memMedia) Init(jsconf string) error { return nil }
+func (mm *memMedia) Headers(req *http.Request, serve bool) (http.Header, int, error) {
+	return nil, 0, nil
+}
+func (mm *memMedia) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, int64, error) {
+	fdef.Location = "mem/" + fdef.Id
+	if err := store.Files.StartUpload(fdef); err != nil {
+		return "", 0, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", 0, err
+	}
+	mm.files[fdef.Id] = data
+	return "/v0/file/s/" + fdef.Id, int64(len(data)), nil
+}
+func (mm *memMedia) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	data, ok := mm.files[mm.GetIdFromUrl(url).String()]
+	if !ok {
+		return nil, nil, types.ErrNotFound
+	}
+	return nil, memFile{bytes.NewReader(data)}, nil
+}
+func (mm *memMedia) Delete(locations []string) error { return nil }
+func (mm *memMedia) GetIdFromUrl(url string) types.Uid {
+	return media.GetIdFromUrl(url, "/v0/file/s/")
+}
+
+// archiveTopic creates a topic with messages "1".."10" and moves the messages 1..6 to two segments.
+func archiveTopic(t *testing.T) (string, types.Uid) {
+	t.Helper()
+	resetDb(t)
+
+	alice := createUser(t, "Alice")
+	topic := createTopic(t, alice)
+	saveMessages(t, topic, alice, "1", "2", "3", "4", "5", "6", "7", "8", "9", "10")
+	for i := 0; i < 2; i++ {
+		if count, err := store.Messages.Archive(topic, types.TimeNow(), 3); count != 3 || err != nil {
+			t.Fatal("Archive:", count, err)
+		}
+	}
+	return topic, alice
+}
+
+// segments returns the list of archive segments of the topic.
+func segments(t *testing.T, topic string) []map[string]any {
+	t.Helper()
+	val, err := store.PCache.Get(store.ArchiveKeyPrefix + topic)
+	if err == types.ErrNotFound {
+		return nil
+	}
+	var list []map[string]any
+	if err == nil {
+		err = json.Unmarshal([]byte(val), &list)
+	}
+	if err != nil {
+		t.Fatal("segments:", err)
+	}
+	return list
+}
+
+// contents returns contents of the messages.
+func contents(msgs []types.Message) []string {
+	var out []string
+	for i := range msgs {
+		out = append(out, msgs[i].Content.(string))
+	}
+	return out
+}
+
+// Pages of messages continue from live messages into archive segments.
+func TestArchivePaging(t *testing.T) {
+	defer store.SetMediaHandler(&memMedia{files: make(map[string][]byte)})()
+	topic, alice := archiveTopic(t)
+
+	if list := segments(t, topic); len(list) != 2 {
+		t.Fatal("Expected 2 segments, got", list)
+	}
+	if archived, err := store.Messages.HasArchive(topic); !archived || err != nil {
+		t.Error("HasArchive: expected true, got", archived, err)
+	}
+	// Topics known to have no archive return live messages only.
+	msgs, err := store.Messages.GetAll(topic, alice, &types.QueryOpt{Before: 9}, false)
+	if want := []string{"8", "7"}; err != nil || !reflect.DeepEqual(contents(msgs), want) {
+		t.Errorf("GetAll without archive: expected %v, got %v (%v)", want, contents(msgs), err)
+	}
+
+	var pages [][]string
+	for before := 0; ; {
+		msgs, err := store.Messages.GetAll(topic, alice, &types.QueryOpt{Before: before, Limit: 4}, true)
+		if err != nil {
+			t.Fatal("GetAll:", err)
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		pages = append(pages, contents(msgs))
+		before = msgs[len(msgs)-1].SeqId
+	}
+	want := [][]string{{"10", "9", "8", "7"}, {"6", "5", "4", "3"}, {"2", "1"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("Pages: expected %v, got %v", want, pages)
+	}
+
+	// Range inside the archive.
+	msgs, err = store.Messages.GetAll(topic, alice, &types.QueryOpt{Since: 2, Before: 5}, true)
+	if want := []string{"4", "3", "2"}; err != nil || !reflect.DeepEqual(contents(msgs), want) {
+		t.Errorf("GetAll 2..5: expected %v, got %v (%v)", want, contents(msgs), err)
+	}
+
+	// Messages deleted for the user are skipped in the archive too.
+	if err := store.Messages.DeleteList(topic, 1, alice, []types.Range{{Low: 5}}); err != nil {
+		t.Fatal("DeleteList:", err)
+	}
+	msgs, err = store.Messages.GetAll(topic, alice, &types.QueryOpt{Before: 7}, true)
+	if want := []string{"6", "4", "3", "2", "1"}; err != nil || !reflect.DeepEqual(contents(msgs), want) {
+		t.Errorf("GetAll deleted for user: expected %v, got %v (%v)", want, contents(msgs), err)
+	}
+
+	// Export replaces the stubs with archived messages.
+	msgs, err = store.Messages.Export(topic, types.ZeroUid, 0, 4)
+	if want := []string{"1", "2", "3", "4"}; err != nil || !reflect.DeepEqual(contents(msgs), want) {
+		t.Errorf("Export: expected %v, got %v (%v)", want, contents(msgs), err)
+	}
+}
+
+// Earlier revisions of archived messages are kept in the segment.
+func TestArchiveRevisions(t *testing.T) {
+	resetDb(t)
+	defer store.SetMediaHandler(&memMedia{files: make(map[string][]byte)})()
+
+	alice := createUser(t, "Alice")
+	topic := createTopic(t, alice)
+	saveMessages(t, topic, alice, "1", "2", "3", "4")
+	edited := &types.Message{Topic: topic, SeqId: 2, From: alice.String(), Content: "2 edited"}
+	if err := store.Messages.Edit(edited, nil); err != nil {
+		t.Fatal("Edit:", err)
+	}
+	if archived, err := store.Messages.HasArchive(topic); archived || err != nil {
+		t.Error("HasArchive before archiving: expected false, got", archived, err)
+	}
+	// Edits made in the same millisecond as archiving starts are a conflict.
+	time.Sleep(2 * time.Millisecond)
+
+	if count, err := store.Messages.Archive(topic, types.TimeNow().Add(time.Second), 3); count != 3 || err != nil {
+		t.Fatal("Archive:", count, err)
+	}
+	if revs, err := store.Store.GetAdapter().MessageGetRevisions(topic, 2); err != nil || len(revs) != 0 {
+		t.Fatal("Revisions are left in the database:", revs, err)
+	}
+
+	revs, err := store.Messages.GetRevisions(topic, 2)
+	if want := []string{"2"}; err != nil || !reflect.DeepEqual(contents(revs), want) {
+		t.Errorf("GetRevisions: expected %v, got %v (%v)", want, contents(revs), err)
+	}
+	msgs, err := store.Messages.GetAll(topic, alice, &types.QueryOpt{Since: 2, Before: 3}, true)
+	if want := []string{"2 edited"}; err != nil || !reflect.DeepEqual(contents(msgs), want) {
+		t.Errorf("GetAll edited: expected %v, got %v (%v)", want, contents(msgs), err)
+	}
+}
+
+// Hard-deleted messages are removed from the segments.
+func TestArchiveHardDelete(t *testing.T) {
+	defer store.SetMediaHandler(&memMedia{files: make(map[string][]byte)})()
+	topic, alice := archiveTopic(t)
+	before := segments(t, topic)
+
+	err := store.Messages.DeleteList(topic, 1, types.ZeroUid, []types.Range{{Low: 2}, {Low: 4, Hi: 7}})
+	if err != nil {
+		t.Fatal("DeleteList:", err)
+	}
+
+	// The first segment is replaced, the second one is dropped.
+	after := segments(t, topic)
+	if len(after) != 1 || after[0]["file"] == before[0]["file"] || after[0]["count"] != float64(2) {
+		t.Fatalf("Segments after delete: %v, before: %v", after, before)
+	}
+	msgs, err := store.Messages.GetAll(topic, alice, nil, true)
+	if want := []string{"10", "9", "8", "7", "3", "1"}; err != nil || !reflect.DeepEqual(contents(msgs), want) {
+		t.Errorf("GetAll: expected %v, got %v (%v)", want, contents(msgs), err)
+	}
+
+	// Old segment files are no longer used.
+	locs, err := store.Store.GetAdapter().FileDeleteUnused(time.Now().Add(time.Minute), 10)
+	want := []string{"mem/" + before[0]["file"].(string), "mem/" + before[1]["file"].(string)}
+	if err != nil || len(locs) != 2 || !(reflect.DeepEqual(locs, want) || (locs[0] == want[1] && locs[1] == want[0])) {
+		t.Errorf("FileDeleteUnused: expected %v, got %v (%v)", want, locs, err)
+	}
+
+	// Deleting all archived messages drops the list.
+	if err = store.Messages.DeleteList(topic, 2, types.ZeroUid, []types.Range{{Low: 1, Hi: 4}}); err != nil {
+		t.Fatal("DeleteList all:", err)
+	}
+	if list := segments(t, topic); list != nil {
+		t.Error("Segments after deleting all archived messages:", list)
+	}
+}
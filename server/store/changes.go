@@ -0,0 +1,272 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/cdc"
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Changes made through the mappers are recorded as events in an outbox, then delivered to the configured
+// sink in the order of offsets. SQL adapters keep the outbox in a table and add the events in the
+// transaction of the change, so every committed change is delivered at least once. Other adapters keep
+// the outbox in the persistent cache and the events are added after the change, see
+// pendingChange.record. Delivered events are removed from the outbox, so the delivery resumes where it
+// stopped after a restart. Nothing is recorded if the sink is not configured.
+
+const (
+	// Prefix of persistent cache keys of the events recorded by adapters without the outbox table.
+	changeKeyPrefix = "cdc:"
+	// Events of other cluster nodes could be recorded with a delay. Events more recent than that are
+	// not delivered yet to keep the order of delivery close to the order of offsets.
+	changeDeliveryLag = 5 * time.Second
+	// Data of larger events is omitted. The database could limit the size of outbox and cache values to 64K.
+	maxChangeSize = 60000
+)
+
+// Registered event sinks.
+var changeSinks map[string]cdc.Sink
+
+// The sink in use.
+var changeSink cdc.Sink
+
+// Offsets of events recorded by this node are strictly increasing.
+var changeClock struct {
+	sync.Mutex
+	last int64
+}
+
+// RegisterChangeSink saves reference to a sink of change events.
+func RegisterChangeSink(name string, sink cdc.Sink) {
+	if changeSinks == nil {
+		changeSinks = make(map[string]cdc.Sink)
+	}
+
+	if sink == nil {
+		panic("RegisterChangeSink: sink is nil")
+	}
+	if _, dup := changeSinks[name]; dup {
+		panic("RegisterChangeSink: called twice for sink " + name)
+	}
+	changeSinks[name] = sink
+}
+
+// UseChangeSink enables recording of change events and sets the sink to deliver them to.
+func (storeObj) UseChangeSink(name, config string) error {
+	changeSink = changeSinks[name]
+	if changeSink == nil {
+		panic("UseChangeSink: unknown sink '" + name + "'")
+	}
+	return changeSink.Init(config)
+}
+
+// ChangesPersistenceInterface is an interface which defines methods for delivery of change events.
+type ChangesPersistenceInterface interface {
+	Deliver(limit int) (int, error)
+}
+
+// changesMapper is a concrete type implementing ChangesPersistenceInterface.
+type changesMapper struct{}
+
+// Changes is a singleton ancor object exporting ChangesPersistenceInterface methods.
+var Changes ChangesPersistenceInterface
+
+// Deliver sends up to 'limit' oldest recorded events to the sink and removes them from the outbox. Returns
+// the number of delivered events. Events are delivered at least once: if the sink fails, the same events
+// are delivered on the next call. Events recorded late by other nodes are delivered after the events with
+// higher offsets.
+func (changesMapper) Deliver(limit int) (int, error) {
+	if changeSink == nil {
+		return 0, types.ErrUnsupported
+	}
+
+	// Delivered events are removed: the outbox always starts with the events which are not delivered yet.
+	entries, err := adp.OutboxGet(limit)
+	cached := err == types.ErrUnsupported
+	if cached {
+		entries, err = cachedChanges(limit)
+	}
+	if err != nil {
+		return 0, err
+	}
+	horizon := changeOffset(time.Now().Add(-changeDeliveryLag).UnixMicro(), "")
+	var offsets []string
+	var events []cdc.Event
+	for _, entry := range entries {
+		if entry.Offset >= horizon {
+			break
+		}
+		offsets = append(offsets, entry.Offset)
+		var event cdc.Event
+		if err := json.Unmarshal([]byte(entry.Event), &event); err != nil {
+			logs.Warn.Printf("cdc: skipped malformed event %s: %v", entry.Offset, err)
+			continue
+		}
+		events = append(events, event)
+	}
+	if len(offsets) == 0 {
+		return 0, nil
+	}
+
+	if len(events) > 0 {
+		if err = changeSink.Deliver(events); err != nil {
+			return 0, err
+		}
+	}
+	if !cached {
+		if err = adp.OutboxDelete(offsets); err != nil {
+			// The events will be delivered again.
+			logs.Warn.Printf("cdc: failed to remove %d delivered events: %v", len(offsets), err)
+		}
+		return len(offsets), nil
+	}
+	for _, offset := range offsets {
+		if err = adp.PCacheDelete(changeKeyPrefix + offset); err != nil {
+			// The event will be delivered again.
+			logs.Warn.Printf("cdc: failed to remove delivered event %s: %v", offset, err)
+		}
+	}
+	return len(offsets), nil
+}
+
+// cachedChanges returns up to 'limit' oldest events from the outbox kept in the persistent cache.
+func cachedChanges(limit int) ([]adapter.OutboxEntry, error) {
+	cached, err := adp.PCacheExport(changeKeyPrefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	var entries []adapter.OutboxEntry
+	for _, entry := range cached {
+		if !strings.HasPrefix(entry.Key, changeKeyPrefix) {
+			break
+		}
+		entries = append(entries, adapter.OutboxEntry{Offset: entry.Key[len(changeKeyPrefix):], Event: entry.Value})
+	}
+	return entries, nil
+}
+
+// changeOffset formats the offset of an event recorded at the given time in microseconds.
+func changeOffset(micros int64, unique string) string {
+	return fmt.Sprintf("%014x%s", micros, unique)
+}
+
+// pendingChange holds the events of one change of stored objects. A nil pendingChange records nothing:
+// it's returned when the sink is not configured.
+type pendingChange struct {
+	events []*cdc.Event
+	data   []any
+	// The events are passed to the adapter in the outbox and serialized once.
+	outbox     adapter.Outbox
+	serialized []adapter.OutboxEntry
+}
+
+// newChange starts a change with the event. The 'data' is the created object or the updated fields. It's
+// serialized when the change is made, so it describes the object as written.
+func newChange(event *cdc.Event, data any) *pendingChange {
+	if changeSink == nil {
+		return nil
+	}
+	c := &pendingChange{}
+	c.outbox.Entries = c.entries
+	return c.add(event, data)
+}
+
+// add adds one more event to the change.
+func (c *pendingChange) add(event *cdc.Event, data any) *pendingChange {
+	if c == nil {
+		return nil
+	}
+
+	event.Ts = types.TimeNow()
+	changeClock.Lock()
+	micros := time.Now().UnixMicro()
+	if micros <= changeClock.last {
+		micros = changeClock.last + 1
+	}
+	changeClock.last = micros
+	changeClock.Unlock()
+	// Offsets of events recorded by different nodes in the same microsecond are made unique by a random suffix.
+	event.Offset = changeOffset(micros, "."+Store.GetUidString())
+
+	c.events = append(c.events, event)
+	c.data = append(c.data, data)
+	return c
+}
+
+// adapter returns the adapter to make the change with: the events are added to the outbox table in the
+// transaction of the change if the adapter supports it.
+func (c *pendingChange) adapter() adapter.Adapter {
+	if c != nil {
+		if txAdp := adp.WithOutbox(&c.outbox); txAdp != nil {
+			return txAdp
+		}
+	}
+	return adp
+}
+
+// record adds the events to the outbox after the change unless they were added in the transaction of the
+// change. Errors are logged: the change itself is already made.
+//
+// Events are recorded after the change by adapters which cannot write to the outbox table in their
+// transactions: the Mongo and RethinkDB adapters, which do not use transactions, and the sharded adapter,
+// which writes to several databases. The outbox of non-SQL adapters is kept in the persistent cache.
+// Events are also recorded after the change when they describe the result of the change which is not
+// known before it's committed: tags of a user replaced by UpdateTags and files removed by DeleteUnused.
+// If the server stops between the change and this call, such events are lost while the change is kept.
+func (c *pendingChange) record() {
+	if c == nil || c.outbox.Written {
+		return
+	}
+
+	entries := c.entries()
+	if len(entries) == 0 {
+		return
+	}
+	err := adp.OutboxAdd(entries)
+	if err == types.ErrUnsupported {
+		err = nil
+		for _, entry := range entries {
+			if err = adp.PCacheUpsert(changeKeyPrefix+entry.Offset, entry.Event, true); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		logs.Warn.Printf("cdc: failed to record %s %s: %v", c.events[0].Object, c.events[0].Op, err)
+	}
+}
+
+// entries returns the serialized events. Events which fail to serialize are skipped.
+func (c *pendingChange) entries() []adapter.OutboxEntry {
+	if c.serialized != nil || len(c.events) == 0 {
+		return c.serialized
+	}
+
+	c.serialized = []adapter.OutboxEntry{}
+	for i, event := range c.events {
+		var err error
+		if c.data[i] != nil {
+			if event.Data, err = json.Marshal(c.data[i]); err != nil {
+				logs.Warn.Printf("cdc: failed to serialize %s %s: %v", event.Object, event.Op, err)
+				continue
+			}
+		}
+		val, err := json.Marshal(event)
+		if err == nil && len(val) > maxChangeSize {
+			event.Data, event.Truncated = nil, true
+			val, err = json.Marshal(event)
+		}
+		if err != nil {
+			logs.Warn.Printf("cdc: failed to serialize %s %s: %v", event.Object, event.Op, err)
+			continue
+		}
+		c.serialized = append(c.serialized, adapter.OutboxEntry{Offset: event.Offset, Event: string(val)})
+	}
+	return c.serialized
+}
@@ -0,0 +1,215 @@
+package store_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/cdc"
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// recordingSink keeps delivered events in memory.
+type recordingSink struct {
+	events []cdc.Event
+	fail   bool
+}
+
+func (s *recordingSink) Init(jsconf string) error { return nil }
+func (s *recordingSink) Close() error             { return nil }
+func (s *recordingSink) Deliver(events []cdc.Event) error {
+	if s.fail {
+		return errors.New("sink is down")
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+// offsets returns offsets of delivered events and forgets the events.
+func (s *recordingSink) offsets() []string {
+	var out []string
+	for _, event := range s.events {
+		out = append(out, event.Offset)
+	}
+	s.events = nil
+	return out
+}
+
+// putChange adds an event recorded 'ago' to the outbox as another cluster node would. Returns the offset.
+func putChange(t *testing.T, ago time.Duration) string {
+	t.Helper()
+	offset := fmt.Sprintf("%014x.%s", time.Now().Add(-ago).UnixMicro(), store.Store.GetUidString())
+	val, _ := json.Marshal(&cdc.Event{Offset: offset, Object: cdc.ObjTopic, Op: cdc.OpUpdate, Topic: "grpTest"})
+	if err := store.PCache.Upsert("cdc:"+offset, string(val), true); err != nil {
+		t.Fatal("PCache.Upsert:", err)
+	}
+	return offset
+}
+
+// outbox returns offsets of the events which are not delivered yet.
+func outbox(t *testing.T) []string {
+	t.Helper()
+	entries, err := store.Store.GetAdapter().PCacheExport("cdc:", 100)
+	if err != nil {
+		t.Fatal("PCacheExport:", err)
+	}
+	var out []string
+	for _, entry := range entries {
+		if len(entry.Key) > 4 && entry.Key[:4] == "cdc:" {
+			out = append(out, entry.Key[4:])
+		}
+	}
+	return out
+}
+
+func TestDeliverChanges(t *testing.T) {
+	resetDb(t)
+	sink := &recordingSink{}
+	defer store.SetChangeSink(sink)()
+
+	first := putChange(t, time.Minute)
+	second := putChange(t, 50*time.Second)
+	third := putChange(t, 40*time.Second)
+
+	// Oldest first, up to the limit.
+	if count, err := store.Changes.Deliver(2); count != 2 || err != nil {
+		t.Fatal("Deliver:", count, err)
+	}
+	if got, want := sink.offsets(), []string{first, second}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Delivered: expected %v, got %v", want, got)
+	}
+	if got, want := outbox(t), []string{third}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Outbox: expected %v, got %v", want, got)
+	}
+
+	// An event recorded late by another node has an offset below the delivered ones.
+	late := putChange(t, 2*time.Minute)
+	// Recent events are not delivered yet.
+	createUser(t, "Alice")
+	recent := outbox(t)[2:]
+
+	if count, err := store.Changes.Deliver(10); count != 2 || err != nil {
+		t.Fatal("Deliver late:", count, err)
+	}
+	if got, want := sink.offsets(), []string{late, third}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Delivered late: expected %v, got %v", want, got)
+	}
+	if got := outbox(t); len(recent) == 0 || !reflect.DeepEqual(got, recent) {
+		t.Errorf("Outbox with recent events: expected %v, got %v", recent, got)
+	}
+}
+
+// Delivery resumes from the first undelivered event after a failure of the sink.
+func TestDeliverChangesResume(t *testing.T) {
+	resetDb(t)
+	sink := &recordingSink{fail: true}
+	defer store.SetChangeSink(sink)()
+
+	first := putChange(t, time.Minute)
+	// Malformed events are dropped.
+	if err := store.PCache.Upsert("cdc:"+fmt.Sprintf("%014x", time.Now().Add(-55*time.Second).UnixMicro()),
+		"{", true); err != nil {
+		t.Fatal("PCache.Upsert:", err)
+	}
+	second := putChange(t, 50*time.Second)
+
+	if count, err := store.Changes.Deliver(10); count != 0 || err == nil {
+		t.Fatal("Deliver to failed sink:", count, err)
+	}
+	if got := outbox(t); len(got) != 3 {
+		t.Errorf("Outbox after failure: expected 3 events, got %v", got)
+	}
+
+	sink.fail = false
+	if count, err := store.Changes.Deliver(10); count != 3 || err != nil {
+		t.Fatal("Deliver resumed:", count, err)
+	}
+	if got, want := sink.offsets(), []string{first, second}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Delivered after resume: expected %v, got %v", want, got)
+	}
+	if got := outbox(t); len(got) != 0 {
+		t.Errorf("Outbox after resume: %v", got)
+	}
+
+	if count, err := store.Changes.Deliver(10); count != 0 || err != nil {
+		t.Error("Deliver from empty outbox:", count, err)
+	}
+}
+
+// Changes are not recorded if the sink is not configured.
+func TestDeliverChangesNoSink(t *testing.T) {
+	resetDb(t)
+	createUser(t, "Alice")
+	if got := outbox(t); len(got) != 0 {
+		t.Errorf("Outbox without sink: %v", got)
+	}
+	if _, err := store.Changes.Deliver(10); err != types.ErrUnsupported {
+		t.Error("Deliver without sink: expected ErrUnsupported, got", err)
+	}
+}
+
+// outboxAdapter keeps the outbox table in memory and adds the events in the "transaction" of UserUpdate.
+type outboxAdapter struct {
+	adapter.Adapter
+	outbox *adapter.Outbox
+	table  *[]adapter.OutboxEntry
+}
+
+func (a *outboxAdapter) WithOutbox(outbox *adapter.Outbox) adapter.Adapter {
+	return &outboxAdapter{Adapter: a.Adapter, outbox: outbox, table: a.table}
+}
+
+func (a *outboxAdapter) UserUpdate(uid types.Uid, update map[string]any) error {
+	if err := a.Adapter.UserUpdate(uid, update); err != nil {
+		return err
+	}
+	if a.outbox != nil && !a.outbox.Written {
+		*a.table = append(*a.table, a.outbox.Entries()...)
+		a.outbox.Written = true
+	}
+	return nil
+}
+
+func (a *outboxAdapter) OutboxAdd(entries []adapter.OutboxEntry) error {
+	*a.table = append(*a.table, entries...)
+	return nil
+}
+
+// Events are added in the transaction of the change if the adapter supports it, after the change otherwise.
+func TestRecordChangesOutbox(t *testing.T) {
+	resetDb(t)
+	uid := createUser(t, "Alice")
+
+	var table []adapter.OutboxEntry
+	defer store.SetAdapter(&outboxAdapter{Adapter: store.Store.GetAdapter(), table: &table})()
+	defer store.SetChangeSink(&recordingSink{})()
+
+	if err := store.Users.Update(uid, map[string]any{"UserAgent": "test"}); err != nil {
+		t.Fatal("Users.Update:", err)
+	}
+	if len(table) != 1 {
+		t.Fatalf("Outbox after update: expected 1 event, got %v", table)
+	}
+	var event cdc.Event
+	if err := json.Unmarshal([]byte(table[0].Event), &event); err != nil || event.Offset != table[0].Offset ||
+		event.Object != cdc.ObjUser || event.Op != cdc.OpUpdate || event.User != uid.String() {
+		t.Error("Event of update:", table[0], err)
+	}
+
+	// The outbox is not written by UserUpdateTags: the event is added after the change.
+	if _, err := store.Users.UpdateTags(uid, []string{"tag"}, nil, nil); err != nil {
+		t.Fatal("Users.UpdateTags:", err)
+	}
+	if len(table) != 2 || table[1].Offset <= table[0].Offset {
+		t.Errorf("Outbox after tags update: expected 2 events, got %v", table)
+	}
+	// Nothing goes to the persistent cache.
+	if got := outbox(t); len(got) != 0 {
+		t.Errorf("Persistent cache outbox: %v", got)
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"github.com/volvlabs/towncryer-chat-server/server/cdc"
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/media"
+	"github.com/volvlabs/towncryer-chat-server/server/search"
+)
+
+// SetSearchIndexer replaces the search indexer. Returns a function which restores the previous one.
+func SetSearchIndexer(idx search.Indexer) func() {
+	prev := searchIndexer
+	searchIndexer = idx
+	return func() { searchIndexer = prev }
+}
+
+// SetMediaHandler replaces the media handler. Returns a function which restores the previous one.
+func SetMediaHandler(mh media.Handler) func() {
+	prev := mediaHandler
+	mediaHandler = mh
+	return func() { mediaHandler = prev }
+}
+
+// OpenShards combines the open adapter with new databases of the same kind with the given names.
+func OpenShards(main adapter.Adapter, names ...string) (adapter.Adapter, error) {
+	var configs []shardConfig
+	for _, name := range names {
+		configs = append(configs, shardConfig{Name: name})
+	}
+	return openShards(main, configs, 0)
+}
+
+// Shards returns all databases of the sharded adapter, the main one first.
+func Shards(sharded adapter.Adapter) []adapter.Adapter {
+	return sharded.(*shardedAdapter).list
+}
+
+// ShardOf returns the database which keeps the topic.
+func ShardOf(sharded adapter.Adapter, topic string) adapter.Adapter {
+	return sharded.(*shardedAdapter).shard(topic)
+}
+
+// SetAdapter replaces the adapter used by the mappers. Returns a function which restores the previous one.
+func SetAdapter(a adapter.Adapter) func() {
+	prev := adp
+	adp = a
+	return func() { adp = prev }
+}
+
+// SetChangeSink replaces the sink of change events. Returns a function which restores the previous one.
+func SetChangeSink(sink cdc.Sink) func() {
+	prev := changeSink
+	changeSink = sink
+	return func() { changeSink = prev }
+}
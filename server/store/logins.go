@@ -0,0 +1,158 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Login records are kept in the persistent cache under keys <prefix><uid>:<login id>, so records of
+// one user can be read in one range scan.
+
+const (
+	// Prefix of persistent cache keys of login records.
+	loginKeyPrefix = "login:"
+	// Number of records read from the cache at once.
+	loginPageSize = 64
+)
+
+// LoginsPersistenceInterface is an interface which defines methods for managing server-side records
+// of revocable authentication tokens.
+type LoginsPersistenceInterface interface {
+	Save(uid types.Uid, login *types.Login) error
+	Get(uid types.Uid, id string) (*types.Login, error)
+	GetAll(uid types.Uid) ([]types.Login, error)
+	Delete(uid types.Uid, ids []string) ([]string, error)
+	Expire(before time.Time) error
+}
+
+// loginsMapper is a concrete type implementing LoginsPersistenceInterface.
+type loginsMapper struct{}
+
+// Logins is a singleton ancor object exporting LoginsPersistenceInterface methods.
+var Logins LoginsPersistenceInterface
+
+func loginKey(uid types.Uid, id string) string {
+	return loginKeyPrefix + uid.String() + ":" + id
+}
+
+// Save creates or updates a login record.
+func (loginsMapper) Save(uid types.Uid, login *types.Login) error {
+	if login.Id == "" || strings.ContainsAny(login.Id, ":%") {
+		return types.ErrMalformed
+	}
+	data, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	return adp.PCacheUpsert(loginKey(uid, login.Id), string(data), false)
+}
+
+// Get returns a login record or types.ErrNotFound.
+func (loginsMapper) Get(uid types.Uid, id string) (*types.Login, error) {
+	val, err := adp.PCacheGet(loginKey(uid, id))
+	if err != nil {
+		return nil, err
+	}
+	var login types.Login
+	if err = json.Unmarshal([]byte(val), &login); err != nil {
+		return nil, types.ErrInternal
+	}
+	login.Id = id
+	return &login, nil
+}
+
+// GetAll returns user's login records which have not expired yet.
+func (loginsMapper) GetAll(uid types.Uid) ([]types.Login, error) {
+	prefix := loginKey(uid, "")
+	now := time.Now()
+	var logins []types.Login
+	after := prefix
+	for {
+		entries, err := adp.PCacheExport(after, loginPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Key, prefix) {
+				return logins, nil
+			}
+			var login types.Login
+			if err := json.Unmarshal([]byte(entry.Value), &login); err != nil {
+				logs.Warn.Printf("logins: skipped malformed record %s: %v", entry.Key, err)
+				continue
+			}
+			if login.Expires.Before(now) {
+				continue
+			}
+			login.Id = entry.Key[len(prefix):]
+			logins = append(logins, login)
+		}
+		if len(entries) < loginPageSize {
+			return logins, nil
+		}
+		after = entries[len(entries)-1].Key
+	}
+}
+
+// Delete removes user's login records with the given IDs, or all user's records if ids is empty.
+// Returns IDs of deleted records.
+func (m loginsMapper) Delete(uid types.Uid, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		logins, err := m.GetAll(uid)
+		if err != nil {
+			return nil, err
+		}
+		for i := range logins {
+			ids = append(ids, logins[i].Id)
+		}
+	}
+
+	var deleted []string
+	for _, id := range ids {
+		if _, err := adp.PCacheGet(loginKey(uid, id)); err == types.ErrNotFound {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		if err := adp.PCacheDelete(loginKey(uid, id)); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, nil
+}
+
+// Expire deletes login records of all users which expired before the given time. The expiration time
+// is taken from the record: the time of the cache entry is not updated by all adapters.
+func (loginsMapper) Expire(before time.Time) error {
+	after := loginKeyPrefix
+	for {
+		entries, err := adp.PCacheExport(after, loginPageSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Key, loginKeyPrefix) {
+				return nil
+			}
+			var login types.Login
+			if err := json.Unmarshal([]byte(entry.Value), &login); err != nil {
+				logs.Warn.Printf("logins: skipped malformed record %s: %v", entry.Key, err)
+				continue
+			}
+			if login.Expires.Before(before) {
+				if err := adp.PCacheDelete(entry.Key); err != nil {
+					return err
+				}
+			}
+		}
+		if len(entries) < loginPageSize {
+			return nil
+		}
+		after = entries[len(entries)-1].Key
+	}
+}
@@ -0,0 +1,146 @@
+package store_test
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// saveLogins saves login records with IDs <prefix>0, <prefix>1... expiring at the given time.
+func saveLogins(t *testing.T, uid types.Uid, prefix string, count int, expires time.Time) []string {
+	t.Helper()
+	var ids []string
+	for i := 0; i < count; i++ {
+		login := &types.Login{
+			Id:        fmt.Sprintf("%s%03d", prefix, i),
+			UserAgent: "test",
+			CreatedAt: types.TimeNow(),
+			LastSeen:  types.TimeNow(),
+			Expires:   expires,
+		}
+		if err := store.Logins.Save(uid, login); err != nil {
+			t.Fatal("Logins.Save:", err)
+		}
+		ids = append(ids, login.Id)
+	}
+	return ids
+}
+
+func loginIds(logins []types.Login) []string {
+	var ids []string
+	for i := range logins {
+		ids = append(ids, logins[i].Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestLogins(t *testing.T) {
+	resetDb(t)
+	alice, bob := createUser(t, "Alice"), createUser(t, "Bob")
+	future := types.TimeNow().Add(time.Hour)
+
+	for _, id := range []string{"", "a:b", "a%"} {
+		if err := store.Logins.Save(alice, &types.Login{Id: id}); err != types.ErrMalformed {
+			t.Errorf("Save with ID %q: expected ErrMalformed, got %v", id, err)
+		}
+	}
+
+	saveLogins(t, alice, "a", 1, future)
+	login, err := store.Logins.Get(alice, "a000")
+	if err != nil || login.Id != "a000" || login.UserAgent != "test" || !login.Expires.Equal(future) {
+		t.Fatal("Get:", login, err)
+	}
+	// The record is updated.
+	login.UserAgent = "updated"
+	if err = store.Logins.Save(alice, login); err != nil {
+		t.Fatal("Save:", err)
+	}
+	if login, err = store.Logins.Get(alice, "a000"); err != nil || login.UserAgent != "updated" {
+		t.Error("Get updated:", login, err)
+	}
+	if _, err = store.Logins.Get(bob, "a000"); err != types.ErrNotFound {
+		t.Error("Get login of another user: expected ErrNotFound, got", err)
+	}
+
+	// Records are read in several pages, expired records and records of other users are skipped.
+	valid := append([]string{"a000"}, saveLogins(t, alice, "b", 70, future)...)
+	saveLogins(t, alice, "c", 3, types.TimeNow().Add(-time.Minute))
+	saveLogins(t, bob, "a", 2, future)
+	logins, err := store.Logins.GetAll(alice)
+	if got := loginIds(logins); err != nil || !reflect.DeepEqual(got, valid) {
+		t.Errorf("GetAll: expected %v, got %v (%v)", valid, got, err)
+	}
+
+	// Missing records are not reported as deleted.
+	deleted, err := store.Logins.Delete(alice, []string{"b001", "missing", "b002"})
+	if want := []string{"b001", "b002"}; err != nil || !reflect.DeepEqual(deleted, want) {
+		t.Errorf("Delete: expected %v, got %v (%v)", want, deleted, err)
+	}
+	if _, err = store.Logins.Get(alice, "b001"); err != types.ErrNotFound {
+		t.Error("Get deleted: expected ErrNotFound, got", err)
+	}
+
+	// All valid records of the user are deleted.
+	deleted, err = store.Logins.Delete(alice, nil)
+	if err != nil || len(deleted) != len(valid)-2 {
+		t.Errorf("Delete all: expected %d records, got %d (%v)", len(valid)-2, len(deleted), err)
+	}
+	if logins, err = store.Logins.GetAll(alice); err != nil || len(logins) != 0 {
+		t.Error("GetAll after deleting all:", loginIds(logins), err)
+	}
+	if logins, err = store.Logins.GetAll(bob); err != nil || len(logins) != 2 {
+		t.Error("Logins of another user are deleted:", loginIds(logins), err)
+	}
+}
+
+// Records are expired by the expiration time saved in the record, not by the time of the last update.
+func TestLoginsExpire(t *testing.T) {
+	resetDb(t)
+	alice, bob := createUser(t, "Alice"), createUser(t, "Bob")
+	now := types.TimeNow()
+
+	saveLogins(t, alice, "a", 40, now.Add(-time.Minute))
+	kept := saveLogins(t, alice, "b", 40, now.Add(time.Hour))
+	saveLogins(t, bob, "a", 1, now.Add(-time.Second))
+	keptBob := saveLogins(t, bob, "b", 1, now.Add(time.Minute))
+	// Other entries of the cache are not touched.
+	if err := store.PCache.Upsert("loginx", "{", false); err != nil {
+		t.Fatal("PCache.Upsert:", err)
+	}
+
+	if err := store.Logins.Expire(now); err != nil {
+		t.Fatal("Expire:", err)
+	}
+	if logins, err := store.Logins.GetAll(alice); err != nil || !reflect.DeepEqual(loginIds(logins), kept) {
+		t.Errorf("Alice's logins: expected %v, got %v (%v)", kept, loginIds(logins), err)
+	}
+	if logins, err := store.Logins.GetAll(bob); err != nil || !reflect.DeepEqual(loginIds(logins), keptBob) {
+		t.Errorf("Bob's logins: expected %v, got %v (%v)", keptBob, loginIds(logins), err)
+	}
+	// Expired records are deleted, not just hidden.
+	if _, err := store.Logins.Get(alice, "a000"); err != types.ErrNotFound {
+		t.Error("Get expired: expected ErrNotFound, got", err)
+	}
+	if _, err := store.PCache.Get("loginx"); err != nil {
+		t.Error("Unrelated entry is deleted:", err)
+	}
+
+	// Records refreshed with a later expiration time are kept.
+	login, _ := store.Logins.Get(alice, "b000")
+	login.Expires = now.Add(3 * time.Hour)
+	if err := store.Logins.Save(alice, login); err != nil {
+		t.Fatal("Save:", err)
+	}
+	if err := store.Logins.Expire(now.Add(2 * time.Hour)); err != nil {
+		t.Fatal("Expire later:", err)
+	}
+	if logins, err := store.Logins.GetAll(alice); err != nil || !reflect.DeepEqual(loginIds(logins), []string{"b000"}) {
+		t.Errorf("Refreshed login: expected [b000], got %v (%v)", loginIds(logins), err)
+	}
+}
@@ -292,6 +292,34 @@ func (mr *MockPersistentStorageInterfaceMockRecorder) UseMediaHandler(name, conf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseMediaHandler", reflect.TypeOf((*MockPersistentStorageInterface)(nil).UseMediaHandler), name, config)
 }
 
+// UseChangeSink mocks base method.
+func (m *MockPersistentStorageInterface) UseChangeSink(name string, config string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseChangeSink", name, config)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseChangeSink indicates an expected call of UseChangeSink.
+func (mr *MockPersistentStorageInterfaceMockRecorder) UseChangeSink(name, config interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseChangeSink", reflect.TypeOf((*MockPersistentStorageInterface)(nil).UseChangeSink), name, config)
+}
+
+// UseSearchIndexer mocks base method.
+func (m *MockPersistentStorageInterface) UseSearchIndexer(name string, config string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseSearchIndexer", name, config)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseSearchIndexer indicates an expected call of UseSearchIndexer.
+func (mr *MockPersistentStorageInterfaceMockRecorder) UseSearchIndexer(name, config interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseSearchIndexer", reflect.TypeOf((*MockPersistentStorageInterface)(nil).UseSearchIndexer), name, config)
+}
+
 // MockUsersPersistenceInterface is a mock of UsersPersistenceInterface interface.
 type MockUsersPersistenceInterface struct {
 	ctrl     *gomock.Controller
@@ -329,6 +357,20 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) AddAuthRecord(uid, authLvl,
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddAuthRecord", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).AddAuthRecord), uid, authLvl, scheme, unique, secret, expires)
 }
 
+// AddSharedAuthRecord mocks base method.
+func (m *MockUsersPersistenceInterface) AddSharedAuthRecord(uid types.Uid, authLvl auth.Level, scheme, namespace, unique string, secret []byte, expires time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddSharedAuthRecord", uid, authLvl, scheme, namespace, unique, secret, expires)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddSharedAuthRecord indicates an expected call of AddSharedAuthRecord.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) AddSharedAuthRecord(uid, authLvl, scheme, namespace, unique, secret, expires interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddSharedAuthRecord", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).AddSharedAuthRecord), uid, authLvl, scheme, namespace, unique, secret, expires)
+}
+
 // ConfirmCred mocks base method.
 func (m *MockUsersPersistenceInterface) ConfirmCred(id types.Uid, method string) error {
 	m.ctrl.T.Helper()
@@ -695,6 +737,20 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) UpdateLastSeen(uid, userAge
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateLastSeen", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).UpdateLastSeen), uid, userAgent, when)
 }
 
+// UpdateSharedAuthRecord mocks base method.
+func (m *MockUsersPersistenceInterface) UpdateSharedAuthRecord(uid types.Uid, authLvl auth.Level, scheme, namespace, unique string, secret []byte, expires time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateSharedAuthRecord", uid, authLvl, scheme, namespace, unique, secret, expires)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateSharedAuthRecord indicates an expected call of UpdateSharedAuthRecord.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) UpdateSharedAuthRecord(uid, authLvl, scheme, namespace, unique, secret, expires interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateSharedAuthRecord", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).UpdateSharedAuthRecord), uid, authLvl, scheme, namespace, unique, secret, expires)
+}
+
 // UpdateState mocks base method.
 func (m *MockUsersPersistenceInterface) UpdateState(uid types.Uid, state types.ObjState) error {
 	m.ctrl.T.Helper()
@@ -804,6 +860,21 @@ func (mr *MockTopicsPersistenceInterfaceMockRecorder) Delete(topic, isChan, hard
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).Delete), topic, isChan, hard)
 }
 
+// Export mocks base method.
+func (m *MockTopicsPersistenceInterface) Export(after string, limit int) ([]types.Topic, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Export", after, limit)
+	ret0, _ := ret[0].([]types.Topic)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Export indicates an expected call of Export.
+func (mr *MockTopicsPersistenceInterfaceMockRecorder) Export(after, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Export", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).Export), after, limit)
+}
+
 // Get mocks base method.
 func (m *MockTopicsPersistenceInterface) Get(topic string) (*types.Topic, error) {
 	m.ctrl.T.Helper()
@@ -1014,6 +1085,21 @@ func (m *MockMessagesPersistenceInterface) EXPECT() *MockMessagesPersistenceInte
 	return m.recorder
 }
 
+// Archive mocks base method.
+func (m *MockMessagesPersistenceInterface) Archive(topic string, olderThan time.Time, count int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Archive", topic, olderThan, count)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Archive indicates an expected call of Archive.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Archive(topic, olderThan, count interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Archive", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Archive), topic, olderThan, count)
+}
+
 // DeleteList mocks base method.
 func (m *MockMessagesPersistenceInterface) DeleteList(topic string, delID int, forUser types.Uid, ranges []types.Range) error {
 	m.ctrl.T.Helper()
@@ -1028,19 +1114,62 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) DeleteList(topic, delID,
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteList", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).DeleteList), topic, delID, forUser, ranges)
 }
 
+// DeleteScheduled mocks base method.
+func (m *MockMessagesPersistenceInterface) DeleteScheduled(id types.Uid, user types.Uid) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteScheduled", id, user)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteScheduled indicates an expected call of DeleteScheduled.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) DeleteScheduled(id, user interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteScheduled", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).DeleteScheduled), id, user)
+}
+
+// Edit mocks base method.
+func (m *MockMessagesPersistenceInterface) Edit(msg *types.Message, attachmentURLs []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Edit", msg, attachmentURLs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Edit indicates an expected call of Edit.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Edit(msg, attachmentURLs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Edit", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Edit), msg, attachmentURLs)
+}
+
+// Export mocks base method.
+func (m *MockMessagesPersistenceInterface) Export(topic string, from types.Uid, after, limit int) ([]types.Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Export", topic, from, after, limit)
+	ret0, _ := ret[0].([]types.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Export indicates an expected call of Export.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Export(topic, from, after, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Export", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Export), topic, from, after, limit)
+}
+
 // GetAll mocks base method.
-func (m *MockMessagesPersistenceInterface) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Message, error) {
+func (m *MockMessagesPersistenceInterface) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt, archived bool) ([]types.Message, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetAll", topic, forUser, opt)
+	ret := m.ctrl.Call(m, "GetAll", topic, forUser, opt, archived)
 	ret0, _ := ret[0].([]types.Message)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetAll indicates an expected call of GetAll.
-func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetAll(topic, forUser, opt interface{}) *gomock.Call {
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetAll(topic, forUser, opt, archived interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetAll), topic, forUser, opt)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetAll), topic, forUser, opt, archived)
 }
 
 // GetDeleted mocks base method.
@@ -1059,6 +1188,154 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetDeleted(topic, forUse
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeleted", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetDeleted), topic, forUser, opt)
 }
 
+// GetExpired mocks base method.
+func (m *MockMessagesPersistenceInterface) GetExpired(now time.Time, accept func(string) bool, limit int) (map[string]types.Range, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpired", now, accept, limit)
+	ret0, _ := ret[0].(map[string]types.Range)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExpired indicates an expected call of GetExpired.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetExpired(now, accept, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpired", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetExpired), now, accept, limit)
+}
+
+// GetReactions mocks base method.
+func (m *MockMessagesPersistenceInterface) GetReactions(topic string, opt *types.QueryOpt) ([]types.Reaction, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReactions", topic, opt)
+	ret0, _ := ret[0].([]types.Reaction)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetReactions indicates an expected call of GetReactions.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetReactions(topic, opt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReactions", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetReactions), topic, opt)
+}
+
+// GetRevisions mocks base method.
+func (m *MockMessagesPersistenceInterface) GetRevisions(topic string, seqId int) ([]types.Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRevisions", topic, seqId)
+	ret0, _ := ret[0].([]types.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRevisions indicates an expected call of GetRevisions.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetRevisions(topic, seqId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRevisions", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetRevisions), topic, seqId)
+}
+
+// GetScheduled mocks base method.
+func (m *MockMessagesPersistenceInterface) GetScheduled(topic string, user types.Uid) ([]types.ScheduledMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetScheduled", topic, user)
+	ret0, _ := ret[0].([]types.ScheduledMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetScheduled indicates an expected call of GetScheduled.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetScheduled(topic, user interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetScheduled", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetScheduled), topic, user)
+}
+
+// GetScheduledById mocks base method.
+func (m *MockMessagesPersistenceInterface) GetScheduledById(id types.Uid) (*types.ScheduledMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetScheduledById", id)
+	ret0, _ := ret[0].(*types.ScheduledMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetScheduledById indicates an expected call of GetScheduledById.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetScheduledById(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetScheduledById", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetScheduledById), id)
+}
+
+// GetScheduledDue mocks base method.
+func (m *MockMessagesPersistenceInterface) GetScheduledDue(before time.Time, accept func(string) bool, limit int) ([]types.ScheduledMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetScheduledDue", before, accept, limit)
+	ret0, _ := ret[0].([]types.ScheduledMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetScheduledDue indicates an expected call of GetScheduledDue.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetScheduledDue(before, accept, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetScheduledDue", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetScheduledDue), before, accept, limit)
+}
+
+// GetThreads mocks base method.
+func (m *MockMessagesPersistenceInterface) GetThreads(topic string, forUser types.Uid) ([]types.ThreadStatus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetThreads", topic, forUser)
+	ret0, _ := ret[0].([]types.ThreadStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetThreads indicates an expected call of GetThreads.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetThreads(topic, forUser interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetThreads", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetThreads), topic, forUser)
+}
+
+// HasArchive mocks base method.
+func (m *MockMessagesPersistenceInterface) HasArchive(topic string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HasArchive", topic)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// HasArchive indicates an expected call of HasArchive.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) HasArchive(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HasArchive", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).HasArchive), topic)
+}
+
+// React mocks base method.
+func (m *MockMessagesPersistenceInterface) React(topic string, seqId int, user types.Uid, value string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "React", topic, seqId, user, value)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// React indicates an expected call of React.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) React(topic, seqId, user, value interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "React", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).React), topic, seqId, user, value)
+}
+
+// Reschedule mocks base method.
+func (m *MockMessagesPersistenceInterface) Reschedule(msg *types.ScheduledMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Reschedule", msg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Reschedule indicates an expected call of Reschedule.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Reschedule(msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reschedule", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Reschedule), msg)
+}
+
 // Save mocks base method.
 func (m *MockMessagesPersistenceInterface) Save(msg *types.Message, attachmentURLs []string, readBySender bool) (error, bool) {
 	m.ctrl.T.Helper()
@@ -1074,6 +1351,49 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) Save(msg, attachmentURLs
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Save), msg, attachmentURLs, readBySender)
 }
 
+// Schedule mocks base method.
+func (m *MockMessagesPersistenceInterface) Schedule(msg *types.ScheduledMessage, attachmentURLs []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Schedule", msg, attachmentURLs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Schedule indicates an expected call of Schedule.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Schedule(msg, attachmentURLs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Schedule", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Schedule), msg, attachmentURLs)
+}
+
+// Search mocks base method.
+func (m *MockMessagesPersistenceInterface) Search(topics []string, forUser types.Uid, words []string, opt *types.QueryOpt) ([]types.Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Search", topics, forUser, words, opt)
+	ret0, _ := ret[0].([]types.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Search indicates an expected call of Search.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Search(topics, forUser, words, opt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Search", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Search), topics, forUser, words, opt)
+}
+
+// ThreadRead mocks base method.
+func (m *MockMessagesPersistenceInterface) ThreadRead(topic string, user types.Uid, thread int, readSeqId int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ThreadRead", topic, user, thread, readSeqId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ThreadRead indicates an expected call of ThreadRead.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) ThreadRead(topic, user, thread, readSeqId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ThreadRead", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).ThreadRead), topic, user, thread, readSeqId)
+}
+
 // MockDevicePersistenceInterface is a mock of DevicePersistenceInterface interface.
 type MockDevicePersistenceInterface struct {
 	ctrl     *gomock.Controller
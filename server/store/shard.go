@@ -0,0 +1,573 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/db/common"
+	rh "github.com/volvlabs/towncryer-chat-server/server/ringhash"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Topics can be distributed over several databases (shards) of the same kind. The shard of a topic is
+// chosen by the topic name, so the topic, its subscriptions, messages, deletion log, reactions and scheduled
+// messages are kept together. The main database keeps the rest: authentication records, credentials,
+// devices, persistent cache. Records of users and files are written to all shards because topic data
+// refers to them, but read from the main database. Queries by user are sent to all shards and the results
+// are merged.
+//
+// Topics are placed with a consistent hash of shard names. The list of shards cannot be changed once
+// topics are created: the existing topics are not moved.
+
+const (
+	// Name of the main database in the ring of shards.
+	mainShardName = "main"
+	// Number of replicas of each shard in the ring.
+	shardRingReplicas = 20
+	// Default limit of query results of DB adapters.
+	defaultMaxResults = 1024
+)
+
+// shardConfig is the config of one additional database.
+type shardConfig struct {
+	// Name of the shard. Placement of topics depends on names, not on the order of shards.
+	Name string `json:"name"`
+	// Configuration of the adapter, same as in 'adapters'.
+	Config json.RawMessage `json:"config"`
+}
+
+// shardedAdapter distributes topics over several adapters of the same kind. Calls which are not
+// overridden are passed to the main adapter.
+type shardedAdapter struct {
+	adapter.Adapter
+
+	// All shards, the main one first.
+	list []adapter.Adapter
+	// Shards by name.
+	shards map[string]adapter.Adapter
+	ring   *rh.Ring
+
+	maxResults int
+}
+
+// openShards opens additional databases and combines them with the already open main adapter.
+func openShards(main adapter.Adapter, configs []shardConfig, maxResults int) (*shardedAdapter, error) {
+	a := &shardedAdapter{
+		Adapter: main,
+		list:    []adapter.Adapter{main},
+		shards:  map[string]adapter.Adapter{mainShardName: main},
+		ring:    rh.New(shardRingReplicas, nil),
+	}
+	a.setMaxResults(maxResults)
+
+	names := []string{mainShardName}
+	for _, conf := range configs {
+		if conf.Name == "" {
+			a.closeShards()
+			return nil, errors.New("store: shard name is missing")
+		}
+		if _, ok := a.shards[conf.Name]; ok {
+			a.closeShards()
+			return nil, errors.New("store: duplicate shard name '" + conf.Name + "'")
+		}
+
+		ad, err := newAdapter(main)
+		if err == nil {
+			if err = ad.SetMaxResults(maxResults); err == nil {
+				err = ad.Open(conf.Config)
+			}
+		}
+		if err != nil {
+			a.closeShards()
+			return nil, errors.New("store: failed to open shard '" + conf.Name + "': " + err.Error())
+		}
+		a.list = append(a.list, ad)
+		a.shards[conf.Name] = ad
+		names = append(names, conf.Name)
+	}
+	a.ring.Add(names...)
+
+	return a, nil
+}
+
+// newAdapter creates another instance of the adapter of the same kind. Adapters are registered as
+// pointers to zero values, so the zero value is a valid adapter which is not open yet.
+func newAdapter(proto adapter.Adapter) (adapter.Adapter, error) {
+	typ := reflect.TypeOf(proto)
+	if typ.Kind() != reflect.Ptr {
+		return nil, errors.New("adapter '" + proto.GetName() + "' cannot be instantiated")
+	}
+	return reflect.New(typ.Elem()).Interface().(adapter.Adapter), nil
+}
+
+// closeShards closes the additional databases.
+func (a *shardedAdapter) closeShards() error {
+	var firstErr error
+	for _, ad := range a.list[1:] {
+		if !ad.IsOpen() {
+			continue
+		}
+		if err := ad.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (a *shardedAdapter) setMaxResults(val int) {
+	if val <= 0 {
+		val = defaultMaxResults
+	}
+	a.maxResults = val
+}
+
+// shard returns the adapter which keeps the topic.
+func (a *shardedAdapter) shard(topic string) adapter.Adapter {
+	// Channels are stored as group topics.
+	if grp := types.ChnToGrp(topic); grp != "" {
+		topic = grp
+	}
+	return a.shards[a.ring.Get(topic)]
+}
+
+// each calls the function for every shard, the main one first, and stops at the first error.
+func (a *shardedAdapter) each(fn func(ad adapter.Adapter) error) error {
+	for _, ad := range a.list {
+		if err := fn(ad); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open is not supported: the shards are opened by the store.
+func (a *shardedAdapter) Open(config json.RawMessage) error {
+	return errors.New("store: connection is already opened")
+}
+
+// Close closes all shards.
+func (a *shardedAdapter) Close() error {
+	err := a.closeShards()
+	if merr := a.Adapter.Close(); merr != nil {
+		err = merr
+	}
+	return err
+}
+
+// CheckDbVersion checks versions of all shards.
+func (a *shardedAdapter) CheckDbVersion() error {
+	return a.each(func(ad adapter.Adapter) error { return ad.CheckDbVersion() })
+}
+
+// SetMaxResults configures all shards.
+func (a *shardedAdapter) SetMaxResults(val int) error {
+	if err := a.each(func(ad adapter.Adapter) error { return ad.SetMaxResults(val) }); err != nil {
+		return err
+	}
+	a.setMaxResults(val)
+	return nil
+}
+
+// CreateDb creates databases of all shards.
+func (a *shardedAdapter) CreateDb(reset bool) error {
+	return a.each(func(ad adapter.Adapter) error { return ad.CreateDb(reset) })
+}
+
+// UpgradeDb upgrades databases of all shards.
+func (a *shardedAdapter) UpgradeDb() error {
+	return a.each(func(ad adapter.Adapter) error { return ad.UpgradeDb() })
+}
+
+// Stats returns connection stats of all shards by shard name.
+func (a *shardedAdapter) Stats() any {
+	stats := make(map[string]any, len(a.shards))
+	for name, ad := range a.shards {
+		stats[name] = ad.Stats()
+	}
+	return stats
+}
+
+// Users are written to all shards.
+
+func (a *shardedAdapter) UserCreate(user *types.User) error {
+	return a.each(func(ad adapter.Adapter) error { return ad.UserCreate(user) })
+}
+
+func (a *shardedAdapter) UserDelete(uid types.Uid, hard bool) error {
+	return a.each(func(ad adapter.Adapter) error { return ad.UserDelete(uid, hard) })
+}
+
+func (a *shardedAdapter) UserUpdate(uid types.Uid, update map[string]any) error {
+	return a.each(func(ad adapter.Adapter) error { return ad.UserUpdate(uid, update) })
+}
+
+func (a *shardedAdapter) UserUpdateTags(uid types.Uid, add, remove, reset []string) ([]string, error) {
+	tags, err := a.Adapter.UserUpdateTags(uid, add, remove, reset)
+	if err != nil {
+		return nil, err
+	}
+	for _, ad := range a.list[1:] {
+		if _, err = ad.UserUpdateTags(uid, add, remove, reset); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+func (a *shardedAdapter) UserUnreadCount(ids ...types.Uid) (map[types.Uid]int, error) {
+	counts := make(map[types.Uid]int, len(ids))
+	for _, uid := range ids {
+		counts[uid] = 0
+	}
+	for _, ad := range a.list {
+		part, err := ad.UserUnreadCount(ids...)
+		if err != nil {
+			return counts, err
+		}
+		for uid, count := range part {
+			counts[uid] += count
+		}
+	}
+	return counts, nil
+}
+
+// Topics and subscriptions are kept in the shard of the topic.
+
+func (a *shardedAdapter) TopicCreate(topic *types.Topic) error {
+	return a.shard(topic.Id).TopicCreate(topic)
+}
+
+func (a *shardedAdapter) TopicCreateP2P(initiator, invited *types.Subscription) error {
+	return a.shard(initiator.Topic).TopicCreateP2P(initiator, invited)
+}
+
+func (a *shardedAdapter) TopicGet(topic string) (*types.Topic, error) {
+	return a.shard(topic).TopicGet(topic)
+}
+
+func (a *shardedAdapter) TopicsForUser(uid types.Uid, keepDeleted bool, opts *types.QueryOpt) ([]types.Subscription, error) {
+	var subs []types.Subscription
+	for _, ad := range a.list {
+		part, err := ad.TopicsForUser(uid, keepDeleted, opts)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, part...)
+	}
+	// Each shard returned up to the limit of the earliest updated subscriptions.
+	return common.SelectEarliestUpdatedSubs(subs, opts, a.maxResults), nil
+}
+
+func (a *shardedAdapter) UsersForTopic(topic string, keepDeleted bool, opts *types.QueryOpt) ([]types.Subscription, error) {
+	return a.shard(topic).UsersForTopic(topic, keepDeleted, opts)
+}
+
+func (a *shardedAdapter) OwnTopics(uid types.Uid) ([]string, error) {
+	var names []string
+	for _, ad := range a.list {
+		part, err := ad.OwnTopics(uid)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, part...)
+	}
+	return names, nil
+}
+
+func (a *shardedAdapter) ChannelsForUser(uid types.Uid) ([]string, error) {
+	var names []string
+	for _, ad := range a.list {
+		part, err := ad.ChannelsForUser(uid)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, part...)
+	}
+	return names, nil
+}
+
+func (a *shardedAdapter) TopicShare(subs []*types.Subscription) error {
+	byShard := make(map[adapter.Adapter][]*types.Subscription)
+	for _, sub := range subs {
+		ad := a.shard(sub.Topic)
+		byShard[ad] = append(byShard[ad], sub)
+	}
+	return a.each(func(ad adapter.Adapter) error {
+		if part := byShard[ad]; len(part) > 0 {
+			return ad.TopicShare(part)
+		}
+		return nil
+	})
+}
+
+func (a *shardedAdapter) TopicDelete(topic string, isChan, hard bool) error {
+	return a.shard(topic).TopicDelete(topic, isChan, hard)
+}
+
+func (a *shardedAdapter) TopicUpdateOnMessage(topic string, msg *types.Message) error {
+	return a.shard(topic).TopicUpdateOnMessage(topic, msg)
+}
+
+func (a *shardedAdapter) TopicUpdate(topic string, update map[string]any) error {
+	return a.shard(topic).TopicUpdate(topic, update)
+}
+
+func (a *shardedAdapter) TopicOwnerChange(topic string, newOwner types.Uid) error {
+	return a.shard(topic).TopicOwnerChange(topic, newOwner)
+}
+
+func (a *shardedAdapter) SubscriptionGet(topic string, user types.Uid, keepDeleted bool) (*types.Subscription, error) {
+	return a.shard(topic).SubscriptionGet(topic, user, keepDeleted)
+}
+
+func (a *shardedAdapter) SubsForUser(user types.Uid) ([]types.Subscription, error) {
+	var subs []types.Subscription
+	for _, ad := range a.list {
+		part, err := ad.SubsForUser(user)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, part...)
+	}
+	return subs, nil
+}
+
+func (a *shardedAdapter) SubsForTopic(topic string, keepDeleted bool, opts *types.QueryOpt) ([]types.Subscription, error) {
+	return a.shard(topic).SubsForTopic(topic, keepDeleted, opts)
+}
+
+func (a *shardedAdapter) SubsUpdate(topic string, user types.Uid, update map[string]any) error {
+	return a.shard(topic).SubsUpdate(topic, user, update)
+}
+
+func (a *shardedAdapter) SubsDelete(topic string, user types.Uid) error {
+	return a.shard(topic).SubsDelete(topic, user)
+}
+
+func (a *shardedAdapter) FindTopics(req [][]string, opt []string, activeOnly bool) ([]types.Subscription, error) {
+	var subs []types.Subscription
+	for _, ad := range a.list {
+		part, err := ad.FindTopics(req, opt, activeOnly)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, part...)
+	}
+	if len(subs) > a.maxResults {
+		subs = subs[:a.maxResults]
+	}
+	return subs, nil
+}
+
+// Messages are kept in the shard of the topic.
+
+func (a *shardedAdapter) MessageSearch(topics []string, forUser types.Uid, words []string, opts *types.QueryOpt) ([]types.Message, error) {
+	byShard := make(map[adapter.Adapter][]string)
+	for _, topic := range topics {
+		ad := a.shard(topic)
+		byShard[ad] = append(byShard[ad], topic)
+	}
+	var msgs []types.Message
+	for _, ad := range a.list {
+		if len(byShard[ad]) == 0 {
+			continue
+		}
+		part, err := ad.MessageSearch(byShard[ad], forUser, words, opts)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, part...)
+	}
+
+	// Most recent first.
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].CreatedAt.After(msgs[j].CreatedAt)
+	})
+	limit := defaultMessageLimit
+	if opts != nil && opts.Limit > 0 {
+		limit = opts.Limit
+	}
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs, nil
+}
+
+func (a *shardedAdapter) MessageSave(msg *types.Message) error {
+	return a.shard(msg.Topic).MessageSave(msg)
+}
+
+func (a *shardedAdapter) MessageEdit(msg *types.Message) error {
+	return a.shard(msg.Topic).MessageEdit(msg)
+}
+
+func (a *shardedAdapter) MessageGetRevisions(topic string, seqId int) ([]types.Message, error) {
+	return a.shard(topic).MessageGetRevisions(topic, seqId)
+}
+
+func (a *shardedAdapter) MessageGetAll(topic string, forUser types.Uid, opts *types.QueryOpt) ([]types.Message, error) {
+	return a.shard(topic).MessageGetAll(topic, forUser, opts)
+}
+
+func (a *shardedAdapter) MessageDeleteList(topic string, toDel *types.DelMessage) error {
+	return a.shard(topic).MessageDeleteList(topic, toDel)
+}
+
+func (a *shardedAdapter) MessageGetDeleted(topic string, forUser types.Uid, opts *types.QueryOpt) ([]types.DelMessage, error) {
+	return a.shard(topic).MessageGetDeleted(topic, forUser, opts)
+}
+
+func (a *shardedAdapter) MessageGetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]types.Range, error) {
+	expired := make(map[string]types.Range)
+	for _, ad := range a.list {
+		part, err := ad.MessageGetExpired(now, accept, limit-len(expired))
+		if err != nil {
+			return nil, err
+		}
+		for topic, rng := range part {
+			expired[topic] = rng
+		}
+		if len(expired) >= limit {
+			break
+		}
+	}
+	return expired, nil
+}
+
+func (a *shardedAdapter) MessageArchive(topic string, rng types.Range, segment string, unchangedSince time.Time) error {
+	return a.shard(topic).MessageArchive(topic, rng, segment, unchangedSince)
+}
+
+func (a *shardedAdapter) MessageExport(topic string, from types.Uid, after, limit int) ([]types.Message, error) {
+	return a.shard(topic).MessageExport(topic, from, after, limit)
+}
+
+func (a *shardedAdapter) ThreadReadUpdate(topic string, user types.Uid, thread, readSeqId int) error {
+	return a.shard(topic).ThreadReadUpdate(topic, user, thread, readSeqId)
+}
+
+func (a *shardedAdapter) ThreadGetAll(topic string, forUser types.Uid) ([]types.ThreadStatus, error) {
+	return a.shard(topic).ThreadGetAll(topic, forUser)
+}
+
+func (a *shardedAdapter) SchedMsgSave(msg *types.ScheduledMessage) error {
+	return a.shard(msg.Topic).SchedMsgSave(msg)
+}
+
+func (a *shardedAdapter) SchedMsgGetAll(topic string, user types.Uid) ([]types.ScheduledMessage, error) {
+	return a.shard(topic).SchedMsgGetAll(topic, user)
+}
+
+// SchedMsgGet finds the message in the shard which has it. The topic is not known.
+func (a *shardedAdapter) SchedMsgGet(id types.Uid) (*types.ScheduledMessage, error) {
+	for _, ad := range a.list {
+		if msg, err := ad.SchedMsgGet(id); err != types.ErrNotFound {
+			return msg, err
+		}
+	}
+	return nil, types.ErrNotFound
+}
+
+func (a *shardedAdapter) SchedMsgGetDue(before time.Time, accept func(topic string) bool, limit int) ([]types.ScheduledMessage, error) {
+	var msgs []types.ScheduledMessage
+	for _, ad := range a.list {
+		part, err := ad.SchedMsgGetDue(before, accept, limit)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, part...)
+	}
+	// Earliest first.
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].SendAt.Before(msgs[j].SendAt)
+	})
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs, nil
+}
+
+// SchedMsgDelete deletes the message from the shard which has it. The topic is not known.
+func (a *shardedAdapter) SchedMsgDelete(id, user types.Uid) error {
+	for _, ad := range a.list {
+		if err := ad.SchedMsgDelete(id, user); err != types.ErrNotFound {
+			return err
+		}
+	}
+	return types.ErrNotFound
+}
+
+func (a *shardedAdapter) ReactionUpsert(r *types.Reaction) error {
+	return a.shard(r.Topic).ReactionUpsert(r)
+}
+
+func (a *shardedAdapter) ReactionDelete(topic string, seqId int, user types.Uid) error {
+	return a.shard(topic).ReactionDelete(topic, seqId, user)
+}
+
+func (a *shardedAdapter) ReactionGetAll(topic string, opts *types.QueryOpt) ([]types.Reaction, error) {
+	return a.shard(topic).ReactionGetAll(topic, opts)
+}
+
+// File records are written to all shards, links are kept with the linked object.
+
+func (a *shardedAdapter) FileStartUpload(fd *types.FileDef) error {
+	return a.each(func(ad adapter.Adapter) error { return ad.FileStartUpload(fd) })
+}
+
+func (a *shardedAdapter) FileFinishUpload(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+	result, err := a.Adapter.FileFinishUpload(fd, success, size)
+	if err != nil {
+		return nil, err
+	}
+	for _, ad := range a.list[1:] {
+		if _, err = ad.FileFinishUpload(fd, success, size); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// WithOutbox is not supported: the change and the outbox table could be in different shards. Change events
+// are added to the outbox table of the main database after the change.
+func (a *shardedAdapter) WithOutbox(outbox *adapter.Outbox) adapter.Adapter {
+	return nil
+}
+
+// FileDeleteUnused is not supported: a file is unused only if it's not linked in any of the shards.
+func (a *shardedAdapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
+	return nil, types.ErrUnsupported
+}
+
+func (a *shardedAdapter) FileLinkAttachments(topic string, userId, msgId types.Uid, fids []string) error {
+	if topic == "" {
+		return a.Adapter.FileLinkAttachments(topic, userId, msgId, fids)
+	}
+	return a.shard(topic).FileLinkAttachments(topic, userId, msgId, fids)
+}
+
+func (a *shardedAdapter) FileRelinkMessages(topic, oldFid, newFid string) error {
+	return a.shard(topic).FileRelinkMessages(topic, oldFid, newFid)
+}
+
+func (a *shardedAdapter) TopicExport(after string, limit int) ([]types.Topic, error) {
+	var topics []types.Topic
+	for _, ad := range a.list {
+		part, err := ad.TopicExport(after, limit)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, part...)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Id < topics[j].Id
+	})
+	if len(topics) > limit {
+		topics = topics[:limit]
+	}
+	return topics, nil
+}
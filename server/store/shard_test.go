@@ -0,0 +1,178 @@
+package store_test
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/db/memory"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// openShards opens the main in-memory database and two more shards.
+func openShards(t *testing.T) adapter.Adapter {
+	t.Helper()
+	main := memory.GetTestAdapter()
+	if err := main.Open(nil); err != nil {
+		t.Fatal("Open:", err)
+	}
+	sharded, err := store.OpenShards(main, "one", "two")
+	if err != nil {
+		t.Fatal("OpenShards:", err)
+	}
+	t.Cleanup(func() { sharded.Close() })
+	return sharded
+}
+
+// shardTopics creates topics until each shard has at least one. Returns topic names in the order of creation.
+func shardTopics(t *testing.T, sharded adapter.Adapter, owner types.Uid, now time.Time) []string {
+	t.Helper()
+	used := make(map[adapter.Adapter]bool)
+	var names []string
+	for i := 0; len(used) < len(store.Shards(sharded)); i++ {
+		if i > 100 {
+			t.Fatal("Topics are not distributed over shards:", len(used))
+		}
+		topic := &types.Topic{
+			ObjHeader: types.ObjHeader{Id: "grp" + strconv.Itoa(1000+i), CreatedAt: now, UpdatedAt: now},
+			TouchedAt: now,
+			Owner:     owner.String(),
+		}
+		if err := sharded.TopicCreate(topic); err != nil {
+			t.Fatal("TopicCreate:", err)
+		}
+		used[store.ShardOf(sharded, topic.Id)] = true
+		names = append(names, topic.Id)
+	}
+	return names
+}
+
+// Topic data is kept in the shard chosen by the topic name, users are written to all shards.
+func TestShardRouting(t *testing.T) {
+	sharded := openShards(t)
+	now := types.TimeNow()
+
+	alice := &types.User{ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now}}
+	alice.SetUid(store.Store.GetUid())
+	if err := sharded.UserCreate(alice); err != nil {
+		t.Fatal("UserCreate:", err)
+	}
+	for i, ad := range store.Shards(sharded) {
+		if user, err := ad.UserGet(alice.Uid()); err != nil || user == nil {
+			t.Errorf("User is missing in shard %d: %v", i, err)
+		}
+	}
+
+	for _, name := range shardTopics(t, sharded, alice.Uid(), now) {
+		home := store.ShardOf(sharded, name)
+		if chn := types.GrpToChn(name); store.ShardOf(sharded, chn) != home {
+			t.Errorf("Channel %s is placed apart from its topic", chn)
+		}
+		for i, ad := range store.Shards(sharded) {
+			topic, err := ad.TopicGet(name)
+			if err != nil {
+				t.Fatal("TopicGet:", err)
+			}
+			if (topic != nil) != (ad == home) {
+				t.Errorf("Topic %s in shard %d: found %t, expected %t", name, i, topic != nil, ad == home)
+			}
+		}
+
+		msg := &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			SeqId:     1,
+			Topic:     name,
+			From:      alice.Id,
+			Content:   "hello",
+		}
+		msg.SetUid(store.Store.GetUid())
+		if err := sharded.MessageSave(msg); err != nil {
+			t.Fatal("MessageSave:", err)
+		}
+		if msgs, err := home.MessageGetAll(name, alice.Uid(), nil); err != nil || len(msgs) != 1 {
+			t.Errorf("Message of %s is not in the topic's shard: %v %v", name, msgs, err)
+		}
+	}
+}
+
+// Queries by user are sent to all shards and the results are merged.
+func TestShardFanOut(t *testing.T) {
+	sharded := openShards(t)
+	now := types.TimeNow().Add(-time.Hour)
+
+	alice := &types.User{ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now}}
+	alice.SetUid(store.Store.GetUid())
+	if err := sharded.UserCreate(alice); err != nil {
+		t.Fatal("UserCreate:", err)
+	}
+	names := shardTopics(t, sharded, alice.Uid(), now)
+
+	// Subscriptions are updated in the order of topics, messages are created in reverse order.
+	var subs []*types.Subscription
+	for i, name := range names {
+		updated := now.Add(time.Duration(i) * time.Minute)
+		subs = append(subs, &types.Subscription{
+			ObjHeader: types.ObjHeader{CreatedAt: updated, UpdatedAt: updated},
+			User:      alice.Id,
+			Topic:     name,
+			ModeWant:  types.ModeCFull,
+			ModeGiven: types.ModeCFull,
+		})
+
+		created := now.Add(-time.Duration(i) * time.Minute)
+		msg := &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: created, UpdatedAt: created},
+			SeqId:     1,
+			Topic:     name,
+			From:      alice.Id,
+			Content:   "match " + name,
+			PlainText: "match " + name,
+		}
+		msg.SetUid(store.Store.GetUid())
+		if err := sharded.MessageSave(msg); err != nil {
+			t.Fatal("MessageSave:", err)
+		}
+	}
+	if err := sharded.TopicShare(subs); err != nil {
+		t.Fatal("TopicShare:", err)
+	}
+
+	topicsOf := func(subs []types.Subscription) []string {
+		var out []string
+		for i := range subs {
+			out = append(out, subs[i].Topic)
+		}
+		return out
+	}
+
+	// All subscriptions from all shards.
+	found, err := sharded.TopicsForUser(alice.Uid(), false, nil)
+	got := topicsOf(found)
+	sort.Strings(got)
+	if err != nil || !reflect.DeepEqual(got, names) {
+		t.Errorf("TopicsForUser: expected %v, got %v (%v)", names, got, err)
+	}
+	// The limit keeps the earliest updated subscriptions.
+	found, err = sharded.TopicsForUser(alice.Uid(), false, &types.QueryOpt{Limit: 2})
+	got = topicsOf(found)
+	sort.Strings(got)
+	if want := names[:2]; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("TopicsForUser with limit: expected %v, got %v (%v)", want, got, err)
+	}
+
+	// Topics are exported in ascending order of names across shards.
+	exported, err := sharded.TopicExport(names[0], 2)
+	if err != nil || len(exported) != 2 || exported[0].Id != names[1] || exported[1].Id != names[2] {
+		t.Errorf("TopicExport: expected %v, got %v (%v)", names[1:3], exported, err)
+	}
+
+	// Search results are merged most recent first.
+	msgs, err := sharded.MessageSearch(names, alice.Uid(), []string{"match"}, &types.QueryOpt{Limit: 2})
+	if err != nil || len(msgs) != 2 || msgs[0].Topic != names[0] || msgs[1].Topic != names[1] {
+		t.Errorf("MessageSearch: expected messages of %v, got %v (%v)", names[:2], msgs, err)
+	}
+}
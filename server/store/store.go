@@ -11,8 +11,11 @@ import (
 	"github.com/volvlabs/towncryer-chat-server/server/logs"
 
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/cdc"
 	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/drafty"
 	"github.com/volvlabs/towncryer-chat-server/server/media"
+	"github.com/volvlabs/towncryer-chat-server/server/search"
 	"github.com/volvlabs/towncryer-chat-server/server/store/types"
 	"github.com/volvlabs/towncryer-chat-server/server/validate"
 )
@@ -20,6 +23,7 @@ import (
 var adp adapter.Adapter
 var availableAdapters = make(map[string]adapter.Adapter)
 var mediaHandler media.Handler
+var searchIndexer search.Indexer
 
 // Unique ID generator
 var uGen types.UidGenerator
@@ -33,6 +37,8 @@ type configType struct {
 	UseAdapter string `json:"use_adapter"`
 	// Configurations for individual adapters.
 	Adapters map[string]json.RawMessage `json:"adapters"`
+	// Additional databases to distribute topics over, optional.
+	Shards []shardConfig `json:"shards"`
 }
 
 func openAdapter(workerId int, jsonconf json.RawMessage) error {
@@ -41,6 +47,10 @@ func openAdapter(workerId int, jsonconf json.RawMessage) error {
 		return errors.New("store: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
 	}
 
+	if sharded, ok := adp.(*shardedAdapter); ok {
+		// Reopening: shards are configured anew.
+		adp = sharded.Adapter
+	}
 	if adp == nil {
 		if len(config.UseAdapter) > 0 {
 			// Adapter name specified explicitly.
@@ -81,7 +91,18 @@ func openAdapter(workerId int, jsonconf json.RawMessage) error {
 		adapterConfig = config.Adapters[adp.GetName()]
 	}
 
-	return adp.Open(adapterConfig)
+	if err := adp.Open(adapterConfig); err != nil {
+		return err
+	}
+	if len(config.Shards) > 0 {
+		sharded, err := openShards(adp, config.Shards, config.MaxResults)
+		if err != nil {
+			adp.Close()
+			return err
+		}
+		adp = sharded
+	}
+	return nil
 }
 
 // PersistentStorageInterface defines methods used for interation with persistent storage.
@@ -104,6 +125,8 @@ type PersistentStorageInterface interface {
 	GetValidator(name string) validate.Validator
 	GetMediaHandler() media.Handler
 	UseMediaHandler(name, config string) error
+	UseSearchIndexer(name, config string) error
+	UseChangeSink(name, config string) error
 }
 
 // Store is the main object for interacting with persistent storage.
@@ -125,6 +148,17 @@ func (storeObj) Open(workerId int, jsonconf json.RawMessage) error {
 
 // Close terminates connection to persistent storage.
 func (storeObj) Close() error {
+	if searchIndexer != nil {
+		if err := searchIndexer.Close(); err != nil {
+			logs.Warn.Println("store: failed to close search index", err)
+		}
+	}
+	if changeSink != nil {
+		if err := changeSink.Close(); err != nil {
+			logs.Warn.Println("store: failed to close change sink", err)
+		}
+	}
+
 	if adp.IsOpen() {
 		return adp.Close()
 	}
@@ -213,6 +247,57 @@ func RegisterAdapter(a adapter.Adapter) {
 	availableAdapters[adapterName] = a
 }
 
+// OpenAdapter opens a secondary adapter, e.g. the source of a data migration. The main adapter must
+// be open already. The secondary adapter is configured with the 'store_config' like the main one,
+// must be a different adapter and must use the same 'uid_key': the SQL adapters use the global
+// Uid generator to convert object IDs.
+func OpenAdapter(jsonconf json.RawMessage) (adapter.Adapter, error) {
+	if adp == nil || !adp.IsOpen() {
+		return nil, errors.New("store: main adapter is not open")
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return nil, errors.New("store: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.UseAdapter == "" {
+		return nil, errors.New("store: db adapter is not specified")
+	}
+	ad, ok := availableAdapters[config.UseAdapter]
+	if !ok {
+		return nil, errors.New("store: " + config.UseAdapter + " adapter is not available in this binary")
+	}
+	if ad == adp {
+		return nil, errors.New("store: " + config.UseAdapter + " adapter is already in use")
+	}
+	if ad.IsOpen() {
+		return nil, errors.New("store: connection is already opened")
+	}
+
+	var ug types.UidGenerator
+	if err := ug.Init(1, config.UidKey); err != nil {
+		return nil, errors.New("store: failed to init snowflake: " + err.Error())
+	}
+	if ug.EncodeInt64(1) != uGen.EncodeInt64(1) {
+		return nil, errors.New("store: uid_key must be the same as of the main adapter")
+	}
+
+	if err := ad.SetMaxResults(config.MaxResults); err != nil {
+		return nil, err
+	}
+
+	var adapterConfig json.RawMessage
+	if config.Adapters != nil {
+		adapterConfig = config.Adapters[ad.GetName()]
+	}
+
+	if err := ad.Open(adapterConfig); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
 // GetUid generates a unique ID suitable for use as a primary key.
 func (storeObj) GetUid() types.Uid {
 	return uGen.Get()
@@ -256,6 +341,10 @@ type UsersPersistenceInterface interface {
 	GetAuthUniqueRecord(scheme, unique string) (types.Uid, auth.Level, []byte, time.Time, error)
 	AddAuthRecord(uid types.Uid, authLvl auth.Level, scheme, unique string, secret []byte, expires time.Time) error
 	UpdateAuthRecord(uid types.Uid, authLvl auth.Level, scheme, unique string, secret []byte, expires time.Time) error
+	AddSharedAuthRecord(uid types.Uid, authLvl auth.Level, scheme, namespace, unique string, secret []byte,
+		expires time.Time) error
+	UpdateSharedAuthRecord(uid types.Uid, authLvl auth.Level, scheme, namespace, unique string, secret []byte,
+		expires time.Time) error
 	DelAuthRecords(uid types.Uid, scheme string) error
 	Get(uid types.Uid) (*types.User, error)
 	GetAll(uid ...types.Uid) ([]types.User, error)
@@ -293,10 +382,12 @@ func (usersMapper) Create(user *types.User, private interface{}) (*types.User, e
 	user.SetUid(Store.GetUid())
 	user.InitTimes()
 
-	err := adp.UserCreate(user)
+	change := newChange(&cdc.Event{Object: cdc.ObjUser, Op: cdc.OpCreate, User: user.Id}, user)
+	err := change.adapter().UserCreate(user)
 	if err != nil {
 		return nil, err
 	}
+	change.record()
 
 	// Create user's subscription to 'me' && 'fnd'. These topics are ephemeral, the topic object need not to be
 	// inserted.
@@ -320,7 +411,10 @@ func (usersMapper) Create(user *types.User, private interface{}) (*types.User, e
 	if err != nil {
 		// Best effort to delete incomplete user record. Orphaned user records are not a problem.
 		// They just take up space.
-		adp.UserDelete(user.Uid(), true)
+		change = newChange(&cdc.Event{Object: cdc.ObjUser, Op: cdc.OpDelete, User: user.Id, Hard: true}, nil)
+		if change.adapter().UserDelete(user.Uid(), true) == nil {
+			change.record()
+		}
 		return nil, err
 	}
 
@@ -363,6 +457,22 @@ func (usersMapper) UpdateAuthRecord(uid types.Uid, authLvl auth.Level, scheme, u
 	return adp.AuthUpdRecord(uid, scheme, scheme+":"+unique, authLvl, secret, expires)
 }
 
+// AddSharedAuthRecord creates a new authentication record with the unique identifier in the namespace
+// shared by several schemes, such as multiple keys of the same user. The record is found by
+// GetAuthUniqueRecord(namespace, unique).
+func (usersMapper) AddSharedAuthRecord(uid types.Uid, authLvl auth.Level, scheme, namespace, unique string,
+	secret []byte, expires time.Time) error {
+
+	return adp.AuthAddRecord(uid, scheme, namespace+":"+unique, authLvl, secret, expires)
+}
+
+// UpdateSharedAuthRecord updates authentication record created by AddSharedAuthRecord.
+func (usersMapper) UpdateSharedAuthRecord(uid types.Uid, authLvl auth.Level, scheme, namespace, unique string,
+	secret []byte, expires time.Time) error {
+
+	return adp.AuthUpdRecord(uid, scheme, namespace+":"+unique, authLvl, secret, expires)
+}
+
 // DelAuthRecords deletes user's auth records of the given scheme.
 func (usersMapper) DelAuthRecords(uid types.Uid, scheme string) error {
 	return adp.AuthDelScheme(uid, scheme)
@@ -385,12 +495,17 @@ func (usersMapper) GetByCred(method, value string) (types.Uid, error) {
 
 // Delete deletes user records.
 func (usersMapper) Delete(id types.Uid, hard bool) error {
-	return adp.UserDelete(id, hard)
+	change := newChange(&cdc.Event{Object: cdc.ObjUser, Op: cdc.OpDelete, User: id.String(), Hard: hard}, nil)
+	if err := change.adapter().UserDelete(id, hard); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // UpdateLastSeen updates LastSeen and UserAgent.
 func (usersMapper) UpdateLastSeen(uid types.Uid, userAgent string, when time.Time) error {
-	return adp.UserUpdate(uid, map[string]interface{}{"LastSeen": when, "UserAgent": userAgent})
+	return userUpdate(uid, map[string]interface{}{"LastSeen": when, "UserAgent": userAgent})
 }
 
 // Update is a general-purpose update of user data.
@@ -398,12 +513,28 @@ func (usersMapper) Update(uid types.Uid, update map[string]interface{}) error {
 	if _, ok := update["UpdatedAt"]; !ok {
 		update["UpdatedAt"] = types.TimeNow()
 	}
-	return adp.UserUpdate(uid, update)
+	return userUpdate(uid, update)
+}
+
+// userUpdate updates user record and records the change.
+func userUpdate(uid types.Uid, update map[string]interface{}) error {
+	change := newChange(&cdc.Event{Object: cdc.ObjUser, Op: cdc.OpUpdate, User: uid.String()}, update)
+	if err := change.adapter().UserUpdate(uid, update); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // UpdateTags either adds, removes, or resets tags to the given slices.
 func (usersMapper) UpdateTags(uid types.Uid, add, remove, reset []string) ([]string, error) {
-	return adp.UserUpdateTags(uid, add, remove, reset)
+	tags, err := adp.UserUpdateTags(uid, add, remove, reset)
+	if err == nil {
+		// The resulting tags are known only after the change.
+		newChange(&cdc.Event{Object: cdc.ObjUser, Op: cdc.OpUpdate, User: uid.String()},
+			map[string]interface{}{"Tags": tags}).record()
+	}
+	return tags, err
 }
 
 // UpdateState changes user's state and state of some topics associated with the user.
@@ -411,7 +542,7 @@ func (usersMapper) UpdateState(uid types.Uid, state types.ObjState) error {
 	update := map[string]interface{}{
 		"State":   state,
 		"StateAt": types.TimeNow()}
-	return adp.UserUpdate(uid, update)
+	return userUpdate(uid, update)
 }
 
 // GetSubs loads *all* subscriptions for the given user.
@@ -519,6 +650,7 @@ type TopicsPersistenceInterface interface {
 	Update(topic string, update map[string]interface{}) error
 	OwnerChange(topic string, newOwner types.Uid) error
 	Delete(topic string, isChan, hard bool) error
+	Export(after string, limit int) ([]types.Topic, error)
 }
 
 // topicsMapper is a concrete type implementing TopicsPersistenceInterface.
@@ -534,10 +666,12 @@ func (topicsMapper) Create(topic *types.Topic, owner types.Uid, private interfac
 	topic.TouchedAt = topic.CreatedAt
 	topic.Owner = owner.String()
 
-	err := adp.TopicCreate(topic)
+	change := newChange(&cdc.Event{Object: cdc.ObjTopic, Op: cdc.OpCreate, Topic: topic.Id}, topic)
+	err := change.adapter().TopicCreate(topic)
 	if err != nil {
 		return err
 	}
+	change.record()
 
 	if !owner.IsZero() {
 		err = Subs.Create(&types.Subscription{
@@ -559,7 +693,15 @@ func (topicsMapper) CreateP2P(initiator, invited *types.Subscription) error {
 	invited.InitTimes()
 	invited.SetTouchedAt(invited.CreatedAt)
 
-	return adp.TopicCreateP2P(initiator, invited)
+	change := newChange(&cdc.Event{Object: cdc.ObjTopic, Op: cdc.OpCreate, Topic: initiator.Topic}, nil)
+	for _, sub := range []*types.Subscription{initiator, invited} {
+		change.add(&cdc.Event{Object: cdc.ObjSub, Op: cdc.OpCreate, Topic: sub.Topic, User: sub.User}, sub)
+	}
+	if err := change.adapter().TopicCreateP2P(initiator, invited); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // Get a single topic with a list of relevant users de-normalized into it
@@ -596,17 +738,52 @@ func (topicsMapper) Update(topic string, update map[string]interface{}) error {
 	if _, ok := update["UpdatedAt"]; !ok {
 		update["UpdatedAt"] = types.TimeNow()
 	}
-	return adp.TopicUpdate(topic, update)
+	change := newChange(&cdc.Event{Object: cdc.ObjTopic, Op: cdc.OpUpdate, Topic: topic}, update)
+	if err := change.adapter().TopicUpdate(topic, update); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // OwnerChange replaces the old topic owner with the new owner.
 func (topicsMapper) OwnerChange(topic string, newOwner types.Uid) error {
-	return adp.TopicOwnerChange(topic, newOwner)
+	change := newChange(&cdc.Event{Object: cdc.ObjTopic, Op: cdc.OpUpdate, Topic: topic},
+		map[string]interface{}{"Owner": newOwner.String()})
+	if err := change.adapter().TopicOwnerChange(topic, newOwner); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // Delete deletes topic, messages, attachments, and subscriptions.
 func (topicsMapper) Delete(topic string, isChan, hard bool) error {
-	return adp.TopicDelete(topic, isChan, hard)
+	change := newChange(&cdc.Event{Object: cdc.ObjTopic, Op: cdc.OpDelete, Topic: topic, Hard: hard}, nil)
+	if err := change.adapter().TopicDelete(topic, isChan, hard); err != nil {
+		return err
+	}
+	change.record()
+
+	if hard && searchIndexer != nil {
+		// Remove all messages of the topic.
+		if err := searchIndexer.Delete(topic, types.ZeroUid, nil); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to remove messages from search index: %v", topic, err)
+		}
+	}
+	if hard {
+		// Segment files are unlinked and will be garbage collected.
+		if err := deleteArchived(topic, nil); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to remove list of archive segments: %v", topic, err)
+		}
+	}
+	return nil
+}
+
+// Export returns up to 'limit' topics, including soft-deleted, with names greater than 'after'
+// in ascending order.
+func (topicsMapper) Export(after string, limit int) ([]types.Topic, error) {
+	return adp.TopicExport(after, limit)
 }
 
 // SubsPersistenceInterface is an interface which defines methods for persistent storage of subscriptions.
@@ -625,11 +802,22 @@ var Subs SubsPersistenceInterface
 
 // Create creates multiple subscriptions
 func (subsMapper) Create(subs ...*types.Subscription) error {
+	var change *pendingChange
 	for _, sub := range subs {
 		sub.InitTimes()
+		event := &cdc.Event{Object: cdc.ObjSub, Op: cdc.OpCreate, Topic: sub.Topic, User: sub.User}
+		if change == nil {
+			change = newChange(event, sub)
+		} else {
+			change.add(event, sub)
+		}
 	}
 
-	return adp.TopicShare(subs)
+	if err := change.adapter().TopicShare(subs); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // Get subscription given topic and user ID.
@@ -640,20 +828,47 @@ func (subsMapper) Get(topic string, user types.Uid, keepDeleted bool) (*types.Su
 // Update values of topic's subscriptions.
 func (subsMapper) Update(topic string, user types.Uid, update map[string]interface{}) error {
 	update["UpdatedAt"] = types.TimeNow()
-	return adp.SubsUpdate(topic, user, update)
+	change := newChange(&cdc.Event{Object: cdc.ObjSub, Op: cdc.OpUpdate, Topic: topic, User: user.String()}, update)
+	if err := change.adapter().SubsUpdate(topic, user, update); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // Delete deletes a subscription
 func (subsMapper) Delete(topic string, user types.Uid) error {
-	return adp.SubsDelete(topic, user)
+	change := newChange(&cdc.Event{Object: cdc.ObjSub, Op: cdc.OpDelete, Topic: topic, User: user.String()}, nil)
+	if err := change.adapter().SubsDelete(topic, user); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // MessagesPersistenceInterface is an interface which defines methods for persistent storage of messages.
 type MessagesPersistenceInterface interface {
 	Save(msg *types.Message, attachmentURLs []string, readBySender bool) (error, bool)
+	Edit(msg *types.Message, attachmentURLs []string) error
+	GetRevisions(topic string, seqId int) ([]types.Message, error)
 	DeleteList(topic string, delID int, forUser types.Uid, ranges []types.Range) error
-	GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Message, error)
+	GetAll(topic string, forUser types.Uid, opt *types.QueryOpt, archived bool) ([]types.Message, error)
+	HasArchive(topic string) (bool, error)
+	Export(topic string, from types.Uid, after, limit int) ([]types.Message, error)
 	GetDeleted(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Range, int, error)
+	GetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]types.Range, error)
+	Archive(topic string, olderThan time.Time, count int) (int, error)
+	Search(topics []string, forUser types.Uid, words []string, opt *types.QueryOpt) ([]types.Message, error)
+	React(topic string, seqId int, user types.Uid, value string) error
+	GetReactions(topic string, opt *types.QueryOpt) ([]types.Reaction, error)
+	ThreadRead(topic string, user types.Uid, thread, readSeqId int) error
+	GetThreads(topic string, forUser types.Uid) ([]types.ThreadStatus, error)
+	Schedule(msg *types.ScheduledMessage, attachmentURLs []string) error
+	GetScheduled(topic string, user types.Uid) ([]types.ScheduledMessage, error)
+	GetScheduledById(id types.Uid) (*types.ScheduledMessage, error)
+	GetScheduledDue(before time.Time, accept func(topic string) bool, limit int) ([]types.ScheduledMessage, error)
+	Reschedule(msg *types.ScheduledMessage) error
+	DeleteScheduled(id, user types.Uid) error
 }
 
 // messagesMapper is a concrete type implementing MessagesPersistenceInterface.
@@ -666,16 +881,26 @@ var Messages MessagesPersistenceInterface
 func (messagesMapper) Save(msg *types.Message, attachmentURLs []string, readBySender bool) (error, bool) {
 	msg.InitTimes()
 	msg.SetUid(Store.GetUid())
+	// Text for full-text search. Content which is not a valid Drafty is not indexed.
+	plainText, _ := drafty.PlainText(msg.Content)
+	if searchIndexer == nil {
+		// Messages are searched by the database.
+		msg.PlainText = plainText
+	}
 	// Increment topic's or user's SeqId
 	err := adp.TopicUpdateOnMessage(msg.Topic, msg)
 	if err != nil {
 		return err, false
 	}
 
-	err = adp.MessageSave(msg)
+	change := newChange(&cdc.Event{Object: cdc.ObjMessage, Op: cdc.OpCreate, Topic: msg.Topic, SeqId: msg.SeqId}, msg)
+	err = change.adapter().MessageSave(msg)
 	if err != nil {
 		return err, false
 	}
+	change.record()
+
+	indexMessage(msg, plainText)
 
 	markedReadBySender := false
 	// Mark message as read by the sender.
@@ -704,13 +929,54 @@ func (messagesMapper) Save(msg *types.Message, attachmentURLs []string, readBySe
 			}
 		}
 		if len(attachments) > 0 {
-			return adp.FileLinkAttachments("", types.ZeroUid, msg.Uid(), attachments), markedReadBySender
+			return adp.FileLinkAttachments(msg.Topic, types.ZeroUid, msg.Uid(), attachments), markedReadBySender
 		}
 	}
 
 	return nil, markedReadBySender
 }
 
+// Edit replaces head and content of an existing message keeping the previous version as a revision.
+func (messagesMapper) Edit(msg *types.Message, attachmentURLs []string) error {
+	msg.UpdatedAt = types.TimeNow()
+	plainText, _ := drafty.PlainText(msg.Content)
+	if searchIndexer == nil {
+		msg.PlainText = plainText
+	}
+	change := newChange(&cdc.Event{Object: cdc.ObjMessage, Op: cdc.OpUpdate, Topic: msg.Topic, SeqId: msg.SeqId}, msg)
+	if err := change.adapter().MessageEdit(msg); err != nil {
+		return err
+	}
+	change.record()
+
+	indexMessage(msg, plainText)
+
+	if len(attachmentURLs) > 0 {
+		var attachments []string
+		for _, url := range attachmentURLs {
+			// Convert attachment URLs to file IDs.
+			if fid := mediaHandler.GetIdFromUrl(url); !fid.IsZero() {
+				attachments = append(attachments, fid.String())
+			}
+		}
+		if len(attachments) > 0 {
+			return adp.FileLinkAttachments(msg.Topic, types.ZeroUid, msg.Uid(), attachments)
+		}
+	}
+
+	return nil
+}
+
+// GetRevisions returns earlier revisions of the message, oldest first.
+func (messagesMapper) GetRevisions(topic string, seqId int) ([]types.Message, error) {
+	revs, err := adp.MessageGetRevisions(topic, seqId)
+	if err != nil || len(revs) > 0 || mediaHandler == nil {
+		return revs, err
+	}
+	// Revisions of archived messages are kept in the segment.
+	return archivedRevisions(topic, seqId)
+}
+
 // DeleteList deletes multiple messages defined by a list of ranges.
 func (messagesMapper) DeleteList(topic string, delID int, forUser types.Uid, ranges []types.Range) error {
 	var toDel *types.DelMessage
@@ -724,10 +990,32 @@ func (messagesMapper) DeleteList(topic string, delID int, forUser types.Uid, ran
 		toDel.InitTimes()
 	}
 
-	err := adp.MessageDeleteList(topic, toDel)
+	// Messages are deleted for all users if forUser is not set. All messages of the topic are deleted
+	// if ranges are not set.
+	var forUserStr string
+	if !forUser.IsZero() {
+		forUserStr = forUser.String()
+	}
+	change := newChange(&cdc.Event{Object: cdc.ObjMessage, Op: cdc.OpDelete, Topic: topic, User: forUserStr,
+		Hard: forUser.IsZero()}, map[string]interface{}{"DelId": delID, "SeqIdRanges": ranges})
+
+	err := change.adapter().MessageDeleteList(topic, toDel)
 	if err != nil {
 		return err
 	}
+	change.record()
+
+	if searchIndexer != nil {
+		// Errors are not fatal: search results are checked against the DB.
+		if ierr := searchIndexer.Delete(topic, forUser, ranges); ierr != nil {
+			logs.Warn.Printf("topic[%s]: failed to remove messages from search index: %v", topic, ierr)
+		}
+	}
+	if forUser.IsZero() && mediaHandler != nil {
+		if aerr := deleteArchived(topic, ranges); aerr != nil {
+			logs.Warn.Printf("topic[%s]: failed to remove messages from archive: %v", topic, aerr)
+		}
+	}
 
 	// TODO: move to adapter.
 	if delID > 0 {
@@ -748,9 +1036,34 @@ func (messagesMapper) DeleteList(topic string, delID int, forUser types.Uid, ran
 	return err
 }
 
-// GetAll returns multiple messages.
-func (messagesMapper) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Message, error) {
-	return adp.MessageGetAll(topic, forUser, opt)
+// GetAll returns multiple messages. Messages older than the live ones are read from the archive unless
+// 'archived' is false, i.e. the topic is known to have no archive, see HasArchive.
+func (messagesMapper) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt, archived bool) ([]types.Message, error) {
+	msgs, err := adp.MessageGetAll(topic, forUser, opt)
+	if err != nil || mediaHandler == nil || !archived {
+		return msgs, err
+	}
+	return appendArchived(topic, forUser, opt, msgs)
+}
+
+// HasArchive checks if some messages of the topic were moved to the archive.
+func (messagesMapper) HasArchive(topic string) (bool, error) {
+	if mediaHandler == nil {
+		return false, nil
+	}
+	segments, err := archiveSegments(topic)
+	return len(segments) > 0, err
+}
+
+// Export returns up to 'limit' messages of the topic with seq IDs greater than 'after' in ascending
+// order, together with IDs of attached files. Hard-deleted messages are skipped, archived messages
+// are read from the archive. If 'from' is not zero, only messages sent by that user are returned.
+func (messagesMapper) Export(topic string, from types.Uid, after, limit int) ([]types.Message, error) {
+	msgs, err := adp.MessageExport(topic, from, after, limit)
+	if err != nil || mediaHandler == nil {
+		return msgs, err
+	}
+	return exportArchived(topic, msgs)
 }
 
 // GetDeleted returns the ranges of deleted messages and the largest DelId reported in the list.
@@ -776,6 +1089,210 @@ func (messagesMapper) GetDeleted(topic string, forUser types.Uid, opt *types.Que
 	return ranges, maxID, nil
 }
 
+// GetExpired returns up to 'limit' topics with the ranges of messages which have outlived the topic's message TTL.
+// If 'accept' is not nil, only the topics it accepts are checked.
+func (messagesMapper) GetExpired(now time.Time, accept func(topic string) bool, limit int) (map[string]types.Range, error) {
+	return adp.MessageGetExpired(now, accept, limit)
+}
+
+// Search finds messages in the given topics which contain all of the given words, most recent first.
+func (messagesMapper) Search(topics []string, forUser types.Uid, words []string, opt *types.QueryOpt) ([]types.Message, error) {
+	var lowercase []string
+	for _, word := range words {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			lowercase = append(lowercase, word)
+		}
+	}
+	if len(topics) == 0 || len(lowercase) == 0 {
+		return nil, nil
+	}
+
+	if searchIndexer == nil {
+		return adp.MessageSearch(topics, forUser, lowercase, opt)
+	}
+
+	var limit int
+	if opt != nil {
+		limit = opt.Limit
+	}
+	docs, err := searchIndexer.Search(topics, forUser, lowercase, limit)
+	if err != nil {
+		return nil, err
+	}
+	live, err := liveSearchHits(docs, forUser)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []types.Message
+	for i := range docs {
+		doc := &docs[i]
+		if !live[doc.Topic][doc.SeqId] {
+			// The index is stale: the message was deleted but removing it from the index has failed.
+			continue
+		}
+		msgs = append(msgs, types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: doc.CreatedAt},
+			Topic:     doc.Topic,
+			SeqId:     doc.SeqId,
+			From:      doc.From,
+			PlainText: doc.Text,
+		})
+	}
+	return msgs, nil
+}
+
+// liveSearchHits checks which of the messages found by the search indexer still exist in the DB and
+// are not deleted for the user. Returns a map topic -> seq ID -> true.
+func liveSearchHits(docs []search.Document, forUser types.Uid) (map[string]map[int]bool, error) {
+	byTopic := make(map[string][]int)
+	for i := range docs {
+		byTopic[docs[i].Topic] = append(byTopic[docs[i].Topic], docs[i].SeqId)
+	}
+
+	live := make(map[string]map[int]bool, len(byTopic))
+	for topic, seqs := range byTopic {
+		sort.Ints(seqs)
+		found := make(map[int]bool, len(seqs))
+		msgs, err := adp.MessageGetAll(topic, forUser,
+			&types.QueryOpt{Since: seqs[0], Before: seqs[len(seqs)-1] + 1})
+		if err != nil {
+			return nil, err
+		}
+		// Messages are returned newest first. The result may be truncated by the adapter's limit.
+		oldest := seqs[0]
+		for i := range msgs {
+			found[msgs[i].SeqId] = true
+			oldest = msgs[i].SeqId
+		}
+		for _, seq := range seqs {
+			if seq >= oldest {
+				break
+			}
+			// Outside of the returned page: check one by one.
+			one, err := adp.MessageGetAll(topic, forUser, &types.QueryOpt{Since: seq, Before: seq + 1, Limit: 1})
+			if err != nil {
+				return nil, err
+			}
+			found[seq] = len(one) > 0
+		}
+		live[topic] = found
+	}
+	return live, nil
+}
+
+// indexMessage adds a saved or edited message to the external search index, if one is used.
+// Indexing errors are logged but otherwise ignored: the message is already saved.
+func indexMessage(msg *types.Message, plainText string) {
+	if searchIndexer == nil {
+		return
+	}
+
+	var err error
+	if plainText == "" {
+		// The message has no text (e.g. edited to an attachment only), make sure the old text is not found.
+		err = searchIndexer.Delete(msg.Topic, types.ZeroUid, []types.Range{{Low: msg.SeqId}})
+	} else {
+		err = searchIndexer.Index(&search.Document{
+			Topic:     msg.Topic,
+			SeqId:     msg.SeqId,
+			From:      msg.From,
+			CreatedAt: msg.CreatedAt,
+			Text:      plainText,
+		})
+	}
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to index message (seq: %d): %v", msg.Topic, msg.SeqId, err)
+	}
+}
+
+// React sets, replaces or, if value is empty, removes user's reaction to a message.
+func (messagesMapper) React(topic string, seqId int, user types.Uid, value string) error {
+	event := &cdc.Event{Object: cdc.ObjReaction, Topic: topic, SeqId: seqId, User: user.String()}
+	if value == "" {
+		event.Op = cdc.OpDelete
+		change := newChange(event, nil)
+		if err := change.adapter().ReactionDelete(topic, seqId, user); err != nil {
+			return err
+		}
+		change.record()
+		return nil
+	}
+	reaction := &types.Reaction{
+		CreatedAt: types.TimeNow(),
+		Topic:     topic,
+		SeqId:     seqId,
+		User:      user.String(),
+		Value:     value,
+	}
+	// Replaced reactions are recorded as created.
+	event.Op = cdc.OpCreate
+	change := newChange(event, reaction)
+	if err := change.adapter().ReactionUpsert(reaction); err != nil {
+		return err
+	}
+	change.record()
+	return nil
+}
+
+// GetReactions returns reactions to messages with seq IDs in range [opt.Since, opt.Before).
+func (messagesMapper) GetReactions(topic string, opt *types.QueryOpt) ([]types.Reaction, error) {
+	return adp.ReactionGetAll(topic, opt)
+}
+
+// ThreadRead records the latest reply in the thread read by the user.
+func (messagesMapper) ThreadRead(topic string, user types.Uid, thread, readSeqId int) error {
+	return adp.ThreadReadUpdate(topic, user, thread, readSeqId)
+}
+
+// GetThreads returns summaries of all threads in the topic as seen by the given user.
+func (messagesMapper) GetThreads(topic string, forUser types.Uid) ([]types.ThreadStatus, error) {
+	return adp.ThreadGetAll(topic, forUser)
+}
+
+// Schedule saves a message for delivery at msg.SendAt.
+func (messagesMapper) Schedule(msg *types.ScheduledMessage, attachmentURLs []string) error {
+	msg.InitTimes()
+	msg.SetUid(Store.GetUid())
+
+	msg.Attachments = nil
+	for _, url := range attachmentURLs {
+		// Convert attachment URLs to file IDs. File IDs are accepted as attachment URLs
+		// when the message is published.
+		if fid := mediaHandler.GetIdFromUrl(url); !fid.IsZero() {
+			msg.Attachments = append(msg.Attachments, fid.String())
+		}
+	}
+
+	return adp.SchedMsgSave(msg)
+}
+
+// GetScheduled returns pending scheduled messages sent by the user to the topic.
+func (messagesMapper) GetScheduled(topic string, user types.Uid) ([]types.ScheduledMessage, error) {
+	return adp.SchedMsgGetAll(topic, user)
+}
+
+// GetScheduledById returns the pending scheduled message with the given ID or types.ErrNotFound.
+func (messagesMapper) GetScheduledById(id types.Uid) (*types.ScheduledMessage, error) {
+	return adp.SchedMsgGet(id)
+}
+
+// GetScheduledDue returns up to 'limit' scheduled messages which are due for delivery before the given time.
+// If 'accept' is not nil, only messages to the topics it accepts are returned.
+func (messagesMapper) GetScheduledDue(before time.Time, accept func(topic string) bool, limit int) ([]types.ScheduledMessage, error) {
+	return adp.SchedMsgGetDue(before, accept, limit)
+}
+
+// Reschedule saves back a scheduled message previously read from the store, with the same ID and attachments.
+func (messagesMapper) Reschedule(msg *types.ScheduledMessage) error {
+	return adp.SchedMsgSave(msg)
+}
+
+// DeleteScheduled deletes a scheduled message. If user is not zero, only the message sent by the user
+// is deleted. Returns types.ErrNotFound if the message does not exist, i.e. it was already published or deleted.
+func (messagesMapper) DeleteScheduled(id, user types.Uid) error {
+	return adp.SchedMsgDelete(id, user)
+}
+
 // Registered authentication handlers.
 var authHandlers map[string]auth.AuthHandler
 
@@ -986,6 +1503,33 @@ func (storeObj) UseMediaHandler(name, config string) error {
 	return mediaHandler.Init(config)
 }
 
+// Registered search indexers.
+var searchIndexers map[string]search.Indexer
+
+// RegisterSearchIndexer saves reference to an external full-text index of messages.
+func RegisterSearchIndexer(name string, idx search.Indexer) {
+	if searchIndexers == nil {
+		searchIndexers = make(map[string]search.Indexer)
+	}
+
+	if idx == nil {
+		panic("RegisterSearchIndexer: indexer is nil")
+	}
+	if _, dup := searchIndexers[name]; dup {
+		panic("RegisterSearchIndexer: called twice for indexer " + name)
+	}
+	searchIndexers[name] = idx
+}
+
+// UseSearchIndexer sets specified search indexer to be used instead of the full-text search of the database.
+func (storeObj) UseSearchIndexer(name, config string) error {
+	searchIndexer = searchIndexers[name]
+	if searchIndexer == nil {
+		panic("UseSearchIndexer: unknown indexer '" + name + "'")
+	}
+	return searchIndexer.Init(config)
+}
+
 // FilePersistenceInterface is an interface wchich defines methods used for file handling (records or uploaded files).
 type FilePersistenceInterface interface {
 	// StartUpload records that the given user initiated a file upload
@@ -1010,12 +1554,29 @@ var Files FilePersistenceInterface
 // StartUpload records that the given user initiated a file upload
 func (fileMapper) StartUpload(fd *types.FileDef) error {
 	fd.Status = types.UploadStarted
-	return adp.FileStartUpload(fd)
+	change := newChange(&cdc.Event{Object: cdc.ObjFile, Op: cdc.OpCreate, Id: fd.Id}, fd)
+	if err := change.adapter().FileStartUpload(fd); err != nil {
+		return err
+	}
+	change.record()
+	return nil
 }
 
 // FinishUpload marks started upload as successfully finished or failed.
 func (fileMapper) FinishUpload(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
-	return adp.FileFinishUpload(fd, success, size)
+	var change *pendingChange
+	if success {
+		change = newChange(&cdc.Event{Object: cdc.ObjFile, Op: cdc.OpUpdate, Id: fd.Id}, fd)
+	} else {
+		// Records of failed uploads are deleted.
+		change = newChange(&cdc.Event{Object: cdc.ObjFile, Op: cdc.OpDelete, Id: fd.Id, Hard: true}, nil)
+	}
+	fd, err := change.adapter().FileFinishUpload(fd, success, size)
+	if err != nil {
+		return nil, err
+	}
+	change.record()
+	return fd, nil
 }
 
 // Get fetches a file record for a unique file id.
@@ -1030,6 +1591,9 @@ func (fileMapper) DeleteUnused(olderThan time.Time, limit int) error {
 		return err
 	}
 	if len(toDel) > 0 {
+		// The adapter returns locations of deleted files rather than IDs. They are known only after the change.
+		newChange(&cdc.Event{Object: cdc.ObjFile, Op: cdc.OpDelete, Hard: true},
+			map[string]interface{}{"Locations": toDel}).record()
 		logs.Warn.Println("deleting media", toDel)
 		return Store.GetMediaHandler().Delete(toDel)
 	}
@@ -1103,5 +1667,7 @@ func init() {
 	Messages = messagesMapper{}
 	Devices = deviceMapper{}
 	Files = fileMapper{}
+	Changes = changesMapper{}
+	Logins = loginsMapper{}
 	PCache = pcacheMapper{}
 }
@@ -0,0 +1,147 @@
+package store_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/volvlabs/towncryer-chat-server/server/db/memory"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/search"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Tests run against the in-memory adapter.
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	// The adapter registers itself only when built with the 'memory' tag.
+	store.RegisterAdapter(memory.GetTestAdapter())
+	config, _ := json.Marshal(map[string]any{
+		"uid_key":     []byte("la6YsO+bNX/+XIkO"),
+		"use_adapter": "memory",
+	})
+	if err := store.Store.Open(1, config); err != nil {
+		logs.Err.Fatal("failed to open store: ", err)
+	}
+	code := m.Run()
+	store.Store.Close()
+	os.Exit(code)
+}
+
+// resetDb drops all data.
+func resetDb(t *testing.T) {
+	t.Helper()
+	if err := store.Store.GetAdapter().CreateDb(true); err != nil {
+		t.Fatal("CreateDb:", err)
+	}
+}
+
+func createUser(t *testing.T, name string) types.Uid {
+	t.Helper()
+	user, err := store.Users.Create(&types.User{
+		Access: types.DefaultAccess{Auth: types.ModeCAuth, Anon: types.ModeNone},
+		Public: map[string]any{"fn": name},
+	}, nil)
+	if err != nil {
+		t.Fatal("Users.Create:", err)
+	}
+	return user.Uid()
+}
+
+// createTopic creates a group topic owned by the user.
+func createTopic(t *testing.T, owner types.Uid) string {
+	t.Helper()
+	topic := &types.Topic{
+		ObjHeader: types.ObjHeader{Id: "grp" + store.Store.GetUidString()},
+		Access:    types.DefaultAccess{Auth: types.ModeCPublic, Anon: types.ModeNone},
+	}
+	if err := store.Topics.Create(topic, owner, nil); err != nil {
+		t.Fatal("Topics.Create:", err)
+	}
+	return topic.Id
+}
+
+// saveMessages saves messages with the given texts. The messages are created an hour ago.
+func saveMessages(t *testing.T, topic string, from types.Uid, texts ...string) {
+	t.Helper()
+	stored, err := store.Topics.Get(topic)
+	if err != nil || stored == nil {
+		t.Fatal("Topics.Get:", err)
+	}
+	for i, text := range texts {
+		msg := &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: types.TimeNow().Add(-time.Hour)},
+			SeqId:     stored.SeqId + i + 1,
+			Topic:     topic,
+			From:      from.String(),
+			Content:   text,
+		}
+		if err, _ := store.Messages.Save(msg, nil, false); err != nil {
+			t.Fatal("Messages.Save:", err)
+		}
+	}
+}
+
+// staticIndexer is a search indexer which always returns the same documents.
+type staticIndexer struct {
+	docs []search.Document
+}
+
+func (ix *staticIndexer) Init(jsconf string) error { return nil }
+func (ix *staticIndexer) Close() error             { return nil }
+func (ix *staticIndexer) Index(doc *search.Document) error {
+	return nil
+}
+func (ix *staticIndexer) Delete(topic string, forUser types.Uid, ranges []types.Range) error {
+	return nil
+}
+func (ix *staticIndexer) Search(topics []string, forUser types.Uid, words []string, limit int) ([]search.Document, error) {
+	return ix.docs, nil
+}
+
+// Search must skip stale hits of the index: messages hard-deleted or deleted for the user.
+func TestSearchSkipsDeletedMessages(t *testing.T) {
+	resetDb(t)
+	alice := createUser(t, "Alice")
+	bob := createUser(t, "Bob")
+	topic := createTopic(t, alice)
+	saveMessages(t, topic, alice, "one", "two", "three", "four", "five")
+
+	ix := &staticIndexer{}
+	for seq := 5; seq >= 1; seq-- {
+		ix.docs = append(ix.docs, search.Document{Topic: topic, SeqId: seq, From: alice.String(), Text: "match"})
+	}
+	defer store.SetSearchIndexer(ix)()
+
+	// Deletions are not propagated to the index by staticIndexer.
+	if err := store.Messages.DeleteList(topic, 1, types.ZeroUid, []types.Range{{Low: 2}}); err != nil {
+		t.Fatal("DeleteList hard:", err)
+	}
+	if err := store.Messages.DeleteList(topic, 2, bob, []types.Range{{Low: 4}}); err != nil {
+		t.Fatal("DeleteList for user:", err)
+	}
+
+	check := func(user types.Uid, want ...int) {
+		t.Helper()
+		msgs, err := store.Messages.Search([]string{topic}, user, []string{"match"}, nil)
+		if err != nil {
+			t.Fatal("Search:", err)
+		}
+		var got []int
+		for _, msg := range msgs {
+			got = append(got, msg.SeqId)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Search for %s: expected %v, got %v", user, want, got)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("Search for %s: expected %v, got %v", user, want, got)
+			}
+		}
+	}
+	check(alice, 5, 4, 3, 1)
+	check(bob, 5, 3, 1)
+}
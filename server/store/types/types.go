@@ -51,6 +51,10 @@ const (
 	ErrInvalidResponse = StoreError("invalid response")
 	// ErrRedirected means the subscription request was redirected to another topic.
 	ErrRedirected = StoreError("redirected")
+	// ErrTooManyAttempts means the action is blocked for some time after too many failed attempts.
+	ErrTooManyAttempts = StoreError("too many attempts")
+	// ErrConflict means the object was changed concurrently and the operation was not performed.
+	ErrConflict = StoreError("conflict")
 )
 
 // Uid is a database-specific record id, suitable to be used as a primary key.
@@ -411,6 +415,22 @@ func (ss StringSlice) Value() (driver.Value, error) {
 	return json.Marshal(ss)
 }
 
+// IntSlice is defined so Scanner and Valuer can be attached to it.
+type IntSlice []int
+
+// Scan implements sql.Scanner interface.
+func (is *IntSlice) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), is)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (is IntSlice) Value() (driver.Value, error) {
+	return json.Marshal(is)
+}
+
 // ObjState represents information on objects state,
 // such as an indication that User or Topic is suspended/soft-deleted.
 type ObjState int
@@ -521,6 +541,9 @@ type User struct {
 	DeviceArray []*DeviceDef `json:"-" bson:"devices"`
 	// Channel options are WhatsApp, Website SDK or Instagram
 	Channel string `json:"channel,omitempty"`
+
+	// IDs of the files attached to the user (avatar). Not loaded by all adapters.
+	Attachments StringSlice `json:"Attachments,omitempty" bson:",omitempty"`
 }
 
 // AccessMode is a definition of access mode bits.
@@ -671,12 +694,15 @@ func (m *AccessMode) UnmarshalJSON(b []byte) error {
 }
 
 // Scan is an implementation of sql.Scanner interface. It expects the
-// value to be a byte slice representation of an ASCII string.
+// value to be a byte slice or a string representation of an ASCII string.
 func (m *AccessMode) Scan(val interface{}) error {
-	if bb, ok := val.([]byte); ok {
-		return m.UnmarshalText(bb)
+	switch v := val.(type) {
+	case []byte:
+		return m.UnmarshalText(v)
+	case string:
+		return m.UnmarshalText([]byte(v))
 	}
-	return errors.New("scan failed: data is not a byte slice")
+	return errors.New("scan failed: data is neither a byte slice nor a string")
 }
 
 // Value is an implementation of sql.driver.Valuer interface.
@@ -1093,6 +1119,15 @@ type Topic struct {
 	// Indexed tags for finding this topic.
 	Tags StringSlice
 
+	// IDs of pinned messages, most recently pinned first.
+	Pinned IntSlice
+
+	// Lifetime of messages in seconds. Older messages are deleted. Zero means messages never expire.
+	MsgTTL int
+
+	// IDs of the files attached to the topic (avatar). Not loaded by all adapters.
+	Attachments StringSlice `json:"Attachments,omitempty" bson:",omitempty"`
+
 	// Deserialized ephemeral params
 	perUser map[Uid]*perUserData // deserialized from Subscription
 }
@@ -1167,6 +1202,11 @@ type MessageHeaders map[string]interface{}
 
 // Scan implements sql.Scanner interface.
 func (mh *MessageHeaders) Scan(val interface{}) error {
+	if val == nil {
+		// Headers of deleted and archived messages.
+		*mh = nil
+		return nil
+	}
 	return json.Unmarshal(val.([]byte), mh)
 }
 
@@ -1187,9 +1227,59 @@ type Message struct {
 	SeqId      int
 	Topic      string
 	// Sender's user ID as string (without 'usr' prefix), could be empty.
+	From string
+	// SeqId of the parent message, i.e. the first message of the thread this message is a reply in.
+	// Zero if the message is not a part of a thread.
+	Thread  int            `json:"Thread,omitempty" bson:",omitempty"`
+	Head    MessageHeaders `json:"Head,omitempty" bson:",omitempty"`
+	Content interface{}
+	// Text of the message content for full-text search, not sent to clients.
+	PlainText string `json:"PlainText,omitempty" bson:",omitempty"`
+	// IDs of the files attached to the message. Not loaded by all adapters.
+	Attachments StringSlice `json:"Attachments,omitempty" bson:",omitempty"`
+}
+
+// MsgDelIdArchived is the DelId of a message moved to the archive. The message is kept
+// as a stub without content, the content is stored in a segment file.
+const MsgDelIdArchived = -1
+
+// ScheduledMessage is a {pub} message held by the server until it's due for delivery.
+type ScheduledMessage struct {
+	ObjHeader `bson:",inline"`
+	// Time when the message should be published.
+	SendAt time.Time
+	Topic  string
+	// Sender's user ID as string (without 'usr' prefix).
 	From    string
 	Head    MessageHeaders `json:"Head,omitempty" bson:",omitempty"`
 	Content interface{}
+	// IDs of the files attached to the message.
+	Attachments StringSlice `json:"Attachments,omitempty" bson:",omitempty"`
+}
+
+// ThreadStatus is a summary of replies in one thread as seen by one user.
+type ThreadStatus struct {
+	// SeqId of the parent message of the thread.
+	Thread int
+	// Number of replies in the thread.
+	Count int
+	// SeqId of the latest reply.
+	LastSeqId int
+	// SeqId of the latest reply read by the user.
+	ReadSeqId int
+	// Number of replies newer than ReadSeqId.
+	Unread int
+}
+
+// Reaction is a single user's reaction to a message. A user may have at most one reaction per message.
+type Reaction struct {
+	CreatedAt time.Time
+	Topic     string
+	SeqId     int
+	// User ID of the reacting user as string (without 'usr' prefix).
+	User string
+	// Reaction value, usually an emoji.
+	Value string
 }
 
 // Range is a range of message SeqIDs. Low end is inclusive (closed), high end is exclusive (open): [Low, Hi).
@@ -1271,6 +1361,8 @@ type QueryOpt struct {
 	// ID-based query parameters: Messages
 	Since  int
 	Before int
+	// Messages: replies in the thread with this parent SeqId only.
+	Thread int
 	// Common parameter
 	Limit int
 }
@@ -1322,6 +1414,24 @@ type DeviceDef struct {
 	Lang string
 }
 
+// Login is a server-side record of a revocable authentication token. Tokens re-issued to the session
+// which logged in with a token share the record of that token.
+type Login struct {
+	// Random ID of the record.
+	Id string `json:"-"`
+	// Client which received the token.
+	UserAgent  string `json:"ua,omitempty"`
+	RemoteAddr string `json:"ip,omitempty"`
+	DeviceId   string `json:"dev,omitempty"`
+	// Tokens cannot be used for logging in, like tokens for validating credentials.
+	NoLogin   bool      `json:"nologin,omitempty"`
+	CreatedAt time.Time `json:"created"`
+	// Time when the latest token was issued.
+	LastSeen time.Time `json:"seen"`
+	// Expiration time of the latest token.
+	Expires time.Time `json:"expires"`
+}
+
 // Media handling constants
 const (
 	// UploadStarted indicates that the upload has started but not finished yet.
@@ -9,12 +9,16 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	"github.com/volvlabs/towncryer-chat-server/server/drafty"
 	"github.com/volvlabs/towncryer-chat-server/server/logs"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
 	"github.com/volvlabs/towncryer-chat-server/server/store/types"
@@ -45,6 +49,8 @@ type Topic struct {
 	lastID int
 	// ID of the deletion operation. Not an ID of the message.
 	delID int
+	// Some messages were moved to the archive. Set when the topic is loaded and by the archiver.
+	archived atomic.Bool
 
 	// Last published userAgent ('me' topic only)
 	userAgent string
@@ -64,6 +70,12 @@ type Topic struct {
 	// Topic's trusted data
 	trusted any
 
+	// IDs of pinned messages, most recently pinned first
+	pinned []int
+
+	// Lifetime of messages in seconds, 0 if messages never expire
+	msgTTL int
+
 	// Topic's per-subscriber data
 	perUser map[types.Uid]perUserData
 	// Union of permissions across all users (used by proxy sessions with uid = 0).
@@ -383,6 +395,31 @@ func (t *Topic) handleMetaGet(msg *ClientComMessage, asUid types.Uid, asChan boo
 			logs.Warn.Printf("topic[%s] meta.Get.Del failed: %s", t.name, err)
 		}
 	}
+	if msg.MetaWhat&constMsgMetaReact != 0 {
+		if err := t.replyGetReact(msg.sess, asUid, asChan, msg.Get.React, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.React failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaThread != 0 {
+		if err := t.replyGetThread(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Thread failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaSched != 0 {
+		if err := t.replyGetSched(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Sched failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaSearch != 0 {
+		if err := t.replyGetSearch(msg.sess, asUid, msg.Get.Search, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Search failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaRcpt != 0 {
+		if err := t.replyGetRcpt(msg.sess, asUid, asChan, msg.Get.Rcpt, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Rcpt failed: %s", t.name, err)
+		}
+	}
 	if msg.MetaWhat&constMsgMetaTags != 0 {
 		if err := t.replyGetTags(msg.sess, asUid, msg); err != nil {
 			logs.Warn.Printf("topic[%s] meta.Get.Tags failed: %s", t.name, err)
@@ -394,6 +431,16 @@ func (t *Topic) handleMetaGet(msg *ClientComMessage, asUid types.Uid, asChan boo
 			logs.Warn.Printf("topic[%s] meta.Get.Creds failed: %s", t.name, err)
 		}
 	}
+	if msg.MetaWhat&constMsgMetaExport != 0 {
+		if err := t.replyGetExport(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Export failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaLogin != 0 {
+		if err := t.replyGetLogins(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Login failed: %s", t.name, err)
+		}
+	}
 }
 
 func (t *Topic) handleMetaSet(msg *ClientComMessage, asUid types.Uid, asChan bool, authLevel auth.Level) {
@@ -426,13 +473,21 @@ func (t *Topic) handleMetaDel(msg *ClientComMessage, asUid types.Uid, asChan boo
 	var err error
 	switch msg.MetaWhat {
 	case constMsgDelMsg:
-		err = t.replyDelMsg(msg.sess, asUid, asChan, msg)
+		if msg.expired {
+			err = t.deleteExpired(msg)
+		} else {
+			err = t.replyDelMsg(msg.sess, asUid, asChan, msg)
+		}
 	case constMsgDelSub:
 		err = t.replyDelSub(msg.sess, asUid, msg)
 	case constMsgDelTopic:
 		err = t.replyDelTopic(msg.sess, asUid, msg)
 	case constMsgDelCred:
 		err = t.replyDelCred(msg.sess, asUid, authLevel, msg)
+	case constMsgDelSched:
+		err = t.replyDelSched(msg.sess, asUid, msg)
+	case constMsgDelLogin:
+		err = t.replyDelLogin(msg.sess, asUid, msg)
 	}
 
 	if err != nil {
@@ -594,6 +649,10 @@ func (t *Topic) runLocal(hub *Hub) {
 func (t *Topic) handleClientMsg(msg *ClientComMessage) {
 	if msg.Pub != nil {
 		t.handlePubBroadcast(msg)
+		if !msg.sched.IsZero() && len(t.sessions) == 0 && t.cat != types.TopicCatSys {
+			// The topic may have been loaded just to publish a scheduled message. Let it expire.
+			t.killTimer.Reset(idleMasterTopicTimeout)
+		}
 	} else if msg.Note != nil {
 		t.handleNoteBroadcast(msg)
 	} else {
@@ -681,6 +740,34 @@ func (t *Topic) handleSubscription(msg *ClientComMessage) error {
 		}
 	}
 
+	if getWhat&constMsgMetaReact != 0 {
+		// Send get.react response as a separate {meta} packet
+		if err := t.replyGetReact(msg.sess, asUid, asChan, msgsub.Get.React, msg); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.React failed: %v sid=%s", t.name, err, msg.sess.sid)
+		}
+	}
+
+	if getWhat&constMsgMetaThread != 0 {
+		// Send get.thread response as a separate {meta} packet
+		if err := t.replyGetThread(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.Thread failed: %v sid=%s", t.name, err, msg.sess.sid)
+		}
+	}
+
+	if getWhat&constMsgMetaSched != 0 {
+		// Send get.sched response as a separate {meta} packet
+		if err := t.replyGetSched(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.Sched failed: %v sid=%s", t.name, err, msg.sess.sid)
+		}
+	}
+
+	if getWhat&constMsgMetaRcpt != 0 {
+		// Send get.rcpt response as a separate {meta} packet
+		if err := t.replyGetRcpt(msg.sess, asUid, asChan, msgsub.Get.Rcpt, msg); err != nil {
+			logs.Warn.Printf("topic[%s] handleSubscription Get.Rcpt failed: %v sid=%s", t.name, err, msg.sess.sid)
+		}
+	}
+
 	return nil
 }
 
@@ -984,6 +1071,23 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 		delete(head, "sender")
 	}
 
+	// The "edited" header is set by the server only.
+	delete(head, "edited")
+
+	// Message with the "replace" header is an edit of an earlier message, unless it's a video call update.
+	if seq := parseSeqRef(head["replace"]); seq > 0 && head["webrtc"] == nil {
+		return t.saveAndBroadcastEdit(msg, asUid, noEcho, attachments, head, content, seq)
+	}
+
+	// Message with the "thread" header is a reply in the thread started by an earlier message.
+	thread := 0
+	if ref, ok := head["thread"]; ok {
+		if thread = parseSeqRef(ref); thread == 0 || thread > t.lastID {
+			msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
+			return types.ErrMalformed
+		}
+	}
+
 	markedReadBySender := false
 	if err, unreadUpdated := store.Messages.Save(
 		&types.Message{
@@ -991,6 +1095,7 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 			SeqId:     t.lastID + 1,
 			Topic:     t.name,
 			From:      asUid.String(),
+			Thread:    thread,
 			Head:      head,
 			Content:   content,
 		}, attachments, (pud.modeGiven & pud.modeWant).IsReader()); err != nil {
@@ -1053,6 +1158,186 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 	return nil
 }
 
+// Replaces content of the {pub} message with the content of the message being forwarded after checking
+// that the sender can read it. The topic, ID and sender of the forwarded message are saved in the "origin" header.
+// Files attached to the forwarded message are attached to the new message too.
+func (t *Topic) resolveForward(msg *ClientComMessage, asUid types.Uid) error {
+	fwd := msg.Pub.Forward
+	head := msg.Pub.Head
+	if fwd.SeqId <= 0 || msg.Pub.Content != nil || head["replace"] != nil || head["webrtc"] != nil {
+		msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
+		return types.ErrMalformed
+	}
+
+	// Name of the topic the subscription is to and the name the messages are stored under.
+	var subName, dbName string
+	switch {
+	case strings.HasPrefix(fwd.Topic, "usr"):
+		if uid2 := types.ParseUserId(fwd.Topic); !uid2.IsZero() && uid2 != asUid {
+			subName = asUid.P2PName(uid2)
+			dbName = subName
+		}
+	case strings.HasPrefix(fwd.Topic, "grp"):
+		subName = fwd.Topic
+		dbName = subName
+	case types.IsChannel(fwd.Topic):
+		// Channel messages are stored in the group topic.
+		subName = fwd.Topic
+		dbName = types.ChnToGrp(fwd.Topic)
+	}
+	if subName == "" {
+		msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
+		return types.ErrMalformed
+	}
+
+	sub, err := store.Subs.Get(subName, asUid, false)
+	if err != nil {
+		msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
+		return err
+	}
+	if sub == nil || !(sub.ModeWant & sub.ModeGiven).IsReader() {
+		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+		return types.ErrPermissionDenied
+	}
+
+	// Messages deleted by the sender are not found. The source topic is not loaded here, so its archive
+	// is checked too.
+	msgs, err := store.Messages.GetAll(dbName, asUid,
+		&types.QueryOpt{Since: fwd.SeqId, Before: fwd.SeqId + 1, Limit: 1}, true)
+	if err != nil {
+		msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
+		return err
+	}
+	if len(msgs) == 0 {
+		msg.sess.queueOut(ErrNotFound(msg.Id, t.original(asUid), msg.Timestamp))
+		return types.ErrNotFound
+	}
+	src := &msgs[0]
+
+	if head == nil {
+		head = make(map[string]any)
+	}
+	if mime, ok := src.Head["mime"]; ok {
+		head["mime"] = mime
+	}
+	origin := map[string]any{
+		"topic": fwd.Topic,
+		"seq":   fwd.SeqId,
+	}
+	if from := types.ParseUid(src.From); !from.IsZero() && !types.IsChannel(fwd.Topic) {
+		// Channel readers don't see the sender, so it's not revealed by forwarding either.
+		origin["from"] = from.UserId()
+	}
+	head["origin"] = origin
+
+	msg.Pub.Head = head
+	msg.Pub.Content = src.Content
+	if refs := drafty.Attachments(src.Content); len(refs) > 0 {
+		if msg.Extra == nil {
+			msg.Extra = &MsgClientExtra{}
+		}
+		msg.Extra.Attachments = refs
+	}
+
+	return nil
+}
+
+// Replaces head and content of an earlier message with the given seq ID in response to a client request
+// (msg, asUid) and broadcasts the updated message to the attached sessions. The previous version
+// of the message is kept as a revision.
+func (t *Topic) saveAndBroadcastEdit(msg *ClientComMessage, asUid types.Uid, noEcho bool, attachments []string, head map[string]any, content any, seq int) error {
+	if seq > t.lastID {
+		msg.sess.queueOut(ErrNotFound(msg.Id, t.original(asUid), msg.Timestamp))
+		return types.ErrNotFound
+	}
+
+	orig, err := store.Messages.GetAll(t.name, asUid, &types.QueryOpt{Since: seq, Before: seq + 1, Limit: 1}, t.archived.Load())
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load message for editing: %v", t.name, err)
+		msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
+		return err
+	}
+	if len(orig) == 0 {
+		msg.sess.queueOut(ErrNotFound(msg.Id, t.original(asUid), msg.Timestamp))
+		return types.ErrNotFound
+	}
+	// Only the author may edit the message.
+	if orig[0].From != asUid.String() {
+		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+		return types.ErrPermissionDenied
+	}
+
+	// The message is replaced in place, the stored head does not need the "replace" header.
+	stored := make(map[string]any, len(head))
+	for key, val := range head {
+		if key != "replace" {
+			stored[key] = val
+		}
+	}
+	stored["edited"] = msg.Timestamp.Format(time.RFC3339Nano)
+
+	if err := store.Messages.Edit(&types.Message{
+		ObjHeader: types.ObjHeader{CreatedAt: orig[0].CreatedAt, UpdatedAt: msg.Timestamp},
+		SeqId:     seq,
+		Topic:     t.name,
+		From:      asUid.String(),
+		Head:      stored,
+		Content:   content,
+	}, attachments); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to edit message (seq: %d): %v", t.name, seq, err)
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), msg.Timestamp, msg.Timestamp, nil))
+		return err
+	}
+
+	if msg.Id != "" && msg.sess != nil {
+		reply := NoErrAccepted(msg.Id, t.original(asUid), msg.Timestamp)
+		reply.Ctrl.Params = map[string]any{"seq": seq}
+		msg.sess.queueOut(reply)
+	}
+
+	// Attached sessions receive the "replace" header to update the message in place.
+	head = make(map[string]any, len(stored)+1)
+	for key, val := range stored {
+		head[key] = val
+	}
+	head["replace"] = ":" + strconv.Itoa(seq)
+
+	data := &ServerComMessage{
+		Data: &MsgServerData{
+			Topic:     msg.Original,
+			From:      msg.AsUser,
+			Timestamp: orig[0].CreatedAt,
+			SeqId:     seq,
+			Head:      head,
+			Content:   content,
+		},
+		// Internal-only values.
+		Id:        msg.Id,
+		RcptTo:    msg.RcptTo,
+		AsUser:    msg.AsUser,
+		Timestamp: msg.Timestamp,
+		sess:      msg.sess,
+	}
+	if noEcho {
+		data.SkipSid = msg.sess.sid
+	}
+
+	// Tell the plugins that a message was updated.
+	pluginMessage(data.Data, plgActUpd)
+
+	t.broadcastToSessions(data)
+
+	// Edited message is not a new message, it should not change the unread count.
+	if pushRcpt := t.pushForData(asUid, data.Data, true); pushRcpt != nil {
+		for uid, rcpt := range pushRcpt.To {
+			rcpt.ShouldIncrementUnreadCountInCache = false
+			pushRcpt.To[uid] = rcpt
+		}
+		sendPush(pushRcpt)
+	}
+	return nil
+}
+
 // handlePubBroadcast fans out {pub} -> {data} messages to recipients in a master topic.
 // This is a NON-proxy broadcast.
 func (t *Topic) handlePubBroadcast(msg *ClientComMessage) {
@@ -1063,8 +1348,41 @@ func (t *Topic) handlePubBroadcast(msg *ClientComMessage) {
 		return
 	}
 
+	var sched *types.ScheduledMessage
+	if !msg.sched.IsZero() {
+		// The scheduled message is due. It may have been sent more than once or cancelled by the sender:
+		// publish it only if it's claimed by this call.
+		var err error
+		if sched, err = claimScheduled(msg.sched); sched == nil {
+			if err != nil {
+				logs.Warn.Printf("topic[%s]: failed to claim scheduled message %s: %v", t.name, msg.sched, err)
+			}
+			return
+		}
+	}
+
 	if t.isReadOnly() {
 		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+		t.finishScheduled(sched, asUid, types.ErrPermissionDenied)
+		return
+	}
+
+	if msg.sched.IsZero() {
+		// The "origin" header is set by the server only. Scheduled messages got it when they were scheduled.
+		delete(msg.Pub.Head, "origin")
+	}
+
+	if msg.Pub.Forward != nil {
+		if err := t.resolveForward(msg, asUid); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to forward message: %v", t.name, err)
+			t.finishScheduled(sched, asUid, err)
+			return
+		}
+	}
+
+	if msg.Pub.SendAt != nil && msg.Pub.SendAt.After(msg.Timestamp) {
+		// The message is to be published later.
+		t.schedulePub(msg, asUid)
 		return
 	}
 
@@ -1090,7 +1408,9 @@ func (t *Topic) handlePubBroadcast(msg *ClientComMessage) {
 		attachments = msg.Extra.Attachments
 	}
 
-	if err := t.saveAndBroadcastMessage(msg, asUid, msg.Pub.NoEcho, attachments, msg.Pub.Head, msg.Pub.Content); err != nil {
+	err := t.saveAndBroadcastMessage(msg, asUid, msg.Pub.NoEcho, attachments, msg.Pub.Head, msg.Pub.Content)
+	t.finishScheduled(sched, asUid, err)
+	if err != nil {
 		logs.Err.Printf("topic[%s]: failed to save messagge - %s", t.name, err)
 		return
 	}
@@ -1100,6 +1420,98 @@ func (t *Topic) handlePubBroadcast(msg *ClientComMessage) {
 	}
 }
 
+// claimScheduled removes the due scheduled message from the schedule before it's published. Only one of
+// concurrent claims succeeds, so the message is never published twice. Returns nil if the message was already
+// claimed or cancelled by the sender.
+func claimScheduled(id types.Uid) (*types.ScheduledMessage, error) {
+	sched, err := store.Messages.GetScheduledById(id)
+	if err == nil {
+		err = store.Messages.DeleteScheduled(id, types.ZeroUid)
+	}
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = nil
+		}
+		return nil, err
+	}
+	return sched, nil
+}
+
+// finishScheduled handles the outcome of publishing the claimed scheduled message. Messages which failed to save
+// for transient reasons, like a database error, are put back to the schedule and retried later. The sender is
+// notified of rejected messages. The message is lost if the server fails after it's claimed but before it's saved.
+func (t *Topic) finishScheduled(sched *types.ScheduledMessage, asUid types.Uid, err error) {
+	if sched == nil || err == nil {
+		return
+	}
+
+	if err != types.ErrPermissionDenied && err != types.ErrMalformed {
+		logs.Warn.Printf("topic[%s]: scheduled message %s will be retried: %v", t.name, sched.Id, err)
+		if rerr := store.Messages.Reschedule(sched); rerr != nil {
+			logs.Err.Printf("topic[%s]: failed to reschedule message %s: %v", t.name, sched.Id, rerr)
+		}
+		return
+	}
+
+	payload, _ := json.Marshal(map[string]string{"sched": sched.Id})
+	globals.hub.routeSrv <- &ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic:   "me",
+			Src:     t.original(asUid),
+			What:    "sched",
+			Event:   "rejected",
+			Payload: payload,
+		},
+		RcptTo: asUid.UserId(),
+	}
+}
+
+// schedulePub saves {pub} message for publishing at msg.Pub.SendAt.
+func (t *Topic) schedulePub(msg *ClientComMessage, asUid types.Uid) {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp && t.cat != types.TopicCatP2P {
+		msg.sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return
+	}
+
+	if msg.Pub.Head != nil && msg.Pub.Head["webrtc"] != nil {
+		// Video calls cannot be scheduled.
+		msg.sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return
+	}
+
+	pud := t.perUser[asUid]
+	if !(pud.modeWant & pud.modeGiven).IsWriter() {
+		msg.sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return
+	}
+
+	var attachments []string
+	if msg.Extra != nil {
+		attachments = msg.Extra.Attachments
+	}
+
+	sched := &types.ScheduledMessage{
+		SendAt:  *msg.Pub.SendAt,
+		Topic:   t.name,
+		From:    asUid.String(),
+		Head:    msg.Pub.Head,
+		Content: msg.Pub.Content,
+	}
+	if err := store.Messages.Schedule(sched, attachments); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to schedule message: %v", t.name, err)
+		msg.sess.queueOut(ErrUnknownReply(msg, now))
+		return
+	}
+
+	if msg.Id != "" {
+		reply := NoErrAccepted(msg.Id, t.original(asUid), msg.Timestamp)
+		reply.Ctrl.Params = map[string]any{"sched": sched.Id}
+		msg.sess.queueOut(reply)
+	}
+}
+
 // handleNoteBroadcast fans out {note} -> {info} messages to recipients in a master topic.
 // This is a NON-proxy broadcast (at master topic).
 func (t *Topic) handleNoteBroadcast(msg *ClientComMessage) {
@@ -1137,10 +1549,25 @@ func (t *Topic) handleNoteBroadcast(msg *ClientComMessage) {
 		if !mode.IsReader() {
 			return
 		}
+		if msg.Note.Thread > 0 {
+			// Position in a thread is not tracked for channel readers.
+			if !asChan {
+				t.handleThreadRead(msg, asUid)
+			}
+			return
+		}
 	case "call":
 		// Handle calls separately.
 		t.handleCallEvent(msg)
 		return
+	case "react":
+		// Filter out reactions from users with no 'R' permission and from channel readers.
+		if !mode.IsReader() || asChan {
+			return
+		}
+		// Reactions are handled separately.
+		t.handleReaction(msg, asUid)
+		return
 	}
 
 	var read, recv, unread, seq int
@@ -1234,6 +1661,64 @@ func (t *Topic) handleNoteBroadcast(msg *ClientComMessage) {
 	t.broadcastToSessions(info)
 }
 
+// handleThreadRead records user's position in a thread of replies, then notifies online subscribers.
+func (t *Topic) handleThreadRead(msg *ClientComMessage, asUid types.Uid) {
+	if msg.Note.SeqId <= msg.Note.Thread {
+		// Replies always follow the message which started the thread.
+		return
+	}
+
+	if err := store.Messages.ThreadRead(t.name, asUid, msg.Note.Thread, msg.Note.SeqId); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to update thread %d read counter: %v", t.name, msg.Note.Thread, err)
+		return
+	}
+
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic:  msg.Original,
+			From:   msg.AsUser,
+			What:   "read",
+			SeqId:  msg.Note.SeqId,
+			Thread: msg.Note.Thread,
+		},
+		RcptTo:    msg.RcptTo,
+		AsUser:    msg.AsUser,
+		Timestamp: msg.Timestamp,
+		SkipSid:   msg.sess.sid,
+		sess:      msg.sess,
+	})
+}
+
+// handleReaction saves, replaces or removes user's reaction to a message, then notifies online subscribers.
+func (t *Topic) handleReaction(msg *ClientComMessage, asUid types.Uid) {
+	seq := msg.Note.SeqId
+	// Make sure the message exists and is not deleted.
+	msgs, err := store.Messages.GetAll(t.name, asUid, &types.QueryOpt{Since: seq, Before: seq + 1, Limit: 1}, t.archived.Load())
+	if err != nil || len(msgs) == 0 {
+		return
+	}
+
+	if err := store.Messages.React(t.name, seq, asUid, msg.Note.React); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to save reaction to seq %d: %v", t.name, seq, err)
+		return
+	}
+
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic: msg.Original,
+			From:  msg.AsUser,
+			What:  "react",
+			SeqId: seq,
+			React: msg.Note.React,
+		},
+		RcptTo:    msg.RcptTo,
+		AsUser:    msg.AsUser,
+		Timestamp: msg.Timestamp,
+		SkipSid:   msg.sess.sid,
+		sess:      msg.sess,
+	})
+}
+
 // handlePresence fans out {pres} messages to recipients in topic.
 func (t *Topic) handlePresence(msg *ServerComMessage) {
 	what := t.procPresReq(msg.Pres.Src, msg.Pres.What, msg.Pres.WantReply)
@@ -2135,6 +2620,10 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, asChan bool, opts *
 			desc.DelId = max(pud.delID, t.delID)
 			desc.ReadSeqId = pud.readID
 			desc.RecvSeqId = max(pud.recvID, pud.readID)
+			if ifUpdated {
+				desc.Pinned = t.pinned
+				desc.MsgTTL = t.msgTTL
+			}
 		} else {
 			// Send some sane value of touched.
 			desc.TouchedAt = &t.updated
@@ -2220,6 +2709,18 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 			return errors.New("attempt to change Trusted by non-root")
 		}
 
+		if set.Desc.Pinned != nil && t.cat != types.TopicCatGrp {
+			// Messages can be pinned in group topics only.
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("attempt to pin messages outside of a group topic")
+		}
+
+		if set.Desc.MsgTTL != nil && t.cat != types.TopicCatGrp && t.cat != types.TopicCatP2P {
+			// Messages expire in group and p2p topics only.
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("attempt to set message TTL outside of a group or p2p topic")
+		}
+
 		switch t.cat {
 		case types.TopicCatMe:
 			// Update current user
@@ -2259,6 +2760,39 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 			return err
 		}
 
+		if set.Desc.Pinned != nil {
+			// Only topic admins can pin messages.
+			if pud := t.perUser[asUid]; asChan || !(pud.modeGiven & pud.modeWant).IsAdmin() {
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+				return errors.New("attempt to change pinned messages by non-admin")
+			}
+			pinned, err := normalizePinned(set.Desc.Pinned, t.lastID)
+			if err != nil {
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return err
+			}
+			if !intSlicesEqual(pinned, t.pinned) {
+				core["Pinned"] = types.IntSlice(pinned)
+				sendCommon = true
+			}
+		}
+
+		if set.Desc.MsgTTL != nil {
+			// Only topic admins can change lifetime of messages.
+			if pud := t.perUser[asUid]; asChan || !(pud.modeGiven & pud.modeWant).IsAdmin() {
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+				return errors.New("attempt to change message TTL by non-admin")
+			}
+			if *set.Desc.MsgTTL < 0 {
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return errors.New("negative message TTL")
+			}
+			if *set.Desc.MsgTTL != t.msgTTL {
+				core["MsgTTL"] = *set.Desc.MsgTTL
+				sendCommon = true
+			}
+		}
+
 		sendPriv = assignGenericValues(sub, "Private", t.perUser[asUid].private, set.Desc.Private)
 	}
 
@@ -2311,10 +2845,16 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 		if trusted, ok := core["Trusted"]; ok {
 			t.trusted = trusted
 		}
+		if pinned, ok := core["Pinned"]; ok {
+			t.pinned = pinned.(types.IntSlice)
+		}
 	} else if t.cat == types.TopicCatFnd {
 		// Assign per-session fnd.Public.
 		t.fndSetPublic(sess, core["Public"])
 	}
+	if ttl, ok := core["MsgTTL"]; ok {
+		t.msgTTL = ttl.(int)
+	}
 
 	pud := t.perUser[asUid]
 	mode := pud.modeGiven & pud.modeWant
@@ -2719,11 +3259,15 @@ func (t *Topic) replyGetData(sess *Session, asUid types.Uid, asChan bool, req *M
 		return errors.New("invalid MsgGetOpts query")
 	}
 
+	if req != nil && req.Hist > 0 {
+		return t.replyGetDataHistory(sess, asUid, asChan, req, msg)
+	}
+
 	// Check if the user has permission to read the topic data
 	count := 0
 	if userData := t.perUser[asUid]; (userData.modeGiven & userData.modeWant).IsReader() {
 		// Read messages from DB
-		messages, err := store.Messages.GetAll(t.name, asUid, msgOpts2storeOpts(req))
+		messages, err := store.Messages.GetAll(t.name, asUid, msgOpts2storeOpts(req), t.archived.Load())
 		if err != nil {
 			sess.queueOut(ErrUnknownReply(msg, now))
 			return err
@@ -2733,6 +3277,18 @@ func (t *Topic) replyGetData(sess *Session, asUid types.Uid, asChan bool, req *M
 		if messages != nil {
 			count = len(messages)
 			if count > 0 {
+				// Messages are sorted by SeqId in descending order.
+				reacts, err := store.Messages.GetReactions(t.name,
+					&types.QueryOpt{Since: messages[count-1].SeqId, Before: messages[0].SeqId + 1})
+				if err != nil {
+					sess.queueOut(ErrUnknownReply(msg, now))
+					return err
+				}
+				reactsBySeq := make(map[int][]MsgReaction)
+				for _, mr := range reactionsAggregate(reacts, asChan) {
+					reactsBySeq[mr.SeqId] = mr.React
+				}
+
 				outgoingMessages := make([]*ServerComMessage, count)
 				for i := range messages {
 					mm := &messages[i]
@@ -2749,6 +3305,7 @@ func (t *Topic) replyGetData(sess *Session, asUid types.Uid, asChan bool, req *M
 							From:      from,
 							Timestamp: mm.CreatedAt,
 							Content:   mm.Content,
+							React:     reactsBySeq[mm.SeqId],
 						},
 					}
 				}
@@ -2768,13 +3325,80 @@ func (t *Topic) replyGetData(sess *Session, asUid types.Uid, asChan bool, req *M
 	return nil
 }
 
-// replyGetTags returns topic's tags - tokens used for discovery.
-func (t *Topic) replyGetTags(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+// replyGetDataHistory sends revision history of one message as {data} messages: earlier revisions
+// first, the current version last.
+func (t *Topic) replyGetDataHistory(sess *Session, asUid types.Uid, asChan bool, req *MsgGetOpts, msg *ClientComMessage) error {
 	now := types.TimeNow()
+	toriginal := t.original(asUid)
 
-	if t.cat != types.TopicCatMe && t.cat != types.TopicCatGrp {
-		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
-		return errors.New("invalid topic category for getting tags")
+	if req.SinceId != 0 || req.BeforeId != 0 || req.Limit != 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts history query")
+	}
+
+	count := 0
+	if userData := t.perUser[asUid]; (userData.modeGiven & userData.modeWant).IsReader() {
+		// Make sure the message is available to the user, i.e. not deleted.
+		current, err := store.Messages.GetAll(t.name, asUid,
+			&types.QueryOpt{Since: req.Hist, Before: req.Hist + 1, Limit: 1}, t.archived.Load())
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+
+		var revisions []types.Message
+		if len(current) > 0 {
+			if revisions, err = store.Messages.GetRevisions(t.name, req.Hist); err != nil {
+				sess.queueOut(ErrUnknownReply(msg, now))
+				return err
+			}
+			// The current version was written when the message was last updated.
+			current[0].CreatedAt = current[0].UpdatedAt
+			revisions = append(revisions, current[0])
+		}
+
+		count = len(revisions)
+		if count > 0 {
+			outgoingMessages := make([]*ServerComMessage, count)
+			for i := range revisions {
+				mm := &revisions[i]
+				from := ""
+				if !asChan {
+					// Don't show sender for channel readers
+					from = types.ParseUid(mm.From).UserId()
+				}
+				outgoingMessages[i] = &ServerComMessage{
+					Data: &MsgServerData{
+						Topic:     toriginal,
+						Head:      mm.Head,
+						SeqId:     mm.SeqId,
+						From:      from,
+						Timestamp: mm.CreatedAt,
+						Content:   mm.Content,
+					},
+				}
+			}
+			sess.queueOutBatch(outgoingMessages)
+		}
+	}
+
+	if count == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "data", "hist": req.Hist}))
+	} else {
+		sess.queueOut(NoErrDeliveredParams(msg.Id, msg.Original, now,
+			map[string]any{"what": "data", "hist": req.Hist, "count": count}))
+	}
+
+	return nil
+}
+
+// replyGetTags returns topic's tags - tokens used for discovery.
+func (t *Topic) replyGetTags(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting tags")
 	}
 	if t.cat == types.TopicCatGrp && t.owner != asUid {
 		sess.queueOut(ErrPermissionDeniedReply(msg, now))
@@ -2894,6 +3518,56 @@ func (t *Topic) replyGetCreds(sess *Session, asUid types.Uid, msg *ClientComMess
 	return nil
 }
 
+// replyGetLogins returns user's logins which can be revoked.
+func (t *Topic) replyGetLogins(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting logins")
+	}
+
+	slogins, err := store.Logins.GetAll(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	var logins []MsgLogin
+	for i := range slogins {
+		sl := &slogins[i]
+		if sl.NoLogin {
+			// Tokens for validating credentials and such.
+			continue
+		}
+		logins = append(logins, MsgLogin{
+			Id:         sl.Id,
+			UserAgent:  sl.UserAgent,
+			RemoteAddr: sl.RemoteAddr,
+			DeviceId:   sl.DeviceId,
+			CreatedAt:  sl.CreatedAt,
+			LastSeen:   sl.LastSeen,
+			Expires:    sl.Expires,
+			Current:    sl.Id == sess.loginId,
+		})
+	}
+
+	if len(logins) > 0 {
+		sess.queueOut(&ServerComMessage{
+			Meta: &MsgServerMeta{
+				Id:        msg.Id,
+				Topic:     t.original(asUid),
+				Timestamp: &now,
+				Login:     logins,
+			},
+		})
+		return nil
+	}
+
+	sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "login"}))
+	return nil
+}
+
 // replySetCred adds or validates user credentials such as email and phone numbers.
 func (t *Topic) replySetCred(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
 	now := types.TimeNow()
@@ -2976,6 +3650,437 @@ func (t *Topic) replyGetDel(sess *Session, asUid types.Uid, req *MsgGetOpts, msg
 	return nil
 }
 
+// Maximum number of consecutive messages to load reactions to in one {get what="react"}, also the default.
+const maxReactRange = 100
+
+// replyGetReact sends aggregated reactions to messages in the given range as {meta}.
+// The range is limited to req.Limit or maxReactRange most recent messages in the range.
+func (t *Topic) replyGetReact(sess *Session, asUid types.Uid, asChan bool, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	id := msg.Id
+	incomingReqTs := msg.Timestamp
+
+	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "" || req.Hist != 0 || req.Thread != 0) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts query")
+	}
+
+	// Check if the user has permission to read the topic data.
+	if userData := t.perUser[asUid]; (userData.modeGiven & userData.modeWant).IsReader() {
+		opts := msgOpts2storeOpts(req)
+		if opts == nil {
+			opts = &types.QueryOpt{}
+		}
+		if opts.Before <= 0 || opts.Before > t.lastID+1 {
+			opts.Before = t.lastID + 1
+		}
+		if opts.Limit <= 0 || opts.Limit > maxReactRange {
+			opts.Limit = maxReactRange
+		}
+		if opts.Since < opts.Before-opts.Limit {
+			opts.Since = opts.Before - opts.Limit
+		}
+
+		reacts, err := store.Messages.GetReactions(t.name, opts)
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+
+		if len(reacts) > 0 {
+			sess.queueOut(&ServerComMessage{
+				Meta: &MsgServerMeta{
+					Id:        id,
+					Topic:     toriginal,
+					React:     reactionsAggregate(reacts, asChan),
+					Timestamp: &now,
+				},
+			})
+			return nil
+		}
+	}
+
+	sess.queueOut(NoContentParams(id, toriginal, now, incomingReqTs, map[string]string{"what": "react"}))
+
+	return nil
+}
+
+// replyGetThread sends summaries of threads of replies in the topic as {meta}.
+func (t *Topic) replyGetThread(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	id := msg.Id
+	incomingReqTs := msg.Timestamp
+
+	// Check if the user has permission to read the topic data. Threads are not tracked for channel readers.
+	if userData := t.perUser[asUid]; !asChan && (userData.modeGiven & userData.modeWant).IsReader() {
+		threads, err := store.Messages.GetThreads(t.name, asUid)
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+
+		if len(threads) > 0 {
+			summary := make([]MsgThreadStatus, len(threads))
+			for i := range threads {
+				ts := &threads[i]
+				summary[i] = MsgThreadStatus{
+					Thread:    ts.Thread,
+					Count:     ts.Count,
+					LastSeqId: ts.LastSeqId,
+					ReadSeqId: ts.ReadSeqId,
+					Unread:    ts.Unread,
+				}
+			}
+			sess.queueOut(&ServerComMessage{
+				Meta: &MsgServerMeta{
+					Id:        id,
+					Topic:     toriginal,
+					Thread:    summary,
+					Timestamp: &now,
+				},
+			})
+			return nil
+		}
+	}
+
+	sess.queueOut(NoContentParams(id, toriginal, now, incomingReqTs, map[string]string{"what": "thread"}))
+
+	return nil
+}
+
+// replyGetRcpt reports which members of a group topic have received and read the given message as {meta}.
+// Members with the 'A' permission see the status of all members, others see only the members who have
+// received the message. The list of members is paged by user ID.
+func (t *Topic) replyGetRcpt(sess *Session, asUid types.Uid, asChan bool, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	id := msg.Id
+	incomingReqTs := msg.Timestamp
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("read receipts requested in non-group topic")
+	}
+
+	if req == nil || req.SeqId <= 0 || req.SeqId > t.lastID || req.IfModifiedSince != nil || req.Topic != "" ||
+		req.SinceId != 0 || req.BeforeId != 0 || req.Hist != 0 || req.Thread != 0 || req.Query != "" {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts query")
+	}
+
+	var user, after types.Uid
+	if req.User != "" {
+		if user = types.ParseUserId(req.User); user.IsZero() {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("invalid user ID")
+		}
+	}
+	if req.After != "" {
+		if after = types.ParseUserId(req.After); after.IsZero() {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("invalid paging user ID")
+		}
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > globals.maxSubscriberCount {
+		limit = globals.maxSubscriberCount
+	}
+
+	// Check if the user has permission to read the topic data. Delivery status is not tracked for channel readers.
+	userData := t.perUser[asUid]
+	mode := userData.modeGiven & userData.modeWant
+	if !asChan && mode.IsReader() {
+		rcpt := &MsgRcptValues{SeqId: req.SeqId}
+		var members []types.Uid
+		for uid, pud := range t.perUser {
+			if pud.deleted || pud.isChan || !(pud.modeGiven & pud.modeWant).IsReader() {
+				continue
+			}
+			if pud.recvID >= req.SeqId {
+				rcpt.Recv++
+			}
+			if pud.readID >= req.SeqId {
+				rcpt.Read++
+			}
+			if (user.IsZero() || uid == user) && uid.Compare(after) > 0 &&
+				(mode.IsApprover() || pud.recvID >= req.SeqId) {
+				members = append(members, uid)
+			}
+		}
+
+		sort.Slice(members, func(i, j int) bool { return members[i].Compare(members[j]) < 0 })
+		if len(members) > limit {
+			members = members[:limit]
+		}
+		for _, uid := range members {
+			pud := t.perUser[uid]
+			rcpt.Users = append(rcpt.Users, MsgMemberRcpt{
+				User:      uid.UserId(),
+				RecvSeqId: pud.recvID,
+				ReadSeqId: pud.readID,
+			})
+		}
+
+		sess.queueOut(&ServerComMessage{
+			Meta: &MsgServerMeta{
+				Id:        id,
+				Topic:     toriginal,
+				Rcpt:      rcpt,
+				Timestamp: &now,
+			},
+		})
+		return nil
+	}
+
+	sess.queueOut(NoContentParams(id, toriginal, now, incomingReqTs, map[string]string{"what": "rcpt"}))
+
+	return nil
+}
+
+// replyGetSched sends requester's messages scheduled for publishing in the topic as {meta}.
+func (t *Topic) replyGetSched(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	id := msg.Id
+	incomingReqTs := msg.Timestamp
+
+	// Channel readers cannot publish, consequently they have no scheduled messages.
+	if !asChan {
+		msgs, err := store.Messages.GetScheduled(t.name, asUid)
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+
+		if len(msgs) > 0 {
+			sched := make([]MsgScheduledMessage, len(msgs))
+			for i := range msgs {
+				sm := &msgs[i]
+				sched[i] = MsgScheduledMessage{
+					Id:        sm.Id,
+					CreatedAt: &sm.CreatedAt,
+					SendAt:    &sm.SendAt,
+					Head:      sm.Head,
+					Content:   sm.Content,
+				}
+			}
+			sess.queueOut(&ServerComMessage{
+				Meta: &MsgServerMeta{
+					Id:        id,
+					Topic:     toriginal,
+					Sched:     sched,
+					Timestamp: &now,
+				},
+			})
+			return nil
+		}
+	}
+
+	sess.queueOut(NoContentParams(id, toriginal, now, incomingReqTs, map[string]string{"what": "sched"}))
+
+	return nil
+}
+
+const (
+	// Maximum number of words in a full-text search query.
+	maxSearchWords = 8
+	// Length of the text fragment returned with each search result, in runes.
+	searchSnippetLength = 96
+)
+
+// replyGetSearch runs a full-text search over messages in topics readable by the user, 'fnd' topic only.
+func (t *Topic) replyGetSearch(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	id := msg.Id
+	incomingReqTs := msg.Timestamp
+
+	if t.cat != types.TopicCatFnd {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("attempt to search messages outside of 'fnd'")
+	}
+
+	var words []string
+	if req != nil {
+		words = searchWords(req.Query, maxSearchWords)
+	}
+	if len(words) == 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("empty search query")
+	}
+
+	subs, err := store.Users.GetSubs(asUid)
+	if err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+
+	// Names of topics as stored in the DB mapped to names as seen by the user.
+	topics := make(map[string]string)
+	for i := range subs {
+		sub := &subs[i]
+		if !(sub.ModeWant & sub.ModeGiven).IsReader() {
+			continue
+		}
+
+		name, visible := sub.Topic, sub.Topic
+		switch types.GetTopicCat(name) {
+		case types.TopicCatP2P:
+			var err error
+			if visible, err = types.P2PNameForUser(asUid, name); err != nil {
+				continue
+			}
+		case types.TopicCatGrp:
+			if types.IsChannel(name) {
+				// Messages of channels are stored under the group name.
+				name = types.ChnToGrp(name)
+			}
+		default:
+			// Messages in 'me', 'fnd' and 'sys' are not searchable.
+			continue
+		}
+
+		if req.Topic != "" && req.Topic != visible {
+			continue
+		}
+		if _, ok := topics[name]; ok && types.IsChannel(visible) {
+			// The user is both a member of the group and a reader of the channel. Keep the group name.
+			continue
+		}
+		topics[name] = visible
+	}
+
+	var names []string
+	for name := range topics {
+		names = append(names, name)
+	}
+
+	var msgs []types.Message
+	if len(names) > 0 {
+		msgs, err = store.Messages.Search(names, asUid, words, &types.QueryOpt{Limit: req.Limit})
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+	}
+
+	if len(msgs) == 0 {
+		sess.queueOut(NoContentParams(id, toriginal, now, incomingReqTs, map[string]string{"what": "search"}))
+		return nil
+	}
+
+	hits := make([]MsgSearchHit, len(msgs))
+	for i := range msgs {
+		mm := &msgs[i]
+		visible := topics[mm.Topic]
+		from := ""
+		if !types.IsChannel(visible) {
+			// Don't show sender for channel readers
+			from = types.ParseUid(mm.From).UserId()
+		}
+		hits[i] = MsgSearchHit{
+			Topic:     visible,
+			SeqId:     mm.SeqId,
+			From:      from,
+			Timestamp: &mm.CreatedAt,
+			Snippet:   searchSnippet(mm.PlainText, words, searchSnippetLength),
+		}
+	}
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        id,
+			Topic:     toriginal,
+			Search:    hits,
+			Timestamp: &now,
+		},
+	})
+
+	return nil
+}
+
+// replyDelSched deletes requester's scheduled message in response to del.sched packet.
+func (t *Topic) replyDelSched(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	id := types.ParseUid(msg.Del.Sched)
+	if id.IsZero() {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("del.sched: invalid message id")
+	}
+
+	if err := store.Messages.DeleteScheduled(id, asUid); err != nil {
+		if err == types.ErrNotFound {
+			// The message does not exist, belongs to someone else or has already been published.
+			sess.queueOut(ErrNotFoundReply(msg, now))
+			return nil
+		}
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyDelLogin revokes one or all of requester's logins and terminates sessions which use them.
+// The requesting session is not terminated even if its login is revoked.
+func (t *Topic) replyDelLogin(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("del.login: invalid topic category")
+	}
+
+	var ids []string
+	switch msg.Del.Login {
+	case "":
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("del.login: missing login id")
+	case "*":
+		logins, err := store.Logins.GetAll(asUid)
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+		for i := range logins {
+			if logins[i].Id != sess.loginId {
+				ids = append(ids, logins[i].Id)
+			}
+		}
+		if len(ids) == 0 {
+			sess.queueOut(InfoNoActionReply(msg, now))
+			return nil
+		}
+	default:
+		ids = []string{msg.Del.Login}
+	}
+
+	deleted, err := store.Logins.Delete(asUid, ids)
+	if len(deleted) > 0 {
+		evictLogins(asUid, deleted, sess.sid)
+	}
+	if err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+	if len(deleted) == 0 {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return nil
+	}
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]any{"count": len(deleted)}))
+	return nil
+}
+
 // replyDelMsg deletes (soft or hard) messages in response to del.msg packet.
 func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
 	now := types.TimeNow()
@@ -3087,6 +4192,47 @@ func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *Cl
 	return nil
 }
 
+// deleteExpired hard-deletes messages which have outlived the topic's message TTL. The request is made
+// by the message garbage collector, not by a user, so there is no one to reply to.
+func (t *Topic) deleteExpired(msg *ClientComMessage) error {
+	if len(t.sessions) == 0 && t.cat != types.TopicCatSys {
+		// The topic may have been loaded just to delete the messages. Let it expire.
+		t.killTimer.Reset(idleMasterTopicTimeout)
+	}
+
+	if t.msgTTL <= 0 {
+		// TTL was removed after the messages were selected for deletion.
+		return nil
+	}
+
+	dq := msg.Del.DelSeq[0]
+	if dq.LowId <= 0 || dq.LowId > t.lastID {
+		return errors.New("del.msg: invalid range of expired messages")
+	}
+	if dq.HiId > t.lastID {
+		dq.HiId = t.lastID + 1
+	}
+	ranges := []types.Range{{Low: dq.LowId, Hi: dq.HiId}}
+
+	if err := store.Messages.DeleteList(t.name, t.delID+1, types.ZeroUid, ranges); err != nil {
+		return err
+	}
+
+	t.delID++
+	for uid, pud := range t.perUser {
+		pud.delID = t.delID
+		t.perUser[uid] = pud
+	}
+
+	// Broadcast the change to all, online and offline.
+	params := &presParams{delID: t.delID, delSeq: delrangeDeserialize(ranges)}
+	filters := &presFilters{filterIn: types.ModeRead}
+	t.presSubsOnline("del", "", params, filters, "")
+	t.presSubsOffline("del", params, filters, nilPresFilters, "", true)
+
+	return nil
+}
+
 // Handle request to delete the topic {del what="topic"}.
 // 1. If requester is the owner then it should have been handled at the hub, log an error.
 // 2. If requester is not the owner, treat it like {leave unsub=true}.
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -11,6 +18,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
 	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/media"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
 	"github.com/volvlabs/towncryer-chat-server/server/store/mock_store"
 	"github.com/volvlabs/towncryer-chat-server/server/store/types"
@@ -569,6 +577,324 @@ func TestHandleBroadcastDataDbError(t *testing.T) {
 	}
 }
 
+func TestHandleBroadcastDataEdit(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 3
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 5
+
+	from := helper.uids[0]
+	createdAt := time.Now().UTC().Add(-time.Hour).Round(time.Millisecond)
+	helper.mm.EXPECT().GetAll(topicName, from, &types.QueryOpt{Since: 3, Before: 4, Limit: 1}, false).
+		Return([]types.Message{{ObjHeader: types.ObjHeader{CreatedAt: createdAt}, SeqId: 3, Topic: topicName, From: from.String()}}, nil)
+	var edited *types.Message
+	helper.mm.EXPECT().Edit(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(msg *types.Message, attachments []string) error {
+			edited = msg
+			return nil
+		})
+
+	msg := &ClientComMessage{
+		Id:       "1",
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Head:    map[string]any{"replace": ":3", "edited": "fake"},
+			Content: "corrected",
+		},
+		sess:      helper.sessions[0],
+		Timestamp: types.TimeNow(),
+	}
+
+	helper.topic.handleClientMsg(msg)
+	helper.finish()
+
+	if helper.topic.lastID != 5 {
+		t.Errorf("Topic.lastID: expected to remain 5, found %d", helper.topic.lastID)
+	}
+	if edited == nil {
+		t.Fatal("Message was not saved")
+	}
+	if edited.SeqId != 3 {
+		t.Errorf("Edited seq: expected 3, got %d", edited.SeqId)
+	}
+	if _, found := edited.Head["replace"]; found {
+		t.Error("Saved head must not contain 'replace'")
+	}
+	if edited.Head["edited"] == "fake" {
+		t.Error("Saved head must not contain client-provided 'edited'")
+	}
+
+	// The sender gets the {ctrl} and the {data} echo, others get the {data}.
+	for i := 0; i < numUsers; i++ {
+		var data *MsgServerData
+		for _, m := range helper.results[i].messages {
+			if r := m.(*ServerComMessage); r.Data != nil {
+				data = r.Data
+			} else if r.Ctrl != nil && (r.Ctrl.Code != 202 || r.Ctrl.Params.(map[string]any)["seq"] != 3) {
+				t.Errorf("Uid%d: unexpected ctrl %+v", i, r.Ctrl)
+			}
+		}
+		if data == nil {
+			t.Fatalf("Uid%d: expected {data} message", i)
+		}
+		if data.SeqId != 3 {
+			t.Errorf("Uid%d: expected seq 3, got %d", i, data.SeqId)
+		}
+		if !data.Timestamp.Equal(createdAt) {
+			t.Errorf("Uid%d: expected original timestamp %s, got %s", i, createdAt, data.Timestamp)
+		}
+		if data.Head["replace"] != ":3" {
+			t.Errorf("Uid%d: expected 'replace' header ':3', got %v", i, data.Head["replace"])
+		}
+		if data.Content.(string) != "corrected" {
+			t.Errorf("Uid%d: expected content 'corrected', got '%s'", i, data.Content.(string))
+		}
+	}
+	// Edits do not generate 'msg' presence notifications.
+	if len(helper.hubMessages) != 0 {
+		t.Errorf("Hub.route did not expect any messages, however %d received.", len(helper.hubMessages))
+	}
+}
+
+func TestHandleBroadcastDataEditNotAuthor(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 5
+
+	helper.mm.EXPECT().GetAll(topicName, helper.uids[1], gomock.Any(), false).
+		Return([]types.Message{{SeqId: 3, Topic: topicName, From: helper.uids[0].String()}}, nil)
+
+	msg := &ClientComMessage{
+		AsUser:   helper.uids[1].UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Head:    map[string]any{"replace": ":3"},
+			Content: "not mine",
+		},
+		sess: helper.sessions[1],
+	}
+
+	helper.topic.handleClientMsg(msg)
+	helper.finish()
+
+	if len(helper.results[1].messages) != 1 {
+		t.Fatalf("User 2 is expected to receive one message vs %d received.", len(helper.results[1].messages))
+	}
+	em := helper.results[1].messages[0].(*ServerComMessage)
+	if em.Ctrl == nil || em.Ctrl.Code != 403 {
+		t.Errorf("User 2: expected ctrl.code 403, received %+v", em.Ctrl)
+	}
+	if len(helper.results[0].messages) != 0 {
+		t.Errorf("User 1 is not expected to receive any messages, %d received.", len(helper.results[0].messages))
+	}
+}
+
+func TestHandleBroadcastDataInvalidThread(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 10
+
+	// The thread refers to a message which does not exist yet.
+	from := helper.uids[0].UserId()
+	msg := &ClientComMessage{
+		AsUser:   from,
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Head:    map[string]any{"thread": ":11"},
+			Content: "test",
+		},
+		sess: helper.sessions[0],
+	}
+	helper.topic.handleClientMsg(msg)
+	helper.finish()
+
+	if helper.topic.lastID != 10 {
+		t.Errorf("Topic.lastID: expected 10, found %d", helper.topic.lastID)
+	}
+	if len(helper.results[0].messages) != 1 {
+		t.Fatalf("Sender: expected 1 message, got %d", len(helper.results[0].messages))
+	}
+	if em := helper.results[0].messages[0].(*ServerComMessage); em.Ctrl == nil || em.Ctrl.Code != 400 {
+		t.Errorf("Sender: expected ctrl.code 400, received %+v", em)
+	}
+	if len(helper.results[1].messages) != 0 {
+		t.Errorf("Uid1 is not expected to receive any messages, %d received.", len(helper.results[1].messages))
+	}
+}
+
+func TestHandleBroadcastDataForward(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+
+	from := helper.uids[0]
+	other := types.Uid(100)
+	p2p := from.P2PName(other)
+	content := map[string]any{
+		"txt": "roses",
+		"ent": []any{map[string]any{"tp": "IM", "data": map[string]any{"ref": "/v0/file/s/sFmjlQ_kA6A.jpg"}}},
+		"fmt": []any{map[string]any{"at": -1.0}},
+	}
+	helper.ss.EXPECT().Get(p2p, from, false).Return(&types.Subscription{
+		ModeWant:  types.ModeCP2P,
+		ModeGiven: types.ModeCP2P,
+	}, nil)
+	helper.mm.EXPECT().GetAll(p2p, from, &types.QueryOpt{Since: 5, Before: 6, Limit: 1}, true).Return([]types.Message{
+		{
+			SeqId:   5,
+			Topic:   p2p,
+			From:    other.String(),
+			Head:    types.MessageHeaders{"mime": "text/x-drafty", "reply": ":3"},
+			Content: content,
+		},
+	}, nil)
+	var saved *types.Message
+	helper.mm.EXPECT().Save(gomock.Any(), []string{"/v0/file/s/sFmjlQ_kA6A.jpg"}, gomock.Any()).DoAndReturn(
+		func(msg *types.Message, attachmentURLs []string, readBySender bool) (error, bool) {
+			saved = msg
+			return nil, true
+		})
+
+	msg := &ClientComMessage{
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic: topicName,
+			// Clients cannot set the origin.
+			Head:    map[string]any{"origin": "fake"},
+			Forward: &MsgForward{Topic: other.UserId(), SeqId: 5},
+		},
+		sess: helper.sessions[0],
+	}
+	helper.topic.handleClientMsg(msg)
+	helper.finish()
+
+	if saved == nil {
+		t.Fatal("Forwarded message was not saved")
+	}
+	if !reflect.DeepEqual(saved.Content, content) {
+		t.Errorf("Content: expected %v, found %v", content, saved.Content)
+	}
+	expectedHead := types.MessageHeaders{
+		"mime":   "text/x-drafty",
+		"origin": map[string]any{"topic": other.UserId(), "seq": 5, "from": other.UserId()},
+	}
+	if !reflect.DeepEqual(saved.Head, expectedHead) {
+		t.Errorf("Head: expected %v, found %v", expectedHead, saved.Head)
+	}
+	if len(helper.results[1].messages) != 1 {
+		t.Errorf("Uid1: expected 1 message, received %d", len(helper.results[1].messages))
+	}
+}
+
+func TestHandleBroadcastDataForwardFromChannel(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+
+	from := helper.uids[0]
+	author := types.Uid(100)
+	helper.ss.EXPECT().Get("chnSource", from, false).Return(&types.Subscription{
+		ModeWant:  types.ModeCChnReader,
+		ModeGiven: types.ModeCChnReader,
+	}, nil)
+	// Channel messages are read from the group topic.
+	helper.mm.EXPECT().GetAll("grpSource", from, &types.QueryOpt{Since: 5, Before: 6, Limit: 1}, true).Return([]types.Message{
+		{
+			SeqId:   5,
+			Topic:   "grpSource",
+			From:    author.String(),
+			Head:    types.MessageHeaders{"mime": "text/x-drafty"},
+			Content: "news",
+		},
+	}, nil)
+	var saved *types.Message
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(msg *types.Message, attachmentURLs []string, readBySender bool) (error, bool) {
+			saved = msg
+			return nil, true
+		})
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Forward: &MsgForward{Topic: "chnSource", SeqId: 5},
+		},
+		sess: helper.sessions[0],
+	})
+	helper.finish()
+
+	if saved == nil {
+		t.Fatal("Forwarded message was not saved")
+	}
+	// The author of the channel message is not revealed.
+	expectedHead := types.MessageHeaders{
+		"mime":   "text/x-drafty",
+		"origin": map[string]any{"topic": "chnSource", "seq": 5},
+	}
+	if !reflect.DeepEqual(saved.Head, expectedHead) {
+		t.Errorf("Head: expected %v, found %v", expectedHead, saved.Head)
+	}
+}
+
+func TestHandleBroadcastDataForwardNoAccess(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+
+	from := helper.uids[0]
+	// The sender was banned from the source topic.
+	helper.ss.EXPECT().Get("grpSource", from, false).Return(&types.Subscription{
+		ModeWant:  types.ModeCPublic,
+		ModeGiven: types.ModeNone,
+	}, nil)
+
+	msg := &ClientComMessage{
+		Id:       "id123",
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Id:      "id123",
+			Topic:   topicName,
+			Forward: &MsgForward{Topic: "grpSource", SeqId: 5},
+		},
+		sess: helper.sessions[0],
+	}
+	helper.topic.handleClientMsg(msg)
+	helper.finish()
+
+	if helper.topic.lastID != 0 {
+		t.Errorf("Topic.lastID: expected 0, found %d", helper.topic.lastID)
+	}
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("Uid0: expected 1 message, received %d", len(r.messages))
+	}
+	if res := r.messages[0].(*ServerComMessage); res.Ctrl == nil || res.Ctrl.Code != 403 {
+		t.Errorf("Response: expected ctrl.code 403, found %+v", res)
+	}
+}
+
 func TestHandleBroadcastDataInactiveTopic(t *testing.T) {
 	numUsers := 2
 	helper := TopicTestHelper{}
@@ -1077,91 +1403,221 @@ func TestHandleBroadcastInfoChannelProcessing(t *testing.T) {
 	}
 }
 
-func TestHandleBroadcastPresMe(t *testing.T) {
-	topicName := "usrMe"
-	numUsers := 1
+func TestHandleBroadcastInfoReact(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 3
 	helper := TopicTestHelper{}
-	helper.setUp(t, numUsers, types.TopicCatMe, topicName, true)
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
 	defer helper.tearDown()
+	helper.topic.lastID = 10
 
-	uid := helper.uids[0]
-	srcUid := types.Uid(10)
-	helper.topic.perSubs = make(map[string]perSubsData)
-	helper.topic.perSubs[srcUid.UserId()] = perSubsData{enabled: true, online: false}
+	from := helper.uids[0]
+	helper.mm.EXPECT().GetAll(topicName, from, &types.QueryOpt{Since: 3, Before: 4, Limit: 1}, false).
+		Return([]types.Message{{SeqId: 3, Topic: topicName}}, nil)
+	helper.mm.EXPECT().React(topicName, 3, from, "+1").Return(nil)
 
-	msg := &ServerComMessage{
-		AsUser: uid.UserId(),
-		RcptTo: uid.UserId(),
-		Pres: &MsgServerPres{
-			Topic: "me",
-			Src:   srcUid.UserId(),
-			What:  "on",
+	msg := &ClientComMessage{
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Note: &MsgClientNote{
+			Topic: topicName,
+			What:  "react",
+			SeqId: 3,
+			React: "+1",
 		},
+		sess: helper.sessions[0],
 	}
-	helper.topic.handleServerMsg(msg)
+	helper.topic.handleClientMsg(msg)
 	helper.finish()
 
-	// Topic metadata.
-	if online := helper.topic.perSubs[srcUid.UserId()].online; !online {
-		t.Errorf("User %s is expected to be online.", srcUid.UserId())
-	}
-	// Server messages.
-	if len(helper.results[0].messages) != 1 {
-		t.Fatalf("Session 0 is expected to receive one message. Received %d.", len(helper.results[0].messages))
-	}
-	s := helper.results[0].messages[0].(*ServerComMessage)
-	if s.RcptTo != uid.UserId() {
-		t.Errorf("Message.RcptTo: expected '%s', found '%s'", uid.UserId(), s.RcptTo)
+	// The sender's session is skipped.
+	if numMessages := len(helper.results[0].messages); numMessages != 0 {
+		t.Errorf("Sender is not expected to receive any messages, %d received.", numMessages)
 	}
-	if s.Pres != nil {
-		pres := s.Pres
-		if pres.Topic != "me" {
-			t.Errorf("Expected to notify user on 'me' topic. Found: '%s'", pres.Topic)
+	for i := 1; i < numUsers; i++ {
+		r := helper.results[i]
+		if len(r.messages) != 1 {
+			t.Fatalf("Uid%d: expected 1 message, got %d", i, len(r.messages))
 		}
-		if pres.Src != srcUid.UserId() {
-			t.Errorf("Expected notification from '%s'. Found: '%s'", srcUid.UserId(), pres.Topic)
+		info := r.messages[0].(*ServerComMessage).Info
+		if info == nil {
+			t.Fatalf("Uid%d: expected {info} message", i)
 		}
-		if pres.What != "on" {
-			t.Errorf("Expected an online notification. Found: '%s'", pres.What)
+		if info.What != "react" || info.SeqId != 3 || info.React != "+1" || info.From != from.UserId() {
+			t.Errorf("Uid%d: unexpected info %+v", i, info)
 		}
-	} else {
-		t.Error("Message is expected to be pres.")
 	}
+	// Reactions are not reported to offline users.
 	if len(helper.hubMessages) != 0 {
-		t.Errorf("Hubhelper.route isn't expected to receive messages. Received %d", len(helper.hubMessages))
+		t.Errorf("Hub.route did not expect any messages, however %d received.", len(helper.hubMessages))
 	}
 }
 
-func TestHandleBroadcastPresInactiveTopic(t *testing.T) {
-	topicName := "usrMe"
-	numUsers := 1
+func TestHandleBroadcastInfoReactWithoutRPermission(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
 	helper := TopicTestHelper{}
-	helper.setUp(t, numUsers, types.TopicCatMe, topicName, true)
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
 	defer helper.tearDown()
+	helper.topic.lastID = 10
 
-	uid := helper.uids[0]
-	srcUid := types.Uid(10)
-	helper.topic.perSubs = make(map[string]perSubsData)
-	helper.topic.perSubs[srcUid.UserId()] = perSubsData{enabled: true, online: false}
+	// Revoke R permission from the sender.
+	from := helper.uids[0]
+	pud := helper.topic.perUser[from]
+	pud.modeGiven = types.ModeWrite | types.ModeJoin
+	helper.topic.perUser[from] = pud
 
-	msg := &ServerComMessage{
-		AsUser: uid.UserId(),
-		RcptTo: uid.UserId(),
-		Pres: &MsgServerPres{
-			Topic: "me",
-			Src:   srcUid.UserId(),
-			What:  "on",
+	msg := &ClientComMessage{
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Note: &MsgClientNote{
+			Topic: topicName,
+			What:  "react",
+			SeqId: 3,
+			React: "+1",
 		},
+		sess: helper.sessions[0],
 	}
-
-	// Deactivate topic.
-	helper.topic.markDeleted()
-
-	helper.topic.handleServerMsg(msg)
+	helper.topic.handleClientMsg(msg)
 	helper.finish()
 
-	// Topic metadata.
-	if online := helper.topic.perSubs[srcUid.UserId()].online; online {
+	for i, r := range helper.results {
+		if numMessages := len(r.messages); numMessages != 0 {
+			t.Errorf("User %d is not expected to receive any messages, %d received.", i, numMessages)
+		}
+	}
+}
+
+func TestHandleBroadcastInfoThreadRead(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 10
+
+	from := helper.uids[0]
+	helper.mm.EXPECT().ThreadRead(topicName, from, 3, 7).Return(nil)
+
+	msg := &ClientComMessage{
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Note: &MsgClientNote{
+			Topic:  topicName,
+			What:   "read",
+			SeqId:  7,
+			Thread: 3,
+		},
+		sess: helper.sessions[0],
+	}
+	helper.topic.handleClientMsg(msg)
+	helper.finish()
+
+	// Topic-wide read position is not affected.
+	if readID := helper.topic.perUser[from].readID; readID != 0 {
+		t.Errorf("Topic read ID: expected 0, got %d", readID)
+	}
+	if numMessages := len(helper.results[0].messages); numMessages != 0 {
+		t.Errorf("Sender is not expected to receive any messages, %d received.", numMessages)
+	}
+	r := helper.results[1]
+	if len(r.messages) != 1 {
+		t.Fatalf("Uid1: expected 1 message, got %d", len(r.messages))
+	}
+	info := r.messages[0].(*ServerComMessage).Info
+	if info == nil || info.What != "read" || info.SeqId != 7 || info.Thread != 3 {
+		t.Errorf("Uid1: unexpected info %+v", info)
+	}
+	if len(helper.hubMessages) != 0 {
+		t.Errorf("Hub.route did not expect any messages, however %d received.", len(helper.hubMessages))
+	}
+}
+
+func TestHandleBroadcastPresMe(t *testing.T) {
+	topicName := "usrMe"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	srcUid := types.Uid(10)
+	helper.topic.perSubs = make(map[string]perSubsData)
+	helper.topic.perSubs[srcUid.UserId()] = perSubsData{enabled: true, online: false}
+
+	msg := &ServerComMessage{
+		AsUser: uid.UserId(),
+		RcptTo: uid.UserId(),
+		Pres: &MsgServerPres{
+			Topic: "me",
+			Src:   srcUid.UserId(),
+			What:  "on",
+		},
+	}
+	helper.topic.handleServerMsg(msg)
+	helper.finish()
+
+	// Topic metadata.
+	if online := helper.topic.perSubs[srcUid.UserId()].online; !online {
+		t.Errorf("User %s is expected to be online.", srcUid.UserId())
+	}
+	// Server messages.
+	if len(helper.results[0].messages) != 1 {
+		t.Fatalf("Session 0 is expected to receive one message. Received %d.", len(helper.results[0].messages))
+	}
+	s := helper.results[0].messages[0].(*ServerComMessage)
+	if s.RcptTo != uid.UserId() {
+		t.Errorf("Message.RcptTo: expected '%s', found '%s'", uid.UserId(), s.RcptTo)
+	}
+	if s.Pres != nil {
+		pres := s.Pres
+		if pres.Topic != "me" {
+			t.Errorf("Expected to notify user on 'me' topic. Found: '%s'", pres.Topic)
+		}
+		if pres.Src != srcUid.UserId() {
+			t.Errorf("Expected notification from '%s'. Found: '%s'", srcUid.UserId(), pres.Topic)
+		}
+		if pres.What != "on" {
+			t.Errorf("Expected an online notification. Found: '%s'", pres.What)
+		}
+	} else {
+		t.Error("Message is expected to be pres.")
+	}
+	if len(helper.hubMessages) != 0 {
+		t.Errorf("Hubhelper.route isn't expected to receive messages. Received %d", len(helper.hubMessages))
+	}
+}
+
+func TestHandleBroadcastPresInactiveTopic(t *testing.T) {
+	topicName := "usrMe"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	srcUid := types.Uid(10)
+	helper.topic.perSubs = make(map[string]perSubsData)
+	helper.topic.perSubs[srcUid.UserId()] = perSubsData{enabled: true, online: false}
+
+	msg := &ServerComMessage{
+		AsUser: uid.UserId(),
+		RcptTo: uid.UserId(),
+		Pres: &MsgServerPres{
+			Topic: "me",
+			Src:   srcUid.UserId(),
+			What:  "on",
+		},
+	}
+
+	// Deactivate topic.
+	helper.topic.markDeleted()
+
+	helper.topic.handleServerMsg(msg)
+	helper.finish()
+
+	// Topic metadata.
+	if online := helper.topic.perSubs[srcUid.UserId()].online; online {
 		t.Errorf("User %s is expected to be offline.", srcUid.UserId())
 	}
 	// Server messages.
@@ -1285,6 +1741,42 @@ func TestReplyGetDescInvalidOpts(t *testing.T) {
 	}
 }
 
+func TestReplyGetReactDefaultRange(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 500
+
+	// No range: reactions to the most recent messages only.
+	helper.mm.EXPECT().GetReactions(topicName, &types.QueryOpt{Since: 401, Before: 501, Limit: maxReactRange}).
+		Return(nil, nil)
+	// Range wider than the limit is cut from below.
+	helper.mm.EXPECT().GetReactions(topicName, &types.QueryOpt{Since: 290, Before: 300, Limit: 10}).
+		Return([]types.Reaction{{SeqId: 295, User: helper.uids[0].String(), Value: "+1"}}, nil)
+
+	msg := &ClientComMessage{Id: "id1", Original: topicName}
+	if err := helper.topic.replyGetReact(helper.sessions[0], helper.uids[0], false, nil, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.topic.replyGetReact(helper.sessions[0], helper.uids[0], false,
+		&MsgGetOpts{SinceId: 1, BeforeId: 300, Limit: 10}, msg); err != nil {
+		t.Fatal(err)
+	}
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 2 {
+		t.Fatalf("responses received: expected 2, received %d", len(r.messages))
+	}
+	if resp := r.messages[0].(*ServerComMessage); resp.Ctrl == nil || resp.Ctrl.Code != 204 {
+		t.Errorf("expected 'no content' response, got %+v", resp)
+	}
+	if resp := r.messages[1].(*ServerComMessage); resp.Meta == nil || len(resp.Meta.React) != 1 {
+		t.Errorf("expected one message with reactions, got %+v", resp)
+	}
+}
+
 // Verifies ctrl codes in session outputs.
 func registerSessionVerifyOutputs(t *testing.T, sessionOutput *responses, expectedCtrlCodes []int) {
 	t.Helper()
@@ -2325,7 +2817,7 @@ func TestHandleMetaGet(t *testing.T) {
 	defer helper.tearDown()
 
 	uid := helper.uids[0]
-	helper.mm.EXPECT().GetAll(topicName, uid, gomock.Any()).Return([]types.Message{}, nil)
+	helper.mm.EXPECT().GetAll(topicName, uid, gomock.Any(), false).Return([]types.Message{}, nil)
 	helper.mm.EXPECT().GetDeleted(topicName, uid, gomock.Any()).Return([]types.Range{}, 0, nil)
 	helper.uu.EXPECT().GetTopics(uid, gomock.Any()).Return([]types.Subscription{}, nil)
 
@@ -2466,6 +2958,847 @@ func TestHandleMetaSetDescMePublicPrivate(t *testing.T) {
 	}
 }
 
+func TestHandleMetaSetDescGrpPinned(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 10
+
+	uid := helper.uids[0]
+	var pinned any
+	helper.tt.EXPECT().Update(topicName, gomock.Any()).
+		DoAndReturn(func(topic string, upd map[string]any) error {
+			pinned = upd["Pinned"]
+			return nil
+		})
+
+	meta := &ClientComMessage{
+		Set: &MsgClientSet{
+			Id:    "id456",
+			Topic: topicName,
+			MsgSetQuery: MsgSetQuery{
+				Desc: &MsgSetDesc{
+					Pinned: []int{5, 0, 3, 5},
+				},
+			},
+		},
+		AsUser:   uid.UserId(),
+		Original: topicName,
+		MetaWhat: constMsgMetaDesc,
+		sess:     helper.sessions[0],
+	}
+	helper.topic.handleMeta(meta)
+	helper.finish()
+
+	// Zero and duplicate IDs are dropped.
+	if !reflect.DeepEqual(pinned, types.IntSlice{5, 3}) {
+		t.Errorf("Stored pinned: expected [5 3], found %v", pinned)
+	}
+	if !reflect.DeepEqual(helper.topic.pinned, []int{5, 3}) {
+		t.Errorf("Cached pinned: expected [5 3], found %v", helper.topic.pinned)
+	}
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(r.messages))
+	}
+	if msg := r.messages[0].(*ServerComMessage); msg.Ctrl == nil || msg.Ctrl.Code != 200 {
+		t.Errorf("Response: expected ctrl.code 200, found %+v", msg)
+	}
+	// The other subscriber is notified of the change.
+	if userPres, ok := helper.hubMessages[helper.uids[1].UserId()]; !ok || len(userPres) != 1 ||
+		userPres[0].Pres == nil || userPres[0].Pres.What != "upd" {
+		t.Errorf("Uid1: expected one {pres what=upd}, found %v", userPres)
+	}
+}
+
+func TestHandleMetaSetDescGrpPinnedNotAdmin(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 10
+
+	// Uid1 has no A or O permissions.
+	uid := helper.uids[1]
+	pud := helper.topic.perUser[uid]
+	pud.modeGiven = types.ModeJoin | types.ModeRead | types.ModeWrite | types.ModePres
+	helper.topic.perUser[uid] = pud
+
+	meta := &ClientComMessage{
+		Set: &MsgClientSet{
+			Id:    "id456",
+			Topic: topicName,
+			MsgSetQuery: MsgSetQuery{
+				Desc: &MsgSetDesc{
+					Pinned: []int{3},
+				},
+			},
+		},
+		AsUser:   uid.UserId(),
+		Original: topicName,
+		MetaWhat: constMsgMetaDesc,
+		sess:     helper.sessions[1],
+	}
+	helper.topic.handleMeta(meta)
+	helper.finish()
+
+	if helper.topic.pinned != nil {
+		t.Errorf("Pinned messages are not expected to change, found %v", helper.topic.pinned)
+	}
+	r := helper.results[1]
+	if len(r.messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(r.messages))
+	}
+	if msg := r.messages[0].(*ServerComMessage); msg.Ctrl == nil || msg.Ctrl.Code != 403 {
+		t.Errorf("Response: expected ctrl.code 403, found %+v", msg)
+	}
+	if len(helper.hubMessages) != 0 {
+		t.Errorf("Hub messages: expected 0, received %d", len(helper.hubMessages))
+	}
+}
+
+func TestHandleMetaSetDescGrpMsgTTL(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	var ttl any
+	helper.tt.EXPECT().Update(topicName, gomock.Any()).
+		DoAndReturn(func(topic string, upd map[string]any) error {
+			ttl = upd["MsgTTL"]
+			return nil
+		})
+
+	val := 3600
+	meta := &ClientComMessage{
+		Set: &MsgClientSet{
+			Id:    "id456",
+			Topic: topicName,
+			MsgSetQuery: MsgSetQuery{
+				Desc: &MsgSetDesc{
+					MsgTTL: &val,
+				},
+			},
+		},
+		AsUser:   uid.UserId(),
+		Original: topicName,
+		MetaWhat: constMsgMetaDesc,
+		sess:     helper.sessions[0],
+	}
+	helper.topic.handleMeta(meta)
+	helper.finish()
+
+	if ttl != 3600 {
+		t.Errorf("Stored message TTL: expected 3600, found %v", ttl)
+	}
+	if helper.topic.msgTTL != 3600 {
+		t.Errorf("Cached message TTL: expected 3600, found %d", helper.topic.msgTTL)
+	}
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(r.messages))
+	}
+	if msg := r.messages[0].(*ServerComMessage); msg.Ctrl == nil || msg.Ctrl.Code != 200 {
+		t.Errorf("Response: expected ctrl.code 200, found %+v", msg)
+	}
+}
+
+func TestHandleMetaDelExpired(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 10
+	helper.topic.delID = 2
+	helper.topic.msgTTL = 3600
+
+	helper.mm.EXPECT().DeleteList(topicName, 3, types.ZeroUid, []types.Range{{Low: 1, Hi: 6}}).Return(nil)
+
+	meta := &ClientComMessage{
+		Del: &MsgClientDel{
+			Topic:  topicName,
+			What:   "msg",
+			DelSeq: []MsgDelRange{{LowId: 1, HiId: 6}},
+			Hard:   true,
+		},
+		Original: topicName,
+		RcptTo:   topicName,
+		AuthLvl:  int(auth.LevelRoot),
+		MetaWhat: constMsgDelMsg,
+		expired:  true,
+	}
+	helper.topic.handleMeta(meta)
+	helper.finish()
+
+	if helper.topic.delID != 3 {
+		t.Errorf("Topic.delID: expected 3, found %d", helper.topic.delID)
+	}
+	for uid, pud := range helper.topic.perUser {
+		if pud.delID != 3 {
+			t.Errorf("%s delID: expected 3, found %d", uid.UserId(), pud.delID)
+		}
+	}
+	// Online subscribers are notified.
+	if pres, ok := helper.hubMessages[topicName]; !ok || len(pres) != 1 ||
+		pres[0].Pres == nil || pres[0].Pres.What != "del" || pres[0].Pres.DelId != 3 {
+		t.Errorf("Topic: expected one {pres what=del}, found %v", pres)
+	}
+	// No one to reply to.
+	for i, r := range helper.results {
+		if len(r.messages) != 0 {
+			t.Errorf("Uid%d: expected 0 messages, received %d", i, len(r.messages))
+		}
+	}
+}
+
+func TestHandleBroadcastDataScheduled(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+
+	from := helper.uids[0]
+	schedId := types.Uid(12345)
+	sendAt := types.TimeNow().Add(time.Hour)
+	helper.mm.EXPECT().Schedule(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(msg *types.ScheduledMessage, attachmentURLs []string) error {
+			if msg.Topic != topicName || msg.From != from.String() || !msg.SendAt.Equal(sendAt) {
+				t.Errorf("Scheduled message: unexpected %+v", msg)
+			}
+			msg.SetUid(schedId)
+			return nil
+		})
+
+	msg := &ClientComMessage{
+		Id:       "id123",
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Id:      "id123",
+			Topic:   topicName,
+			Content: "test",
+			SendAt:  &sendAt,
+		},
+		sess:      helper.sessions[0],
+		Timestamp: types.TimeNow(),
+	}
+	helper.topic.handleClientMsg(msg)
+	helper.finish()
+
+	if helper.topic.lastID != 0 {
+		t.Errorf("Topic.lastID: expected 0, found %d", helper.topic.lastID)
+	}
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("Uid0: expected 1 message, received %d", len(r.messages))
+	}
+	res := r.messages[0].(*ServerComMessage)
+	if res.Ctrl == nil || res.Ctrl.Code != 202 {
+		t.Fatalf("Response: expected ctrl.code 202, found %+v", res)
+	}
+	if params, ok := res.Ctrl.Params.(map[string]any); !ok || params["sched"] != schedId.String() {
+		t.Errorf("Response params: expected sched '%s', found %+v", schedId.String(), res.Ctrl.Params)
+	}
+	// The message is not delivered until the scheduled time.
+	if len(helper.results[1].messages) != 0 {
+		t.Errorf("Uid1: expected 0 messages, received %d", len(helper.results[1].messages))
+	}
+	if len(helper.hubMessages) != 0 {
+		t.Errorf("Hub messages: expected 0, received %d", len(helper.hubMessages))
+	}
+}
+
+// Makes a due scheduled message as sent by the hub.
+func scheduledPub(topicName string, from types.Uid, schedId types.Uid) *ClientComMessage {
+	return &ClientComMessage{
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Content: "test",
+		},
+		Timestamp: types.TimeNow(),
+		sched:     schedId,
+	}
+}
+
+func TestHandleBroadcastScheduledPublished(t *testing.T) {
+	topicName := "grp-test"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	from := helper.uids[0]
+	schedId := types.Uid(12345)
+	pending := &types.ScheduledMessage{ObjHeader: types.ObjHeader{Id: schedId.String()}}
+	// The message is claimed by deleting it from the schedule before it's saved.
+	gomock.InOrder(
+		helper.mm.EXPECT().GetScheduledById(schedId).Return(pending, nil),
+		helper.mm.EXPECT().DeleteScheduled(schedId, types.ZeroUid).Return(nil),
+		helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true),
+		// The same message sent again is not published.
+		helper.mm.EXPECT().GetScheduledById(schedId).Return(nil, types.ErrNotFound),
+		// The message is claimed by someone else between the read and the delete.
+		helper.mm.EXPECT().GetScheduledById(schedId).Return(pending, nil),
+		helper.mm.EXPECT().DeleteScheduled(schedId, types.ZeroUid).Return(types.ErrNotFound),
+	)
+
+	helper.topic.handleClientMsg(scheduledPub(topicName, from, schedId))
+	helper.topic.handleClientMsg(scheduledPub(topicName, from, schedId))
+	helper.topic.handleClientMsg(scheduledPub(topicName, from, schedId))
+	helper.finish()
+
+	if helper.topic.lastID != 1 {
+		t.Errorf("Topic.lastID: expected 1, found %d", helper.topic.lastID)
+	}
+	if len(helper.results[1].messages) != 1 {
+		t.Errorf("Uid1: expected 1 message, got %d", len(helper.results[1].messages))
+	}
+}
+
+func TestHandleBroadcastScheduledDbError(t *testing.T) {
+	topicName := "grp-test"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	from := helper.uids[0]
+	schedId := types.Uid(12345)
+	pending := &types.ScheduledMessage{ObjHeader: types.ObjHeader{Id: schedId.String()}}
+	gomock.InOrder(
+		helper.mm.EXPECT().GetScheduledById(schedId).Return(pending, nil),
+		helper.mm.EXPECT().DeleteScheduled(schedId, types.ZeroUid).Return(nil),
+		helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(types.ErrInternal, false),
+		// The message is put back to the schedule to be retried.
+		helper.mm.EXPECT().Reschedule(pending).Return(nil),
+	)
+
+	helper.topic.handleClientMsg(scheduledPub(topicName, from, schedId))
+	helper.finish()
+
+	if helper.topic.lastID != 0 {
+		t.Errorf("Topic.lastID: expected to remain 0, found %d", helper.topic.lastID)
+	}
+	if len(helper.hubMessages) != 0 {
+		t.Errorf("Hub messages: expected 0, received %d", len(helper.hubMessages))
+	}
+}
+
+func TestHandleBroadcastScheduledRejected(t *testing.T) {
+	topicName := "grp-test"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	// The sender lost the W permission after scheduling the message.
+	from := helper.uids[1]
+	pud := helper.topic.perUser[from]
+	pud.modeGiven = types.ModeRead | types.ModeJoin
+	helper.topic.perUser[from] = pud
+
+	schedId := types.Uid(12345)
+	pending := &types.ScheduledMessage{ObjHeader: types.ObjHeader{Id: schedId.String()}}
+	helper.mm.EXPECT().GetScheduledById(schedId).Return(pending, nil)
+	helper.mm.EXPECT().DeleteScheduled(schedId, types.ZeroUid).Return(nil)
+
+	helper.topic.handleClientMsg(scheduledPub(topicName, from, schedId))
+	helper.finish()
+
+	if helper.topic.lastID != 0 {
+		t.Errorf("Topic.lastID: expected to remain 0, found %d", helper.topic.lastID)
+	}
+	// The sender is notified that the message was dropped.
+	mm := helper.hubMessages[from.UserId()]
+	if len(mm) != 1 || mm[0].Info == nil || mm[0].Info.What != "sched" || mm[0].Info.Event != "rejected" {
+		t.Fatalf("Sender: expected one {info what=sched}, got %+v", mm)
+	}
+	if expected := `{"sched":"` + schedId.String() + `"}`; string(mm[0].Info.Payload) != expected {
+		t.Errorf("Info payload: expected %s, found %s", expected, mm[0].Info.Payload)
+	}
+}
+
+func TestHandleMetaDelSched(t *testing.T) {
+	topicName := "grp-test"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	schedId := types.Uid(12345)
+	helper.mm.EXPECT().DeleteScheduled(schedId, uid).Return(nil)
+	helper.mm.EXPECT().DeleteScheduled(schedId, uid).Return(types.ErrNotFound)
+
+	// The second attempt fails because the message is already gone.
+	for i := 0; i < 2; i++ {
+		meta := &ClientComMessage{
+			Del: &MsgClientDel{
+				Id:    "id456",
+				Topic: topicName,
+				What:  "sched",
+				Sched: schedId.String(),
+			},
+			AsUser:   uid.UserId(),
+			Original: topicName,
+			MetaWhat: constMsgDelSched,
+			sess:     helper.sessions[0],
+		}
+		helper.topic.handleMeta(meta)
+	}
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 2 {
+		t.Fatalf("responses received: expected 2, received %d", len(r.messages))
+	}
+	for i, code := range []int{200, 404} {
+		if msg := r.messages[i].(*ServerComMessage); msg.Ctrl == nil || msg.Ctrl.Code != code {
+			t.Errorf("Response[%d]: expected ctrl.code %d, found %+v", i, code, msg)
+		}
+	}
+}
+
+func TestHandleMetaGetSearch(t *testing.T) {
+	topicName := "fnd-test"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatFnd, topicName /*attach=*/, true)
+	defer helper.tearDown()
+	helper.topic.xoriginal = "fnd"
+
+	uid := helper.uids[0]
+	other := types.Uid(100)
+	p2p := uid.P2PName(other)
+	helper.uu.EXPECT().GetSubs(uid).Return([]types.Subscription{
+		{Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P},
+		{Topic: "grpReadable", ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic},
+		// Banned from the topic.
+		{Topic: "grpBanned", ModeWant: types.ModeCPublic, ModeGiven: types.ModeNone},
+		{Topic: "chnChannel", ModeWant: types.ModeCChnReader, ModeGiven: types.ModeCChnReader},
+	}, nil)
+
+	var searched []string
+	now := types.TimeNow()
+	helper.mm.EXPECT().Search(gomock.Any(), uid, []string{"lunch", "friday"}, &types.QueryOpt{Limit: 5}).
+		DoAndReturn(func(topics []string, forUser types.Uid, words []string, opt *types.QueryOpt) ([]types.Message, error) {
+			searched = topics
+			return []types.Message{
+				{
+					ObjHeader: types.ObjHeader{CreatedAt: now},
+					Topic:     p2p,
+					SeqId:     7,
+					From:      other.String(),
+					PlainText: "Lunch on Friday?",
+				},
+				{
+					ObjHeader: types.ObjHeader{CreatedAt: now},
+					Topic:     "grpChannel",
+					SeqId:     3,
+					From:      other.String(),
+					PlainText: "Lunch is served on Friday",
+				},
+			}, nil
+		})
+
+	meta := &ClientComMessage{
+		Get: &MsgClientGet{
+			Id:    "id456",
+			Topic: topicName,
+			MsgGetQuery: MsgGetQuery{
+				What:   "search",
+				Search: &MsgGetOpts{Query: "Lunch, FRIDAY lunch", Limit: 5},
+			},
+		},
+		AsUser:   uid.UserId(),
+		Original: topicName,
+		MetaWhat: constMsgMetaSearch,
+		sess:     helper.sessions[0],
+	}
+	helper.topic.handleMeta(meta)
+	helper.finish()
+
+	sort.Strings(searched)
+	if expected := []string{"grpChannel", "grpReadable", p2p}; !reflect.DeepEqual(searched, expected) {
+		t.Errorf("Searched topics: expected %v, found %v", expected, searched)
+	}
+
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(r.messages))
+	}
+	msg := r.messages[0].(*ServerComMessage)
+	if msg.Meta == nil || len(msg.Meta.Search) != 2 {
+		t.Fatalf("Response must contain two search hits, found %+v", msg)
+	}
+	hit := msg.Meta.Search[0]
+	if hit.Topic != other.UserId() || hit.SeqId != 7 || hit.From != other.UserId() || hit.Snippet != "Lunch on Friday?" {
+		t.Errorf("Unexpected search hit %+v", hit)
+	}
+	// The sender is hidden from channel readers.
+	hit = msg.Meta.Search[1]
+	if hit.Topic != "chnChannel" || hit.SeqId != 3 || hit.From != "" {
+		t.Errorf("Unexpected search hit in channel %+v", hit)
+	}
+}
+
+func TestHandleMetaGetRcpt(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 4
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+
+	helper.topic.lastID = 10
+	recvRead := [][2]int{{10, 8}, {5, 5}, {8, 3}, {0, 0}}
+	for i, uid := range helper.uids {
+		pud := helper.topic.perUser[uid]
+		pud.recvID, pud.readID = recvRead[i][0], recvRead[i][1]
+		helper.topic.perUser[uid] = pud
+	}
+	// The second user is not an approver.
+	pud := helper.topic.perUser[helper.uids[1]]
+	pud.modeGiven = types.ModeCPublic
+	helper.topic.perUser[helper.uids[1]] = pud
+
+	getRcpt := func(i int, opts *MsgGetOpts) {
+		helper.topic.handleMeta(&ClientComMessage{
+			Get: &MsgClientGet{
+				Id:    "id456",
+				Topic: topicName,
+				MsgGetQuery: MsgGetQuery{
+					What: "rcpt",
+					Rcpt: opts,
+				},
+			},
+			AsUser:   helper.uids[i].UserId(),
+			Original: topicName,
+			MetaWhat: constMsgMetaRcpt,
+			sess:     helper.sessions[i],
+		})
+	}
+	// Approver, two pages.
+	getRcpt(0, &MsgGetOpts{SeqId: 6, Limit: 3})
+	getRcpt(0, &MsgGetOpts{SeqId: 6, Limit: 3, After: helper.uids[2].UserId()})
+	// Regular member sees only those who received the message.
+	getRcpt(1, &MsgGetOpts{SeqId: 6})
+	// Message does not exist.
+	getRcpt(2, &MsgGetOpts{SeqId: 11})
+	helper.finish()
+
+	members := func(rcpt *MsgRcptValues) []string {
+		var users []string
+		for _, u := range rcpt.Users {
+			users = append(users, u.User)
+		}
+		return users
+	}
+	expectRcpt := func(r *responses, idx int, expected []types.Uid) {
+		t.Helper()
+		msg := r.messages[idx].(*ServerComMessage)
+		if msg.Meta == nil || msg.Meta.Rcpt == nil {
+			t.Fatalf("Response must contain read receipts, found %+v", msg)
+		}
+		rcpt := msg.Meta.Rcpt
+		if rcpt.SeqId != 6 || rcpt.Recv != 2 || rcpt.Read != 1 {
+			t.Errorf("Receipt counts: expected seq=6 recv=2 read=1, found %+v", rcpt)
+		}
+		var users []string
+		for _, uid := range expected {
+			users = append(users, uid.UserId())
+		}
+		if found := members(rcpt); !reflect.DeepEqual(found, users) {
+			t.Errorf("Members: expected %v, found %v", users, found)
+		}
+	}
+
+	uids := helper.uids
+	if len(helper.results[0].messages) != 2 {
+		t.Fatalf("responses received: expected 2, received %d", len(helper.results[0].messages))
+	}
+	expectRcpt(helper.results[0], 0, uids[:3])
+	expectRcpt(helper.results[0], 1, uids[3:])
+
+	if len(helper.results[1].messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(helper.results[1].messages))
+	}
+	expectRcpt(helper.results[1], 0, []types.Uid{uids[0], uids[2]})
+	if rcpt := helper.results[1].messages[0].(*ServerComMessage).Meta.Rcpt; rcpt.Users[1].RecvSeqId != 8 || rcpt.Users[1].ReadSeqId != 3 {
+		t.Errorf("Member status: expected recv=8 read=3, found %+v", rcpt.Users[1])
+	}
+
+	if len(helper.results[2].messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(helper.results[2].messages))
+	}
+	if msg := helper.results[2].messages[0].(*ServerComMessage); msg.Ctrl == nil || msg.Ctrl.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a nonexistent message, found %+v", msg)
+	}
+}
+
+// In-memory media handler.
+type testMediaHandler struct {
+	// File content by file ID.
+	files map[string][]byte
+}
+
+type testMediaFile struct {
+	*bytes.Reader
+}
+
+func (testMediaFile) Close() error { return nil }
+
+func (mh *testMediaHandler) Init(jsconf string) error { return nil }
+
+func (mh *testMediaHandler) Headers(req *http.Request, serve bool) (http.Header, int, error) {
+	return nil, 0, nil
+}
+
+func (mh *testMediaHandler) Upload(fdef *types.FileDef, file io.ReadSeeker) (string, int64, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", 0, err
+	}
+	mh.files[fdef.Id] = data
+	return "/v0/file/s/" + fdef.Id, int64(len(data)), nil
+}
+
+func (mh *testMediaHandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	data, ok := mh.files[mh.GetIdFromUrl(url).String()]
+	if !ok {
+		return nil, nil, types.ErrNotFound
+	}
+	return nil, testMediaFile{bytes.NewReader(data)}, nil
+}
+
+func (mh *testMediaHandler) Delete(locations []string) error { return nil }
+
+func (mh *testMediaHandler) GetIdFromUrl(url string) types.Uid {
+	return media.GetIdFromUrl(url, "/v0/file/s/")
+}
+
+func TestHandleMetaGetExport(t *testing.T) {
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatMe, "usrMe" /*attach=*/, true)
+	defer helper.tearDown()
+
+	mh := &testMediaHandler{files: make(map[string][]byte)}
+	st := mock_store.NewMockPersistentStorageInterface(helper.ctrl)
+	ff := mock_store.NewMockFilePersistenceInterface(helper.ctrl)
+	realStore := store.Store
+	st.EXPECT().GetMediaHandler().Return(mh)
+	st.EXPECT().GetUidString().Return(types.Uid(200).String())
+	store.Store = st
+	store.Files = ff
+	defer func() {
+		store.Store = realStore
+		store.Files = nil
+	}()
+
+	uid, other := helper.uids[0], helper.uids[1]
+	avatar := &types.FileDef{
+		ObjHeader: types.ObjHeader{Id: types.Uid(101).String()},
+		Status:    types.UploadCompleted,
+		User:      uid.String(),
+		MimeType:  "image/png",
+	}
+	mh.files[avatar.Id] = []byte("avatar content")
+	// Attachment forwarded by the user but uploaded by someone else.
+	foreign := &types.FileDef{
+		ObjHeader: types.ObjHeader{Id: types.Uid(102).String()},
+		Status:    types.UploadCompleted,
+		User:      other.String(),
+	}
+	user := &types.User{
+		ObjHeader: types.ObjHeader{Id: uid.String()},
+		Public: map[string]any{
+			"fn":    "Alice",
+			"photo": map[string]any{"ref": "/v0/file/s/" + avatar.Id + ".png"},
+		},
+	}
+	helper.uu.EXPECT().Get(uid).Return(user, nil)
+	helper.uu.EXPECT().GetAllCreds(uid, "", false).Return([]types.Credential{{Method: "email", Value: "alice@example.com", Done: true}}, nil)
+	helper.uu.EXPECT().GetTopics(uid, nil).Return([]types.Subscription{{Topic: "grpTest"}, {Topic: other.UserId()}}, nil)
+	helper.mm.EXPECT().Export("grpTest", uid, 0, exportPageSize).Return([]types.Message{
+		{SeqId: 1, Topic: "grpTest", From: uid.String(), Content: "mine", Attachments: []string{foreign.Id}},
+	}, nil)
+	helper.mm.EXPECT().Export(uid.P2PName(other), uid, 0, exportPageSize).Return(nil, nil)
+	ff.EXPECT().Get(avatar.Id).Return(avatar, nil)
+	ff.EXPECT().Get(foreign.Id).Return(foreign, nil)
+	var archive *types.FileDef
+	ff.EXPECT().FinishUpload(gomock.Any(), true, gomock.Any()).DoAndReturn(
+		func(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+			archive = fd
+			return fd, nil
+		})
+
+	getExport := func(i int) {
+		helper.topic.handleMeta(&ClientComMessage{
+			Get: &MsgClientGet{
+				Id:          "id789",
+				Topic:       "me",
+				MsgGetQuery: MsgGetQuery{What: "export"},
+			},
+			AsUser:   helper.uids[i].UserId(),
+			Original: "me",
+			MetaWhat: constMsgMetaExport,
+			sess:     helper.sessions[i],
+		})
+	}
+	getExport(0)
+	// The export runs in the background.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, busy := exportsInProgress.Load(uid); !busy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Export did not complete in time")
+		}
+	}
+	helper.finish()
+
+	if len(helper.results[0].messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(helper.results[0].messages))
+	}
+	msg := helper.results[0].messages[0].(*ServerComMessage)
+	if msg.Ctrl == nil || msg.Ctrl.Code != http.StatusOK {
+		t.Fatalf("Expected 200, found %+v", msg)
+	}
+	params := msg.Ctrl.Params.(map[string]string)
+	if params["url"] != "/v0/file/s/"+archive.Id || params["expires"] == "" {
+		t.Errorf("Unexpected response params %v", params)
+	}
+	// The file is marked as an archive of exported data of the user.
+	if archive.MimeType != exportMimeType || archive.User != uid.String() {
+		t.Errorf("Archive file is not marked as export: %+v", archive)
+	}
+
+	data := mh.files[archive.Id]
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		content[f.Name] = string(data)
+	}
+	var exported exportedUser
+	if err := json.Unmarshal([]byte(content["user.json"]), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.User.Id != uid.String() || len(exported.Credentials) != 1 || exported.Credentials[0].Value != "alice@example.com" {
+		t.Errorf("Unexpected user data %+v", exported)
+	}
+	if lines := strings.Split(strings.TrimSpace(content["messages.json"]), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"mine"`) {
+		t.Errorf("Expected only the message of the user, found %v", lines)
+	}
+	var files []types.FileDef
+	if err := json.Unmarshal([]byte(content["files.json"]), &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Id != avatar.Id || files[0].Location != "" {
+		t.Errorf("Expected only the avatar in files, found %+v", files)
+	}
+	if data := content["files/"+avatar.Id+".png"]; data != "avatar content" {
+		t.Errorf("Avatar content: expected 'avatar content', found '%s'", data)
+	}
+}
+
+func TestHandleMetaGetExportNotMe(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatGrp, topicName /*attach=*/, true)
+	defer helper.tearDown()
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id789",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "export"},
+		},
+		AsUser:   helper.uids[0].UserId(),
+		Original: topicName,
+		MetaWhat: constMsgMetaExport,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	if len(helper.results[0].messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(helper.results[0].messages))
+	}
+	if msg := helper.results[0].messages[0].(*ServerComMessage); msg.Ctrl == nil || msg.Ctrl.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, found %+v", msg)
+	}
+}
+
+func TestCheckExportAccess(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ff := mock_store.NewMockFilePersistenceInterface(ctrl)
+	store.Files = ff
+	defer func() {
+		store.Files = nil
+		ctrl.Finish()
+	}()
+
+	now := types.TimeNow()
+	owner, other := types.Uid(1), types.Uid(2)
+	archive, file, missing := types.Uid(10), types.Uid(11), types.Uid(12)
+	archiveDef := &types.FileDef{
+		ObjHeader: types.ObjHeader{Id: archive.String(), CreatedAt: now.Add(time.Minute - unusedFileLifetime)},
+		User:      owner.String(),
+		MimeType:  exportMimeType,
+	}
+	fileDef := &types.FileDef{
+		ObjHeader: types.ObjHeader{Id: file.String(), CreatedAt: now},
+		User:      owner.String(),
+		MimeType:  "application/zip",
+	}
+	ff.EXPECT().Get(archive.String()).Return(archiveDef, nil).Times(2)
+	ff.EXPECT().Get(file.String()).Return(fileDef, nil)
+	ff.EXPECT().Get(missing.String()).Return(nil, nil)
+
+	if err := checkExportAccess(archive, owner, now); err != nil {
+		t.Errorf("Owner must have access to the archive: %s", err)
+	}
+	if err := checkExportAccess(archive, other, now); err != types.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for another user, found %v", err)
+	}
+	if err := checkExportAccess(file, other, now); err != nil {
+		t.Errorf("Regular files must not be restricted: %s", err)
+	}
+	if err := checkExportAccess(missing, other, now); err != nil {
+		t.Errorf("Missing files must be reported by the media handler: %s", err)
+	}
+	// Not a file ID.
+	if err := checkExportAccess(types.ZeroUid, other, now); err != nil {
+		t.Errorf("Expected no error for a zero file ID, found %s", err)
+	}
+
+	// The archive is not deleted by the garbage collector yet.
+	ff.EXPECT().Get(archive.String()).Return(archiveDef, nil)
+	if err := checkExportAccess(archive, owner, now.Add(time.Hour)); err != types.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for an expired archive, found %v", err)
+	}
+
+	ff.EXPECT().Get(archive.String()).Return(nil, types.ErrInternal)
+	if err := checkExportAccess(archive, owner, now); err != types.ErrInternal {
+		t.Errorf("Expected DB error to deny access, found %v", err)
+	}
+}
+
 func TestHandleSessionUpdateSessToForeground(t *testing.T) {
 	topicName := "usrMe"
 	numUsers := 1
@@ -3,6 +3,7 @@ package main
 import (
 	"container/heap"
 	"math/rand"
+	"net/http"
 	"time"
 
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
@@ -191,6 +192,11 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		// Process user's login request.
 		_, missing, _ := stringSliceDelta(globals.authValidators[rec.AuthLevel], validated)
 		reply = s.onLogin(msg.Id, msg.Timestamp, rec, missing)
+		if reply.Ctrl.Code >= http.StatusBadRequest {
+			// The account is created, but the token could not be issued.
+			s.queueOut(reply)
+			return
+		}
 	} else {
 		// Not using the new account for logging in.
 		reply = NoErrCreated(msg.Id, "", msg.Timestamp)
@@ -277,8 +283,9 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	}
 
 	var params map[string]any
+	var challenge []byte
 	if msg.Acc.Scheme != "" {
-		err = updateUserAuth(msg, user, rec, s.remoteAddr)
+		params, challenge, err = updateUserAuth(msg, user, rec, s.remoteAddr)
 	} else if len(msg.Acc.Cred) > 0 {
 		if authLvl == auth.LevelNone {
 			// msg.Acc.AuthLevel contains invalid data.
@@ -323,6 +330,12 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		return
 	}
 
+	if challenge != nil {
+		// Multi-step update, like registration of a passkey.
+		s.queueOut(InfoChallenge(msg.Id, msg.Timestamp, challenge))
+		return
+	}
+
 	s.queueOut(NoErrParams(msg.Id, "", msg.Timestamp, params))
 
 	// Call plugin with the account update
@@ -330,16 +343,17 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 }
 
 // Authentication update
-func updateUserAuth(msg *ClientComMessage, user *types.User, rec *auth.Rec, remoteAddr string) error {
+func updateUserAuth(msg *ClientComMessage, user *types.User, rec *auth.Rec, remoteAddr string) (map[string]any, []byte, error) {
 	authhdl := store.Store.GetLogicalAuthHandler(msg.Acc.Scheme)
 	if authhdl != nil {
-		// Request to update auth of an existing account. Only basic & rest auth are currently supported
+		// Request to update auth of an existing account. Basic & rest auth and the second factor
+		// are currently supported.
 
 		// TODO(gene): support adding new auth schemes
 
 		rec, err := authhdl.UpdateRecord(&auth.Rec{Uid: user.Uid(), Tags: user.Tags}, msg.Acc.Secret, remoteAddr)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		// Tags may have been changed by authhdl.UpdateRecord, reset them.
@@ -347,11 +361,12 @@ func updateUserAuth(msg *ClientComMessage, user *types.User, rec *auth.Rec, remo
 		if _, err = store.Users.UpdateTags(user.Uid(), nil, nil, rec.Tags); err != nil {
 			logs.Warn.Println("updateUserAuth tags update failed:", err)
 		}
-		return nil
+		// Parameters generated by the authenticator, like the second factor secret, or a challenge.
+		return rec.Params, rec.Challenge, nil
 	}
 
 	// Invalid or unknown auth scheme
-	return types.ErrMalformed
+	return nil, nil, types.ErrMalformed
 }
 
 // addCreds adds new credentials and re-send validation request for existing ones.
@@ -556,6 +571,7 @@ func deleteCred(uid types.Uid, authLvl auth.Level, cred *MsgCredClient) ([]strin
 // 3. Suspend/activate p2p with the user.
 // 4. Suspend/activate grp topics where the user is the owner.
 // 5. Update user's DB record.
+// Setting the state to normal (ok) also unlocks the account locked after failed logins.
 func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientComMessage) (bool, error) {
 	state, err := types.NewObjState(msg.Acc.State)
 	if err != nil || state == types.StateUndefined {
@@ -563,9 +579,17 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 		return false, types.ErrMalformed
 	}
 
+	unlocked := false
+	if state == types.StateOK && globals.loginLimiter != nil {
+		// Restoring the state also lifts the lockout after failed logins.
+		if unlocked, err = globals.loginLimiter.unlock(uid); err != nil {
+			return false, err
+		}
+	}
+
 	// State unchanged.
 	if user.State == state {
-		return false, nil
+		return unlocked, nil
 	}
 
 	if state != types.StateOK {
@@ -726,6 +750,10 @@ type UserCacheReq struct {
 	Inc bool
 	// User is being deleted, remove user from cache.
 	Gone bool
+	// Logins of the user (UserId is set) were revoked, terminate sessions which use them
+	// except the session SkipSid.
+	Logins  []string
+	SkipSid string
 
 	// Optional push notification
 	PushRcpt *push.Receipt
@@ -868,6 +896,17 @@ func usersRemoveUser(uid types.Uid) {
 	}
 }
 
+// evictLogins terminates sessions of the user authenticated with the given logins on all cluster nodes.
+func evictLogins(uid types.Uid, logins []string, skipSid string) {
+	globals.sessionStore.EvictLogins(uid, logins, skipSid)
+
+	if globals.cluster != nil {
+		if err := globals.cluster.routeUserReq(&UserCacheReq{UserId: uid, Logins: logins, SkipSid: skipSid}); err != nil {
+			logs.Warn.Println("evictLogins: failed to notify cluster", uid, err)
+		}
+	}
+}
+
 // Account users as members of an active topic. Used for cache management.
 // In case of a cluster this method is called only when the topic is local:
 // globals.cluster.isRemoteTopic(t.name) == false
@@ -20,9 +20,11 @@ import (
 
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
 	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/search"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
 	"github.com/volvlabs/towncryer-chat-server/server/store/types"
 
+	"github.com/rivo/uniseg"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -215,11 +217,105 @@ func msgOpts2storeOpts(req *MsgGetOpts) *types.QueryOpt {
 			Limit:           req.Limit,
 			Since:           req.SinceId,
 			Before:          req.BeforeId,
+			Thread:          req.Thread,
 		}
 	}
 	return opts
 }
 
+// Validates a list of IDs of pinned messages: drops non-positive IDs and duplicates,
+// rejects references to messages which do not exist yet and lists which are too long.
+func normalizePinned(pinned []int, lastID int) ([]int, error) {
+	out := make([]int, 0, len(pinned))
+	seen := make(map[int]bool, len(pinned))
+	for _, seq := range pinned {
+		if seq <= 0 || seen[seq] {
+			continue
+		}
+		if seq > lastID {
+			return nil, errors.New("pinned message does not exist")
+		}
+		seen[seq] = true
+		out = append(out, seq)
+	}
+	if len(out) > maxPinnedMessages {
+		return nil, errors.New("too many pinned messages")
+	}
+	return out, nil
+}
+
+// Checks if two slices of ints contain the same values in the same order.
+func intSlicesEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a topic-unique message reference of the form ":123" into a seq ID.
+// Returns 0 if the reference is missing or invalid.
+func parseSeqRef(ref any) int {
+	str, ok := ref.(string)
+	if !ok || !strings.HasPrefix(str, ":") {
+		return 0
+	}
+	seq, err := strconv.Atoi(str[1:])
+	if err != nil || seq <= 0 {
+		return 0
+	}
+	return seq
+}
+
+// Checks if the value is acceptable as a reaction to a message: a single grapheme, such as an emoji,
+// of at most maxReactionLength runes without control or whitespace characters. An empty value
+// removes the reaction and is valid too.
+func validReaction(value string) bool {
+	if value == "" {
+		return true
+	}
+	if !utf8.ValidString(value) || utf8.RuneCountInString(value) > maxReactionLength ||
+		uniseg.GraphemeClusterCount(value) != 1 {
+		return false
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) || unicode.IsSpace(r) || r == utf8.RuneError {
+			return false
+		}
+	}
+	return true
+}
+
+// Aggregates reactions by message and by reaction value. Reactions must be sorted by SeqId.
+// Values are listed in the order they first appeared. User IDs are omitted if hideUsers is true.
+func reactionsAggregate(reacts []types.Reaction, hideUsers bool) []MsgMessageReactions {
+	var out []MsgMessageReactions
+	var pos map[string]int
+	for i := range reacts {
+		r := &reacts[i]
+		if len(out) == 0 || out[len(out)-1].SeqId != r.SeqId {
+			out = append(out, MsgMessageReactions{SeqId: r.SeqId})
+			pos = make(map[string]int)
+		}
+		last := &out[len(out)-1]
+		idx, ok := pos[r.Value]
+		if !ok {
+			idx = len(last.React)
+			pos[r.Value] = idx
+			last.React = append(last.React, MsgReaction{Value: r.Value})
+		}
+		last.React[idx].Count++
+		if !hideUsers {
+			last.React[idx].Users = append(last.React[idx].Users, types.ParseUid(r.User).UserId())
+		}
+	}
+	return out
+}
+
 // Check if the interface contains a string with a single Unicode Del control character.
 func isNullValue(i any) bool {
 	if str, ok := i.(string); ok {
@@ -271,6 +367,8 @@ func decodeStoreErrorExplicitTs(err error, id, topic string, serverTs, incomingR
 			errmsg = ErrInvalidResponse(id, topic, serverTs, incomingReqTs)
 		case types.ErrRedirected:
 			errmsg = InfoUseOther(id, topic, params["topic"].(string), serverTs, incomingReqTs)
+		case types.ErrTooManyAttempts:
+			errmsg = ErrTooManyRequests(id, topic, serverTs, incomingReqTs)
 		default:
 			errmsg = ErrUnknownExplicitTs(id, topic, serverTs, incomingReqTs)
 		}
@@ -640,6 +738,70 @@ func parseSearchQuery(query, countryCode string, withLogin bool) ([][]string, []
 	return and, or, nil
 }
 
+// Split full-text search query into unique lowercase words. Anything but letters and digits is a separator.
+// At most maxWords words are returned, the rest are ignored.
+func searchWords(query string, maxWords int) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, word := range search.Words(query) {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+		if len(words) == maxWords {
+			break
+		}
+	}
+	return words
+}
+
+// Extract a fragment of text up to length runes long around the first occurrence of any of the words.
+// The words are expected to be lowercase. Ellipsis marks the cut ends.
+func searchSnippet(text string, words []string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		// Lowercasing changed the number of runes, positions do not match. Use the original.
+		lower = runes
+	}
+
+	// Find the earliest match.
+	pos := -1
+	for _, word := range words {
+		if idx := strings.Index(string(lower), word); idx >= 0 {
+			idx = utf8.RuneCountInString(string(lower)[:idx])
+			if pos < 0 || idx < pos {
+				pos = idx
+			}
+		}
+	}
+
+	// Place the match at about a quarter of the snippet.
+	start := 0
+	if pos > length/4 {
+		start = pos - length/4
+	}
+	end := start + length
+	if end > len(runes) {
+		end = len(runes)
+		start = max(0, end-length)
+	}
+
+	snippet := string(runes[start:end])
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
 // Returns > 0 if v1 > v2; zero if equal; < 0 if v1 < v2
 // Only Major and Minor parts are compared, the trailer is ignored.
 func versionCompare(v1, v2 int) int {
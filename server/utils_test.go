@@ -1,7 +1,11 @@
 package main
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
 )
 
 func slicesEqual(expected, gotten []string) bool {
@@ -58,3 +62,122 @@ func TestStringSliceDelta(t *testing.T) {
 
 	}
 }
+
+func TestParseSeqRef(t *testing.T) {
+	cases := []struct {
+		ref      any
+		expected int
+	}{
+		{":123", 123},
+		{":1", 1},
+		{"123", 0},
+		{":0", 0},
+		{":-5", 0},
+		{":abc", 0},
+		{"grp1XUtEhjv6HND:123", 0},
+		{123, 0},
+		{nil, 0},
+	}
+
+	for _, tc := range cases {
+		if seq := parseSeqRef(tc.ref); seq != tc.expected {
+			t.Errorf("parseSeqRef(%v): expected %d, got %d", tc.ref, tc.expected, seq)
+		}
+	}
+}
+
+func TestReactionsAggregate(t *testing.T) {
+	uid1, uid2, uid3 := types.Uid(1), types.Uid(2), types.Uid(3)
+	reacts := []types.Reaction{
+		{SeqId: 3, User: uid1.String(), Value: "+1"},
+		{SeqId: 3, User: uid2.String(), Value: "heart"},
+		{SeqId: 3, User: uid3.String(), Value: "+1"},
+		{SeqId: 5, User: uid2.String(), Value: "+1"},
+	}
+	expected := []MsgMessageReactions{
+		{SeqId: 3, React: []MsgReaction{
+			{Value: "+1", Count: 2, Users: []string{uid1.UserId(), uid3.UserId()}},
+			{Value: "heart", Count: 1, Users: []string{uid2.UserId()}},
+		}},
+		{SeqId: 5, React: []MsgReaction{
+			{Value: "+1", Count: 1, Users: []string{uid2.UserId()}},
+		}},
+	}
+	if out := reactionsAggregate(reacts, false); !reflect.DeepEqual(out, expected) {
+		t.Errorf("reactionsAggregate: expected %+v, got %+v", expected, out)
+	}
+
+	// Users are hidden.
+	out := reactionsAggregate(reacts, true)
+	if len(out) != 2 || out[0].React[0].Count != 2 || out[0].React[0].Users != nil {
+		t.Errorf("reactionsAggregate(hideUsers): unexpected %+v", out)
+	}
+
+	if out := reactionsAggregate(nil, false); out != nil {
+		t.Errorf("reactionsAggregate(nil): expected nil, got %+v", out)
+	}
+}
+
+func TestValidReaction(t *testing.T) {
+	valid := []string{
+		"", "👍", "❤️", "👍🏽", "👨‍👩‍👧‍👦", "🇺🇦", "🏴󠁧󠁢󠁳󠁣󠁴󠁿", "a", "+", "é", "e\u0301",
+	}
+	for _, val := range valid {
+		if !validReaction(val) {
+			t.Errorf("validReaction(%q): expected true", val)
+		}
+	}
+	invalid := []string{
+		" ", "\t", "\n", "\x00", "\u200b\u200b", "+1", "👍👍", "hello", "👍 ", "\u0085", "\xff",
+		"e" + strings.Repeat("\u0301", maxReactionLength),
+	}
+	for _, val := range invalid {
+		if validReaction(val) {
+			t.Errorf("validReaction(%q): expected false", val)
+		}
+	}
+}
+
+func TestSearchWords(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"Lunch on Friday", []string{"lunch", "on", "friday"}},
+		{"  lunch, LUNCH;friday!? ", []string{"lunch", "friday"}},
+		{"Größe 42", []string{"größe", "42"}},
+		{"a b c d", []string{"a", "b", "c"}},
+		{" ,.!", nil},
+	}
+
+	for _, tc := range cases {
+		if words := searchWords(tc.query, 3); !reflect.DeepEqual(words, tc.expected) {
+			t.Errorf("searchWords(%q): expected %v, got %v", tc.query, tc.expected, words)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	cases := []struct {
+		text     string
+		words    []string
+		expected string
+	}{
+		// Short text is returned as is.
+		{"Lunch on?", []string{"lunch"}, "Lunch on?"},
+		// Match at the start.
+		{"Lunch on Friday, then a long walk", []string{"lunch"}, "Lunch on F…"},
+		// Match in the middle.
+		{"We should go to lunch on Friday", []string{"friday", "lunch"}, "…o lunch on…"},
+		// Match at the end.
+		{"We should go to lunch on Friday", []string{"friday"}, "… on Friday"},
+		// No match.
+		{"We should go to lunch", []string{"dinner"}, "We should …"},
+	}
+
+	for _, tc := range cases {
+		if snippet := searchSnippet(tc.text, tc.words, 10); snippet != tc.expected {
+			t.Errorf("searchSnippet(%q, %v): expected %q, got %q", tc.text, tc.words, tc.expected, snippet)
+		}
+	}
+}
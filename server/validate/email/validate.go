@@ -19,6 +19,7 @@ import (
 	"strconv"
 	"strings"
 	textt "text/template"
+	"time"
 
 	"github.com/volvlabs/towncryer-chat-server/server/logs"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
@@ -37,6 +38,8 @@ type validator struct {
 	ValidationTemplFile string `json:"validation_templ"`
 	// Path to templates for resetting the authentication secret.
 	ResetTemplFile string `json:"reset_secret_templ"`
+	// Optional path to templates of notifications about locked accounts.
+	LockoutTemplFile string `json:"lockout_templ"`
 	// Sender RFC 5322 email address.
 	SendFrom string `json:"sender"`
 	// Login to use for SMTP authentication.
@@ -67,6 +70,7 @@ type validator struct {
 	// https://github.com/golang/go/issues/24211
 	validationTempl []*textt.Template
 	resetTempl      []*textt.Template
+	lockoutTempl    []*textt.Template
 	auth            smtp.Auth
 	senderEmail     string
 	langMatcher     i18n.Matcher
@@ -185,6 +189,12 @@ func (v *validator) Init(jsonconf string) error {
 		}
 	}
 
+	if v.LockoutTemplFile != "" {
+		if err = v.initLockoutTempl(); err != nil {
+			return err
+		}
+	}
+
 	if v.HostUrl, err = validate.ValidateHostURL(v.HostUrl); err != nil {
 		return err
 	}
@@ -212,6 +222,35 @@ func (v *validator) Init(jsonconf string) error {
 	return nil
 }
 
+// initLockoutTempl reads optional templates of lockout notifications.
+func (v *validator) initLockoutTempl() error {
+	var err error
+	if v.LockoutTemplFile, err = validate.ResolveTemplatePath(v.LockoutTemplFile); err != nil {
+		return err
+	}
+	lockoutPathTempl, err := textt.New("lockout").Parse(v.LockoutTemplFile)
+	if err != nil {
+		return err
+	}
+
+	langs := v.Languages
+	if len(langs) == 0 {
+		// No i18n support. Use defaults.
+		langs = []string{""}
+	}
+	v.lockoutTempl = make([]*textt.Template, len(langs))
+	var path string
+	for idx, lang := range langs {
+		if v.lockoutTempl[idx], path, err = validate.ReadTemplateFile(lockoutPathTempl, lang); err != nil {
+			return err
+		}
+		if err = isTemplateValid(v.lockoutTempl[idx]); err != nil {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
 // IsInitialized returns true if the validator is initialized.
 func (v *validator) IsInitialized() bool {
 	return v.SMTPHeloHost != ""
@@ -345,6 +384,34 @@ func (v *validator) ResetSecret(email, scheme, lang string, code []byte, params
 	return nil
 }
 
+// NotifyLockout sends a message informing the user that the account is temporarily locked.
+func (v *validator) NotifyLockout(email, lang string, until time.Time) error {
+	if v.lockoutTempl == nil {
+		return t.ErrUnsupported
+	}
+
+	var template *textt.Template
+	if v.langMatcher != nil {
+		_, idx := i18n.MatchStrings(v.langMatcher, lang)
+		template = v.lockoutTempl[idx]
+	} else {
+		template = v.lockoutTempl[0]
+	}
+
+	content, err := validate.ExecuteTemplate(template, templateParts, map[string]interface{}{
+		"Cred":    email,
+		"Until":   until.UTC().Format(time.RFC1123),
+		"HostUrl": v.HostUrl})
+	if err != nil {
+		return err
+	}
+
+	// Send email without blocking. Email sending may take long time.
+	go v.send(email, content)
+
+	return nil
+}
+
 // Check checks if the provided validation response matches the expected response.
 // Returns the value of validated credential on success.
 func (v *validator) Check(user t.Uid, resp string) (string, error) {
@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	textt "text/template"
+	"time"
 
 	"github.com/nyaruka/phonenumbers"
 	"github.com/volvlabs/towncryer-chat-server/server/logs"
@@ -238,6 +239,11 @@ func (v *validator) Check(user t.Uid, resp string) (string, error) {
 	return "", t.ErrCredentials
 }
 
+// NotifyLockout is not supported: SMS are sent only with codes.
+func (*validator) NotifyLockout(phone, lang string, until time.Time) error {
+	return t.ErrUnsupported
+}
+
 // Delete deletes user's records. Returns deleted credentials.
 func (*validator) Delete(user t.Uid) error {
 	return store.Users.DelCred(user, validatorName, "")
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"text/template"
+	"time"
 
 	t "github.com/volvlabs/towncryer-chat-server/server/store/types"
 )
@@ -43,6 +44,13 @@ type Validator interface {
 	//   params: authentication params.
 	ResetSecret(cred, scheme, lang string, tmpToken []byte, params map[string]interface{}) error
 
+	// NotifyLockout informs the user that logins to the account are blocked after too many failed
+	// attempts. Returns ErrUnsupported if the validator cannot send such notifications.
+	//   cred: address to use for the message.
+	//   lang: human language of the message.
+	//   until: time when the lockout ends.
+	NotifyLockout(cred, lang string, until time.Time) error
+
 	// Check checks validity of user's response.
 	// Returns the value of validated credential on success.
 	Check(user t.Uid, resp string) (string, error)
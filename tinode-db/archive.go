@@ -0,0 +1,751 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Export writes the full state of one user or one topic to a zip archive which can be imported
+// into the same or another database through the adapter interface.
+//
+// The archive contains:
+//   manifest.json - the user or the topic with subscriptions, deletion log, reactions, positions
+//                   in threads, file records;
+//   messages.json - messages of the topic with earlier revisions, one JSON object per line;
+//   files/<id>    - content of the uploaded files, if the media handler is configured.
+
+const (
+	// Version 2 added revisions of messages and positions in threads. Version 1 is still accepted.
+	archiveVersion = 2
+
+	archiveManifest = "manifest.json"
+	archiveMessages = "messages.json"
+	archiveFiles    = "files/"
+)
+
+// archiveData is the content of the manifest.
+type archiveData struct {
+	Version int `json:"version"`
+	// "user" or "topic".
+	Kind string `json:"kind"`
+	// User ID (usrXXX) or topic name.
+	Name      string    `json:"name"`
+	Adapter   string    `json:"adapter"`
+	CreatedAt time.Time `json:"created"`
+
+	User        *types.User          `json:"user,omitempty"`
+	Auth        []adapter.AuthRecord `json:"auth,omitempty"`
+	Credentials []types.Credential   `json:"credentials,omitempty"`
+	Devices     []types.DeviceDef    `json:"devices,omitempty"`
+
+	Topic     *types.Topic       `json:"topic,omitempty"`
+	Deletions []types.DelMessage `json:"deletions,omitempty"`
+	Reactions []types.Reaction   `json:"reactions,omitempty"`
+	// Positions of the topic's subscribers or of the user in threads.
+	ThreadReads []threadRead `json:"threadreads,omitempty"`
+	// List of archive segments of the topic as stored in the persistent cache.
+	Archive string `json:"archive,omitempty"`
+	// Number of messages in messages.json.
+	Messages int `json:"messages,omitempty"`
+
+	Subscriptions []types.Subscription `json:"subscriptions,omitempty"`
+	Files         []types.FileDef      `json:"files,omitempty"`
+}
+
+// archiveMessage is a line of messages.json.
+type archiveMessage struct {
+	types.Message
+	// Earlier revisions of the message, oldest first.
+	Revisions []types.Message `json:"revisions,omitempty"`
+}
+
+// exportArchive writes the user or the topic with the given name to the archive file.
+func exportArchive(name, filename string) {
+	adp := store.Store.GetAdapter()
+	adp.SetMaxResults(migrateMaxResults)
+
+	out, err := os.Create(filename)
+	if err != nil {
+		log.Fatalln("Failed to create archive:", err)
+	}
+	zw := zip.NewWriter(out)
+
+	data := &archiveData{Version: archiveVersion, Adapter: adp.GetName(), CreatedAt: types.TimeNow()}
+	var fids []string
+	switch {
+	case !types.ParseUserId(name).IsZero():
+		fids, err = exportUser(adp, name, data)
+	case strings.HasPrefix(name, "p2p"), strings.HasPrefix(name, "grp"), strings.HasPrefix(name, "chn"):
+		fids, err = exportTopic(adp, zw, types.ChnToGrp(name), data)
+	default:
+		err = fmt.Errorf("'%s' is neither a user nor a p2p or group topic", name)
+	}
+	if err == nil {
+		err = exportFiles(adp, zw, fids, data)
+	}
+	if err == nil {
+		var w io.Writer
+		if w, err = zw.Create(archiveManifest); err == nil {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(data)
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filename)
+		log.Fatalf("Failed to export '%s': %s", name, err)
+	}
+	log.Printf("Exported %s '%s' with %d subscriptions, %d messages, %d files to '%s'", data.Kind, data.Name,
+		len(data.Subscriptions), data.Messages, len(data.Files), filename)
+}
+
+// exportUser reads the user with authentication records, credentials, devices, subscriptions and
+// positions in threads. Returns IDs of the files attached to the user.
+func exportUser(adp adapter.Adapter, name string, data *archiveData) ([]string, error) {
+	uid := types.ParseUserId(name)
+	user, err := findUser(adp, uid)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, types.ErrNotFound
+	}
+	data.Kind, data.Name, data.User = "user", name, user
+	// Devices are exported separately.
+	data.User.Devices = nil
+	data.User.DeviceArray = nil
+
+	if data.Auth, err = adp.AuthExport(uid); err != nil {
+		return nil, err
+	}
+	if data.Credentials, err = adp.CredGetAll(uid, "", false); err != nil {
+		return nil, err
+	}
+	devices, _, err := adp.DeviceGetAll(uid)
+	if err != nil {
+		return nil, err
+	}
+	data.Devices = devices[uid]
+
+	// Subscriptions to 'me' and 'fnd' are returned even if deleted, the rest are live only.
+	topics := []string{uid.UserId(), uid.FndName()}
+	subs, err := adp.SubsForUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range subs {
+		if subs[i].Topic != topics[0] && subs[i].Topic != topics[1] {
+			topics = append(topics, subs[i].Topic)
+		}
+	}
+	for _, topic := range topics {
+		// SubsForUser does not load Private.
+		sub, err := adp.SubscriptionGet(topic, uid, true)
+		if err != nil {
+			return nil, err
+		}
+		if sub != nil {
+			data.Subscriptions = append(data.Subscriptions, *sub)
+		}
+		if cat := types.GetTopicCat(topic); cat == types.TopicCatP2P || cat == types.TopicCatGrp {
+			reads, err := threadReads(adp, types.ChnToGrp(topic), []types.Uid{uid})
+			if err != nil {
+				return nil, err
+			}
+			data.ThreadReads = append(data.ThreadReads, reads...)
+		}
+	}
+	return data.User.Attachments, nil
+}
+
+// exportTopic reads the topic with subscriptions, deletion log, reactions and positions in threads
+// and writes messages with their revisions to the archive. Returns IDs of the files attached to the
+// topic and its messages.
+func exportTopic(adp adapter.Adapter, zw *zip.Writer, name string, data *archiveData) ([]string, error) {
+	topic, err := findTopic(adp, name)
+	if err != nil {
+		return nil, err
+	}
+	if topic == nil {
+		return nil, types.ErrNotFound
+	}
+	data.Kind, data.Name, data.Topic = "topic", name, topic
+
+	if data.Subscriptions, err = topicSubs(adp, topic); err != nil {
+		return nil, err
+	}
+	users := make([]types.Uid, 0, len(data.Subscriptions))
+	for i := range data.Subscriptions {
+		users = append(users, types.ParseUid(data.Subscriptions[i].User))
+	}
+	if data.Deletions, err = deletions(adp, name, users); err != nil {
+		return nil, err
+	}
+	if data.Reactions, err = adp.ReactionGetAll(name, nil); err != nil {
+		return nil, err
+	}
+	if data.ThreadReads, err = threadReads(adp, name, users); err != nil {
+		return nil, err
+	}
+	if data.Archive, err = adp.PCacheGet(store.ArchiveKeyPrefix + name); err == types.ErrNotFound {
+		err = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	fids := append([]string{}, topic.Attachments...)
+	w, err := zw.Create(archiveMessages)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	for after := 0; ; {
+		msgs, err := adp.MessageExport(name, types.ZeroUid, after, migratePageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		for i := range msgs {
+			msg := archiveMessage{Message: msgs[i]}
+			if msg.Revisions, err = revisions(adp, &msgs[i]); err != nil {
+				return nil, err
+			}
+			if err = enc.Encode(&msg); err != nil {
+				return nil, err
+			}
+			fids = append(fids, msgs[i].Attachments...)
+		}
+		data.Messages += len(msgs)
+		after = msgs[len(msgs)-1].SeqId
+	}
+	return fids, nil
+}
+
+// findUser returns the user record as exported, including soft-deleted users and attachments
+// which are not returned by UserGet. The export API can only be paged, so all users are scanned.
+func findUser(adp adapter.Adapter, uid types.Uid) (*types.User, error) {
+	for after := types.ZeroUid; ; {
+		users, err := adp.UserExport(after, migratePageSize)
+		if err != nil || len(users) == 0 {
+			return nil, err
+		}
+		for i := range users {
+			if users[i].Id == uid.String() {
+				return &users[i], nil
+			}
+		}
+		after = types.ParseUid(users[len(users)-1].Id)
+	}
+}
+
+// findTopic returns the topic record as exported, including attachments not returned by TopicGet.
+func findTopic(adp adapter.Adapter, name string) (*types.Topic, error) {
+	for after := ""; ; {
+		topics, err := adp.TopicExport(after, migratePageSize)
+		if err != nil || len(topics) == 0 {
+			return nil, err
+		}
+		for i := range topics {
+			if topics[i].Id == name {
+				return &topics[i], nil
+			}
+		}
+		after = topics[len(topics)-1].Id
+	}
+}
+
+// exportFiles adds records of the files to the manifest and their content to the archive.
+// The content is exported only if the media handler is configured and supports downloading.
+func exportFiles(adp adapter.Adapter, zw *zip.Writer, fids []string, data *archiveData) error {
+	handler := store.Store.GetMediaHandler()
+	seen := map[string]bool{}
+	for _, fid := range fids {
+		if seen[fid] {
+			continue
+		}
+		seen[fid] = true
+
+		fd, err := adp.FileGet(fid)
+		if err != nil {
+			return err
+		}
+		if fd == nil {
+			log.Printf("  file %s is referenced but not found", fid)
+			continue
+		}
+		data.Files = append(data.Files, *fd)
+		if handler == nil || fd.Status != types.UploadCompleted {
+			continue
+		}
+
+		_, rsc, err := handler.Download(fid)
+		if err != nil {
+			log.Printf("  content of file %s is not exported: %s", fid, err)
+			continue
+		}
+		w, err := zw.Create(archiveFiles + fid)
+		if err == nil {
+			_, err = io.Copy(w, rsc)
+		}
+		rsc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remapper replaces IDs of users and group topics in the imported records.
+type remapper map[string]string
+
+// parseRemap parses a comma-separated list of user IDs and group topic names to replace,
+// each optionally followed by '=' and the replacement: "usrAAA=usrBBB,grpCCC". A new
+// ID is generated if the replacement is not given.
+func parseRemap(spec string) (remapper, error) {
+	ids := remapper{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		from, to, _ := strings.Cut(item, "=")
+		if !types.ParseUserId(from).IsZero() {
+			if to == "" {
+				to = store.Store.GetUid().UserId()
+			} else if types.ParseUserId(to).IsZero() {
+				return nil, fmt.Errorf("invalid user ID '%s'", to)
+			}
+		} else if strings.HasPrefix(from, "grp") && !types.ParseUid(from[3:]).IsZero() {
+			if to == "" {
+				to = genTopicName()
+			} else if !strings.HasPrefix(to, "grp") || types.ParseUid(to[3:]).IsZero() {
+				return nil, fmt.Errorf("invalid group topic name '%s'", to)
+			}
+		} else {
+			return nil, fmt.Errorf("'%s' is neither a user ID nor a group topic name", from)
+		}
+		ids[from] = to
+	}
+	return ids, nil
+}
+
+// uid replaces the user ID given as Uid.String().
+func (r remapper) uid(id string) string {
+	if id == "" {
+		return id
+	}
+	return r.user(types.ParseUid(id)).String()
+}
+
+func (r remapper) user(uid types.Uid) types.Uid {
+	if to, ok := r[uid.UserId()]; ok {
+		return types.ParseUserId(to)
+	}
+	return uid
+}
+
+// topic replaces the topic name, including names derived from user IDs.
+func (r remapper) topic(name string) string {
+	switch types.GetTopicCat(name) {
+	case types.TopicCatMe:
+		return r.user(types.ParseUserId(name)).UserId()
+	case types.TopicCatFnd:
+		return r.user(types.ParseUid(name[3:])).FndName()
+	case types.TopicCatP2P:
+		uid1, uid2, err := types.ParseP2P(name)
+		if err != nil {
+			return name
+		}
+		return r.user(uid1).P2PName(r.user(uid2))
+	case types.TopicCatGrp:
+		if types.IsChannel(name) {
+			return types.GrpToChn(r.topic(types.ChnToGrp(name)))
+		}
+		if to, ok := r[name]; ok {
+			return to
+		}
+	}
+	return name
+}
+
+// importArchive loads the user or the topic from the archive file into the database.
+func importArchive(filename, remap string, replace bool) {
+	adp := store.Store.GetAdapter()
+	adp.SetMaxResults(migrateMaxResults)
+
+	ids, err := parseRemap(remap)
+	if err != nil {
+		log.Fatalln("Invalid --remap:", err)
+	}
+
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		log.Fatalln("Failed to open archive:", err)
+	}
+	defer zr.Close()
+
+	var data archiveData
+	if err = readArchiveJSON(&zr.Reader, archiveManifest, &data); err != nil {
+		log.Fatalln("Failed to read archive manifest:", err)
+	}
+	if data.Version < 1 || data.Version > archiveVersion {
+		log.Fatalf("Unsupported archive version %d, expected up to %d", data.Version, archiveVersion)
+	}
+	log.Printf("Importing %s '%s' exported from '%s' at %s", data.Kind, data.Name, data.Adapter,
+		data.CreatedAt.Format(time.RFC3339))
+
+	switch data.Kind {
+	case "user":
+		err = importUser(adp, &zr.Reader, &data, ids, replace)
+	case "topic":
+		err = importTopic(adp, &zr.Reader, &data, ids, replace)
+	default:
+		err = fmt.Errorf("unknown kind of archive '%s'", data.Kind)
+	}
+	if err != nil {
+		log.Fatalf("Failed to import '%s': %s", data.Name, err)
+	}
+}
+
+func readArchiveJSON(zr *zip.Reader, name string, val any) error {
+	r, err := zr.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(val)
+}
+
+// importUser creates the user with authentication records, credentials, devices, subscriptions and
+// positions in threads.
+// Subscriptions to topics which don't exist in the database are skipped.
+func importUser(adp adapter.Adapter, zr *zip.Reader, data *archiveData, ids remapper, replace bool) error {
+	user := data.User
+	uid := ids.user(types.ParseUid(user.Id))
+	if err := prepareImport(adp, uid.UserId(), replace); err != nil {
+		return err
+	}
+	if err := importFiles(adp, zr, data.Files, ids); err != nil {
+		return err
+	}
+
+	attachments := user.Attachments
+	user.SetUid(uid)
+	user.Attachments = nil
+	if err := adp.UserCreate(user); err != nil {
+		return err
+	}
+
+	for _, rec := range data.Auth {
+		if err := adp.AuthAddRecord(uid, rec.Scheme, rec.Unique, rec.AuthLvl, rec.Secret, rec.Expires); err != nil {
+			return fmt.Errorf("auth record %s:%s: %w", rec.Scheme, rec.Unique, err)
+		}
+	}
+	for i := range data.Credentials {
+		cred := &data.Credentials[i]
+		cred.User = uid.String()
+		if _, err := adp.CredUpsert(cred); err == types.ErrDuplicate {
+			log.Printf("  skipped duplicate credential %s:%s", cred.Method, cred.Value)
+		} else if err != nil {
+			return err
+		}
+	}
+	for i := range data.Devices {
+		if err := adp.DeviceUpsert(uid, &data.Devices[i]); err != nil {
+			return err
+		}
+	}
+
+	subs, err := importableSubs(adp, data.Subscriptions, ids)
+	if err != nil {
+		return err
+	}
+	if err = saveSubs(adp, subs); err != nil {
+		return err
+	}
+	// Positions in threads are restored in topics where the subscription is imported.
+	imported := map[string]bool{}
+	for i := range subs {
+		imported[types.ChnToGrp(subs[i].Topic)] = true
+	}
+	for _, r := range data.ThreadReads {
+		if topic := ids.topic(r.Topic); imported[topic] {
+			if err = adp.ThreadReadUpdate(topic, uid, r.Thread, r.ReadSeqId); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(attachments) > 0 {
+		if err = adp.FileLinkAttachments("", uid, types.ZeroUid, attachments); err != nil {
+			return err
+		}
+	}
+	if err = restoreUser(adp, user); err != nil {
+		return err
+	}
+	log.Printf("Imported user '%s' with %d subscriptions, %d files", uid.UserId(), len(subs), len(data.Files))
+	return nil
+}
+
+// importTopic creates the topic with subscriptions, messages with revisions, deletion log, reactions
+// and positions of users in threads.
+// Subscriptions of users who don't exist in the database are skipped.
+func importTopic(adp adapter.Adapter, zr *zip.Reader, data *archiveData, ids remapper, replace bool) error {
+	topic := data.Topic
+	topic.Id = ids.topic(topic.Id)
+	topic.Owner = ids.uid(topic.Owner)
+	if err := prepareImport(adp, topic.Id, replace); err != nil {
+		return err
+	}
+	if err := importFiles(adp, zr, data.Files, ids); err != nil {
+		return err
+	}
+
+	created := *topic
+	created.Attachments = nil
+	if err := adp.TopicCreate(&created); err != nil {
+		return err
+	}
+	subs, err := importableSubs(adp, data.Subscriptions, ids)
+	if err != nil {
+		return err
+	}
+	if err = saveSubs(adp, subs); err != nil {
+		return err
+	}
+
+	count := 0
+	if data.Messages > 0 {
+		r, err := zr.Open(archiveMessages)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		dec := json.NewDecoder(r)
+		for {
+			var msg archiveMessage
+			if err = dec.Decode(&msg); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("message %d: %w", count, err)
+			}
+			msg.Topic = topic.Id
+			msg.From = ids.uid(msg.From)
+			if err = saveMessage(adp, &msg.Message, msg.Revisions); err != nil {
+				return fmt.Errorf("message %d: %w", msg.SeqId, err)
+			}
+			count++
+		}
+	}
+
+	for i := range data.Deletions {
+		del := &data.Deletions[i]
+		del.Topic = topic.Id
+		del.DeletedFor = ids.uid(del.DeletedFor)
+		del.SetUid(store.Store.GetUid())
+		if err = adp.MessageDeleteList(topic.Id, del); err != nil {
+			return err
+		}
+	}
+	for i := range data.Reactions {
+		react := &data.Reactions[i]
+		react.Topic = topic.Id
+		react.User = ids.uid(react.User)
+		if err = adp.ReactionUpsert(react); err != nil {
+			return err
+		}
+	}
+	// Positions of users whose subscriptions are skipped are skipped too.
+	subscribed := map[types.Uid]bool{}
+	for i := range subs {
+		subscribed[types.ParseUid(subs[i].User)] = true
+	}
+	for _, r := range data.ThreadReads {
+		if uid := ids.user(r.User); subscribed[uid] {
+			if err = adp.ThreadReadUpdate(topic.Id, uid, r.Thread, r.ReadSeqId); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(topic.Attachments) > 0 {
+		if err = adp.FileLinkAttachments(topic.Id, types.ZeroUid, types.ZeroUid, topic.Attachments); err != nil {
+			return err
+		}
+	}
+	// Segment files keep their IDs, the list of segments is valid as is. The list left from the
+	// replaced topic is removed.
+	if data.Archive != "" {
+		err = adp.PCacheUpsert(store.ArchiveKeyPrefix+topic.Id, data.Archive, false)
+	} else {
+		err = adp.PCacheDelete(store.ArchiveKeyPrefix + topic.Id)
+	}
+	if err != nil {
+		return err
+	}
+	if err = restoreTopic(adp, topic); err != nil {
+		return err
+	}
+	log.Printf("Imported topic '%s' with %d subscriptions, %d messages, %d files", topic.Id, len(subs), count,
+		len(data.Files))
+	return nil
+}
+
+// prepareImport checks that the user or the topic does not exist or deletes it if replace is true.
+func prepareImport(adp adapter.Adapter, name string, replace bool) error {
+	var err error
+	exists := false
+	if types.GetTopicCat(name) == types.TopicCatMe {
+		var user *types.User
+		if user, err = adp.UserGet(types.ParseUserId(name)); err == nil && user == nil {
+			// Soft-deleted users are not returned by UserGet.
+			user, err = findUser(adp, types.ParseUserId(name))
+		}
+		exists = user != nil
+	} else {
+		var topic *types.Topic
+		if topic, err = adp.TopicGet(name); err == nil {
+			exists = topic != nil
+		}
+	}
+	if err != nil || !exists {
+		return err
+	}
+	if !replace {
+		return fmt.Errorf("'%s' already exists; use --replace to overwrite it", name)
+	}
+
+	log.Printf("Deleting existing '%s'", name)
+	if types.GetTopicCat(name) == types.TopicCatMe {
+		return adp.UserDelete(types.ParseUserId(name), true)
+	}
+	return adp.TopicDelete(name, types.IsChannel(name), true)
+}
+
+// importableSubs remaps subscriptions and drops those which cannot be saved: of missing users
+// or to missing topics. Subscriptions which already exist are left intact.
+func importableSubs(adp adapter.Adapter, subs []types.Subscription, ids remapper) ([]types.Subscription, error) {
+	users := map[string]bool{}
+	topics := map[string]bool{}
+	var result []types.Subscription
+	for _, sub := range subs {
+		sub.User = ids.uid(sub.User)
+		sub.Topic = ids.topic(sub.Topic)
+		uid := types.ParseUid(sub.User)
+
+		exists, ok := users[sub.User]
+		if !ok {
+			user, err := adp.UserGet(uid)
+			if err != nil {
+				return nil, err
+			}
+			exists = user != nil
+			users[sub.User] = exists
+		}
+		if !exists {
+			log.Printf("  skipped subscription of missing user '%s' to '%s'", uid.UserId(), sub.Topic)
+			continue
+		}
+
+		// Topics 'me' and 'fnd' exist implicitly.
+		if cat := types.GetTopicCat(sub.Topic); cat == types.TopicCatP2P || cat == types.TopicCatGrp {
+			name := types.ChnToGrp(sub.Topic)
+			exists, ok = topics[name]
+			if !ok {
+				topic, err := adp.TopicGet(name)
+				if err != nil {
+					return nil, err
+				}
+				exists = topic != nil
+				topics[name] = exists
+			}
+			if !exists {
+				log.Printf("  skipped subscription of '%s' to missing topic '%s'", uid.UserId(), sub.Topic)
+				continue
+			}
+		}
+
+		if have, err := adp.SubscriptionGet(sub.Topic, uid, true); err != nil {
+			return nil, err
+		} else if have != nil {
+			log.Printf("  skipped existing subscription of '%s' to '%s'", uid.UserId(), sub.Topic)
+			continue
+		}
+		result = append(result, sub)
+	}
+	return result, nil
+}
+
+// importFiles creates file records which don't exist in the database. The content is uploaded
+// through the media handler if the archive has it and the handler is configured. Otherwise
+// the records keep locations from the source.
+func importFiles(adp adapter.Adapter, zr *zip.Reader, files []types.FileDef, ids remapper) error {
+	handler := store.Store.GetMediaHandler()
+	for i := range files {
+		fd := &files[i]
+		fd.SetUid(types.ParseUid(fd.Id))
+		fd.User = ids.uid(fd.User)
+		if have, err := adp.FileGet(fd.Id); err != nil {
+			return err
+		} else if have != nil {
+			continue
+		}
+
+		content, err := readArchiveFile(zr, archiveFiles+fd.Id)
+		if err != nil {
+			return fmt.Errorf("file %s: %w", fd.Id, err)
+		}
+		if content == nil || handler == nil {
+			if content != nil {
+				log.Printf("  media handler is not configured, content of file %s is not imported", fd.Id)
+			}
+			if err = adp.FileStartUpload(fd); err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, size, err := handler.Upload(fd, bytes.NewReader(content))
+		if err == nil {
+			_, err = store.Files.FinishUpload(fd, true, size)
+		}
+		if err != nil {
+			return fmt.Errorf("file %s: %w", fd.Id, err)
+		}
+	}
+	return nil
+}
+
+// readArchiveFile returns content of the file in the archive or nil if the file is not there.
+func readArchiveFile(zr *zip.Reader, name string) ([]byte, error) {
+	r, err := zr.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// topicSums computes checksums of the topic and its messages, subscriptions, etc.
+func topicSums(t *testing.T, adp adapter.Adapter, name string) map[string]*checksum {
+	t.Helper()
+	topic, err := findTopic(adp, name)
+	if err != nil || topic == nil {
+		t.Fatal("findTopic:", name, err)
+	}
+	sums := map[string]*checksum{}
+	for _, kind := range verifyKinds {
+		sums[kind] = &checksum{}
+	}
+	if err = topicChecksums(adp, topic, sums); err != nil {
+		t.Fatal("topicChecksums:", err)
+	}
+	return sums
+}
+
+func TestArchiveTopicRoundTrip(t *testing.T) {
+	adp := testDb(t)
+	data := populate(t, adp)
+	before := topicSums(t, adp, data.topic)
+
+	filename := filepath.Join(t.TempDir(), "topic.zip")
+	exportArchive(data.topic, filename)
+	// Replace the topic with its own copy.
+	importArchive(filename, "", true)
+
+	after := topicSums(t, adp, data.topic)
+	for _, kind := range verifyKinds {
+		if before[kind].count != after[kind].count || before[kind].sum != after[kind].sum {
+			t.Errorf("%s: expected %d records (%s), got %d (%s)", kind, before[kind].count, before[kind],
+				after[kind].count, after[kind])
+		}
+	}
+	if before["revisions"].count != 2 || before["threadreads"].count != 1 {
+		t.Errorf("Test data: expected 2 revisions and 1 thread read marker, got %d and %d",
+			before["revisions"].count, before["threadreads"].count)
+	}
+}
+
+func TestArchiveTopicRemap(t *testing.T) {
+	adp := testDb(t)
+	data := populate(t, adp)
+
+	filename := filepath.Join(t.TempDir(), "topic.zip")
+	exportArchive(data.topic, filename)
+	// Import a copy under a new name next to the original.
+	copyName := genTopicName()
+	importArchive(filename, data.topic+"="+copyName, false)
+
+	revs, err := adp.MessageGetRevisions(copyName, 1)
+	if err != nil || len(revs) != 2 || revs[0].Content != "message 1" || revs[1].Content != "first edit" {
+		t.Errorf("Revisions: expected [message 1, first edit], got %+v (%v)", revs, err)
+	}
+	msgs, err := adp.MessageGetAll(copyName, data.alice, &types.QueryOpt{Since: 1, Before: 2})
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "second edit" {
+		t.Errorf("Message 1: expected 'second edit', got %+v (%v)", msgs, err)
+	}
+	threads, err := adp.ThreadGetAll(copyName, data.bob)
+	if err != nil || len(threads) != 1 || threads[0].Thread != 2 || threads[0].ReadSeqId != 3 {
+		t.Errorf("Threads: expected thread 2 read up to 3, got %+v (%v)", threads, err)
+	}
+
+	// The original is intact.
+	if revs, _ = adp.MessageGetRevisions(data.topic, 1); len(revs) != 2 {
+		t.Errorf("Original revisions: expected 2, got %d", len(revs))
+	}
+}
+
+func TestArchiveUserRemap(t *testing.T) {
+	adp := testDb(t)
+	data := populate(t, adp)
+
+	filename := filepath.Join(t.TempDir(), "user.zip")
+	exportArchive(data.bob.UserId(), filename)
+	// Import Bob as a new user: the subscription and the position in the thread are copied.
+	// The unique login must not clash with the original, so the auth record is dropped first.
+	if _, err := adp.AuthDelAllRecords(data.bob); err != nil {
+		t.Fatal("AuthDelAllRecords:", err)
+	}
+	uid := store.Store.GetUid()
+	importArchive(filename, data.bob.UserId()+"="+uid.UserId(), false)
+
+	sub, err := adp.SubscriptionGet(data.topic, uid, false)
+	if err != nil || sub == nil {
+		t.Fatalf("Subscription of the imported user is missing (%v)", err)
+	}
+	threads, err := adp.ThreadGetAll(data.topic, uid)
+	if err != nil || len(threads) != 1 || threads[0].ReadSeqId != 3 {
+		t.Errorf("Threads: expected thread 2 read up to 3, got %+v (%v)", threads, err)
+	}
+}
@@ -15,16 +15,30 @@ import (
 
 	jcr "github.com/tinode/jsonco"
 	"github.com/volvlabs/towncryer-chat-server/server/auth"
+	_ "github.com/volvlabs/towncryer-chat-server/server/db/memory"
 	_ "github.com/volvlabs/towncryer-chat-server/server/db/mongodb"
 	_ "github.com/volvlabs/towncryer-chat-server/server/db/mysql"
 	_ "github.com/volvlabs/towncryer-chat-server/server/db/postgres"
 	_ "github.com/volvlabs/towncryer-chat-server/server/db/rethinkdb"
+	_ "github.com/volvlabs/towncryer-chat-server/server/db/sqlite"
+	_ "github.com/volvlabs/towncryer-chat-server/server/media/fs"
+	_ "github.com/volvlabs/towncryer-chat-server/server/media/s3"
 	"github.com/volvlabs/towncryer-chat-server/server/store"
 	"github.com/volvlabs/towncryer-chat-server/server/store/types"
 )
 
 type configType struct {
 	StoreConfig json.RawMessage `json:"store_config"`
+	// Optional media handler config, same as in the server config. Needed to export and import
+	// content of the uploaded files.
+	Media *mediaConfig `json:"media"`
+}
+
+type mediaConfig struct {
+	// The name of the handler to use for file uploads.
+	UseHandler string `json:"use_handler"`
+	// Configurations for individual handlers.
+	Handlers map[string]json.RawMessage `json:"handlers"`
 }
 
 type theCard struct {
@@ -192,6 +206,32 @@ func getPassword(n int) string {
 	return string(passwd)
 }
 
+// Read and parse config file, exit on failure.
+func loadConfig(filename string) configType {
+	var config configType
+	if file, err := os.Open(filename); err != nil {
+		log.Fatalln("Failed to read config file:", err)
+	} else {
+		defer file.Close()
+		jr := jcr.New(file)
+		if err = json.NewDecoder(jr).Decode(&config); err != nil {
+			switch jerr := err.(type) {
+			case *json.UnmarshalTypeError:
+				lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
+				log.Fatalf("Unmarshall error in config file in %s at %d:%d (offset %d bytes): %s",
+					jerr.Field, lnum, cnum, jerr.Offset, jerr.Error())
+			case *json.SyntaxError:
+				lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
+				log.Fatalf("Syntax error in config file at %d:%d (offset %d bytes): %s",
+					lnum, cnum, jerr.Offset, jerr.Error())
+			default:
+				log.Fatal("Failed to parse config file: ", err)
+			}
+		}
+	}
+	return config
+}
+
 func main() {
 	reset := flag.Bool("reset", false, "force database reset")
 	upgrade := flag.Bool("upgrade", false, "perform database version upgrade")
@@ -200,6 +240,14 @@ func main() {
 	makeRoot := flag.String("make_root", "", "promote ordinary user to ROOT, auth scheme 'basic'")
 	datafile := flag.String("data", "", "name of file with sample data to load")
 	conffile := flag.String("config", "./tinode.conf", "config of the database connection")
+	migrateFrom := flag.String("migrate", "", "config of the source database to migrate all data from")
+	checkpoint := flag.String("checkpoint", "./migrate.checkpoint", "file to save progress of the migration to")
+	verifyOnly := flag.Bool("verify_only", false, "compare source and destination of the migration, don't copy data")
+	exportName := flag.String("export", "", "user ID or topic name to export to archive")
+	archive := flag.String("archive", "", "name of the archive file to export to, default '<export>.zip'")
+	importFrom := flag.String("import", "", "name of the archive file to import user or topic from")
+	remap := flag.String("remap", "", "comma-separated user IDs and group topic names to replace on import, 'old=new' or 'old' to generate new")
+	replace := flag.Bool("replace", false, "delete existing user or topic before import")
 
 	flag.Parse()
 
@@ -218,26 +266,7 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 	data.datapath, _ = filepath.Split(*datafile)
 
-	var config configType
-	if file, err := os.Open(*conffile); err != nil {
-		log.Fatalln("Failed to read config file:", err)
-	} else {
-		jr := jcr.New(file)
-		if err = json.NewDecoder(jr).Decode(&config); err != nil {
-			switch jerr := err.(type) {
-			case *json.UnmarshalTypeError:
-				lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
-				log.Fatalf("Unmarshall error in config file in %s at %d:%d (offset %d bytes): %s",
-					jerr.Field, lnum, cnum, jerr.Offset, jerr.Error())
-			case *json.SyntaxError:
-				lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
-				log.Fatalf("Syntax error in config file at %d:%d (offset %d bytes): %s",
-					lnum, cnum, jerr.Offset, jerr.Error())
-			default:
-				log.Fatal("Failed to parse config file: ", err)
-			}
-		}
-	}
+	config := loadConfig(*conffile)
 
 	err := store.Store.Open(1, config.StoreConfig)
 	defer store.Store.Close()
@@ -301,7 +330,23 @@ func main() {
 		log.Fatalln("Failure:", err)
 	}
 
-	if *reset || created {
+	if config.Media != nil && config.Media.UseHandler != "" && (*exportName != "" || *importFrom != "") {
+		params := config.Media.Handlers[config.Media.UseHandler]
+		if err = store.Store.UseMediaHandler(config.Media.UseHandler, string(params)); err != nil {
+			log.Fatalf("Failed to init media handler '%s': %s", config.Media.UseHandler, err)
+		}
+	}
+
+	if *migrateFrom != "" {
+		migrate(*migrateFrom, *checkpoint, *verifyOnly)
+	} else if *exportName != "" {
+		if *archive == "" {
+			*archive = *exportName + ".zip"
+		}
+		exportArchive(*exportName, *archive)
+	} else if *importFrom != "" {
+		importArchive(*importFrom, *remap, *replace)
+	} else if *reset || created {
 		genDb(&data)
 	} else if len(data.Users) > 0 {
 		log.Println("Sample data ignored.")
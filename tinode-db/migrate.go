@@ -0,0 +1,1047 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Migration copies all data from the source database to the destination (the database
+// from --config) through the adapter interface, so any two adapters compiled into the
+// binary can be used. The data is copied in stages. Progress is saved to a checkpoint file
+// after each user, topic, or page of records so an interrupted migration can be resumed.
+// Once copying is done, both databases are verified to contain the same data.
+
+const (
+	// Number of records to copy at once.
+	migratePageSize = 100
+	// The adapters limit the number of returned subscriptions, deletion ranges, etc. Raise the
+	// limit high enough to fetch all records of a topic at once.
+	migrateMaxResults = 1 << 20
+)
+
+// Stages of the migration in the order of execution. Files go first because users,
+// topics and messages link to them.
+var migrateStages = []string{"files", "users", "topics", "scheduled", "pcache", "done"}
+
+// migrateCheckpoint is the progress of migration saved to disk.
+type migrateCheckpoint struct {
+	// Stage being migrated.
+	Stage string `json:"stage"`
+	// Key of the last fully migrated record of the stage: user ID, topic name, etc.
+	After string `json:"after,omitempty"`
+	// Topic which is migrated partially and seq ID of its last migrated message.
+	Topic string `json:"topic,omitempty"`
+	SeqId int    `json:"seq,omitempty"`
+}
+
+type migrator struct {
+	src adapter.Adapter
+	dst adapter.Adapter
+
+	cpFile string
+	cp     migrateCheckpoint
+	// True when the migration is resumed and the next record may be partially copied.
+	resumed bool
+}
+
+// migrate copies all data from the database described by the config file srcConfig to the
+// currently open database then verifies that the data is the same.
+func migrate(srcConfig, cpFile string, verifyOnly bool) {
+	config := loadConfig(srcConfig)
+	src, err := store.OpenAdapter(config.StoreConfig)
+	if err != nil {
+		log.Fatalln("Failed to open source database:", err)
+	}
+	defer src.Close()
+
+	if err = src.CheckDbVersion(); err != nil {
+		log.Fatalln("Source database:", err, "Upgrade the source database first.")
+	}
+
+	m := &migrator{src: src, dst: store.Store.GetAdapter(), cpFile: cpFile}
+	log.Printf("Migrating from '%s' to '%s'", src.GetName(), m.dst.GetName())
+
+	src.SetMaxResults(migrateMaxResults)
+	m.dst.SetMaxResults(migrateMaxResults)
+
+	if !verifyOnly {
+		if err = m.loadCheckpoint(); err != nil {
+			log.Fatalln("Failed to read checkpoint:", err)
+		}
+		if m.cp.Stage == "done" {
+			log.Printf("Migration is already completed according to checkpoint '%s'", cpFile)
+		} else if err = m.run(); err != nil {
+			log.Fatalf("Migration failed at stage '%s' after '%s': %s", m.cp.Stage, m.cp.After, err)
+		}
+	}
+
+	if !m.verify() {
+		log.Fatalln("Verification failed: source and destination databases differ.")
+	}
+	log.Println("Verification passed.")
+}
+
+// loadCheckpoint reads saved progress of the migration, if any.
+func (m *migrator) loadCheckpoint() error {
+	data, err := os.ReadFile(m.cpFile)
+	if os.IsNotExist(err) {
+		// Starting from scratch.
+		m.cp = migrateCheckpoint{Stage: migrateStages[0]}
+		// The destination may contain only the data created with the database.
+		users, err := m.dst.UserExport(types.ZeroUid, 1)
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			return fmt.Errorf("destination database is not empty and checkpoint '%s' is not found; "+
+				"use --reset to clear the destination", m.cpFile)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, &m.cp); err != nil {
+		return err
+	}
+	if m.cp.Stage != "done" {
+		log.Printf("Resuming migration at stage '%s' after '%s'", m.cp.Stage, m.cp.After)
+		m.resumed = true
+	}
+	return nil
+}
+
+// saveCheckpoint writes progress of the migration to disk.
+func (m *migrator) saveCheckpoint() error {
+	data, err := json.Marshal(&m.cp)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so the checkpoint is not corrupted by a crash.
+	tmp := m.cpFile + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.cpFile)
+}
+
+// run executes the remaining stages of the migration.
+func (m *migrator) run() error {
+	stages := map[string]func() error{
+		"files":     m.copyFiles,
+		"users":     m.copyUsers,
+		"topics":    m.copyTopics,
+		"scheduled": m.copyScheduled,
+		"pcache":    m.copyPCache,
+	}
+
+	started := false
+	for _, stage := range migrateStages {
+		if stage == m.cp.Stage {
+			started = true
+		}
+		if !started || stage == "done" {
+			continue
+		}
+
+		if m.cp.Stage != stage {
+			m.cp = migrateCheckpoint{Stage: stage}
+		}
+		log.Printf("Migrating %s...", stage)
+		if err := stages[stage](); err != nil {
+			return err
+		}
+		m.resumed = false
+	}
+	if !started {
+		return fmt.Errorf("invalid stage '%s' in checkpoint", m.cp.Stage)
+	}
+
+	m.cp = migrateCheckpoint{Stage: "done"}
+	if err := m.saveCheckpoint(); err != nil {
+		return err
+	}
+	log.Println("Migration completed.")
+	return nil
+}
+
+// copyFiles copies records of uploaded files. Files themselves are not copied: the media
+// handler is independent from the database.
+func (m *migrator) copyFiles() error {
+	for {
+		files, err := m.src.FileExport(m.cp.After, migratePageSize)
+		if err != nil || len(files) == 0 {
+			return err
+		}
+		for i := range files {
+			fd := &files[i]
+			fd.SetUid(types.ParseUid(fd.Id))
+			if m.resumed {
+				if have, err := m.dst.FileGet(fd.Id); err != nil {
+					return err
+				} else if have != nil {
+					continue
+				}
+			}
+			if err = m.dst.FileStartUpload(fd); err != nil {
+				return err
+			}
+		}
+		m.resumed = false
+		m.cp.After = files[len(files)-1].Id
+		if err = m.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+}
+
+// copyUsers copies users with their authentication records, credentials, devices,
+// and subscriptions to 'me' and 'fnd'.
+func (m *migrator) copyUsers() error {
+	count := 0
+	for {
+		users, err := m.src.UserExport(types.ParseUid(m.cp.After), migratePageSize)
+		if err != nil || len(users) == 0 {
+			return err
+		}
+		for i := range users {
+			if err = m.copyUser(&users[i]); err != nil {
+				return fmt.Errorf("user %s: %w", users[i].Id, err)
+			}
+			m.cp.After = users[i].Id
+			if err = m.saveCheckpoint(); err != nil {
+				return err
+			}
+		}
+		count += len(users)
+		log.Printf("  %d users", count)
+	}
+}
+
+func (m *migrator) copyUser(user *types.User) error {
+	uid := types.ParseUid(user.Id)
+	if m.resumed {
+		// The user may be partially copied: start over.
+		if err := m.dst.UserDelete(uid, true); err != nil && err != types.ErrNotFound {
+			return err
+		}
+		m.resumed = false
+	}
+
+	attachments := user.Attachments
+	user.SetUid(uid)
+	user.Attachments = nil
+	// Devices are copied separately.
+	user.Devices = nil
+	user.DeviceArray = nil
+	if err := m.dst.UserCreate(user); err != nil {
+		return err
+	}
+
+	records, err := m.src.AuthExport(uid)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err = m.dst.AuthAddRecord(uid, rec.Scheme, rec.Unique, rec.AuthLvl, rec.Secret, rec.Expires); err != nil {
+			return err
+		}
+	}
+
+	creds, err := m.src.CredGetAll(uid, "", false)
+	if err != nil {
+		return err
+	}
+	// Validated credentials go first: an unvalidated credential may duplicate a validated one of another user.
+	sort.SliceStable(creds, func(i, j int) bool { return creds[i].Done && !creds[j].Done })
+	for i := range creds {
+		if _, err = m.dst.CredUpsert(&creds[i]); err == types.ErrDuplicate {
+			log.Printf("  skipped duplicate credential %s:%s of user %s", creds[i].Method, creds[i].Value, user.Id)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	devices, _, err := m.src.DeviceGetAll(uid)
+	if err != nil {
+		return err
+	}
+	for i := range devices[uid] {
+		if err = m.dst.DeviceUpsert(uid, &devices[uid][i]); err != nil {
+			return err
+		}
+	}
+
+	// Topics 'me' and 'fnd' don't exist in the database, only subscriptions to them.
+	for _, topic := range []string{uid.UserId(), uid.FndName()} {
+		sub, err := m.src.SubscriptionGet(topic, uid, true)
+		if err != nil {
+			return err
+		}
+		if sub != nil {
+			if err = saveSubs(m.dst, []types.Subscription{*sub}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(attachments) > 0 {
+		if err = m.dst.FileLinkAttachments("", uid, types.ZeroUid, attachments); err != nil {
+			return err
+		}
+	}
+
+	return restoreUser(m.dst, user)
+}
+
+// restoreUser restores fields of the user which are not saved on creation and the timestamp
+// changed by subsequent updates.
+func restoreUser(adp adapter.Adapter, user *types.User) error {
+	update := map[string]any{"UpdatedAt": user.UpdatedAt}
+	if user.StateAt != nil {
+		update["StateAt"] = user.StateAt
+	}
+	if user.LastSeen != nil {
+		update["LastSeen"] = user.LastSeen
+		update["UserAgent"] = user.UserAgent
+	}
+	return adp.UserUpdate(user.Uid(), update)
+}
+
+// saveSubs saves subscriptions including their read/recv status and soft-deletion.
+func saveSubs(adp adapter.Adapter, subs []types.Subscription) error {
+	for i := range subs {
+		sub := &subs[i]
+		if err := adp.TopicShare([]*types.Subscription{sub}); err != nil {
+			return err
+		}
+		update := map[string]any{
+			"UpdatedAt": sub.UpdatedAt,
+			"DelId":     sub.DelId,
+			"RecvSeqId": sub.RecvSeqId,
+			"ReadSeqId": sub.ReadSeqId,
+		}
+		if sub.DeletedAt != nil {
+			update["DeletedAt"] = sub.DeletedAt
+		}
+		if err := adp.SubsUpdate(sub.Topic, types.ParseUid(sub.User), update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topicSubs loads all subscriptions to the topic, including deleted and those of channel readers.
+func topicSubs(adp adapter.Adapter, topic *types.Topic) ([]types.Subscription, error) {
+	subs, err := adp.SubsForTopic(topic.Id, true, nil)
+	if err != nil || !topic.UseBt {
+		return subs, err
+	}
+	readers, err := adp.SubsForTopic(types.GrpToChn(topic.Id), true, nil)
+	return append(subs, readers...), err
+}
+
+// copyTopics copies topics with subscriptions, messages, deletion log and reactions.
+func (m *migrator) copyTopics() error {
+	count := 0
+	for {
+		topics, err := m.src.TopicExport(m.cp.After, migratePageSize)
+		if err != nil || len(topics) == 0 {
+			return err
+		}
+		for i := range topics {
+			if err = m.copyTopic(&topics[i]); err != nil {
+				return fmt.Errorf("topic %s: %w", topics[i].Id, err)
+			}
+			m.cp.After, m.cp.Topic, m.cp.SeqId = topics[i].Id, "", 0
+			if err = m.saveCheckpoint(); err != nil {
+				return err
+			}
+		}
+		count += len(topics)
+		log.Printf("  %d topics", count)
+	}
+}
+
+func (m *migrator) copyTopic(topic *types.Topic) error {
+	subs, err := topicSubs(m.src, topic)
+	if err != nil {
+		return err
+	}
+
+	if m.cp.Topic != topic.Id {
+		// The topic may exist if it's created with the database, like 'sys', or partially copied.
+		if have, err := m.dst.TopicGet(topic.Id); err != nil {
+			return err
+		} else if have != nil {
+			if err = m.dst.TopicDelete(topic.Id, have.UseBt, true); err != nil {
+				return err
+			}
+		}
+
+		created := *topic
+		created.Attachments = nil
+		if err = m.dst.TopicCreate(&created); err != nil {
+			return err
+		}
+		if err = saveSubs(m.dst, subs); err != nil {
+			return err
+		}
+
+		m.cp.Topic, m.cp.SeqId = topic.Id, 0
+		if err = m.saveCheckpoint(); err != nil {
+			return err
+		}
+		m.resumed = false
+	}
+
+	if err = m.copyMessages(topic.Id); err != nil {
+		return err
+	}
+
+	users := make([]types.Uid, 0, len(subs))
+	for i := range subs {
+		users = append(users, types.ParseUid(subs[i].User))
+	}
+	if err = m.copyDeletions(topic.Id, users); err != nil {
+		return err
+	}
+
+	reads, err := threadReads(m.src, topic.Id, users)
+	if err != nil {
+		return err
+	}
+	for _, r := range reads {
+		// The value is never decreased, so replaying it again is harmless.
+		if err = m.dst.ThreadReadUpdate(topic.Id, r.User, r.Thread, r.ReadSeqId); err != nil {
+			return err
+		}
+	}
+
+	reactions, err := m.src.ReactionGetAll(topic.Id, nil)
+	if err != nil {
+		return err
+	}
+	for i := range reactions {
+		if err = m.dst.ReactionUpsert(&reactions[i]); err != nil {
+			return err
+		}
+	}
+
+	if len(topic.Attachments) > 0 {
+		if err = m.dst.FileLinkAttachments(topic.Id, types.ZeroUid, types.ZeroUid, topic.Attachments); err != nil {
+			return err
+		}
+	}
+
+	return restoreTopic(m.dst, topic)
+}
+
+// restoreTopic restores fields of the topic which are not saved on creation and the timestamps
+// changed by subsequent updates.
+func restoreTopic(adp adapter.Adapter, topic *types.Topic) error {
+	update := map[string]any{
+		"UpdatedAt": topic.UpdatedAt,
+		"TouchedAt": topic.TouchedAt,
+		"SeqId":     topic.SeqId,
+		"DelId":     topic.DelId,
+	}
+	if topic.StateAt != nil {
+		update["StateAt"] = topic.StateAt
+	}
+	if len(topic.Pinned) > 0 {
+		update["Pinned"] = topic.Pinned
+	}
+	if topic.MsgTTL > 0 {
+		update["MsgTTL"] = topic.MsgTTL
+	}
+	return adp.TopicUpdate(topic.Id, update)
+}
+
+// copyMessages copies messages of the topic. Message IDs are assigned anew.
+func (m *migrator) copyMessages(topic string) error {
+	for {
+		msgs, err := m.src.MessageExport(topic, types.ZeroUid, m.cp.SeqId, migratePageSize)
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+
+		// When resumed, some messages of the page could have been copied already.
+		existing := map[int]*types.Message{}
+		if m.resumed {
+			have, err := m.dst.MessageExport(topic, types.ZeroUid, m.cp.SeqId, len(msgs))
+			if err != nil {
+				return err
+			}
+			for i := range have {
+				existing[have[i].SeqId] = &have[i]
+			}
+			m.resumed = false
+		}
+
+		for i := range msgs {
+			msg := &msgs[i]
+			attachments := msg.Attachments
+			revs, err := revisions(m.src, msg)
+			if err != nil {
+				return err
+			}
+			if have := existing[msg.SeqId]; have != nil {
+				if len(have.Attachments) == 0 && len(attachments) > 0 {
+					if err = m.dst.FileLinkAttachments(have.Topic, types.ZeroUid, types.ParseUid(have.Id), attachments); err != nil {
+						return err
+					}
+				}
+				if have.DelId == 0 && msg.DelId == types.MsgDelIdArchived {
+					if err = archiveStub(m.dst, msg); err != nil {
+						return err
+					}
+				}
+				if len(revs) > 0 {
+					// Some of the edits could have been replayed already.
+					done, err := m.dst.MessageGetRevisions(topic, msg.SeqId)
+					if err != nil {
+						return err
+					}
+					if err = replayEdits(m.dst, msg, revs, len(done)); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if err = saveMessage(m.dst, msg, revs); err != nil {
+				return err
+			}
+		}
+
+		m.cp.SeqId = msgs[len(msgs)-1].SeqId
+		if err = m.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+}
+
+// saveMessage saves the message under a new ID and links its attachments. Deletions are
+// not saved: they are replayed from the deletion log. Stubs of archived messages remain stubs.
+// If the message has earlier revisions, the first revision is saved and then edited.
+func saveMessage(adp adapter.Adapter, msg *types.Message, revs []types.Message) error {
+	attachments := msg.Attachments
+	archived := msg.DelId == types.MsgDelIdArchived
+	saved := *msg
+	saved.DelId = 0
+	saved.DeletedFor = nil
+	saved.DeletedAt = nil
+	saved.Attachments = nil
+	if len(revs) > 0 {
+		saved.Head, saved.Content, saved.PlainText = revs[0].Head, revs[0].Content, ""
+		saved.UpdatedAt = revs[0].CreatedAt
+	}
+	saved.SetUid(store.Store.GetUid())
+	if err := adp.MessageSave(&saved); err != nil {
+		return err
+	}
+	msg.Id = saved.Id
+	if len(attachments) > 0 {
+		if err := adp.FileLinkAttachments(msg.Topic, types.ZeroUid, msg.Uid(), attachments); err != nil {
+			return err
+		}
+	}
+	if archived {
+		return archiveStub(adp, msg)
+	}
+	return replayEdits(adp, msg, revs, 0)
+}
+
+// revisions loads earlier revisions of the message. Only edited live messages have revisions.
+func revisions(adp adapter.Adapter, msg *types.Message) ([]types.Message, error) {
+	if msg.DelId != 0 || !msg.UpdatedAt.After(msg.CreatedAt) {
+		return nil, nil
+	}
+	return adp.MessageGetRevisions(msg.Topic, msg.SeqId)
+}
+
+// replayEdits edits the saved message to recreate its revisions. The saved message has 'done'
+// revisions already: its content is the revision revs[done] or, if all revisions are done, the
+// current content. A revision is timestamped with the time of the version it replaces, so each
+// edit is dated with the time of the next revision.
+func replayEdits(adp adapter.Adapter, msg *types.Message, revs []types.Message, done int) error {
+	if done >= len(revs) {
+		return nil
+	}
+	for i := done + 1; i <= len(revs); i++ {
+		edit := &types.Message{
+			ObjHeader: types.ObjHeader{UpdatedAt: msg.UpdatedAt},
+			Topic:     msg.Topic,
+			SeqId:     msg.SeqId,
+			Head:      msg.Head,
+			Content:   msg.Content,
+			PlainText: msg.PlainText,
+		}
+		if i < len(revs) {
+			edit.UpdatedAt, edit.Head, edit.Content, edit.PlainText = revs[i].CreatedAt, revs[i].Head, revs[i].Content, ""
+		}
+		if err := adp.MessageEdit(edit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveStub turns the saved message into a stub of an archived message. The segment file
+// is linked as an attachment of the stub.
+func archiveStub(adp adapter.Adapter, msg *types.Message) error {
+	return adp.MessageArchive(msg.Topic, types.Range{Low: msg.SeqId, Hi: msg.SeqId + 1}, "", time.Time{})
+}
+
+// deletions loads the log of message deletions in the topic: hard deletions and soft
+// deletions by the given users, ordered by DelId.
+func deletions(adp adapter.Adapter, topic string, users []types.Uid) ([]types.DelMessage, error) {
+	seen := map[string]bool{}
+	var result []types.DelMessage
+	for _, uid := range append([]types.Uid{types.ZeroUid}, users...) {
+		dels, err := adp.MessageGetDeleted(topic, uid, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, del := range dels {
+			key := strconv.Itoa(del.DelId) + ":" + del.DeletedFor
+			if !seen[key] {
+				seen[key] = true
+				result = append(result, del)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].DelId == result[j].DelId {
+			return result[i].DeletedFor < result[j].DeletedFor
+		}
+		return result[i].DelId < result[j].DelId
+	})
+	return result, nil
+}
+
+// copyDeletions replays the log of message deletions. Hard-deleted messages are not copied,
+// but the log is needed by clients to synchronize their caches.
+func (m *migrator) copyDeletions(topic string, users []types.Uid) error {
+	dels, err := deletions(m.src, topic, users)
+	if err != nil || len(dels) == 0 {
+		return err
+	}
+	// Deletions may have been copied already if the migration was interrupted.
+	have, err := deletions(m.dst, topic, users)
+	if err != nil {
+		return err
+	}
+	copied := map[string]bool{}
+	for _, del := range have {
+		copied[strconv.Itoa(del.DelId)+":"+del.DeletedFor] = true
+	}
+
+	for i := range dels {
+		del := &dels[i]
+		if copied[strconv.Itoa(del.DelId)+":"+del.DeletedFor] {
+			continue
+		}
+		del.SetUid(store.Store.GetUid())
+		if err = m.dst.MessageDeleteList(topic, del); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// threadRead is the latest reply in the thread read by the user.
+type threadRead struct {
+	Topic     string    `json:"topic"`
+	User      types.Uid `json:"user"`
+	Thread    int       `json:"thread"`
+	ReadSeqId int       `json:"read"`
+}
+
+// threadReads loads positions of the given users in threads of the topic.
+func threadReads(adp adapter.Adapter, topic string, users []types.Uid) ([]threadRead, error) {
+	var reads []threadRead
+	for _, uid := range users {
+		threads, err := adp.ThreadGetAll(topic, uid)
+		if err != nil {
+			return nil, err
+		}
+		for _, th := range threads {
+			if th.ReadSeqId > 0 {
+				reads = append(reads, threadRead{Topic: topic, User: uid, Thread: th.Thread, ReadSeqId: th.ReadSeqId})
+			}
+		}
+	}
+	return reads, nil
+}
+
+// scheduled loads all pending scheduled messages.
+func scheduled(adp adapter.Adapter) ([]types.ScheduledMessage, error) {
+	return adp.SchedMsgGetDue(time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC), nil, migrateMaxResults)
+}
+
+// copyScheduled copies pending scheduled messages.
+func (m *migrator) copyScheduled() error {
+	msgs, err := scheduled(m.src)
+	if err != nil || len(msgs) == 0 {
+		return err
+	}
+	have, err := scheduled(m.dst)
+	if err != nil {
+		return err
+	}
+	copied := map[string]bool{}
+	for i := range have {
+		copied[have[i].Id] = true
+	}
+
+	for i := range msgs {
+		if copied[msgs[i].Id] {
+			continue
+		}
+		msgs[i].SetUid(types.ParseUid(msgs[i].Id))
+		if err = m.dst.SchedMsgSave(&msgs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyPCache copies persistent cache entries.
+func (m *migrator) copyPCache() error {
+	for {
+		entries, err := m.src.PCacheExport(m.cp.After, migratePageSize)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		for _, entry := range entries {
+			if err = m.dst.PCacheUpsert(entry.Key, entry.Value, false); err != nil {
+				return err
+			}
+		}
+		m.cp.After = entries[len(entries)-1].Key
+		if err = m.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
+}
+
+// Verification.
+
+// Kinds of records compared by verification.
+var verifyKinds = []string{"files", "users", "auth", "credentials", "devices", "topics", "subscriptions",
+	"messages", "revisions", "deletions", "reactions", "threadreads", "scheduled", "pcache"}
+
+// checksum is a count and an order-independent digest of records: a sum of their SHA-256 hashes.
+type checksum struct {
+	count int
+	sum   [4]uint64
+}
+
+// add adds a record described by a list of its normalized fields.
+func (c *checksum) add(fields ...any) {
+	data, _ := json.Marshal(fields)
+	hash := sha256.Sum256(data)
+	var carry uint64
+	for i := 3; i >= 0; i-- {
+		c.sum[i], carry = bits.Add64(c.sum[i], binary.BigEndian.Uint64(hash[i*8:]), carry)
+	}
+	c.count++
+}
+
+func (c *checksum) String() string {
+	return fmt.Sprintf("%016x%016x%016x%016x", c.sum[0], c.sum[1], c.sum[2], c.sum[3])
+}
+
+// verify computes checksums of the source and the destination, prints them and reports
+// if they are the same.
+func (m *migrator) verify() bool {
+	log.Println("Verifying...")
+	srcSums, err := checksums(m.src)
+	if err != nil {
+		log.Fatalln("Failed to read source database:", err)
+	}
+	dstSums, err := checksums(m.dst)
+	if err != nil {
+		log.Fatalln("Failed to read destination database:", err)
+	}
+
+	ok := true
+	for _, kind := range verifyKinds {
+		src, dst := srcSums[kind], dstSums[kind]
+		status := "ok"
+		if src.count != dst.count || src.sum != dst.sum {
+			status = "MISMATCH"
+			ok = false
+		}
+		log.Printf("  %-14s %8d %8d  %s %s", kind, src.count, dst.count, src.String()[:16], status)
+	}
+	return ok
+}
+
+// checksums reads all data from the database and computes checksums of each kind of records.
+func checksums(adp adapter.Adapter) (map[string]*checksum, error) {
+	sums := map[string]*checksum{}
+	for _, kind := range verifyKinds {
+		sums[kind] = &checksum{}
+	}
+
+	for after := ""; ; {
+		files, err := adp.FileExport(after, migratePageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			break
+		}
+		for _, fd := range files {
+			sums["files"].add(fd.Id, normTime(fd.CreatedAt), fd.User, fd.Status, fd.MimeType, fd.Size, fd.Location)
+		}
+		after = files[len(files)-1].Id
+	}
+
+	for after := types.ZeroUid; ; {
+		users, err := adp.UserExport(after, migratePageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) == 0 {
+			break
+		}
+		for i := range users {
+			if err = userChecksums(adp, &users[i], sums); err != nil {
+				return nil, err
+			}
+		}
+		after = types.ParseUid(users[len(users)-1].Id)
+	}
+
+	for after := ""; ; {
+		topics, err := adp.TopicExport(after, migratePageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(topics) == 0 {
+			break
+		}
+		for i := range topics {
+			if err = topicChecksums(adp, &topics[i], sums); err != nil {
+				return nil, err
+			}
+		}
+		after = topics[len(topics)-1].Id
+	}
+
+	sched, err := scheduled(adp)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range sched {
+		sums["scheduled"].add(msg.Id, normTime(msg.CreatedAt), normTime(msg.SendAt), msg.Topic, msg.From,
+			normJSON(msg.Head), normJSON(msg.Content), normStrings(msg.Attachments))
+	}
+
+	for after := ""; ; {
+		entries, err := adp.PCacheExport(after, migratePageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			sums["pcache"].add(entry.Key, entry.Value)
+		}
+		after = entries[len(entries)-1].Key
+	}
+
+	return sums, nil
+}
+
+func userChecksums(adp adapter.Adapter, user *types.User, sums map[string]*checksum) error {
+	uid := types.ParseUid(user.Id)
+	sums["users"].add(user.Id, normTime(user.CreatedAt), normTime(user.UpdatedAt), user.State,
+		normTimePtr(user.StateAt), user.Access, normTimePtr(user.LastSeen), user.UserAgent,
+		normJSON(user.Public), normJSON(user.Trusted), normStrings(user.Tags), normStrings(user.Attachments))
+
+	records, err := adp.AuthExport(uid)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		sums["auth"].add(user.Id, rec.Scheme, rec.Unique, rec.AuthLvl, rec.Secret, normTime(rec.Expires))
+	}
+
+	creds, err := adp.CredGetAll(uid, "", false)
+	if err != nil {
+		return err
+	}
+	for _, cred := range creds {
+		sums["credentials"].add(cred.User, cred.Method, cred.Value, cred.Resp, cred.Done)
+	}
+
+	devices, _, err := adp.DeviceGetAll(uid)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devices[uid] {
+		sums["devices"].add(user.Id, dev.DeviceId, dev.Platform, normTime(dev.LastSeen), dev.Lang)
+	}
+
+	for _, topic := range []string{uid.UserId(), uid.FndName()} {
+		sub, err := adp.SubscriptionGet(topic, uid, true)
+		if err != nil {
+			return err
+		}
+		if sub != nil {
+			subChecksum(sub, sums)
+		}
+	}
+	return nil
+}
+
+func subChecksum(sub *types.Subscription, sums map[string]*checksum) {
+	sums["subscriptions"].add(sub.Topic, sub.User, normTime(sub.CreatedAt), normTime(sub.UpdatedAt),
+		normTimePtr(sub.DeletedAt), sub.DelId, sub.RecvSeqId, sub.ReadSeqId, sub.ModeWant, sub.ModeGiven,
+		normJSON(sub.Private))
+}
+
+func topicChecksums(adp adapter.Adapter, topic *types.Topic, sums map[string]*checksum) error {
+	sums["topics"].add(topic.Id, normTime(topic.CreatedAt), normTime(topic.UpdatedAt), topic.State,
+		normTimePtr(topic.StateAt), normTime(topic.TouchedAt), topic.UseBt, topic.Owner, topic.Access,
+		topic.SeqId, topic.DelId, normJSON(topic.Public), normJSON(topic.Trusted), normStrings(topic.Tags),
+		[]int(topic.Pinned), topic.MsgTTL, normStrings(topic.Attachments))
+
+	subs, err := topicSubs(adp, topic)
+	if err != nil {
+		return err
+	}
+	users := make([]types.Uid, 0, len(subs))
+	for i := range subs {
+		subChecksum(&subs[i], sums)
+		users = append(users, types.ParseUid(subs[i].User))
+	}
+
+	for after := 0; ; {
+		msgs, err := adp.MessageExport(topic.Id, types.ZeroUid, after, migratePageSize)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		for i := range msgs {
+			msg := &msgs[i]
+			sums["messages"].add(msg.Topic, msg.SeqId, normTime(msg.CreatedAt), normTime(msg.UpdatedAt),
+				msg.From, msg.Thread, msg.DelId, normJSON(msg.Head), normJSON(msg.Content), msg.PlainText,
+				normStrings(msg.Attachments))
+
+			revs, err := revisions(adp, msg)
+			if err != nil {
+				return err
+			}
+			for _, rev := range revs {
+				sums["revisions"].add(rev.Topic, rev.SeqId, normTime(rev.CreatedAt), normJSON(rev.Head),
+					normJSON(rev.Content))
+			}
+		}
+		after = msgs[len(msgs)-1].SeqId
+	}
+
+	dels, err := deletions(adp, topic.Id, users)
+	if err != nil {
+		return err
+	}
+	for _, del := range dels {
+		ranges := make([]types.Range, len(del.SeqIdRanges))
+		for i, r := range del.SeqIdRanges {
+			if r.Hi <= r.Low {
+				r.Hi = r.Low + 1
+			}
+			ranges[i] = r
+		}
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i].Low < ranges[j].Low })
+		sums["deletions"].add(topic.Id, del.DelId, del.DeletedFor, ranges)
+	}
+
+	reactions, err := adp.ReactionGetAll(topic.Id, nil)
+	if err != nil {
+		return err
+	}
+	for _, r := range reactions {
+		sums["reactions"].add(r.Topic, r.SeqId, r.User, r.Value)
+	}
+
+	reads, err := threadReads(adp, topic.Id, users)
+	if err != nil {
+		return err
+	}
+	for _, r := range reads {
+		sums["threadreads"].add(topic.Id, r.User.String(), r.Thread, r.ReadSeqId)
+	}
+	return nil
+}
+
+// normTime converts timestamp to a string with the precision supported by all databases.
+func normTime(ts time.Time) string {
+	if ts.IsZero() {
+		return ""
+	}
+	return ts.UTC().Round(time.Millisecond).Format(time.RFC3339Nano)
+}
+
+func normTimePtr(ts *time.Time) string {
+	if ts == nil {
+		return ""
+	}
+	return normTime(*ts)
+}
+
+// normJSON converts a value to its generic JSON form: databases return different types for
+// the same document. Empty values are treated as missing.
+func normJSON(val any) any {
+	if val == nil {
+		return nil
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil
+	}
+	var out any
+	json.Unmarshal(data, &out)
+	switch v := out.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			return nil
+		}
+	case []any:
+		if len(v) == 0 {
+			return nil
+		}
+	}
+	return out
+}
+
+// normStrings sorts a copy of the list, empty list is nil.
+func normStrings(src []string) []string {
+	if len(src) == 0 {
+		return nil
+	}
+	dst := append([]string{}, src...)
+	sort.Strings(dst)
+	return dst
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	adapter "github.com/volvlabs/towncryer-chat-server/server/db"
+	"github.com/volvlabs/towncryer-chat-server/server/db/memory"
+	"github.com/volvlabs/towncryer-chat-server/server/logs"
+	"github.com/volvlabs/towncryer-chat-server/server/store"
+	"github.com/volvlabs/towncryer-chat-server/server/store/types"
+)
+
+// Tests run against the in-memory adapter: the store uses one instance, tests open more as needed.
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	config, _ := json.Marshal(map[string]any{
+		"uid_key":     []byte("la6YsO+bNX/+XIkO"),
+		"use_adapter": "memory",
+	})
+	if err := store.Store.Open(1, config); err != nil {
+		// The adapter registers itself only when built with the 'memory' tag.
+		store.RegisterAdapter(memory.GetTestAdapter())
+		if err = store.Store.Open(1, config); err != nil {
+			log.Fatalln("Failed to open store:", err)
+		}
+	}
+	code := m.Run()
+	store.Store.Close()
+	os.Exit(code)
+}
+
+// testDb returns the store's adapter with all data removed.
+func testDb(t *testing.T) adapter.Adapter {
+	t.Helper()
+	adp := store.Store.GetAdapter()
+	if err := adp.CreateDb(true); err != nil {
+		t.Fatal("CreateDb:", err)
+	}
+	return adp
+}
+
+// openSource opens a separate in-memory database.
+func openSource(t *testing.T) adapter.Adapter {
+	t.Helper()
+	adp := memory.GetTestAdapter()
+	if err := adp.Open(nil); err != nil {
+		t.Fatal("Open:", err)
+	}
+	t.Cleanup(func() { adp.Close() })
+	return adp
+}
+
+// testData describes the records created by populate.
+type testData struct {
+	alice, bob types.Uid
+	topic      string
+}
+
+// populate fills the database with records of every kind: an edited message with revisions,
+// a thread with a read marker, deletions, reactions, scheduled messages and cache entries.
+func populate(t *testing.T, adp adapter.Adapter) *testData {
+	t.Helper()
+	now := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return now.Add(time.Duration(sec) * time.Second) }
+
+	data := &testData{alice: store.Store.GetUid(), bob: store.Store.GetUid(), topic: "grp" + store.Store.GetUidString()}
+	for i, uid := range []types.Uid{data.alice, data.bob} {
+		user := &types.User{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			Access:    types.DefaultAccess{Auth: types.ModeCAuth, Anon: types.ModeNone},
+			Public:    map[string]any{"fn": []string{"Alice", "Bob"}[i]},
+		}
+		user.SetUid(uid)
+		if err := adp.UserCreate(user); err != nil {
+			t.Fatal("UserCreate:", err)
+		}
+		if err := adp.AuthAddRecord(uid, "basic", []string{"alice", "bob"}[i], 20, []byte("secret"), time.Time{}); err != nil {
+			t.Fatal("AuthAddRecord:", err)
+		}
+	}
+
+	topic := &types.Topic{
+		ObjHeader: types.ObjHeader{Id: data.topic, CreatedAt: now, UpdatedAt: now},
+		TouchedAt: now,
+		Owner:     data.alice.String(),
+		Access:    types.DefaultAccess{Auth: types.ModeCPublic, Anon: types.ModeNone},
+		Public:    map[string]any{"fn": "Topic"},
+	}
+	if err := adp.TopicCreate(topic); err != nil {
+		t.Fatal("TopicCreate:", err)
+	}
+	var subs []*types.Subscription
+	for _, uid := range []types.Uid{data.alice, data.bob} {
+		subs = append(subs, &types.Subscription{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			User:      uid.String(),
+			Topic:     data.topic,
+			ModeWant:  types.ModeCFull,
+			ModeGiven: types.ModeCFull,
+		})
+	}
+	if err := adp.TopicShare(subs); err != nil {
+		t.Fatal("TopicShare:", err)
+	}
+
+	// Message 2 starts a thread of replies 3 and 4.
+	var last *types.Message
+	for seq := 1; seq <= 5; seq++ {
+		msg := &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: at(seq), UpdatedAt: at(seq)},
+			SeqId:     seq,
+			Topic:     data.topic,
+			From:      data.alice.String(),
+			Content:   "message " + string(rune('0'+seq)),
+			PlainText: "message " + string(rune('0'+seq)),
+		}
+		if seq == 3 || seq == 4 {
+			msg.Thread = 2
+		}
+		msg.SetUid(store.Store.GetUid())
+		if err := adp.MessageSave(msg); err != nil {
+			t.Fatal("MessageSave:", err)
+		}
+		last = msg
+	}
+	if err := adp.TopicUpdateOnMessage(data.topic, last); err != nil {
+		t.Fatal("TopicUpdateOnMessage:", err)
+	}
+
+	// Two edits of message 1 create two revisions.
+	for i, text := range []string{"first edit", "second edit"} {
+		edit := &types.Message{
+			ObjHeader: types.ObjHeader{UpdatedAt: at(100 + i)},
+			Topic:     data.topic,
+			SeqId:     1,
+			Content:   text,
+			PlainText: text,
+		}
+		if err := adp.MessageEdit(edit); err != nil {
+			t.Fatal("MessageEdit:", err)
+		}
+	}
+
+	if err := adp.ThreadReadUpdate(data.topic, data.bob, 2, 3); err != nil {
+		t.Fatal("ThreadReadUpdate:", err)
+	}
+
+	del := &types.DelMessage{
+		ObjHeader:   types.ObjHeader{CreatedAt: at(200)},
+		Topic:       data.topic,
+		DeletedFor:  data.bob.String(),
+		DelId:       1,
+		SeqIdRanges: []types.Range{{Low: 5}},
+	}
+	del.SetUid(store.Store.GetUid())
+	if err := adp.MessageDeleteList(data.topic, del); err != nil {
+		t.Fatal("MessageDeleteList:", err)
+	}
+
+	if err := adp.ReactionUpsert(&types.Reaction{CreatedAt: at(300), Topic: data.topic, SeqId: 1,
+		User: data.bob.String(), Value: "👍"}); err != nil {
+		t.Fatal("ReactionUpsert:", err)
+	}
+
+	sched := &types.ScheduledMessage{
+		ObjHeader: types.ObjHeader{CreatedAt: at(400), UpdatedAt: at(400)},
+		SendAt:    at(10000),
+		Topic:     data.topic,
+		From:      data.alice.String(),
+		Content:   "later",
+	}
+	sched.SetUid(store.Store.GetUid())
+	if err := adp.SchedMsgSave(sched); err != nil {
+		t.Fatal("SchedMsgSave:", err)
+	}
+
+	if err := adp.PCacheUpsert("test:key", "value", false); err != nil {
+		t.Fatal("PCacheUpsert:", err)
+	}
+	return data
+}
+
+// interruptedAdapter fails MessageEdit once the given number of edits is used up.
+type interruptedAdapter struct {
+	adapter.Adapter
+	edits int
+}
+
+func (a *interruptedAdapter) MessageEdit(msg *types.Message) error {
+	if a.edits <= 0 {
+		return errors.New("interrupted")
+	}
+	a.edits--
+	return a.Adapter.MessageEdit(msg)
+}
+
+func TestMigrate(t *testing.T) {
+	src := openSource(t)
+	dst := testDb(t)
+	data := populate(t, src)
+
+	m := &migrator{src: src, dst: dst, cpFile: filepath.Join(t.TempDir(), "checkpoint")}
+	if err := m.loadCheckpoint(); err != nil {
+		t.Fatal("loadCheckpoint:", err)
+	}
+	if err := m.run(); err != nil {
+		t.Fatal("run:", err)
+	}
+	if !m.verify() {
+		t.Fatal("Verification failed")
+	}
+
+	revs, err := dst.MessageGetRevisions(data.topic, 1)
+	if err != nil || len(revs) != 2 || revs[0].Content != "message 1" || revs[1].Content != "first edit" {
+		t.Errorf("Revisions: expected [message 1, first edit], got %+v (%v)", revs, err)
+	}
+	threads, err := dst.ThreadGetAll(data.topic, data.bob)
+	if err != nil || len(threads) != 1 || threads[0].ReadSeqId != 3 {
+		t.Errorf("Threads: expected thread 2 read up to 3, got %+v (%v)", threads, err)
+	}
+
+	// Thread read markers and revisions are verified.
+	if err = dst.ThreadReadUpdate(data.topic, data.bob, 2, 4); err != nil {
+		t.Fatal("ThreadReadUpdate:", err)
+	}
+	if m.verify() {
+		t.Error("Verification passed with a different thread read marker")
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	src := openSource(t)
+	dst := testDb(t)
+	data := populate(t, src)
+	cpFile := filepath.Join(t.TempDir(), "checkpoint")
+
+	// Message 1 is saved as its first revision and edited twice: interrupt after the first edit.
+	m := &migrator{src: src, dst: &interruptedAdapter{Adapter: dst, edits: 1}, cpFile: cpFile}
+	if err := m.loadCheckpoint(); err != nil {
+		t.Fatal("loadCheckpoint:", err)
+	}
+	if err := m.run(); err == nil {
+		t.Fatal("Interrupted migration must fail")
+	}
+	if m.cp.Stage != "topics" || m.cp.Topic != data.topic {
+		t.Fatalf("Checkpoint: expected stage 'topics' in %s, got %+v", data.topic, m.cp)
+	}
+
+	m = &migrator{src: src, dst: dst, cpFile: cpFile}
+	if err := m.loadCheckpoint(); err != nil {
+		t.Fatal("loadCheckpoint:", err)
+	}
+	if !m.resumed {
+		t.Fatal("Migration is not resumed from checkpoint")
+	}
+	if err := m.run(); err != nil {
+		t.Fatal("run:", err)
+	}
+	if !m.verify() {
+		t.Fatal("Verification failed after resume")
+	}
+	if revs, _ := dst.MessageGetRevisions(data.topic, 1); len(revs) != 2 {
+		t.Errorf("Revisions: expected 2 after resume, got %d", len(revs))
+	}
+
+	// Completed migration is not repeated.
+	m = &migrator{src: src, dst: dst, cpFile: cpFile}
+	if err := m.loadCheckpoint(); err != nil || m.cp.Stage != "done" {
+		t.Errorf("Checkpoint: expected 'done', got %+v (%v)", m.cp, err)
+	}
+}